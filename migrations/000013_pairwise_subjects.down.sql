@@ -0,0 +1 @@
+DROP TABLE pairwise_subjects;
@@ -0,0 +1,12 @@
+CREATE TABLE pairwise_subjects (
+    id BIGSERIAL,
+    client_id character varying(255) NOT NULL,
+    user_id integer NOT NULL,
+    subject character varying(64) NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (id),
+    UNIQUE (subject),
+    UNIQUE (client_id, user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
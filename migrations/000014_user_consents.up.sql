@@ -0,0 +1,12 @@
+CREATE TABLE user_consents (
+    id BIGSERIAL,
+    user_id integer NOT NULL,
+    client_id character varying(255) NOT NULL,
+    scopes text NOT NULL,
+    granted_at timestamp without time zone NOT NULL DEFAULT now(),
+    last_used_at timestamp without time zone,
+
+    PRIMARY KEY (id),
+    UNIQUE (user_id, client_id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
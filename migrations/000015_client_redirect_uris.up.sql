@@ -0,0 +1,13 @@
+CREATE TABLE client_redirect_uris (
+    id BIGSERIAL,
+    client_id character varying(255) NOT NULL,
+    redirect_uri text NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (id),
+    UNIQUE (client_id, redirect_uri)
+);
+
+INSERT INTO client_redirect_uris (client_id, redirect_uri)
+SELECT id, redirect_uri FROM clients
+WHERE id IS NOT NULL AND id <> '' AND redirect_uri IS NOT NULL AND redirect_uri <> '';
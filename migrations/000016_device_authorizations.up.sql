@@ -0,0 +1,18 @@
+CREATE TABLE device_authorizations (
+    id BIGSERIAL,
+    device_code_hash character varying(64) NOT NULL,
+    user_code character varying(16) NOT NULL,
+    client_id character varying(255) NOT NULL,
+    scopes text NOT NULL,
+    status character varying(16) NOT NULL,
+    user_id integer,
+    interval integer NOT NULL,
+    last_polled_at timestamp without time zone,
+    expires_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (id),
+    UNIQUE (device_code_hash),
+    UNIQUE (user_code),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
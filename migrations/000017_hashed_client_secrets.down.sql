@@ -0,0 +1,7 @@
+-- the plaintext secrets cannot be recovered, clients have to rotate after a rollback
+ALTER TABLE clients ADD COLUMN secret character varying NOT NULL DEFAULT '';
+
+ALTER TABLE clients
+    DROP COLUMN secret_hash,
+    DROP COLUMN previous_secret_hash,
+    DROP COLUMN previous_secret_expires_at;
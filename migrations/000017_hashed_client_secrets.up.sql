@@ -0,0 +1,11 @@
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+
+ALTER TABLE clients
+    ADD COLUMN secret_hash character varying(60) NOT NULL DEFAULT '',
+    ADD COLUMN previous_secret_hash character varying(60) NOT NULL DEFAULT '',
+    ADD COLUMN previous_secret_expires_at timestamp without time zone;
+
+-- pgcrypto's blowfish crypt produces the same $2a$ hashes golang.org/x/crypto/bcrypt verifies
+UPDATE clients SET secret_hash = crypt(secret, gen_salt('bf', 10)) WHERE secret <> '';
+
+ALTER TABLE clients DROP COLUMN secret;
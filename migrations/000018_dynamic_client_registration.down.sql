@@ -0,0 +1,5 @@
+ALTER TABLE clients
+    DROP COLUMN logo_uri,
+    DROP COLUMN contacts,
+    DROP COLUMN grant_types,
+    DROP COLUMN registration_access_token_hash;
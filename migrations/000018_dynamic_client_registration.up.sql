@@ -0,0 +1,5 @@
+ALTER TABLE clients
+    ADD COLUMN logo_uri text NOT NULL DEFAULT '',
+    ADD COLUMN contacts text NOT NULL DEFAULT '',
+    ADD COLUMN grant_types text NOT NULL DEFAULT '',
+    ADD COLUMN registration_access_token_hash character varying(64) NOT NULL DEFAULT '';
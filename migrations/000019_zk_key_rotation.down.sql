@@ -0,0 +1,3 @@
+ALTER TABLE zk_snarks_key_pairs
+    DROP COLUMN created_at,
+    DROP COLUMN retired_at;
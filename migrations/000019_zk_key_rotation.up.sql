@@ -0,0 +1,3 @@
+ALTER TABLE zk_snarks_key_pairs
+    ADD COLUMN created_at timestamp without time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    ADD COLUMN retired_at timestamp without time zone;
@@ -0,0 +1,2 @@
+ALTER TABLE zk_snarks_key_pairs
+    DROP COLUMN transcript_hash;
@@ -0,0 +1,2 @@
+ALTER TABLE zk_snarks_key_pairs
+    ADD COLUMN transcript_hash VARCHAR(64);
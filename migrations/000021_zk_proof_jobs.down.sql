@@ -0,0 +1 @@
+DROP TABLE zk_proof_jobs;
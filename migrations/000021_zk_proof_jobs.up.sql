@@ -0,0 +1,19 @@
+CREATE TABLE zk_proof_jobs (
+    id BIGSERIAL,
+    user_id integer NOT NULL,
+    attribute character varying(16) NOT NULL,
+    input text NOT NULL,
+    verification_code character varying(16) NOT NULL,
+    status character varying(16) NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    error text NOT NULL DEFAULT '',
+    zk_key_pair_id integer,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    started_at timestamp without time zone,
+    finished_at timestamp without time zone,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX zk_proof_jobs_status_idx ON zk_proof_jobs (status, id);
@@ -0,0 +1,4 @@
+DROP TABLE email_domain_proofs;
+
+ALTER TABLE zk_snarks_key_pairs
+    DROP COLUMN circuit;
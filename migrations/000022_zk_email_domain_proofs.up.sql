@@ -0,0 +1,18 @@
+ALTER TABLE zk_snarks_key_pairs
+    ADD COLUMN circuit VARCHAR(32) NOT NULL DEFAULT 'verification_code';
+
+CREATE TABLE email_domain_proofs (
+    id SERIAL,
+    user_id integer NOT NULL,
+    domain_set character varying(64) NOT NULL,
+    domain character varying(255),
+    domain_set_root character varying(64) NOT NULL,
+    zk_proof bytea NOT NULL,
+    zk_key_pair_id integer NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (id),
+    UNIQUE (user_id, domain_set),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (zk_key_pair_id) REFERENCES zk_snarks_key_pairs(id)
+);
@@ -0,0 +1 @@
+DROP TABLE scram_sessions;
@@ -0,0 +1,14 @@
+CREATE TABLE scram_sessions (
+    id BIGSERIAL,
+    principal character varying(16) NOT NULL,
+    username character varying(255) NOT NULL,
+    c_nonce text NOT NULL,
+    nonce text NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (id),
+    UNIQUE (nonce)
+);
+
+CREATE INDEX scram_sessions_expires_at_idx ON scram_sessions (expires_at);
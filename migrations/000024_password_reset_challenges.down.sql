@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN sessions_revoked_at;
+
+DROP TABLE password_reset_challenges;
@@ -0,0 +1,14 @@
+CREATE TABLE password_reset_challenges (
+    id BIGSERIAL,
+    username character varying(255) NOT NULL,
+    challenge text NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (id),
+    UNIQUE (challenge)
+);
+
+CREATE INDEX password_reset_challenges_expires_at_idx ON password_reset_challenges (expires_at);
+
+ALTER TABLE users ADD COLUMN sessions_revoked_at timestamp without time zone;
@@ -0,0 +1 @@
+DROP TABLE security_events;
@@ -0,0 +1,13 @@
+CREATE TABLE security_events (
+    id BIGSERIAL,
+    type character varying(64) NOT NULL,
+    principal character varying(16) NOT NULL,
+    subject character varying(255) NOT NULL,
+    source character varying(255) NOT NULL,
+    details jsonb NOT NULL DEFAULT '{}',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX security_events_principal_subject_idx ON security_events (principal, subject, created_at);
@@ -0,0 +1,9 @@
+CREATE TABLE login_attempts (
+    key text NOT NULL,
+    failures integer NOT NULL,
+    last_failure_at timestamp without time zone NOT NULL,
+
+    PRIMARY KEY (key)
+);
+
+CREATE INDEX login_attempts_last_failure_at_idx ON login_attempts (last_failure_at);
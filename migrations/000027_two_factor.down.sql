@@ -0,0 +1,4 @@
+ALTER TABLE clients DROP COLUMN require_user_two_factor;
+
+DROP TABLE two_factor_recovery_codes;
+DROP TABLE two_factor_credentials;
@@ -0,0 +1,25 @@
+CREATE TABLE two_factor_credentials (
+    id BIGSERIAL,
+    principal character varying(16) NOT NULL,
+    username character varying(255) NOT NULL,
+    encrypted_secret text NOT NULL,
+    last_used_step bigint NOT NULL DEFAULT 0,
+    confirmed_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (id),
+    UNIQUE (principal, username)
+);
+
+CREATE TABLE two_factor_recovery_codes (
+    id BIGSERIAL,
+    credential_id bigint NOT NULL,
+    code_hash character varying(64) NOT NULL,
+    used_at timestamp without time zone,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (credential_id) REFERENCES two_factor_credentials(id) ON DELETE CASCADE,
+    UNIQUE (credential_id, code_hash)
+);
+
+ALTER TABLE clients ADD COLUMN require_user_two_factor boolean NOT NULL DEFAULT false;
@@ -0,0 +1,32 @@
+CREATE TABLE passkeys (
+    id BIGSERIAL,
+    user_id bigint NOT NULL,
+    name character varying(255) NOT NULL DEFAULT '',
+    credential_id text NOT NULL,
+    public_key bytea NOT NULL,
+    sign_count bigint NOT NULL DEFAULT 0,
+    attestation_format character varying(32) NOT NULL,
+    aaguid character varying(32) NOT NULL DEFAULT '',
+    last_used_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE (credential_id)
+);
+
+CREATE INDEX passkeys_user_id_idx ON passkeys (user_id);
+
+CREATE TABLE webauthn_challenges (
+    id BIGSERIAL,
+    ceremony character varying(16) NOT NULL,
+    challenge text NOT NULL,
+    user_id bigint,
+    expires_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (id),
+    UNIQUE (challenge)
+);
+
+CREATE INDEX webauthn_challenges_expires_at_idx ON webauthn_challenges (expires_at);
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN sessions_revoked_at timestamp without time zone;
+
+DROP TABLE sessions;
@@ -0,0 +1,27 @@
+-- user_id is set on sessions of the user portal and of apps acting for a
+-- user, client_id on sessions of the client portal and of apps. Tokens
+-- issued before this migration carry no session and must log in again.
+CREATE TABLE sessions (
+    id BIGSERIAL,
+    jti character varying(36) NOT NULL,
+    principal character varying(16) NOT NULL,
+    user_id bigint,
+    client_id character varying(36),
+    device_label character varying(255) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    last_seen_at timestamp without time zone NOT NULL DEFAULT now(),
+    expires_at timestamp without time zone NOT NULL,
+    revoked_at timestamp without time zone,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (client_id) REFERENCES clients(id) ON DELETE CASCADE,
+    UNIQUE (jti)
+);
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+CREATE INDEX sessions_client_id_idx ON sessions (client_id);
+CREATE INDEX sessions_expires_at_idx ON sessions (expires_at);
+
+-- a password reset revokes the sessions of the user instead
+ALTER TABLE users DROP COLUMN sessions_revoked_at;
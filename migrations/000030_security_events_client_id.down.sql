@@ -0,0 +1,6 @@
+DROP RULE security_events_no_update ON security_events;
+
+DROP INDEX security_events_created_at_idx;
+DROP INDEX security_events_client_id_idx;
+
+ALTER TABLE security_events DROP COLUMN client_id;
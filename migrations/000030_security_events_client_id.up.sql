@@ -0,0 +1,11 @@
+-- client_id names the client an event involves, so that clients can query
+-- the events of their users too, e.g. which of them they read the metadata
+-- of. It is empty on events that involve no client.
+ALTER TABLE security_events ADD COLUMN client_id character varying(36) NOT NULL DEFAULT '';
+
+CREATE INDEX security_events_client_id_idx ON security_events (client_id, created_at);
+CREATE INDEX security_events_created_at_idx ON security_events (created_at);
+
+-- the audit trail is append-only: events are only deleted once they are
+-- older than the retention period
+CREATE RULE security_events_no_update AS ON UPDATE TO security_events DO INSTEAD NOTHING;
@@ -0,0 +1,2 @@
+DROP TABLE data_access_digests;
+DROP TABLE data_access_records;
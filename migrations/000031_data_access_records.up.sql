@@ -0,0 +1,27 @@
+-- every release of user metadata to a client, shown to the user as a
+-- timeline. client_id has no foreign key: the history outlives the client.
+CREATE TABLE data_access_records (
+    id BIGSERIAL,
+    user_id bigint NOT NULL,
+    client_id character varying(36) NOT NULL,
+    scopes text NOT NULL,
+    fields text NOT NULL,
+    accessed_at timestamp without time zone NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX data_access_records_user_id_idx ON data_access_records (user_id, accessed_at);
+
+-- users who asked for a digest of the releases by email. The address is
+-- the one the user verified, it is only kept while the digest is on.
+CREATE TABLE data_access_digests (
+    user_id bigint NOT NULL,
+    email character varying(255) NOT NULL,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    last_sent_at timestamp without time zone,
+
+    PRIMARY KEY (user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,10 @@
+-- authorization codes are self-contained tokens, a redeemed code is recorded
+-- by its jti so that it cannot be redeemed again before it expires
+CREATE TABLE used_authorization_codes (
+    jti character varying(64) NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+
+    PRIMARY KEY (jti)
+);
+
+CREATE INDEX used_authorization_codes_expires_at_idx ON used_authorization_codes (expires_at);
@@ -0,0 +1,3 @@
+ALTER TABLE user_metadata
+    DROP COLUMN IF EXISTS email_reprove_by,
+    DROP COLUMN IF EXISTS phone_number_reprove_by;
@@ -0,0 +1,5 @@
+-- set while an attribute was proven with a superseded zk key pair: the
+-- attribute stays verified until then and is reset unless proven again
+ALTER TABLE user_metadata
+    ADD COLUMN email_reprove_by timestamp without time zone,
+    ADD COLUMN phone_number_reprove_by timestamp without time zone;
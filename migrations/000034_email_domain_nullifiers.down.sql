@@ -0,0 +1,9 @@
+DELETE FROM email_domain_proofs;
+
+ALTER TABLE email_domain_proofs
+    DROP CONSTRAINT email_domain_proofs_user_id_client_id_domain_set_key,
+    DROP COLUMN client_id,
+    DROP COLUMN nullifier,
+    ADD UNIQUE (user_id, domain_set);
+
+DROP TABLE user_email_domains;
@@ -0,0 +1,29 @@
+-- the domain of a user's verified email address and the secret key of the
+-- nullifiers of its proofs, which are made per client when first released
+CREATE TABLE user_email_domains (
+    user_id integer NOT NULL,
+    domain character varying(255) NOT NULL,
+    nullifier_key bytea NOT NULL,
+
+    PRIMARY KEY (user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+INSERT INTO user_email_domains (user_id, domain, nullifier_key)
+SELECT user_id, domain, gen_random_bytes(32)
+FROM email_domain_proofs
+WHERE domain IS NOT NULL;
+
+-- the proofs made with the salt and verification code as public inputs
+DELETE FROM email_domain_proofs;
+
+ALTER TABLE email_domain_proofs
+    DROP CONSTRAINT email_domain_proofs_user_id_domain_set_key,
+    ADD COLUMN client_id character varying(255) NOT NULL,
+    ADD COLUMN nullifier character varying(64) NOT NULL,
+    ADD UNIQUE (user_id, client_id, domain_set);
+
+-- the keys of the previous circuit cannot verify the new proofs
+UPDATE zk_snarks_key_pairs
+SET retired_at = now()
+WHERE circuit = 'email_domain' AND retired_at IS NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE data_access_digests
+    DROP COLUMN IF EXISTS claimed_at;
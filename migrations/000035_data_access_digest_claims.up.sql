@@ -0,0 +1,3 @@
+-- set while an instance is sending the digest, so that it is sent once
+ALTER TABLE data_access_digests
+    ADD COLUMN claimed_at timestamp without time zone;
@@ -0,0 +1,7 @@
+DELETE FROM email_domain_proofs;
+
+ALTER TABLE email_domain_proofs
+    DROP COLUMN domain_commitment;
+
+ALTER TABLE user_email_domains
+    DROP COLUMN domain_commitment;
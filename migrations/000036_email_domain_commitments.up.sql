@@ -0,0 +1,15 @@
+-- the domains were not committed to by the proofs of the email verification,
+-- they are kept again once the address is proved with the new circuit
+DELETE FROM email_domain_proofs;
+DELETE FROM user_email_domains;
+
+ALTER TABLE user_email_domains
+    ADD COLUMN domain_commitment character varying(64) NOT NULL;
+
+ALTER TABLE email_domain_proofs
+    ADD COLUMN domain_commitment character varying(64) NOT NULL;
+
+-- the keys of the previous circuit cannot verify the new proofs
+UPDATE zk_snarks_key_pairs
+SET retired_at = now()
+WHERE circuit = 'email_domain' AND retired_at IS NULL;
@@ -0,0 +1,71 @@
+// Runs the browser side of the passkey ceremonies: the server sends the
+// options with binary values base64url encoded, the browser wants them as
+// buffers, and the credential goes back base64url encoded again.
+window.passkey = (() => {
+  const toBuffer = (value) => {
+    const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+    const padded = base64 + "=".repeat((4 - (base64.length % 4)) % 4);
+    return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0)).buffer;
+  };
+
+  const toBase64URL = (buffer) => {
+    if (!buffer) {
+      return "";
+    }
+    return btoa(String.fromCharCode(...new Uint8Array(buffer)))
+      .replace(/\+/g, "-")
+      .replace(/\//g, "_")
+      .replace(/=+$/, "");
+  };
+
+  const descriptors = (credentials) =>
+    (credentials || []).map((credential) => ({ ...credential, id: toBuffer(credential.id) }));
+
+  const supported = () => window.PublicKeyCredential !== undefined;
+
+  // create registers a new passkey for the creation options of the server
+  const create = async (options) => {
+    const credential = await navigator.credentials.create({
+      publicKey: {
+        ...options,
+        challenge: toBuffer(options.challenge),
+        user: { ...options.user, id: toBuffer(options.user.id) },
+        excludeCredentials: descriptors(options.excludeCredentials),
+      },
+    });
+
+    return {
+      id: credential.id,
+      type: credential.type,
+      response: {
+        clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+        attestationObject: toBase64URL(credential.response.attestationObject),
+      },
+    };
+  };
+
+  // get signs the challenge of the request options of the server with any
+  // passkey of the relying party the user picks
+  const get = async (options) => {
+    const credential = await navigator.credentials.get({
+      publicKey: {
+        ...options,
+        challenge: toBuffer(options.challenge),
+        allowCredentials: descriptors(options.allowCredentials),
+      },
+    });
+
+    return {
+      id: credential.id,
+      type: credential.type,
+      response: {
+        clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+        authenticatorData: toBase64URL(credential.response.authenticatorData),
+        signature: toBase64URL(credential.response.signature),
+        userHandle: toBase64URL(credential.response.userHandle),
+      },
+    };
+  };
+
+  return { supported, create, get };
+})();
@@ -0,0 +1,28 @@
+// Solves the proof of work challenges the login endpoints issue after too
+// many failed attempts: a solution is "challenge:nonce" whose SHA-256 digest
+// starts with `difficulty` zero bits.
+window.proofOfWork = (() => {
+  const leadingZeroBits = (digest) => {
+    let zeros = 0;
+    for (const byte of digest) {
+      if (byte !== 0) {
+        return zeros + Math.clz32(byte) - 24;
+      }
+      zeros += 8;
+    }
+    return zeros;
+  };
+
+  const solve = async (challenge, difficulty) => {
+    const encoder = new TextEncoder();
+    for (let nonce = 0; ; nonce++) {
+      const solution = `${challenge}:${nonce}`;
+      const digest = await window.crypto.subtle.digest("SHA-256", encoder.encode(solution));
+      if (leadingZeroBits(new Uint8Array(digest)) >= difficulty) {
+        return solution;
+      }
+    }
+  };
+
+  return { solve };
+})();
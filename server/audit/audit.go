@@ -0,0 +1,220 @@
+// Package audit records security relevant events, such as login lockouts,
+// to the security audit trail shared by the resource server and the
+// authorization server.
+package audit
+
+import (
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Event types
+const (
+	// EventLoginLocked is recorded when failed logins lock an account, a
+	// source address or the pair of both.
+	EventLoginLocked = "login.locked"
+	// EventLoginSucceeded and EventLoginFailed are recorded for logins to
+	// the OAuth portal and to the user and client portals.
+	EventLoginSucceeded = "login.succeeded"
+	EventLoginFailed    = "login.failed"
+	// EventPasswordReset is recorded when a user resets the password.
+	EventPasswordReset = "password.reset"
+	// EventCertificateUploaded is recorded when a client uploads the x.509
+	// certificate of its service provider.
+	EventCertificateUploaded = "certificate.uploaded"
+	// EventConsentGranted and EventConsentRevoked are recorded when a user
+	// approves the scopes of a client or revokes its access.
+	EventConsentGranted = "consent.granted"
+	EventConsentRevoked = "consent.revoked"
+	// EventTokenIssued is recorded when a client is issued an access token
+	// for a user.
+	EventTokenIssued = "token.issued"
+	// EventMetadataAccessed is recorded when a client reads the metadata of
+	// a user, the details name the scopes it was read with.
+	EventMetadataAccessed = "metadata.accessed"
+)
+
+// Event is a single entry of the audit trail. Principal and Subject name the
+// account the event is about, e.g. "user" and its username, and Source is the
+// address the triggering request came from. ClientID is set on events that
+// involve a client, such as a client reading the metadata of a user.
+type Event struct {
+	Type      string            `json:"type"`
+	Principal string            `json:"principal"`
+	Subject   string            `json:"subject"`
+	ClientID  string            `json:"client_id,omitempty"`
+	Source    string            `json:"source"`
+	Details   map[string]string `json:"details"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// Sink stores audit events.
+type Sink interface {
+	Record(event Event) error
+}
+
+// Store is a Sink that can also be queried and pruned. Events are never
+// changed once recorded, they are only deleted when they are older than the
+// retention period.
+type Store interface {
+	Sink
+	// Events returns the events matching the filter, newest first.
+	Events(filter Filter) ([]Event, error)
+	// DeleteBefore deletes the events recorded before the time and returns
+	// how many were deleted.
+	DeleteBefore(before time.Time) (int64, error)
+}
+
+// Filter selects the events of an account: those about the account named by
+// Principal and Subject and, if ClientID is set, those involving the client.
+// Types, Since and Until narrow the selection further when they are set.
+type Filter struct {
+	Principal string
+	Subject   string
+	ClientID  string
+	Types     []string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+func (f Filter) matches(event Event) bool {
+	isAccount := event.Principal == f.Principal && event.Subject == f.Subject
+	isClient := f.ClientID != "" && event.ClientID == f.ClientID
+	if !isAccount && !isClient {
+		return false
+	}
+
+	if len(f.Types) > 0 {
+		found := false
+		for _, eventType := range f.Types {
+			if event.Type == eventType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if !f.Since.IsZero() && event.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !event.CreatedAt.Before(f.Until) {
+		return false
+	}
+
+	return true
+}
+
+// withDefaults fills in the details and time of an event being recorded.
+func withDefaults(event Event) Event {
+	if event.Details == nil {
+		event.Details = map[string]string{}
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now().UTC()
+	}
+	return event
+}
+
+// securityEvent is how an Event is stored by PostgresSink.
+type securityEvent struct {
+	ID        uint      `gorm:"primaryKey; autoIncrement; not null"`
+	Type      string    `gorm:"column:type; not null"`
+	Principal string    `gorm:"column:principal; not null"`
+	Subject   string    `gorm:"column:subject; not null"`
+	ClientID  string    `gorm:"column:client_id; not null"`
+	Source    string    `gorm:"column:source; not null"`
+	Details   string    `gorm:"column:details; not null"`
+	CreatedAt time.Time `gorm:"column:created_at; not null"`
+}
+
+func (securityEvent) TableName() string {
+	return "security_events"
+}
+
+// PostgresSink stores audit events in the security_events table.
+type PostgresSink struct {
+	db *gorm.DB
+}
+
+func NewPostgresSink(db *gorm.DB) *PostgresSink {
+	return &PostgresSink{db: db}
+}
+
+func (s *PostgresSink) Record(event Event) error {
+	event = withDefaults(event)
+
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Create(&securityEvent{
+		Type:      event.Type,
+		Principal: event.Principal,
+		Subject:   event.Subject,
+		ClientID:  event.ClientID,
+		Source:    event.Source,
+		Details:   string(details),
+		CreatedAt: event.CreatedAt,
+	}).Error
+}
+
+func (s *PostgresSink) Events(filter Filter) ([]Event, error) {
+	query := s.db.Model(&securityEvent{})
+	if filter.ClientID != "" {
+		query = query.Where(
+			"(principal = ? AND subject = ?) OR client_id = ?", filter.Principal, filter.Subject, filter.ClientID,
+		)
+	} else {
+		query = query.Where("principal = ? AND subject = ?", filter.Principal, filter.Subject)
+	}
+	if len(filter.Types) > 0 {
+		query = query.Where("type IN ?", filter.Types)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at < ?", filter.Until)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	var rows []securityEvent
+	err := query.Order("created_at DESC, id DESC").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]Event, 0, len(rows))
+	for _, row := range rows {
+		details := map[string]string{}
+		if err := json.Unmarshal([]byte(row.Details), &details); err != nil {
+			return nil, err
+		}
+
+		events = append(events, Event{
+			Type:      row.Type,
+			Principal: row.Principal,
+			Subject:   row.Subject,
+			ClientID:  row.ClientID,
+			Source:    row.Source,
+			Details:   details,
+			CreatedAt: row.CreatedAt,
+		})
+	}
+
+	return events, nil
+}
+
+func (s *PostgresSink) DeleteBefore(before time.Time) (int64, error) {
+	result := s.db.Where("created_at < ?", before).Delete(&securityEvent{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,196 @@
+package audit
+
+import (
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestPostgresSink_Record(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal("Failed to create mock DB:", err)
+	}
+
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: mockDB}), &gorm.Config{})
+	if err != nil {
+		t.Fatal("Failed to connect to mock DB:", err)
+	}
+
+	createdAt := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`INSERT INTO "security_events" ("type","principal","subject","client_id","source","details","created_at") `+
+			`VALUES ($1,$2,$3,$4,$5,$6,$7) RETURNING "id"`,
+	)).WithArgs(
+		EventLoginLocked, "user", "alice", "", "10.0.0.1", `{"counter":"account"}`, createdAt,
+	).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	err = NewPostgresSink(db).Record(Event{
+		Type:      EventLoginLocked,
+		Principal: "user",
+		Subject:   "alice",
+		Source:    "10.0.0.1",
+		Details:   map[string]string{"counter": "account"},
+		CreatedAt: createdAt,
+	})
+
+	assert.Nil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func newMockDB(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal("Failed to create mock DB:", err)
+	}
+
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: mockDB}), &gorm.Config{})
+	if err != nil {
+		t.Fatal("Failed to connect to mock DB:", err)
+	}
+
+	return db, mock
+}
+
+func TestPostgresSink_Events(t *testing.T) {
+	db, mock := newMockDB(t)
+
+	since := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	createdAt := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "security_events" WHERE ((principal = $1 AND subject = $2) OR client_id = $3) `+
+			`AND type IN ($4,$5) AND created_at >= $6 ORDER BY created_at DESC, id DESC LIMIT $7`,
+	)).WithArgs(
+		"client", "acme", "client-1", EventLoginFailed, EventMetadataAccessed, since, 10,
+	).WillReturnRows(sqlmock.NewRows(
+		[]string{"id", "type", "principal", "subject", "client_id", "source", "details", "created_at"},
+	).AddRow(
+		2, EventMetadataAccessed, "user", "alice", "client-1", "10.0.0.2", `{"scopes":"read:user"}`, createdAt,
+	))
+
+	events, err := NewPostgresSink(db).Events(Filter{
+		Principal: "client",
+		Subject:   "acme",
+		ClientID:  "client-1",
+		Types:     []string{EventLoginFailed, EventMetadataAccessed},
+		Since:     since,
+		Limit:     10,
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []Event{{
+		Type:      EventMetadataAccessed,
+		Principal: "user",
+		Subject:   "alice",
+		ClientID:  "client-1",
+		Source:    "10.0.0.2",
+		Details:   map[string]string{"scopes": "read:user"},
+		CreatedAt: createdAt,
+	}}, events)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPostgresSink_DeleteBefore(t *testing.T) {
+	db, mock := newMockDB(t)
+
+	before := time.Date(2025, 10, 19, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "security_events" WHERE created_at < $1`)).
+		WithArgs(before).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	deleted, err := NewPostgresSink(db).DeleteBefore(before)
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), deleted)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestJSONLinesSink_RecordAndQuery(t *testing.T) {
+	sink := NewJSONLinesSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+
+	// a file that does not exist yet has no events
+	events, err := sink.Events(Filter{Principal: "user", Subject: "alice"})
+	assert.Nil(t, err)
+	assert.Empty(t, events)
+
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 12, 0, 0, 0, time.UTC) }
+	recorded := []Event{
+		{Type: EventLoginSucceeded, Principal: "user", Subject: "alice", CreatedAt: day(1)},
+		{Type: EventLoginFailed, Principal: "user", Subject: "bob", CreatedAt: day(2)},
+		{Type: EventMetadataAccessed, Principal: "user", Subject: "alice", ClientID: "client-1", CreatedAt: day(3)},
+		{Type: EventLoginSucceeded, Principal: "client", Subject: "acme", CreatedAt: day(4)},
+	}
+	for _, event := range recorded {
+		assert.Nil(t, sink.Record(event))
+	}
+
+	events, err = sink.Events(Filter{Principal: "user", Subject: "alice"})
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, EventMetadataAccessed, events[0].Type)
+	assert.Equal(t, map[string]string{}, events[0].Details)
+	assert.Equal(t, EventLoginSucceeded, events[1].Type)
+
+	events, err = sink.Events(Filter{Principal: "client", Subject: "acme", ClientID: "client-1"})
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, "acme", events[0].Subject)
+	assert.Equal(t, "client-1", events[1].ClientID)
+
+	events, err = sink.Events(Filter{
+		Principal: "user", Subject: "alice", Types: []string{EventLoginSucceeded}, Until: day(3),
+	})
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+
+	events, err = sink.Events(Filter{Principal: "user", Subject: "alice", Since: day(2), Limit: 1})
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, day(3), events[0].CreatedAt)
+}
+
+func TestJSONLinesSink_DeleteBefore(t *testing.T) {
+	sink := NewJSONLinesSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 12, 0, 0, 0, time.UTC) }
+	for d := 1; d <= 3; d++ {
+		assert.Nil(t, sink.Record(Event{Type: EventLoginSucceeded, Principal: "user", Subject: "alice", CreatedAt: day(d)}))
+	}
+
+	deleted, err := sink.DeleteBefore(day(3))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), deleted)
+
+	events, err := sink.Events(Filter{Principal: "user", Subject: "alice"})
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, day(3), events[0].CreatedAt)
+
+	// events recorded after the pruning are appended to the rewritten file
+	assert.Nil(t, sink.Record(Event{Type: EventLoginFailed, Principal: "user", Subject: "alice", CreatedAt: day(4)}))
+	events, err = sink.Events(Filter{Principal: "user", Subject: "alice"})
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+}
@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxJSONLineSize bounds a single event of a JSON lines file.
+const maxJSONLineSize = 1 << 20
+
+// JSONLinesSink appends audit events to a file, one JSON object per line,
+// for deployments that ship their logs elsewhere. Queries scan the whole
+// file, so it suits small installations.
+type JSONLinesSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewJSONLinesSink(path string) *JSONLinesSink {
+	return &JSONLinesSink{path: path}
+}
+
+func (s *JSONLinesSink) Record(event Event) error {
+	line, err := json.Marshal(withDefaults(event))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *JSONLinesSink) Events(filter Filter) ([]Event, error) {
+	s.mu.Lock()
+	events, err := s.readAll()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	matching := []Event{}
+	for _, event := range events {
+		if filter.matches(event) {
+			matching = append(matching, event)
+		}
+	}
+
+	sort.SliceStable(matching, func(i, j int) bool {
+		return matching[i].CreatedAt.After(matching[j].CreatedAt)
+	})
+
+	if filter.Limit > 0 && len(matching) > filter.Limit {
+		matching = matching[:filter.Limit]
+	}
+	return matching, nil
+}
+
+// DeleteBefore rewrites the file without the events recorded before the
+// time. The new file replaces the old one by a rename, so a crash leaves one
+// of them intact.
+func (s *JSONLinesSink) DeleteBefore(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events, err := s.readAll()
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	kept := []Event{}
+	for _, event := range events {
+		if event.CreatedAt.Before(before) {
+			deleted++
+			continue
+		}
+		kept = append(kept, event)
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	tmpPath := s.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return 0, err
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, event := range kept {
+		if err = encoder.Encode(event); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// readAll returns every event of the file, the caller holds the lock.
+func (s *JSONLinesSink) readAll() ([]Event, error) {
+	file, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	events := []Event{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxJSONLineSize)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, scanner.Err()
+}
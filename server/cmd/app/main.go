@@ -4,16 +4,19 @@ import (
 	"context"
 	"embed"
 	"fmt"
+	"globe-and-citizen/layer8/server/audit"
 	"globe-and-citizen/layer8/server/config"
 	"globe-and-citizen/layer8/server/handlers"
+	"globe-and-citizen/layer8/server/loginthrottle"
 	"globe-and-citizen/layer8/server/opentelemetry"
+	"globe-and-citizen/layer8/server/resource_server/dataaccessdigest"
 	"globe-and-citizen/layer8/server/resource_server/db"
 	"globe-and-citizen/layer8/server/resource_server/emails/sender"
 	"globe-and-citizen/layer8/server/resource_server/emails/verification"
 	"globe-and-citizen/layer8/server/resource_server/emails/verification/code"
 	"globe-and-citizen/layer8/server/resource_server/emails/verification/zk"
-	"globe-and-citizen/layer8/server/resource_server/models"
 	"globe-and-citizen/layer8/server/resource_server/paywithcrypto"
+	"globe-and-citizen/layer8/server/resource_server/zkproofjobs"
 	"io/fs"
 	"log"
 	"net/http"
@@ -22,10 +25,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/consensys/gnark-crypto/ecc"
-	"github.com/consensys/gnark/backend/groth16"
-	"github.com/consensys/gnark/constraint"
-
 	Ctl "globe-and-citizen/layer8/server/resource_server/controller"
 	"globe-and-citizen/layer8/server/resource_server/interfaces"
 	"globe-and-citizen/layer8/server/resource_server/utils"
@@ -44,6 +43,17 @@ import (
 // go:embed dist
 var StaticFiles embed.FS
 
+const (
+	zkKeyMaintenanceInterval          = time.Hour
+	defaultZkKeyRetirementGracePeriod = 30 * 24 * time.Hour
+	defaultZkProofWorkers             = 2
+	loginAttemptsPruneInterval        = 10 * time.Minute
+	auditPruneInterval                = time.Hour
+	defaultAuditRetention             = 365 * 24 * time.Hour
+	dataAccessDigestCheckInterval     = time.Hour
+	defaultDataAccessDigestInterval   = 7 * 24 * time.Hour
+)
+
 var workingDirectory string
 
 func getPwd() {
@@ -72,8 +82,10 @@ func main() {
 		config.InitDB()
 	}
 
+	auditStore := newAuditStore()
+
 	resourceRepository = rsRepo.NewRepository(config.DB)
-	oauthService = &oauthSvc.Service{Repo: oauthRepo.NewOauthRepository(config.DB)}
+	oauthService = &oauthSvc.Service{Repo: oauthRepo.NewOauthRepository(config.DB), Audit: auditStore}
 
 	adminEmailAddress := fmt.Sprintf(
 		"%s@%s",
@@ -89,12 +101,14 @@ func main() {
 
 	codeGenerator := code.NewMIMCCodeGenerator()
 
+	emailSender := sender.NewMailerSendService(
+		os.Getenv("MAILER_SEND_API_KEY"),
+		os.Getenv("MAILER_SEND_TEMPLATE_ID"),
+	)
+
 	emailVerifier := verification.NewEmailVerifier(
 		adminEmailAddress,
-		sender.NewMailerSendService(
-			os.Getenv("MAILER_SEND_API_KEY"),
-			os.Getenv("MAILER_SEND_TEMPLATE_ID"),
-		),
+		emailSender,
 		codeGenerator,
 		verificationCodeValidityDuration,
 		time.Now,
@@ -105,44 +119,77 @@ func main() {
 		log.Fatalf("Error while parsing GENERATE_NEW_ZK_SNARKS_KEYS flag: %e", err)
 	}
 
-	var cs constraint.ConstraintSystem
-	var zkKeyPairId uint
-	var provingKey groth16.ProvingKey
-	var verifyingKey groth16.VerifyingKey
+	keyManager := zk.NewKeyManager(resourceRepository, zk.VerificationCodeCircuit, zk.RunZkSnarksSetup)
+	emailDomainKeyManager := zk.NewKeyManager(resourceRepository, zk.EmailDomainCircuit, zk.RunEmailDomainSetup)
+	keyManagers := []*zk.KeyManager{keyManager, emailDomainKeyManager}
 
-	if generateNewKeys {
-		cs, provingKey, verifyingKey = zk.RunZkSnarksSetup()
+	for _, manager := range keyManagers {
+		if err := manager.Load(); err != nil {
+			log.Fatal(err)
+		}
 
-		zkKeyPairId, err = resourceRepository.SaveZkSnarksKeyPair(
-			models.ZkSnarksKeyPair{
-				ProvingKey:   utils.WriteBytes(provingKey),
-				VerifyingKey: utils.WriteBytes(verifyingKey),
-			},
-		)
+		if generateNewKeys {
+			if err := manager.Rotate(); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	emailDomainSets := map[string][]string{}
+	if path := os.Getenv("ZK_EMAIL_DOMAIN_SETS_FILE"); path != "" {
+		emailDomainSets, err = zk.LoadEmailDomainSets(path)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("failed to load email domain sets: %v", err)
+		}
+	}
+
+	emailDomainProver, err := zk.NewEmailDomainProver(emailDomainKeyManager, emailDomainSets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	oauthService.EmailDomainProver = emailDomainProver
+
+	var zkKeyRotationInterval time.Duration
+	if value := os.Getenv("ZK_KEY_ROTATION_INTERVAL"); value != "" {
+		zkKeyRotationInterval, err = time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("failed to parse zk key rotation interval: %e", err)
 		}
-	} else {
-		zkSnarksKeyPair, err := resourceRepository.GetLatestZkSnarksKeys()
+	}
+
+	zkKeyRetirementGracePeriod := defaultZkKeyRetirementGracePeriod
+	if value := os.Getenv("ZK_KEY_RETIREMENT_GRACE_PERIOD"); value != "" {
+		zkKeyRetirementGracePeriod, err = time.ParseDuration(value)
 		if err != nil {
-			log.Fatalf("Error while reading zk-snarks keys from the database: %e", err)
+			log.Fatalf("failed to parse zk key retirement grace period: %e", err)
 		}
+	}
 
-		cs = zk.GenerateConstraintSystem()
-		zkKeyPairId = zkSnarksKeyPair.ID
+	go func() {
+		ticker := time.NewTicker(zkKeyMaintenanceInterval)
 
-		// Empty proving key initialised with elliptic curve id
-		provingKey = groth16.NewProvingKey(ecc.BN254)
-		// Deserialize proving key representation bytes from db into the provingKey object
-		utils.ReadBytes[groth16.ProvingKey](provingKey, zkSnarksKeyPair.ProvingKey)
+		for currTime := range ticker.C {
+			for _, manager := range keyManagers {
+				err := manager.Maintain(currTime.UTC(), zkKeyRotationInterval, zkKeyRetirementGracePeriod)
+				if err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}()
 
-		// Empty verifying key initialised with elliptic curve id
-		verifyingKey = groth16.NewVerifyingKey(ecc.BN254)
-		// Deserialize verifying key representation bytes from db into the verifyingKey object
-		utils.ReadBytes[groth16.VerifyingKey](verifyingKey, zkSnarksKeyPair.VerifyingKey)
+	zkProofWorkers := defaultZkProofWorkers
+	if value := os.Getenv("ZK_PROOF_WORKERS"); value != "" {
+		zkProofWorkers, err = strconv.Atoi(value)
+		if err != nil || zkProofWorkers < 1 {
+			log.Fatalf("failed to parse the number of zk proof workers: %q", value)
+		}
 	}
 
-	proofProcessor := zk.NewProofProcessor(cs, zkKeyPairId, provingKey, verifyingKey)
+	proofPool := zkproofjobs.NewPool(
+		resourceRepository, keyManager, zkProofWorkers, verificationCodeValidityDuration,
+	)
+	go proofPool.Run(context.Background())
 
 	updateInterval, err := time.ParseDuration(os.Getenv("UPDATE_CLIENT_USAGE_STATISTICS_TIME_INTERVAL"))
 	if err != nil {
@@ -168,20 +215,159 @@ func main() {
 	eventListener := paywithcrypto.NewEventListener(resourceRepository)
 	go eventListener.Start()
 
+	loginThrottler := loginthrottle.New(
+		loginthrottle.NewPostgresStore(config.DB),
+		auditStore,
+		loginThrottleConfig(),
+	)
+
+	go func() {
+		ticker := time.NewTicker(loginAttemptsPruneInterval)
+
+		for range ticker.C {
+			if err := loginThrottler.Prune(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+
+	// a retention of zero keeps the audit trail forever
+	auditRetention := defaultAuditRetention
+	if value := os.Getenv("AUDIT_RETENTION"); value != "" {
+		auditRetention, err = time.ParseDuration(value)
+		if err != nil || auditRetention < 0 {
+			log.Fatalf("failed to parse AUDIT_RETENTION: %q", value)
+		}
+	}
+
+	if auditRetention > 0 {
+		go func() {
+			ticker := time.NewTicker(auditPruneInterval)
+
+			for currTime := range ticker.C {
+				if _, err := auditStore.DeleteBefore(currTime.UTC().Add(-auditRetention)); err != nil {
+					log.Println(err)
+				}
+			}
+		}()
+	}
+
+	dataAccessDigestInterval := defaultDataAccessDigestInterval
+	if value := os.Getenv("DATA_ACCESS_DIGEST_INTERVAL"); value != "" {
+		dataAccessDigestInterval, err = time.ParseDuration(value)
+		if err != nil || dataAccessDigestInterval <= 0 {
+			log.Fatalf("failed to parse DATA_ACCESS_DIGEST_INTERVAL: %q", value)
+		}
+	}
+
+	dataAccessDigestSender := dataaccessdigest.NewSender(
+		resourceRepository, emailSender, adminEmailAddress, dataAccessDigestInterval,
+	)
+
+	go func() {
+		ticker := time.NewTicker(dataAccessDigestCheckInterval)
+
+		for currTime := range ticker.C {
+			if err := dataAccessDigestSender.Send(currTime.UTC()); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+
 	// Run server (which never returns)
 	Server(
-		svc.NewService(resourceRepository, emailVerifier, proofProcessor, codeGenerator),
+		svc.NewService(resourceRepository, emailVerifier, keyManager, codeGenerator),
 		oauthService,
+		loginThrottler,
+		auditStore,
 	)
 }
 
-func Server(resourceService interfaces.IService, oauthService *oauthSvc.Service) {
+// newAuditStore returns the audit trail AUDIT_SINK selects: the
+// security_events table by default, or the JSON lines file at
+// AUDIT_JSONL_PATH.
+func newAuditStore() audit.Store {
+	switch sink := os.Getenv("AUDIT_SINK"); sink {
+	case "", "postgres":
+		return audit.NewPostgresSink(config.DB)
+	case "jsonl":
+		path := os.Getenv("AUDIT_JSONL_PATH")
+		if path == "" {
+			log.Fatal("AUDIT_JSONL_PATH must be set when AUDIT_SINK is jsonl")
+		}
+		return audit.NewJSONLinesSink(path)
+	default:
+		log.Fatalf("unknown AUDIT_SINK: %q", sink)
+		return nil
+	}
+}
+
+// loginThrottleConfig overrides the default login throttling with the
+// LOGIN_THROTTLE_* and LOGIN_POW_* variables that are set.
+func loginThrottleConfig() loginthrottle.Config {
+	throttleConfig := loginthrottle.DefaultConfig()
+
+	durations := map[string]*time.Duration{
+		"LOGIN_THROTTLE_BASE_DELAY":        &throttleConfig.BaseDelay,
+		"LOGIN_THROTTLE_MAX_DELAY":         &throttleConfig.MaxDelay,
+		"LOGIN_THROTTLE_ACCOUNT_MAX_DELAY": &throttleConfig.AccountMaxDelay,
+		"LOGIN_THROTTLE_WINDOW":            &throttleConfig.Window,
+		"LOGIN_POW_TTL":                    &throttleConfig.ProofOfWorkTTL,
+	}
+	for name, duration := range durations {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				log.Fatalf("failed to parse %s: %q", name, value)
+			}
+			*duration = parsed
+		}
+	}
+
+	counts := map[string]*int{
+		"LOGIN_THROTTLE_FREE_FAILURES": &throttleConfig.FreeFailures,
+		"LOGIN_POW_DIFFICULTY":         &throttleConfig.ProofOfWorkDifficulty,
+		"LOGIN_POW_FAILURES":           &throttleConfig.ProofOfWorkFailures,
+	}
+	for name, count := range counts {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				log.Fatalf("failed to parse %s: %q", name, value)
+			}
+			*count = parsed
+		}
+	}
+
+	if value := os.Getenv("LOGIN_THROTTLE_TRUST_FORWARDED_FOR"); value != "" {
+		trustForwardedFor, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Fatalf("failed to parse LOGIN_THROTTLE_TRUST_FORWARDED_FOR: %q", value)
+		}
+		throttleConfig.TrustForwardedFor = trustForwardedFor
+	}
+
+	throttleConfig.ProofOfWorkSecret = []byte(os.Getenv("LOGIN_POW_SECRET"))
+	if throttleConfig.ProofOfWorkDifficulty > 0 && len(throttleConfig.ProofOfWorkSecret) == 0 {
+		log.Fatal("LOGIN_POW_SECRET must be set unless LOGIN_POW_DIFFICULTY is zero")
+	}
+
+	return throttleConfig
+}
+
+func Server(
+	resourceService interfaces.IService,
+	oauthService *oauthSvc.Service,
+	loginThrottler *loginthrottle.Throttler,
+	auditStore audit.Store,
+) {
 	port := os.Getenv("SERVER_PORT")
 
 	getPwd()
 
 	authenticationHandler := handlers.NewAuthenticationHandler(
 		oauthService,
+		loginThrottler,
 		utils.ParseHTML,
 	)
 
@@ -203,6 +389,8 @@ func Server(resourceService interfaces.IService, oauthService *oauthSvc.Service)
 
 			r = r.WithContext(context.WithValue(r.Context(), "Oauthservice", oauthService))
 			r = r.WithContext(context.WithValue(r.Context(), "service", resourceService))
+			r = r.WithContext(context.WithValue(r.Context(), "loginThrottler", loginThrottler))
+			r = r.WithContext(context.WithValue(r.Context(), "auditStore", auditStore))
 
 			staticFS, _ := fs.Sub(StaticFiles, "dist")
 			httpFS := http.FileServer(http.FS(staticFS))
@@ -225,6 +413,8 @@ func Server(resourceService interfaces.IService, oauthService *oauthSvc.Service)
 				authenticationHandler.Login(w, r)
 			case path == "/authorize":
 				authorizationHandler.Authorize(w, r)
+			case path == "/device":
+				authorizationHandler.Device(w, r)
 			case path == "/error":
 				authorizationHandler.Error(w, r)
 			case path == "/api/oauth":
@@ -235,6 +425,8 @@ func Server(resourceService interfaces.IService, oauthService *oauthSvc.Service)
 				handlers.UploadSPCertificate(w, r)
 			case path == "/api/token":
 				handlers.TokenHandler(w, r)
+			case path == "/api/device-authorization":
+				handlers.DeviceAuthorizationHandler(w, r)
 			case path == "/api/zk-metadata":
 				handlers.ZkMetadataHandler(w, r)
 			case strings.HasPrefix(path, "/assets-v1"):
@@ -279,6 +471,28 @@ func Server(resourceService interfaces.IService, oauthService *oauthSvc.Service)
 				Ctl.RegisterClientHandler(w, r)
 			case path == "/api/v1/login-client":
 				Ctl.LoginClientHandler(w, r) // Login Client
+			case path == "/api/v1/login-two-factor":
+				Ctl.LoginTwoFactorHandler(w, r)
+			case path == "/api/v1/login-passkey-options":
+				Ctl.LoginPasskeyOptionsHandler(w, r)
+			case path == "/api/v1/login-passkey":
+				Ctl.LoginPasskeyHandler(w, r)
+			case path == "/api/v1/passkeys":
+				Ctl.PasskeysHandler(w, r)
+			case path == "/api/v1/passkeys/registration-options":
+				Ctl.PasskeyRegistrationOptionsHandler(w, r)
+			case path == "/api/v1/passkeys/registration":
+				Ctl.PasskeyRegistrationHandler(w, r)
+			case path == "/api/v1/two-factor":
+				Ctl.UserTwoFactorHandler(w, r)
+			case path == "/api/v1/two-factor/confirm":
+				Ctl.UserTwoFactorConfirmHandler(w, r)
+			case path == "/api/v1/client-two-factor":
+				Ctl.ClientTwoFactorHandler(w, r)
+			case path == "/api/v1/client-two-factor/confirm":
+				Ctl.ClientTwoFactorConfirmHandler(w, r)
+			case path == "/api/v1/client-require-user-two-factor":
+				Ctl.ClientRequireUserTwoFactorHandler(w, r)
 			case path == "/api/v1/profile":
 				Ctl.ProfileHandler(w, r)
 			case path == "/api/v1/client-profile":
@@ -309,6 +523,48 @@ func Server(resourceService interfaces.IService, oauthService *oauthSvc.Service)
 				Ctl.CheckPhoneNumberVerificationCode(w, r)
 			case path == "/api/v1/generate-telegram-session-id":
 				Ctl.GenerateTelegramSessionIDHandler(w, r)
+			case path == "/api/v1/connected-apps":
+				Ctl.ConnectedAppsHandler(w, r)
+			case path == "/api/v1/revoke-connected-app":
+				Ctl.RevokeConnectedAppHandler(w, r)
+			case path == "/api/v1/sessions":
+				Ctl.SessionsHandler(w, r)
+			case path == "/api/v1/client-sessions":
+				Ctl.ClientSessionsHandler(w, r)
+			case path == "/api/v1/logout":
+				Ctl.LogoutHandler(w, r)
+			case path == "/api/v1/audit-events":
+				Ctl.AuditEventsHandler(w, r)
+			case path == "/api/v1/client-audit-events":
+				Ctl.ClientAuditEventsHandler(w, r)
+			case path == "/api/v1/data-access":
+				Ctl.DataAccessHandler(w, r)
+			case path == "/api/v1/data-access/export":
+				Ctl.DataAccessExportHandler(w, r)
+			case path == "/api/v1/data-access/digest":
+				Ctl.DataAccessDigestHandler(w, r)
+			case path == "/api/v1/client-redirect-uris":
+				Ctl.ClientRedirectURIsHandler(w, r)
+			case path == "/api/v1/add-client-redirect-uri":
+				Ctl.AddClientRedirectURIHandler(w, r)
+			case path == "/api/v1/remove-client-redirect-uri":
+				Ctl.RemoveClientRedirectURIHandler(w, r)
+			case path == "/api/v1/rotate-client-secret":
+				Ctl.RotateClientSecretHandler(w, r)
+			case path == "/api/v1/verified-attributes-credential":
+				Ctl.VerifiedAttributesCredentialHandler(w, r)
+			case path == "/.well-known/jwt-vc-issuer":
+				Ctl.CredentialIssuerMetadataHandler(w, r)
+			case path == "/api/v1/zk/verifying-keys":
+				Ctl.ZkVerifyingKeysHandler(w, r)
+			case path == "/api/v1/zk/verify-proof":
+				Ctl.VerifyZkProofHandler(w, r)
+			case path == "/api/v1/zk/proof-jobs":
+				Ctl.ZkProofJobHandler(w, r)
+			case path == "/api/v1/register":
+				Ctl.DynamicClientRegistrationHandler(w, r)
+			case strings.HasPrefix(path, "/api/v1/register/"):
+				Ctl.ClientConfigurationHandler(w, r)
 			case path == "/favicon.ico":
 				faviconPath := workingDirectory + "/dist/favicon.ico"
 				http.ServeFile(w, r, faviconPath)
@@ -0,0 +1,201 @@
+// Command ceremony runs the multi-party Phase 2 of the Groth16 setup of the
+// email and phone verification circuit.
+//
+//	go run cmd/ceremony/main.go begin -phase1 pot16.bin -transcript ceremony.bin
+//	go run cmd/ceremony/main.go contribute -transcript ceremony.bin
+//	go run cmd/ceremony/main.go verify -phase1 pot16.bin -transcript ceremony.bin
+//	go run cmd/ceremony/main.go finalize -phase1 pot16.bin -transcript ceremony.bin
+//
+// The coordinator begins the ceremony from Phase-1 powers of tau in gnark's
+// mpcsetup encoding and sends the transcript to the first participant. Each
+// participant contributes and sends the transcript on. Anyone can verify the
+// transcript at any point. Finalize verifies it once more, extracts the keys
+// and stores them with the transcript hash; servers prove with them after a
+// restart.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/consensys/gnark/backend/groth16/bn254/mpcsetup"
+	"github.com/joho/godotenv"
+
+	"globe-and-citizen/layer8/server/config"
+	"globe-and-citizen/layer8/server/resource_server/emails/verification/zk"
+	"globe-and-citizen/layer8/server/resource_server/emails/verification/zk/ceremony"
+	"globe-and-citizen/layer8/server/resource_server/models"
+	"globe-and-citizen/layer8/server/resource_server/repository"
+	"globe-and-citizen/layer8/server/resource_server/utils"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	phase1Path := flags.String("phase1", "", "Phase-1 powers of tau in gnark's mpcsetup encoding")
+	transcriptPath := flags.String("transcript", "ceremony.bin", "ceremony transcript")
+	flags.Parse(os.Args[2:])
+
+	switch os.Args[1] {
+	case "begin":
+		begin(readPhase1(*phase1Path), *transcriptPath)
+	case "contribute":
+		contribute(*transcriptPath)
+	case "verify":
+		verify(readPhase1(*phase1Path), *transcriptPath)
+	case "finalize":
+		finalize(readPhase1(*phase1Path), *transcriptPath)
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ceremony begin|contribute|verify|finalize [-phase1 file] [-transcript file]")
+	os.Exit(2)
+}
+
+func begin(phase1 *mpcsetup.Phase1, transcriptPath string) {
+	if _, err := os.Stat(transcriptPath); err == nil {
+		log.Fatalf("%s already exists, refusing to overwrite an ongoing ceremony", transcriptPath)
+	}
+
+	log.Println("Compiling the circuit and deriving the initial Phase 2 state, this takes a while...")
+	transcript, err := ceremony.Begin(zk.GenerateConstraintSystem(), phase1)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	writeTranscript(transcript, transcriptPath)
+	log.Printf("Ceremony started, send %s to the first participant", transcriptPath)
+}
+
+func contribute(transcriptPath string) {
+	transcript := readTranscript(transcriptPath)
+
+	if err := transcript.Contribute(); err != nil {
+		log.Fatal(err)
+	}
+
+	writeTranscript(transcript, transcriptPath)
+	log.Printf(
+		"Contribution %d added with hash %s, note it and check it is part of the final transcript",
+		transcript.Contributions(), transcript.ContributionHash(transcript.Contributions()),
+	)
+}
+
+func verify(phase1 *mpcsetup.Phase1, transcriptPath string) {
+	transcript := readTranscript(transcriptPath)
+
+	log.Println("Compiling the circuit and deriving the initial Phase 2 state, this takes a while...")
+	if err := transcript.Verify(zk.GenerateConstraintSystem(), phase1); err != nil {
+		log.Fatal(err)
+	}
+
+	for i := 1; i <= transcript.Contributions(); i++ {
+		log.Printf("Contribution %d: %s", i, transcript.ContributionHash(i))
+	}
+	log.Printf("Transcript %s is valid, hash %s", transcriptPath, transcriptHash(transcript))
+}
+
+func finalize(phase1 *mpcsetup.Phase1, transcriptPath string) {
+	transcript := readTranscript(transcriptPath)
+	hash := transcriptHash(transcript)
+
+	log.Println("Verifying the transcript and extracting the keys, this takes a while...")
+	provingKey, verifyingKey, err := transcript.ExtractKeys(zk.GenerateConstraintSystem(), phase1)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Fatal("Error loading .env file")
+	}
+	config.InitDB()
+
+	id, err := repository.NewRepository(config.DB).SaveZkSnarksKeyPair(models.ZkSnarksKeyPair{
+		Circuit:        models.ZkCircuitVerificationCode,
+		ProvingKey:     utils.WriteBytes(provingKey),
+		VerifyingKey:   utils.WriteBytes(verifyingKey),
+		TranscriptHash: &hash,
+	})
+	if err != nil {
+		log.Fatalf("Error while saving zk-snarks key pair: %v", err)
+	}
+
+	log.Printf(
+		"Stored key pair %d from %d contributions, transcript hash %s. Restart the servers to prove with it.",
+		id, transcript.Contributions(), hash,
+	)
+}
+
+func readPhase1(path string) *mpcsetup.Phase1 {
+	if path == "" {
+		log.Fatal("-phase1 is required")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	phase1, err := ceremony.ReadPhase1(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return phase1
+}
+
+func readTranscript(path string) *ceremony.Transcript {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	transcript, err := ceremony.ReadTranscript(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return transcript
+}
+
+// writeTranscript replaces path only once the whole transcript is written, an
+// interrupted write must not destroy the contributions made so far.
+func writeTranscript(transcript *ceremony.Transcript, path string) {
+	tmpPath := path + ".tmp"
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := transcript.WriteTo(file); err != nil {
+		file.Close()
+		log.Fatalf("Error while writing transcript: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		log.Fatalf("Error while writing transcript: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func transcriptHash(transcript *ceremony.Transcript) string {
+	hash, err := transcript.Hash()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return hash
+}
@@ -0,0 +1,57 @@
+// Command zkverifier exports the active zk verifying key as a Solidity
+// contract that checks Layer8 email and phone number proofs on chain.
+//
+//	go run cmd/zkverifier/main.go -out contracts/pay-with-crypto/contracts/Layer8ZkVerifier.sol
+//
+// Calldata for the contract is built with zkverify.EncodeVerifyProofCalldata.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	"globe-and-citizen/layer8/server/config"
+	"globe-and-citizen/layer8/server/resource_server/models"
+	"globe-and-citizen/layer8/server/resource_server/repository"
+	"globe-and-citizen/layer8/server/zkverify"
+)
+
+func main() {
+	out := flag.String(
+		"out", "contracts/pay-with-crypto/contracts/"+zkverify.SolidityVerifierContract+".sol", "path of the contract",
+	)
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Fatal("Error loading .env file")
+	}
+	config.InitDB()
+
+	keyPair, err := repository.NewRepository(config.DB).GetLatestZkSnarksKeys(models.ZkCircuitVerificationCode)
+	if err != nil {
+		log.Fatalf("Error while reading zk-snarks keys from the database: %v", err)
+	}
+
+	verifyingKey, err := zkverify.ReadVerifyingKey(keyPair.VerifyingKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := zkverify.ExportSolidityVerifier(verifyingKey, keyPair.ID, file); err != nil {
+		file.Close()
+		log.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Exported the verifier of zk key pair %d to %s", keyPair.ID, *out)
+}
@@ -11,4 +11,47 @@ var (
 	ErrNotFound                 = errors.New("not found")
 	ErrInvalidPassword          = errors.New("password is invalid")
 	ErrMissingFields            = errors.New("missing fields")
+
+	ErrInvalidRegistrationAccessToken = errors.New("invalid registration access token")
+
+	ErrInvalidPasswordResetChallenge = errors.New("password reset challenge is invalid or expired")
+	ErrInvalidPasswordResetSignature = errors.New("password reset signature is invalid")
+	ErrUsernameUnavailable           = errors.New("username is not available")
+
+	ErrInvalidLoginSession = errors.New("login session is invalid or expired")
+	ErrInvalidClientProof  = errors.New("client proof is invalid")
+	// ErrAuthenticationFailed is returned for an unknown username as well as
+	// for a wrong password, so that a login does not tell them apart.
+	ErrAuthenticationFailed = errors.New("server failed to authenticate the user")
+
+	ErrInvalidTwoFactorCode    = errors.New("two-factor code is invalid")
+	ErrInvalidTwoFactorToken   = errors.New("two-factor login is invalid or expired")
+	ErrTwoFactorAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorRequired       = errors.New("the application requires two-factor authentication")
+
+	ErrInvalidPasskey = errors.New("passkey is invalid")
+	// ErrPasskeyCloned is returned when the signature counter of a passkey did
+	// not increase, a sign that the authenticator was cloned.
+	ErrPasskeyCloned          = errors.New("passkey signature counter did not increase")
+	ErrInvalidPasskeyCeremony = errors.New("passkey ceremony is invalid or expired")
+
+	ErrSessionRevoked = errors.New("session has been revoked or has expired")
+
+	// ErrDigestEmailNotVerified is returned when a user asks for the data
+	// access digest at an address other than the verified one.
+	ErrDigestEmailNotVerified = errors.New("digest email is not the verified email of the user")
 )
+
+// Errors returned to a device polling the token endpoint, named after the
+// error codes of RFC 8628 section 3.5.
+var (
+	ErrAuthorizationPending = errors.New("authorization_pending")
+	ErrSlowDown             = errors.New("slow_down")
+	ErrAccessDenied         = errors.New("access_denied")
+	ErrExpiredToken         = errors.New("expired_token")
+)
+
+// ErrUnsupportedGrantType is returned by the token endpoint for a grant type
+// it does not implement, named after the error code of RFC 6749 section 5.2.
+var ErrUnsupportedGrantType = errors.New("unsupported_grant_type")
@@ -3,4 +3,25 @@ package constants
 const (
 	AccessTokenValidityMinutes = 10
 	TokenTypeBearer            = "Bearer"
+
+	// ClientCredentialsTokenAudience is the audience of client credentials
+	// tokens, the client APIs of the resource server
+	ClientCredentialsTokenAudience = "layer8:client-api"
+)
+
+// Grant types accepted by the token endpoint
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// Device authorization grant (RFC 8628)
+const (
+	DeviceCodeValidityMinutes    = 10
+	DevicePollingIntervalSeconds = 5
+
+	DeviceAuthorizationPending  = "pending"
+	DeviceAuthorizationApproved = "approved"
+	DeviceAuthorizationDenied   = "denied"
 )
@@ -1,22 +1,186 @@
 package constants
 
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
 // Scopes
 const (
-	ReadUserScope                = "read:user"
-	ReadUserDisplayNameScope     = "read:user:display_name"
-	ReadUserColorScope           = "read:user:color"
-	ReadUserBioScope             = "read:user:bio"
-	ReadUserIsEmailVerifiedScope = "read:user:is_email_verified"
+	ReadUserScope                      = "read:user"
+	ReadUserDisplayNameScope           = "read:user:display_name"
+	ReadUserColorScope                 = "read:user:color"
+	ReadUserBioScope                   = "read:user:bio"
+	ReadUserIsEmailVerifiedScope       = "read:user:is_email_verified"
+	ReadUserIsPhoneNumberVerifiedScope = "read:user:is_phone_number_verified"
+	ReadUserEmailDomainScope           = "read:user:email_domain"
+	ReadUserEmailDomainMembershipScope = "read:user:email_domain_membership"
 )
 
+// Client scopes are granted to a client's own backend through the client
+// credentials grant. They are never shown to or consented to by a user.
+const (
+	ClientReadUsageStatsScope   = "client:read:usage_stats"
+	ClientWriteCertificateScope = "client:write:certificate"
+	ClientReadUnpaidAmountScope = "client:read:unpaid_amount"
+	ClientReadAuditEventsScope  = "client:read:audit_events"
+)
+
+var clientScopes = []string{
+	ClientReadUsageStatsScope,
+	ClientWriteCertificateScope,
+	ClientReadUnpaidAmountScope,
+	ClientReadAuditEventsScope,
+}
+
 const (
-	UserDisplayNameMetadataKey   = "display_name"
-	UserEmailVerifiedMetadataKey = "email_verified"
-	UserColorMetadataKey         = "color"
-	UserBioMetadataKey           = "bio"
+	UserDisplayNameMetadataKey         = "display_name"
+	UserEmailVerifiedMetadataKey       = "email_verified"
+	UserPhoneNumberVerifiedMetadataKey = "phone_number_verified"
+	UserColorMetadataKey               = "color"
+	UserBioMetadataKey                 = "bio"
+	UserEmailDomainMetadataKey         = "email_domain"
+	UserEmailDomainMembershipKey       = "email_domain_membership"
 )
 
-// Scope descriptions
-var ScopeDescriptions = map[string]string{
-	ReadUserScope: "read anonymized information about your account",
+// Scope describes an OAuth scope a client can request.
+type Scope struct {
+	Name        string
+	Description string
+	// Parent is the scope this one is nested under. Requesting the parent
+	// offers the user each of its children on the consent page.
+	Parent string
+	// MetadataFields are the user metadata keys released by this scope alone;
+	// children do not inherit them and parents do not release their children's.
+	MetadataFields []string
+}
+
+// scopes is the registry of all known scopes, in the order they are shown to the user.
+var scopes = []Scope{
+	{
+		Name:        ReadUserScope,
+		Description: "read anonymized information about your account",
+	},
+	{
+		Name:           ReadUserDisplayNameScope,
+		Description:    "read your display name",
+		Parent:         ReadUserScope,
+		MetadataFields: []string{UserDisplayNameMetadataKey},
+	},
+	{
+		Name:           ReadUserIsEmailVerifiedScope,
+		Description:    "know whether your email address is verified",
+		Parent:         ReadUserScope,
+		MetadataFields: []string{UserEmailVerifiedMetadataKey},
+	},
+	{
+		Name:           ReadUserIsPhoneNumberVerifiedScope,
+		Description:    "know whether your phone number is verified",
+		Parent:         ReadUserScope,
+		MetadataFields: []string{UserPhoneNumberVerifiedMetadataKey},
+	},
+	{
+		Name:           ReadUserEmailDomainScope,
+		Description:    "know the domain of your email address, but not the address itself",
+		Parent:         ReadUserScope,
+		MetadataFields: []string{UserEmailDomainMetadataKey},
+	},
+	{
+		Name:           ReadUserEmailDomainMembershipScope,
+		Description:    "know which lists of domains the domain of your email address is on, but not the domain itself",
+		Parent:         ReadUserScope,
+		MetadataFields: []string{UserEmailDomainMembershipKey},
+	},
+	{
+		Name:           ReadUserColorScope,
+		Description:    "read your favourite color",
+		Parent:         ReadUserScope,
+		MetadataFields: []string{UserColorMetadataKey},
+	},
+	{
+		Name:           ReadUserBioScope,
+		Description:    "read your bio",
+		Parent:         ReadUserScope,
+		MetadataFields: []string{UserBioMetadataKey},
+	},
+}
+
+// LookupScope returns the registered scope with the given name.
+func LookupScope(name string) (Scope, bool) {
+	for _, scope := range scopes {
+		if scope.Name == name {
+			return scope, true
+		}
+	}
+	return Scope{}, false
+}
+
+// ParseScopes splits a comma separated scope string, dropping empty entries
+// such as the one left by a trailing comma.
+func ParseScopes(scopesStr string) []string {
+	names := []string{}
+	for _, name := range strings.Split(scopesStr, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ValidateScopes returns an error naming the first scope that is not registered.
+func ValidateScopes(names []string) error {
+	for _, name := range names {
+		if _, ok := LookupScope(name); !ok {
+			return fmt.Errorf("unknown scope: %s", name)
+		}
+	}
+	return nil
+}
+
+// ExpandScopes returns the given scopes followed by all of their descendants,
+// without duplicates. Unknown scopes are returned as an error.
+func ExpandScopes(names []string) ([]string, error) {
+	if err := ValidateScopes(names); err != nil {
+		return nil, err
+	}
+
+	expanded := []string{}
+	seen := map[string]bool{}
+
+	var add func(name string)
+	add = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		expanded = append(expanded, name)
+
+		for _, scope := range scopes {
+			if scope.Parent == name {
+				add(scope.Name)
+			}
+		}
+	}
+
+	for _, name := range names {
+		add(name)
+	}
+
+	return expanded, nil
+}
+
+// ClientScopes returns every scope a client can be granted for itself.
+func ClientScopes() []string {
+	return slices.Clone(clientScopes)
+}
+
+// ValidateClientScopes returns an error naming the first scope that is not a client scope.
+func ValidateClientScopes(names []string) error {
+	for _, name := range names {
+		if !slices.Contains(clientScopes, name) {
+			return fmt.Errorf("unknown client scope: %s", name)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,62 @@
+package constants
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScopes_EmptyEntriesDropped(t *testing.T) {
+	assert.Equal(t, []string{ReadUserScope, ReadUserBioScope}, ParseScopes("read:user, read:user:bio,,"))
+	assert.Equal(t, []string{}, ParseScopes(""))
+}
+
+func TestLookupScope_EveryScopeHasADescription(t *testing.T) {
+	for _, scope := range scopes {
+		assert.NotEmpty(t, scope.Description, scope.Name)
+
+		if scope.Parent != "" {
+			_, ok := LookupScope(scope.Parent)
+			assert.True(t, ok, "parent of %s is not registered", scope.Name)
+		}
+	}
+}
+
+func TestValidateScopes_UnknownScope(t *testing.T) {
+	assert.Nil(t, ValidateScopes([]string{ReadUserScope, ReadUserIsPhoneNumberVerifiedScope}))
+	assert.NotNil(t, ValidateScopes([]string{ReadUserScope, "write:user"}))
+}
+
+func TestExpandScopes_ParentExpandsToChildren(t *testing.T) {
+	expanded, err := ExpandScopes([]string{ReadUserScope})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		ReadUserScope,
+		ReadUserDisplayNameScope,
+		ReadUserIsEmailVerifiedScope,
+		ReadUserIsPhoneNumberVerifiedScope,
+		ReadUserEmailDomainScope,
+		ReadUserEmailDomainMembershipScope,
+		ReadUserColorScope,
+		ReadUserBioScope,
+	}, expanded)
+}
+
+func TestExpandScopes_ChildDoesNotExpand(t *testing.T) {
+	expanded, err := ExpandScopes([]string{ReadUserBioScope, ReadUserBioScope})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{ReadUserBioScope}, expanded)
+}
+
+func TestExpandScopes_UnknownScope(t *testing.T) {
+	_, err := ExpandScopes([]string{"read:everything"})
+
+	assert.NotNil(t, err)
+}
+
+func TestValidateClientScopes(t *testing.T) {
+	assert.Nil(t, ValidateClientScopes(ClientScopes()))
+	assert.NotNil(t, ValidateClientScopes([]string{ClientReadUsageStatsScope, ReadUserScope}))
+}
@@ -1,6 +1,10 @@
 package entities
 
-import "net/url"
+import (
+	"net/url"
+
+	"globe-and-citizen/layer8/server/webauthn"
+)
 
 // AuthURL represents the URL to redirect the user to for authentication
 type AuthURL struct {
@@ -26,3 +30,31 @@ func (u *AuthURL) Query() url.Values {
 	m, _ := url.ParseQuery(u.URL)
 	return m
 }
+
+// LoginRequest is the SCRAM login of a user to the OAuth portal, made with
+// the nonces of a login precheck of the resource server.
+type LoginRequest struct {
+	Username    string
+	Nonce       string
+	CNonce      string
+	ClientProof string
+	// Source is the address the login came from
+	Source string
+}
+
+// TwoFactorLoginRequest is the second step of a LoginRequest of a user who
+// enabled two-factor authentication.
+type TwoFactorLoginRequest struct {
+	TwoFactorToken string
+	// Code is a code of the authenticator or a recovery code
+	Code   string
+	Source string
+}
+
+// PasskeyLoginRequest is the login of a user to the OAuth portal with the
+// assertion of a passkey, signed for the options of a resource server
+// passkey login.
+type PasskeyLoginRequest struct {
+	Credential webauthn.CredentialResponse
+	Source     string
+}
@@ -9,8 +9,20 @@ type Client struct {
 	RedirectURI string `json:"redirect_uri"`
 }
 
+// ClientClaims are the claims of an access token issued to a client. The
+// subject is the user's pairwise identifier for that client, never the
+// internal user ID, so tokens held by different clients cannot be linked.
 type ClientClaims struct {
 	jwt.StandardClaims
-	UserID int64
 	Scopes string
 }
+
+// ClientCredentialsClaims are the claims of a token a client obtains for its
+// own backend. The username and user_id fields mirror the client portal JWT so
+// that the resource server's client APIs can validate both kinds of token.
+type ClientCredentialsClaims struct {
+	jwt.StandardClaims
+	UserName string `json:"username"`
+	ClientID string `json:"user_id"`
+	Scope    string `json:"scope"`
+}
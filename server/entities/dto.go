@@ -1,5 +1,7 @@
 package entities
 
+import "time"
+
 type X509CertificateRequest struct {
 	Certificate string `json:"certificate" validate:"required"`
 }
@@ -9,15 +11,41 @@ type X509CertificateResponse struct {
 }
 
 type OauthTokenRequest struct {
+	// GrantType is required, the token endpoint answers unsupported_grant_type
+	// to any other than authorization_code, client_credentials and
+	// urn:ietf:params:oauth:grant-type:device_code
+	GrantType         string `json:"grant_type"`
 	ClientUUID        string `json:"client_oauth_uuid" validate:"required"`
 	ClientSecret      string `json:"client_oauth_secret" validate:"required"`
-	AuthorizationCode string `json:"authorization_code" validate:"required"`
+	AuthorizationCode string `json:"authorization_code" validate:"required_if=GrantType authorization_code"`
+	DeviceCode        string `json:"device_code" validate:"required_if=GrantType urn:ietf:params:oauth:grant-type:device_code"`
+	// RedirectURI must be the redirect_uri the authorization code was
+	// issued for
+	RedirectURI string `json:"redirect_uri" validate:"required_if=GrantType authorization_code"`
+	// Scope is only read for the client_credentials grant
+	Scope string `json:"scope"`
+}
+
+type DeviceAuthorizationRequest struct {
+	ClientUUID   string `json:"client_oauth_uuid" validate:"required"`
+	ClientSecret string `json:"client_oauth_secret" validate:"required"`
+	Scope        string `json:"scope"`
+}
+
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
 }
 
 type OauthTokenResponse struct {
 	AccessToken      string `json:"access_token"`
 	TokenType        string `json:"token_type"`
 	ExpiresInMinutes int    `json:"expires_in_minutes"`
+	Scope            string `json:"scope,omitempty"`
 }
 
 type ZkMetadataRequest struct {
@@ -26,8 +54,39 @@ type ZkMetadataRequest struct {
 }
 
 type ZkMetadataResponse struct {
-	IsEmailVerified bool   `json:"is_email_verified"`
-	DisplayName     string `json:"display_name"`
-	Color           string `json:"color"`
-	Bio             string `json:"bio"`
+	Subject               string `json:"sub"`
+	IsEmailVerified       bool   `json:"is_email_verified"`
+	IsPhoneNumberVerified bool   `json:"is_phone_number_verified"`
+	// EmailReproveBy and PhoneNumberReproveBy are set when the verification
+	// lapses at that time unless the user verifies the attribute again: its
+	// proof was made with a zk key pair that is being retired, and cannot be
+	// made again under the new key pair without the user
+	EmailReproveBy         *time.Time         `json:"email_reprove_by,omitempty"`
+	PhoneNumberReproveBy   *time.Time         `json:"phone_number_reprove_by,omitempty"`
+	DisplayName            string             `json:"display_name"`
+	Color                  string             `json:"color"`
+	Bio                    string             `json:"bio"`
+	EmailDomain            *EmailDomainClaim  `json:"email_domain,omitempty"`
+	EmailDomainMemberships []EmailDomainClaim `json:"email_domain_memberships,omitempty"`
+}
+
+// EmailDomainClaim states that the domain of the user's verified email address
+// is in the set of domains with root DomainSetRoot, either the set of Domain
+// alone or the set named DomainSet. Clients check it with
+// zkverify.VerifyEmailDomainProof, their client ID and the verifying key
+// ZkKeyPairID. The proof was made for the client: its nullifier is the same
+// in every claim the client gets about the user's domain, and cannot be
+// linked to the nullifiers other clients get. DomainCommitment is the
+// commitment the proof of the user's email verification outputs: checking
+// that proof with zkverify.VerifyProof and the same commitment shows the
+// domain is the one of the verified address. Unlike the nullifier, it is the
+// same for every client.
+type EmailDomainClaim struct {
+	Domain           string `json:"domain,omitempty"`
+	DomainSet        string `json:"domain_set,omitempty"`
+	DomainSetRoot    string `json:"domain_set_root"`
+	Nullifier        string `json:"nullifier"`
+	DomainCommitment string `json:"domain_commitment"`
+	ZkProof          []byte `json:"zk_proof"`
+	ZkKeyPairID      uint   `json:"zk_key_pair_id"`
 }
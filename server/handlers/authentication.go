@@ -1,10 +1,17 @@
 package handlers
 
 import (
+	"encoding/json"
 	"errors"
+	"globe-and-citizen/layer8/server/entities"
 	svc "globe-and-citizen/layer8/server/internals/service"
+	"globe-and-citizen/layer8/server/loginthrottle"
+	"globe-and-citizen/layer8/server/resource_server/utils"
+	"log"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
 )
 
 type AuthenticationHandler interface {
@@ -12,16 +19,20 @@ type AuthenticationHandler interface {
 }
 
 type authenticationHandlerImpl struct {
-	service   svc.ServiceInterface
+	service svc.ServiceInterface
+	// throttler limits failed logins, logins are not throttled if it is nil
+	throttler *loginthrottle.Throttler
 	parseHTML func(w http.ResponseWriter, statusCode int, htmlFile string, params map[string]interface{})
 }
 
 func NewAuthenticationHandler(
 	service svc.ServiceInterface,
+	throttler *loginthrottle.Throttler,
 	htmlParserFunc func(w http.ResponseWriter, statusCode int, htmlFile string, params map[string]interface{}),
 ) AuthenticationHandler {
 	return &authenticationHandlerImpl{
 		service:   service,
+		throttler: throttler,
 		parseHTML: htmlParserFunc,
 	}
 }
@@ -71,16 +82,139 @@ func (a *authenticationHandlerImpl) getLoginHandler(w http.ResponseWriter, r *ht
 }
 
 func (a *authenticationHandlerImpl) postLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("two_factor_token") != "" {
+		a.postTwoFactorLoginHandler(w, r)
+		return
+	}
+	if r.FormValue("passkey_credential") != "" {
+		a.postPasskeyLoginHandler(w, r)
+		return
+	}
+
+	next := r.URL.Query().Get("next")
+	// the login page runs the SCRAM exchange, the password is not sent
+	request := entities.LoginRequest{
+		Username:    r.FormValue("username"),
+		Nonce:       r.FormValue("nonce"),
+		CNonce:      r.FormValue("c_nonce"),
+		ClientProof: r.FormValue("client_proof"),
+	}
+
+	attempt := loginthrottle.Attempt{
+		Principal:   loginthrottle.PrincipalUser,
+		Username:    request.Username,
+		ProofOfWork: r.FormValue("proof_of_work"),
+	}
+	if a.throttler != nil {
+		attempt.Source = a.throttler.Source(r)
+		request.Source = attempt.Source
+		if err := a.throttler.Check(attempt); err != nil {
+			a.parseThrottledLogin(w, r, err)
+			return
+		}
+	}
+
+	rUser, err := a.service.LoginUser(request)
+	a.recordLoginAttempt(attempt, err)
+	if err != nil {
+		a.parseLoginWithErr(w, r, err)
+		return
+	}
+
+	// the password checked out, the page asks for a code of the authenticator
+	if twoFactorToken, ok := rUser["two_factor_token"].(string); ok {
+		a.parseHTML(w, http.StatusOK, "assets-v1/templates/src/pages/oauth_portal/login.html",
+			map[string]interface{}{
+				"HasNext":        true,
+				"Next":           next,
+				"TwoFactorToken": twoFactorToken,
+			},
+		)
+		return
+	}
+
+	a.setTokenAndRedirect(w, r, rUser, next)
+}
+
+// postTwoFactorLoginHandler is the second step of a login of a user who
+// enabled two-factor authentication. Wrong codes are throttled like wrong
+// passwords.
+func (a *authenticationHandlerImpl) postTwoFactorLoginHandler(w http.ResponseWriter, r *http.Request) {
+	next := r.URL.Query().Get("next")
+	request := entities.TwoFactorLoginRequest{
+		TwoFactorToken: r.FormValue("two_factor_token"),
+		Code:           r.FormValue("two_factor_code"),
+	}
+
+	claims, err := utils.ParseTwoFactorToken(request.TwoFactorToken)
+	if err != nil {
+		a.parseLoginWithErr(w, r, err)
+		return
+	}
+
+	attempt := loginthrottle.Attempt{
+		Principal:   loginthrottle.PrincipalUser,
+		Username:    claims.Subject,
+		ProofOfWork: r.FormValue("proof_of_work"),
+	}
+	if a.throttler != nil {
+		attempt.Source = a.throttler.Source(r)
+		request.Source = attempt.Source
+		if err := a.throttler.Check(attempt); err != nil {
+			a.parseThrottledLogin(w, r, err)
+			return
+		}
+	}
+
+	rUser, err := a.service.LoginTwoFactor(request)
+	a.recordLoginAttempt(attempt, err)
+	if err != nil {
+		a.parseLoginWithErr(w, r, err)
+		return
+	}
+
+	a.setTokenAndRedirect(w, r, rUser, next)
+}
+
+// postPasskeyLoginHandler logs a user in with the assertion of a passkey the
+// login page posts as JSON. Like on the resource server, passkey logins are
+// not throttled as there is nothing to guess.
+func (a *authenticationHandlerImpl) postPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
 	next := r.URL.Query().Get("next")
-	username := r.FormValue("username")
-	password := r.FormValue("password")
 
-	rUser, err := a.service.LoginUser(username, password)
+	var request entities.PasskeyLoginRequest
+	err := json.Unmarshal([]byte(r.FormValue("passkey_credential")), &request.Credential)
+	if err != nil {
+		a.parseLoginWithErr(w, r, errors.New("passkey credential is malformed"))
+		return
+	}
+	if a.throttler != nil {
+		request.Source = a.throttler.Source(r)
+	}
+
+	rUser, err := a.service.LoginPasskey(request)
 	if err != nil {
 		a.parseLoginWithErr(w, r, err)
 		return
 	}
 
+	if twoFactorToken, ok := rUser["two_factor_token"].(string); ok {
+		a.parseHTML(w, http.StatusOK, "assets-v1/templates/src/pages/oauth_portal/login.html",
+			map[string]interface{}{
+				"HasNext":        true,
+				"Next":           next,
+				"TwoFactorToken": twoFactorToken,
+			},
+		)
+		return
+	}
+
+	a.setTokenAndRedirect(w, r, rUser, next)
+}
+
+func (a *authenticationHandlerImpl) setTokenAndRedirect(
+	w http.ResponseWriter, r *http.Request, rUser map[string]interface{}, next string,
+) {
 	token, ok := rUser["token"].(string)
 	if !ok {
 		a.parseLoginWithErr(w, r, errors.New("could not get token"))
@@ -107,3 +241,47 @@ func (a *authenticationHandlerImpl) parseLoginWithErr(w http.ResponseWriter, r *
 		})
 
 }
+
+func (a *authenticationHandlerImpl) parseThrottledLogin(w http.ResponseWriter, r *http.Request, err error) {
+	params := map[string]interface{}{
+		"HasNext": true,
+		"Next":    r.URL.Query().Get("next"),
+	}
+
+	var lockedErr *loginthrottle.LockedError
+	var proofOfWorkErr *loginthrottle.ProofOfWorkError
+
+	switch {
+	case errors.As(err, &lockedErr):
+		retryAfter := int(math.Ceil(lockedErr.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		params["Error"] = "Too many failed login attempts, try again later"
+	case errors.As(err, &proofOfWorkErr):
+		params["Error"] = "Too many failed login attempts, please log in again"
+		params["ProofOfWorkChallenge"] = proofOfWorkErr.Challenge
+		params["ProofOfWorkDifficulty"] = proofOfWorkErr.Difficulty
+	default:
+		a.parseLoginWithErr(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusTooManyRequests)
+	a.parseHTML(w, http.StatusTooManyRequests, "assets-v1/templates/src/pages/oauth_portal/login.html", params)
+}
+
+func (a *authenticationHandlerImpl) recordLoginAttempt(attempt loginthrottle.Attempt, loginErr error) {
+	if a.throttler == nil {
+		return
+	}
+
+	var err error
+	if loginErr != nil {
+		err = a.throttler.Fail(attempt)
+	} else {
+		err = a.throttler.Succeed(attempt)
+	}
+
+	if err != nil {
+		log.Printf("failed to record login attempt of %s: %v", attempt.Username, err)
+	}
+}
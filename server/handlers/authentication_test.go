@@ -2,15 +2,21 @@ package handlers_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"globe-and-citizen/layer8/server/entities"
 	"globe-and-citizen/layer8/server/handlers"
+	"globe-and-citizen/layer8/server/loginthrottle"
 	"globe-and-citizen/layer8/server/models"
+	rsUtils "globe-and-citizen/layer8/server/resource_server/utils"
 	"globe-and-citizen/layer8/server/utils/mocks"
+	"globe-and-citizen/layer8/server/webauthn"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"testing"
+	"time"
 
 	"go.uber.org/mock/gomock"
 
@@ -37,7 +43,7 @@ func Test_GetLoginHandler_NoToken_OK(t *testing.T) {
 		assert.Equal(t, expectedHTMLParsingParams, params)
 	}
 
-	handler := handlers.NewAuthenticationHandler(serviceMock, htmlParserMock)
+	handler := handlers.NewAuthenticationHandler(serviceMock, nil, htmlParserMock)
 
 	os.Setenv("PROXY_URL", proxyUrl)
 
@@ -62,7 +68,7 @@ func Test_GetLoginHandler_TokenExists_OK(t *testing.T) {
 	serviceMock := mocks.NewMockServiceInterface(ctrl)
 	serviceMock.EXPECT().GetUserByToken(fakeJwtToken).Return(&models.User{}, nil)
 
-	handler := handlers.NewAuthenticationHandler(serviceMock, nil)
+	handler := handlers.NewAuthenticationHandler(serviceMock, nil, nil)
 
 	// Execute the test
 	req := httptest.NewRequest("GET", "/login", nil)
@@ -79,7 +85,12 @@ func Test_PostLoginHandler_ValidCredentials_OK(t *testing.T) {
 	// Prepare the test
 	var (
 		username     = "username"
-		password     = "password"
+		loginRequest = entities.LoginRequest{
+			Username:    username,
+			Nonce:       "nonce",
+			CNonce:      "c_nonce",
+			ClientProof: "client_proof",
+		}
 		nextUrl      = "/next"
 		fakeJwtToken = "fakeJwt"
 
@@ -92,14 +103,16 @@ func Test_PostLoginHandler_ValidCredentials_OK(t *testing.T) {
 	ctrl := gomock.NewController(t)
 
 	serviceMock := mocks.NewMockServiceInterface(ctrl)
-	serviceMock.EXPECT().LoginUser(username, password).Return(loginResult, nil)
+	serviceMock.EXPECT().LoginUser(loginRequest).Return(loginResult, nil)
 
-	handler := handlers.NewAuthenticationHandler(serviceMock, nil)
+	handler := handlers.NewAuthenticationHandler(serviceMock, nil, nil)
 
 	// Execute the test
 	params := url.Values{}
-	params.Add("username", username)
-	params.Add("password", password)
+	params.Add("username", loginRequest.Username)
+	params.Add("nonce", loginRequest.Nonce)
+	params.Add("c_nonce", loginRequest.CNonce)
+	params.Add("client_proof", loginRequest.ClientProof)
 
 	req := httptest.NewRequest("POST", "/login", bytes.NewBufferString(params.Encode()))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -126,9 +139,14 @@ func Test_PostLoginHandler_ValidCredentials_OK(t *testing.T) {
 func Test_PostLoginHandler_TokenNotExists_OK(t *testing.T) {
 	// Prepare the test
 	var (
-		username = "username"
-		password = "password"
-		nextUrl  = "/next"
+		username     = "username"
+		loginRequest = entities.LoginRequest{
+			Username:    username,
+			Nonce:       "nonce",
+			CNonce:      "c_nonce",
+			ClientProof: "client_proof",
+		}
+		nextUrl = "/next"
 
 		loginResult = map[string]interface{}{
 			"username": username,
@@ -149,14 +167,16 @@ func Test_PostLoginHandler_TokenNotExists_OK(t *testing.T) {
 		assert.Equal(t, expectedHTMLParsingParams, params)
 	}
 	serviceMock := mocks.NewMockServiceInterface(ctrl)
-	serviceMock.EXPECT().LoginUser(username, password).Return(loginResult, nil)
+	serviceMock.EXPECT().LoginUser(loginRequest).Return(loginResult, nil)
 
-	handler := handlers.NewAuthenticationHandler(serviceMock, htmlParserMock)
+	handler := handlers.NewAuthenticationHandler(serviceMock, nil, htmlParserMock)
 
 	// Execute the test
 	params := url.Values{}
-	params.Add("username", username)
-	params.Add("password", password)
+	params.Add("username", loginRequest.Username)
+	params.Add("nonce", loginRequest.Nonce)
+	params.Add("c_nonce", loginRequest.CNonce)
+	params.Add("client_proof", loginRequest.ClientProof)
 
 	req := httptest.NewRequest("POST", "/login", bytes.NewBufferString(params.Encode()))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -173,9 +193,14 @@ func Test_PostLoginHandler_TokenNotExists_OK(t *testing.T) {
 func Test_PostLoginHandler_InvalidCredentials_OK(t *testing.T) {
 	// Prepare the test
 	var (
-		username = "username"
-		password = "password"
-		nextUrl  = "/next"
+		username     = "username"
+		loginRequest = entities.LoginRequest{
+			Username:    username,
+			Nonce:       "nonce",
+			CNonce:      "c_nonce",
+			ClientProof: "client_proof",
+		}
+		nextUrl = "/next"
 
 		loginError = errors.New("invalid credentials")
 
@@ -194,14 +219,16 @@ func Test_PostLoginHandler_InvalidCredentials_OK(t *testing.T) {
 		assert.Equal(t, expectedHTMLParsingParams, params)
 	}
 	serviceMock := mocks.NewMockServiceInterface(ctrl)
-	serviceMock.EXPECT().LoginUser(username, password).Return(nil, loginError)
+	serviceMock.EXPECT().LoginUser(loginRequest).Return(nil, loginError)
 
-	handler := handlers.NewAuthenticationHandler(serviceMock, htmlParserMock)
+	handler := handlers.NewAuthenticationHandler(serviceMock, nil, htmlParserMock)
 
 	// Execute the test
 	params := url.Values{}
-	params.Add("username", username)
-	params.Add("password", password)
+	params.Add("username", loginRequest.Username)
+	params.Add("nonce", loginRequest.Nonce)
+	params.Add("c_nonce", loginRequest.CNonce)
+	params.Add("client_proof", loginRequest.ClientProof)
 
 	req := httptest.NewRequest("POST", "/login", bytes.NewBufferString(params.Encode()))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -214,3 +241,212 @@ func Test_PostLoginHandler_InvalidCredentials_OK(t *testing.T) {
 	assert.Equal(t, http.StatusUnauthorized, responseRecorder.Code)
 	assert.Len(t, responseRecorder.Result().Cookies(), 0)
 }
+
+// lockedStore is a loginthrottle.Store on which every key has just failed
+// often enough to be locked
+type lockedStore struct{}
+
+func (lockedStore) Counters(keys []string) (map[string]loginthrottle.Counter, error) {
+	counters := map[string]loginthrottle.Counter{}
+	for _, key := range keys {
+		counters[key] = loginthrottle.Counter{Failures: 10, LastFailureAt: time.Now().UTC()}
+	}
+	return counters, nil
+}
+
+func (lockedStore) RecordFailure(key string, now time.Time, window time.Duration) (loginthrottle.Counter, error) {
+	return loginthrottle.Counter{}, nil
+}
+
+func (lockedStore) Reset(keys []string) error {
+	return nil
+}
+
+func (lockedStore) Prune(before time.Time) error {
+	return nil
+}
+
+func Test_PostLoginHandler_Locked(t *testing.T) {
+	// Prepare the test
+	var (
+		nextUrl = "/next"
+
+		expectedLoginHTMLPath     = "assets-v1/templates/src/pages/oauth_portal/login.html"
+		expectedHTMLParsingParams = map[string]interface{}{
+			"HasNext": true,
+			"Next":    nextUrl,
+			"Error":   "Too many failed login attempts, try again later",
+		}
+	)
+
+	ctrl := gomock.NewController(t)
+
+	htmlParserMock := func(w http.ResponseWriter, statusCode int, htmlFile string, params map[string]interface{}) {
+		assert.Equal(t, expectedLoginHTMLPath, htmlFile)
+		assert.Equal(t, expectedHTMLParsingParams, params)
+	}
+	// LoginUser is not expected, locked logins do not reach the service
+	serviceMock := mocks.NewMockServiceInterface(ctrl)
+
+	throttler := loginthrottle.New(lockedStore{}, nil, loginthrottle.DefaultConfig())
+	handler := handlers.NewAuthenticationHandler(serviceMock, throttler, htmlParserMock)
+
+	// Execute the test
+	params := url.Values{}
+	params.Add("username", "username")
+	params.Add("nonce", "nonce")
+	params.Add("c_nonce", "c_nonce")
+	params.Add("client_proof", "client_proof")
+
+	req := httptest.NewRequest("POST", "/login", bytes.NewBufferString(params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.URL.RawQuery = "next=" + nextUrl
+
+	responseRecorder := httptest.NewRecorder()
+	handler.Login(responseRecorder, req)
+
+	// Verify the results
+	assert.Equal(t, http.StatusTooManyRequests, responseRecorder.Code)
+	assert.Equal(t, "16", responseRecorder.Header().Get("Retry-After"))
+}
+
+func Test_PostLoginHandler_TwoFactorRequired(t *testing.T) {
+	loginRequest := entities.LoginRequest{
+		Username:    "username",
+		Nonce:       "nonce",
+		CNonce:      "c_nonce",
+		ClientProof: "client_proof",
+	}
+
+	ctrl := gomock.NewController(t)
+
+	serviceMock := mocks.NewMockServiceInterface(ctrl)
+	serviceMock.EXPECT().LoginUser(loginRequest).Return(map[string]interface{}{
+		"two_factor_token": "two_factor_token",
+	}, nil)
+
+	htmlParserMock := func(w http.ResponseWriter, statusCode int, htmlFile string, params map[string]interface{}) {
+		assert.Equal(t, "assets-v1/templates/src/pages/oauth_portal/login.html", htmlFile)
+		assert.Equal(t, "two_factor_token", params["TwoFactorToken"])
+		assert.Equal(t, "/next", params["Next"])
+	}
+
+	handler := handlers.NewAuthenticationHandler(serviceMock, nil, htmlParserMock)
+
+	params := url.Values{}
+	params.Add("username", loginRequest.Username)
+	params.Add("nonce", loginRequest.Nonce)
+	params.Add("c_nonce", loginRequest.CNonce)
+	params.Add("client_proof", loginRequest.ClientProof)
+
+	req := httptest.NewRequest("POST", "/login", bytes.NewBufferString(params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.URL.RawQuery = "next=/next"
+
+	responseRecorder := httptest.NewRecorder()
+	handler.Login(responseRecorder, req)
+
+	// no session is started before the code is checked
+	assert.Empty(t, responseRecorder.Result().Cookies())
+}
+
+func Test_PostLoginHandler_Passkey_OK(t *testing.T) {
+	credential := webauthn.CredentialResponse{
+		ID:   "credential_id",
+		Type: "public-key",
+		Response: webauthn.AuthenticatorResponse{
+			ClientDataJSON:    "client_data",
+			AuthenticatorData: "authenticator_data",
+			Signature:         "signature",
+		},
+	}
+
+	ctrl := gomock.NewController(t)
+
+	serviceMock := mocks.NewMockServiceInterface(ctrl)
+	serviceMock.EXPECT().LoginPasskey(entities.PasskeyLoginRequest{Credential: credential}).
+		Return(map[string]interface{}{"token": "fakeJwt"}, nil)
+
+	handler := handlers.NewAuthenticationHandler(serviceMock, nil, nil)
+
+	encoded, err := json.Marshal(credential)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := url.Values{}
+	params.Add("passkey_credential", string(encoded))
+
+	req := httptest.NewRequest("POST", "/login", bytes.NewBufferString(params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.URL.RawQuery = "next=/next"
+
+	responseRecorder := httptest.NewRecorder()
+	handler.Login(responseRecorder, req)
+
+	assert.Equal(t, http.StatusSeeOther, responseRecorder.Code)
+	assert.Equal(t, "/next", responseRecorder.Header().Get("Location"))
+
+	cookies := responseRecorder.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, "fakeJwt", cookies[0].Value)
+}
+
+func Test_PostLoginHandler_Passkey_Malformed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	serviceMock := mocks.NewMockServiceInterface(ctrl)
+
+	htmlParserMock := func(w http.ResponseWriter, statusCode int, htmlFile string, params map[string]interface{}) {
+		assert.Equal(t, http.StatusUnauthorized, statusCode)
+		assert.Equal(t, "passkey credential is malformed", params["Error"])
+	}
+
+	handler := handlers.NewAuthenticationHandler(serviceMock, nil, htmlParserMock)
+
+	params := url.Values{}
+	params.Add("passkey_credential", "{")
+
+	req := httptest.NewRequest("POST", "/login", bytes.NewBufferString(params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	responseRecorder := httptest.NewRecorder()
+	handler.Login(responseRecorder, req)
+
+	assert.Equal(t, http.StatusUnauthorized, responseRecorder.Code)
+}
+
+func Test_PostLoginHandler_TwoFactorCode_OK(t *testing.T) {
+	t.Setenv("JWT_SECRET_KEY", "jwt_secret")
+
+	twoFactorToken, err := rsUtils.GenerateTwoFactorToken(models.ScramPrincipalUser, "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctrl := gomock.NewController(t)
+
+	serviceMock := mocks.NewMockServiceInterface(ctrl)
+	serviceMock.EXPECT().LoginTwoFactor(entities.TwoFactorLoginRequest{
+		TwoFactorToken: twoFactorToken,
+		Code:           "123456",
+	}).Return(map[string]interface{}{"token": "fakeJwt"}, nil)
+
+	handler := handlers.NewAuthenticationHandler(serviceMock, nil, nil)
+
+	params := url.Values{}
+	params.Add("two_factor_token", twoFactorToken)
+	params.Add("two_factor_code", "123456")
+
+	req := httptest.NewRequest("POST", "/login", bytes.NewBufferString(params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.URL.RawQuery = "next=/next"
+
+	responseRecorder := httptest.NewRecorder()
+	handler.Login(responseRecorder, req)
+
+	assert.Equal(t, http.StatusSeeOther, responseRecorder.Code)
+	assert.Equal(t, "/next", responseRecorder.Header().Get("Location"))
+
+	cookies := responseRecorder.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, "fakeJwt", cookies[0].Value)
+}
@@ -1,12 +1,14 @@
 package handlers
 
 import (
+	"errors"
 	"globe-and-citizen/layer8/server/constants"
 	svc "globe-and-citizen/layer8/server/internals/service"
 	"globe-and-citizen/layer8/server/utils"
 	"log"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -16,6 +18,7 @@ import (
 type AuthorizationHandler interface {
 	Authorize(w http.ResponseWriter, r *http.Request)
 	OAuthToken(w http.ResponseWriter, r *http.Request)
+	Device(w http.ResponseWriter, r *http.Request)
 	Error(w http.ResponseWriter, r *http.Request)
 }
 
@@ -59,9 +62,17 @@ func (a *authorizationHandlerImpl) getAuthorizeHandler(w http.ResponseWriter, r
 		scopes = constants.ReadUserScope
 	}
 
+	requestedScopes, optionalScopes, err := resolveRequestedScopes(scopes)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/error?opt=invalid_scope", http.StatusSeeOther)
+		return
+	}
+
 	// add the scope descriptions
-	for _, scope := range strings.Split(scopes, ",") {
-		scopeDescriptions = append(scopeDescriptions, constants.ScopeDescriptions[scope])
+	for _, name := range requestedScopes {
+		scope, _ := constants.LookupScope(name)
+		scopeDescriptions = append(scopeDescriptions, scope.Description)
 	}
 
 	// get the client
@@ -73,6 +84,14 @@ func (a *authorizationHandlerImpl) getAuthorizeHandler(w http.ResponseWriter, r
 		return
 	}
 
+	// check that the redirect_uri matches one registered for the client
+	redirectURI, err = a.service.ResolveRedirectURI(client, redirectURI)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/error?opt=redirect_uri_mismatch", http.StatusSeeOther)
+		return
+	}
+
 	// generate the next url
 	uri, err := url.Parse("/authorize")
 	if err != nil {
@@ -82,8 +101,9 @@ func (a *authorizationHandlerImpl) getAuthorizeHandler(w http.ResponseWriter, r
 	}
 
 	uri.RawQuery = url.Values{
-		"client_id": {clientID},
-		"scope":     {scopes},
+		"client_id":    {clientID},
+		"scope":        {scopes},
+		"redirect_uri": {redirectURI},
 	}.Encode()
 
 	next = uri.String()
@@ -91,33 +111,89 @@ func (a *authorizationHandlerImpl) getAuthorizeHandler(w http.ResponseWriter, r
 	// check that the user is logged in
 	token, err := r.Cookie("token")
 	if token == nil || err != nil {
-		http.Redirect(w, r, "/login?next="+next, http.StatusSeeOther)
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusSeeOther)
 		return
 	}
 
 	user, err := a.service.GetUserByToken(token.Value)
 	if err != nil || user == nil {
-		http.Redirect(w, r, "/login?next="+next, http.StatusSeeOther)
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusSeeOther)
 		return
 	}
 
-	// check that the redirect_uri is valid match the client's redirect_uri
-	if redirectURI != "" && client.RedirectURI != redirectURI {
-		http.Redirect(w, r, "/error?opt=redirect_uri_mismatch", http.StatusSeeOther)
+	// skip the prompt if the user already consented to every requested scope
+	consent, err := a.service.GetCoveringConsent(int64(user.ID), client.ID, requestedScopes)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/error?opt=server_error", http.StatusSeeOther)
+		return
+	}
+
+	if consent != nil {
+		// issue what this request asks for, not everything the consent
+		// covers: the requested scopes, and their children the user shared
+		// when consenting
+		grantedScopes := requestedScopes
+		consentedScopes := strings.Split(consent.Scopes, ",")
+		for _, name := range optionalScopes {
+			if slices.Contains(consentedScopes, name) {
+				grantedScopes = append(grantedScopes, name)
+			}
+		}
+
+		config := &oauth2.Config{
+			ClientID:    client.ID,
+			RedirectURL: redirectURI,
+			Scopes:      grantedScopes,
+		}
+
+		redirectURL, err := a.service.GenerateAuthorizationURL(config, int64(user.ID))
+		if err != nil {
+			log.Println(err)
+			http.Redirect(w, r, "/error?opt="+authorizationErrorOpt(err), http.StatusSeeOther)
+			return
+		}
+
+		code, err := a.service.GenerateAuthJwtCode(config, int64(user.ID))
+		if err != nil {
+			log.Println(err)
+			http.Redirect(w, r, "/error?opt=server_error", http.StatusSeeOther)
+			return
+		}
+
+		a.parseHTML(w, http.StatusOK, "assets-v1/templates/src/pages/oauth_portal/authorized.html", map[string]interface{}{
+			"ClientName":   client.Name,
+			"Redirect":     redirectURL.String(),
+			"Code":         code,
+			"TargetOrigin": redirectOrigin(redirectURI),
+		})
 		return
 	}
 
 	a.parseHTML(w, http.StatusOK, "assets-v1/templates/src/pages/oauth_portal/authorize.html", map[string]interface{}{
-		"ClientName": client.Name,
-		"Scopes":     scopeDescriptions,
-		"Next":       next,
+		"ClientName":     client.Name,
+		"Scopes":         scopeDescriptions,
+		"OptionalScopes": optionalScopeFields(optionalScopes),
+		"Next":           next,
+		"TargetOrigin":   redirectOrigin(redirectURI),
 	})
 }
 
+// redirectOrigin is the origin of the registered redirect URI, the only
+// window an authorize page hands its result to when it runs in a popup.
+func redirectOrigin(redirectURI string) string {
+	uri, err := url.Parse(redirectURI)
+	if err != nil || uri.Scheme == "" || uri.Host == "" {
+		return ""
+	}
+	return uri.Scheme + "://" + uri.Host
+}
+
 func (a *authorizationHandlerImpl) postAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		clientID        = r.URL.Query().Get("client_id")
 		scopes          = r.URL.Query().Get("scope")
+		redirectURI     = r.URL.Query().Get("redirect_uri")
 		returnResult, _ = strconv.ParseBool(r.URL.Query().Get("return_result"))
 	)
 
@@ -163,11 +239,11 @@ func (a *authorizationHandlerImpl) postAuthorizeHandler(w http.ResponseWriter, r
 			returnResult, w,
 			&utils.JSONResponseInput{
 				StatusCode: http.StatusOK,
-				Data:       `{"redr": "/login?next=` + r.URL.String() + `"}`,
+				Data:       `{"redr": "/login?next=` + url.QueryEscape(r.URL.String()) + `"}`,
 			},
 			&utils.RedirectResponseInput{
 				StatusCode: http.StatusSeeOther,
-				Location:   "/login?next=" + r.URL.String(),
+				Location:   "/login?next=" + url.QueryEscape(r.URL.String()),
 			},
 		)
 	}
@@ -178,11 +254,29 @@ func (a *authorizationHandlerImpl) postAuthorizeHandler(w http.ResponseWriter, r
 			returnResult, w,
 			&utils.JSONResponseInput{
 				StatusCode: http.StatusOK,
-				Data:       `{"redr": "/login?next=` + r.URL.String() + `"}`,
+				Data:       `{"redr": "/login?next=` + url.QueryEscape(r.URL.String()) + `"}`,
+			},
+			&utils.RedirectResponseInput{
+				StatusCode: http.StatusSeeOther,
+				Location:   "/login?next=" + url.QueryEscape(r.URL.String()),
+			},
+		)
+
+		return
+	}
+
+	redirectURI, err = a.service.ResolveRedirectURI(client, redirectURI)
+	if err != nil {
+		log.Println(err)
+		utils.MapResponse(
+			returnResult, w,
+			&utils.JSONResponseInput{
+				StatusCode: http.StatusOK,
+				Data:       `{"redr": "/error?opt=redirect_uri_mismatch"}`,
 			},
 			&utils.RedirectResponseInput{
 				StatusCode: http.StatusSeeOther,
-				Location:   "/login?next=" + r.URL.String(),
+				Location:   "/error?opt=redirect_uri_mismatch",
 			},
 		)
 
@@ -193,37 +287,68 @@ func (a *authorizationHandlerImpl) postAuthorizeHandler(w http.ResponseWriter, r
 		scopes = constants.ReadUserScope
 	}
 
-	if r.FormValue("share_display_name") == "true" {
-		scopes += "," + constants.ReadUserDisplayNameScope
-	}
+	requestedScopes, optionalScopes, err := resolveRequestedScopes(scopes)
+	if err != nil {
+		log.Println(err)
+		utils.MapResponse(
+			returnResult, w,
+			&utils.JSONResponseInput{
+				StatusCode: http.StatusOK,
+				Data:       `{"redr": "/error?opt=invalid_scope"}`,
+			},
+			&utils.RedirectResponseInput{
+				StatusCode: http.StatusSeeOther,
+				Location:   "/error?opt=invalid_scope",
+			},
+		)
 
-	if r.FormValue("share_color") == "true" {
-		scopes += "," + constants.ReadUserColorScope
+		return
 	}
 
-	if r.FormValue("share_is_email_verified") == "true" {
-		scopes += "," + constants.ReadUserIsEmailVerifiedScope
+	// the requested scopes are granted as a whole, their children only if
+	// the user ticked them on the consent page
+	grantedScopes := requestedScopes
+	for _, field := range optionalScopeFields(optionalScopes) {
+		if r.FormValue(field.FormField) == "true" {
+			grantedScopes = append(grantedScopes, field.Name)
+		}
 	}
 
-	if r.FormValue("share_bio") == "true" {
-		scopes += "," + constants.ReadUserBioScope
+	err = a.service.SaveUserConsent(int64(user.ID), client.ID, grantedScopes)
+	if err != nil {
+		log.Println(err)
+		utils.MapResponse(
+			returnResult, w,
+			&utils.JSONResponseInput{
+				StatusCode: http.StatusOK,
+				Data:       `{"redr": "/error?opt=server_error"}`,
+			},
+			&utils.RedirectResponseInput{
+				StatusCode: http.StatusSeeOther,
+				Location:   "/error?opt=server_error",
+			},
+		)
+
+		return
 	}
 
 	redirectURL, err := a.service.GenerateAuthorizationURL(&oauth2.Config{
 		ClientID:    client.ID,
-		RedirectURL: client.RedirectURI,
-		Scopes:      strings.Split(scopes, ","),
+		RedirectURL: redirectURI,
+		Scopes:      grantedScopes,
 	}, int64(user.ID))
 	if err != nil {
+		log.Println(err)
+		opt := authorizationErrorOpt(err)
 		utils.MapResponse(
 			returnResult, w,
 			&utils.JSONResponseInput{
 				StatusCode: http.StatusOK,
-				Data:       `{"redr": "/error?opt=server_error"}`,
+				Data:       `{"redr": "/error?opt=` + opt + `"}`,
 			},
 			&utils.RedirectResponseInput{
 				StatusCode: http.StatusSeeOther,
-				Location:   "/error?opt=server_error",
+				Location:   "/error?opt=" + opt,
 			},
 		)
 
@@ -232,8 +357,8 @@ func (a *authorizationHandlerImpl) postAuthorizeHandler(w http.ResponseWriter, r
 
 	code, err := a.service.GenerateAuthJwtCode(&oauth2.Config{
 		ClientID:    client.ID,
-		RedirectURL: client.RedirectURI,
-		Scopes:      strings.Split(scopes, ","),
+		RedirectURL: redirectURI,
+		Scopes:      grantedScopes,
 	}, int64(user.ID))
 	if err != nil {
 		utils.MapResponse(
@@ -297,8 +422,7 @@ func (a *authorizationHandlerImpl) postOAauthToken(w http.ResponseWriter, r *htt
 		return
 	}
 
-	// get the client
-	client, err := a.service.GetClient(clientID)
+	err = a.service.AuthenticateClient(clientID, clientSecret)
 	if err != nil {
 		utils.WriteJSONResponse(
 			w,
@@ -308,19 +432,19 @@ func (a *authorizationHandlerImpl) postOAauthToken(w http.ResponseWriter, r *htt
 		return
 	}
 
-	if client.Secret != clientSecret {
+	err = a.service.CheckClientGrantType(clientID, constants.GrantTypeAuthorizationCode)
+	if err != nil {
 		utils.WriteJSONResponse(
 			w,
-			http.StatusUnauthorized,
-			`{"error": "invalid client secret"}`,
+			http.StatusBadRequest,
+			`{"error": "unauthorized_client"}`,
 		)
 		return
 	}
 
 	token, err := a.service.ExchangeCodeForToken(&oauth2.Config{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		RedirectURL:  redirectURI,
+		ClientID:    clientID,
+		RedirectURL: redirectURI,
 	}, code)
 	if err != nil {
 		utils.WriteJSONResponse(
@@ -339,6 +463,163 @@ func (a *authorizationHandlerImpl) postOAauthToken(w http.ResponseWriter, r *htt
 	)
 }
 
+func (a *authorizationHandlerImpl) Device(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		a.getDeviceHandler(w, r)
+	case "POST":
+		a.postDeviceHandler(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getDeviceHandler asks the user for the code shown on their device and, once
+// entered, for consent to the scopes the device requested.
+func (a *authorizationHandlerImpl) getDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		userCode          = r.URL.Query().Get("user_code")
+		scopeDescriptions = []string{}
+		next              = deviceNextURL(userCode)
+	)
+
+	// check that the user is logged in
+	token, err := r.Cookie("token")
+	if token == nil || err != nil {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+
+	user, err := a.service.GetUserByToken(token.Value)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+
+	if userCode == "" {
+		a.parseHTML(w, http.StatusOK, "assets-v1/templates/src/pages/oauth_portal/device.html", map[string]interface{}{
+			"Next": next,
+		})
+		return
+	}
+
+	authorization, err := a.service.GetPendingDeviceAuthorization(userCode)
+	if err != nil {
+		log.Println(err)
+		a.parseHTML(w, http.StatusOK, "assets-v1/templates/src/pages/oauth_portal/device.html", map[string]interface{}{
+			"Error": "The code is invalid or has expired. Check the code shown on your device and try again.",
+			"Next":  next,
+		})
+		return
+	}
+
+	client, err := a.service.GetClient(authorization.ClientID)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/error?opt=invalid_client", http.StatusSeeOther)
+		return
+	}
+
+	requestedScopes, optionalScopes, err := resolveRequestedScopes(authorization.Scopes)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/error?opt=invalid_scope", http.StatusSeeOther)
+		return
+	}
+
+	for _, name := range requestedScopes {
+		scope, _ := constants.LookupScope(name)
+		scopeDescriptions = append(scopeDescriptions, scope.Description)
+	}
+
+	a.parseHTML(w, http.StatusOK, "assets-v1/templates/src/pages/oauth_portal/device.html", map[string]interface{}{
+		"ClientName":     client.Name,
+		"Scopes":         scopeDescriptions,
+		"OptionalScopes": optionalScopeFields(optionalScopes),
+		"UserCode":       authorization.UserCode,
+		"Next":           next,
+	})
+}
+
+// postDeviceHandler records the user's decision on a device authorization.
+// The device picks up the result the next time it polls the token endpoint.
+func (a *authorizationHandlerImpl) postDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		userCode = r.FormValue("user_code")
+		next     = deviceNextURL(userCode)
+	)
+
+	token, err := r.Cookie("token")
+	if token == nil || err != nil {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+
+	user, err := a.service.GetUserByToken(token.Value)
+	if err != nil || user == nil {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+
+	authorization, err := a.service.GetPendingDeviceAuthorization(userCode)
+	if err != nil {
+		log.Println(err)
+		a.parseHTML(w, http.StatusOK, "assets-v1/templates/src/pages/oauth_portal/device.html", map[string]interface{}{
+			"Error": "The code is invalid or has expired. Check the code shown on your device and try again.",
+			"Next":  deviceNextURL(""),
+		})
+		return
+	}
+
+	if r.FormValue("decision") != "allow" {
+		err = a.service.DenyDeviceAuthorization(authorization.UserCode)
+		if err != nil {
+			log.Println(err)
+			http.Redirect(w, r, "/error?opt=server_error", http.StatusSeeOther)
+			return
+		}
+
+		a.parseHTML(w, http.StatusOK, "assets-v1/templates/src/pages/oauth_portal/device.html", map[string]interface{}{
+			"Message": "The device was denied access. You can close this window.",
+			"Next":    deviceNextURL(""),
+		})
+		return
+	}
+
+	requestedScopes, optionalScopes, err := resolveRequestedScopes(authorization.Scopes)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/error?opt=invalid_scope", http.StatusSeeOther)
+		return
+	}
+
+	grantedScopes := requestedScopes
+	for _, field := range optionalScopeFields(optionalScopes) {
+		if r.FormValue(field.FormField) == "true" {
+			grantedScopes = append(grantedScopes, field.Name)
+		}
+	}
+
+	err = a.service.SaveUserConsent(int64(user.ID), authorization.ClientID, grantedScopes)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/error?opt=server_error", http.StatusSeeOther)
+		return
+	}
+
+	err = a.service.ApproveDeviceAuthorization(authorization.UserCode, int64(user.ID), grantedScopes)
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/error?opt="+authorizationErrorOpt(err), http.StatusSeeOther)
+		return
+	}
+
+	a.parseHTML(w, http.StatusOK, "assets-v1/templates/src/pages/oauth_portal/device.html", map[string]interface{}{
+		"Message": "Your device is now connected. You can return to it and close this window.",
+		"Next":    deviceNextURL(""),
+	})
+}
+
 func (a *authorizationHandlerImpl) Error(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
@@ -357,7 +638,9 @@ func (a *authorizationHandlerImpl) getError(w http.ResponseWriter, r *http.Reque
 			"invalid_client":        "The client is invalid.",
 			"access_denied":         "The user denied the request.",
 			"server_error":          "An error occurred on the server.",
-			"redirect_uri_mismatch": "The redirect uri does not match the client's redirect uri.",
+			"redirect_uri_mismatch": "The redirect uri does not match any of the client's registered redirect uris.",
+			"invalid_scope":         "The requested scope is invalid or unknown.",
+			"two_factor_required":   "The application requires two-factor authentication, enable it in your account settings and try again.",
 		}
 	)
 	// add the error to the list of errors
@@ -369,3 +652,62 @@ func (a *authorizationHandlerImpl) getError(w http.ResponseWriter, r *http.Reque
 		"Errors": opts,
 	})
 }
+
+// authorizationErrorOpt is the error page option shown when an authorization
+// could not be granted.
+func authorizationErrorOpt(err error) string {
+	if errors.Is(err, constants.ErrTwoFactorRequired) {
+		return "two_factor_required"
+	}
+	return "server_error"
+}
+
+// optionalScopeField is a child scope the user can choose to share on the consent page.
+type optionalScopeField struct {
+	Name        string
+	Description string
+	FormField   string
+}
+
+// resolveRequestedScopes validates the requested scopes and returns them
+// together with the descendants the user may additionally share.
+func resolveRequestedScopes(scopes string) ([]string, []string, error) {
+	requested := constants.ParseScopes(scopes)
+
+	expanded, err := constants.ExpandScopes(requested)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	optional := []string{}
+	for _, name := range expanded {
+		if !slices.Contains(requested, name) {
+			optional = append(optional, name)
+		}
+	}
+
+	return requested, optional, nil
+}
+
+// optionalScopeFields names the consent form checkbox of each scope after the
+// last segment of the scope, e.g. read:user:bio is shared through share_bio.
+func optionalScopeFields(names []string) []optionalScopeField {
+	fields := []optionalScopeField{}
+	for _, name := range names {
+		scope, _ := constants.LookupScope(name)
+		fields = append(fields, optionalScopeField{
+			Name:        scope.Name,
+			Description: scope.Description,
+			FormField:   "share_" + strings.TrimPrefix(scope.Name, scope.Parent+":"),
+		})
+	}
+	return fields
+}
+
+// deviceNextURL is the device page URL to come back to after logging in.
+func deviceNextURL(userCode string) string {
+	if userCode == "" {
+		return "/device"
+	}
+	return "/device?" + url.Values{"user_code": {userCode}}.Encode()
+}
@@ -0,0 +1,123 @@
+package handlers_test
+
+import (
+	"globe-and-citizen/layer8/server/entities"
+	"globe-and-citizen/layer8/server/handlers"
+	"globe-and-citizen/layer8/server/models"
+	"globe-and-citizen/layer8/server/utils/mocks"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"go.uber.org/mock/gomock"
+	"golang.org/x/oauth2"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	authorizeClientID    = "client-id"
+	authorizeRedirectURI = "https://sp.example/callback"
+	authorizeUserToken   = "user token"
+)
+
+// newAuthorizeRequest is a GET /authorize of a logged in user for the scope.
+func newAuthorizeRequest(scope string) *http.Request {
+	req := httptest.NewRequest("GET", "/authorize?"+url.Values{
+		"client_id":    {authorizeClientID},
+		"scope":        {scope},
+		"redirect_uri": {authorizeRedirectURI},
+	}.Encode(), nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: authorizeUserToken})
+	return req
+}
+
+// expectAuthorizingUser sets up the client and the logged in user the
+// authorize page is requested for.
+func expectAuthorizingUser(serviceMock *mocks.MockServiceInterface) *models.Client {
+	client := &models.Client{ID: authorizeClientID, Name: "Service Provider"}
+
+	serviceMock.EXPECT().GetClient(authorizeClientID).Return(client, nil)
+	serviceMock.EXPECT().ResolveRedirectURI(client, authorizeRedirectURI).Return(authorizeRedirectURI, nil)
+	serviceMock.EXPECT().GetUserByToken(authorizeUserToken).Return(&models.User{ID: 1}, nil)
+
+	return client
+}
+
+func Test_GetAuthorizeHandler_ConsentCoversMoreScopes_IssuesRequestedScopesOnly(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	serviceMock := mocks.NewMockServiceInterface(ctrl)
+	expectAuthorizingUser(serviceMock)
+
+	serviceMock.EXPECT().
+		GetCoveringConsent(int64(1), authorizeClientID, []string{"read:user:is_email_verified"}).
+		Return(&models.UserConsent{Scopes: "read:user,read:user:bio,read:user:is_email_verified"}, nil)
+
+	expectedConfig := &oauth2.Config{
+		ClientID:    authorizeClientID,
+		RedirectURL: authorizeRedirectURI,
+		Scopes:      []string{"read:user:is_email_verified"},
+	}
+	serviceMock.EXPECT().
+		GenerateAuthorizationURL(expectedConfig, int64(1)).
+		Return(&entities.AuthURL{URL: authorizeRedirectURI, Code: "code"}, nil)
+	serviceMock.EXPECT().GenerateAuthJwtCode(expectedConfig, int64(1)).Return("code", nil)
+
+	var renderedPage string
+	handler := handlers.NewAuthorizationHandler(serviceMock, func(w http.ResponseWriter, statusCode int, htmlFile string, params map[string]interface{}) {
+		renderedPage = htmlFile
+	})
+
+	handler.Authorize(httptest.NewRecorder(), newAuthorizeRequest("read:user:is_email_verified"))
+
+	assert.Equal(t, "assets-v1/templates/src/pages/oauth_portal/authorized.html", renderedPage)
+}
+
+func Test_GetAuthorizeHandler_ConsentCoversRequestedScope_IssuesSharedChildren(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	serviceMock := mocks.NewMockServiceInterface(ctrl)
+	expectAuthorizingUser(serviceMock)
+
+	serviceMock.EXPECT().
+		GetCoveringConsent(int64(1), authorizeClientID, []string{"read:user"}).
+		Return(&models.UserConsent{Scopes: "read:user,read:user:bio"}, nil)
+
+	expectedConfig := &oauth2.Config{
+		ClientID:    authorizeClientID,
+		RedirectURL: authorizeRedirectURI,
+		Scopes:      []string{"read:user", "read:user:bio"},
+	}
+	serviceMock.EXPECT().
+		GenerateAuthorizationURL(expectedConfig, int64(1)).
+		Return(&entities.AuthURL{URL: authorizeRedirectURI, Code: "code"}, nil)
+	serviceMock.EXPECT().GenerateAuthJwtCode(expectedConfig, int64(1)).Return("code", nil)
+
+	handler := handlers.NewAuthorizationHandler(serviceMock, func(w http.ResponseWriter, statusCode int, htmlFile string, params map[string]interface{}) {
+		assert.Equal(t, "assets-v1/templates/src/pages/oauth_portal/authorized.html", htmlFile)
+	})
+
+	handler.Authorize(httptest.NewRecorder(), newAuthorizeRequest("read:user"))
+}
+
+func Test_GetAuthorizeHandler_ConsentMissesRequestedScope_AsksForConsent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	serviceMock := mocks.NewMockServiceInterface(ctrl)
+	expectAuthorizingUser(serviceMock)
+
+	serviceMock.EXPECT().
+		GetCoveringConsent(int64(1), authorizeClientID, []string{"read:user:bio"}).
+		Return(nil, nil)
+
+	var renderedPage string
+	handler := handlers.NewAuthorizationHandler(serviceMock, func(w http.ResponseWriter, statusCode int, htmlFile string, params map[string]interface{}) {
+		renderedPage = htmlFile
+	})
+
+	handler.Authorize(httptest.NewRecorder(), newAuthorizeRequest("read:user:bio"))
+
+	assert.Equal(t, "assets-v1/templates/src/pages/oauth_portal/authorize.html", renderedPage)
+}
@@ -2,12 +2,15 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"globe-and-citizen/layer8/server/constants"
 	"globe-and-citizen/layer8/server/entities"
 	svc "globe-and-citizen/layer8/server/internals/service"
 	"globe-and-citizen/layer8/server/resource_server/utils"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
 )
 
@@ -29,26 +32,162 @@ func TokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	authClaims, err := service.DecodeAuthorizationCode(req.ClientSecret, req.AuthorizationCode)
-	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "the authorization code is invalid", err)
+	switch req.GrantType {
+	case constants.GrantTypeAuthorizationCode, constants.GrantTypeClientCredentials, constants.GrantTypeDeviceCode:
+	default:
+		// an omitted grant type is not assumed to be authorization_code,
+		// see RFC 6749 section 5.2
+		utils.HandleError(w, http.StatusBadRequest, constants.ErrUnsupportedGrantType.Error(),
+			fmt.Errorf("%w: %q", constants.ErrUnsupportedGrantType, req.GrantType))
 		return
 	}
 
-	accessToken, err := service.GenerateAccessToken(authClaims, req.ClientUUID, req.ClientSecret)
+	err = service.CheckClientGrantType(req.ClientUUID, req.GrantType)
 	if err != nil {
-		utils.HandleError(w, http.StatusInternalServerError, "internal error when generating the access token", err)
+		utils.HandleError(w, http.StatusBadRequest, "the client is not allowed to use this grant type", err)
 		return
 	}
 
+	var tokenResponse entities.OauthTokenResponse
+	switch req.GrantType {
+	case constants.GrantTypeClientCredentials:
+		scopes := constants.ParseScopes(req.Scope)
+		if len(scopes) == 0 {
+			scopes = constants.ClientScopes()
+		}
+
+		if err := constants.ValidateClientScopes(scopes); err != nil {
+			utils.HandleError(w, http.StatusBadRequest, "the requested scope is invalid", err)
+			return
+		}
+
+		accessToken, err := service.GenerateClientCredentialsToken(req.ClientUUID, scopes)
+		if err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "internal error when generating the access token", err)
+			return
+		}
+
+		tokenResponse = entities.OauthTokenResponse{
+			AccessToken:      accessToken,
+			TokenType:        constants.TokenTypeBearer,
+			ExpiresInMinutes: constants.AccessTokenValidityMinutes,
+			Scope:            strings.Join(scopes, ","),
+		}
+	case constants.GrantTypeDeviceCode:
+		authClaims, err := service.PollDeviceAuthorization(req.ClientUUID, req.DeviceCode)
+		if err != nil {
+			switch {
+			case errors.Is(err, constants.ErrAuthorizationPending),
+				errors.Is(err, constants.ErrSlowDown),
+				errors.Is(err, constants.ErrAccessDenied),
+				errors.Is(err, constants.ErrExpiredToken):
+				// the device tells these apart by the message, see RFC 8628 section 3.5
+				utils.HandleError(w, http.StatusBadRequest, err.Error(), err)
+			default:
+				utils.HandleError(w, http.StatusBadRequest, "the device code is invalid", err)
+			}
+			return
+		}
+
+		accessToken, err := service.GenerateAccessToken(authClaims, req.ClientUUID)
+		if err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "internal error when generating the access token", err)
+			return
+		}
+
+		tokenResponse = entities.OauthTokenResponse{
+			AccessToken:      accessToken,
+			TokenType:        constants.TokenTypeBearer,
+			ExpiresInMinutes: constants.AccessTokenValidityMinutes,
+		}
+	case constants.GrantTypeAuthorizationCode:
+		authClaims, err := service.DecodeAuthorizationCode(req.ClientUUID, req.AuthorizationCode, req.RedirectURI)
+		if err != nil {
+			utils.HandleError(w, http.StatusBadRequest, "the authorization code is invalid", err)
+			return
+		}
+
+		accessToken, err := service.GenerateAccessToken(authClaims, req.ClientUUID)
+		if err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "internal error when generating the access token", err)
+			return
+		}
+
+		tokenResponse = entities.OauthTokenResponse{
+			AccessToken:      accessToken,
+			TokenType:        constants.TokenTypeBearer,
+			ExpiresInMinutes: constants.AccessTokenValidityMinutes,
+		}
+	}
+
 	resp := utils.BuildResponse(
 		w,
 		http.StatusOK,
 		"access token generated successfully",
-		entities.OauthTokenResponse{
-			AccessToken:      accessToken,
-			TokenType:        constants.TokenTypeBearer,
-			ExpiresInMinutes: constants.AccessTokenValidityMinutes,
+		tokenResponse,
+	)
+
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "failed to encode the response", err)
+	}
+}
+
+// DeviceAuthorizationHandler starts the device authorization grant for
+// clients running on devices that cannot open the authorize page themselves.
+func DeviceAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
+
+	req, err := utils.DecodeJsonFromRequest[entities.DeviceAuthorizationRequest](w, r.Body)
+	if err != nil {
+		return
+	}
+
+	service := r.Context().Value("Oauthservice").(svc.ServiceInterface)
+
+	err = service.AuthenticateClient(req.ClientUUID, req.ClientSecret)
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "failed to authenticate client", err)
+		return
+	}
+
+	err = service.CheckClientGrantType(req.ClientUUID, constants.GrantTypeDeviceCode)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "the client is not allowed to use this grant type", err)
+		return
+	}
+
+	// use the default scope if none is provided
+	scopes := constants.ParseScopes(req.Scope)
+	if len(scopes) == 0 {
+		scopes = []string{constants.ReadUserScope}
+	}
+
+	if err := constants.ValidateScopes(scopes); err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "the requested scope is invalid", err)
+		return
+	}
+
+	deviceCode, authorization, err := service.CreateDeviceAuthorization(req.ClientUUID, scopes)
+	if err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "internal error when starting the device authorization", err)
+		return
+	}
+
+	verificationURI := os.Getenv("PROXY_URL") + "/device"
+
+	resp := utils.BuildResponse(
+		w,
+		http.StatusOK,
+		"device authorization started successfully",
+		entities.DeviceAuthorizationResponse{
+			DeviceCode:              deviceCode,
+			UserCode:                authorization.UserCode,
+			VerificationURI:         verificationURI,
+			VerificationURIComplete: verificationURI + "?user_code=" + url.QueryEscape(authorization.UserCode),
+			ExpiresIn:               constants.DeviceCodeValidityMinutes * 60,
+			Interval:                authorization.Interval,
 		},
 	)
 
@@ -85,18 +224,38 @@ func ZkMetadataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	claims, err := service.ValidateAccessToken(req.ClientSecret, accessToken)
+	claims, err := service.ValidateAccessToken(accessToken)
 	if err != nil {
 		utils.HandleError(w, http.StatusUnauthorized, "Failed to validate client access token", err)
 		return
 	}
 
-	zkMetadata, err := service.GetZkUserMetadata(claims.Scopes, claims.UserID)
+	if claims.Audience != req.ClientUUID {
+		errorMsg := "access token was not issued to this client"
+		utils.HandleError(w, http.StatusUnauthorized, errorMsg, fmt.Errorf(errorMsg))
+		return
+	}
+
+	userID, err := service.ResolvePairwiseSubject(req.ClientUUID, claims.Subject)
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Failed to resolve the token subject", err)
+		return
+	}
+
+	err = service.VerifyUserConsent(userID, req.ClientUUID, claims.IssuedAt)
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Access to the user's data was revoked", err)
+		return
+	}
+
+	zkMetadata, err := service.GetZkUserMetadata(req.ClientUUID, claims.Scopes, userID)
 	if err != nil {
 		utils.HandleError(w, http.StatusInternalServerError, "Failed to get user metadata", err)
 		return
 	}
 
+	zkMetadata.Subject = claims.Subject
+
 	resp := utils.BuildResponse(w, http.StatusOK, "User metadata retrieved successfully", zkMetadata)
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
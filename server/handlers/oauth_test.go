@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"globe-and-citizen/layer8/server/constants"
 	"globe-and-citizen/layer8/server/entities"
 	"globe-and-citizen/layer8/server/handlers"
+	"globe-and-citizen/layer8/server/models"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 
+	"github.com/dgrijalva/jwt-go"
+	utilities "github.com/globe-and-citizen/layer8-utils"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,6 +24,7 @@ const authorizationCode = "test_authorization_code"
 const accessToken = "test_access_token"
 const scopes = "color,email_verified"
 const userID = 25
+const pairwiseSubject = "test_pairwise_subject"
 const displayName = "test_display_name"
 const color = "test_color"
 
@@ -86,9 +92,11 @@ func TestTokenHandler_RequiredRequestParametersMissing(t *testing.T) {
 
 func TestTokenHandler_FailedToAuthenticateClient(t *testing.T) {
 	request := []byte(`{
+		"grant_type": "authorization_code",
 		"client_oauth_uuid": "test_uuid", 
 		"client_oauth_secret": "test_secret",
-		"authorization_code": "test_authorization_code"
+		"authorization_code": "test_authorization_code",
+		"redirect_uri": "https://client.com/callback"
 	}`)
 	req, err := http.NewRequest(http.MethodPost, "/api/token", bytes.NewBuffer(request))
 	if err != nil {
@@ -122,6 +130,416 @@ func TestTokenHandler_FailedToAuthenticateClient(t *testing.T) {
 	assert.Equal(t, "failed to authenticate client", response.Message)
 }
 
+func TestTokenHandler_UnsupportedGrantType(t *testing.T) {
+	for _, grantType := range []string{"", "password"} {
+		request := []byte(fmt.Sprintf(`{
+			"grant_type": %q,
+			"client_oauth_uuid": "test_uuid",
+			"client_oauth_secret": "test_secret",
+			"authorization_code": "test_authorization_code",
+			"redirect_uri": "https://client.com/callback"
+		}`, grantType))
+		req, err := http.NewRequest(http.MethodPost, "/api/token", bytes.NewBuffer(request))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mockService := MockService{
+			authenticateClient: func(uuid string, secret string) error {
+				return nil
+			},
+			decodeAuthorizationCode: func(clientID string, code string, redirectURI string) (*utilities.AuthCodeClaims, error) {
+				t.Fatalf("the %q grant type was handled as authorization_code", grantType)
+				return nil, nil
+			},
+		}
+
+		req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", mockService))
+		rr := httptest.NewRecorder()
+
+		handlers.TokenHandler(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+		response := decodeResponseBodyForResponse(t, rr)
+
+		assert.False(t, response.IsSuccess)
+		assert.Equal(t, "unsupported_grant_type", response.Message)
+	}
+}
+
+func TestTokenHandler_AuthorizationCodeRedirectURIMissing(t *testing.T) {
+	request := []byte(`{
+		"grant_type": "authorization_code",
+		"client_oauth_uuid": "test_uuid",
+		"client_oauth_secret": "test_secret",
+		"authorization_code": "test_authorization_code"
+	}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/token", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", MockService{}))
+	rr := httptest.NewRecorder()
+
+	handlers.TokenHandler(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestTokenHandler_AuthorizationCodeTokenServedSuccessfully(t *testing.T) {
+	request := []byte(`{
+		"grant_type": "authorization_code",
+		"client_oauth_uuid": "test_uuid",
+		"client_oauth_secret": "test_secret",
+		"authorization_code": "test_authorization_code",
+		"redirect_uri": "https://client.com/callback"
+	}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/token", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authClaims := &utilities.AuthCodeClaims{ClientID: clientUUID, UserID: userID, Scopes: "read:user"}
+
+	mockService := MockService{
+		authenticateClient: func(uuid string, secret string) error {
+			return nil
+		},
+		decodeAuthorizationCode: func(clientID string, code string, redirectURI string) (*utilities.AuthCodeClaims, error) {
+			assert.Equal(t, clientUUID, clientID)
+			assert.Equal(t, authorizationCode, code)
+			assert.Equal(t, "https://client.com/callback", redirectURI)
+			return authClaims, nil
+		},
+		generateAccessToken: func(claims *utilities.AuthCodeClaims, clientID string) (string, error) {
+			assert.Equal(t, authClaims, claims)
+			return accessToken, nil
+		},
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", mockService))
+	rr := httptest.NewRecorder()
+
+	handlers.TokenHandler(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	response := decodeResponseBodyForResponse(t, rr)
+
+	assert.True(t, response.IsSuccess)
+	assert.Equal(t, accessToken, response.Data.(map[string]interface{})["access_token"])
+}
+
+func TestTokenHandler_GrantTypeNotAllowedForClient(t *testing.T) {
+	request := []byte(`{
+		"grant_type": "client_credentials",
+		"client_oauth_uuid": "test_uuid",
+		"client_oauth_secret": "test_secret",
+		"scope": "read:user"
+	}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/token", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockService := MockService{
+		authenticateClient: func(uuid string, secret string) error {
+			return nil
+		},
+		checkClientGrantType: func(clientID string, grantType string) error {
+			assert.Equal(t, clientUUID, clientID)
+			assert.Equal(t, "client_credentials", grantType)
+			return fmt.Errorf("grant type not registered")
+		},
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", mockService))
+	rr := httptest.NewRecorder()
+
+	handlers.TokenHandler(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	response := decodeResponseBodyForResponse(t, rr)
+
+	assert.False(t, response.IsSuccess)
+	assert.Equal(t, "the client is not allowed to use this grant type", response.Message)
+}
+
+func TestTokenHandler_ClientCredentialsInvalidScope(t *testing.T) {
+	request := []byte(`{
+		"grant_type": "client_credentials",
+		"client_oauth_uuid": "test_uuid",
+		"client_oauth_secret": "test_secret",
+		"scope": "read:user"
+	}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/token", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockService := MockService{
+		authenticateClient: func(uuid string, secret string) error {
+			return nil
+		},
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", mockService))
+	rr := httptest.NewRecorder()
+
+	handlers.TokenHandler(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	response := decodeResponseBodyForResponse(t, rr)
+
+	assert.False(t, response.IsSuccess)
+	assert.Equal(t, "the requested scope is invalid", response.Message)
+}
+
+func TestTokenHandler_ClientCredentialsTokenServedSuccessfully(t *testing.T) {
+	request := []byte(`{
+		"grant_type": "client_credentials",
+		"client_oauth_uuid": "test_uuid",
+		"client_oauth_secret": "test_secret",
+		"scope": "client:read:usage_stats"
+	}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/token", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockService := MockService{
+		authenticateClient: func(uuid string, secret string) error {
+			return nil
+		},
+		generateClientCredentialsToken: func(clientID string, scopes []string) (string, error) {
+			assert.Equal(t, clientUUID, clientID)
+			assert.Equal(t, []string{constants.ClientReadUsageStatsScope}, scopes)
+			return "client_credentials_token", nil
+		},
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", mockService))
+	rr := httptest.NewRecorder()
+
+	handlers.TokenHandler(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	response := decodeResponseBodyForResponse(t, rr)
+
+	assert.True(t, response.IsSuccess)
+
+	resp := response.Data.(map[string]interface{})
+
+	assert.Equal(t, "client_credentials_token", resp["access_token"])
+	assert.Equal(t, constants.ClientReadUsageStatsScope, resp["scope"])
+}
+
+func TestTokenHandler_ClientCredentialsDefaultsToAllClientScopes(t *testing.T) {
+	request := []byte(`{
+		"grant_type": "client_credentials",
+		"client_oauth_uuid": "test_uuid",
+		"client_oauth_secret": "test_secret"
+	}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/token", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockService := MockService{
+		authenticateClient: func(uuid string, secret string) error {
+			return nil
+		},
+		generateClientCredentialsToken: func(clientID string, scopes []string) (string, error) {
+			assert.Equal(t, constants.ClientScopes(), scopes)
+			return "client_credentials_token", nil
+		},
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", mockService))
+	rr := httptest.NewRecorder()
+
+	handlers.TokenHandler(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestTokenHandler_DeviceCodeAuthorizationPending(t *testing.T) {
+	request := []byte(`{
+		"grant_type": "urn:ietf:params:oauth:grant-type:device_code",
+		"client_oauth_uuid": "test_uuid",
+		"client_oauth_secret": "test_secret",
+		"device_code": "test_device_code"
+	}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/token", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockService := MockService{
+		authenticateClient: func(uuid string, secret string) error {
+			return nil
+		},
+		pollDeviceAuthorization: func(clientID string, deviceCode string) (*utilities.AuthCodeClaims, error) {
+			assert.Equal(t, clientUUID, clientID)
+			assert.Equal(t, "test_device_code", deviceCode)
+			return nil, constants.ErrAuthorizationPending
+		},
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", mockService))
+	rr := httptest.NewRecorder()
+
+	handlers.TokenHandler(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	response := decodeResponseBodyForResponse(t, rr)
+
+	assert.False(t, response.IsSuccess)
+	assert.Equal(t, "authorization_pending", response.Message)
+}
+
+func TestTokenHandler_DeviceCodeMissing(t *testing.T) {
+	request := []byte(`{
+		"grant_type": "urn:ietf:params:oauth:grant-type:device_code",
+		"client_oauth_uuid": "test_uuid",
+		"client_oauth_secret": "test_secret"
+	}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/token", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", MockService{}))
+	rr := httptest.NewRecorder()
+
+	handlers.TokenHandler(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	response := decodeResponseBodyForResponse(t, rr)
+
+	assert.Equal(t, "Input json is invalid", response.Message)
+}
+
+func TestTokenHandler_DeviceCodeTokenServedSuccessfully(t *testing.T) {
+	request := []byte(`{
+		"grant_type": "urn:ietf:params:oauth:grant-type:device_code",
+		"client_oauth_uuid": "test_uuid",
+		"client_oauth_secret": "test_secret",
+		"device_code": "test_device_code"
+	}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/token", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authClaims := &utilities.AuthCodeClaims{ClientID: clientUUID, UserID: userID, Scopes: "read:user"}
+
+	mockService := MockService{
+		authenticateClient: func(uuid string, secret string) error {
+			return nil
+		},
+		pollDeviceAuthorization: func(clientID string, deviceCode string) (*utilities.AuthCodeClaims, error) {
+			return authClaims, nil
+		},
+		generateAccessToken: func(claims *utilities.AuthCodeClaims, clientID string) (string, error) {
+			assert.Equal(t, authClaims, claims)
+			return accessToken, nil
+		},
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", mockService))
+	rr := httptest.NewRecorder()
+
+	handlers.TokenHandler(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	response := decodeResponseBodyForResponse(t, rr)
+
+	assert.True(t, response.IsSuccess)
+	assert.Equal(t, accessToken, response.Data.(map[string]interface{})["access_token"])
+}
+
+func TestDeviceAuthorizationHandler_InvalidScope(t *testing.T) {
+	request := []byte(`{
+		"client_oauth_uuid": "test_uuid",
+		"client_oauth_secret": "test_secret",
+		"scope": "write:user"
+	}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/device-authorization", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockService := MockService{
+		authenticateClient: func(uuid string, secret string) error {
+			return nil
+		},
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", mockService))
+	rr := httptest.NewRecorder()
+
+	handlers.DeviceAuthorizationHandler(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	response := decodeResponseBodyForResponse(t, rr)
+
+	assert.Equal(t, "the requested scope is invalid", response.Message)
+}
+
+func TestDeviceAuthorizationHandler_Success(t *testing.T) {
+	os.Setenv("PROXY_URL", "https://layer8.example")
+	defer os.Unsetenv("PROXY_URL")
+
+	request := []byte(`{
+		"client_oauth_uuid": "test_uuid",
+		"client_oauth_secret": "test_secret"
+	}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/device-authorization", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockService := MockService{
+		authenticateClient: func(uuid string, secret string) error {
+			return nil
+		},
+		createDeviceAuthorization: func(clientID string, scopes []string) (string, *models.DeviceAuthorization, error) {
+			assert.Equal(t, clientUUID, clientID)
+			assert.Equal(t, []string{constants.ReadUserScope}, scopes)
+			return "test_device_code", &models.DeviceAuthorization{
+				UserCode: "BCDF-GHJK",
+				Interval: constants.DevicePollingIntervalSeconds,
+			}, nil
+		},
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", mockService))
+	rr := httptest.NewRecorder()
+
+	handlers.DeviceAuthorizationHandler(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	response := decodeResponseBodyForResponse(t, rr)
+	resp := response.Data.(map[string]interface{})
+
+	assert.Equal(t, "test_device_code", resp["device_code"])
+	assert.Equal(t, "BCDF-GHJK", resp["user_code"])
+	assert.Equal(t, "https://layer8.example/device", resp["verification_uri"])
+	assert.Equal(t, "https://layer8.example/device?user_code=BCDF-GHJK", resp["verification_uri_complete"])
+	assert.Equal(t, float64(constants.DeviceCodeValidityMinutes*60), resp["expires_in"])
+}
+
 // func TestTokenHandler_FailedToVerifyAuthorizationCode(t *testing.T) {
 // 	request := []byte(`{
 // 		"client_oauth_uuid": "test_uuid",
@@ -451,10 +869,7 @@ func TestZkMetadataHandler_FailedToValidateAccessToken(t *testing.T) {
 
 			return nil
 		},
-		validateAccessToken: func(secret string, token string) (*entities.ClientClaims, error) {
-			if secret != clientSecret {
-				t.Fatalf("Invalid secret, expected: %s, got: %s", clientSecret, secret)
-			}
+		validateAccessToken: func(token string) (*entities.ClientClaims, error) {
 			if token != accessToken {
 				t.Fatalf("Invalid access token, expected: %s, got: %s", accessToken, token)
 			}
@@ -478,6 +893,136 @@ func TestZkMetadataHandler_FailedToValidateAccessToken(t *testing.T) {
 	assert.Equal(t, "Failed to validate client access token", response.Message)
 }
 
+func TestZkMetadataHandler_AccessTokenIssuedToAnotherClient(t *testing.T) {
+	request := []byte(`{
+		"client_oauth_uuid": "test_uuid",
+		"client_oauth_secret": "test_secret"
+	}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/zk-metadata", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockService := MockService{
+		authenticateClient: func(uuid string, secret string) error {
+			return nil
+		},
+		validateAccessToken: func(token string) (*entities.ClientClaims, error) {
+			return &entities.ClientClaims{
+				StandardClaims: jwt.StandardClaims{
+					Subject:  pairwiseSubject,
+					Audience: "another_client_uuid",
+				},
+				Scopes: scopes,
+			}, nil
+		},
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", mockService))
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	rr := httptest.NewRecorder()
+
+	handlers.ZkMetadataHandler(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	response := decodeResponseBodyForResponse(t, rr)
+
+	assert.False(t, response.IsSuccess)
+	assert.Equal(t, "access token was not issued to this client", response.Message)
+}
+
+func TestZkMetadataHandler_FailedToResolvePairwiseSubject(t *testing.T) {
+	request := []byte(`{
+		"client_oauth_uuid": "test_uuid",
+		"client_oauth_secret": "test_secret"
+	}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/zk-metadata", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockService := MockService{
+		authenticateClient: func(uuid string, secret string) error {
+			return nil
+		},
+		validateAccessToken: func(token string) (*entities.ClientClaims, error) {
+			return &entities.ClientClaims{
+				StandardClaims: jwt.StandardClaims{
+					Subject:  pairwiseSubject,
+					Audience: clientUUID,
+				},
+				Scopes: scopes,
+			}, nil
+		},
+		resolvePairwiseSubject: func(clientID string, subject string) (int64, error) {
+			return 0, fmt.Errorf("record not found")
+		},
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", mockService))
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	rr := httptest.NewRecorder()
+
+	handlers.ZkMetadataHandler(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	response := decodeResponseBodyForResponse(t, rr)
+
+	assert.False(t, response.IsSuccess)
+	assert.NotNil(t, response.Error)
+	assert.Equal(t, "Failed to resolve the token subject", response.Message)
+}
+
+func TestZkMetadataHandler_UserConsentRevoked(t *testing.T) {
+	request := []byte(`{
+		"client_oauth_uuid": "test_uuid",
+		"client_oauth_secret": "test_secret"
+	}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/zk-metadata", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockService := MockService{
+		authenticateClient: func(uuid string, secret string) error {
+			return nil
+		},
+		validateAccessToken: func(token string) (*entities.ClientClaims, error) {
+			return &entities.ClientClaims{
+				StandardClaims: jwt.StandardClaims{
+					Subject:  pairwiseSubject,
+					Audience: clientUUID,
+				},
+				Scopes: scopes,
+			}, nil
+		},
+		resolvePairwiseSubject: func(clientID string, subject string) (int64, error) {
+			return userID, nil
+		},
+		verifyUserConsent: func(userId int64, clientID string, issuedAt int64) error {
+			return fmt.Errorf("no active consent for the client")
+		},
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", mockService))
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	rr := httptest.NewRecorder()
+
+	handlers.ZkMetadataHandler(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	response := decodeResponseBodyForResponse(t, rr)
+
+	assert.False(t, response.IsSuccess)
+	assert.Equal(t, "Access to the user's data was revoked", response.Message)
+}
+
 func TestZkMetadataHandler_FailedToGetZkUserMetadata(t *testing.T) {
 	request := []byte(`{
 		"client_oauth_uuid": "test_uuid",
@@ -499,20 +1044,38 @@ func TestZkMetadataHandler_FailedToGetZkUserMetadata(t *testing.T) {
 
 			return nil
 		},
-		validateAccessToken: func(secret string, token string) (*entities.ClientClaims, error) {
-			if secret != clientSecret {
-				t.Fatalf("Invalid secret, expected: %s, got: %s", clientSecret, secret)
-			}
+		validateAccessToken: func(token string) (*entities.ClientClaims, error) {
 			if token != accessToken {
 				t.Fatalf("Invalid access token, expected: %s, got: %s", accessToken, token)
 			}
 
 			return &entities.ClientClaims{
+				StandardClaims: jwt.StandardClaims{
+					Subject:  pairwiseSubject,
+					Audience: clientUUID,
+				},
 				Scopes: scopes,
-				UserID: userID,
 			}, nil
 		},
-		getZkUserMetadata: func(scopesStr string, userId int64) (*entities.ZkMetadataResponse, error) {
+		resolvePairwiseSubject: func(clientID string, subject string) (int64, error) {
+			if clientID != clientUUID {
+				t.Fatalf("Invalid client id, expected: %s, got: %s", clientUUID, clientID)
+			}
+			if subject != pairwiseSubject {
+				t.Fatalf("Invalid subject, expected: %s, got: %s", pairwiseSubject, subject)
+			}
+			return userID, nil
+		},
+		verifyUserConsent: func(userId int64, clientID string, issuedAt int64) error {
+			if userId != userID {
+				t.Fatalf("Invalid user id, expected: %d, got: %d", userID, userId)
+			}
+			return nil
+		},
+		getZkUserMetadata: func(clientID string, scopesStr string, userId int64) (*entities.ZkMetadataResponse, error) {
+			if clientID != clientUUID {
+				t.Fatalf("Invalid client id, expected: %s, got: %s", clientUUID, clientID)
+			}
 			if scopesStr != scopes {
 				t.Fatalf("Invalid scopes, expected: %s, got: %s", scopes, scopesStr)
 			}
@@ -561,20 +1124,38 @@ func TestZkMetadataHandler_UserZkMetadataServedSuccessfully(t *testing.T) {
 
 			return nil
 		},
-		validateAccessToken: func(secret string, token string) (*entities.ClientClaims, error) {
-			if secret != clientSecret {
-				t.Fatalf("Invalid secret, expected: %s, got: %s", clientSecret, secret)
-			}
+		validateAccessToken: func(token string) (*entities.ClientClaims, error) {
 			if token != accessToken {
 				t.Fatalf("Invalid access token, expected: %s, got: %s", accessToken, token)
 			}
 
 			return &entities.ClientClaims{
+				StandardClaims: jwt.StandardClaims{
+					Subject:  pairwiseSubject,
+					Audience: clientUUID,
+				},
 				Scopes: scopes,
-				UserID: userID,
 			}, nil
 		},
-		getZkUserMetadata: func(scopesStr string, userId int64) (*entities.ZkMetadataResponse, error) {
+		resolvePairwiseSubject: func(clientID string, subject string) (int64, error) {
+			if clientID != clientUUID {
+				t.Fatalf("Invalid client id, expected: %s, got: %s", clientUUID, clientID)
+			}
+			if subject != pairwiseSubject {
+				t.Fatalf("Invalid subject, expected: %s, got: %s", pairwiseSubject, subject)
+			}
+			return userID, nil
+		},
+		verifyUserConsent: func(userId int64, clientID string, issuedAt int64) error {
+			if userId != userID {
+				t.Fatalf("Invalid user id, expected: %d, got: %d", userID, userId)
+			}
+			return nil
+		},
+		getZkUserMetadata: func(clientID string, scopesStr string, userId int64) (*entities.ZkMetadataResponse, error) {
+			if clientID != clientUUID {
+				t.Fatalf("Invalid client id, expected: %s, got: %s", clientUUID, clientID)
+			}
 			if scopesStr != scopes {
 				t.Fatalf("Invalid scopes, expected: %s, got: %s", scopes, scopesStr)
 			}
@@ -607,6 +1188,7 @@ func TestZkMetadataHandler_UserZkMetadataServedSuccessfully(t *testing.T) {
 
 	resp := response.Data.(map[string]interface{})
 
+	assert.Equal(t, pairwiseSubject, resp["sub"])
 	assert.Equal(t, true, resp["is_email_verified"])
 	assert.Equal(t, displayName, resp["display_name"])
 	assert.Equal(t, color, resp["color"])
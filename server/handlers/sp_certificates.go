@@ -3,6 +3,7 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
+	"globe-and-citizen/layer8/server/constants"
 	"globe-and-citizen/layer8/server/entities"
 	svc "globe-and-citizen/layer8/server/internals/service"
 	"globe-and-citizen/layer8/server/resource_server/utils"
@@ -31,7 +32,9 @@ func UploadSPCertificate(w http.ResponseWriter, r *http.Request) {
 	}
 	token = token[7:]
 
-	clientClaims, err := utils.ValidateClientToken(token)
+	service := r.Context().Value("Oauthservice").(svc.ServiceInterface)
+
+	clientClaims, err := service.ValidateClientTokenWithScope(token, constants.ClientWriteCertificateScope)
 	if err != nil {
 		utils.HandleError(
 			w,
@@ -47,8 +50,6 @@ func UploadSPCertificate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	service := r.Context().Value("Oauthservice").(svc.ServiceInterface)
-
 	err = service.SaveX509Certificate(clientClaims.ClientID, req.Certificate)
 	if err != nil {
 		utils.HandleError(w, http.StatusInternalServerError, "failed to save the SP x.509 certificate", err)
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"globe-and-citizen/layer8/server/constants"
 	"globe-and-citizen/layer8/server/entities"
 	"globe-and-citizen/layer8/server/internals/repository"
 	svc "globe-and-citizen/layer8/server/internals/service"
@@ -33,30 +34,54 @@ var mockService = &svc.Service{
 }
 
 type MockService struct {
-	getUserByToken           func(token string) (*models.User, error)
-	loginUser                func(username, password string) (map[string]interface{}, error)
-	generateAuthorizationURL func(config *oauth2.Config, userID int64) (*entities.AuthURL, error)
-	exchangeCodeForToken     func(config *oauth2.Config, code string) (*oauth2.Token, error)
-	accessResourcesWithToken func(token string) (map[string]interface{}, error)
-	getClient                func(id string) (*models.Client, error)
-	verifyToken              func(token string) (isvalid bool, err error)
-	checkClient              func(backendURL string) (*models.Client, error)
-	saveX509Certificate      func(clientID string, certificate string) error
-	decodeAuthorizationCode  func(secret string, code string) (*utilities.AuthCodeClaims, error)
-	authenticateClient       func(uuid string, secret string) error
-	generateAccessToken      func(authClaims *utilities.AuthCodeClaims, clientID string, clientSecret string) (string, error)
-	validateAccessToken      func(clientSecret string, accessToken string) (*entities.ClientClaims, error)
-	getZkUserMetadata        func(scopesStr string, userID int64) (*entities.ZkMetadataResponse, error)
-	addTestClient            func() (*models.Client, error)
-	generateAuthJwtCode      func(config *oauth2.Config, userID int64) (string, error)
+	getUserByToken                 func(token string) (*models.User, error)
+	loginUser                      func(req entities.LoginRequest) (map[string]interface{}, error)
+	generateAuthorizationURL       func(config *oauth2.Config, userID int64) (*entities.AuthURL, error)
+	exchangeCodeForToken           func(config *oauth2.Config, code string) (*oauth2.Token, error)
+	accessResourcesWithToken       func(token string) (map[string]interface{}, error)
+	getClient                      func(id string) (*models.Client, error)
+	verifyToken                    func(token string) (isvalid bool, err error)
+	checkClient                    func(backendURL string) (*models.Client, error)
+	saveX509Certificate            func(clientID string, certificate string) error
+	decodeAuthorizationCode        func(clientID string, code string, redirectURI string) (*utilities.AuthCodeClaims, error)
+	authenticateClient             func(uuid string, secret string) error
+	generateAccessToken            func(authClaims *utilities.AuthCodeClaims, clientID string) (string, error)
+	validateAccessToken            func(accessToken string) (*entities.ClientClaims, error)
+	validateClientTokenWithScope   func(tokenString string, scope string) (*resourceModels.ClientClaims, error)
+	checkClientGrantType           func(clientID string, grantType string) error
+	getZkUserMetadata              func(clientID string, scopesStr string, userID int64) (*entities.ZkMetadataResponse, error)
+	addTestClient                  func() (*models.Client, error)
+	generateAuthJwtCode            func(config *oauth2.Config, userID int64) (string, error)
+	getPairwiseSubject             func(clientID string, userID int64) (string, error)
+	resolvePairwiseSubject         func(clientID string, subject string) (int64, error)
+	saveUserConsent                func(userID int64, clientID string, scopes []string) error
+	getCoveringConsent             func(userID int64, clientID string, scopes []string) (*models.UserConsent, error)
+	verifyUserConsent              func(userID int64, clientID string, issuedAt int64) error
+	resolveRedirectURI             func(client *models.Client, requested string) (string, error)
+	generateClientCredentialsToken func(clientID string, scopes []string) (string, error)
+	createDeviceAuthorization      func(clientID string, scopes []string) (string, *models.DeviceAuthorization, error)
+	getPendingDeviceAuthorization  func(userCode string) (*models.DeviceAuthorization, error)
+	approveDeviceAuthorization     func(userCode string, userID int64, scopes []string) error
+	denyDeviceAuthorization        func(userCode string) error
+	pollDeviceAuthorization        func(clientID string, deviceCode string) (*utilities.AuthCodeClaims, error)
+	loginTwoFactor                 func(req entities.TwoFactorLoginRequest) (map[string]interface{}, error)
+	loginPasskey                   func(req entities.PasskeyLoginRequest) (map[string]interface{}, error)
 }
 
 func (m MockService) GetUserByToken(token string) (*models.User, error) {
 	return m.getUserByToken(token)
 }
 
-func (m MockService) LoginUser(username, password string) (map[string]interface{}, error) {
-	return m.loginUser(username, password)
+func (m MockService) LoginUser(req entities.LoginRequest) (map[string]interface{}, error) {
+	return m.loginUser(req)
+}
+
+func (m MockService) LoginTwoFactor(req entities.TwoFactorLoginRequest) (map[string]interface{}, error) {
+	return m.loginTwoFactor(req)
+}
+
+func (m MockService) LoginPasskey(req entities.PasskeyLoginRequest) (map[string]interface{}, error) {
+	return m.loginPasskey(req)
 }
 
 func (m MockService) GenerateAuthorizationURL(config *oauth2.Config, userID int64) (*entities.AuthURL, error) {
@@ -87,28 +112,100 @@ func (m MockService) SaveX509Certificate(clientID string, certificate string) er
 	return m.saveX509Certificate(clientID, certificate)
 }
 
-func (m MockService) DecodeAuthorizationCode(secret string, code string) (*utilities.AuthCodeClaims, error) {
-	return m.decodeAuthorizationCode(secret, code)
+func (m MockService) DecodeAuthorizationCode(
+	clientID string, code string, redirectURI string,
+) (*utilities.AuthCodeClaims, error) {
+	return m.decodeAuthorizationCode(clientID, code, redirectURI)
 }
 
 func (m MockService) AuthenticateClient(uuid string, secret string) error {
 	return m.authenticateClient(uuid, secret)
 }
 
-func (m MockService) GenerateAccessToken(authClaims *utilities.AuthCodeClaims, clientID string, clientSecret string) (string, error) {
-	return m.generateAccessToken(authClaims, clientID, clientSecret)
+func (m MockService) GenerateAccessToken(authClaims *utilities.AuthCodeClaims, clientID string) (string, error) {
+	return m.generateAccessToken(authClaims, clientID)
+}
+
+func (m MockService) CheckClientGrantType(clientID string, grantType string) error {
+	// clients created through the portal may use every grant
+	if m.checkClientGrantType == nil {
+		return nil
+	}
+	return m.checkClientGrantType(clientID, grantType)
 }
 
 func (m MockService) GenerateAuthJwtCode(config *oauth2.Config, userID int64) (string, error) {
 	return m.generateAuthJwtCode(config, userID)
 }
 
-func (m MockService) ValidateAccessToken(clientSecret string, accessToken string) (*entities.ClientClaims, error) {
-	return m.validateAccessToken(clientSecret, accessToken)
+func (m MockService) ValidateAccessToken(accessToken string) (*entities.ClientClaims, error) {
+	return m.validateAccessToken(accessToken)
+}
+
+func (m MockService) ValidateClientTokenWithScope(tokenString string, scope string) (*resourceModels.ClientClaims, error) {
+	if m.validateClientTokenWithScope != nil {
+		return m.validateClientTokenWithScope(tokenString, scope)
+	}
+	return utils.ValidateClientTokenWithScope(liveSessions{}, tokenString, scope)
+}
+
+// liveSessions keeps the session of every token live.
+type liveSessions struct{}
+
+func (liveSessions) TouchSession(jti string, now time.Time) error {
+	return nil
+}
+
+func (m MockService) GetZkUserMetadata(clientID string, scopesStr string, userID int64) (*entities.ZkMetadataResponse, error) {
+	return m.getZkUserMetadata(clientID, scopesStr, userID)
 }
 
-func (m MockService) GetZkUserMetadata(scopesStr string, userID int64) (*entities.ZkMetadataResponse, error) {
-	return m.getZkUserMetadata(scopesStr, userID)
+func (m MockService) GetPairwiseSubject(clientID string, userID int64) (string, error) {
+	return m.getPairwiseSubject(clientID, userID)
+}
+
+func (m MockService) ResolvePairwiseSubject(clientID string, subject string) (int64, error) {
+	return m.resolvePairwiseSubject(clientID, subject)
+}
+
+func (m MockService) SaveUserConsent(userID int64, clientID string, scopes []string) error {
+	return m.saveUserConsent(userID, clientID, scopes)
+}
+
+func (m MockService) GetCoveringConsent(userID int64, clientID string, scopes []string) (*models.UserConsent, error) {
+	return m.getCoveringConsent(userID, clientID, scopes)
+}
+
+func (m MockService) VerifyUserConsent(userID int64, clientID string, issuedAt int64) error {
+	return m.verifyUserConsent(userID, clientID, issuedAt)
+}
+
+func (m MockService) GenerateClientCredentialsToken(clientID string, scopes []string) (string, error) {
+	return m.generateClientCredentialsToken(clientID, scopes)
+}
+
+func (m MockService) CreateDeviceAuthorization(clientID string, scopes []string) (string, *models.DeviceAuthorization, error) {
+	return m.createDeviceAuthorization(clientID, scopes)
+}
+
+func (m MockService) GetPendingDeviceAuthorization(userCode string) (*models.DeviceAuthorization, error) {
+	return m.getPendingDeviceAuthorization(userCode)
+}
+
+func (m MockService) ApproveDeviceAuthorization(userCode string, userID int64, scopes []string) error {
+	return m.approveDeviceAuthorization(userCode, userID, scopes)
+}
+
+func (m MockService) DenyDeviceAuthorization(userCode string) error {
+	return m.denyDeviceAuthorization(userCode)
+}
+
+func (m MockService) PollDeviceAuthorization(clientID string, deviceCode string) (*utilities.AuthCodeClaims, error) {
+	return m.pollDeviceAuthorization(clientID, deviceCode)
+}
+
+func (m MockService) ResolveRedirectURI(client *models.Client, requested string) (string, error) {
+	return m.resolveRedirectURI(client, requested)
 }
 
 func (m MockService) AddTestClient() (*models.Client, error) {
@@ -276,6 +373,33 @@ func TestUploadSPCertificate_InvalidAuthorizationToken(t *testing.T) {
 	assert.Equal(t, http.StatusUnauthorized, rr.Code)
 }
 
+func TestUploadSPCertificate_SessionRevoked(t *testing.T) {
+	request := []byte(`{"certificate": "x509 certificate"}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/upload-certificate", bytes.NewBuffer(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := MockService{
+		validateClientTokenWithScope: func(tokenString string, scope string) (*resourceModels.ClientClaims, error) {
+			return nil, constants.ErrSessionRevoked
+		},
+		saveX509Certificate: func(clientID string, certificate string) error {
+			t.Fatal("a revoked session must not save a certificate")
+			return nil
+		},
+	}
+
+	req = req.WithContext(context.WithValue(context.Background(), "Oauthservice", service))
+	req.Header.Set("Authorization", "Bearer "+generateJwtToken())
+
+	rr := httptest.NewRecorder()
+
+	Ctl.UploadSPCertificate(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
 func TestUploadSPCertificate_InvalidRequestSchema(t *testing.T) {
 	request := []byte(`{somethingelse}`)
 	req, err := http.NewRequest(http.MethodPost, "/api/upload-certificate", bytes.NewBuffer(request))
@@ -405,6 +529,7 @@ func generateJwtToken() string {
 		UserName: "username",
 		ClientID: clientId,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "session_jti",
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(60 * time.Minute)),
 			Issuer:    "GlobeAndCitizen",
 		},
@@ -14,12 +14,46 @@ type Repository interface {
 	// Get user from db by username
 	GetUser(username string) (*models.User, error)
 
+	// ConsumeScramSession deletes the unexpired login session issued to
+	// principal and username for the nonces. It returns gorm.ErrRecordNotFound
+	// if there is none.
+	ConsumeScramSession(principal string, username string, nonce string, cNonce string, now time.Time) error
+
+	// GetTwoFactorCredential gets the authenticator enrolled by principal
+	// and username.
+	GetTwoFactorCredential(principal string, username string) (*models.TwoFactorCredential, error)
+
+	// UseTwoFactorStep and UseTwoFactorRecoveryCode mark a code as used,
+	// see totp.Store.
+	UseTwoFactorStep(credentialID uint, step int64) error
+	UseTwoFactorRecoveryCode(credentialID uint, codeHash string, usedAt time.Time) error
+
+	// GetPasskey gets the passkey the authenticator knows by credentialID.
+	GetPasskey(credentialID string) (*models.Passkey, error)
+
+	// ConsumeWebAuthnChallenge and UseWebAuthnCredential check a login with
+	// a passkey, see webauthn.Store.
+	ConsumeWebAuthnChallenge(ceremony string, challenge string, userID uint, now time.Time) error
+	UseWebAuthnCredential(id uint, signCount uint32, usedAt time.Time) error
+
 	// GetUserByID gets a user by ID.
 	GetUserByID(id int64) (*models.User, error)
 
 	// GetUserMetadata gets a user metadata by key.
 	GetUserMetadata(userID int64) (*models.UserMetadata, error)
 
+	// GetUserEmailDomain gets the domain of the user's verified email
+	// address. It returns gorm.ErrRecordNotFound if there is none.
+	GetUserEmailDomain(userID int64) (*models.UserEmailDomain, error)
+
+	// GetEmailDomainProofs gets the proofs of the domain of the user's
+	// verified email address made for a client.
+	GetEmailDomainProofs(userID int64, clientID string) ([]models.EmailDomainProof, error)
+
+	// SaveEmailDomainProofs stores proofs made for a client, leaving the
+	// proofs of the same set already stored untouched.
+	SaveEmailDomainProofs(proofs []models.EmailDomainProof) error
+
 	// Set a client for testing purposes
 	SetClient(client *models.Client) error
 
@@ -31,6 +65,58 @@ type Repository interface {
 	// SaveX509Certificate saves the x509 certificate per client
 	SaveX509Certificate(clientID string, certificate string) error
 
+	// SavePairwiseSubject stores the subject derived for a (client, user) pair,
+	// leaving an already stored mapping untouched.
+	SavePairwiseSubject(subject *models.PairwiseSubject) error
+
+	// GetPairwiseSubject looks up the mapping for a subject issued to the given client.
+	GetPairwiseSubject(clientID string, subject string) (*models.PairwiseSubject, error)
+
+	// SaveUserConsent creates the user's consent for a client or replaces the
+	// scopes and grant time of the existing one.
+	SaveUserConsent(consent *models.UserConsent) error
+
+	// GetUserConsent gets the consent the user granted to a client.
+	GetUserConsent(userID int64, clientID string) (*models.UserConsent, error)
+
+	// UpdateUserConsentLastUsedAt records when a client last used the user's consent.
+	UpdateUserConsentLastUsedAt(userID int64, clientID string, lastUsedAt time.Time) error
+
+	// GetClientRedirectURIs gets the redirect URIs registered for a client.
+	GetClientRedirectURIs(clientID string) ([]string, error)
+
+	// SaveDeviceAuthorization creates a device authorization.
+	SaveDeviceAuthorization(authorization *models.DeviceAuthorization) error
+
+	// DecideDeviceAuthorization records the user's decision on a pending device authorization.
+	DecideDeviceAuthorization(userCode string, status string, userID *uint, scopes string) error
+
+	// RecordDeviceAuthorizationPoll records a device polling a pending device authorization.
+	RecordDeviceAuthorizationPoll(deviceCodeHash string, lastPolledAt time.Time, interval int) error
+
+	// GetDeviceAuthorizationByUserCode gets the device authorization the user code was issued for.
+	GetDeviceAuthorizationByUserCode(userCode string) (*models.DeviceAuthorization, error)
+
+	// GetDeviceAuthorizationByDeviceCodeHash gets the device authorization a device is polling for.
+	GetDeviceAuthorizationByDeviceCodeHash(deviceCodeHash string) (*models.DeviceAuthorization, error)
+
+	// DeleteDeviceAuthorization deletes a device authorization once it can no longer be redeemed.
+	DeleteDeviceAuthorization(id uint) error
+
+	// CreateSession starts the session of an access token.
+	CreateSession(session *models.Session) error
+
+	// TouchSession records the use of a live session, see
+	// rs_utils.SessionStore.
+	TouchSession(jti string, now time.Time) error
+
+	// SaveDataAccessRecord records a release of user metadata to a client.
+	SaveDataAccessRecord(record *models.DataAccessRecord) error
+
+	// UseAuthorizationCode records that the authorization code with the jti
+	// was redeemed. It returns gorm.ErrDuplicatedKey if it already was.
+	UseAuthorizationCode(jti string, expiresAt time.Time, now time.Time) error
+
 	// SetTTL sets the value for the given key with a short TTL.
 	SetTTL(key string, value []byte, ttl time.Duration) error
 
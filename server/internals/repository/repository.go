@@ -2,11 +2,13 @@ package repository
 
 import (
 	"fmt"
+	"globe-and-citizen/layer8/server/constants"
 	"globe-and-citizen/layer8/server/models"
 	"strings"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type PostgresRepository struct {
@@ -40,6 +42,110 @@ func (r *PostgresRepository) GetUser(username string) (*models.User, error) {
 	return &user, nil
 }
 
+// ConsumeScramSession deletes the session in the same statement that finds
+// it, so two logins cannot both use it.
+func (r *PostgresRepository) ConsumeScramSession(
+	principal string, username string, nonce string, cNonce string, now time.Time,
+) error {
+	result := r.db.
+		Where(
+			"principal = ? AND username = ? AND nonce = ? AND c_nonce = ? AND expires_at > ?",
+			principal, username, nonce, cNonce, now,
+		).
+		Delete(&models.ScramSession{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *PostgresRepository) GetTwoFactorCredential(principal string, username string) (*models.TwoFactorCredential, error) {
+	var credential models.TwoFactorCredential
+	err := r.db.Where("principal = ? AND username = ?", principal, username).First(&credential).Error
+	if err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+// UseTwoFactorStep only moves the last used step forward, so a code used by
+// a concurrent login is not accepted again.
+func (r *PostgresRepository) UseTwoFactorStep(credentialID uint, step int64) error {
+	result := r.db.Model(&models.TwoFactorCredential{}).
+		Where("id = ? AND last_used_step < ?", credentialID, step).
+		Update("last_used_step", step)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *PostgresRepository) UseTwoFactorRecoveryCode(credentialID uint, codeHash string, usedAt time.Time) error {
+	result := r.db.Model(&models.TwoFactorRecoveryCode{}).
+		Where("credential_id = ? AND code_hash = ? AND used_at IS NULL", credentialID, codeHash).
+		Update("used_at", usedAt)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *PostgresRepository) GetPasskey(credentialID string) (*models.Passkey, error) {
+	var passkey models.Passkey
+	err := r.db.Where("credential_id = ?", credentialID).First(&passkey).Error
+	if err != nil {
+		return nil, err
+	}
+	return &passkey, nil
+}
+
+// ConsumeWebAuthnChallenge deletes the challenge in the same statement that
+// finds it, like ConsumeScramSession.
+func (r *PostgresRepository) ConsumeWebAuthnChallenge(ceremony string, challenge string, userID uint, now time.Time) error {
+	query := r.db.Where("ceremony = ? AND challenge = ? AND expires_at > ?", ceremony, challenge, now)
+	if userID == 0 {
+		query = query.Where("user_id IS NULL")
+	} else {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	result := query.Delete(&models.WebAuthnChallenge{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// UseWebAuthnCredential only moves the signature counter forward, unless the
+// authenticator does not count signatures at all.
+func (r *PostgresRepository) UseWebAuthnCredential(id uint, signCount uint32, usedAt time.Time) error {
+	result := r.db.Model(&models.Passkey{}).
+		Where("id = ? AND (sign_count < ? OR (sign_count = 0 AND ? = 0))", id, signCount, signCount).
+		Updates(map[string]interface{}{
+			"sign_count":   signCount,
+			"last_used_at": usedAt,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
 func (r *PostgresRepository) GetUserByID(id int64) (*models.User, error) {
 	var user models.User
 	err := r.db.Where("id = ?", id).First(&user).Error
@@ -58,6 +164,28 @@ func (r *PostgresRepository) GetUserMetadata(userID int64) (*models.UserMetadata
 	return &userMetadata, nil
 }
 
+func (r *PostgresRepository) GetUserEmailDomain(userID int64) (*models.UserEmailDomain, error) {
+	var emailDomain models.UserEmailDomain
+	err := r.db.Where("user_id = ?", userID).First(&emailDomain).Error
+	if err != nil {
+		return nil, err
+	}
+	return &emailDomain, nil
+}
+
+func (r *PostgresRepository) GetEmailDomainProofs(userID int64, clientID string) ([]models.EmailDomainProof, error) {
+	var proofs []models.EmailDomainProof
+	err := r.db.Where("user_id = ? AND client_id = ?", userID, clientID).Order("id").Find(&proofs).Error
+	if err != nil {
+		return nil, err
+	}
+	return proofs, nil
+}
+
+func (r *PostgresRepository) SaveEmailDomainProofs(proofs []models.EmailDomainProof) error {
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&proofs).Error
+}
+
 func (r *PostgresRepository) SetClient(client *models.Client) error {
 	// Check if client already exists
 	var existingClient models.Client
@@ -103,6 +231,176 @@ func (r *PostgresRepository) SaveX509Certificate(clientID string, certificate st
 		Error
 }
 
+func (r *PostgresRepository) SavePairwiseSubject(subject *models.PairwiseSubject) error {
+	return r.db.
+		Where("client_id = ? AND user_id = ?", subject.ClientID, subject.UserID).
+		FirstOrCreate(subject).
+		Error
+}
+
+func (r *PostgresRepository) GetPairwiseSubject(clientID string, subject string) (*models.PairwiseSubject, error) {
+	var pairwiseSubject models.PairwiseSubject
+	err := r.db.Where("client_id = ? AND subject = ?", clientID, subject).First(&pairwiseSubject).Error
+	if err != nil {
+		return &models.PairwiseSubject{}, err
+	}
+	return &pairwiseSubject, nil
+}
+
+func (r *PostgresRepository) SaveUserConsent(consent *models.UserConsent) error {
+	return r.db.
+		Where("user_id = ? AND client_id = ?", consent.UserID, consent.ClientID).
+		Assign(map[string]interface{}{
+			"scopes":     consent.Scopes,
+			"granted_at": consent.GrantedAt,
+		}).
+		FirstOrCreate(consent).
+		Error
+}
+
+func (r *PostgresRepository) GetUserConsent(userID int64, clientID string) (*models.UserConsent, error) {
+	var consent models.UserConsent
+	err := r.db.Where("user_id = ? AND client_id = ?", userID, clientID).First(&consent).Error
+	if err != nil {
+		return &models.UserConsent{}, err
+	}
+	return &consent, nil
+}
+
+func (r *PostgresRepository) UpdateUserConsentLastUsedAt(userID int64, clientID string, lastUsedAt time.Time) error {
+	return r.db.Model(&models.UserConsent{}).
+		Where("user_id = ? AND client_id = ?", userID, clientID).
+		Update("last_used_at", lastUsedAt).
+		Error
+}
+
+func (r *PostgresRepository) CreateSession(session *models.Session) error {
+	return r.db.Create(session).Error
+}
+
+func (r *PostgresRepository) SaveDataAccessRecord(record *models.DataAccessRecord) error {
+	return r.db.Create(record).Error
+}
+
+// UseAuthorizationCode records the code as redeemed. The insert fails on the
+// primary key when the code was already redeemed, also by another instance.
+// Codes that expired are forgotten on the way.
+func (r *PostgresRepository) UseAuthorizationCode(jti string, expiresAt time.Time, now time.Time) error {
+	err := r.db.Where("expires_at < ?", now).Delete(&models.UsedAuthorizationCode{}).Error
+	if err != nil {
+		return err
+	}
+
+	result := r.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.UsedAuthorizationCode{JTI: jti, ExpiresAt: expiresAt})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrDuplicatedKey
+	}
+	return nil
+}
+
+// TouchSession finds the session and records its use in one statement, so
+// a session revoked in the meantime is not accepted.
+func (r *PostgresRepository) TouchSession(jti string, now time.Time) error {
+	result := r.db.Model(&models.Session{}).
+		Where("jti = ? AND revoked_at IS NULL AND expires_at > ?", jti, now).
+		Update("last_seen_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *PostgresRepository) GetClientRedirectURIs(clientID string) ([]string, error) {
+	var redirectURIs []string
+	err := r.db.Model(&models.ClientRedirectURI{}).
+		Where("client_id = ?", clientID).
+		Order("id").
+		Pluck("redirect_uri", &redirectURIs).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return redirectURIs, nil
+}
+
+func (r *PostgresRepository) SaveDeviceAuthorization(authorization *models.DeviceAuthorization) error {
+	return r.db.Create(authorization).Error
+}
+
+// DecideDeviceAuthorization records the user's decision, status with the
+// approving user and granted scopes, on an authorization that is still
+// pending. A decision made or a code redeemed in the meantime is never
+// overwritten: the update then fails with gorm.ErrRecordNotFound.
+func (r *PostgresRepository) DecideDeviceAuthorization(
+	userCode string, status string, userID *uint, scopes string,
+) error {
+	result := r.db.Model(&models.DeviceAuthorization{}).
+		Where("user_code = ? AND status = ?", userCode, constants.DeviceAuthorizationPending).
+		Updates(map[string]interface{}{"status": status, "user_id": userID, "scopes": scopes})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// RecordDeviceAuthorizationPoll records a poll of an authorization that is
+// still pending, so that it cannot undo a decision made since the poll read
+// it. It fails with gorm.ErrRecordNotFound when the user decided meanwhile.
+func (r *PostgresRepository) RecordDeviceAuthorizationPoll(
+	deviceCodeHash string, lastPolledAt time.Time, interval int,
+) error {
+	result := r.db.Model(&models.DeviceAuthorization{}).
+		Where("device_code_hash = ? AND status = ?", deviceCodeHash, constants.DeviceAuthorizationPending).
+		Updates(map[string]interface{}{"last_polled_at": lastPolledAt, "interval": interval})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *PostgresRepository) GetDeviceAuthorizationByUserCode(userCode string) (*models.DeviceAuthorization, error) {
+	var authorization models.DeviceAuthorization
+	err := r.db.Where("user_code = ?", userCode).First(&authorization).Error
+	if err != nil {
+		return &models.DeviceAuthorization{}, err
+	}
+	return &authorization, nil
+}
+
+func (r *PostgresRepository) GetDeviceAuthorizationByDeviceCodeHash(deviceCodeHash string) (*models.DeviceAuthorization, error) {
+	var authorization models.DeviceAuthorization
+	err := r.db.Where("device_code_hash = ?", deviceCodeHash).First(&authorization).Error
+	if err != nil {
+		return &models.DeviceAuthorization{}, err
+	}
+	return &authorization, nil
+}
+
+func (r *PostgresRepository) DeleteDeviceAuthorization(id uint) error {
+	result := r.db.Delete(&models.DeviceAuthorization{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	// a concurrent poll already redeemed the authorization
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
 // SetTTL sets the key to hold the value for a limited time
 func (r *PostgresRepository) SetTTL(key string, value []byte, ttl time.Duration) error {
 	r.storage[key] = value
@@ -7,6 +7,7 @@ import (
 	"globe-and-citizen/layer8/server/models"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
@@ -42,6 +43,7 @@ const certificate = "certificate"
 const displayName = "display_name"
 const color = "color"
 const bio = "some bio"
+const pairwiseSubject = "pairwise_subject"
 
 func TestLoginUserPrecheck(t *testing.T) {
 	setUp(t)
@@ -91,6 +93,73 @@ func TestGetUser(t *testing.T) {
 	}
 }
 
+func TestConsumeScramSession_SessionNotFound(t *testing.T) {
+	setUp(t)
+
+	now := time.Now().UTC()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(
+			`DELETE FROM "scram_sessions" WHERE principal = $1 AND username = $2 AND nonce = $3 AND c_nonce = $4 AND expires_at > $5`,
+		),
+	).WithArgs(
+		models.ScramPrincipalUser, "test_user", "nonce", "c_nonce", now,
+	).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	err := repo.ConsumeScramSession(models.ScramPrincipalUser, "test_user", "nonce", "c_nonce", now)
+
+	assert.Equal(t, gorm.ErrRecordNotFound, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestUseWebAuthnCredential_Success(t *testing.T) {
+	setUp(t)
+
+	now := time.Now().UTC()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(
+			`UPDATE "passkeys" SET "last_used_at"=$1,"sign_count"=$2 `+
+				`WHERE id = $3 AND (sign_count < $4 OR (sign_count = 0 AND $5 = 0))`,
+		),
+	).WithArgs(now, uint32(8), 3, uint32(8), uint32(8)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := repo.UseWebAuthnCredential(3, 8, now)
+
+	assert.Nil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestTouchSession_Revoked(t *testing.T) {
+	setUp(t)
+
+	now := time.Now().UTC()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "sessions" SET "last_seen_at"=$1 WHERE jti = $2 AND revoked_at IS NULL AND expires_at > $3`),
+	).WithArgs(now, "session_jti", now).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	err := repo.TouchSession("session_jti", now)
+
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
 func TestGetUserByID(t *testing.T) {
 	setUp(t)
 
@@ -148,13 +217,102 @@ func TestGetUserMetadata(t *testing.T) {
 	}
 }
 
+func TestGetUserEmailDomain(t *testing.T) {
+	setUp(t)
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT * FROM "user_email_domains" WHERE user_id = $1 ORDER BY "user_email_domains"."user_id" LIMIT $2`),
+	).WithArgs(
+		userID, 1,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"user_id", "domain", "nullifier_key"}).AddRow(userID, "mit.edu", []byte("key")),
+	)
+
+	emailDomain, err := repo.GetUserEmailDomain(userID)
+	if err != nil {
+		t.Fatal("Failed to call GetUserEmailDomain:", err)
+	}
+
+	assert.Equal(t, "mit.edu", emailDomain.Domain)
+	assert.Equal(t, []byte("key"), emailDomain.NullifierKey)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestGetEmailDomainProofs(t *testing.T) {
+	setUp(t)
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`SELECT * FROM "email_domain_proofs" WHERE user_id = $1 AND client_id = $2 ORDER BY id`,
+		),
+	).WithArgs(
+		userID, "client",
+	).WillReturnRows(
+		sqlmock.NewRows(
+			[]string{"domain_set", "domain", "domain_set_root", "nullifier", "zk_proof", "zk_key_pair_id"},
+		).AddRow(
+			"", "mit.edu", "root", "nullifier", []byte("proof"), 3,
+		).AddRow(
+			"universities", nil, "set root", "nullifier", []byte("set proof"), 3,
+		),
+	)
+
+	proofs, err := repo.GetEmailDomainProofs(userID, "client")
+	if err != nil {
+		t.Fatal("Failed to call GetEmailDomainProofs:", err)
+	}
+
+	assert.Len(t, proofs, 2)
+	assert.Equal(t, "mit.edu", *proofs[0].Domain)
+	assert.Equal(t, "nullifier", proofs[0].Nullifier)
+	assert.Equal(t, "universities", proofs[1].DomainSet)
+	assert.Nil(t, proofs[1].Domain)
+	assert.Equal(t, []byte("set proof"), proofs[1].ZkProof)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestSaveEmailDomainProofs(t *testing.T) {
+	setUp(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`INSERT INTO "email_domain_proofs"`),
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow(1),
+	)
+	mock.ExpectCommit()
+
+	err := repo.SaveEmailDomainProofs([]models.EmailDomainProof{{
+		UserID:        uint(userID),
+		ClientID:      "client",
+		DomainSet:     "universities",
+		DomainSetRoot: "set root",
+		Nullifier:     "nullifier",
+		ZkProof:       []byte("set proof"),
+		ZkKeyPairID:   3,
+	}})
+	if err != nil {
+		t.Fatal("Failed to call SaveEmailDomainProofs:", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
 func TestSetClient(t *testing.T) {
 	setUp(t)
 
 	// Make a mock setClient input
 	client := &models.Client{
 		ID:                   "test_id",
-		Secret:               "test_secret",
+		SecretHash:           "test_secret_hash",
 		Name:                 "test_name",
 		RedirectURI:          "test_redirect_uri",
 		BackendURI:           "test_backend_uri",
@@ -177,13 +335,17 @@ func TestSetClient(t *testing.T) {
 		regexp.QuoteMeta("INSERT INTO \"clients\""),
 	).WithArgs(
 		client.ID,
-		client.Secret,
+		client.SecretHash,
+		client.PreviousSecretHash,
+		nil,
 		client.Name,
 		client.RedirectURI,
 		client.BackendURI,
 		client.Username,
 		client.Salt,
 		client.X509CertificateBytes,
+		client.GrantTypes,
+		client.RequireUserTwoFactor,
 	).WillReturnResult(
 		sqlmock.NewResult(1, 1),
 	)
@@ -208,7 +370,7 @@ func TestGetClient(t *testing.T) {
 	// Make a mock getClient input
 	id := "test_id"
 
-	mock.ExpectQuery("SELECT (.+) FROM \"clients\" WHERE id = (.+)").WithArgs(id, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "secret", "name", "redirect_uri"}).AddRow("test_id", "test_secret", "test_name", "test_redirect_uri"))
+	mock.ExpectQuery("SELECT (.+) FROM \"clients\" WHERE id = (.+)").WithArgs(id, 1).WillReturnRows(sqlmock.NewRows([]string{"id", "secret_hash", "name", "redirect_uri"}).AddRow("test_id", "test_secret_hash", "test_name", "test_redirect_uri"))
 
 	// Call the function and check the result
 	client, err := repo.GetClient(id)
@@ -217,7 +379,7 @@ func TestGetClient(t *testing.T) {
 	}
 
 	assert.Equal(t, "test_id", client.ID)
-	assert.Equal(t, "test_secret", client.Secret)
+	assert.Equal(t, "test_secret_hash", client.SecretHash)
 	assert.Equal(t, "test_name", client.Name)
 	assert.Equal(t, "test_redirect_uri", client.RedirectURI)
 
@@ -254,8 +416,8 @@ func TestGetClientByURL(t *testing.T) {
 	url := "test_backend_uri"
 
 	mock.ExpectQuery("SELECT (.+) FROM \"clients\" WHERE backend_uri = (.+)").WithArgs(url, 1).WillReturnRows(
-		sqlmock.NewRows([]string{"id", "secret", "name", "redirect_uri", "backend_uri", "username", "password", "salt"}).
-			AddRow("test_id", "test_secret", "test_name", "test_redirect_uri", "test_backend_uri", "test_username", "test_password", "test_salt"))
+		sqlmock.NewRows([]string{"id", "secret_hash", "name", "redirect_uri", "backend_uri", "username", "password", "salt"}).
+			AddRow("test_id", "test_secret_hash", "test_name", "test_redirect_uri", "test_backend_uri", "test_username", "test_password", "test_salt"))
 
 	// Call the function and check the result
 	client, err := repo.GetClientByURL(url)
@@ -264,7 +426,7 @@ func TestGetClientByURL(t *testing.T) {
 	}
 
 	assert.Equal(t, "test_id", client.ID)
-	assert.Equal(t, "test_secret", client.Secret)
+	assert.Equal(t, "test_secret_hash", client.SecretHash)
 	assert.Equal(t, "test_name", client.Name)
 	assert.Equal(t, "test_redirect_uri", client.RedirectURI)
 	assert.Equal(t, "test_backend_uri", client.BackendURI)
@@ -328,3 +490,292 @@ func TestSaveX509Certificate_Success(t *testing.T) {
 		t.Fatal("Unmet expectations:", err)
 	}
 }
+
+func TestSavePairwiseSubject_SubjectAlreadyStored(t *testing.T) {
+	setUp(t)
+
+	mock.ExpectQuery(
+		"SELECT (.+) FROM \"pairwise_subjects\" WHERE client_id = (.+) AND user_id = (.+)",
+	).WithArgs(
+		clientID, userID, 1,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "client_id", "user_id", "subject"}).AddRow(1, clientID, userID, pairwiseSubject),
+	)
+
+	err := repo.SavePairwiseSubject(&models.PairwiseSubject{ClientID: clientID, UserID: userID, Subject: pairwiseSubject})
+
+	assert.Nil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestSavePairwiseSubject_NewSubjectCreated(t *testing.T) {
+	setUp(t)
+
+	mock.ExpectQuery(
+		"SELECT (.+) FROM \"pairwise_subjects\" WHERE client_id = (.+) AND user_id = (.+)",
+	).WithArgs(
+		clientID, userID, 1,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "client_id", "user_id", "subject"}),
+	)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(
+		"INSERT INTO \"pairwise_subjects\" (.+) VALUES (.+) RETURNING \"id\"",
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow(1),
+	)
+	mock.ExpectCommit()
+
+	err := repo.SavePairwiseSubject(&models.PairwiseSubject{ClientID: clientID, UserID: userID, Subject: pairwiseSubject})
+
+	assert.Nil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestGetPairwiseSubject(t *testing.T) {
+	setUp(t)
+
+	mock.ExpectQuery(
+		"SELECT (.+) FROM \"pairwise_subjects\" WHERE client_id = (.+) AND subject = (.+)",
+	).WithArgs(
+		clientID, pairwiseSubject, 1,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "client_id", "user_id", "subject"}).AddRow(1, clientID, userID, pairwiseSubject),
+	)
+
+	subject, err := repo.GetPairwiseSubject(clientID, pairwiseSubject)
+
+	assert.Nil(t, err)
+	assert.Equal(t, uint(userID), subject.UserID)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestGetUserConsent(t *testing.T) {
+	setUp(t)
+
+	mock.ExpectQuery(
+		"SELECT (.+) FROM \"user_consents\" WHERE user_id = (.+) AND client_id = (.+)",
+	).WithArgs(
+		userID, clientID, 1,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "user_id", "client_id", "scopes"}).AddRow(1, userID, clientID, "read:user"),
+	)
+
+	consent, err := repo.GetUserConsent(userID, clientID)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "read:user", consent.Scopes)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestSaveUserConsent_ExistingConsentReplaced(t *testing.T) {
+	setUp(t)
+
+	grantedAt := time.Now().UTC()
+
+	mock.ExpectQuery(
+		"SELECT (.+) FROM \"user_consents\" WHERE user_id = (.+) AND client_id = (.+)",
+	).WithArgs(
+		userID, clientID, 1,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "user_id", "client_id", "scopes"}).AddRow(1, userID, clientID, "read:user"),
+	)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		"UPDATE \"user_consents\" SET (.+) WHERE \\(user_id = (.+) AND client_id = (.+)\\)",
+	).WillReturnResult(
+		sqlmock.NewResult(1, 1),
+	)
+	mock.ExpectCommit()
+
+	err := repo.SaveUserConsent(&models.UserConsent{
+		UserID:    userID,
+		ClientID:  clientID,
+		Scopes:    "read:user,read:user:bio",
+		GrantedAt: grantedAt,
+	})
+
+	assert.Nil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestGetDeviceAuthorizationByUserCode(t *testing.T) {
+	setUp(t)
+
+	mock.ExpectQuery(
+		"SELECT (.+) FROM \"device_authorizations\" WHERE user_code = (.+)",
+	).WithArgs(
+		"BCDF-GHJK", 1,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "user_code", "client_id", "status"}).AddRow(1, "BCDF-GHJK", clientID, "pending"),
+	)
+
+	authorization, err := repo.GetDeviceAuthorizationByUserCode("BCDF-GHJK")
+
+	assert.Nil(t, err)
+	assert.Equal(t, clientID, authorization.ClientID)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestDecideDeviceAuthorization_Success(t *testing.T) {
+	setUp(t)
+
+	approvedBy := uint(userID)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "device_authorizations" SET "scopes"=$1,"status"=$2,"user_id"=$3 WHERE user_code = $4 AND status = $5`),
+	).WithArgs(
+		"read:user", "approved", &approvedBy, "BCDF-GHJK", "pending",
+	).WillReturnResult(
+		sqlmock.NewResult(0, 1),
+	)
+	mock.ExpectCommit()
+
+	err := repo.DecideDeviceAuthorization("BCDF-GHJK", "approved", &approvedBy, "read:user")
+
+	assert.Nil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestDecideDeviceAuthorization_AlreadyDecided(t *testing.T) {
+	setUp(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "device_authorizations" SET "scopes"=$1,"status"=$2,"user_id"=$3 WHERE user_code = $4 AND status = $5`),
+	).WithArgs(
+		"read:user", "denied", nil, "BCDF-GHJK", "pending",
+	).WillReturnResult(
+		sqlmock.NewResult(0, 0),
+	)
+	mock.ExpectCommit()
+
+	err := repo.DecideDeviceAuthorization("BCDF-GHJK", "denied", nil, "read:user")
+
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestRecordDeviceAuthorizationPoll_DecidedMeanwhile(t *testing.T) {
+	setUp(t)
+
+	now := time.Now().UTC()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "device_authorizations" SET "interval"=$1,"last_polled_at"=$2 WHERE device_code_hash = $3 AND status = $4`),
+	).WithArgs(
+		10, now, "device code hash", "pending",
+	).WillReturnResult(
+		sqlmock.NewResult(0, 0),
+	)
+	mock.ExpectCommit()
+
+	err := repo.RecordDeviceAuthorizationPoll("device code hash", now, 10)
+
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestDeleteDeviceAuthorization_AlreadyDeleted(t *testing.T) {
+	setUp(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		"DELETE FROM \"device_authorizations\" WHERE \"device_authorizations\".\"id\" = (.+)",
+	).WithArgs(
+		1,
+	).WillReturnResult(
+		sqlmock.NewResult(0, 0),
+	)
+	mock.ExpectCommit()
+
+	err := repo.DeleteDeviceAuthorization(1)
+
+	assert.NotNil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestDeleteDeviceAuthorization_Success(t *testing.T) {
+	setUp(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		"DELETE FROM \"device_authorizations\" WHERE \"device_authorizations\".\"id\" = (.+)",
+	).WithArgs(
+		1,
+	).WillReturnResult(
+		sqlmock.NewResult(0, 1),
+	)
+	mock.ExpectCommit()
+
+	err := repo.DeleteDeviceAuthorization(1)
+
+	assert.Nil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
+
+func TestUseAuthorizationCode_AlreadyUsed(t *testing.T) {
+	setUp(t)
+
+	now := time.Now().UTC()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		"DELETE FROM \"used_authorization_codes\" WHERE expires_at < (.+)",
+	).WillReturnResult(
+		sqlmock.NewResult(0, 0),
+	)
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		"INSERT INTO \"used_authorization_codes\" (.+) VALUES (.+) ON CONFLICT DO NOTHING",
+	).WillReturnResult(
+		sqlmock.NewResult(0, 0),
+	)
+	mock.ExpectCommit()
+
+	err := repo.UseAuthorizationCode("jti", now.Add(time.Minute), now)
+
+	assert.ErrorIs(t, err, gorm.ErrDuplicatedKey)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal("Unmet expectations:", err)
+	}
+}
@@ -1,28 +1,46 @@
 package service
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"globe-and-citizen/layer8/server/audit"
 	"globe-and-citizen/layer8/server/config"
 	"globe-and-citizen/layer8/server/constants"
 	"globe-and-citizen/layer8/server/entities"
 	"globe-and-citizen/layer8/server/internals/repository"
 	"globe-and-citizen/layer8/server/models"
+	"globe-and-citizen/layer8/server/totp"
+	"globe-and-citizen/layer8/server/utils"
+	"globe-and-citizen/layer8/server/webauthn"
+	"log"
+	"math/big"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/dgrijalva/jwt-go"
 
 	utilities "github.com/globe-and-citizen/layer8-utils"
 	"golang.org/x/oauth2"
+	"gorm.io/gorm"
 
+	rsModels "globe-and-citizen/layer8/server/resource_server/models"
 	rs_utils "globe-and-citizen/layer8/server/resource_server/utils"
 )
 
 type ServiceInterface interface {
 	GetUserByToken(token string) (*models.User, error)
-	LoginUser(username, password string) (map[string]interface{}, error)
+	LoginUser(req entities.LoginRequest) (map[string]interface{}, error)
+	LoginTwoFactor(req entities.TwoFactorLoginRequest) (map[string]interface{}, error)
+	LoginPasskey(req entities.PasskeyLoginRequest) (map[string]interface{}, error)
 	GenerateAuthorizationURL(config *oauth2.Config, userID int64) (*entities.AuthURL, error)
 	GenerateAuthJwtCode(config *oauth2.Config, userID int64) (string, error)
 	ExchangeCodeForToken(config *oauth2.Config, code string) (*oauth2.Token, error)
@@ -30,16 +48,44 @@ type ServiceInterface interface {
 	VerifyToken(token string) (isvalid bool, err error)
 	CheckClient(backendURL string) (*models.Client, error)
 	SaveX509Certificate(clientID string, certificate string) error
-	DecodeAuthorizationCode(secret string, code string) (*utilities.AuthCodeClaims, error)
+	DecodeAuthorizationCode(clientID string, code string, redirectURI string) (*utilities.AuthCodeClaims, error)
 	AuthenticateClient(uuid string, secret string) error
-	GenerateAccessToken(authClaims *utilities.AuthCodeClaims, clientID string, clientSecret string) (string, error)
-	ValidateAccessToken(clientSecret string, accessToken string) (*entities.ClientClaims, error)
-	GetZkUserMetadata(scopesStr string, userID int64) (*entities.ZkMetadataResponse, error)
+	CheckClientGrantType(clientID string, grantType string) error
+	GenerateAccessToken(authClaims *utilities.AuthCodeClaims, clientID string) (string, error)
+	GenerateClientCredentialsToken(clientID string, scopes []string) (string, error)
+	ValidateAccessToken(accessToken string) (*entities.ClientClaims, error)
+	ValidateClientTokenWithScope(tokenString string, scope string) (*rsModels.ClientClaims, error)
+	GetZkUserMetadata(clientID string, scopesStr string, userID int64) (*entities.ZkMetadataResponse, error)
+	GetPairwiseSubject(clientID string, userID int64) (string, error)
+	ResolvePairwiseSubject(clientID string, subject string) (int64, error)
+	SaveUserConsent(userID int64, clientID string, scopes []string) error
+	GetCoveringConsent(userID int64, clientID string, scopes []string) (*models.UserConsent, error)
+	VerifyUserConsent(userID int64, clientID string, issuedAt int64) error
+	ResolveRedirectURI(client *models.Client, requested string) (string, error)
+	CreateDeviceAuthorization(clientID string, scopes []string) (string, *models.DeviceAuthorization, error)
+	GetPendingDeviceAuthorization(userCode string) (*models.DeviceAuthorization, error)
+	ApproveDeviceAuthorization(userCode string, userID int64, scopes []string) error
+	DenyDeviceAuthorization(userCode string) error
+	PollDeviceAuthorization(clientID string, deviceCode string) (*utilities.AuthCodeClaims, error)
 	AddTestClient() (*models.Client, error)
 }
 
 type Service struct {
 	Repo repository.Repository
+	// Audit records logins, consents, issued tokens and reads of user
+	// metadata to the security audit trail, nothing is audited if it is nil
+	Audit audit.Sink
+	// EmailDomainProver makes the proofs of the email domain claims the
+	// first time they are released to a client; proofs not made yet are
+	// not released if it is nil
+	EmailDomainProver EmailDomainProver
+}
+
+// EmailDomainProver proves to a client that the domain of a user's verified
+// email address is in a set of domains, see zk.EmailDomainProver.
+type EmailDomainProver interface {
+	ProveEmailDomain(emailDomain models.UserEmailDomain, clientID string) (models.EmailDomainProof, error)
+	ProveEmailDomainMemberships(emailDomain models.UserEmailDomain, clientID string) ([]models.EmailDomainProof, error)
 }
 
 func NewService(repo repository.Repository) ServiceInterface {
@@ -63,24 +109,300 @@ func (u *Service) GetUserByToken(token string) (*models.User, error) {
 	return user, nil
 }
 
-func (u *Service) LoginUser(username, password string) (map[string]interface{}, error) {
-	// TODO: use SCRAM authentication here
-	user, err := u.Repo.GetUser(username)
+// LoginUser checks the SCRAM client proof of a login made with the nonces
+// of a resource server login precheck and issues a token for the OAuth
+// portal. The returned server signature lets the client check the server.
+// A user who enabled two-factor authentication gets a two_factor_token
+// instead, to be exchanged for the token by LoginTwoFactor.
+func (u *Service) LoginUser(req entities.LoginRequest) (map[string]interface{}, error) {
+	user, serverSignature, err := u.authenticateUser(req)
+	if err != nil {
+		u.recordLogin(audit.EventLoginFailed, req, map[string]string{"reason": err.Error()})
+		return nil, err
+	}
+
+	credential, err := u.Repo.GetTwoFactorCredential(models.ScramPrincipalUser, user.Username)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to get two-factor credential: %v", err)
+	}
+	if err == nil && credential.Confirmed() {
+		twoFactorToken, err := rs_utils.GenerateTwoFactorToken(models.ScramPrincipalUser, user.Username)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"two_factor_token": twoFactorToken,
+			"server_signature": serverSignature,
+		}, nil
+	}
+
+	token, err := utilities.GenerateUserToken(config.SECRET_KEY, int64(user.ID))
 	if err != nil {
 		return nil, err
 	}
 
+	u.recordLogin(audit.EventLoginSucceeded, req, nil)
+
+	return map[string]interface{}{
+		"token":            token,
+		"user":             user,
+		"server_signature": serverSignature,
+	}, nil
+}
+
+// LoginTwoFactor issues the OAuth portal token of a login that passed the
+// SCRAM check once a code of the user's authenticator checks out.
+func (u *Service) LoginTwoFactor(req entities.TwoFactorLoginRequest) (map[string]interface{}, error) {
+	claims, err := rs_utils.ParseTwoFactorToken(req.TwoFactorToken)
+	if err != nil || claims.Principal != models.ScramPrincipalUser {
+		return nil, constants.ErrInvalidTwoFactorToken
+	}
+
+	login := entities.LoginRequest{Username: claims.Subject, Source: req.Source}
+
+	user, err := u.verifyTwoFactorCode(claims.Subject, req.Code)
+	if err != nil {
+		u.recordLogin(audit.EventLoginFailed, login, map[string]string{"reason": err.Error()})
+		return nil, err
+	}
+
+	token, err := utilities.GenerateUserToken(config.SECRET_KEY, int64(user.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	u.recordLogin(audit.EventLoginSucceeded, login, map[string]string{"two_factor": "true"})
+
+	return map[string]interface{}{
+		"token": token,
+		"user":  user,
+	}, nil
+}
+
+// LoginPasskey issues the OAuth portal token of a login with a passkey. A
+// passkey the authenticator unlocked with a PIN or biometric is both
+// factors, otherwise a user who enabled two-factor authentication gets a
+// two_factor_token like after a password.
+func (u *Service) LoginPasskey(req entities.PasskeyLoginRequest) (map[string]interface{}, error) {
+	webauthnConfig, err := webauthn.ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	passkey, err := u.Repo.GetPasskey(req.Credential.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, constants.ErrInvalidPasskey
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get passkey: %v", err)
+	}
+
+	user, err := u.Repo.GetUserByID(int64(passkey.UserID))
+	if err != nil {
+		return nil, fmt.Errorf("could not get user: %v", err)
+	}
+	login := entities.LoginRequest{Username: user.Username, Source: req.Source}
+
+	userVerified, err := webauthn.VerifyLogin(u.Repo, webauthnConfig, webauthn.Credential{
+		ID:           passkey.ID,
+		UserID:       passkey.UserID,
+		CredentialID: passkey.CredentialID,
+		PublicKey:    passkey.PublicKey,
+		SignCount:    passkey.SignCount,
+	}, req.Credential, time.Now().UTC())
+	if err != nil {
+		u.recordLogin(audit.EventLoginFailed, login, map[string]string{"passkey": "true", "reason": err.Error()})
+		return nil, err
+	}
+
+	if !userVerified {
+		credential, err := u.Repo.GetTwoFactorCredential(models.ScramPrincipalUser, user.Username)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to get two-factor credential: %v", err)
+		}
+		if err == nil && credential.Confirmed() {
+			twoFactorToken, err := rs_utils.GenerateTwoFactorToken(models.ScramPrincipalUser, user.Username)
+			if err != nil {
+				return nil, err
+			}
+
+			return map[string]interface{}{
+				"two_factor_token": twoFactorToken,
+			}, nil
+		}
+	}
+
 	token, err := utilities.GenerateUserToken(config.SECRET_KEY, int64(user.ID))
 	if err != nil {
 		return nil, err
 	}
 
+	u.recordLogin(audit.EventLoginSucceeded, login, map[string]string{"passkey": "true"})
+
 	return map[string]interface{}{
 		"token": token,
 		"user":  user,
 	}, nil
 }
 
+func (u *Service) verifyTwoFactorCode(username string, code string) (*models.User, error) {
+	credential, err := u.Repo.GetTwoFactorCredential(models.ScramPrincipalUser, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, constants.ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get two-factor credential: %v", err)
+	}
+	if !credential.Confirmed() {
+		return nil, constants.ErrTwoFactorNotEnabled
+	}
+
+	key, err := totp.EncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	err = totp.Verify(u.Repo, key, totp.Credential{
+		ID:              credential.ID,
+		EncryptedSecret: credential.EncryptedSecret,
+		LastUsedStep:    credential.LastUsedStep,
+	}, code, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	return u.Repo.GetUser(username)
+}
+
+// checkUserTwoFactor fails with constants.ErrTwoFactorRequired if the client
+// requires two-factor authentication and the user has not enabled it. Since
+// logins of such users always ask for a code, their sessions passed it.
+func (u *Service) checkUserTwoFactor(client *models.Client, userID int64) error {
+	if !client.RequireUserTwoFactor {
+		return nil
+	}
+
+	user, err := u.Repo.GetUserByID(userID)
+	if err != nil {
+		return fmt.Errorf("could not get user: %v", err)
+	}
+
+	credential, err := u.Repo.GetTwoFactorCredential(models.ScramPrincipalUser, user.Username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return constants.ErrTwoFactorRequired
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get two-factor credential: %v", err)
+	}
+	if !credential.Confirmed() {
+		return constants.ErrTwoFactorRequired
+	}
+
+	return nil
+}
+
+func (u *Service) authenticateUser(req entities.LoginRequest) (*models.User, string, error) {
+	err := u.Repo.ConsumeScramSession(models.ScramPrincipalUser, req.Username, req.Nonce, req.CNonce, time.Now().UTC())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, "", constants.ErrInvalidLoginSession
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to check login session: %v", err)
+	}
+
+	user, err := u.Repo.GetUser(req.Username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, "", constants.ErrAuthenticationFailed
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	// a registration that was prechecked but never completed has no credential
+	if user.StoredKey == "" {
+		return nil, "", constants.ErrAuthenticationFailed
+	}
+
+	authMessage := rs_utils.ScramAuthMessage(req.Username, req.CNonce, user.Salt, user.IterationCount, req.Nonce)
+
+	serverSignature, err := rs_utils.VerifyScramClientProof(authMessage, user.StoredKey, user.ServerKey, req.ClientProof)
+	if errors.Is(err, constants.ErrInvalidClientProof) {
+		return nil, "", constants.ErrAuthenticationFailed
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return user, serverSignature, nil
+}
+
+func (u *Service) recordLogin(eventType string, req entities.LoginRequest, details map[string]string) {
+	if u.Audit == nil {
+		return
+	}
+
+	err := u.Audit.Record(audit.Event{
+		Type:      eventType,
+		Principal: models.ScramPrincipalUser,
+		Subject:   req.Username,
+		Source:    req.Source,
+		Details:   details,
+	})
+	if err != nil {
+		log.Printf("failed to record login of %s: %v", req.Username, err)
+	}
+}
+
+// recordUserEvent records an event about the user that involves the client.
+// Like logins, failing to record it does not fail the action.
+func (u *Service) recordUserEvent(eventType string, userID int64, clientID string, details map[string]string) {
+	if u.Audit == nil {
+		return
+	}
+
+	user, err := u.Repo.GetUserByID(userID)
+	if err != nil {
+		log.Printf("failed to record %s of user %d: %v", eventType, userID, err)
+		return
+	}
+
+	err = u.Audit.Record(audit.Event{
+		Type:      eventType,
+		Principal: models.ScramPrincipalUser,
+		Subject:   user.Username,
+		ClientID:  clientID,
+		Details:   details,
+	})
+	if err != nil {
+		log.Printf("failed to record %s of user %d: %v", eventType, userID, err)
+	}
+}
+
+// recordClientEvent records an event about the client's own account.
+func (u *Service) recordClientEvent(eventType string, clientID string, details map[string]string) {
+	if u.Audit == nil {
+		return
+	}
+
+	client, err := u.Repo.GetClient(clientID)
+	if err != nil {
+		log.Printf("failed to record %s of client %s: %v", eventType, clientID, err)
+		return
+	}
+
+	err = u.Audit.Record(audit.Event{
+		Type:      eventType,
+		Principal: rsModels.ScramPrincipalClient,
+		Subject:   client.Username,
+		ClientID:  client.ID,
+		Details:   details,
+	})
+	if err != nil {
+		log.Printf("failed to record %s of client %s: %v", eventType, clientID, err)
+	}
+}
+
 // GenerateAuthorizationURL generates an authorization URL for the user to visit
 // and authorize the application to access their account.
 func (u *Service) GenerateAuthorizationURL(config *oauth2.Config, userID int64) (*entities.AuthURL, error) {
@@ -94,22 +416,37 @@ func (u *Service) GenerateAuthorizationURL(config *oauth2.Config, userID int64)
 		return nil, fmt.Errorf("could not get user: %v", err)
 	}
 
+	if err := u.checkUserTwoFactor(client, userID); err != nil {
+		return nil, err
+	}
+
 	state, stateErr := utilities.GenerateRandomString(24)
 	if stateErr != nil {
 		return nil, fmt.Errorf("could not generate random state: %v", stateErr)
 	}
 
+	signingKey, err := tokenSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
 	// generate the auth code
 	scopes := ""
 	for _, scope := range config.Scopes {
 		scopes += scope + ","
 	}
-	code, err := utilities.GenerateAuthCode(client.Secret, &utilities.AuthCodeClaims{
+	jti, err := utilities.GenerateRandomString(16)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate auth code id: %v", err)
+	}
+	code, err := utilities.GenerateAuthCode(signingKey, &utilities.AuthCodeClaims{
 		ClientID:    config.ClientID,
 		UserID:      int64(user.ID),
 		RedirectURI: config.RedirectURL,
 		Scopes:      scopes,
 		ExpiresAt:   time.Now().Add(time.Minute * 5).Unix(),
+		// the jti lets the code be redeemed only once
+		StandardClaims: jwt.StandardClaims{Id: jti},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("could not generate auth code: %v", err)
@@ -127,7 +464,7 @@ func (u *Service) GenerateAuthorizationURL(config *oauth2.Config, userID int64)
 
 func (u *Service) GenerateAuthJwtCode(config *oauth2.Config, userID int64) (string, error) {
 	// first, check that both client and user exist
-	client, err := u.GetClient(config.ClientID)
+	_, err := u.GetClient(config.ClientID)
 	if err != nil {
 		return "", fmt.Errorf("could not get client: %v", err)
 	}
@@ -136,17 +473,27 @@ func (u *Service) GenerateAuthJwtCode(config *oauth2.Config, userID int64) (stri
 		return "", fmt.Errorf("could not get user: %v", err)
 	}
 
+	signingKey, err := tokenSigningKey()
+	if err != nil {
+		return "", err
+	}
+
 	// generate the auth code
 	scopes := ""
 	for _, scope := range config.Scopes {
 		scopes += scope + ","
 	}
-	code, err := utilities.GenerateAuthCode(client.Secret, &utilities.AuthCodeClaims{
-		ClientID:    config.ClientID,
-		UserID:      int64(user.ID),
-		RedirectURI: config.RedirectURL,
-		Scopes:      scopes,
-		ExpiresAt:   time.Now().Add(time.Minute * 5).Unix(),
+	jti, err := utilities.GenerateRandomString(16)
+	if err != nil {
+		return "", fmt.Errorf("could not generate auth code id: %v", err)
+	}
+	code, err := utilities.GenerateAuthCode(signingKey, &utilities.AuthCodeClaims{
+		ClientID:       config.ClientID,
+		UserID:         int64(user.ID),
+		RedirectURI:    config.RedirectURL,
+		Scopes:         scopes,
+		ExpiresAt:      time.Now().Add(time.Minute * 5).Unix(),
+		StandardClaims: jwt.StandardClaims{Id: jti},
 	})
 	if err != nil {
 		return "", fmt.Errorf("could not generate auth code: %v", err)
@@ -157,12 +504,8 @@ func (u *Service) GenerateAuthJwtCode(config *oauth2.Config, userID int64) (stri
 
 // ExchangeCodeForToken generates an access token from an authorization code.
 func (u *Service) ExchangeCodeForToken(config *oauth2.Config, code string) (*oauth2.Token, error) {
-	// ensure that the secret is specified
-	if config.ClientSecret == "" {
-		return nil, fmt.Errorf("client secret is not specified")
-	}
 	// verify the code
-	claims, err := utilities.DecodeAuthCode(config.ClientSecret, code)
+	claims, err := u.DecodeAuthorizationCode(config.ClientID, code, config.RedirectURL)
 	if err != nil {
 		return nil, err
 	}
@@ -222,27 +565,89 @@ func (u *Service) CheckClient(backendURL string) (*models.Client, error) {
 }
 
 func (u *Service) SaveX509Certificate(clientID string, certificate string) error {
-	return u.Repo.SaveX509Certificate(clientID, certificate)
+	err := u.Repo.SaveX509Certificate(clientID, certificate)
+	if err != nil {
+		return err
+	}
+
+	u.recordClientEvent(audit.EventCertificateUploaded, clientID, nil)
+	return nil
 }
 
-func (u *Service) DecodeAuthorizationCode(secret string, code string) (*utilities.AuthCodeClaims, error) {
-	// Decode the auth code
-	// verify the code
-	claims, err := utilities.DecodeAuthCode(secret, code)
+// DecodeAuthorizationCode verifies an authorization code, checks that it was
+// issued to the client redeeming it for the redirect URI of the token request
+// (RFC 6749 section 4.1.3) and redeems it, a code is only accepted once.
+func (u *Service) DecodeAuthorizationCode(
+	clientID string, code string, redirectURI string,
+) (*utilities.AuthCodeClaims, error) {
+	signingKey, err := tokenSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := utilities.DecodeAuthCode(signingKey, code)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode auth code: %v", err)
 	}
+
+	if claims.ClientID != clientID {
+		return nil, fmt.Errorf("auth code was not issued to this client")
+	}
+
+	// a client can register several redirect URIs, the code is only good for
+	// the one it was sent to
+	if claims.RedirectURI != redirectURI {
+		return nil, fmt.Errorf("redirect uri does not match the one of the auth code")
+	}
+
+	if claims.Id == "" {
+		return nil, fmt.Errorf("auth code has no id")
+	}
+	err = u.Repo.UseAuthorizationCode(claims.Id, time.Unix(claims.ExpiresAt, 0).UTC(), time.Now().UTC())
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, fmt.Errorf("auth code was already redeemed")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem auth code: %v", err)
+	}
+
 	return claims, nil
 }
 
+// AuthenticateClient checks secret against the client's current secret, or
+// against the one it replaced while the rotation overlap has not run out.
 func (u *Service) AuthenticateClient(uuid string, secret string) error {
 	client, err := u.Repo.GetClient(uuid)
 	if err != nil {
 		return fmt.Errorf("failed to authenticate client: %e", err)
 	}
 
-	if client.Secret != secret {
-		return fmt.Errorf("failed to authenticate client: provided secret value is invalid")
+	if utils.CompareClientSecret(client.SecretHash, secret) {
+		return nil
+	}
+
+	if client.PreviousSecretExpiresAt != nil &&
+		time.Now().UTC().Before(*client.PreviousSecretExpiresAt) &&
+		utils.CompareClientSecret(client.PreviousSecretHash, secret) {
+		return nil
+	}
+
+	return fmt.Errorf("failed to authenticate client: provided secret value is invalid")
+}
+
+// CheckClientGrantType rejects grants the client did not register for.
+func (u *Service) CheckClientGrantType(clientID string, grantType string) error {
+	client, err := u.Repo.GetClient(clientID)
+	if err != nil {
+		return fmt.Errorf("failed to get client: %v", err)
+	}
+
+	if client.GrantTypes == "" {
+		return nil
+	}
+
+	if !slices.Contains(strings.Split(client.GrantTypes, ","), grantType) {
+		return fmt.Errorf("the client is not registered for the %s grant", grantType)
 	}
 
 	return nil
@@ -251,35 +656,140 @@ func (u *Service) AuthenticateClient(uuid string, secret string) error {
 func (u *Service) GenerateAccessToken(
 	authClaims *utilities.AuthCodeClaims,
 	clientID string,
-	clientSecret string,
 ) (string, error) {
+	signingKey, err := tokenSigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	subject, err := u.GetPairwiseSubject(clientID, authClaims.UserID)
+	if err != nil {
+		return "", err
+	}
+
+	session, err := u.startAppSession(authClaims.UserID, clientID)
+	if err != nil {
+		return "", err
+	}
+
 	claims := entities.ClientClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        session.JTI,
+			Issuer:    "Globe and Citizen",
+			IssuedAt:  session.CreatedAt.Unix(),
+			Subject:   subject,
+			Audience:  clientID,
+			ExpiresAt: session.ExpiresAt.Unix(),
+		},
+		Scopes: authClaims.Scopes,
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	signedToken, err := token.SignedString([]byte(signingKey))
+	if err != nil {
+		return "", err
+	}
+
+	u.recordUserEvent(audit.EventTokenIssued, authClaims.UserID, clientID, map[string]string{
+		"scopes": authClaims.Scopes,
+	})
+	return signedToken, nil
+}
+
+// startAppSession starts the session of an access token the user granted
+// the client, it is listed with the user's sessions under the client's name.
+func (u *Service) startAppSession(userID int64, clientID string) (*models.Session, error) {
+	client, err := u.Repo.GetClient(clientID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client: %v", err)
+	}
+
+	sessionUserID := uint(userID)
+	now := time.Now().UTC()
+	session := &models.Session{
+		JTI:         rs_utils.GenerateUUID(),
+		Principal:   models.ScramPrincipalUser,
+		UserID:      &sessionUserID,
+		ClientID:    &client.ID,
+		DeviceLabel: client.Name,
+		CreatedAt:   now,
+		LastSeenAt:  now,
+		ExpiresAt:   now.Add(constants.AccessTokenValidityMinutes * time.Minute),
+	}
+
+	err = u.Repo.CreateSession(session)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+
+	return session, nil
+}
+
+// GenerateClientCredentialsToken issues a token that lets the client's own
+// backend call the resource server's client APIs allowed by scopes. It is
+// signed with the same key as the client portal JWT, which the resource
+// server already validates.
+func (u *Service) GenerateClientCredentialsToken(clientID string, scopes []string) (string, error) {
+	if len(scopes) == 0 {
+		return "", fmt.Errorf("no client scopes requested")
+	}
+
+	if err := constants.ValidateClientScopes(scopes); err != nil {
+		return "", err
+	}
+
+	client, err := u.Repo.GetClient(clientID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get client: %v", err)
+	}
+
+	claims := entities.ClientCredentialsClaims{
 		StandardClaims: jwt.StandardClaims{
 			Issuer:    "Globe and Citizen",
 			IssuedAt:  time.Now().UTC().Unix(),
-			Subject:   clientID,
+			Subject:   client.ID,
+			Audience:  constants.ClientCredentialsTokenAudience,
 			ExpiresAt: time.Now().Add(constants.AccessTokenValidityMinutes * time.Minute).UTC().Unix(),
 		},
-		Scopes: authClaims.Scopes,
-		UserID: authClaims.UserID,
+		UserName: client.Username,
+		ClientID: client.ID,
+		Scope:    strings.Join(scopes, ","),
+	}
+
+	signingKey, err := clientCredentialsSigningKey()
+	if err != nil {
+		return "", err
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
-	signedToken, err := token.SignedString([]byte(clientSecret))
+	signedToken, err := token.SignedString([]byte(signingKey))
 	if err != nil {
 		return "", err
 	}
 
+	u.recordClientEvent(audit.EventTokenIssued, client.ID, map[string]string{
+		"grant_type": constants.GrantTypeClientCredentials,
+		"scopes":     claims.Scope,
+	})
 	return signedToken, nil
 }
 
-func (u *Service) ValidateAccessToken(clientSecret string, accessToken string) (*entities.ClientClaims, error) {
+func (u *Service) ValidateAccessToken(accessToken string) (*entities.ClientClaims, error) {
+	signingKey, err := tokenSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
 	token, err := jwt.ParseWithClaims(
 		accessToken,
 		&entities.ClientClaims{},
 		func(token *jwt.Token) (interface{}, error) {
-			return []byte(clientSecret), nil
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return []byte(signingKey), nil
 		},
 	)
 	if err != nil {
@@ -299,15 +809,31 @@ func (u *Service) ValidateAccessToken(clientSecret string, accessToken string) (
 		return nil, fmt.Errorf("access token is expired")
 	}
 
+	if err := rs_utils.CheckSession(u.Repo, claims.Id); err != nil {
+		return nil, err
+	}
+
 	return claims, nil
 }
 
-func (u *Service) GetZkUserMetadata(scopesStr string, userID int64) (*entities.ZkMetadataResponse, error) {
-	if scopesStr == "" {
+// ValidateClientTokenWithScope checks a client portal token, or a client
+// credentials token granted the scope, see rs_utils.ValidateClientTokenWithScope.
+func (u *Service) ValidateClientTokenWithScope(tokenString string, scope string) (*rsModels.ClientClaims, error) {
+	return rs_utils.ValidateClientTokenWithScope(u.Repo, tokenString, scope)
+}
+
+// GetZkUserMetadata returns the metadata of the user the scopes granted to
+// the client release, and records which fields the client read for the
+// user's data access timeline and the audit trail.
+func (u *Service) GetZkUserMetadata(clientID string, scopesStr string, userID int64) (*entities.ZkMetadataResponse, error) {
+	scopes := constants.ParseScopes(scopesStr)
+	if len(scopes) == 0 {
 		return &entities.ZkMetadataResponse{}, fmt.Errorf("no access scopes granted")
 	}
 
-	scopes := strings.Split(scopesStr, ",")
+	if err := constants.ValidateScopes(scopes); err != nil {
+		return &entities.ZkMetadataResponse{}, err
+	}
 
 	userMetadata, err := u.Repo.GetUserMetadata(userID)
 	if err != nil {
@@ -315,31 +841,297 @@ func (u *Service) GetZkUserMetadata(scopesStr string, userID int64) (*entities.Z
 	}
 
 	var zkMetadata entities.ZkMetadataResponse
+	released := []string{}
 
-	for _, scope := range scopes {
-		switch scope {
-		case constants.ReadUserBioScope:
-			zkMetadata.Bio = userMetadata.Bio
-		case constants.ReadUserColorScope:
-			zkMetadata.Color = userMetadata.Color
-		case constants.ReadUserDisplayNameScope:
-			zkMetadata.DisplayName = userMetadata.DisplayName
-		case constants.ReadUserIsEmailVerifiedScope:
-			zkMetadata.IsEmailVerified = userMetadata.IsEmailVerified
-		default:
-			continue
+	for _, name := range scopes {
+		scope, _ := constants.LookupScope(name)
+
+		for _, field := range scope.MetadataFields {
+			if slices.Contains(released, field) {
+				continue
+			}
+
+			switch field {
+			case constants.UserBioMetadataKey:
+				zkMetadata.Bio = userMetadata.Bio
+			case constants.UserColorMetadataKey:
+				zkMetadata.Color = userMetadata.Color
+			case constants.UserDisplayNameMetadataKey:
+				zkMetadata.DisplayName = userMetadata.DisplayName
+			case constants.UserEmailVerifiedMetadataKey:
+				zkMetadata.IsEmailVerified = userMetadata.IsEmailVerified
+				zkMetadata.EmailReproveBy = userMetadata.EmailReproveBy
+			case constants.UserPhoneNumberVerifiedMetadataKey:
+				zkMetadata.IsPhoneNumberVerified = userMetadata.IsPhoneNumberVerified
+				zkMetadata.PhoneNumberReproveBy = userMetadata.PhoneNumberReproveBy
+			case constants.UserEmailDomainMetadataKey, constants.UserEmailDomainMembershipKey:
+				if !userMetadata.IsEmailVerified {
+					continue
+				}
+
+				proofs, err := u.emailDomainProofs(clientID, userID, field)
+				if err != nil {
+					return &entities.ZkMetadataResponse{}, fmt.Errorf("failed to get email domain proofs: %v", err)
+				}
+
+				setEmailDomainClaims(&zkMetadata, field, proofs)
+			}
+
+			released = append(released, field)
 		}
 	}
 
+	// metadata is only released once the user can see the release in the
+	// data access timeline
+	err = u.Repo.SaveDataAccessRecord(&models.DataAccessRecord{
+		UserID:     uint(userID),
+		ClientID:   clientID,
+		Scopes:     strings.Join(scopes, ","),
+		Fields:     strings.Join(released, ","),
+		AccessedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return &entities.ZkMetadataResponse{}, fmt.Errorf("failed to record the data access: %v", err)
+	}
+
+	u.recordUserEvent(audit.EventMetadataAccessed, userID, clientID, map[string]string{
+		"scopes": strings.Join(scopes, ","),
+		"fields": strings.Join(released, ","),
+	})
 	return &zkMetadata, nil
 }
 
+// emailDomainProofs returns the proofs made for the client of the domain of
+// the user's verified email address: the proof naming the domain for the
+// email domain field, the proofs of the configured domain sets, which do not
+// name it, for the membership field. They are made the first time the field
+// is released to the client, so a domain is only ever proved to the clients
+// the user released it to.
+func (u *Service) emailDomainProofs(clientID string, userID int64, field string) ([]models.EmailDomainProof, error) {
+	stored, err := u.Repo.GetEmailDomainProofs(userID, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	namesDomain := field == constants.UserEmailDomainMetadataKey
+	var proofs []models.EmailDomainProof
+	for _, proof := range stored {
+		if (proof.Domain != nil) == namesDomain {
+			proofs = append(proofs, proof)
+		}
+	}
+	if len(proofs) > 0 || u.EmailDomainProver == nil {
+		return proofs, nil
+	}
+
+	emailDomain, err := u.Repo.GetUserEmailDomain(userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if namesDomain {
+		proof, err := u.EmailDomainProver.ProveEmailDomain(*emailDomain, clientID)
+		if err != nil {
+			return nil, err
+		}
+		proofs = []models.EmailDomainProof{proof}
+	} else {
+		proofs, err = u.EmailDomainProver.ProveEmailDomainMemberships(*emailDomain, clientID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(proofs) > 0 {
+		if err := u.Repo.SaveEmailDomainProofs(proofs); err != nil {
+			return nil, err
+		}
+	}
+
+	return proofs, nil
+}
+
+// setEmailDomainClaims releases the proofs of a field, see emailDomainProofs.
+func setEmailDomainClaims(zkMetadata *entities.ZkMetadataResponse, field string, proofs []models.EmailDomainProof) {
+	for _, proof := range proofs {
+		claim := entities.EmailDomainClaim{
+			DomainSet:        proof.DomainSet,
+			DomainSetRoot:    proof.DomainSetRoot,
+			Nullifier:        proof.Nullifier,
+			DomainCommitment: proof.DomainCommitment,
+			ZkProof:          proof.ZkProof,
+			ZkKeyPairID:      proof.ZkKeyPairID,
+		}
+
+		switch {
+		case field == constants.UserEmailDomainMetadataKey && proof.Domain != nil:
+			claim.Domain = *proof.Domain
+			zkMetadata.EmailDomain = &claim
+		case field == constants.UserEmailDomainMembershipKey && proof.Domain == nil:
+			zkMetadata.EmailDomainMemberships = append(zkMetadata.EmailDomainMemberships, claim)
+		}
+	}
+}
+
+// tokenSigningKey returns the server key authorization codes and user access
+// tokens are signed with. It used to be the client secret, which tied token
+// validity to a value a client can rotate and which had to be stored readable.
+func tokenSigningKey() (string, error) {
+	key := os.Getenv("OAUTH_TOKEN_SIGNING_KEY")
+	if key == "" {
+		return "", fmt.Errorf("oauth token signing key is not configured")
+	}
+	return key, nil
+}
+
+// clientCredentialsSigningKey returns the key of client credentials tokens.
+// It is neither JWT_SECRET_KEY nor the key of user access tokens, so a client
+// credentials token is never accepted where a portal or user token is
+// expected, nor the other way around.
+func clientCredentialsSigningKey() (string, error) {
+	key := os.Getenv("CLIENT_CREDENTIALS_TOKEN_SIGNING_KEY")
+	if key == "" {
+		return "", fmt.Errorf("client credentials token signing key is not configured")
+	}
+	return key, nil
+}
+
+// GetPairwiseSubject returns the identifier under which the user is known to
+// the given client. It is an HMAC of the client and user IDs keyed with a
+// server secret: stable for one client, unlinkable across clients. Anything
+// handed to a client that identifies the user (access tokens, zk metadata,
+// id tokens) must use this value instead of the internal user ID.
+func (u *Service) GetPairwiseSubject(clientID string, userID int64) (string, error) {
+	secret := os.Getenv("PAIRWISE_SUBJECT_SECRET")
+	if secret == "" {
+		return "", fmt.Errorf("pairwise subject secret is not configured")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(clientID + ":" + strconv.FormatInt(userID, 10)))
+	subject := hex.EncodeToString(mac.Sum(nil))
+
+	err := u.Repo.SavePairwiseSubject(&models.PairwiseSubject{
+		ClientID: clientID,
+		UserID:   uint(userID),
+		Subject:  subject,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to save pairwise subject: %v", err)
+	}
+
+	return subject, nil
+}
+
+// ResolvePairwiseSubject maps a subject issued to the given client back to
+// the internal user ID. The result must never leave Layer8.
+func (u *Service) ResolvePairwiseSubject(clientID string, subject string) (int64, error) {
+	pairwiseSubject, err := u.Repo.GetPairwiseSubject(clientID, subject)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve pairwise subject: %v", err)
+	}
+
+	return int64(pairwiseSubject.UserID), nil
+}
+
+// SaveUserConsent stores the scopes the user approved for the client, replacing
+// any earlier decision.
+func (u *Service) SaveUserConsent(userID int64, clientID string, scopes []string) error {
+	granted := []string{}
+	for _, scope := range scopes {
+		if scope != "" && !slices.Contains(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+
+	err := u.Repo.SaveUserConsent(&models.UserConsent{
+		UserID:    uint(userID),
+		ClientID:  clientID,
+		Scopes:    strings.Join(granted, ","),
+		GrantedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save user consent: %v", err)
+	}
+
+	u.recordUserEvent(audit.EventConsentGranted, userID, clientID, map[string]string{
+		"scopes": strings.Join(granted, ","),
+	})
+	return nil
+}
+
+// GetCoveringConsent returns the user's consent for the client if it already
+// includes every requested scope, and nil if the user has to be asked again.
+func (u *Service) GetCoveringConsent(userID int64, clientID string, scopes []string) (*models.UserConsent, error) {
+	consent, err := u.Repo.GetUserConsent(userID, clientID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user consent: %v", err)
+	}
+
+	granted := strings.Split(consent.Scopes, ",")
+	for _, scope := range scopes {
+		if scope != "" && !slices.Contains(granted, scope) {
+			return nil, nil
+		}
+	}
+
+	return consent, nil
+}
+
+// VerifyUserConsent checks that a token issued at issuedAt is still backed by
+// the user's consent. Revoking the consent, or granting it anew, invalidates
+// every token issued before that moment.
+func (u *Service) VerifyUserConsent(userID int64, clientID string, issuedAt int64) error {
+	consent, err := u.Repo.GetUserConsent(userID, clientID)
+	if err != nil {
+		return fmt.Errorf("no active consent for the client: %v", err)
+	}
+
+	if consent.GrantedAt.Unix() > issuedAt {
+		return fmt.Errorf("the token was issued before the current consent was granted")
+	}
+
+	err = u.Repo.UpdateUserConsentLastUsedAt(userID, clientID, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to update consent usage: %v", err)
+	}
+
+	return nil
+}
+
+// ResolveRedirectURI returns the registered redirect URI of the client that
+// the authorization response for this request must be sent to.
+func (u *Service) ResolveRedirectURI(client *models.Client, requested string) (string, error) {
+	registered, err := u.Repo.GetClientRedirectURIs(client.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get client redirect uris: %v", err)
+	}
+
+	// clients created outside of the portal only have the legacy column set
+	if len(registered) == 0 && client.RedirectURI != "" {
+		registered = []string{client.RedirectURI}
+	}
+
+	return utils.MatchRedirectURI(registered, requested)
+}
+
 // this is only be used for testing purposes
 func (u *Service) AddTestClient() (*models.Client, error) {
+	secretHash, err := utils.HashClientSecret("absolutelynotasecret!")
+	if err != nil {
+		return nil, err
+	}
+
 	rmSalt := rs_utils.GenerateRandomSalt(rs_utils.SaltSize)
 	client := &models.Client{
 		ID:          "notanid",
-		Secret:      "absolutelynotasecret!",
+		SecretHash:  secretHash,
 		Name:        "Ex-C",
 		RedirectURI: "http://localhost:5173/oauth2/callback",
 		BackendURI:  os.Getenv("TEST_CLIENT_BACKEND_URL"),
@@ -348,9 +1140,202 @@ func (u *Service) AddTestClient() (*models.Client, error) {
 		// BackendURI:  "localhost:8000",
 	}
 
-	err := u.Repo.SetClient(client)
+	err = u.Repo.SetClient(client)
 	if err != nil {
 		return nil, err
 	}
 	return client, nil
 }
+
+// userCodeAlphabet has no vowels, so user codes cannot spell words, and no
+// digits that could be mistaken for letters (RFC 8628, section 6.1).
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// CreateDeviceAuthorization starts a device authorization grant. The returned
+// device code is only stored hashed, so it cannot be read back later.
+func (u *Service) CreateDeviceAuthorization(clientID string, scopes []string) (string, *models.DeviceAuthorization, error) {
+	deviceCode, err := utilities.GenerateRandomString(32)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not generate device code: %v", err)
+	}
+
+	userCode, err := generateUserCode()
+	if err != nil {
+		return "", nil, fmt.Errorf("could not generate user code: %v", err)
+	}
+
+	authorization := &models.DeviceAuthorization{
+		DeviceCodeHash: hashDeviceCode(deviceCode),
+		UserCode:       userCode,
+		ClientID:       clientID,
+		Scopes:         strings.Join(scopes, ","),
+		Status:         constants.DeviceAuthorizationPending,
+		Interval:       constants.DevicePollingIntervalSeconds,
+		ExpiresAt:      time.Now().UTC().Add(constants.DeviceCodeValidityMinutes * time.Minute),
+	}
+
+	if err := u.Repo.SaveDeviceAuthorization(authorization); err != nil {
+		return "", nil, fmt.Errorf("failed to save device authorization: %v", err)
+	}
+
+	return deviceCode, authorization, nil
+}
+
+// GetPendingDeviceAuthorization gets the device authorization the user code
+// was issued for, provided it has not expired or been decided on yet.
+func (u *Service) GetPendingDeviceAuthorization(userCode string) (*models.DeviceAuthorization, error) {
+	authorization, err := u.Repo.GetDeviceAuthorizationByUserCode(normalizeUserCode(userCode))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device authorization: %v", err)
+	}
+
+	if authorization.Status != constants.DeviceAuthorizationPending {
+		return nil, fmt.Errorf("the device authorization was already %s", authorization.Status)
+	}
+
+	if time.Now().UTC().After(authorization.ExpiresAt) {
+		return nil, fmt.Errorf("the user code has expired")
+	}
+
+	return authorization, nil
+}
+
+// ApproveDeviceAuthorization grants the device the given scopes on behalf of
+// the user. The device receives its token on its next poll.
+func (u *Service) ApproveDeviceAuthorization(userCode string, userID int64, scopes []string) error {
+	authorization, err := u.GetPendingDeviceAuthorization(userCode)
+	if err != nil {
+		return err
+	}
+
+	client, err := u.GetClient(authorization.ClientID)
+	if err != nil {
+		return fmt.Errorf("could not get client: %v", err)
+	}
+	if err := u.checkUserTwoFactor(client, userID); err != nil {
+		return err
+	}
+
+	approvedBy := uint(userID)
+	err = u.Repo.DecideDeviceAuthorization(
+		authorization.UserCode, constants.DeviceAuthorizationApproved, &approvedBy, strings.Join(scopes, ","),
+	)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("the device authorization was already decided")
+	}
+	return err
+}
+
+// DenyDeviceAuthorization records that the user refused the device's request.
+func (u *Service) DenyDeviceAuthorization(userCode string) error {
+	authorization, err := u.GetPendingDeviceAuthorization(userCode)
+	if err != nil {
+		return err
+	}
+
+	err = u.Repo.DecideDeviceAuthorization(
+		authorization.UserCode, constants.DeviceAuthorizationDenied, nil, authorization.Scopes,
+	)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("the device authorization was already decided")
+	}
+	return err
+}
+
+// PollDeviceAuthorization handles a device polling the token endpoint. While
+// the user has not decided it returns constants.ErrAuthorizationPending, or
+// constants.ErrSlowDown if the device polls faster than its interval. Once
+// approved, it returns the same claims an authorization code would carry and
+// the device code cannot be redeemed again.
+func (u *Service) PollDeviceAuthorization(clientID string, deviceCode string) (*utilities.AuthCodeClaims, error) {
+	authorization, err := u.Repo.GetDeviceAuthorizationByDeviceCodeHash(hashDeviceCode(deviceCode))
+	if err != nil || authorization.ClientID != clientID {
+		return nil, fmt.Errorf("the device code is invalid")
+	}
+
+	now := time.Now().UTC()
+
+	if now.After(authorization.ExpiresAt) {
+		if err := u.Repo.DeleteDeviceAuthorization(authorization.ID); err != nil {
+			log.Printf("failed to delete expired device authorization: %v", err)
+		}
+		return nil, constants.ErrExpiredToken
+	}
+
+	switch authorization.Status {
+	case constants.DeviceAuthorizationApproved:
+		if err := u.Repo.DeleteDeviceAuthorization(authorization.ID); err != nil {
+			return nil, fmt.Errorf("the device code was already redeemed: %v", err)
+		}
+
+		return &utilities.AuthCodeClaims{
+			ClientID:  authorization.ClientID,
+			UserID:    int64(*authorization.UserID),
+			Scopes:    authorization.Scopes,
+			ExpiresAt: authorization.ExpiresAt.Unix(),
+		}, nil
+	case constants.DeviceAuthorizationDenied:
+		if err := u.Repo.DeleteDeviceAuthorization(authorization.ID); err != nil {
+			log.Printf("failed to delete denied device authorization: %v", err)
+		}
+		return nil, constants.ErrAccessDenied
+	}
+
+	tooSoon := authorization.LastPolledAt != nil &&
+		now.Sub(*authorization.LastPolledAt) < time.Duration(authorization.Interval)*time.Second
+
+	// every slow_down response permanently adds 5 seconds to the interval
+	if tooSoon {
+		authorization.Interval += constants.DevicePollingIntervalSeconds
+	}
+	authorization.LastPolledAt = &now
+
+	err = u.Repo.RecordDeviceAuthorizationPoll(authorization.DeviceCodeHash, now, authorization.Interval)
+	// the user decided since the authorization was read, the next poll gets the decision
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, constants.ErrAuthorizationPending
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save device authorization: %v", err)
+	}
+
+	if tooSoon {
+		return nil, constants.ErrSlowDown
+	}
+
+	return nil, constants.ErrAuthorizationPending
+}
+
+// generateUserCode returns a random code in the XXXX-XXXX format shown to the user.
+func generateUserCode() (string, error) {
+	code := make([]byte, 8)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code[:4]) + "-" + string(code[4:]), nil
+}
+
+// normalizeUserCode accepts a user code typed in lower case, with spaces or
+// without the dash.
+func normalizeUserCode(userCode string) string {
+	code := strings.Map(func(r rune) rune {
+		if r == '-' || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, userCode)
+
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+func hashDeviceCode(deviceCode string) string {
+	hash := sha256.Sum256([]byte(deviceCode))
+	return hex.EncodeToString(hash[:])
+}
@@ -1,17 +1,32 @@
 package service
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"globe-and-citizen/layer8/server/audit"
+	"globe-and-citizen/layer8/server/constants"
+	"globe-and-citizen/layer8/server/entities"
 	"globe-and-citizen/layer8/server/models"
+	rsModels "globe-and-citizen/layer8/server/resource_server/models"
+	rsUtils "globe-and-citizen/layer8/server/resource_server/utils"
+	"globe-and-citizen/layer8/server/totp"
+	"globe-and-citizen/layer8/server/utils"
+	"globe-and-citizen/layer8/server/webauthn"
+	"globe-and-citizen/layer8/server/webauthn/webauthntest"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	utilities "github.com/globe-and-citizen/layer8-utils"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"gorm.io/gorm"
 )
 
 // MockRepository is a mock implementation of the Repository interface
@@ -26,6 +41,9 @@ const userID int64 = 10
 const color = "some_color"
 const displayName = "some_display_name"
 const bio = "some_bio"
+const pairwiseSubjectSecret = "pairwise_subject_secret"
+const tokenSigningKeyValue = "token_signing_key"
+const redirectURI = "https://client.com/callback"
 
 func (m *MockRepository) GetClient(key string) (*models.Client, error) {
 	args := m.Called(key)
@@ -42,12 +60,89 @@ func (m *MockRepository) GetClientByURL(backendURL string) (*models.Client, erro
 
 // Implement other required repository methods with empty implementations
 func (m *MockRepository) SetClient(client *models.Client) error                           { return nil }
-func (m *MockRepository) GetUserByID(id int64) (*models.User, error)                      { return nil, nil }
 func (m *MockRepository) LoginUserPrecheck(username string) (string, error)               { return "", nil }
-func (m *MockRepository) GetUser(username string) (*models.User, error)                   { return nil, nil }
 func (m *MockRepository) SetTTL(key string, value []byte, expiration time.Duration) error { return nil }
 func (m *MockRepository) GetTTL(key string) ([]byte, error)                               { return nil, nil }
 
+func (m *MockRepository) GetUser(username string) (*models.User, error) {
+	args := m.Called(username)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.User), args.Error(1)
+}
+
+func (m *MockRepository) GetUserByID(id int64) (*models.User, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.User), args.Error(1)
+}
+
+func (m *MockRepository) GetTwoFactorCredential(principal string, username string) (*models.TwoFactorCredential, error) {
+	args := m.Called(principal, username)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.TwoFactorCredential), args.Error(1)
+}
+
+func (m *MockRepository) UseTwoFactorStep(credentialID uint, step int64) error {
+	args := m.Called(credentialID, step)
+	return args.Error(0)
+}
+
+func (m *MockRepository) UseTwoFactorRecoveryCode(credentialID uint, codeHash string, usedAt time.Time) error {
+	args := m.Called(credentialID, codeHash)
+	return args.Error(0)
+}
+
+func (m *MockRepository) GetPasskey(credentialID string) (*models.Passkey, error) {
+	args := m.Called(credentialID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.Passkey), args.Error(1)
+}
+
+func (m *MockRepository) ConsumeWebAuthnChallenge(ceremony string, challenge string, userID uint, now time.Time) error {
+	args := m.Called(ceremony, challenge, userID)
+	return args.Error(0)
+}
+
+func (m *MockRepository) UseWebAuthnCredential(id uint, signCount uint32, usedAt time.Time) error {
+	args := m.Called(id, signCount)
+	return args.Error(0)
+}
+
+func (m *MockRepository) SaveDataAccessRecord(record *models.DataAccessRecord) error {
+	args := m.Called(record)
+	return args.Error(0)
+}
+
+func (m *MockRepository) UseAuthorizationCode(jti string, expiresAt time.Time, now time.Time) error {
+	args := m.Called(jti)
+	return args.Error(0)
+}
+
+func (m *MockRepository) CreateSession(session *models.Session) error {
+	args := m.Called(session)
+	return args.Error(0)
+}
+
+func (m *MockRepository) TouchSession(jti string, now time.Time) error {
+	args := m.Called(jti)
+	return args.Error(0)
+}
+
+func (m *MockRepository) ConsumeScramSession(
+	principal string, username string, nonce string, cNonce string, now time.Time,
+) error {
+	args := m.Called(principal, username, nonce, cNonce)
+	return args.Error(0)
+}
+
 func (m *MockRepository) GetUserMetadata(userID int64) (*models.UserMetadata, error) {
 	returnValues := m.Called(userID)
 	if returnValues.Get(0) == nil {
@@ -57,6 +152,102 @@ func (m *MockRepository) GetUserMetadata(userID int64) (*models.UserMetadata, er
 	return returnValues.Get(0).(*models.UserMetadata), returnValues.Error(1)
 }
 
+func (m *MockRepository) SavePairwiseSubject(subject *models.PairwiseSubject) error {
+	args := m.Called(subject)
+	return args.Error(0)
+}
+
+func (m *MockRepository) GetUserEmailDomain(userID int64) (*models.UserEmailDomain, error) {
+	args := m.Called(userID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.UserEmailDomain), args.Error(1)
+}
+
+func (m *MockRepository) GetEmailDomainProofs(userID int64, clientID string) ([]models.EmailDomainProof, error) {
+	args := m.Called(userID, clientID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]models.EmailDomainProof), args.Error(1)
+}
+
+func (m *MockRepository) SaveEmailDomainProofs(proofs []models.EmailDomainProof) error {
+	args := m.Called(proofs)
+	return args.Error(0)
+}
+
+func (m *MockRepository) GetPairwiseSubject(clientID string, subject string) (*models.PairwiseSubject, error) {
+	args := m.Called(clientID, subject)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.PairwiseSubject), args.Error(1)
+}
+
+func (m *MockRepository) SaveUserConsent(consent *models.UserConsent) error {
+	args := m.Called(consent)
+	return args.Error(0)
+}
+
+func (m *MockRepository) GetUserConsent(userID int64, clientID string) (*models.UserConsent, error) {
+	args := m.Called(userID, clientID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.UserConsent), args.Error(1)
+}
+
+func (m *MockRepository) UpdateUserConsentLastUsedAt(userID int64, clientID string, lastUsedAt time.Time) error {
+	args := m.Called(userID, clientID, lastUsedAt)
+	return args.Error(0)
+}
+
+func (m *MockRepository) GetClientRedirectURIs(clientID string) ([]string, error) {
+	args := m.Called(clientID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockRepository) SaveDeviceAuthorization(authorization *models.DeviceAuthorization) error {
+	args := m.Called(authorization)
+	return args.Error(0)
+}
+
+func (m *MockRepository) DecideDeviceAuthorization(userCode string, status string, userID *uint, scopes string) error {
+	args := m.Called(userCode, status, userID, scopes)
+	return args.Error(0)
+}
+
+func (m *MockRepository) RecordDeviceAuthorizationPoll(deviceCodeHash string, lastPolledAt time.Time, interval int) error {
+	args := m.Called(deviceCodeHash, lastPolledAt, interval)
+	return args.Error(0)
+}
+
+func (m *MockRepository) GetDeviceAuthorizationByUserCode(userCode string) (*models.DeviceAuthorization, error) {
+	args := m.Called(userCode)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.DeviceAuthorization), args.Error(1)
+}
+
+func (m *MockRepository) GetDeviceAuthorizationByDeviceCodeHash(deviceCodeHash string) (*models.DeviceAuthorization, error) {
+	args := m.Called(deviceCodeHash)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.DeviceAuthorization), args.Error(1)
+}
+
+func (m *MockRepository) DeleteDeviceAuthorization(id uint) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
 func (m *MockRepository) SaveX509Certificate(clientID string, certificate string) error {
 	args := m.Called(clientID, certificate)
 	return args.Error(0)
@@ -131,7 +322,6 @@ func TestService_CheckClient(t *testing.T) {
 			backendURL: "http://valid-client.com",
 			wantClient: &models.Client{
 				ID:         "test-client",
-				Secret:     "test-secret",
 				Name:       "Test Client",
 				BackendURI: "http://valid-client.com",
 			},
@@ -140,7 +330,6 @@ func TestService_CheckClient(t *testing.T) {
 				m.On("GetClientByURL", "http://valid-client.com").
 					Return(&models.Client{
 						ID:         "test-client",
-						Secret:     "test-secret",
 						Name:       "Test Client",
 						BackendURI: "http://valid-client.com",
 					}, nil)
@@ -223,6 +412,23 @@ func TestSaveX509Certificate_Success(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestSaveX509Certificate_UploadAudited(t *testing.T) {
+	sink := &recordingSink{}
+	mockRepo := &MockRepository{}
+	mockRepo.On("SaveX509Certificate", clientID, certificate).Return(nil)
+	mockRepo.On("GetClient", clientID).Return(&models.Client{ID: clientID, Username: "acme"}, nil)
+	service := &Service{Repo: mockRepo, Audit: sink}
+
+	err := service.SaveX509Certificate(clientID, certificate)
+
+	assert.Nil(t, err)
+	assert.Len(t, sink.events, 1)
+	assert.Equal(t, audit.EventCertificateUploaded, sink.events[0].Type)
+	assert.Equal(t, rsModels.ScramPrincipalClient, sink.events[0].Principal)
+	assert.Equal(t, "acme", sink.events[0].Subject)
+	assert.Equal(t, clientID, sink.events[0].ClientID)
+}
+
 func TestAuthenticateClient_FailedToGetClient(t *testing.T) {
 	mockRepo := &MockRepository{}
 	mockRepo.On("GetClient", clientID).Return(
@@ -235,12 +441,20 @@ func TestAuthenticateClient_FailedToGetClient(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func hashClientSecret(t *testing.T, secret string) string {
+	hash, err := utils.HashClientSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
 func TestAuthenticateClient_ClientSecretDoesNotMatch(t *testing.T) {
 	mockRepo := &MockRepository{}
 	mockRepo.On("GetClient", clientID).Return(
 		&models.Client{
-			ID:     clientID,
-			Secret: "other_secret",
+			ID:         clientID,
+			SecretHash: hashClientSecret(t, "other_secret"),
 		}, nil,
 	)
 	service := NewService(mockRepo)
@@ -255,8 +469,8 @@ func TestAuthenticateClient_ClientAuthenticatedSuccessfully(t *testing.T) {
 	mockRepo := &MockRepository{}
 	mockRepo.On("GetClient", clientID).Return(
 		&models.Client{
-			ID:     clientID,
-			Secret: clientSecret,
+			ID:         clientID,
+			SecretHash: hashClientSecret(t, clientSecret),
 		}, nil,
 	)
 	service := NewService(mockRepo)
@@ -266,115 +480,1575 @@ func TestAuthenticateClient_ClientAuthenticatedSuccessfully(t *testing.T) {
 	assert.Nil(t, err)
 }
 
-func TestGenerateAccessToken_Success(t *testing.T) {
+func TestAuthenticateClient_PreviousSecretWithinOverlap(t *testing.T) {
+	expiresAt := time.Now().UTC().Add(time.Hour)
 	mockRepo := &MockRepository{}
+	mockRepo.On("GetClient", clientID).Return(
+		&models.Client{
+			ID:                      clientID,
+			SecretHash:              hashClientSecret(t, "new_secret"),
+			PreviousSecretHash:      hashClientSecret(t, clientSecret),
+			PreviousSecretExpiresAt: &expiresAt,
+		}, nil,
+	)
 	service := NewService(mockRepo)
 
-	accessToken, err := service.GenerateAccessToken(
-		&utilities.AuthCodeClaims{UserID: userID, ClientID: clientID},
-		clientID,
-		clientSecret)
+	err := service.AuthenticateClient(clientID, clientSecret)
+
 	assert.Nil(t, err)
+}
+
+func TestAuthenticateClient_PreviousSecretAfterOverlap(t *testing.T) {
+	expiresAt := time.Now().UTC().Add(-time.Minute)
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetClient", clientID).Return(
+		&models.Client{
+			ID:                      clientID,
+			SecretHash:              hashClientSecret(t, "new_secret"),
+			PreviousSecretHash:      hashClientSecret(t, clientSecret),
+			PreviousSecretExpiresAt: &expiresAt,
+		}, nil,
+	)
+	service := NewService(mockRepo)
+
+	err := service.AuthenticateClient(clientID, clientSecret)
+
+	assert.NotNil(t, err)
+}
+
+func TestCheckClientGrantType_NoGrantTypesRegistered(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetClient", clientID).Return(&models.Client{ID: clientID}, nil)
+	service := NewService(mockRepo)
+
+	err := service.CheckClientGrantType(clientID, constants.GrantTypeDeviceCode)
 
-	claims, err := service.ValidateAccessToken(clientSecret, accessToken)
 	assert.Nil(t, err)
+}
 
-	assert.Equal(t, clientID, claims.Subject)
-	assert.Equal(t, "Globe and Citizen", claims.Issuer)
+func TestCheckClientGrantType_GrantTypeNotRegistered(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetClient", clientID).Return(
+		&models.Client{
+			ID:         clientID,
+			GrantTypes: constants.GrantTypeClientCredentials,
+		}, nil,
+	)
+	service := NewService(mockRepo)
+
+	assert.Nil(t, service.CheckClientGrantType(clientID, constants.GrantTypeClientCredentials))
+	assert.NotNil(t, service.CheckClientGrantType(clientID, constants.GrantTypeAuthorizationCode))
 }
 
-func TestGetZkUserMetadata_NoScopesProvided(t *testing.T) {
+func TestGenerateClientCredentialsToken_UnknownScope(t *testing.T) {
 	mockRepo := &MockRepository{}
 	service := NewService(mockRepo)
 
-	_, err := service.GetZkUserMetadata("", userID)
+	_, err := service.GenerateClientCredentialsToken(clientID, []string{"read:user"})
 
 	assert.NotNil(t, err)
+	mockRepo.AssertNotCalled(t, "GetClient", mock.Anything)
 }
 
-func TestGetZkUserMetadata_RepoFailedToReturnUserMetadata(t *testing.T) {
-	scopes := "color"
+func TestGenerateClientCredentialsToken_Success(t *testing.T) {
+	os.Setenv("JWT_SECRET_KEY", "jwt_secret_key")
+	defer os.Unsetenv("JWT_SECRET_KEY")
+	os.Setenv("CLIENT_CREDENTIALS_TOKEN_SIGNING_KEY", "client_credentials_token_signing_key")
+	defer os.Unsetenv("CLIENT_CREDENTIALS_TOKEN_SIGNING_KEY")
 
 	mockRepo := &MockRepository{}
-	mockRepo.On(
-		"GetUserMetadata", userID,
-	).Return(nil, fmt.Errorf("error"))
+	mockRepo.On("GetClient", clientID).Return(
+		&models.Client{ID: clientID, Username: "client_username"}, nil,
+	)
 	service := NewService(mockRepo)
 
-	_, err := service.GetZkUserMetadata(scopes, userID)
+	token, err := service.GenerateClientCredentialsToken(clientID, []string{constants.ClientReadUsageStatsScope})
+	assert.Nil(t, err)
+
+	// client credentials tokens have no session
+	claims, err := rsUtils.ValidateClientTokenWithScope(mockRepo, token, constants.ClientReadUsageStatsScope)
+	assert.Nil(t, err)
+	assert.Equal(t, clientID, claims.ClientID)
+	assert.Equal(t, "client_username", claims.UserName)
 
+	_, err = rsUtils.ValidateClientTokenWithScope(mockRepo, token, constants.ClientWriteCertificateScope)
+	assert.NotNil(t, err)
+
+	_, err = rsUtils.ValidateClientToken(mockRepo, token)
 	assert.NotNil(t, err)
-	assert.True(t, strings.HasPrefix(err.Error(), "failed to get user metadata:"))
 }
 
-func TestGetZkUserMetadata_OnlyColorMetadataReturned(t *testing.T) {
-	scopes := "read:user:color"
+func TestGenerateAccessToken_Success(t *testing.T) {
+	os.Setenv("PAIRWISE_SUBJECT_SECRET", pairwiseSubjectSecret)
+	defer os.Unsetenv("PAIRWISE_SUBJECT_SECRET")
+	os.Setenv("OAUTH_TOKEN_SIGNING_KEY", tokenSigningKeyValue)
+	defer os.Unsetenv("OAUTH_TOKEN_SIGNING_KEY")
 
 	mockRepo := &MockRepository{}
-	mockRepo.On(
-		"GetUserMetadata", userID,
-	).Return(&models.UserMetadata{
-		ID:                    uint(userID),
-		DisplayName:           displayName,
-		Color:                 color,
-		Bio:                   bio,
-		IsEmailVerified:       true,
-		IsPhoneNumberVerified: true,
-	}, nil)
+	mockRepo.On("SavePairwiseSubject", mock.Anything).Return(nil)
+	mockRepo.On("GetClient", clientID).Return(&models.Client{ID: clientID, Name: "App"}, nil)
+	var session *models.Session
+	mockRepo.On("CreateSession", mock.Anything).Run(func(args mock.Arguments) {
+		session = args.Get(0).(*models.Session)
+	}).Return(nil)
+	mockRepo.On("TouchSession", mock.Anything).Return(nil)
+	service := NewService(mockRepo)
+
+	accessToken, err := service.GenerateAccessToken(
+		&utilities.AuthCodeClaims{UserID: userID, ClientID: clientID},
+		clientID)
+	assert.Nil(t, err)
+
+	// the access token is an app session of the user, labelled with the app
+	assert.Equal(t, uint(userID), *session.UserID)
+	assert.Equal(t, clientID, *session.ClientID)
+	assert.Equal(t, "App", session.DeviceLabel)
+
+	claims, err := service.ValidateAccessToken(accessToken)
+	assert.Nil(t, err)
+	assert.Equal(t, session.JTI, claims.Id)
+	mockRepo.AssertCalled(t, "TouchSession", session.JTI)
+
+	subject, err := service.GetPairwiseSubject(clientID, userID)
+	assert.Nil(t, err)
+
+	assert.Equal(t, subject, claims.Subject)
+	assert.Equal(t, clientID, claims.Audience)
+	assert.Equal(t, "Globe and Citizen", claims.Issuer)
+
+	// tokens must not outlive a change of the signing key
+	os.Setenv("OAUTH_TOKEN_SIGNING_KEY", "another_signing_key")
+	_, err = service.ValidateAccessToken(accessToken)
+	assert.NotNil(t, err)
+}
 
+func TestValidateAccessToken_SessionRevoked(t *testing.T) {
+	os.Setenv("PAIRWISE_SUBJECT_SECRET", pairwiseSubjectSecret)
+	defer os.Unsetenv("PAIRWISE_SUBJECT_SECRET")
+	os.Setenv("OAUTH_TOKEN_SIGNING_KEY", tokenSigningKeyValue)
+	defer os.Unsetenv("OAUTH_TOKEN_SIGNING_KEY")
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("SavePairwiseSubject", mock.Anything).Return(nil)
+	mockRepo.On("GetClient", clientID).Return(&models.Client{ID: clientID}, nil)
+	mockRepo.On("CreateSession", mock.Anything).Return(nil)
+	mockRepo.On("TouchSession", mock.Anything).Return(gorm.ErrRecordNotFound)
 	service := NewService(mockRepo)
-	zkMetadata, err := service.GetZkUserMetadata(scopes, userID)
 
+	accessToken, err := service.GenerateAccessToken(
+		&utilities.AuthCodeClaims{UserID: userID, ClientID: clientID},
+		clientID)
 	assert.Nil(t, err)
-	assert.Equal(t, color, zkMetadata.Color)
-	assert.Equal(t, "", zkMetadata.DisplayName)
-	assert.False(t, zkMetadata.IsEmailVerified)
+
+	_, err = service.ValidateAccessToken(accessToken)
+	assert.ErrorIs(t, err, constants.ErrSessionRevoked)
 }
 
-func TestGetZkUserMetadata_ColorAndIsEmailVerifiedMetadataReturned(t *testing.T) {
-	scopes := "read:user:color,read:user:is_email_verified"
+func TestGenerateAccessToken_PairwiseSecretNotConfigured(t *testing.T) {
+	os.Unsetenv("PAIRWISE_SUBJECT_SECRET")
+	os.Setenv("OAUTH_TOKEN_SIGNING_KEY", tokenSigningKeyValue)
+	defer os.Unsetenv("OAUTH_TOKEN_SIGNING_KEY")
+
 	mockRepo := &MockRepository{}
+	service := NewService(mockRepo)
 
-	mockRepo.On(
-		"GetUserMetadata", userID,
-	).Return(&models.UserMetadata{
-		ID:                    uint(userID),
-		DisplayName:           displayName,
-		Color:                 color,
-		Bio:                   bio,
-		IsEmailVerified:       true,
-		IsPhoneNumberVerified: true,
-	}, nil)
+	_, err := service.GenerateAccessToken(
+		&utilities.AuthCodeClaims{UserID: userID, ClientID: clientID},
+		clientID)
+	assert.NotNil(t, err)
+	mockRepo.AssertNotCalled(t, "SavePairwiseSubject", mock.Anything)
+}
+
+func TestGenerateAccessToken_SigningKeyNotConfigured(t *testing.T) {
+	os.Unsetenv("OAUTH_TOKEN_SIGNING_KEY")
 
+	mockRepo := &MockRepository{}
 	service := NewService(mockRepo)
-	zkMetadata, err := service.GetZkUserMetadata(scopes, userID)
 
-	assert.Nil(t, err)
-	assert.Equal(t, color, zkMetadata.Color)
-	assert.Equal(t, true, zkMetadata.IsEmailVerified)
-	assert.Equal(t, "", zkMetadata.DisplayName)
+	_, err := service.GenerateAccessToken(
+		&utilities.AuthCodeClaims{UserID: userID, ClientID: clientID},
+		clientID)
+	assert.NotNil(t, err)
 }
 
-func TestGetZkUserMetadata_AllMetadataReturned(t *testing.T) {
-	scopes := "read:user:color,read:user:is_email_verified,read:user:display_name"
+func TestDecodeAuthorizationCode_IssuedToAnotherClient(t *testing.T) {
+	os.Setenv("OAUTH_TOKEN_SIGNING_KEY", tokenSigningKeyValue)
+	defer os.Unsetenv("OAUTH_TOKEN_SIGNING_KEY")
+
+	code, err := utilities.GenerateAuthCode(tokenSigningKeyValue, &utilities.AuthCodeClaims{
+		ClientID:       "another_client",
+		UserID:         userID,
+		RedirectURI:    redirectURI,
+		ExpiresAt:      time.Now().Add(time.Minute).Unix(),
+		StandardClaims: jwt.StandardClaims{Id: "jti"},
+	})
+	assert.Nil(t, err)
+
 	mockRepo := &MockRepository{}
+	mockRepo.On("UseAuthorizationCode", "jti").Return(nil)
+	service := NewService(mockRepo)
 
-	mockRepo.On(
-		"GetUserMetadata", userID,
-	).Return(&models.UserMetadata{
-		ID:                    uint(userID),
-		DisplayName:           displayName,
-		Color:                 color,
-		Bio:                   bio,
-		IsEmailVerified:       true,
-		IsPhoneNumberVerified: true,
-	}, nil)
+	_, err = service.DecodeAuthorizationCode(clientID, code, redirectURI)
+	assert.NotNil(t, err)
+
+	claims, err := service.DecodeAuthorizationCode("another_client", code, redirectURI)
+	assert.Nil(t, err)
+	assert.Equal(t, userID, claims.UserID)
+}
+
+func TestDecodeAuthorizationCode_AlreadyRedeemed(t *testing.T) {
+	os.Setenv("OAUTH_TOKEN_SIGNING_KEY", tokenSigningKeyValue)
+	defer os.Unsetenv("OAUTH_TOKEN_SIGNING_KEY")
 
+	code, err := utilities.GenerateAuthCode(tokenSigningKeyValue, &utilities.AuthCodeClaims{
+		ClientID:       clientID,
+		UserID:         userID,
+		RedirectURI:    redirectURI,
+		ExpiresAt:      time.Now().Add(time.Minute).Unix(),
+		StandardClaims: jwt.StandardClaims{Id: "jti"},
+	})
+	assert.Nil(t, err)
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("UseAuthorizationCode", "jti").Return(gorm.ErrDuplicatedKey)
 	service := NewService(mockRepo)
-	zkMetadata, err := service.GetZkUserMetadata(scopes, userID)
 
+	claims, err := service.DecodeAuthorizationCode(clientID, code, redirectURI)
+	assert.NotNil(t, err)
+	assert.Nil(t, claims)
+}
+
+func TestDecodeAuthorizationCode_AnotherRedirectURI(t *testing.T) {
+	os.Setenv("OAUTH_TOKEN_SIGNING_KEY", tokenSigningKeyValue)
+	defer os.Unsetenv("OAUTH_TOKEN_SIGNING_KEY")
+
+	code, err := utilities.GenerateAuthCode(tokenSigningKeyValue, &utilities.AuthCodeClaims{
+		ClientID:       clientID,
+		UserID:         userID,
+		RedirectURI:    "http://127.0.0.1:4000/callback",
+		ExpiresAt:      time.Now().Add(time.Minute).Unix(),
+		StandardClaims: jwt.StandardClaims{Id: "jti"},
+	})
 	assert.Nil(t, err)
-	assert.Equal(t, color, zkMetadata.Color)
+
+	// the code must not be redeemed by a request it is rejected for
+	service := NewService(&MockRepository{})
+
+	_, err = service.DecodeAuthorizationCode(clientID, code, "http://127.0.0.1:5000/callback")
+	assert.NotNil(t, err)
+}
+
+func TestDecodeAuthorizationCode_WithoutID(t *testing.T) {
+	os.Setenv("OAUTH_TOKEN_SIGNING_KEY", tokenSigningKeyValue)
+	defer os.Unsetenv("OAUTH_TOKEN_SIGNING_KEY")
+
+	code, err := utilities.GenerateAuthCode(tokenSigningKeyValue, &utilities.AuthCodeClaims{
+		ClientID:  clientID,
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	})
+	assert.Nil(t, err)
+
+	service := NewService(&MockRepository{})
+
+	_, err = service.DecodeAuthorizationCode(clientID, code, "")
+	assert.NotNil(t, err)
+}
+
+func TestGetPairwiseSubject_StableForOneClientAndUnlinkableAcrossClients(t *testing.T) {
+	os.Setenv("PAIRWISE_SUBJECT_SECRET", pairwiseSubjectSecret)
+	defer os.Unsetenv("PAIRWISE_SUBJECT_SECRET")
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("SavePairwiseSubject", mock.Anything).Return(nil)
+	service := NewService(mockRepo)
+
+	first, err := service.GetPairwiseSubject(clientID, userID)
+	assert.Nil(t, err)
+	second, err := service.GetPairwiseSubject(clientID, userID)
+	assert.Nil(t, err)
+	otherClient, err := service.GetPairwiseSubject("another_client", userID)
+	assert.Nil(t, err)
+
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, otherClient)
+	assert.NotContains(t, first, fmt.Sprint(userID))
+
+	mockRepo.AssertCalled(t, "SavePairwiseSubject", &models.PairwiseSubject{
+		ClientID: clientID,
+		UserID:   uint(userID),
+		Subject:  first,
+	})
+}
+
+func TestGetPairwiseSubject_RepositoryFailedToSaveSubject(t *testing.T) {
+	os.Setenv("PAIRWISE_SUBJECT_SECRET", pairwiseSubjectSecret)
+	defer os.Unsetenv("PAIRWISE_SUBJECT_SECRET")
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("SavePairwiseSubject", mock.Anything).Return(fmt.Errorf("db error"))
+	service := NewService(mockRepo)
+
+	_, err := service.GetPairwiseSubject(clientID, userID)
+	assert.NotNil(t, err)
+}
+
+func TestResolvePairwiseSubject_SubjectNotFound(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetPairwiseSubject", clientID, "unknown").Return(nil, fmt.Errorf("record not found"))
+	service := NewService(mockRepo)
+
+	_, err := service.ResolvePairwiseSubject(clientID, "unknown")
+	assert.NotNil(t, err)
+}
+
+func TestResolvePairwiseSubject_Success(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetPairwiseSubject", clientID, "subject").Return(
+		&models.PairwiseSubject{ClientID: clientID, UserID: uint(userID), Subject: "subject"}, nil,
+	)
+	service := NewService(mockRepo)
+
+	resolvedUserID, err := service.ResolvePairwiseSubject(clientID, "subject")
+	assert.Nil(t, err)
+	assert.Equal(t, userID, resolvedUserID)
+}
+
+func TestGetZkUserMetadata_NoScopesProvided(t *testing.T) {
+	mockRepo := &MockRepository{}
+	service := NewService(mockRepo)
+
+	_, err := service.GetZkUserMetadata(clientID, "", userID)
+
+	assert.NotNil(t, err)
+}
+
+func TestGetZkUserMetadata_UnknownScopeRejected(t *testing.T) {
+	mockRepo := &MockRepository{}
+	service := NewService(mockRepo)
+
+	_, err := service.GetZkUserMetadata(clientID, "read:user:color,color", userID)
+
+	assert.NotNil(t, err)
+	mockRepo.AssertNotCalled(t, "GetUserMetadata", mock.Anything)
+}
+
+func TestGetZkUserMetadata_RepoFailedToReturnUserMetadata(t *testing.T) {
+	scopes := "read:user:color"
+
+	mockRepo := &MockRepository{}
+	mockRepo.On(
+		"GetUserMetadata", userID,
+	).Return(nil, fmt.Errorf("error"))
+	service := NewService(mockRepo)
+
+	_, err := service.GetZkUserMetadata(clientID, scopes, userID)
+
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "failed to get user metadata:"))
+}
+
+func TestGetZkUserMetadata_OnlyColorMetadataReturned(t *testing.T) {
+	scopes := "read:user:color"
+
+	mockRepo := &MockRepository{}
+	mockRepo.On(
+		"GetUserMetadata", userID,
+	).Return(&models.UserMetadata{
+		ID:                    uint(userID),
+		DisplayName:           displayName,
+		Color:                 color,
+		Bio:                   bio,
+		IsEmailVerified:       true,
+		IsPhoneNumberVerified: true,
+	}, nil)
+
+	mockRepo.On("SaveDataAccessRecord", mock.Anything).Return(nil)
+	service := NewService(mockRepo)
+	zkMetadata, err := service.GetZkUserMetadata(clientID, scopes, userID)
+
+	assert.Nil(t, err)
+	assert.Equal(t, color, zkMetadata.Color)
+	assert.Equal(t, "", zkMetadata.DisplayName)
+	assert.False(t, zkMetadata.IsEmailVerified)
+}
+
+func TestGetZkUserMetadata_ColorAndIsEmailVerifiedMetadataReturned(t *testing.T) {
+	scopes := "read:user:color,read:user:is_email_verified"
+	mockRepo := &MockRepository{}
+
+	mockRepo.On(
+		"GetUserMetadata", userID,
+	).Return(&models.UserMetadata{
+		ID:                    uint(userID),
+		DisplayName:           displayName,
+		Color:                 color,
+		Bio:                   bio,
+		IsEmailVerified:       true,
+		IsPhoneNumberVerified: true,
+	}, nil)
+
+	mockRepo.On("SaveDataAccessRecord", mock.Anything).Return(nil)
+	service := NewService(mockRepo)
+	zkMetadata, err := service.GetZkUserMetadata(clientID, scopes, userID)
+
+	assert.Nil(t, err)
+	assert.Equal(t, color, zkMetadata.Color)
+	assert.Equal(t, true, zkMetadata.IsEmailVerified)
+	assert.Equal(t, "", zkMetadata.DisplayName)
+}
+
+func TestGetZkUserMetadata_AllMetadataReturned(t *testing.T) {
+	scopes := "read:user:color,read:user:is_email_verified,read:user:display_name"
+	mockRepo := &MockRepository{}
+
+	mockRepo.On(
+		"GetUserMetadata", userID,
+	).Return(&models.UserMetadata{
+		ID:                    uint(userID),
+		DisplayName:           displayName,
+		Color:                 color,
+		Bio:                   bio,
+		IsEmailVerified:       true,
+		IsPhoneNumberVerified: true,
+	}, nil)
+
+	mockRepo.On("SaveDataAccessRecord", mock.Anything).Return(nil)
+	service := NewService(mockRepo)
+	zkMetadata, err := service.GetZkUserMetadata(clientID, scopes, userID)
+
+	assert.Nil(t, err)
+	assert.Equal(t, color, zkMetadata.Color)
 	assert.Equal(t, true, zkMetadata.IsEmailVerified)
 	assert.Equal(t, displayName, zkMetadata.DisplayName)
 }
+
+func TestGetZkUserMetadata_ReproveByReturnedWithVerificationStatus(t *testing.T) {
+	reproveBy := time.Now().Add(24 * time.Hour).UTC()
+	mockRepo := &MockRepository{}
+
+	mockRepo.On(
+		"GetUserMetadata", userID,
+	).Return(&models.UserMetadata{
+		ID:                    uint(userID),
+		IsEmailVerified:       true,
+		IsPhoneNumberVerified: true,
+		EmailReproveBy:        &reproveBy,
+		PhoneNumberReproveBy:  &reproveBy,
+	}, nil)
+
+	mockRepo.On("SaveDataAccessRecord", mock.Anything).Return(nil)
+	service := NewService(mockRepo)
+	zkMetadata, err := service.GetZkUserMetadata(clientID, "read:user:is_email_verified", userID)
+
+	assert.Nil(t, err)
+	assert.True(t, zkMetadata.IsEmailVerified)
+	assert.Equal(t, &reproveBy, zkMetadata.EmailReproveBy)
+	// released with the phone number verification status only
+	assert.Nil(t, zkMetadata.PhoneNumberReproveBy)
+}
+
+func TestGetZkUserMetadata_AccessAudited(t *testing.T) {
+	sink := &recordingSink{}
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetUserMetadata", userID).Return(&models.UserMetadata{
+		ID:          uint(userID),
+		DisplayName: displayName,
+		Color:       color,
+	}, nil)
+	mockRepo.On("GetUserByID", userID).Return(&models.User{ID: uint(userID), Username: "alice"}, nil)
+	mockRepo.On("SaveDataAccessRecord", mock.Anything).Return(nil)
+	service := &Service{Repo: mockRepo, Audit: sink}
+
+	_, err := service.GetZkUserMetadata(clientID, "read:user:display_name,read:user:color", userID)
+
+	assert.Nil(t, err)
+	assert.Len(t, sink.events, 1)
+	assert.Equal(t, audit.EventMetadataAccessed, sink.events[0].Type)
+	assert.Equal(t, models.ScramPrincipalUser, sink.events[0].Principal)
+	assert.Equal(t, "alice", sink.events[0].Subject)
+	assert.Equal(t, clientID, sink.events[0].ClientID)
+	assert.Equal(t, map[string]string{
+		"scopes": "read:user:display_name,read:user:color",
+		"fields": constants.UserDisplayNameMetadataKey + "," + constants.UserColorMetadataKey,
+	}, sink.events[0].Details)
+}
+
+func TestGetZkUserMetadata_ReleaseRecorded(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetUserMetadata", userID).Return(&models.UserMetadata{
+		ID:              uint(userID),
+		Bio:             bio,
+		IsEmailVerified: false,
+	}, nil)
+	mockRepo.On("SaveDataAccessRecord", mock.MatchedBy(func(record *models.DataAccessRecord) bool {
+		// the email domain of an unverified address is not released
+		return record.UserID == uint(userID) &&
+			record.ClientID == clientID &&
+			record.Scopes == "read:user:bio,read:user:email_domain" &&
+			record.Fields == constants.UserBioMetadataKey &&
+			!record.AccessedAt.IsZero()
+	})).Return(nil)
+	service := NewService(mockRepo)
+
+	_, err := service.GetZkUserMetadata(clientID, "read:user:bio,read:user:email_domain", userID)
+
+	assert.Nil(t, err)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestGetZkUserMetadata_NotReleasedUnlessRecorded(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetUserMetadata", userID).Return(&models.UserMetadata{
+		ID:          uint(userID),
+		DisplayName: displayName,
+	}, nil)
+	mockRepo.On("SaveDataAccessRecord", mock.Anything).Return(fmt.Errorf("connection refused"))
+	service := NewService(mockRepo)
+
+	zkMetadata, err := service.GetZkUserMetadata(clientID, "read:user:display_name", userID)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "", zkMetadata.DisplayName)
+}
+
+func TestGetZkUserMetadata_EmailDomainClaimsReturned(t *testing.T) {
+	scopes := "read:user:email_domain,read:user:email_domain_membership"
+	domain := "mit.edu"
+	mockRepo := &MockRepository{}
+
+	mockRepo.On(
+		"GetUserMetadata", userID,
+	).Return(&models.UserMetadata{ID: uint(userID), IsEmailVerified: true}, nil)
+	mockRepo.On(
+		"GetEmailDomainProofs", userID, clientID,
+	).Return([]models.EmailDomainProof{
+		{
+			Domain: &domain, DomainSetRoot: "root", Nullifier: "nullifier", DomainCommitment: "commitment",
+			ZkProof: []byte("proof"), ZkKeyPairID: 3,
+		},
+		{
+			DomainSet: "universities", DomainSetRoot: "set root", Nullifier: "nullifier", DomainCommitment: "commitment",
+			ZkProof: []byte("set proof"), ZkKeyPairID: 3,
+		},
+	}, nil).Twice()
+
+	mockRepo.On("SaveDataAccessRecord", mock.Anything).Return(nil)
+	service := NewService(mockRepo)
+	zkMetadata, err := service.GetZkUserMetadata(clientID, scopes, userID)
+
+	assert.Nil(t, err)
+	assert.Equal(t, &entities.EmailDomainClaim{
+		Domain:           domain,
+		DomainSetRoot:    "root",
+		Nullifier:        "nullifier",
+		DomainCommitment: "commitment",
+		ZkProof:          []byte("proof"),
+		ZkKeyPairID:      3,
+	}, zkMetadata.EmailDomain)
+	assert.Equal(t, []entities.EmailDomainClaim{{
+		DomainSet:        "universities",
+		DomainSetRoot:    "set root",
+		Nullifier:        "nullifier",
+		DomainCommitment: "commitment",
+		ZkProof:          []byte("set proof"),
+		ZkKeyPairID:      3,
+	}}, zkMetadata.EmailDomainMemberships)
+	mockRepo.AssertExpectations(t)
+	mockRepo.AssertNotCalled(t, "SaveEmailDomainProofs", mock.Anything)
+}
+
+func TestGetZkUserMetadata_EmailDomainProvedOnFirstRelease(t *testing.T) {
+	domain := "mit.edu"
+	emailDomain := &models.UserEmailDomain{UserID: uint(userID), Domain: domain, NullifierKey: []byte("key")}
+	proof := models.EmailDomainProof{
+		UserID:        uint(userID),
+		ClientID:      clientID,
+		Domain:        &domain,
+		DomainSetRoot: "root",
+		Nullifier:     "nullifier",
+		ZkProof:       []byte("proof"),
+		ZkKeyPairID:   3,
+	}
+	mockRepo := &MockRepository{}
+
+	mockRepo.On(
+		"GetUserMetadata", userID,
+	).Return(&models.UserMetadata{ID: uint(userID), IsEmailVerified: true}, nil)
+	mockRepo.On("GetEmailDomainProofs", userID, clientID).Return([]models.EmailDomainProof{}, nil)
+	mockRepo.On("GetUserEmailDomain", userID).Return(emailDomain, nil)
+	mockRepo.On("SaveEmailDomainProofs", []models.EmailDomainProof{proof}).Return(nil)
+	mockRepo.On("SaveDataAccessRecord", mock.Anything).Return(nil)
+	prover := &fakeEmailDomainProver{proof: proof}
+	service := &Service{Repo: mockRepo, EmailDomainProver: prover}
+
+	zkMetadata, err := service.GetZkUserMetadata(clientID, "read:user:email_domain", userID)
+
+	assert.Nil(t, err)
+	assert.Equal(t, domain, zkMetadata.EmailDomain.Domain)
+	assert.Equal(t, "nullifier", zkMetadata.EmailDomain.Nullifier)
+	// the domain is only proved to the client it is released to
+	assert.Equal(t, []string{clientID}, prover.clientIDs)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestGetZkUserMetadata_EmailDomainOfUserWithoutDomainNotReturned(t *testing.T) {
+	mockRepo := &MockRepository{}
+
+	mockRepo.On(
+		"GetUserMetadata", userID,
+	).Return(&models.UserMetadata{ID: uint(userID), IsEmailVerified: true}, nil)
+	mockRepo.On("GetEmailDomainProofs", userID, clientID).Return([]models.EmailDomainProof{}, nil)
+	mockRepo.On("GetUserEmailDomain", userID).Return(nil, gorm.ErrRecordNotFound)
+	mockRepo.On("SaveDataAccessRecord", mock.Anything).Return(nil)
+	prover := &fakeEmailDomainProver{}
+	service := &Service{Repo: mockRepo, EmailDomainProver: prover}
+
+	zkMetadata, err := service.GetZkUserMetadata(clientID, "read:user:email_domain", userID)
+
+	assert.Nil(t, err)
+	assert.Nil(t, zkMetadata.EmailDomain)
+	assert.Empty(t, prover.clientIDs)
+	mockRepo.AssertNotCalled(t, "SaveEmailDomainProofs", mock.Anything)
+}
+
+func TestGetZkUserMetadata_MembershipScopeDoesNotRevealDomain(t *testing.T) {
+	scopes := "read:user:email_domain_membership"
+	domain := "mit.edu"
+	mockRepo := &MockRepository{}
+
+	mockRepo.On(
+		"GetUserMetadata", userID,
+	).Return(&models.UserMetadata{ID: uint(userID), IsEmailVerified: true}, nil)
+	mockRepo.On(
+		"GetEmailDomainProofs", userID, clientID,
+	).Return([]models.EmailDomainProof{{Domain: &domain, DomainSetRoot: "root"}}, nil)
+
+	mockRepo.On("SaveDataAccessRecord", mock.Anything).Return(nil)
+	service := NewService(mockRepo)
+	zkMetadata, err := service.GetZkUserMetadata(clientID, scopes, userID)
+
+	assert.Nil(t, err)
+	assert.Nil(t, zkMetadata.EmailDomain)
+	assert.Empty(t, zkMetadata.EmailDomainMemberships)
+}
+
+func TestGetZkUserMetadata_EmailDomainOfUnverifiedEmailNotReturned(t *testing.T) {
+	mockRepo := &MockRepository{}
+
+	mockRepo.On(
+		"GetUserMetadata", userID,
+	).Return(&models.UserMetadata{ID: uint(userID), IsEmailVerified: false}, nil)
+
+	mockRepo.On("SaveDataAccessRecord", mock.Anything).Return(nil)
+	service := NewService(mockRepo)
+	zkMetadata, err := service.GetZkUserMetadata(clientID, "read:user:email_domain", userID)
+
+	assert.Nil(t, err)
+	assert.Nil(t, zkMetadata.EmailDomain)
+	mockRepo.AssertNotCalled(t, "GetEmailDomainProofs", mock.Anything, mock.Anything)
+}
+
+func TestGetZkUserMetadata_ParentScopeReleasesNoChildFields(t *testing.T) {
+	scopes := "read:user,read:user:is_phone_number_verified,"
+	mockRepo := &MockRepository{}
+
+	mockRepo.On(
+		"GetUserMetadata", userID,
+	).Return(&models.UserMetadata{
+		ID:                    uint(userID),
+		DisplayName:           displayName,
+		Color:                 color,
+		Bio:                   bio,
+		IsEmailVerified:       true,
+		IsPhoneNumberVerified: true,
+	}, nil)
+
+	mockRepo.On("SaveDataAccessRecord", mock.Anything).Return(nil)
+	service := NewService(mockRepo)
+	zkMetadata, err := service.GetZkUserMetadata(clientID, scopes, userID)
+
+	assert.Nil(t, err)
+	assert.True(t, zkMetadata.IsPhoneNumberVerified)
+	assert.False(t, zkMetadata.IsEmailVerified)
+	assert.Equal(t, "", zkMetadata.Color)
+	assert.Equal(t, "", zkMetadata.DisplayName)
+	assert.Equal(t, "", zkMetadata.Bio)
+}
+
+func TestSaveUserConsent_DuplicateAndEmptyScopesDropped(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("SaveUserConsent", mock.MatchedBy(func(consent *models.UserConsent) bool {
+		return consent.UserID == uint(userID) &&
+			consent.ClientID == clientID &&
+			consent.Scopes == "read:user,read:user:color" &&
+			!consent.GrantedAt.IsZero()
+	})).Return(nil)
+	service := NewService(mockRepo)
+
+	err := service.SaveUserConsent(userID, clientID, []string{"read:user", "read:user:color", "read:user", ""})
+
+	assert.Nil(t, err)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestSaveUserConsent_GrantAudited(t *testing.T) {
+	sink := &recordingSink{}
+	mockRepo := &MockRepository{}
+	mockRepo.On("SaveUserConsent", mock.Anything).Return(nil)
+	mockRepo.On("GetUserByID", userID).Return(&models.User{ID: uint(userID), Username: "alice"}, nil)
+	service := &Service{Repo: mockRepo, Audit: sink}
+
+	err := service.SaveUserConsent(userID, clientID, []string{"read:user"})
+
+	assert.Nil(t, err)
+	assert.Len(t, sink.events, 1)
+	assert.Equal(t, audit.EventConsentGranted, sink.events[0].Type)
+	assert.Equal(t, "alice", sink.events[0].Subject)
+	assert.Equal(t, clientID, sink.events[0].ClientID)
+	assert.Equal(t, "read:user", sink.events[0].Details["scopes"])
+}
+
+func TestGetCoveringConsent_NoConsentStored(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetUserConsent", userID, clientID).Return(nil, gorm.ErrRecordNotFound)
+	service := NewService(mockRepo)
+
+	consent, err := service.GetCoveringConsent(userID, clientID, []string{"read:user"})
+
+	assert.Nil(t, err)
+	assert.Nil(t, consent)
+}
+
+func TestGetCoveringConsent_RepositoryError(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetUserConsent", userID, clientID).Return(nil, fmt.Errorf("connection refused"))
+	service := NewService(mockRepo)
+
+	_, err := service.GetCoveringConsent(userID, clientID, []string{"read:user"})
+
+	assert.NotNil(t, err)
+}
+
+func TestGetCoveringConsent_ConsentMissesARequestedScope(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetUserConsent", userID, clientID).Return(
+		&models.UserConsent{Scopes: "read:user"}, nil,
+	)
+	service := NewService(mockRepo)
+
+	consent, err := service.GetCoveringConsent(userID, clientID, []string{"read:user", "read:user:bio"})
+
+	assert.Nil(t, err)
+	assert.Nil(t, consent)
+}
+
+func TestGetCoveringConsent_ConsentCoversRequestedScopes(t *testing.T) {
+	stored := &models.UserConsent{Scopes: "read:user,read:user:color"}
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetUserConsent", userID, clientID).Return(stored, nil)
+	service := NewService(mockRepo)
+
+	consent, err := service.GetCoveringConsent(userID, clientID, []string{"read:user", ""})
+
+	assert.Nil(t, err)
+	assert.Equal(t, stored, consent)
+}
+
+func TestVerifyUserConsent_ConsentRevoked(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetUserConsent", userID, clientID).Return(nil, gorm.ErrRecordNotFound)
+	service := NewService(mockRepo)
+
+	err := service.VerifyUserConsent(userID, clientID, time.Now().Unix())
+
+	assert.NotNil(t, err)
+}
+
+func TestVerifyUserConsent_TokenIssuedBeforeConsentWasGranted(t *testing.T) {
+	grantedAt := time.Now().UTC()
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetUserConsent", userID, clientID).Return(&models.UserConsent{GrantedAt: grantedAt}, nil)
+	service := NewService(mockRepo)
+
+	err := service.VerifyUserConsent(userID, clientID, grantedAt.Add(-time.Minute).Unix())
+
+	assert.NotNil(t, err)
+	mockRepo.AssertNotCalled(t, "UpdateUserConsentLastUsedAt", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestVerifyUserConsent_Success(t *testing.T) {
+	grantedAt := time.Now().UTC().Add(-time.Hour)
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetUserConsent", userID, clientID).Return(&models.UserConsent{GrantedAt: grantedAt}, nil)
+	mockRepo.On("UpdateUserConsentLastUsedAt", userID, clientID, mock.Anything).Return(nil)
+	service := NewService(mockRepo)
+
+	err := service.VerifyUserConsent(userID, clientID, time.Now().Unix())
+
+	assert.Nil(t, err)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestResolveRedirectURI_FallsBackToClientRedirectURI(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetClientRedirectURIs", clientID).Return([]string{}, nil)
+	service := NewService(mockRepo)
+
+	redirectURI, err := service.ResolveRedirectURI(&models.Client{ID: clientID, RedirectURI: "https://client.com/callback"}, "")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "https://client.com/callback", redirectURI)
+}
+
+func TestResolveRedirectURI_OmittedWithSeveralRegistered(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetClientRedirectURIs", clientID).Return(
+		[]string{"https://client.com/callback", "https://client.com/other"}, nil,
+	)
+	service := NewService(mockRepo)
+
+	_, err := service.ResolveRedirectURI(&models.Client{ID: clientID}, "")
+
+	assert.NotNil(t, err)
+}
+
+func TestResolveRedirectURI_NotRegistered(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetClientRedirectURIs", clientID).Return([]string{"https://client.com/callback"}, nil)
+	service := NewService(mockRepo)
+
+	_, err := service.ResolveRedirectURI(&models.Client{ID: clientID}, "https://client.com/callback/evil")
+
+	assert.NotNil(t, err)
+}
+
+func TestResolveRedirectURI_Success(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetClientRedirectURIs", clientID).Return(
+		[]string{"https://client.com/callback", "https://client.com/other"}, nil,
+	)
+	service := NewService(mockRepo)
+
+	redirectURI, err := service.ResolveRedirectURI(&models.Client{ID: clientID}, "https://client.com/other")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "https://client.com/other", redirectURI)
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+	assert.Equal(t, "BCDF-GHJK", normalizeUserCode("bcdf-ghjk"))
+	assert.Equal(t, "BCDF-GHJK", normalizeUserCode("BCDFGHJK"))
+	assert.Equal(t, "BCDF-GHJK", normalizeUserCode(" bcdf ghjk "))
+	assert.Equal(t, "BCD", normalizeUserCode("bcd"))
+}
+
+func TestCreateDeviceAuthorization_Success(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("SaveDeviceAuthorization", mock.Anything).Return(nil)
+	service := NewService(mockRepo)
+
+	deviceCode, authorization, err := service.CreateDeviceAuthorization(clientID, []string{"read:user", "read:user:bio"})
+
+	assert.Nil(t, err)
+	assert.NotEmpty(t, deviceCode)
+	assert.Equal(t, hashDeviceCode(deviceCode), authorization.DeviceCodeHash)
+	assert.Regexp(t, "^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$", authorization.UserCode)
+	assert.Equal(t, "read:user,read:user:bio", authorization.Scopes)
+	assert.Equal(t, constants.DeviceAuthorizationPending, authorization.Status)
+	assert.Equal(t, constants.DevicePollingIntervalSeconds, authorization.Interval)
+}
+
+func TestGetPendingDeviceAuthorization_AlreadyApproved(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetDeviceAuthorizationByUserCode", "BCDF-GHJK").Return(
+		&models.DeviceAuthorization{
+			Status:    constants.DeviceAuthorizationApproved,
+			ExpiresAt: time.Now().UTC().Add(time.Minute),
+		}, nil,
+	)
+	service := NewService(mockRepo)
+
+	_, err := service.GetPendingDeviceAuthorization("bcdfghjk")
+
+	assert.NotNil(t, err)
+}
+
+func TestGetPendingDeviceAuthorization_Expired(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetDeviceAuthorizationByUserCode", "BCDF-GHJK").Return(
+		&models.DeviceAuthorization{
+			Status:    constants.DeviceAuthorizationPending,
+			ExpiresAt: time.Now().UTC().Add(-time.Minute),
+		}, nil,
+	)
+	service := NewService(mockRepo)
+
+	_, err := service.GetPendingDeviceAuthorization("BCDF-GHJK")
+
+	assert.NotNil(t, err)
+}
+
+func TestApproveDeviceAuthorization_Success(t *testing.T) {
+	authorization := &models.DeviceAuthorization{
+		ClientID:  clientID,
+		UserCode:  "BCDF-GHJK",
+		Scopes:    "read:user",
+		Status:    constants.DeviceAuthorizationPending,
+		ExpiresAt: time.Now().UTC().Add(time.Minute),
+	}
+	approvedBy := uint(userID)
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetDeviceAuthorizationByUserCode", "BCDF-GHJK").Return(authorization, nil)
+	mockRepo.On("GetClient", "client:"+clientID).Return(&models.Client{ID: clientID}, nil)
+	mockRepo.On(
+		"DecideDeviceAuthorization", "BCDF-GHJK", constants.DeviceAuthorizationApproved, &approvedBy, "read:user,read:user:bio",
+	).Return(nil)
+	service := NewService(mockRepo)
+
+	err := service.ApproveDeviceAuthorization("BCDF-GHJK", userID, []string{"read:user", "read:user:bio"})
+
+	assert.Nil(t, err)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestApproveDeviceAuthorization_DeniedMeanwhile(t *testing.T) {
+	authorization := &models.DeviceAuthorization{
+		ClientID:  clientID,
+		UserCode:  "BCDF-GHJK",
+		Scopes:    "read:user",
+		Status:    constants.DeviceAuthorizationPending,
+		ExpiresAt: time.Now().UTC().Add(time.Minute),
+	}
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetDeviceAuthorizationByUserCode", "BCDF-GHJK").Return(authorization, nil)
+	mockRepo.On("GetClient", "client:"+clientID).Return(&models.Client{ID: clientID}, nil)
+	// the denial in another tab committed after the approval read the authorization
+	mockRepo.On(
+		"DecideDeviceAuthorization", "BCDF-GHJK", constants.DeviceAuthorizationApproved, mock.Anything, "read:user",
+	).Return(gorm.ErrRecordNotFound)
+	service := NewService(mockRepo)
+
+	err := service.ApproveDeviceAuthorization("BCDF-GHJK", userID, []string{"read:user"})
+
+	assert.NotNil(t, err)
+}
+
+func TestDenyDeviceAuthorization_Success(t *testing.T) {
+	authorization := &models.DeviceAuthorization{
+		ClientID:  clientID,
+		UserCode:  "BCDF-GHJK",
+		Scopes:    "read:user",
+		Status:    constants.DeviceAuthorizationPending,
+		ExpiresAt: time.Now().UTC().Add(time.Minute),
+	}
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetDeviceAuthorizationByUserCode", "BCDF-GHJK").Return(authorization, nil)
+	mockRepo.On(
+		"DecideDeviceAuthorization", "BCDF-GHJK", constants.DeviceAuthorizationDenied, (*uint)(nil), "read:user",
+	).Return(nil)
+	service := NewService(mockRepo)
+
+	err := service.DenyDeviceAuthorization("BCDF-GHJK")
+
+	assert.Nil(t, err)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestPollDeviceAuthorization_IssuedToAnotherClient(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetDeviceAuthorizationByDeviceCodeHash", hashDeviceCode("device_code")).Return(
+		&models.DeviceAuthorization{ClientID: "another_client"}, nil,
+	)
+	service := NewService(mockRepo)
+
+	_, err := service.PollDeviceAuthorization(clientID, "device_code")
+
+	assert.NotNil(t, err)
+}
+
+func TestPollDeviceAuthorization_Expired(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetDeviceAuthorizationByDeviceCodeHash", hashDeviceCode("device_code")).Return(
+		&models.DeviceAuthorization{
+			ID:        1,
+			ClientID:  clientID,
+			Status:    constants.DeviceAuthorizationPending,
+			ExpiresAt: time.Now().UTC().Add(-time.Minute),
+		}, nil,
+	)
+	mockRepo.On("DeleteDeviceAuthorization", uint(1)).Return(nil)
+	service := NewService(mockRepo)
+
+	_, err := service.PollDeviceAuthorization(clientID, "device_code")
+
+	assert.ErrorIs(t, err, constants.ErrExpiredToken)
+}
+
+func TestPollDeviceAuthorization_Pending(t *testing.T) {
+	authorization := &models.DeviceAuthorization{
+		DeviceCodeHash: hashDeviceCode("device_code"),
+		ClientID:       clientID,
+		Status:         constants.DeviceAuthorizationPending,
+		Interval:       constants.DevicePollingIntervalSeconds,
+		ExpiresAt:      time.Now().UTC().Add(time.Minute),
+	}
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetDeviceAuthorizationByDeviceCodeHash", hashDeviceCode("device_code")).Return(authorization, nil)
+	mockRepo.On(
+		"RecordDeviceAuthorizationPoll", hashDeviceCode("device_code"), mock.Anything, constants.DevicePollingIntervalSeconds,
+	).Return(nil)
+	service := NewService(mockRepo)
+
+	_, err := service.PollDeviceAuthorization(clientID, "device_code")
+
+	assert.ErrorIs(t, err, constants.ErrAuthorizationPending)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestPollDeviceAuthorization_SlowDown(t *testing.T) {
+	lastPolledAt := time.Now().UTC().Add(-time.Second)
+	authorization := &models.DeviceAuthorization{
+		DeviceCodeHash: hashDeviceCode("device_code"),
+		ClientID:       clientID,
+		Status:         constants.DeviceAuthorizationPending,
+		Interval:       constants.DevicePollingIntervalSeconds,
+		LastPolledAt:   &lastPolledAt,
+		ExpiresAt:      time.Now().UTC().Add(time.Minute),
+	}
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetDeviceAuthorizationByDeviceCodeHash", hashDeviceCode("device_code")).Return(authorization, nil)
+	mockRepo.On(
+		"RecordDeviceAuthorizationPoll", hashDeviceCode("device_code"), mock.Anything, 2*constants.DevicePollingIntervalSeconds,
+	).Return(nil)
+	service := NewService(mockRepo)
+
+	_, err := service.PollDeviceAuthorization(clientID, "device_code")
+
+	assert.ErrorIs(t, err, constants.ErrSlowDown)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestPollDeviceAuthorization_ApprovedDuringPoll(t *testing.T) {
+	pending := &models.DeviceAuthorization{
+		ID:             1,
+		DeviceCodeHash: hashDeviceCode("device_code"),
+		UserCode:       "BCDF-GHJK",
+		ClientID:       clientID,
+		Scopes:         "read:user",
+		Status:         constants.DeviceAuthorizationPending,
+		Interval:       constants.DevicePollingIntervalSeconds,
+		ExpiresAt:      time.Now().UTC().Add(time.Minute),
+	}
+	approvedBy := uint(userID)
+	approved := *pending
+	approved.Status = constants.DeviceAuthorizationApproved
+	approved.UserID = &approvedBy
+
+	mockRepo := &MockRepository{}
+	service := NewService(mockRepo)
+
+	// the user approves after the poll read the authorization as pending
+	mockRepo.On("GetDeviceAuthorizationByDeviceCodeHash", hashDeviceCode("device_code")).Return(pending, nil).Once().
+		Run(func(mock.Arguments) {
+			assert.Nil(t, service.ApproveDeviceAuthorization("BCDF-GHJK", userID, []string{"read:user"}))
+		})
+	mockRepo.On("GetDeviceAuthorizationByUserCode", "BCDF-GHJK").Return(pending, nil)
+	mockRepo.On("GetClient", "client:"+clientID).Return(&models.Client{ID: clientID}, nil)
+	mockRepo.On(
+		"DecideDeviceAuthorization", "BCDF-GHJK", constants.DeviceAuthorizationApproved, &approvedBy, "read:user",
+	).Return(nil)
+	// the authorization is no longer pending, so the poll does not write it back
+	mockRepo.On(
+		"RecordDeviceAuthorizationPoll", hashDeviceCode("device_code"), mock.Anything, constants.DevicePollingIntervalSeconds,
+	).Return(gorm.ErrRecordNotFound)
+
+	_, err := service.PollDeviceAuthorization(clientID, "device_code")
+
+	assert.ErrorIs(t, err, constants.ErrAuthorizationPending)
+
+	// the next poll gets the approval
+	mockRepo.On("GetDeviceAuthorizationByDeviceCodeHash", hashDeviceCode("device_code")).Return(&approved, nil).Once()
+	mockRepo.On("DeleteDeviceAuthorization", uint(1)).Return(nil)
+
+	claims, err := service.PollDeviceAuthorization(clientID, "device_code")
+
+	assert.Nil(t, err)
+	assert.Equal(t, userID, claims.UserID)
+	assert.Equal(t, "read:user", claims.Scopes)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestPollDeviceAuthorization_Denied(t *testing.T) {
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetDeviceAuthorizationByDeviceCodeHash", hashDeviceCode("device_code")).Return(
+		&models.DeviceAuthorization{
+			ID:        1,
+			ClientID:  clientID,
+			Status:    constants.DeviceAuthorizationDenied,
+			ExpiresAt: time.Now().UTC().Add(time.Minute),
+		}, nil,
+	)
+	mockRepo.On("DeleteDeviceAuthorization", uint(1)).Return(nil)
+	service := NewService(mockRepo)
+
+	_, err := service.PollDeviceAuthorization(clientID, "device_code")
+
+	assert.ErrorIs(t, err, constants.ErrAccessDenied)
+}
+
+func TestPollDeviceAuthorization_Approved(t *testing.T) {
+	approvedBy := uint(userID)
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetDeviceAuthorizationByDeviceCodeHash", hashDeviceCode("device_code")).Return(
+		&models.DeviceAuthorization{
+			ID:        1,
+			ClientID:  clientID,
+			Scopes:    "read:user,read:user:bio",
+			Status:    constants.DeviceAuthorizationApproved,
+			UserID:    &approvedBy,
+			ExpiresAt: time.Now().UTC().Add(time.Minute),
+		}, nil,
+	)
+	mockRepo.On("DeleteDeviceAuthorization", uint(1)).Return(nil)
+	service := NewService(mockRepo)
+
+	claims, err := service.PollDeviceAuthorization(clientID, "device_code")
+
+	assert.Nil(t, err)
+	assert.Equal(t, clientID, claims.ClientID)
+	assert.Equal(t, userID, claims.UserID)
+	assert.Equal(t, "read:user,read:user:bio", claims.Scopes)
+	mockRepo.AssertCalled(t, "DeleteDeviceAuthorization", uint(1))
+}
+
+func TestPollDeviceAuthorization_AlreadyRedeemed(t *testing.T) {
+	approvedBy := uint(userID)
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetDeviceAuthorizationByDeviceCodeHash", hashDeviceCode("device_code")).Return(
+		&models.DeviceAuthorization{
+			ID:        1,
+			ClientID:  clientID,
+			Status:    constants.DeviceAuthorizationApproved,
+			UserID:    &approvedBy,
+			ExpiresAt: time.Now().UTC().Add(time.Minute),
+		}, nil,
+	)
+	mockRepo.On("DeleteDeviceAuthorization", uint(1)).Return(gorm.ErrRecordNotFound)
+	service := NewService(mockRepo)
+
+	_, err := service.PollDeviceAuthorization(clientID, "device_code")
+
+	assert.NotNil(t, err)
+}
+
+type fakeEmailDomainProver struct {
+	proof     models.EmailDomainProof
+	clientIDs []string
+}
+
+func (p *fakeEmailDomainProver) ProveEmailDomain(emailDomain models.UserEmailDomain, clientID string) (models.EmailDomainProof, error) {
+	p.clientIDs = append(p.clientIDs, clientID)
+	return p.proof, nil
+}
+
+func (p *fakeEmailDomainProver) ProveEmailDomainMemberships(emailDomain models.UserEmailDomain, clientID string) ([]models.EmailDomainProof, error) {
+	p.clientIDs = append(p.clientIDs, clientID)
+	return nil, nil
+}
+
+type recordingSink struct {
+	events []audit.Event
+}
+
+func (s *recordingSink) Record(event audit.Event) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+// scramUser returns a user with a SCRAM credential and a login request whose
+// client proof was computed from it
+func scramUser(t *testing.T) (*models.User, entities.LoginRequest, []byte) {
+	clientKey := sha256.Sum256([]byte("client key"))
+	storedKey := sha256.Sum256(clientKey[:])
+	serverKey := sha256.Sum256([]byte("server key"))
+
+	user := &models.User{
+		ID:             uint(userID),
+		Username:       "alice",
+		Salt:           "salt",
+		IterationCount: 4096,
+		StoredKey:      hex.EncodeToString(storedKey[:]),
+		ServerKey:      hex.EncodeToString(serverKey[:]),
+	}
+
+	request := entities.LoginRequest{
+		Username: user.Username,
+		Nonce:    "nonce",
+		CNonce:   "c_nonce",
+		Source:   "10.0.0.1",
+	}
+
+	authMessage := rsUtils.ScramAuthMessage(request.Username, request.CNonce, user.Salt, user.IterationCount, request.Nonce)
+	clientSignature := hmac.New(sha256.New, storedKey[:])
+	clientSignature.Write([]byte(authMessage))
+
+	clientProof, err := rsUtils.XorBytes(clientKey[:], clientSignature.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.ClientProof = hex.EncodeToString(clientProof)
+
+	serverSignature := hmac.New(sha256.New, serverKey[:])
+	serverSignature.Write([]byte(authMessage))
+
+	return user, request, serverSignature.Sum(nil)
+}
+
+func TestLoginUser_Success(t *testing.T) {
+	user, request, serverSignature := scramUser(t)
+	sink := &recordingSink{}
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("ConsumeScramSession", models.ScramPrincipalUser, "alice", "nonce", "c_nonce").Return(nil)
+	mockRepo.On("GetUser", "alice").Return(user, nil)
+	mockRepo.On("GetTwoFactorCredential", models.ScramPrincipalUser, "alice").Return(nil, gorm.ErrRecordNotFound)
+	service := &Service{Repo: mockRepo, Audit: sink}
+
+	result, err := service.LoginUser(request)
+
+	assert.Nil(t, err)
+	assert.NotEmpty(t, result["token"])
+	assert.Equal(t, hex.EncodeToString(serverSignature), result["server_signature"])
+
+	assert.Len(t, sink.events, 1)
+	assert.Equal(t, audit.EventLoginSucceeded, sink.events[0].Type)
+	assert.Equal(t, "alice", sink.events[0].Subject)
+	assert.Equal(t, "10.0.0.1", sink.events[0].Source)
+}
+
+func TestLoginUser_WrongClientProof(t *testing.T) {
+	user, request, _ := scramUser(t)
+	request.ClientProof = strings.Repeat("00", 32)
+	sink := &recordingSink{}
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("ConsumeScramSession", models.ScramPrincipalUser, "alice", "nonce", "c_nonce").Return(nil)
+	mockRepo.On("GetUser", "alice").Return(user, nil)
+	service := &Service{Repo: mockRepo, Audit: sink}
+
+	_, err := service.LoginUser(request)
+
+	assert.ErrorIs(t, err, constants.ErrAuthenticationFailed)
+	assert.Len(t, sink.events, 1)
+	assert.Equal(t, audit.EventLoginFailed, sink.events[0].Type)
+	assert.Equal(t, constants.ErrAuthenticationFailed.Error(), sink.events[0].Details["reason"])
+}
+
+func TestLoginUser_UnknownUsername(t *testing.T) {
+	_, request, _ := scramUser(t)
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("ConsumeScramSession", models.ScramPrincipalUser, "alice", "nonce", "c_nonce").Return(nil)
+	mockRepo.On("GetUser", "alice").Return(&models.User{}, gorm.ErrRecordNotFound)
+	service := NewService(mockRepo)
+
+	_, err := service.LoginUser(request)
+
+	assert.ErrorIs(t, err, constants.ErrAuthenticationFailed)
+}
+
+func TestLoginUser_RegistrationNotCompleted(t *testing.T) {
+	user, request, _ := scramUser(t)
+	user.StoredKey = ""
+	user.ServerKey = ""
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("ConsumeScramSession", models.ScramPrincipalUser, "alice", "nonce", "c_nonce").Return(nil)
+	mockRepo.On("GetUser", "alice").Return(user, nil)
+	service := NewService(mockRepo)
+
+	_, err := service.LoginUser(request)
+
+	assert.ErrorIs(t, err, constants.ErrAuthenticationFailed)
+}
+
+func TestLoginUser_LoginSessionNotFound(t *testing.T) {
+	_, request, _ := scramUser(t)
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("ConsumeScramSession", models.ScramPrincipalUser, "alice", "nonce", "c_nonce").Return(gorm.ErrRecordNotFound)
+	service := NewService(mockRepo)
+
+	_, err := service.LoginUser(request)
+
+	assert.ErrorIs(t, err, constants.ErrInvalidLoginSession)
+	mockRepo.AssertNotCalled(t, "GetUser", "alice")
+}
+
+func TestApproveDeviceAuthorization_TwoFactorRequired(t *testing.T) {
+	authorization := &models.DeviceAuthorization{
+		ClientID:  clientID,
+		Scopes:    "read:user",
+		Status:    constants.DeviceAuthorizationPending,
+		ExpiresAt: time.Now().UTC().Add(time.Minute),
+	}
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetDeviceAuthorizationByUserCode", "BCDF-GHJK").Return(authorization, nil)
+	mockRepo.On("GetClient", "client:"+clientID).Return(&models.Client{ID: clientID, RequireUserTwoFactor: true}, nil)
+	mockRepo.On("GetUserByID", userID).Return(&models.User{ID: uint(userID), Username: "alice"}, nil)
+	mockRepo.On("GetTwoFactorCredential", models.ScramPrincipalUser, "alice").Return(
+		&models.TwoFactorCredential{ID: 1}, nil,
+	)
+	service := NewService(mockRepo)
+
+	err := service.ApproveDeviceAuthorization("BCDF-GHJK", userID, []string{"read:user"})
+
+	assert.ErrorIs(t, err, constants.ErrTwoFactorRequired)
+	mockRepo.AssertNotCalled(t, "SaveDeviceAuthorization", authorization)
+}
+
+// twoFactorCredential enrolls alice with a new authenticator and returns
+// the credential together with its shared secret.
+func twoFactorCredential(t *testing.T) (*models.TwoFactorCredential, string) {
+	key := make([]byte, 32)
+	t.Setenv("TOTP_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+	t.Setenv("JWT_SECRET_KEY", "jwt_secret")
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedSecret, err := totp.EncryptSecret(key, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	confirmedAt := time.Now().UTC()
+	return &models.TwoFactorCredential{
+		ID:              7,
+		Principal:       models.ScramPrincipalUser,
+		Username:        "alice",
+		EncryptedSecret: encryptedSecret,
+		ConfirmedAt:     &confirmedAt,
+	}, secret
+}
+
+func TestLoginUser_TwoFactorRequired(t *testing.T) {
+	user, request, _ := scramUser(t)
+	credential, _ := twoFactorCredential(t)
+	sink := &recordingSink{}
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("ConsumeScramSession", models.ScramPrincipalUser, "alice", "nonce", "c_nonce").Return(nil)
+	mockRepo.On("GetUser", "alice").Return(user, nil)
+	mockRepo.On("GetTwoFactorCredential", models.ScramPrincipalUser, "alice").Return(credential, nil)
+	service := &Service{Repo: mockRepo, Audit: sink}
+
+	result, err := service.LoginUser(request)
+
+	assert.Nil(t, err)
+	assert.Nil(t, result["token"])
+	assert.Empty(t, sink.events)
+
+	claims, err := rsUtils.ParseTwoFactorToken(result["two_factor_token"].(string))
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", claims.Subject)
+}
+
+func TestLoginTwoFactor_Success(t *testing.T) {
+	user, _, _ := scramUser(t)
+	credential, secret := twoFactorCredential(t)
+	sink := &recordingSink{}
+
+	step := totp.Step(time.Now())
+	code, err := totp.Code(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	twoFactorToken, err := rsUtils.GenerateTwoFactorToken(models.ScramPrincipalUser, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetTwoFactorCredential", models.ScramPrincipalUser, "alice").Return(credential, nil)
+	mockRepo.On("UseTwoFactorStep", credential.ID, mock.AnythingOfType("int64")).Return(nil)
+	mockRepo.On("GetUser", "alice").Return(user, nil)
+	service := &Service{Repo: mockRepo, Audit: sink}
+
+	result, err := service.LoginTwoFactor(entities.TwoFactorLoginRequest{
+		TwoFactorToken: twoFactorToken,
+		Code:           code,
+		Source:         "10.0.0.1",
+	})
+
+	assert.Nil(t, err)
+	assert.NotEmpty(t, result["token"])
+	assert.Len(t, sink.events, 1)
+	assert.Equal(t, audit.EventLoginSucceeded, sink.events[0].Type)
+	assert.Equal(t, "alice", sink.events[0].Subject)
+}
+
+func TestLoginTwoFactor_WrongCode(t *testing.T) {
+	credential, secret := twoFactorCredential(t)
+	sink := &recordingSink{}
+
+	// a code of an authenticator whose clock is far ahead
+	code, err := totp.Code(secret, totp.Step(time.Now())+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	twoFactorToken, err := rsUtils.GenerateTwoFactorToken(models.ScramPrincipalUser, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetTwoFactorCredential", models.ScramPrincipalUser, "alice").Return(credential, nil)
+	service := &Service{Repo: mockRepo, Audit: sink}
+
+	_, err = service.LoginTwoFactor(entities.TwoFactorLoginRequest{TwoFactorToken: twoFactorToken, Code: code})
+
+	assert.ErrorIs(t, err, constants.ErrInvalidTwoFactorCode)
+	assert.Len(t, sink.events, 1)
+	assert.Equal(t, audit.EventLoginFailed, sink.events[0].Type)
+	mockRepo.AssertNotCalled(t, "GetUser", "alice")
+}
+
+func TestLoginTwoFactor_InvalidToken(t *testing.T) {
+	t.Setenv("JWT_SECRET_KEY", "jwt_secret")
+
+	// a token of the user portal is not a two-factor token
+	now := time.Now()
+	userToken, err := rsUtils.GenerateToken(
+		rsModels.User{ID: 1, Username: "alice"},
+		rsModels.Session{JTI: "session-jti", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := NewService(&MockRepository{})
+
+	_, err = service.LoginTwoFactor(entities.TwoFactorLoginRequest{TwoFactorToken: userToken, Code: "123456"})
+
+	assert.ErrorIs(t, err, constants.ErrInvalidTwoFactorToken)
+}
+
+// passkeyLogin returns the passkey of alice and the assertion her
+// authenticator signs for a login
+func passkeyLogin(t *testing.T, userVerified bool) (*models.Passkey, entities.PasskeyLoginRequest) {
+	t.Setenv("WEBAUTHN_RP_ID", "localhost")
+	t.Setenv("WEBAUTHN_ORIGINS", "http://localhost:5001")
+	config, err := webauthn.ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator := webauthntest.NewAuthenticator("http://localhost:5001")
+	authenticator.Register(webauthn.NewCreationOptions(config, "registration", uint(userID), "alice", nil))
+	authenticator.UserVerified = userVerified
+
+	passkey := &models.Passkey{
+		ID:           3,
+		UserID:       uint(userID),
+		CredentialID: authenticator.CredentialID(),
+		PublicKey:    authenticator.PublicKey(),
+	}
+	request := entities.PasskeyLoginRequest{
+		Credential: authenticator.Login(webauthn.NewRequestOptions(config, "login")),
+		Source:     "10.0.0.1",
+	}
+	return passkey, request
+}
+
+func TestLoginPasskey_Success(t *testing.T) {
+	user, _, _ := scramUser(t)
+	passkey, request := passkeyLogin(t, true)
+	sink := &recordingSink{}
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetPasskey", passkey.CredentialID).Return(passkey, nil)
+	mockRepo.On("GetUserByID", userID).Return(user, nil)
+	mockRepo.On("ConsumeWebAuthnChallenge", webauthn.CeremonyLogin, "login", uint(0)).Return(nil)
+	mockRepo.On("UseWebAuthnCredential", passkey.ID, uint32(1)).Return(nil)
+	service := &Service{Repo: mockRepo, Audit: sink}
+
+	result, err := service.LoginPasskey(request)
+
+	assert.Nil(t, err)
+	assert.NotEmpty(t, result["token"])
+	assert.Len(t, sink.events, 1)
+	assert.Equal(t, audit.EventLoginSucceeded, sink.events[0].Type)
+	assert.Equal(t, "alice", sink.events[0].Subject)
+	mockRepo.AssertNotCalled(t, "GetTwoFactorCredential", models.ScramPrincipalUser, "alice")
+}
+
+func TestLoginPasskey_UserNotVerifiedRequiresTwoFactor(t *testing.T) {
+	user, _, _ := scramUser(t)
+	credential, _ := twoFactorCredential(t)
+	passkey, request := passkeyLogin(t, false)
+	sink := &recordingSink{}
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetPasskey", passkey.CredentialID).Return(passkey, nil)
+	mockRepo.On("GetUserByID", userID).Return(user, nil)
+	mockRepo.On("ConsumeWebAuthnChallenge", webauthn.CeremonyLogin, "login", uint(0)).Return(nil)
+	mockRepo.On("UseWebAuthnCredential", passkey.ID, uint32(1)).Return(nil)
+	mockRepo.On("GetTwoFactorCredential", models.ScramPrincipalUser, "alice").Return(credential, nil)
+	service := &Service{Repo: mockRepo, Audit: sink}
+
+	result, err := service.LoginPasskey(request)
+
+	assert.Nil(t, err)
+	assert.Nil(t, result["token"])
+	assert.Empty(t, sink.events)
+
+	claims, err := rsUtils.ParseTwoFactorToken(result["two_factor_token"].(string))
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", claims.Subject)
+}
+
+func TestLoginPasskey_ClonedPasskey(t *testing.T) {
+	user, _, _ := scramUser(t)
+	passkey, request := passkeyLogin(t, true)
+	passkey.SignCount = 5
+	sink := &recordingSink{}
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetPasskey", passkey.CredentialID).Return(passkey, nil)
+	mockRepo.On("GetUserByID", userID).Return(user, nil)
+	mockRepo.On("ConsumeWebAuthnChallenge", webauthn.CeremonyLogin, "login", uint(0)).Return(nil)
+	service := &Service{Repo: mockRepo, Audit: sink}
+
+	_, err := service.LoginPasskey(request)
+
+	assert.ErrorIs(t, err, constants.ErrPasskeyCloned)
+	assert.Len(t, sink.events, 1)
+	assert.Equal(t, audit.EventLoginFailed, sink.events[0].Type)
+	mockRepo.AssertNotCalled(t, "UseWebAuthnCredential", passkey.ID, uint32(1))
+}
+
+func TestLoginPasskey_UnknownPasskey(t *testing.T) {
+	_, request := passkeyLogin(t, true)
+
+	mockRepo := &MockRepository{}
+	mockRepo.On("GetPasskey", request.Credential.ID).Return(nil, gorm.ErrRecordNotFound)
+	service := NewService(mockRepo)
+
+	_, err := service.LoginPasskey(request)
+
+	assert.ErrorIs(t, err, constants.ErrInvalidPasskey)
+}
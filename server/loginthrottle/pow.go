@@ -0,0 +1,74 @@
+package loginthrottle
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Challenges are "<expiry>.<random>.<mac>", where the MAC binds the challenge
+// to the attempt and to the failures of the account so far. No challenge has
+// to be stored, and a solution stops being accepted after the next failure.
+//
+// A solution is "<challenge>:<nonce>" whose SHA-256 digest starts with
+// Config.ProofOfWorkDifficulty zero bits.
+
+func (t *Throttler) newChallenge(attempt Attempt, accountFailures int, now time.Time) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	expiry := strconv.FormatInt(now.Add(t.config.ProofOfWorkTTL).Unix(), 10)
+	body := expiry + "." + hex.EncodeToString(random)
+
+	return body + "." + t.challengeMAC(body, attempt, accountFailures), nil
+}
+
+func (t *Throttler) verifyProofOfWork(attempt Attempt, accountFailures int, now time.Time) bool {
+	challenge, _, found := strings.Cut(attempt.ProofOfWork, ":")
+	if !found {
+		return false
+	}
+
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 3 {
+		return false
+	}
+
+	body := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(t.challengeMAC(body, attempt, accountFailures))) {
+		return false
+	}
+
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Unix() > expiry {
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(attempt.ProofOfWork))
+	return leadingZeroBits(digest[:]) >= t.config.ProofOfWorkDifficulty
+}
+
+func (t *Throttler) challengeMAC(body string, attempt Attempt, accountFailures int) string {
+	mac := hmac.New(sha256.New, t.config.ProofOfWorkSecret)
+	fmt.Fprintf(mac, "%s\n%s\n%q\n%q\n%d", body, attempt.Principal, attempt.Username, attempt.Source, accountFailures)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func leadingZeroBits(digest []byte) int {
+	zeros := 0
+	for _, b := range digest {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
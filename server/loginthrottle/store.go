@@ -0,0 +1,100 @@
+package loginthrottle
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Counter is the number of consecutive failed logins recorded for a key.
+type Counter struct {
+	Failures      int
+	LastFailureAt time.Time
+}
+
+// Store keeps the counters of the throttler. It has to be shared by all
+// server instances for the limits to hold across them.
+type Store interface {
+	// Counters returns the counters of the given keys. Keys without failures
+	// are left out.
+	Counters(keys []string) (map[string]Counter, error)
+	// RecordFailure adds a failure at now to the counter of key and returns
+	// the updated counter. A counter whose last failure is older than window
+	// starts over.
+	RecordFailure(key string, now time.Time, window time.Duration) (Counter, error)
+	// Reset forgets the failures of the given keys.
+	Reset(keys []string) error
+	// Prune deletes the counters whose last failure happened before the given time.
+	Prune(before time.Time) error
+}
+
+// loginAttempt is a row of the login_attempts table.
+type loginAttempt struct {
+	Key           string    `gorm:"column:key; primaryKey"`
+	Failures      int       `gorm:"column:failures; not null"`
+	LastFailureAt time.Time `gorm:"column:last_failure_at; not null"`
+}
+
+func (loginAttempt) TableName() string {
+	return "login_attempts"
+}
+
+// PostgresStore is a Store backed by the login_attempts table.
+type PostgresStore struct {
+	db *gorm.DB
+}
+
+func NewPostgresStore(db *gorm.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Counters(keys []string) (map[string]Counter, error) {
+	var attempts []loginAttempt
+	err := s.db.Where("key IN ?", keys).Find(&attempts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make(map[string]Counter, len(attempts))
+	for _, attempt := range attempts {
+		counters[attempt.Key] = Counter{
+			Failures:      attempt.Failures,
+			LastFailureAt: attempt.LastFailureAt,
+		}
+	}
+	return counters, nil
+}
+
+// RecordFailure increments the counter in a single upsert, so concurrent
+// failures on different instances are all counted.
+func (s *PostgresStore) RecordFailure(key string, now time.Time, window time.Duration) (Counter, error) {
+	attempt := loginAttempt{Key: key, Failures: 1, LastFailureAt: now}
+
+	err := s.db.Clauses(
+		clause.OnConflict{
+			Columns: []clause.Column{{Name: "key"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"failures": gorm.Expr(
+					"CASE WHEN login_attempts.last_failure_at <= ? THEN 1 ELSE login_attempts.failures + 1 END",
+					now.Add(-window),
+				),
+				"last_failure_at": now,
+			}),
+		},
+		clause.Returning{Columns: []clause.Column{{Name: "failures"}}},
+	).Create(&attempt).Error
+	if err != nil {
+		return Counter{}, err
+	}
+
+	return Counter{Failures: attempt.Failures, LastFailureAt: now}, nil
+}
+
+func (s *PostgresStore) Reset(keys []string) error {
+	return s.db.Where("key IN ?", keys).Delete(&loginAttempt{}).Error
+}
+
+func (s *PostgresStore) Prune(before time.Time) error {
+	return s.db.Where("last_failure_at < ?", before).Delete(&loginAttempt{}).Error
+}
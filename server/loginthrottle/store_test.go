@@ -0,0 +1,72 @@
+package loginthrottle
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func newMockStore(t *testing.T) (*PostgresStore, sqlmock.Sqlmock) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal("Failed to create mock DB:", err)
+	}
+
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: mockDB}), &gorm.Config{})
+	if err != nil {
+		t.Fatal("Failed to connect to mock DB:", err)
+	}
+
+	return NewPostgresStore(db), mock
+}
+
+func TestPostgresStore_RecordFailure(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`INSERT INTO "login_attempts" ("key","failures","last_failure_at") VALUES ($1,$2,$3) `+
+			`ON CONFLICT ("key") DO UPDATE SET `+
+			`"failures"=CASE WHEN login_attempts.last_failure_at <= $4 THEN 1 ELSE login_attempts.failures + 1 END,`+
+			`"last_failure_at"=$5 RETURNING "failures"`,
+	)).WithArgs(
+		"account:user:alice", 1, testNow, testNow.Add(-time.Hour), testNow,
+	).WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(4))
+	mock.ExpectCommit()
+
+	counter, err := store.RecordFailure("account:user:alice", testNow, time.Hour)
+
+	assert.Nil(t, err)
+	assert.Equal(t, Counter{Failures: 4, LastFailureAt: testNow}, counter)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPostgresStore_Counters(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "login_attempts" WHERE key IN ($1,$2)`,
+	)).WithArgs("account:user:alice", `source:"10.0.0.1"`).WillReturnRows(
+		sqlmock.NewRows([]string{"key", "failures", "last_failure_at"}).
+			AddRow("account:user:alice", 2, testNow),
+	)
+
+	counters, err := store.Counters([]string{"account:user:alice", `source:"10.0.0.1"`})
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]Counter{
+		"account:user:alice": {Failures: 2, LastFailureAt: testNow},
+	}, counters)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,295 @@
+// Package loginthrottle slows down password guessing against the login
+// endpoints. Failed logins are counted per account, per source address and
+// per pair of both; once a counter passes its free failures every further
+// attempt has to wait an exponentially growing delay.
+//
+// The account counter never locks: while it is delayed, attempts have to
+// come with a proof of work instead, so an attacker failing logins on
+// purpose cannot lock the owner out of their account. Without proofs of
+// work only the source and pair counters throttle.
+package loginthrottle
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"globe-and-citizen/layer8/server/audit"
+)
+
+// Principals of login attempts
+const (
+	PrincipalUser   = "user"
+	PrincipalClient = "client"
+)
+
+const (
+	keyAccount = "account"
+	keyPair    = "pair"
+	keySource  = "source"
+)
+
+type Config struct {
+	// FreeFailures is how many failures a counter takes before attempts are delayed
+	FreeFailures int
+	// BaseDelay is the delay after the first failure past FreeFailures, it
+	// doubles with every further failure
+	BaseDelay time.Duration
+	// MaxDelay caps the delay of the source and pair counters
+	MaxDelay time.Duration
+	// AccountMaxDelay caps how long the account counter requires a proof of
+	// work after its last failure
+	AccountMaxDelay time.Duration
+	// Window is how long a counter is kept after its last failure
+	Window time.Duration
+
+	// ProofOfWorkDifficulty is the number of leading zero bits a solved
+	// challenge needs, zero disables proofs of work and with them the
+	// account counter
+	ProofOfWorkDifficulty int
+	// ProofOfWorkFailures is how many failures of any counter make attempts
+	// require a proof of work
+	ProofOfWorkFailures int
+	// ProofOfWorkTTL is how long a challenge can be solved
+	ProofOfWorkTTL time.Duration
+	// ProofOfWorkSecret signs the challenges
+	ProofOfWorkSecret []byte
+
+	// TrustForwardedFor takes the source address from X-Forwarded-For,
+	// which is only safe behind a proxy that sets it
+	TrustForwardedFor bool
+}
+
+func DefaultConfig() Config {
+	return Config{
+		FreeFailures:          5,
+		BaseDelay:             time.Second,
+		MaxDelay:              15 * time.Minute,
+		AccountMaxDelay:       time.Minute,
+		Window:                time.Hour,
+		ProofOfWorkDifficulty: 18,
+		ProofOfWorkFailures:   3,
+		ProofOfWorkTTL:        2 * time.Minute,
+	}
+}
+
+// Attempt is a login of Username, a user or a client, from Source.
+type Attempt struct {
+	Principal string
+	Username  string
+	Source    string
+	// ProofOfWork is the solution of a previously issued challenge, if any
+	ProofOfWork string
+}
+
+func (a Attempt) keys() map[string]string {
+	return map[string]string{
+		keyAccount: fmt.Sprintf("account:%s:%s", a.Principal, a.Username),
+		keyPair:    fmt.Sprintf("pair:%s:%q:%q", a.Principal, a.Source, a.Username),
+		keySource:  fmt.Sprintf("source:%q", a.Source),
+	}
+}
+
+// LockedError is returned for attempts that have to wait before trying again.
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, retry after %s", e.RetryAfter)
+}
+
+// ProofOfWorkError is returned for attempts that lack a valid solution of a
+// proof of work. The attempt can be repeated with a solution of Challenge.
+type ProofOfWorkError struct {
+	Challenge  string
+	Difficulty int
+}
+
+func (e *ProofOfWorkError) Error() string {
+	return "a proof of work is required to log in"
+}
+
+type Throttler struct {
+	store  Store
+	sink   audit.Sink
+	config Config
+	now    func() time.Time
+}
+
+func New(store Store, sink audit.Sink, config Config) *Throttler {
+	return &Throttler{
+		store:  store,
+		sink:   sink,
+		config: config,
+		now:    func() time.Time { return time.Now().UTC() },
+	}
+}
+
+// Check returns a *LockedError or a *ProofOfWorkError if the attempt must not
+// be made now.
+func (t *Throttler) Check(attempt Attempt) error {
+	keys := attempt.keys()
+
+	counters, err := t.counters(keys)
+	if err != nil {
+		return err
+	}
+
+	now := t.now()
+	proofOfWorkRequired := false
+	var retryAfter time.Duration
+
+	for kind, key := range keys {
+		counter := counters[key]
+
+		if t.proofOfWorkEnabled() && counter.Failures >= t.config.ProofOfWorkFailures {
+			proofOfWorkRequired = true
+		}
+
+		wait := counter.LastFailureAt.Add(t.delay(kind, counter.Failures)).Sub(now)
+		if wait <= 0 {
+			continue
+		}
+
+		if kind == keyAccount {
+			// the owner can always get past the account counter by working,
+			// so failures against the account alone never lock it
+			if t.proofOfWorkEnabled() {
+				proofOfWorkRequired = true
+			}
+			continue
+		}
+
+		retryAfter = max(retryAfter, wait)
+	}
+
+	if retryAfter > 0 {
+		return &LockedError{RetryAfter: retryAfter}
+	}
+
+	if proofOfWorkRequired {
+		accountFailures := counters[keys[keyAccount]].Failures
+		if !t.verifyProofOfWork(attempt, accountFailures, now) {
+			challenge, err := t.newChallenge(attempt, accountFailures, now)
+			if err != nil {
+				return err
+			}
+
+			return &ProofOfWorkError{Challenge: challenge, Difficulty: t.config.ProofOfWorkDifficulty}
+		}
+	}
+
+	return nil
+}
+
+// Fail records a failed attempt. Reaching a lock is written to the audit trail.
+func (t *Throttler) Fail(attempt Attempt) error {
+	now := t.now()
+
+	for kind, key := range attempt.keys() {
+		counter, err := t.store.RecordFailure(key, now, t.config.Window)
+		if err != nil {
+			return err
+		}
+
+		if counter.Failures != t.config.FreeFailures+1 {
+			continue
+		}
+
+		err = t.sink.Record(audit.Event{
+			Type:      audit.EventLoginLocked,
+			Principal: attempt.Principal,
+			Subject:   attempt.Username,
+			Source:    attempt.Source,
+			Details: map[string]string{
+				"counter":  kind,
+				"failures": strconv.Itoa(counter.Failures),
+				"delay":    t.delay(kind, counter.Failures).String(),
+			},
+			CreatedAt: now,
+		})
+		if err != nil {
+			// the lock holds even if it could not be audited
+			log.Printf("failed to record login lock of %s %s: %v", attempt.Principal, attempt.Username, err)
+		}
+	}
+
+	return nil
+}
+
+// Succeed forgets the failures of the account and of the pair. The source
+// counter is kept, a successful login to one account says nothing about the
+// guesses against others.
+func (t *Throttler) Succeed(attempt Attempt) error {
+	keys := attempt.keys()
+	return t.store.Reset([]string{keys[keyAccount], keys[keyPair]})
+}
+
+// Prune deletes the counters that are out of the window.
+func (t *Throttler) Prune() error {
+	return t.store.Prune(t.now().Add(-t.config.Window))
+}
+
+// Source returns the address a request came from.
+func (t *Throttler) Source(r *http.Request) string {
+	if t.config.TrustForwardedFor {
+		if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+			first, _, _ := strings.Cut(forwardedFor, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// counters returns the counters of keys, leaving out the ones out of the window.
+func (t *Throttler) counters(keys map[string]string) (map[string]Counter, error) {
+	list := make([]string, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, key)
+	}
+
+	counters, err := t.store.Counters(list)
+	if err != nil {
+		return nil, err
+	}
+
+	windowStart := t.now().Add(-t.config.Window)
+	for key, counter := range counters {
+		if !counter.LastFailureAt.After(windowStart) {
+			delete(counters, key)
+		}
+	}
+	return counters, nil
+}
+
+// delay is how long after the last of the given failures the next attempt is allowed.
+func (t *Throttler) delay(kind string, failures int) time.Duration {
+	if failures <= t.config.FreeFailures {
+		return 0
+	}
+
+	maxDelay := t.config.MaxDelay
+	if kind == keyAccount {
+		maxDelay = t.config.AccountMaxDelay
+	}
+
+	delay := t.config.BaseDelay
+	for i := t.config.FreeFailures + 1; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+func (t *Throttler) proofOfWorkEnabled() bool {
+	return t.config.ProofOfWorkDifficulty > 0
+}
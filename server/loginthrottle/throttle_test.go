@@ -0,0 +1,348 @@
+package loginthrottle
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"globe-and-citizen/layer8/server/audit"
+)
+
+type memoryStore struct {
+	mu       sync.Mutex
+	counters map[string]Counter
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{counters: map[string]Counter{}}
+}
+
+func (s *memoryStore) Counters(keys []string) (map[string]Counter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counters := map[string]Counter{}
+	for _, key := range keys {
+		if counter, ok := s.counters[key]; ok {
+			counters[key] = counter
+		}
+	}
+	return counters, nil
+}
+
+func (s *memoryStore) RecordFailure(key string, now time.Time, window time.Duration) (Counter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.counters[key]
+	if !counter.LastFailureAt.After(now.Add(-window)) {
+		counter.Failures = 0
+	}
+	counter.Failures++
+	counter.LastFailureAt = now
+
+	s.counters[key] = counter
+	return counter, nil
+}
+
+func (s *memoryStore) Reset(keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.counters, key)
+	}
+	return nil
+}
+
+func (s *memoryStore) Prune(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, counter := range s.counters {
+		if counter.LastFailureAt.Before(before) {
+			delete(s.counters, key)
+		}
+	}
+	return nil
+}
+
+type memorySink struct {
+	events []audit.Event
+	err    error
+}
+
+func (s *memorySink) Record(event audit.Event) error {
+	s.events = append(s.events, event)
+	return s.err
+}
+
+var testNow = time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+func newTestThrottler(config Config) (*Throttler, *memoryStore, *memorySink, *time.Time) {
+	store := newMemoryStore()
+	sink := &memorySink{}
+	now := testNow
+
+	throttler := New(store, sink, config)
+	throttler.now = func() time.Time { return now }
+
+	return throttler, store, sink, &now
+}
+
+func userAttempt(username string, source string) Attempt {
+	return Attempt{Principal: PrincipalUser, Username: username, Source: source}
+}
+
+// configWithoutProofOfWork leaves only the source and pair counters to throttle
+func configWithoutProofOfWork() Config {
+	config := DefaultConfig()
+	config.ProofOfWorkDifficulty = 0
+	return config
+}
+
+func failTimes(t *testing.T, throttler *Throttler, attempt Attempt, times int) {
+	for i := 0; i < times; i++ {
+		assert.Nil(t, throttler.Fail(attempt))
+	}
+}
+
+func solve(challenge string, difficulty int) string {
+	for nonce := 0; ; nonce++ {
+		solution := fmt.Sprintf("%s:%d", challenge, nonce)
+		digest := sha256.Sum256([]byte(solution))
+		if leadingZeroBits(digest[:]) >= difficulty {
+			return solution
+		}
+	}
+}
+
+func TestCheck_FreeFailuresAreNotDelayed(t *testing.T) {
+	throttler, _, sink, _ := newTestThrottler(configWithoutProofOfWork())
+	attempt := userAttempt("alice", "10.0.0.1")
+
+	failTimes(t, throttler, attempt, 5)
+
+	assert.Nil(t, throttler.Check(attempt))
+	assert.Empty(t, sink.events)
+}
+
+func TestCheck_DelayGrowsExponentially(t *testing.T) {
+	throttler, _, _, now := newTestThrottler(configWithoutProofOfWork())
+	attempt := userAttempt("alice", "10.0.0.1")
+
+	failTimes(t, throttler, attempt, 6)
+
+	var lockedErr *LockedError
+	assert.True(t, errors.As(throttler.Check(attempt), &lockedErr))
+	assert.Equal(t, time.Second, lockedErr.RetryAfter)
+
+	*now = now.Add(time.Second)
+	assert.Nil(t, throttler.Check(attempt))
+
+	failTimes(t, throttler, attempt, 2)
+
+	assert.True(t, errors.As(throttler.Check(attempt), &lockedErr))
+	assert.Equal(t, 4*time.Second, lockedErr.RetryAfter)
+}
+
+func TestCheck_AccountCounterNeverLocks(t *testing.T) {
+	throttler, _, _, now := newTestThrottler(configWithoutProofOfWork())
+
+	// every failure comes from another source, only the account counter grows
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, throttler.Fail(userAttempt("alice", fmt.Sprintf("10.0.0.%d", i))))
+		*now = now.Add(time.Minute - time.Second)
+	}
+
+	// an attacker failing once a minute does not lock the owner out
+	assert.Nil(t, throttler.Check(userAttempt("alice", "192.168.0.1")))
+}
+
+func TestCheck_SourceDelayIsCappedAtMaxDelay(t *testing.T) {
+	throttler, _, _, _ := newTestThrottler(configWithoutProofOfWork())
+
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, throttler.Fail(userAttempt(fmt.Sprintf("user%d", i), "10.0.0.1")))
+	}
+
+	var lockedErr *LockedError
+	assert.True(t, errors.As(throttler.Check(userAttempt("bob", "10.0.0.1")), &lockedErr))
+	assert.Equal(t, 15*time.Minute, lockedErr.RetryAfter)
+
+	assert.Nil(t, throttler.Check(userAttempt("bob", "10.0.0.2")))
+}
+
+func TestCheck_CountersExpireAfterWindow(t *testing.T) {
+	throttler, _, _, now := newTestThrottler(configWithoutProofOfWork())
+	attempt := userAttempt("alice", "10.0.0.1")
+
+	failTimes(t, throttler, attempt, 10)
+	*now = now.Add(time.Hour)
+
+	assert.Nil(t, throttler.Check(attempt))
+
+	// the next failure starts the counters over
+	failTimes(t, throttler, attempt, 1)
+	assert.Nil(t, throttler.Check(attempt))
+}
+
+func TestFail_LockIsAudited(t *testing.T) {
+	throttler, _, sink, _ := newTestThrottler(configWithoutProofOfWork())
+	attempt := userAttempt("alice", "10.0.0.1")
+
+	failTimes(t, throttler, attempt, 7)
+
+	// each counter is audited once, when it locks
+	assert.Len(t, sink.events, 3)
+	for _, event := range sink.events {
+		assert.Equal(t, audit.EventLoginLocked, event.Type)
+		assert.Equal(t, PrincipalUser, event.Principal)
+		assert.Equal(t, "alice", event.Subject)
+		assert.Equal(t, "10.0.0.1", event.Source)
+		assert.Equal(t, "6", event.Details["failures"])
+		assert.Equal(t, testNow, event.CreatedAt)
+	}
+}
+
+func TestFail_SinkErrorDoesNotFail(t *testing.T) {
+	throttler, _, sink, _ := newTestThrottler(configWithoutProofOfWork())
+	sink.err = errors.New("sink is down")
+	attempt := userAttempt("alice", "10.0.0.1")
+
+	failTimes(t, throttler, attempt, 6)
+
+	assert.NotNil(t, throttler.Check(attempt))
+}
+
+func TestSucceed_KeepsSourceCounter(t *testing.T) {
+	throttler, store, _, _ := newTestThrottler(configWithoutProofOfWork())
+	attempt := userAttempt("alice", "10.0.0.1")
+	keys := attempt.keys()
+
+	failTimes(t, throttler, attempt, 3)
+	assert.Nil(t, throttler.Succeed(attempt))
+
+	counters, _ := store.Counters([]string{keys[keyAccount], keys[keyPair], keys[keySource]})
+	assert.Equal(t, map[string]Counter{
+		keys[keySource]: {Failures: 3, LastFailureAt: testNow},
+	}, counters)
+}
+
+func TestCheck_ProofOfWorkInsteadOfAccountLock(t *testing.T) {
+	config := DefaultConfig()
+	config.ProofOfWorkDifficulty = 8
+	config.ProofOfWorkSecret = []byte("secret")
+	throttler, _, _, _ := newTestThrottler(config)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, throttler.Fail(userAttempt("alice", fmt.Sprintf("10.0.0.%d", i))))
+	}
+
+	attempt := userAttempt("alice", "192.168.0.1")
+
+	var proofOfWorkErr *ProofOfWorkError
+	assert.True(t, errors.As(throttler.Check(attempt), &proofOfWorkErr))
+	assert.Equal(t, 8, proofOfWorkErr.Difficulty)
+
+	attempt.ProofOfWork = solve(proofOfWorkErr.Challenge, proofOfWorkErr.Difficulty)
+	assert.Nil(t, throttler.Check(attempt))
+
+	// a solution is bound to the source it was issued for
+	other := userAttempt("alice", "192.168.0.2")
+	other.ProofOfWork = attempt.ProofOfWork
+	assert.True(t, errors.As(throttler.Check(other), &proofOfWorkErr))
+
+	// and is not accepted after another failure
+	assert.Nil(t, throttler.Fail(attempt))
+	assert.True(t, errors.As(throttler.Check(attempt), &proofOfWorkErr))
+}
+
+func TestCheck_ProofOfWorkIsEnabledByDefault(t *testing.T) {
+	config := DefaultConfig()
+	config.ProofOfWorkSecret = []byte("secret")
+	throttler, _, _, now := newTestThrottler(config)
+
+	// a failure a minute, each from a new source, keeps the account counter delayed
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, throttler.Fail(userAttempt("alice", fmt.Sprintf("10.0.0.%d", i))))
+		*now = now.Add(time.Minute - time.Second)
+	}
+
+	var proofOfWorkErr *ProofOfWorkError
+	assert.True(t, errors.As(throttler.Check(userAttempt("alice", "192.168.0.1")), &proofOfWorkErr))
+	assert.Equal(t, 18, proofOfWorkErr.Difficulty)
+}
+
+func TestCheck_ProofOfWorkAfterFailures(t *testing.T) {
+	config := DefaultConfig()
+	config.ProofOfWorkDifficulty = 8
+	config.ProofOfWorkSecret = []byte("secret")
+	throttler, _, _, now := newTestThrottler(config)
+	attempt := userAttempt("alice", "10.0.0.1")
+
+	failTimes(t, throttler, attempt, 2)
+	assert.Nil(t, throttler.Check(attempt))
+
+	failTimes(t, throttler, attempt, 1)
+
+	var proofOfWorkErr *ProofOfWorkError
+	assert.True(t, errors.As(throttler.Check(attempt), &proofOfWorkErr))
+
+	solution := solve(proofOfWorkErr.Challenge, proofOfWorkErr.Difficulty)
+
+	tampered := strings.Replace(solution, ".", "0.", 1)
+	attempt.ProofOfWork = tampered
+	assert.True(t, errors.As(throttler.Check(attempt), &proofOfWorkErr))
+
+	attempt.ProofOfWork = solution
+	assert.Nil(t, throttler.Check(attempt))
+
+	// the challenge expires
+	*now = now.Add(config.ProofOfWorkTTL + time.Second)
+	assert.True(t, errors.As(throttler.Check(attempt), &proofOfWorkErr))
+}
+
+func TestCheck_ProofOfWorkDoesNotUnlockSource(t *testing.T) {
+	config := DefaultConfig()
+	config.ProofOfWorkDifficulty = 8
+	config.ProofOfWorkSecret = []byte("secret")
+	throttler, _, _, _ := newTestThrottler(config)
+	attempt := userAttempt("alice", "10.0.0.1")
+
+	failTimes(t, throttler, attempt, 6)
+
+	var lockedErr *LockedError
+	assert.True(t, errors.As(throttler.Check(attempt), &lockedErr))
+}
+
+func TestPrune(t *testing.T) {
+	throttler, store, _, now := newTestThrottler(configWithoutProofOfWork())
+
+	failTimes(t, throttler, userAttempt("alice", "10.0.0.1"), 1)
+	*now = now.Add(2 * time.Hour)
+	failTimes(t, throttler, userAttempt("bob", "10.0.0.2"), 1)
+
+	assert.Nil(t, throttler.Prune())
+	assert.Len(t, store.counters, 3)
+}
+
+func TestSource(t *testing.T) {
+	throttler, _, _, _ := newTestThrottler(configWithoutProofOfWork())
+
+	r := httptest.NewRequest("POST", "/api/v1/login-user", nil)
+	r.RemoteAddr = "10.0.0.1:52314"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.1")
+
+	assert.Equal(t, "10.0.0.1", throttler.Source(r))
+
+	throttler.config.TrustForwardedFor = true
+	assert.Equal(t, "1.2.3.4", throttler.Source(r))
+}
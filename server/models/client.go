@@ -1,20 +1,32 @@
 package models
 
+import "time"
+
 type Client struct {
-	ID                   string `gorm:"column:id; not null" json:"id"`
-	Secret               string `gorm:"column:secret" json:"secret"`
-	Name                 string `gorm:"column:name" json:"name"`
-	RedirectURI          string `gorm:"column:redirect_uri" json:"redirect_uri"`
-	BackendURI           string `gorm:"column:backend_uri" json:"backend_uri"`
-	Username             string `gorm:"column:username; unique; not null" json:"username"`
-	Salt                 string `gorm:"column:salt; not null" json:"salt"`
-	X509CertificateBytes []byte `gorm:"column:x509_certificate_bytes" json:"x509_certificate_bytes"`
+	ID         string `gorm:"column:id; not null" json:"id"`
+	SecretHash string `gorm:"column:secret_hash" json:"-"`
+	// PreviousSecretHash keeps the secret replaced by the last rotation valid
+	// until PreviousSecretExpiresAt, so the client can roll out the new one.
+	PreviousSecretHash      string     `gorm:"column:previous_secret_hash" json:"-"`
+	PreviousSecretExpiresAt *time.Time `gorm:"column:previous_secret_expires_at" json:"-"`
+	Name                    string     `gorm:"column:name" json:"name"`
+	RedirectURI             string     `gorm:"column:redirect_uri" json:"redirect_uri"`
+	BackendURI              string     `gorm:"column:backend_uri" json:"backend_uri"`
+	Username                string     `gorm:"column:username; unique; not null" json:"username"`
+	Salt                    string     `gorm:"column:salt; not null" json:"salt"`
+	X509CertificateBytes    []byte     `gorm:"column:x509_certificate_bytes" json:"x509_certificate_bytes"`
+	// GrantTypes is the comma separated list of grants the client registered
+	// for. Clients created through the portal leave it empty and may use all.
+	GrantTypes string `gorm:"column:grant_types" json:"grant_types"`
+	// RequireUserTwoFactor only lets users with two-factor authentication
+	// authorize the client
+	RequireUserTwoFactor bool `gorm:"column:require_user_two_factor; default:false" json:"require_user_two_factor"`
 }
 
-func CreateClient(id, secret, name, redirect_uri string) Client {
+func CreateClient(id, secretHash, name, redirect_uri string) Client {
 	return Client{
 		ID:          id,
-		Secret:      secret,
+		SecretHash:  secretHash,
 		Name:        name,
 		RedirectURI: redirect_uri,
 	}
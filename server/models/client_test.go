@@ -12,8 +12,8 @@ func TestCreateClient(t *testing.T) {
 	if client.ID != "1234" {
 		t.Errorf("Failed to create client struct: wrong id.")
 	}
-	if client.Secret != "5678#1234" {
-		t.Errorf("Failed to create client struct: wrong secret.")
+	if client.SecretHash != "5678#1234" {
+		t.Errorf("Failed to create client struct: wrong secret hash.")
 	}
 	if client.RedirectURI != "my_redirection_uri" {
 		t.Errorf("Failed to create client struct: wrong redirection URL")
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// DataAccessRecord is a release of user metadata to a client, see the
+// resource server model. The authorization server records them.
+type DataAccessRecord struct {
+	ID         uint      `gorm:"primaryKey; autoIncrement; not null"`
+	UserID     uint      `gorm:"column:user_id; not null"`
+	ClientID   string    `gorm:"column:client_id; not null"`
+	Scopes     string    `gorm:"column:scopes; not null"`
+	Fields     string    `gorm:"column:fields; not null"`
+	AccessedAt time.Time `gorm:"column:accessed_at; not null"`
+}
+
+func (DataAccessRecord) TableName() string {
+	return "data_access_records"
+}
@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// DeviceAuthorization is a pending device authorization grant (RFC 8628). The
+// device polls with its device code, stored only as a SHA-256 hash, while the
+// user enters the short user code in the portal to approve or deny it.
+type DeviceAuthorization struct {
+	ID             uint       `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	DeviceCodeHash string     `gorm:"column:device_code_hash; unique; not null" json:"-"`
+	UserCode       string     `gorm:"column:user_code; unique; not null" json:"user_code"`
+	ClientID       string     `gorm:"column:client_id; not null" json:"client_id"`
+	Scopes         string     `gorm:"column:scopes; not null" json:"scopes"`
+	Status         string     `gorm:"column:status; not null" json:"status"`
+	UserID         *uint      `gorm:"column:user_id" json:"user_id"`
+	Interval       int        `gorm:"column:interval; not null" json:"interval"`
+	LastPolledAt   *time.Time `gorm:"column:last_polled_at" json:"last_polled_at"`
+	ExpiresAt      time.Time  `gorm:"column:expires_at; not null" json:"expires_at"`
+	CreatedAt      time.Time  `gorm:"column:created_at; autoCreateTime" json:"created_at"`
+}
+
+func (DeviceAuthorization) TableName() string {
+	return "device_authorizations"
+}
@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// EmailDomainProof is a proof made for a client that the domain of a user's
+// verified email is in a set of domains, see the resource server model. The
+// authorization server makes them when the user's domain is first released
+// to the client and reuses them afterwards. Domain is only set for the proof
+// of the set holding the user's domain alone, DomainSet only for the proofs
+// of the configured sets.
+type EmailDomainProof struct {
+	ID               uint      `gorm:"primaryKey; autoIncrement; not null"`
+	UserID           uint      `gorm:"column:user_id; not null"`
+	ClientID         string    `gorm:"column:client_id; not null"`
+	DomainSet        string    `gorm:"column:domain_set; not null"`
+	Domain           *string   `gorm:"column:domain"`
+	DomainSetRoot    string    `gorm:"column:domain_set_root; not null"`
+	Nullifier        string    `gorm:"column:nullifier; not null"`
+	DomainCommitment string    `gorm:"column:domain_commitment; not null"`
+	ZkProof          []byte    `gorm:"column:zk_proof; not null"`
+	ZkKeyPairID      uint      `gorm:"column:zk_key_pair_id; not null"`
+	CreatedAt        time.Time `gorm:"column:created_at; autoCreateTime"`
+}
+
+func (EmailDomainProof) TableName() string {
+	return "email_domain_proofs"
+}
+
+// UserEmailDomain is the domain of a user's verified email address and the
+// key the nullifiers of its proofs are made with, see the resource server
+// model.
+type UserEmailDomain struct {
+	UserID           uint   `gorm:"column:user_id; primaryKey; not null"`
+	Domain           string `gorm:"column:domain; not null"`
+	NullifierKey     []byte `gorm:"column:nullifier_key; not null"`
+	DomainCommitment string `gorm:"column:domain_commitment; not null"`
+}
+
+func (UserEmailDomain) TableName() string {
+	return "user_email_domains"
+}
@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 type UserMetadata struct {
 	ID                    uint   `gorm:"column:id; primaryKey; not null" json:"id"`
 	DisplayName           string `gorm:"column:display_name; not null" json:"display_name"`
@@ -7,6 +9,11 @@ type UserMetadata struct {
 	Bio                   string `gorm:"column:bio; not null" json:"bio"`
 	IsEmailVerified       bool   `gorm:"column:is_email_verified; not null" json:"is_email_verified"`
 	IsPhoneNumberVerified bool   `gorm:"column:is_phone_number_verified; not null" json:"is_phone_number_verified"`
+	// EmailReproveBy and PhoneNumberReproveBy are when a verified attribute
+	// proved with a superseded zk key pair lapses, unless the user verifies
+	// it again
+	EmailReproveBy       *time.Time `gorm:"column:email_reprove_by" json:"email_reprove_by,omitempty"`
+	PhoneNumberReproveBy *time.Time `gorm:"column:phone_number_reprove_by" json:"phone_number_reprove_by,omitempty"`
 }
 
 func (UserMetadata) TableName() string {
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// PairwiseSubject maps the pseudonymous subject identifier handed out to one
+// client back to the internal user it was derived for.
+type PairwiseSubject struct {
+	ID        uint      `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	ClientID  string    `gorm:"column:client_id; not null" json:"client_id"`
+	UserID    uint      `gorm:"column:user_id; not null" json:"user_id"`
+	Subject   string    `gorm:"column:subject; unique; not null" json:"subject"`
+	CreatedAt time.Time `gorm:"column:created_at; autoCreateTime" json:"created_at"`
+}
+
+func (PairwiseSubject) TableName() string {
+	return "pairwise_subjects"
+}
@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// Passkey is a WebAuthn credential a user registered through the resource
+// server. OAuth portal logins accept it in place of the password.
+type Passkey struct {
+	ID           uint       `gorm:"primaryKey; autoIncrement; not null"`
+	UserID       uint       `gorm:"column:user_id; not null"`
+	CredentialID string     `gorm:"column:credential_id; not null"`
+	PublicKey    []byte     `gorm:"column:public_key; not null"`
+	SignCount    uint32     `gorm:"column:sign_count; not null"`
+	LastUsedAt   *time.Time `gorm:"column:last_used_at"`
+}
+
+func (Passkey) TableName() string {
+	return "passkeys"
+}
+
+// WebAuthnChallenge is the challenge of the options of a passkey ceremony.
+type WebAuthnChallenge struct {
+	ID        uint      `gorm:"primaryKey; autoIncrement; not null"`
+	Ceremony  string    `gorm:"column:ceremony; not null"`
+	Challenge string    `gorm:"column:challenge; not null"`
+	UserID    *uint     `gorm:"column:user_id"`
+	ExpiresAt time.Time `gorm:"column:expires_at; not null"`
+}
+
+func (WebAuthnChallenge) TableName() string {
+	return "webauthn_challenges"
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+const ScramPrincipalUser = "user"
+
+// ScramSession is the server nonce a login precheck of the resource server
+// issued. An OAuth portal login consumes it like a resource server login.
+type ScramSession struct {
+	ID        uint      `gorm:"primaryKey; autoIncrement; not null"`
+	Principal string    `gorm:"column:principal; not null"`
+	Username  string    `gorm:"column:username; not null"`
+	CNonce    string    `gorm:"column:c_nonce; not null"`
+	Nonce     string    `gorm:"column:nonce; not null"`
+	ExpiresAt time.Time `gorm:"column:expires_at; not null"`
+	CreatedAt time.Time `gorm:"column:created_at"`
+}
+
+func (ScramSession) TableName() string {
+	return "scram_sessions"
+}
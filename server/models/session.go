@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// Session is a login, see the resource server model. The authorization
+// server starts the sessions of the apps users granted access to.
+type Session struct {
+	ID          uint      `gorm:"primaryKey; autoIncrement; not null"`
+	JTI         string    `gorm:"column:jti; not null"`
+	Principal   string    `gorm:"column:principal; not null"`
+	UserID      *uint     `gorm:"column:user_id"`
+	ClientID    *string   `gorm:"column:client_id"`
+	DeviceLabel string    `gorm:"column:device_label; not null"`
+	CreatedAt   time.Time `gorm:"column:created_at; not null"`
+	LastSeenAt  time.Time `gorm:"column:last_seen_at; not null"`
+	ExpiresAt   time.Time `gorm:"column:expires_at; not null"`
+}
+
+func (Session) TableName() string {
+	return "sessions"
+}
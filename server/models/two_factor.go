@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// TwoFactorCredential is the authenticator a user enrolled through the
+// resource server. Once confirmed, OAuth portal logins ask for its codes too.
+type TwoFactorCredential struct {
+	ID              uint       `gorm:"primaryKey; autoIncrement; not null"`
+	Principal       string     `gorm:"column:principal; not null"`
+	Username        string     `gorm:"column:username; not null"`
+	EncryptedSecret string     `gorm:"column:encrypted_secret; not null"`
+	LastUsedStep    int64      `gorm:"column:last_used_step; not null"`
+	ConfirmedAt     *time.Time `gorm:"column:confirmed_at"`
+	CreatedAt       time.Time  `gorm:"column:created_at"`
+}
+
+func (TwoFactorCredential) TableName() string {
+	return "two_factor_credentials"
+}
+
+func (c TwoFactorCredential) Confirmed() bool {
+	return c.ConfirmedAt != nil
+}
+
+type TwoFactorRecoveryCode struct {
+	ID           uint       `gorm:"primaryKey; autoIncrement; not null"`
+	CredentialID uint       `gorm:"column:credential_id; not null"`
+	CodeHash     string     `gorm:"column:code_hash; not null"`
+	UsedAt       *time.Time `gorm:"column:used_at"`
+}
+
+func (TwoFactorRecoveryCode) TableName() string {
+	return "two_factor_recovery_codes"
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// UsedAuthorizationCode marks an authorization code as redeemed, by the jti
+// it was issued with, until the code expires and can no longer be redeemed
+// anyway.
+type UsedAuthorizationCode struct {
+	JTI       string    `gorm:"column:jti; primaryKey; not null"`
+	ExpiresAt time.Time `gorm:"column:expires_at; not null"`
+}
+
+func (UsedAuthorizationCode) TableName() string {
+	return "used_authorization_codes"
+}
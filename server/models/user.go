@@ -7,6 +7,10 @@ type User struct {
 	FirstName string `gorm:"column:first_name; not null" json:"first_name"`
 	LastName  string `gorm:"column:last_name; not null" json:"last_name"`
 	Salt      string `gorm:"column:salt; not null" json:"salt"`
+	// The SCRAM credential of the user, shared with the resource server
+	IterationCount int    `gorm:"column:iteration_count" json:"-"`
+	StoredKey      string `gorm:"column:stored_key" json:"-"`
+	ServerKey      string `gorm:"column:server_key" json:"-"`
 }
 
 func (User) TableName() string {
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// UserConsent records the scopes a user granted to a client. There is at most
+// one record per (user, client) pair; granting again replaces the scopes.
+type UserConsent struct {
+	ID         uint       `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	UserID     uint       `gorm:"column:user_id; not null" json:"user_id"`
+	ClientID   string     `gorm:"column:client_id; not null" json:"client_id"`
+	Scopes     string     `gorm:"column:scopes; not null" json:"scopes"`
+	GrantedAt  time.Time  `gorm:"column:granted_at; not null" json:"granted_at"`
+	LastUsedAt *time.Time `gorm:"column:last_used_at" json:"last_used_at"`
+}
+
+func (UserConsent) TableName() string {
+	return "user_consents"
+}
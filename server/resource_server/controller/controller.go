@@ -2,12 +2,16 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -15,6 +19,9 @@ import (
 	"strings"
 	"time"
 
+	"globe-and-citizen/layer8/server/audit"
+	"globe-and-citizen/layer8/server/constants"
+	"globe-and-citizen/layer8/server/loginthrottle"
 	"globe-and-citizen/layer8/server/resource_server/db"
 	"globe-and-citizen/layer8/server/resource_server/dto"
 	"globe-and-citizen/layer8/server/resource_server/interfaces"
@@ -23,6 +30,13 @@ import (
 	"globe-and-citizen/layer8/server/resource_server/utils"
 )
 
+const zkProofJobWaitTimeout = 30 * time.Second
+
+const (
+	defaultAuditEventsLimit = 100
+	maxAuditEventsLimit     = 500
+)
+
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
 	ServeFileHandler(w, r, "assets-v1/templates/public/welcome.html")
 }
@@ -101,8 +115,23 @@ func LoginClientHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	request.DeviceLabel = utils.DeviceLabel(r.UserAgent())
+
+	throttler, _ := r.Context().Value("loginThrottler").(*loginthrottle.Throttler)
+	attempt := loginthrottle.Attempt{
+		Principal:   loginthrottle.PrincipalClient,
+		Username:    request.Username,
+		ProofOfWork: request.ProofOfWork,
+	}
+	if !allowLoginAttempt(w, r, throttler, &attempt) {
+		return
+	}
 
 	serverSignatureResp, err := newService.LoginClient(request)
+	recordLoginAttempt(throttler, attempt, err)
+	if !serverSignatureResp.TwoFactorRequired {
+		auditLogin(r, attempt, err, nil)
+	}
 	if err != nil {
 		utils.HandleError(w, http.StatusBadRequest, "Failed to perform login", err)
 		return
@@ -120,6 +149,117 @@ func LoginClientHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// allowLoginAttempt fills in the source of the attempt and writes a 429
+// response if the throttler does not allow it. A nil throttler allows every
+// attempt.
+func allowLoginAttempt(
+	w http.ResponseWriter, r *http.Request, throttler *loginthrottle.Throttler, attempt *loginthrottle.Attempt,
+) bool {
+	if throttler == nil {
+		return true
+	}
+
+	attempt.Source = throttler.Source(r)
+
+	err := throttler.Check(*attempt)
+	if err == nil {
+		return true
+	}
+
+	var lockedErr *loginthrottle.LockedError
+	var proofOfWorkErr *loginthrottle.ProofOfWorkError
+
+	switch {
+	case errors.As(err, &lockedErr):
+		retryAfter := int(math.Ceil(lockedErr.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		utils.HandleError(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later", err)
+	case errors.As(err, &proofOfWorkErr):
+		w.WriteHeader(http.StatusTooManyRequests)
+		response := utils.BuildErrorResponse("Proof of work required", err.Error(), nil)
+		response.Data = map[string]interface{}{
+			"challenge":  proofOfWorkErr.Challenge,
+			"difficulty": proofOfWorkErr.Difficulty,
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Error sending response: %v", err)
+		}
+	default:
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to check login attempts", err)
+	}
+
+	return false
+}
+
+// recordLoginAttempt counts a failed login or clears the failures after a
+// successful one.
+func recordLoginAttempt(throttler *loginthrottle.Throttler, attempt loginthrottle.Attempt, loginErr error) {
+	if throttler == nil {
+		return
+	}
+
+	var err error
+	if loginErr != nil {
+		err = throttler.Fail(attempt)
+	} else {
+		err = throttler.Succeed(attempt)
+	}
+
+	if err != nil {
+		log.Printf("failed to record login attempt of %s %s: %v", attempt.Principal, attempt.Username, err)
+	}
+}
+
+// auditLogin records a login to the user or client portal to the audit
+// trail. A login that still asks for a second factor is recorded once the
+// code checked out.
+func auditLogin(r *http.Request, attempt loginthrottle.Attempt, loginErr error, details map[string]string) {
+	event := audit.Event{
+		Type:      audit.EventLoginSucceeded,
+		Principal: attempt.Principal,
+		Subject:   attempt.Username,
+		Details:   details,
+	}
+	if loginErr != nil {
+		event.Type = audit.EventLoginFailed
+		event.Details = map[string]string{"reason": loginErr.Error()}
+		for key, value := range details {
+			event.Details[key] = value
+		}
+	}
+
+	recordAuditEvent(r, event)
+}
+
+// recordAuditEvent records the event, from the address of the request, to
+// the audit trail of the request context. Requests without one are not
+// audited, and failing to record an event does not fail the request.
+func recordAuditEvent(r *http.Request, event audit.Event) {
+	auditStore, _ := r.Context().Value("auditStore").(audit.Store)
+	if auditStore == nil {
+		return
+	}
+
+	event.Source = requestSource(r)
+	if err := auditStore.Record(event); err != nil {
+		log.Printf("failed to record %s of %s %s: %v", event.Type, event.Principal, event.Subject, err)
+	}
+}
+
+// requestSource returns the address a request came from, the way the login
+// throttler sees it if there is one.
+func requestSource(r *http.Request) string {
+	if throttler, _ := r.Context().Value("loginThrottler").(*loginthrottle.Throttler); throttler != nil {
+		return throttler.Source(r)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func RegisterClientPrecheckHandler(w http.ResponseWriter, r *http.Request) {
 	if !validateHttpMethod(w, r.Method, http.MethodPost) {
 		return
@@ -202,7 +342,7 @@ func ClientProfileHandler(w http.ResponseWriter, r *http.Request) {
 	newService := r.Context().Value("service").(interfaces.IService)
 	tokenString := r.Header.Get("Authorization")
 	tokenString = tokenString[7:]
-	clientClaims, err := utils.ValidateClientToken(tokenString)
+	clientClaims, err := newService.ValidateClientToken(tokenString)
 	if err != nil {
 		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
 		return
@@ -236,13 +376,13 @@ func RegisterClientHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = newService.RegisterClient(request)
+	registerClientResp, err := newService.RegisterClient(request)
 	if err != nil {
 		utils.HandleError(w, http.StatusBadRequest, "Failed to register client", err)
 		return
 	}
 
-	res := utils.BuildResponseWithNoBody(w, http.StatusCreated, "Client registered successfully")
+	res := utils.BuildResponse(w, http.StatusCreated, "Client registered successfully", registerClientResp)
 	if err := json.NewEncoder(w).Encode(res); err != nil {
 		utils.HandleError(
 			w,
@@ -294,8 +434,23 @@ func LoginUserHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	request.DeviceLabel = utils.DeviceLabel(r.UserAgent())
+
+	throttler, _ := r.Context().Value("loginThrottler").(*loginthrottle.Throttler)
+	attempt := loginthrottle.Attempt{
+		Principal:   loginthrottle.PrincipalUser,
+		Username:    request.Username,
+		ProofOfWork: request.ProofOfWork,
+	}
+	if !allowLoginAttempt(w, r, throttler, &attempt) {
+		return
+	}
 
 	serverSignatureResp, err := newService.LoginUser(request)
+	recordLoginAttempt(throttler, attempt, err)
+	if !serverSignatureResp.TwoFactorRequired {
+		auditLogin(r, attempt, err, nil)
+	}
 	if err != nil {
 		utils.HandleError(w, http.StatusBadRequest, "Failed to perform login", err)
 		return
@@ -313,335 +468,419 @@ func LoginUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func ProfileHandler(w http.ResponseWriter, r *http.Request) {
-	if !validateHttpMethod(w, r.Method, http.MethodGet) {
+// LoginTwoFactorHandler is the second step of a user or client login that
+// answered with two_factor_required. Wrong codes count as failed logins of
+// the principal the two-factor token was issued to.
+func LoginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
 		return
 	}
 
 	newService := r.Context().Value("service").(interfaces.IService)
-	tokenString := r.Header.Get("Authorization")
-	tokenString = tokenString[7:] // Remove the "Bearer " prefix
-	userID, err := utils.ValidateToken(tokenString)
+
+	request, err := utils.DecodeJsonFromRequest[dto.LoginTwoFactorDTO](w, r.Body)
 	if err != nil {
-		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
 		return
 	}
+	request.DeviceLabel = utils.DeviceLabel(r.UserAgent())
 
-	profileResp, err := newService.ProfileUser(userID)
+	claims, err := utils.ParseTwoFactorToken(request.TwoFactorToken)
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "Failed to get user profile", err)
+		utils.HandleError(w, http.StatusUnauthorized, "Failed to perform login", err)
 		return
 	}
 
-	if err := json.NewEncoder(w).Encode(profileResp); err != nil {
-		utils.HandleError(
-			w,
-			http.StatusInternalServerError,
-			"Internal error: could not encode response into json",
-			err,
-		)
+	throttler, _ := r.Context().Value("loginThrottler").(*loginthrottle.Throttler)
+	attempt := loginthrottle.Attempt{
+		Principal:   claims.Principal,
+		Username:    claims.Subject,
+		ProofOfWork: request.ProofOfWork,
 	}
-}
-
-func GetClientData(w http.ResponseWriter, r *http.Request) {
-	if !validateHttpMethod(w, r.Method, http.MethodGet) {
+	if !allowLoginAttempt(w, r, throttler, &attempt) {
 		return
 	}
 
-	newService := r.Context().Value("service").(interfaces.IService)
-	clientName := r.Header.Get("Name")
-
-	clientModel, err := newService.GetClientData(clientName)
+	tokenResp, err := newService.LoginTwoFactor(request)
+	recordLoginAttempt(throttler, attempt, err)
+	auditLogin(r, attempt, err, map[string]string{"two_factor": "true"})
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "Failed to get client profile", err)
+		utils.HandleError(w, http.StatusBadRequest, "Failed to perform login", err)
 		return
 	}
 
-	if err := json.NewEncoder(w).Encode(clientModel); err != nil {
-		utils.HandleError(
-			w,
-			http.StatusInternalServerError,
-			"Internal error: could not encode response into json",
-			err,
-		)
+	response := utils.BuildResponse(w, http.StatusOK, "Login successful", tokenResp)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
 	}
 }
 
-func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+// LoginPasskeyOptionsHandler starts a login with a passkey.
+func LoginPasskeyOptionsHandler(w http.ResponseWriter, r *http.Request) {
 	if !validateHttpMethod(w, r.Method, http.MethodPost) {
 		return
 	}
 
 	newService := r.Context().Value("service").(interfaces.IService)
-	tokenString := r.Header.Get("Authorization")
-	tokenString = tokenString[7:] // Remove the "Bearer " prefix
-	userID, err := utils.ValidateToken(tokenString)
-	if err != nil {
-		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
-		return
-	}
-
-	request, err := utils.DecodeJsonFromRequest[dto.VerifyEmailDTO](w, r.Body)
-	if err != nil {
-		return
-	}
 
-	err = newService.VerifyEmail(userID, request.Email)
+	options, err := newService.StartPasskeyLogin()
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "Failed to verify email", err)
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to start the passkey login", err)
 		return
 	}
 
-	response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Verification email sent")
-	err = json.NewEncoder(w).Encode(response)
-	if err != nil {
-		utils.HandleError(w, http.StatusInternalServerError, "Internal error happened", err)
+	response := utils.BuildResponse(w, http.StatusOK, "Passkey login started", options)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
 	}
 }
 
-func CheckEmailVerificationCode(w http.ResponseWriter, r *http.Request) {
+// LoginPasskeyHandler logs a user in with the assertion of a passkey. It is
+// not throttled like password logins: a signature cannot be guessed, and the
+// challenge it signs is used once.
+func LoginPasskeyHandler(w http.ResponseWriter, r *http.Request) {
 	if !validateHttpMethod(w, r.Method, http.MethodPost) {
 		return
 	}
 
-	service := r.Context().Value("service").(interfaces.IService)
-	tokenString := r.Header.Get("Authorization")
-	tokenString = tokenString[7:] // Remove the "Bearer " prefix
-	userID, err := utils.ValidateToken(tokenString)
-	if err != nil {
-		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
-		return
-	}
+	newService := r.Context().Value("service").(interfaces.IService)
 
-	request, err := utils.DecodeJsonFromRequest[dto.CheckEmailVerificationCodeDTO](w, r.Body)
+	request, err := utils.DecodeJsonFromRequest[dto.LoginPasskeyDTO](w, r.Body)
 	if err != nil {
 		return
 	}
+	request.DeviceLabel = utils.DeviceLabel(r.UserAgent())
 
-	err = service.CheckEmailVerificationCode(userID, request.Code)
+	tokenResp, err := newService.LoginPasskey(request)
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "Failed to verify code", err)
+		utils.HandleError(w, http.StatusUnauthorized, "Failed to perform login", err)
 		return
 	}
 
-	user, err := service.FindUser(userID)
-	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "User with provided id does not exist", err)
-		return
+	// the user is only known once the passkey checked out
+	if claims, err := utils.ParseUserToken(tokenResp.Token); err == nil {
+		attempt := loginthrottle.Attempt{Principal: loginthrottle.PrincipalUser, Username: claims.UserName}
+		auditLogin(r, attempt, nil, map[string]string{"passkey": "true"})
 	}
 
-	zkProof, zkKeyPairId, err := service.GenerateZkProof(user, request.Email, request.Code)
-	if err != nil {
-		utils.HandleError(w, http.StatusInternalServerError, "Failed to generate zk proof of email verification", err)
-		return
+	response := utils.BuildResponse(w, http.StatusOK, "Login successful", tokenResp)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
 	}
+}
 
-	err = service.SaveProofOfEmailVerification(userID, request.Code, zkProof, zkKeyPairId)
-	if err != nil {
-		utils.HandleError(w, http.StatusInternalServerError, "Failed to save proof of the email verification procedure", err)
+// PasskeysHandler lists the passkeys of the logged in user (GET) or removes
+// one of them (DELETE).
+func PasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	user, ok := authenticateUser(w, r)
+	if !ok {
 		return
 	}
 
-	response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Your email was successfully verified!")
+	switch r.Method {
+	case http.MethodGet:
+		passkeys, err := newService.GetPasskeys(user.ID)
+		if err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to get the passkeys", err)
+			return
+		}
 
-	err = json.NewEncoder(w).Encode(response)
-	if err != nil {
-		utils.HandleError(w, http.StatusInternalServerError, "Internal error happened", err)
+		response := utils.BuildResponse(w, http.StatusOK, "Passkeys retrieved successfully", passkeys)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		}
+	case http.MethodDelete:
+		request, err := utils.DecodeJsonFromRequest[dto.DeletePasskeyDTO](w, r.Body)
+		if err != nil {
+			return
+		}
+
+		err = newService.DeletePasskey(user.ID, request.ID)
+		if err != nil {
+			utils.HandleError(w, http.StatusBadRequest, "Failed to delete the passkey", err)
+			return
+		}
+
+		response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Passkey deleted successfully")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		}
+	default:
+		errorMessage := "Invalid http method. Expected GET or DELETE"
+		utils.HandleError(w, http.StatusMethodNotAllowed, errorMessage, fmt.Errorf(errorMessage))
 	}
 }
 
-func UpdateUserMetadataHandler(w http.ResponseWriter, r *http.Request) {
+// PasskeyRegistrationOptionsHandler starts the registration of a new passkey
+// of the logged in user.
+func PasskeyRegistrationOptionsHandler(w http.ResponseWriter, r *http.Request) {
 	if !validateHttpMethod(w, r.Method, http.MethodPost) {
 		return
 	}
 
 	newService := r.Context().Value("service").(interfaces.IService)
-	tokenString := r.Header.Get("Authorization")
-	tokenString = tokenString[7:] // Remove the "Bearer " prefix
-	userID, err := utils.ValidateToken(tokenString)
-	if err != nil {
-		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
-		return
-	}
 
-	request, err := utils.DecodeJsonFromRequest[dto.UpdateUserMetadataDTO](w, r.Body)
-	if err != nil {
+	user, ok := authenticateUser(w, r)
+	if !ok {
 		return
 	}
 
-	err = newService.UpdateUserMetadata(userID, request)
+	options, err := newService.StartPasskeyRegistration(user.ID, user.Username)
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "Failed to update user's metadata", err)
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to start the passkey registration", err)
 		return
 	}
 
-	resp := utils.BuildResponseWithNoBody(w, http.StatusOK, "User's metadata updated successfully")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		utils.HandleError(
-			w,
-			http.StatusInternalServerError,
-			"Internal error: could not encode response into json",
-			err,
-		)
+	response := utils.BuildResponse(w, http.StatusOK, "Passkey registration started", options)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
 	}
 }
 
-func GetUsageStats(w http.ResponseWriter, r *http.Request) {
-	if !validateHttpMethod(w, r.Method, http.MethodGet) {
+// PasskeyRegistrationHandler stores the passkey the authenticator of the
+// logged in user created.
+func PasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
 		return
 	}
 
-	authToken := r.Header.Get("Authorization")
-	if authToken == "" {
-		utils.HandleError(w, http.StatusUnauthorized, "failed to show client usage statistics", errors.New("missing jwt token"))
-		return
-	}
+	newService := r.Context().Value("service").(interfaces.IService)
 
-	authToken = authToken[7:]
-	clientClaims, err := utils.ValidateClientToken(authToken)
-	if err != nil {
-		utils.HandleError(w, http.StatusUnauthorized, "failed to show client usage statistics", errors.New("jwt token invalid"))
+	user, ok := authenticateUser(w, r)
+	if !ok {
 		return
 	}
 
-	statRepo := repository.NewStatRepository(db.GetInfluxDBClient())
-
-	now := time.Now()
-	firstDayOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
-	firstDayOfNextMonth := time.Date(firstDayOfMonth.Year(), firstDayOfMonth.Month()+1, 1, 0, 0, 0, 0, time.UTC)
-	lastDayOfCurrentMonth := firstDayOfNextMonth.Add(-24 * time.Hour)
-	totalDaysInMonth := lastDayOfCurrentMonth.Day()
-	totalDaysBeforeNextMonth := totalDaysInMonth - now.Day()
-
-	thirtyDaysStatistic, err := statRepo.GetTotalRequestsInLastXDaysByClient(r.Context(), 30, clientClaims.ClientID)
+	request, err := utils.DecodeJsonFromRequest[dto.PasskeyRegistrationDTO](w, r.Body)
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "Failed to get last thrthy days usage statistic", err)
 		return
 	}
 
-	monthToDateTotal, err := statRepo.GetTotalByDateRangeByClient(r.Context(), firstDayOfMonth, firstDayOfNextMonth, clientClaims.ClientID)
+	passkey, err := newService.FinishPasskeyRegistration(user.ID, request)
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "Failed to get month to date usage statistic", err)
+		utils.HandleError(w, http.StatusBadRequest, "Failed to register the passkey", err)
 		return
 	}
 
-	finalResponse := models.UsageStatisticResponse{
-		MonthToDate: models.MonthToDateStatistic{
-			Month: firstDayOfMonth.Month().String(),
-		},
-		LastThirtyDaysStatistic: thirtyDaysStatistic,
-		MetricType:              "data_transferred",
-		UnitOfMeasurement:       "GB",
+	response := utils.BuildResponse(w, http.StatusOK, "Passkey registered successfully", passkey)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
 	}
+}
 
-	if monthToDateTotal > 0 {
-		finalResponse.MonthToDate.MonthToDateUsage = monthToDateTotal / 1000000000
-		finalResponse.MonthToDate.ForecastedEndOfMonthUsage = (monthToDateTotal / 1000000000) + float64(totalDaysBeforeNextMonth)*thirtyDaysStatistic.Average
+// UserTwoFactorHandler returns whether the logged in user enabled
+// two-factor authentication (GET), starts the enrollment of an
+// authenticator (POST) or removes it given a code (DELETE).
+func UserTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := authenticateUser(w, r)
+	if !ok {
+		return
 	}
 
-	resp := utils.BuildResponse(w, http.StatusOK, "Client usage statistics", finalResponse)
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		utils.HandleError(
-			w,
-			http.StatusInternalServerError,
-			"Internal error: could not encode response into json",
-			err,
-		)
-	}
+	twoFactorHandler(w, r, models.ScramPrincipalUser, user.Username)
 }
 
-func CheckBackendURI(w http.ResponseWriter, r *http.Request) {
+// UserTwoFactorConfirmHandler enables the authenticator enrolled by the
+// logged in user and returns its recovery codes.
+func UserTwoFactorConfirmHandler(w http.ResponseWriter, r *http.Request) {
 	if !validateHttpMethod(w, r.Method, http.MethodPost) {
 		return
 	}
 
-	newService := r.Context().Value("service").(interfaces.IService)
-
-	request, err := utils.DecodeJsonFromRequest[dto.CheckBackendURIDTO](w, r.Body)
-	if err != nil {
+	user, ok := authenticateUser(w, r)
+	if !ok {
 		return
 	}
 
-	response, err := newService.CheckBackendURI(request.BackendURI)
-	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "Failed to check backend url", err)
+	confirmTwoFactor(w, r, models.ScramPrincipalUser, user.Username)
+}
+
+// ClientTwoFactorHandler is UserTwoFactorHandler for the SP admin account
+// of the logged in client.
+func ClientTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	clientClaims, ok := authenticateClient(w, r)
+	if !ok {
 		return
 	}
 
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		utils.HandleError(
-			w,
-			http.StatusInternalServerError,
-			"Internal error: could not encode response into json",
-			err,
-		)
-	}
+	twoFactorHandler(w, r, models.ScramPrincipalClient, clientClaims.UserName)
 }
 
-func RegisterUserPrecheck(w http.ResponseWriter, r *http.Request) {
+func ClientTwoFactorConfirmHandler(w http.ResponseWriter, r *http.Request) {
 	if !validateHttpMethod(w, r.Method, http.MethodPost) {
 		return
 	}
 
-	newService, ok := r.Context().Value("service").(interfaces.IService)
+	clientClaims, ok := authenticateClient(w, r)
 	if !ok {
-		utils.HandleError(w, http.StatusInternalServerError, "Service not found in context", nil)
 		return
 	}
 
-	iterCount, err := strconv.Atoi(os.Getenv("SCRAM_ITERATION_COUNT"))
-	if err != nil {
-		utils.HandleError(w, http.StatusInternalServerError, "Invalid iteration count configuration", err)
+	confirmTwoFactor(w, r, models.ScramPrincipalClient, clientClaims.UserName)
+}
+
+// ClientRequireUserTwoFactorHandler sets whether users must have enabled
+// two-factor authentication to authorize the logged in client.
+func ClientRequireUserTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
 		return
 	}
 
-	request, err := utils.DecodeJsonFromRequest[dto.RegisterUserPrecheckDTO](w, r.Body)
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	clientClaims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	request, err := utils.DecodeJsonFromRequest[dto.ClientRequireTwoFactorDTO](w, r.Body)
 	if err != nil {
 		return
 	}
 
-	salt, err := newService.RegisterUserPrecheck(request, iterCount)
+	err = newService.SetClientRequireUserTwoFactor(clientClaims.ClientID, request.Required)
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "Failed to register user", err)
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to update the two-factor requirement", err)
 		return
 	}
 
-	registerUserPrecheckResp := models.RegisterUserPrecheckResponseOutput{
-		Salt:           salt,
-		IterationCount: iterCount,
+	response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Two-factor requirement updated successfully")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
 	}
+}
 
-	resp := utils.BuildResponse(w, http.StatusCreated, "User is successfully registered", registerUserPrecheckResp)
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		utils.HandleError(
-			w,
-			http.StatusInternalServerError,
-			"Internal Server Error",
-			err,
-		)
+func twoFactorHandler(w http.ResponseWriter, r *http.Request, principal string, username string) {
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	switch r.Method {
+	case http.MethodGet:
+		status, err := newService.GetTwoFactorStatus(principal, username)
+		if err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to get the two-factor status", err)
+			return
+		}
+
+		response := utils.BuildResponse(w, http.StatusOK, "Two-factor status retrieved successfully", status)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		}
+	case http.MethodPost:
+		enrollment, err := newService.StartTwoFactorEnrollment(principal, username)
+		if err != nil {
+			utils.HandleError(w, http.StatusBadRequest, "Failed to start the two-factor enrollment", err)
+			return
+		}
+
+		response := utils.BuildResponse(w, http.StatusOK, "Two-factor enrollment started", enrollment)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		}
+	case http.MethodDelete:
+		request, err := utils.DecodeJsonFromRequest[dto.TwoFactorCodeDTO](w, r.Body)
+		if err != nil {
+			return
+		}
+
+		err = newService.DisableTwoFactor(principal, username, request.Code)
+		if err != nil {
+			utils.HandleError(w, http.StatusBadRequest, "Failed to disable two-factor authentication", err)
+			return
+		}
+
+		response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Two-factor authentication disabled")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		}
+	default:
+		errorMessage := "Invalid http method. Expected GET, POST or DELETE"
+		utils.HandleError(w, http.StatusMethodNotAllowed, errorMessage, fmt.Errorf(errorMessage))
 	}
 }
 
-func RegisterUserHandler(w http.ResponseWriter, r *http.Request) {
-	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+func confirmTwoFactor(w http.ResponseWriter, r *http.Request, principal string, username string) {
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	request, err := utils.DecodeJsonFromRequest[dto.TwoFactorCodeDTO](w, r.Body)
+	if err != nil {
+		return
+	}
+
+	recoveryCodes, err := newService.ConfirmTwoFactorEnrollment(principal, username, request.Code)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "Failed to confirm the two-factor enrollment", err)
 		return
 	}
 
+	response := utils.BuildResponse(w, http.StatusOK, "Two-factor authentication enabled", recoveryCodes)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
+
+// authenticateUser returns the user of the user portal token of the
+// request, or writes a 401 response.
+func authenticateUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
 	newService := r.Context().Value("service").(interfaces.IService)
 
-	request, err := utils.DecodeJsonFromRequest[dto.RegisterUserDTO](w, r.Body)
+	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	userID, err := newService.ValidateUserToken(tokenString)
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return models.User{}, false
+	}
+
+	user, err := newService.FindUser(userID)
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return models.User{}, false
+	}
+
+	return user, true
+}
+
+// authenticateClient returns the claims of the client portal token of the
+// request, or writes a 401 response.
+func authenticateClient(w http.ResponseWriter, r *http.Request) (*models.ClientClaims, bool) {
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	authToken := r.Header.Get("Authorization")
+	if authToken == "" {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: missing token", errors.New("missing jwt token"))
+		return nil, false
+	}
+
+	clientClaims, err := newService.ValidateClientToken(strings.TrimPrefix(authToken, "Bearer "))
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return nil, false
+	}
+
+	return clientClaims, true
+}
+
+func ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodGet) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+	tokenString := r.Header.Get("Authorization")
+	tokenString = tokenString[7:] // Remove the "Bearer " prefix
+	userID, err := newService.ValidateUserToken(tokenString)
 	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
 		return
 	}
 
-	err = newService.RegisterUser(request)
+	profileResp, err := newService.ProfileUser(userID)
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "Failed to register user", err)
+		utils.HandleError(w, http.StatusBadRequest, "Failed to get user profile", err)
 		return
 	}
 
-	res := utils.BuildResponseWithNoBody(w, http.StatusCreated, "User registered successfully")
-	if err := json.NewEncoder(w).Encode(res); err != nil {
+	if err := json.NewEncoder(w).Encode(profileResp); err != nil {
 		utils.HandleError(
 			w,
 			http.StatusInternalServerError,
@@ -651,145 +890,129 @@ func RegisterUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func ResetPasswordPrecheckHandler(w http.ResponseWriter, r *http.Request) {
-	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+func GetClientData(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodGet) {
 		return
 	}
 
 	newService := r.Context().Value("service").(interfaces.IService)
+	clientName := r.Header.Get("Name")
 
-	request, err := utils.DecodeJsonFromRequest[dto.ResetPasswordPrecheckDTO](w, r.Body)
-	if err != nil {
-		return
-	}
-
-	user, err := newService.GetUserForUsername(request.Username)
+	clientModel, err := newService.GetClientData(clientName)
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "User does not exist!", err)
+		utils.HandleError(w, http.StatusBadRequest, "Failed to get client profile", err)
 		return
 	}
 
-	resetPasswordPrecheckResp := models.ResetPasswordPrecheckResponseOutput{
-		Salt:           user.Salt,
-		IterationCount: user.IterationCount,
-	}
-
-	response := utils.BuildResponse(w, http.StatusOK, "User does exist!", resetPasswordPrecheckResp)
-	if err := json.NewEncoder(w).Encode(response); err != nil {
+	if err := json.NewEncoder(w).Encode(clientModel); err != nil {
 		utils.HandleError(
 			w,
 			http.StatusInternalServerError,
-			"Internal Server Error",
+			"Internal error: could not encode response into json",
 			err,
 		)
 	}
 }
 
-func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
 	if !validateHttpMethod(w, r.Method, http.MethodPost) {
 		return
 	}
 
 	newService := r.Context().Value("service").(interfaces.IService)
-
-	request, err := utils.DecodeJsonFromRequest[dto.ResetPasswordDTO](w, r.Body)
+	tokenString := r.Header.Get("Authorization")
+	tokenString = tokenString[7:] // Remove the "Bearer " prefix
+	userID, err := newService.ValidateUserToken(tokenString)
 	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
 		return
 	}
 
-	user, err := newService.GetUserForUsername(request.Username)
+	request, err := utils.DecodeJsonFromRequest[dto.VerifyEmailDTO](w, r.Body)
 	if err != nil {
-		utils.HandleError(w, http.StatusNotFound, "User does not exist!", err)
 		return
 	}
 
-	err = newService.ValidateSignature("Sign-in with Layer8", request.Signature, user.PublicKey)
+	err = newService.VerifyEmail(userID, request.Email)
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "Signature is invalid!", err)
+		utils.HandleError(w, http.StatusBadRequest, "Failed to verify email", err)
 		return
 	}
 
-	err = newService.UpdateUserPassword(user.Username, request.StoredKey, request.ServerKey)
+	response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Verification email sent")
+	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		utils.HandleError(w, http.StatusInternalServerError, "Internal error: failed to update user", err)
-		return
-	}
-
-	response := utils.BuildResponseWithNoBody(
-		w, http.StatusCreated, "Your password was updated successfully!",
-	)
-	if err := json.NewEncoder(w).Encode(&response); err != nil {
-		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		utils.HandleError(w, http.StatusInternalServerError, "Internal error happened", err)
 	}
 }
 
-func ClientUnpaidAmountHandler(w http.ResponseWriter, r *http.Request) {
+func CheckEmailVerificationCode(w http.ResponseWriter, r *http.Request) {
 	if !validateHttpMethod(w, r.Method, http.MethodPost) {
 		return
 	}
 
-	newService := r.Context().Value("service").(interfaces.IService)
+	service := r.Context().Value("service").(interfaces.IService)
+	tokenString := r.Header.Get("Authorization")
+	tokenString = tokenString[7:] // Remove the "Bearer " prefix
+	userID, err := service.ValidateUserToken(tokenString)
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return
+	}
 
-	request, err := utils.DecodeJsonFromRequest[dto.ClientUnpaidAmountDTO](w, r.Body)
+	request, err := utils.DecodeJsonFromRequest[dto.CheckEmailVerificationCodeDTO](w, r.Body)
 	if err != nil {
 		return
 	}
 
-	unpaidAmount, err := newService.GetClientUnpaidAmount(request.ClientId)
+	err = service.CheckEmailVerificationCode(userID, request.Code)
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "Failed to get client's unpaid amount", err)
+		utils.HandleError(w, http.StatusBadRequest, "Failed to verify code", err)
 		return
 	}
 
-	clientUnpaidAmountResponseOutput := models.ClientUnpaidAmountResponseOutput{
-		UnpaidAmount: unpaidAmount,
+	// the email counts as verified once the proof is generated and saved
+	job, err := service.EnqueueZkProofJob(userID, models.ZkProofJobEmail, request.Email, request.Code)
+	if err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to queue the zk proof of email verification", err)
+		return
 	}
 
-	response := utils.BuildResponse(
-		w,
-		http.StatusOK,
-		"successfully retrieved client's unpaid amount",
-		clientUnpaidAmountResponseOutput,
-	)
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	response := utils.BuildResponse(w, http.StatusAccepted, "The code is correct, the proof of your email is being generated", job)
+
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Internal error happened", err)
 	}
 }
 
-func GenerateTelegramSessionIDHandler(w http.ResponseWriter, r *http.Request) {
+func UpdateUserMetadataHandler(w http.ResponseWriter, r *http.Request) {
 	if !validateHttpMethod(w, r.Method, http.MethodPost) {
 		return
 	}
 
 	newService := r.Context().Value("service").(interfaces.IService)
-
 	tokenString := r.Header.Get("Authorization")
 	tokenString = tokenString[7:] // Remove the "Bearer " prefix
-	userID, err := utils.ValidateToken(tokenString)
+	userID, err := newService.ValidateUserToken(tokenString)
 	if err != nil {
 		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
 		return
 	}
 
-	sessionID, err := newService.GenerateTelegramSessionID()
+	request, err := utils.DecodeJsonFromRequest[dto.UpdateUserMetadataDTO](w, r.Body)
 	if err != nil {
-		utils.HandleError(w, http.StatusInternalServerError, "failed to generate session id", err)
 		return
 	}
 
-	err = newService.SaveTelegramSessionID(userID, sessionID)
+	err = newService.UpdateUserMetadata(userID, request)
 	if err != nil {
-		utils.HandleError(w, http.StatusInternalServerError, "failed to save the Telegram session id", err)
+		utils.HandleError(w, http.StatusBadRequest, "Failed to update user's metadata", err)
 		return
 	}
 
-	sessionIdDTO := dto.TelegramSessionIdDTO{
-		SessionID: base64.RawURLEncoding.EncodeToString(sessionID),
-	}
-
-	response := utils.BuildResponse(w, http.StatusOK, "session id generated", sessionIdDTO)
-
-	if err := json.NewEncoder(w).Encode(response); err != nil {
+	resp := utils.BuildResponseWithNoBody(w, http.StatusOK, "User's metadata updated successfully")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		utils.HandleError(
 			w,
 			http.StatusInternalServerError,
@@ -799,251 +1022,1441 @@ func GenerateTelegramSessionIDHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func VerifyPhoneNumberViaTelegramBotHandler(w http.ResponseWriter, r *http.Request) {
+func GetUsageStats(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodGet) {
+		return
+	}
+
 	newService := r.Context().Value("service").(interfaces.IService)
 
-	tokenString := r.Header.Get("Authorization")
-	tokenString = tokenString[7:] // Remove the "Bearer " prefix
-	userID, err := utils.ValidateToken(tokenString)
+	authToken := r.Header.Get("Authorization")
+	if authToken == "" {
+		utils.HandleError(w, http.StatusUnauthorized, "failed to show client usage statistics", errors.New("missing jwt token"))
+		return
+	}
+
+	authToken = authToken[7:]
+	clientClaims, err := newService.ValidateClientTokenWithScope(authToken, constants.ClientReadUsageStatsScope)
 	if err != nil {
-		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		utils.HandleError(w, http.StatusUnauthorized, "failed to show client usage statistics", errors.New("jwt token invalid"))
 		return
 	}
 
-	user, err := newService.FindUser(userID)
+	statRepo := repository.NewStatRepository(db.GetInfluxDBClient())
+
+	now := time.Now()
+	firstDayOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	firstDayOfNextMonth := time.Date(firstDayOfMonth.Year(), firstDayOfMonth.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	lastDayOfCurrentMonth := firstDayOfNextMonth.Add(-24 * time.Hour)
+	totalDaysInMonth := lastDayOfCurrentMonth.Day()
+	totalDaysBeforeNextMonth := totalDaysInMonth - now.Day()
+
+	thirtyDaysStatistic, err := statRepo.GetTotalRequestsInLastXDaysByClient(r.Context(), 30, clientClaims.ClientID)
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "User not found for ID", err)
+		utils.HandleError(w, http.StatusBadRequest, "Failed to get last thrthy days usage statistic", err)
+		return
 	}
 
-	telegramAPIToken := os.Getenv("TELEGRAM_API_KEY")
-	if telegramAPIToken == "" {
-		log.Fatal("No Telegram API token provided")
+	monthToDateTotal, err := statRepo.GetTotalByDateRangeByClient(r.Context(), firstDayOfMonth, firstDayOfNextMonth, clientClaims.ClientID)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "Failed to get month to date usage statistic", err)
+		return
 	}
 
-	baseURL := fmt.Sprintf(
-		"https://api.telegram.org/bot%s",
-		url.PathEscape(telegramAPIToken),
-	)
+	finalResponse := models.UsageStatisticResponse{
+		MonthToDate: models.MonthToDateStatistic{
+			Month: firstDayOfMonth.Month().String(),
+		},
+		LastThirtyDaysStatistic: thirtyDaysStatistic,
+		MetricType:              "data_transferred",
+		UnitOfMeasurement:       "GB",
+	}
 
-	var offset int64 = 0
-	var telegramUserID int64 = 0
+	if monthToDateTotal > 0 {
+		finalResponse.MonthToDate.MonthToDateUsage = monthToDateTotal / 1000000000
+		finalResponse.MonthToDate.ForecastedEndOfMonthUsage = (monthToDateTotal / 1000000000) + float64(totalDaysBeforeNextMonth)*thirtyDaysStatistic.Average
+	}
 
-	for i := 0; i < 500; i++ {
-		if i > 0 {
-			time.Sleep(500 * time.Millisecond)
-		}
+	resp := utils.BuildResponse(w, http.StatusOK, "Client usage statistics", finalResponse)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		utils.HandleError(
+			w,
+			http.StatusInternalServerError,
+			"Internal error: could not encode response into json",
+			err,
+		)
+	}
+}
 
-		updates, err := newService.RefreshTelegramMessages(baseURL, offset)
-		if err != nil {
-			log.Printf("failed to refresh messages from Telegram: %v\n", err)
-			time.Sleep(2 * time.Second)
-			continue
-		}
+func CheckBackendURI(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
 
-		foundStartMessage := false
+	newService := r.Context().Value("service").(interfaces.IService)
 
-		for _, u := range updates {
-			offset = u.UpdateID + 1
+	request, err := utils.DecodeJsonFromRequest[dto.CheckBackendURIDTO](w, r.Body)
+	if err != nil {
+		return
+	}
+
+	response, err := newService.CheckBackendURI(request.BackendURI)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "Failed to check backend url", err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(
+			w,
+			http.StatusInternalServerError,
+			"Internal error: could not encode response into json",
+			err,
+		)
+	}
+}
+
+func RegisterUserPrecheck(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
+
+	newService, ok := r.Context().Value("service").(interfaces.IService)
+	if !ok {
+		utils.HandleError(w, http.StatusInternalServerError, "Service not found in context", nil)
+		return
+	}
+
+	iterCount, err := strconv.Atoi(os.Getenv("SCRAM_ITERATION_COUNT"))
+	if err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Invalid iteration count configuration", err)
+		return
+	}
+
+	request, err := utils.DecodeJsonFromRequest[dto.RegisterUserPrecheckDTO](w, r.Body)
+	if err != nil {
+		return
+	}
+
+	salt, err := newService.RegisterUserPrecheck(request, iterCount)
+	if errors.Is(err, constants.ErrUsernameUnavailable) {
+		utils.HandleError(w, http.StatusConflict, "Username is not available", err)
+		return
+	}
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "Failed to register user", err)
+		return
+	}
+
+	registerUserPrecheckResp := models.RegisterUserPrecheckResponseOutput{
+		Salt:           salt,
+		IterationCount: iterCount,
+	}
+
+	resp := utils.BuildResponse(w, http.StatusCreated, "User is successfully registered", registerUserPrecheckResp)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		utils.HandleError(
+			w,
+			http.StatusInternalServerError,
+			"Internal Server Error",
+			err,
+		)
+	}
+}
+
+func RegisterUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	request, err := utils.DecodeJsonFromRequest[dto.RegisterUserDTO](w, r.Body)
+	if err != nil {
+		return
+	}
+
+	err = newService.RegisterUser(request)
+	if errors.Is(err, constants.ErrUsernameUnavailable) {
+		utils.HandleError(w, http.StatusConflict, "Username is not available", err)
+		return
+	}
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "Failed to register user", err)
+		return
+	}
+
+	res := utils.BuildResponseWithNoBody(w, http.StatusCreated, "User registered successfully")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		utils.HandleError(
+			w,
+			http.StatusInternalServerError,
+			"Internal error: could not encode response into json",
+			err,
+		)
+	}
+}
+
+func ResetPasswordPrecheckHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	request, err := utils.DecodeJsonFromRequest[dto.ResetPasswordPrecheckDTO](w, r.Body)
+	if err != nil {
+		return
+	}
+
+	resetPasswordPrecheckResp, err := newService.ResetPasswordPrecheck(request)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "Failed to perform precheck, service error", err)
+		return
+	}
+
+	response := utils.BuildResponse(w, http.StatusOK, "Precheck successful", resetPasswordPrecheckResp)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(
+			w,
+			http.StatusInternalServerError,
+			"Internal Server Error",
+			err,
+		)
+	}
+}
+
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	request, err := utils.DecodeJsonFromRequest[dto.ResetPasswordDTO](w, r.Body)
+	if err != nil {
+		return
+	}
+
+	err = newService.ResetPassword(request)
+	if errors.Is(err, constants.ErrInvalidPasswordResetChallenge) ||
+		errors.Is(err, constants.ErrInvalidPasswordResetSignature) {
+		utils.HandleError(w, http.StatusBadRequest, "Signature is invalid!", err)
+		return
+	}
+	if err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Internal error: failed to update user", err)
+		return
+	}
+
+	recordAuditEvent(r, audit.Event{
+		Type:      audit.EventPasswordReset,
+		Principal: models.ScramPrincipalUser,
+		Subject:   request.Username,
+	})
+
+	response := utils.BuildResponseWithNoBody(
+		w, http.StatusCreated, "Your password was updated successfully!",
+	)
+	if err := json.NewEncoder(w).Encode(&response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
+
+func ClientUnpaidAmountHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	// a client authenticated by a token asks for its own unpaid amount,
+	// callers without a token still name the client in the body
+	var clientID string
+	if authToken := r.Header.Get("Authorization"); authToken != "" {
+		clientClaims, err := newService.ValidateClientTokenWithScope(
+			strings.TrimPrefix(authToken, "Bearer "), constants.ClientReadUnpaidAmountScope,
+		)
+		if err != nil {
+			utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+			return
+		}
+		clientID = clientClaims.ClientID
+	} else {
+		request, err := utils.DecodeJsonFromRequest[dto.ClientUnpaidAmountDTO](w, r.Body)
+		if err != nil {
+			return
+		}
+		clientID = request.ClientId
+	}
+
+	unpaidAmount, err := newService.GetClientUnpaidAmount(clientID)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "Failed to get client's unpaid amount", err)
+		return
+	}
+
+	clientUnpaidAmountResponseOutput := models.ClientUnpaidAmountResponseOutput{
+		UnpaidAmount: unpaidAmount,
+	}
+
+	response := utils.BuildResponse(
+		w,
+		http.StatusOK,
+		"successfully retrieved client's unpaid amount",
+		clientUnpaidAmountResponseOutput,
+	)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
+
+func GenerateTelegramSessionIDHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	tokenString := r.Header.Get("Authorization")
+	tokenString = tokenString[7:] // Remove the "Bearer " prefix
+	userID, err := newService.ValidateUserToken(tokenString)
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return
+	}
+
+	sessionID, err := newService.GenerateTelegramSessionID()
+	if err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "failed to generate session id", err)
+		return
+	}
+
+	err = newService.SaveTelegramSessionID(userID, sessionID)
+	if err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "failed to save the Telegram session id", err)
+		return
+	}
+
+	sessionIdDTO := dto.TelegramSessionIdDTO{
+		SessionID: base64.RawURLEncoding.EncodeToString(sessionID),
+	}
+
+	response := utils.BuildResponse(w, http.StatusOK, "session id generated", sessionIdDTO)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(
+			w,
+			http.StatusInternalServerError,
+			"Internal error: could not encode response into json",
+			err,
+		)
+	}
+}
+
+func VerifyPhoneNumberViaTelegramBotHandler(w http.ResponseWriter, r *http.Request) {
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	tokenString := r.Header.Get("Authorization")
+	tokenString = tokenString[7:] // Remove the "Bearer " prefix
+	userID, err := newService.ValidateUserToken(tokenString)
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return
+	}
+
+	user, err := newService.FindUser(userID)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "User not found for ID", err)
+	}
+
+	telegramAPIToken := os.Getenv("TELEGRAM_API_KEY")
+	if telegramAPIToken == "" {
+		log.Fatal("No Telegram API token provided")
+	}
+
+	baseURL := fmt.Sprintf(
+		"https://api.telegram.org/bot%s",
+		url.PathEscape(telegramAPIToken),
+	)
+
+	var offset int64 = 0
+	var telegramUserID int64 = 0
+
+	for i := 0; i < 500; i++ {
+		if i > 0 {
+			time.Sleep(500 * time.Millisecond)
+		}
+
+		updates, err := newService.RefreshTelegramMessages(baseURL, offset)
+		if err != nil {
+			log.Printf("failed to refresh messages from Telegram: %v\n", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		foundStartMessage := false
+
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+
+			if u.Message == nil || u.Message.Chat.Type != "private" {
+				continue
+			}
+
+			msg := u.Message
+
+			if !strings.HasPrefix(msg.Text, "/start ") {
+				continue
+			}
+
+			sessionID := msg.Text[7:]
+			if sessionID == "" {
+				continue
+			}
+
+			sessionIDBytes, err := base64.RawURLEncoding.DecodeString(sessionID)
+			if err != nil {
+				log.Printf("failed to decode session id %s, skipping\n", sessionID)
+				continue
+			}
+
+			sessionIDHash := sha256.Sum256(sessionIDBytes)
+
+			if bytes.Equal(user.TelegramSessionIDHash, sessionIDHash[:]) {
+				log.Printf("Found matching session id\n")
+
+				// Send a reply keyboard that *requests contact*.
+				kb := dto.ReplyKeyboardMarkup{
+					Keyboard: [][]dto.KeyboardButton{
+						{
+							{Text: "Share my phone", RequestContact: true},
+						},
+					},
+					ResizeKeyboard:  true,
+					OneTimeKeyboard: true,
+				}
+				text := "Hi! In order for us to verify your phone number, please tap the button below to allow Telegram sharing your phone number with us."
+
+				err := newService.SendTelegramBotMessage(baseURL, dto.SendMessageRequestDTO{
+					ChatID:      msg.Chat.ID,
+					Text:        text,
+					ParseMode:   "Markdown",
+					ReplyMarkup: kb,
+				})
+				if err != nil {
+					log.Printf("sendMessage error: %v", err)
+				}
+
+				foundStartMessage = true
+				telegramUserID = msg.From.ID
+				break
+			}
+		}
+
+		if foundStartMessage {
+			break
+		}
+	}
+
+	for i := 0; i < 500; i++ {
+		if i > 0 {
+			time.Sleep(400 * time.Millisecond)
+		}
+
+		updates, err := newService.RefreshTelegramMessages(baseURL, offset)
+		if err != nil {
+			log.Printf("failed to refresh messages from Telegram: %v\n", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+
+			if u.Message == nil || u.Message.Chat.Type != "private" {
+				continue
+			}
+
+			msg := u.Message
+
+			if msg.Contact == nil {
+				continue
+			}
+
+			// Validate the contact belongs to the sender.
+			if msg.From == nil || msg.Contact.UserID != msg.From.ID || msg.From.ID != telegramUserID {
+				continue
+			}
+
+			phoneNumber := strings.TrimSpace(msg.Contact.PhoneNumber)
+
+			verificationCode, err := newService.GeneratePhoneNumberVerificationCode(&user, phoneNumber)
+			if err != nil {
+				utils.HandleError(w, http.StatusInternalServerError, "failed to generate the verification code", err)
+				return
+			}
+
+			// Remove keyboard after success.
+			err = newService.SendTelegramBotMessage(baseURL, dto.SendMessageRequestDTO{
+				ChatID: msg.Chat.ID,
+				Text: fmt.Sprintf(
+					"Thanks! Your verification code is: %s. You can go back to the Layer8 user portal now.",
+					verificationCode,
+				),
+				ReplyMarkup: dto.ReplyKeyboardRemove{
+					RemoveKeyboard: true,
+				},
+			})
+			if err != nil {
+				utils.HandleError(w, http.StatusInternalServerError, "failed to send message from the Telegram bot", err)
+				log.Printf("failed to send message from the Telegram bot: %v", err)
+				return
+			}
+
+			// the verification data is saved by the worker once the proof is generated
+			job, err := newService.EnqueueZkProofJob(user.ID, models.ZkProofJobPhoneNumber, phoneNumber, verificationCode)
+			if err != nil {
+				utils.HandleError(w, http.StatusInternalServerError, "failed to queue the zk proof of phone number verification", err)
+				return
+			}
+
+			log.Println("Phone number received, proof of its verification is queued, exiting")
+
+			apiResponse := utils.BuildResponse(w, http.StatusAccepted, "phone number is received, its proof is being generated", job)
+
+			if err := json.NewEncoder(w).Encode(apiResponse); err != nil {
+				utils.HandleError(
+					w,
+					http.StatusInternalServerError,
+					"Internal error: could not encode response into json",
+					err,
+				)
+			}
+			return
+		}
+	}
+}
+
+func CheckPhoneNumberVerificationCode(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	tokenString := r.Header.Get("Authorization")
+	tokenString = tokenString[7:] // Remove the "Bearer " prefix
+	userID, err := newService.ValidateUserToken(tokenString)
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return
+	}
+
+	request, err := utils.DecodeJsonFromRequest[dto.CheckPhoneNumberVerificationCodeDTO](w, r.Body)
+	if err != nil {
+		return
+	}
+
+	verificationData, err := newService.GetPhoneNumberVerificationData(userID)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "user's verification data not found", err)
+		return
+	}
+
+	err = newService.CheckPhoneNumberVerificationCode(request.VerificationCode, verificationData)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "failed to validate the provided verification code", err)
+		return
+	}
+
+	err = newService.SaveProofOfPhoneNumberVerification(verificationData)
+	if err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "failed to update phone number verification metadata in the db", err)
+		return
+	}
+
+	response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Your phone number is verified successfully! Congratulations!")
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "failed to encode response into json", err)
+	}
+}
+
+func ConnectedAppsHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodGet) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+	tokenString := r.Header.Get("Authorization")
+	tokenString = tokenString[7:] // Remove the "Bearer " prefix
+	userID, err := newService.ValidateUserToken(tokenString)
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return
+	}
+
+	connectedApps, err := newService.GetConnectedApps(userID)
+	if err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to get connected apps", err)
+		return
+	}
+
+	response := utils.BuildResponse(w, http.StatusOK, "Connected apps retrieved successfully", connectedApps)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
+
+func RevokeConnectedAppHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	user, ok := authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	request, err := utils.DecodeJsonFromRequest[dto.RevokeConnectedAppDTO](w, r.Body)
+	if err != nil {
+		return
+	}
+
+	err = newService.RevokeConnectedApp(user.ID, request.ClientID)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "Failed to revoke the app's access", err)
+		return
+	}
+
+	recordAuditEvent(r, audit.Event{
+		Type:      audit.EventConsentRevoked,
+		Principal: models.ScramPrincipalUser,
+		Subject:   user.Username,
+		ClientID:  request.ClientID,
+	})
+
+	response := utils.BuildResponseWithNoBody(w, http.StatusOK, "The app's access was revoked")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
+
+// SessionsHandler lists the sessions of the logged in user (GET) or revokes
+// one or all of them (DELETE). The sessions of the apps the user connected
+// are listed too.
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	user, ok := authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	switch r.Method {
+	case http.MethodGet:
+		sessions, err := newService.GetUserSessions(user.ID, tokenString)
+		if err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to get the sessions", err)
+			return
+		}
+
+		response := utils.BuildResponse(w, http.StatusOK, "Sessions retrieved successfully", sessions)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		}
+	case http.MethodDelete:
+		request, err := utils.DecodeJsonFromRequest[dto.RevokeSessionDTO](w, r.Body)
+		if err != nil {
+			return
+		}
+
+		err = newService.RevokeUserSessions(user.ID, revokedSessionID(request))
+		if err != nil {
+			utils.HandleError(w, http.StatusBadRequest, "Failed to revoke the session", err)
+			return
+		}
+
+		response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Session revoked successfully")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		}
+	default:
+		errorMessage := "Invalid http method. Expected GET or DELETE"
+		utils.HandleError(w, http.StatusMethodNotAllowed, errorMessage, fmt.Errorf(errorMessage))
+	}
+}
+
+// ClientSessionsHandler is SessionsHandler for the client portal.
+func ClientSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	clientClaims, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	switch r.Method {
+	case http.MethodGet:
+		sessions, err := newService.GetClientSessions(clientClaims.ClientID, tokenString)
+		if err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to get the sessions", err)
+			return
+		}
+
+		response := utils.BuildResponse(w, http.StatusOK, "Sessions retrieved successfully", sessions)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		}
+	case http.MethodDelete:
+		request, err := utils.DecodeJsonFromRequest[dto.RevokeSessionDTO](w, r.Body)
+		if err != nil {
+			return
+		}
+
+		err = newService.RevokeClientSessions(clientClaims.ClientID, revokedSessionID(request))
+		if err != nil {
+			utils.HandleError(w, http.StatusBadRequest, "Failed to revoke the session", err)
+			return
+		}
+
+		response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Session revoked successfully")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		}
+	default:
+		errorMessage := "Invalid http method. Expected GET or DELETE"
+		utils.HandleError(w, http.StatusMethodNotAllowed, errorMessage, fmt.Errorf(errorMessage))
+	}
+}
+
+// revokedSessionID returns the id the service revokes: 0 stands for all
+// sessions.
+func revokedSessionID(request dto.RevokeSessionDTO) uint {
+	if request.All {
+		return 0
+	}
+	return request.ID
+}
+
+// LogoutHandler ends the session of the user or client portal token of the
+// request. An expired token can still be logged out.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if tokenString == "" {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: missing token", errors.New("missing jwt token"))
+		return
+	}
+
+	err := newService.Logout(tokenString)
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Failed to log out", err)
+		return
+	}
+
+	response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Logged out successfully")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
+
+// AuditEventsHandler lists the audit trail of the logged in user: its
+// logins and password resets, and the apps it granted access, that were
+// issued tokens for it and that read its metadata. The events can be
+// narrowed with the type, since, until and limit query parameters.
+func AuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodGet) {
+		return
+	}
+
+	user, ok := authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	filter := audit.Filter{
+		Principal: models.ScramPrincipalUser,
+		Subject:   user.Username,
+	}
+	writeAuditEvents(w, r, filter, false)
+}
+
+// ClientAuditEventsHandler is AuditEventsHandler for a client, from the
+// client portal or its backend. It lists the events of the client's account
+// and the events of users that involve the client.
+func ClientAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodGet) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	clientClaims, err := newService.ValidateClientTokenWithScope(tokenString, constants.ClientReadAuditEventsScope)
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return
+	}
+
+	filter := audit.Filter{
+		Principal: models.ScramPrincipalClient,
+		Subject:   clientClaims.UserName,
+		ClientID:  clientClaims.ClientID,
+	}
+	writeAuditEvents(w, r, filter, true)
+}
+
+// writeAuditEvents writes the events of the filter, narrowed by the query
+// parameters of the request.
+func writeAuditEvents(w http.ResponseWriter, r *http.Request, filter audit.Filter, forClient bool) {
+	auditStore, _ := r.Context().Value("auditStore").(audit.Store)
+	if auditStore == nil {
+		errorMessage := "The audit trail is not available"
+		utils.HandleError(w, http.StatusServiceUnavailable, errorMessage, fmt.Errorf(errorMessage))
+		return
+	}
+
+	filter, err := auditQuery(r.URL.Query(), filter)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "Invalid audit event query", err)
+		return
+	}
+
+	events, err := auditStore.Events(filter)
+	if err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to get the audit events", err)
+		return
+	}
+
+	output := make([]models.AuditEventResponseOutput, 0, len(events))
+	for _, event := range events {
+		eventOutput := models.AuditEventResponseOutput{
+			Type:      event.Type,
+			Principal: event.Principal,
+			Subject:   event.Subject,
+			ClientID:  event.ClientID,
+			Source:    event.Source,
+			Details:   event.Details,
+			CreatedAt: event.CreatedAt,
+		}
+		if forClient && event.Principal != models.ScramPrincipalClient {
+			eventOutput.Subject = ""
+			eventOutput.Source = ""
+		}
+		output = append(output, eventOutput)
+	}
+
+	response := utils.BuildResponse(w, http.StatusOK, "Audit events retrieved successfully", output)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
+
+// auditQuery narrows the filter with the type (comma separated), since and
+// until (RFC 3339) and limit query parameters.
+func auditQuery(query url.Values, filter audit.Filter) (audit.Filter, error) {
+	if types := query.Get("type"); types != "" {
+		filter.Types = strings.Split(types, ",")
+	}
+
+	for name, bound := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s: %q", name, value)
+			}
+			*bound = parsed.UTC()
+		}
+	}
+
+	filter.Limit = defaultAuditEventsLimit
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditEventsLimit {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxAuditEventsLimit)
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+// DataAccessHandler lists the data access timeline of the logged in user:
+// which apps read which of its metadata fields, and when. It can be narrowed
+// with the client_id, since and until query parameters.
+func DataAccessHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodGet) {
+		return
+	}
+
+	timeline, ok := dataAccessTimeline(w, r)
+	if !ok {
+		return
+	}
+
+	response := utils.BuildResponse(w, http.StatusOK, "Data access timeline retrieved successfully", timeline)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
+
+// DataAccessExportHandler downloads the data access timeline of the logged
+// in user as a JSON or, with format=csv, a CSV file. It takes the query
+// parameters of DataAccessHandler.
+func DataAccessExportHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodGet) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		utils.HandleError(w, http.StatusBadRequest, "Invalid export format", fmt.Errorf("unsupported format %q", format))
+		return
+	}
+
+	timeline, ok := dataAccessTimeline(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="data-access.%s"`, format))
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(timeline); err != nil {
+			log.Printf("failed to write the data access export: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	writer := csv.NewWriter(w)
+	rows := [][]string{{"accessed_at", "client_id", "client_name", "scopes", "fields"}}
+	for _, entry := range timeline {
+		rows = append(rows, []string{
+			entry.AccessedAt.Format(time.RFC3339),
+			entry.ClientID,
+			entry.ClientName,
+			strings.Join(entry.Scopes, " "),
+			strings.Join(entry.Fields, " "),
+		})
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		log.Printf("failed to write the data access export: %v", err)
+	}
+}
+
+// dataAccessTimeline returns the timeline of the user of the request, or
+// writes an error response.
+func dataAccessTimeline(w http.ResponseWriter, r *http.Request) ([]models.DataAccessResponseOutput, bool) {
+	user, ok := authenticateUser(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	query := r.URL.Query()
+
+	var since, until time.Time
+	for name, bound := range map[string]*time.Time{"since": &since, "until": &until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				utils.HandleError(w, http.StatusBadRequest, "Invalid data access query", fmt.Errorf("invalid %s: %q", name, value))
+				return nil, false
+			}
+			*bound = parsed.UTC()
+		}
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	timeline, err := newService.GetDataAccessTimeline(user.ID, query.Get("client_id"), since, until)
+	if err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to get the data access timeline", err)
+		return nil, false
+	}
+
+	return timeline, true
+}
+
+// DataAccessDigestHandler shows (GET), subscribes to (PUT) and unsubscribes
+// from (DELETE) the email digest of the data access timeline of the logged
+// in user.
+func DataAccessDigestHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	switch r.Method {
+	case http.MethodGet:
+		digest, err := newService.GetDataAccessDigest(user.ID)
+		if err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to get the data access digest", err)
+			return
+		}
+
+		response := utils.BuildResponse(w, http.StatusOK, "Data access digest retrieved successfully", digest)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		}
+	case http.MethodPut:
+		request, err := utils.DecodeJsonFromRequest[dto.DataAccessDigestDTO](w, r.Body)
+		if err != nil {
+			return
+		}
+
+		err = newService.SubscribeDataAccessDigest(user.ID, request.Email)
+		if err != nil {
+			utils.HandleError(w, http.StatusBadRequest, "Failed to subscribe to the data access digest", err)
+			return
+		}
+
+		response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Subscribed to the data access digest successfully")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		}
+	case http.MethodDelete:
+		err := newService.UnsubscribeDataAccessDigest(user.ID)
+		if err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to unsubscribe from the data access digest", err)
+			return
+		}
+
+		response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Unsubscribed from the data access digest successfully")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		}
+	default:
+		errorMessage := "Invalid http method. Expected GET, PUT or DELETE"
+		utils.HandleError(w, http.StatusMethodNotAllowed, errorMessage, fmt.Errorf(errorMessage))
+	}
+}
+
+func ClientRedirectURIsHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodGet) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	authToken := r.Header.Get("Authorization")
+	if authToken == "" {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: missing token", errors.New("missing jwt token"))
+		return
+	}
+
+	clientClaims, err := newService.ValidateClientToken(authToken[7:])
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return
+	}
+
+	redirectURIs, err := newService.GetClientRedirectURIs(clientClaims.ClientID)
+	if err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to get the client's redirect uris", err)
+		return
+	}
+
+	response := utils.BuildResponse(w, http.StatusOK, "Redirect uris retrieved successfully", redirectURIs)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
+
+func AddClientRedirectURIHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	authToken := r.Header.Get("Authorization")
+	if authToken == "" {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: missing token", errors.New("missing jwt token"))
+		return
+	}
+
+	clientClaims, err := newService.ValidateClientToken(authToken[7:])
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return
+	}
+
+	request, err := utils.DecodeJsonFromRequest[dto.ClientRedirectURIDTO](w, r.Body)
+	if err != nil {
+		return
+	}
+
+	err = newService.AddClientRedirectURI(clientClaims.ClientID, request.RedirectURI)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "Failed to add the redirect uri", err)
+		return
+	}
+
+	response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Redirect uri added successfully")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
+
+func RemoveClientRedirectURIHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	authToken := r.Header.Get("Authorization")
+	if authToken == "" {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: missing token", errors.New("missing jwt token"))
+		return
+	}
+
+	clientClaims, err := newService.ValidateClientToken(authToken[7:])
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return
+	}
+
+	request, err := utils.DecodeJsonFromRequest[dto.ClientRedirectURIDTO](w, r.Body)
+	if err != nil {
+		return
+	}
+
+	err = newService.RemoveClientRedirectURI(clientClaims.ClientID, request.RedirectURI)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "Failed to remove the redirect uri", err)
+		return
+	}
+
+	response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Redirect uri removed successfully")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
+
+// RotateClientSecretHandler issues a new client secret. It is only returned
+// in this response; the previous secret stays valid for the overlap window.
+func RotateClientSecretHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	authToken := r.Header.Get("Authorization")
+	if authToken == "" {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: missing token", errors.New("missing jwt token"))
+		return
+	}
+
+	clientClaims, err := newService.ValidateClientToken(authToken[7:])
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return
+	}
+
+	rotated, err := newService.RotateClientSecret(clientClaims.ClientID)
+	if err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to rotate the client secret", err)
+		return
+	}
 
-			if u.Message == nil || u.Message.Chat.Type != "private" {
-				continue
-			}
+	response := utils.BuildResponse(w, http.StatusOK, "Client secret rotated successfully", rotated)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
 
-			msg := u.Message
+// DynamicClientRegistrationHandler creates a client from RFC 7591 metadata.
+// The caller authenticates with the initial access token handed out to
+// platform operators.
+func DynamicClientRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
 
-			if !strings.HasPrefix(msg.Text, "/start ") {
-				continue
-			}
+	newService := r.Context().Value("service").(interfaces.IService)
 
-			sessionID := msg.Text[7:]
-			if sessionID == "" {
-				continue
-			}
+	authToken := r.Header.Get("Authorization")
+	if authToken == "" {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: missing token", errors.New("missing initial access token"))
+		return
+	}
 
-			sessionIDBytes, err := base64.RawURLEncoding.DecodeString(sessionID)
-			if err != nil {
-				log.Printf("failed to decode session id %s, skipping\n", sessionID)
-				continue
-			}
+	err := utils.ValidateInitialAccessToken(strings.TrimPrefix(authToken, "Bearer "))
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return
+	}
 
-			sessionIDHash := sha256.Sum256(sessionIDBytes)
+	request, err := utils.DecodeJsonFromRequest[dto.ClientRegistrationDTO](w, r.Body)
+	if err != nil {
+		return
+	}
 
-			if bytes.Equal(user.TelegramSessionIDHash, sessionIDHash[:]) {
-				log.Printf("Found matching session id\n")
+	registered, err := newService.RegisterDynamicClient(request)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "Failed to register the client", err)
+		return
+	}
 
-				// Send a reply keyboard that *requests contact*.
-				kb := dto.ReplyKeyboardMarkup{
-					Keyboard: [][]dto.KeyboardButton{
-						{
-							{Text: "Share my phone", RequestContact: true},
-						},
-					},
-					ResizeKeyboard:  true,
-					OneTimeKeyboard: true,
-				}
-				text := "Hi! In order for us to verify your phone number, please tap the button below to allow Telegram sharing your phone number with us."
+	response := utils.BuildResponse(w, http.StatusCreated, "Client registered successfully", registered)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
 
-				err := newService.SendTelegramBotMessage(baseURL, dto.SendMessageRequestDTO{
-					ChatID:      msg.Chat.ID,
-					Text:        text,
-					ParseMode:   "Markdown",
-					ReplyMarkup: kb,
-				})
-				if err != nil {
-					log.Printf("sendMessage error: %v", err)
-				}
+// ClientConfigurationHandler serves the client configuration endpoint of
+// RFC 7592 at the registration_client_uri returned on registration. It is
+// authenticated with the client's registration access token.
+func ClientConfigurationHandler(w http.ResponseWriter, r *http.Request) {
+	newService := r.Context().Value("service").(interfaces.IService)
 
-				foundStartMessage = true
-				telegramUserID = msg.From.ID
-				break
-			}
-		}
+	clientID := strings.TrimPrefix(r.URL.Path, "/api/v1/register/")
 
-		if foundStartMessage {
-			break
-		}
+	authToken := r.Header.Get("Authorization")
+	if authToken == "" {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: missing token", errors.New("missing registration access token"))
+		return
 	}
+	registrationAccessToken := strings.TrimPrefix(authToken, "Bearer ")
 
-	for i := 0; i < 500; i++ {
-		if i > 0 {
-			time.Sleep(400 * time.Millisecond)
+	switch r.Method {
+	case http.MethodGet:
+		client, err := newService.GetRegisteredClient(clientID, registrationAccessToken)
+		if err != nil {
+			handleClientConfigurationError(w, "Failed to get the client", err)
+			return
 		}
 
-		updates, err := newService.RefreshTelegramMessages(baseURL, offset)
+		response := utils.BuildResponse(w, http.StatusOK, "Client retrieved successfully", client)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		}
+	case http.MethodPut:
+		request, err := utils.DecodeJsonFromRequest[dto.ClientRegistrationDTO](w, r.Body)
 		if err != nil {
-			log.Printf("failed to refresh messages from Telegram: %v\n", err)
-			time.Sleep(2 * time.Second)
-			continue
+			return
 		}
 
-		for _, u := range updates {
-			offset = u.UpdateID + 1
+		client, err := newService.UpdateRegisteredClient(clientID, registrationAccessToken, request)
+		if err != nil {
+			handleClientConfigurationError(w, "Failed to update the client", err)
+			return
+		}
 
-			if u.Message == nil || u.Message.Chat.Type != "private" {
-				continue
-			}
+		response := utils.BuildResponse(w, http.StatusOK, "Client updated successfully", client)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+		}
+	case http.MethodDelete:
+		err := newService.DeleteRegisteredClient(clientID, registrationAccessToken)
+		if err != nil {
+			handleClientConfigurationError(w, "Failed to delete the client", err)
+			return
+		}
 
-			msg := u.Message
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		errorMessage := "Invalid http method. Expected GET, PUT or DELETE"
+		utils.HandleError(w, http.StatusMethodNotAllowed, errorMessage, fmt.Errorf(errorMessage))
+	}
+}
 
-			if msg.Contact == nil {
-				continue
-			}
+func handleClientConfigurationError(w http.ResponseWriter, message string, err error) {
+	if errors.Is(err, constants.ErrInvalidRegistrationAccessToken) {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return
+	}
+	utils.HandleError(w, http.StatusBadRequest, message, err)
+}
 
-			// Validate the contact belongs to the sender.
-			if msg.From == nil || msg.Contact.UserID != msg.From.ID || msg.From.ID != telegramUserID {
-				continue
-			}
+func validateHttpMethod(w http.ResponseWriter, actualMethod string, expectedMethod string) bool {
+	if actualMethod != expectedMethod {
+		errorMessage := fmt.Sprintf("Invalid http method. Expected %s", expectedMethod)
+		utils.HandleError(
+			w,
+			http.StatusMethodNotAllowed,
+			errorMessage,
+			fmt.Errorf(errorMessage),
+		)
+		return false
+	}
 
-			phoneNumber := strings.TrimSpace(msg.Contact.PhoneNumber)
+	return true
+}
 
-			verificationCode, err := newService.GeneratePhoneNumberVerificationCode(&user, phoneNumber)
-			if err != nil {
-				utils.HandleError(w, http.StatusInternalServerError, "failed to generate the verification code", err)
-				return
-			}
+// VerifiedAttributesCredentialHandler issues the logged in user an SD-JWT of
+// their verified attributes bound to the holder key in the body, to be
+// presented to service providers.
+func VerifiedAttributesCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
+	}
 
-			// Remove keyboard after success.
-			err = newService.SendTelegramBotMessage(baseURL, dto.SendMessageRequestDTO{
-				ChatID: msg.Chat.ID,
-				Text: fmt.Sprintf(
-					"Thanks! Your verification code is: %s. You can go back to the Layer8 user portal now.",
-					verificationCode,
-				),
-				ReplyMarkup: dto.ReplyKeyboardRemove{
-					RemoveKeyboard: true,
-				},
-			})
-			if err != nil {
-				utils.HandleError(w, http.StatusInternalServerError, "failed to send message from the Telegram bot", err)
-				log.Printf("failed to send message from the Telegram bot: %v", err)
-				return
-			}
+	newService := r.Context().Value("service").(interfaces.IService)
 
-			zkProof, zkPairID, err := newService.GenerateZkProof(user, phoneNumber, verificationCode)
-			if err != nil {
-				utils.HandleError(w, http.StatusInternalServerError, "failed to generate the zk proof of phone number verification", err)
-				return
-			}
+	authToken := r.Header.Get("Authorization")
+	if authToken == "" {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: missing token", errors.New("missing jwt token"))
+		return
+	}
 
-			err = newService.SavePhoneNumberVerificationData(user.ID, verificationCode, zkProof, zkPairID)
-			if err != nil {
-				utils.HandleError(w, http.StatusInternalServerError, "failed to save proof of the phone number verification into the db", err)
-				return
-			}
+	userID, err := newService.ValidateUserToken(authToken[7:])
+	if err != nil {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		return
+	}
 
-			log.Println("Phone number successfully verified, exiting")
+	request, err := utils.DecodeJsonFromRequest[dto.VerifiedAttributesCredentialDTO](w, r.Body)
+	if err != nil {
+		return
+	}
 
-			apiResponse := utils.BuildResponseWithNoBody(w, http.StatusOK, "phone number is verified")
+	credential, err := newService.IssueVerifiedAttributesCredential(userID, request)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "Failed to issue the credential", err)
+		return
+	}
 
-			if err := json.NewEncoder(w).Encode(apiResponse); err != nil {
-				utils.HandleError(
-					w,
-					http.StatusInternalServerError,
-					"Internal error: could not encode response into json",
-					err,
-				)
-			}
-			return
-		}
+	response := utils.BuildResponse(w, http.StatusOK, "Credential issued successfully", credential)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
 	}
 }
 
-func CheckPhoneNumberVerificationCode(w http.ResponseWriter, r *http.Request) {
-	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+// CredentialIssuerMetadataHandler serves the keys credentials are signed with.
+// The document is read by SD-JWT libraries as is, so it is not wrapped in the
+// usual response envelope.
+func CredentialIssuerMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodGet) {
 		return
 	}
 
 	newService := r.Context().Value("service").(interfaces.IService)
 
-	tokenString := r.Header.Get("Authorization")
-	tokenString = tokenString[7:] // Remove the "Bearer " prefix
-	userID, err := utils.ValidateToken(tokenString)
+	metadata, err := newService.GetCredentialIssuerMetadata()
 	if err != nil {
-		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to get the credential issuer metadata", err)
 		return
 	}
 
-	request, err := utils.DecodeJsonFromRequest[dto.CheckPhoneNumberVerificationCodeDTO](w, r.Body)
-	if err != nil {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(metadata); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
+
+// ZkVerifyingKeysHandler publishes every zk verifying key by ID, serialized
+// with gnark, for service providers checking proofs with the zkverify package.
+func ZkVerifyingKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodGet) {
 		return
 	}
 
-	verificationData, err := newService.GetPhoneNumberVerificationData(userID)
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	verifyingKeys, err := newService.GetZkVerifyingKeys()
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "user's verification data not found", err)
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to get the zk verifying keys", err)
 		return
 	}
 
-	err = newService.CheckPhoneNumberVerificationCode(request.VerificationCode, verificationData)
+	response := utils.BuildResponse(w, http.StatusOK, "Verifying keys retrieved successfully", verifyingKeys)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
+}
+
+// ZkProofJobHandler reports the state of a queued proof of the logged in
+// user. With wait=true it holds the request until the job is finished, for at
+// most zkProofJobWaitTimeout, so clients need not poll in a tight loop.
+func ZkProofJobHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodGet) {
+		return
+	}
+
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	authToken := r.Header.Get("Authorization")
+	if authToken == "" {
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: missing token", errors.New("missing jwt token"))
+		return
+	}
+
+	userID, err := newService.ValidateUserToken(authToken[7:])
 	if err != nil {
-		utils.HandleError(w, http.StatusBadRequest, "failed to validate the provided verification code", err)
+		utils.HandleError(w, http.StatusUnauthorized, "Authentication error: invalid token", err)
 		return
 	}
 
-	err = newService.SaveProofOfPhoneNumberVerification(verificationData)
+	jobID, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
 	if err != nil {
-		utils.HandleError(w, http.StatusInternalServerError, "failed to update phone number verification metadata in the db", err)
+		utils.HandleError(w, http.StatusBadRequest, "Invalid job id", err)
 		return
 	}
 
-	response := utils.BuildResponseWithNoBody(w, http.StatusOK, "Your phone number is verified successfully! Congratulations!")
+	var job models.ZkProofJobResponseOutput
+	if r.URL.Query().Get("wait") == "true" {
+		ctx, cancel := context.WithTimeout(r.Context(), zkProofJobWaitTimeout)
+		defer cancel()
+		job, err = newService.WaitForZkProofJob(ctx, userID, uint(jobID))
+	} else {
+		job, err = newService.GetZkProofJob(userID, uint(jobID))
+	}
+	if err != nil {
+		utils.HandleError(w, http.StatusNotFound, "Job not found", err)
+		return
+	}
 
+	response := utils.BuildResponse(w, http.StatusOK, "Job retrieved successfully", job)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		utils.HandleError(w, http.StatusInternalServerError, "failed to encode response into json", err)
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
 	}
 }
 
-func validateHttpMethod(w http.ResponseWriter, actualMethod string, expectedMethod string) bool {
-	if actualMethod != expectedMethod {
-		errorMessage := fmt.Sprintf("Invalid http method. Expected %s", expectedMethod)
-		utils.HandleError(
-			w,
-			http.StatusMethodNotAllowed,
-			errorMessage,
-			fmt.Errorf(errorMessage),
-		)
-		return false
+// VerifyZkProofHandler checks a proof for callers that do not want to run the
+// Groth16 verifier themselves.
+func VerifyZkProofHandler(w http.ResponseWriter, r *http.Request) {
+	if !validateHttpMethod(w, r.Method, http.MethodPost) {
+		return
 	}
 
-	return true
+	newService := r.Context().Value("service").(interfaces.IService)
+
+	request, err := utils.DecodeJsonFromRequest[dto.VerifyZkProofDTO](w, r.Body)
+	if err != nil {
+		return
+	}
+
+	result, err := newService.VerifyZkProof(request)
+	if err != nil {
+		utils.HandleError(w, http.StatusBadRequest, "Failed to verify the zk proof", err)
+		return
+	}
+
+	response := utils.BuildResponse(w, http.StatusOK, "Proof checked successfully", result)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		utils.HandleError(w, http.StatusInternalServerError, "Failed to encode the response", err)
+	}
 }
@@ -0,0 +1,128 @@
+// Package dataaccessdigest emails users who subscribed to it the releases of
+// their metadata to clients since their last digest, so that they learn about
+// them without visiting the user portal.
+package dataaccessdigest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"globe-and-citizen/layer8/server/resource_server/emails/sender"
+	"globe-and-citizen/layer8/server/resource_server/models"
+)
+
+// claimTimeout is how long a claimed digest is left to the instance that
+// claimed it before another instance may send it
+const claimTimeout = 10 * time.Minute
+
+type Repository interface {
+	ClaimDueDataAccessDigests(now time.Time, sentBefore time.Time, claimedBefore time.Time) ([]models.DataAccessDigest, error)
+	ReleaseDataAccessDigest(userID uint) error
+	GetDataAccessRecords(userID uint, clientID string, since time.Time, until time.Time) ([]models.DataAccessRecord, error)
+	MarkDataAccessDigestSent(userID uint, sentAt time.Time) error
+	FindUser(userID uint) (models.User, error)
+}
+
+type Sender struct {
+	repository  Repository
+	emailSender sender.EmailService
+	from        string
+	// interval is how long a digest covers, a user gets at most one digest
+	// per interval
+	interval time.Duration
+}
+
+func NewSender(
+	repository Repository, emailSender sender.EmailService, from string, interval time.Duration,
+) *Sender {
+	return &Sender{
+		repository:  repository,
+		emailSender: emailSender,
+		from:        from,
+		interval:    interval,
+	}
+}
+
+// Send sends the digests that are due at now. A digest covers the releases
+// since the previous one, or since the subscription, and is only emailed when
+// there were releases. Due digests are claimed before they are sent, so that
+// each is sent by a single instance. A digest that failed is released and
+// tried again on the next call.
+func (s *Sender) Send(now time.Time) error {
+	digests, err := s.repository.ClaimDueDataAccessDigests(now, now.Add(-s.interval), now.Add(-claimTimeout))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, digest := range digests {
+		err := s.send(digest, now)
+		if err == nil {
+			continue
+		}
+
+		errs = append(errs, fmt.Errorf("failed to send the data access digest of user %d: %w", digest.UserID, err))
+		if err := s.repository.ReleaseDataAccessDigest(digest.UserID); err != nil {
+			errs = append(errs, fmt.Errorf("failed to release the data access digest of user %d: %w", digest.UserID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Sender) send(digest models.DataAccessDigest, now time.Time) error {
+	since := digest.CreatedAt
+	if digest.LastSentAt != nil {
+		since = *digest.LastSentAt
+	}
+
+	records, err := s.repository.GetDataAccessRecords(digest.UserID, "", since, now)
+	if err != nil {
+		return err
+	}
+
+	if len(records) > 0 {
+		user, err := s.repository.FindUser(digest.UserID)
+		if err != nil {
+			return err
+		}
+
+		err = s.emailSender.SendEmail(&models.Email{
+			From:    s.from,
+			To:      digest.Email,
+			Subject: "Apps that read your Layer8 data",
+			Content: models.VerificationEmailContent{Username: user.Username},
+			Text:    digestText(user.Username, since, records),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.repository.MarkDataAccessDigestSent(digest.UserID, now)
+}
+
+// digestText lists the releases, which come newest first.
+func digestText(username string, since time.Time, records []models.DataAccessRecord) string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "Hi, %s!\nThese apps read your data since %s:\n\n", username, since.Format(time.RFC1123))
+
+	for _, record := range records {
+		client := record.ClientName
+		if client == "" {
+			client = record.ClientID
+		}
+
+		fields := strings.ReplaceAll(record.Fields, ",", ", ")
+		if fields == "" {
+			fields = "no fields"
+		}
+
+		fmt.Fprintf(&text, "- %s: %s read %s\n", record.AccessedAt.Format(time.RFC1123), client, fields)
+	}
+
+	text.WriteString("\nThe data access timeline of your profile lists every app that read your data.\n")
+	return text.String()
+}
@@ -0,0 +1,170 @@
+package dataaccessdigest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"globe-and-citizen/layer8/server/resource_server/models"
+	"globe-and-citizen/layer8/server/resource_server/utils/mocks"
+)
+
+type digestRepository struct {
+	digests []models.DataAccessDigest
+	records []models.DataAccessRecord
+}
+
+func (r *digestRepository) ClaimDueDataAccessDigests(
+	now time.Time, sentBefore time.Time, claimedBefore time.Time,
+) ([]models.DataAccessDigest, error) {
+	var due []models.DataAccessDigest
+	for i, digest := range r.digests {
+		last := digest.CreatedAt
+		if digest.LastSentAt != nil {
+			last = *digest.LastSentAt
+		}
+		if !last.Before(sentBefore) || (digest.ClaimedAt != nil && !digest.ClaimedAt.Before(claimedBefore)) {
+			continue
+		}
+
+		r.digests[i].ClaimedAt = &now
+		due = append(due, r.digests[i])
+	}
+	return due, nil
+}
+
+func (r *digestRepository) ReleaseDataAccessDigest(userID uint) error {
+	for i := range r.digests {
+		if r.digests[i].UserID == userID {
+			r.digests[i].ClaimedAt = nil
+		}
+	}
+	return nil
+}
+
+func (r *digestRepository) GetDataAccessRecords(
+	userID uint, clientID string, since time.Time, until time.Time,
+) ([]models.DataAccessRecord, error) {
+	var records []models.DataAccessRecord
+	for _, record := range r.records {
+		if record.UserID == userID && !record.AccessedAt.Before(since) && record.AccessedAt.Before(until) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (r *digestRepository) MarkDataAccessDigestSent(userID uint, sentAt time.Time) error {
+	for i := range r.digests {
+		if r.digests[i].UserID == userID {
+			r.digests[i].LastSentAt = &sentAt
+			r.digests[i].ClaimedAt = nil
+		}
+	}
+	return nil
+}
+
+func (r *digestRepository) FindUser(userID uint) (models.User, error) {
+	return models.User{ID: userID, Username: "user"}, nil
+}
+
+func TestSend(t *testing.T) {
+	now := time.Date(2024, 5, 8, 12, 0, 0, 0, time.UTC)
+	lastSentAt := now.Add(-8 * 24 * time.Hour)
+	recentlySentAt := now.Add(-time.Hour)
+
+	repository := &digestRepository{
+		digests: []models.DataAccessDigest{
+			{UserID: 1, Email: "user@example.com", CreatedAt: now.Add(-30 * 24 * time.Hour), LastSentAt: &lastSentAt},
+			{UserID: 2, Email: "quiet@example.com", CreatedAt: now.Add(-30 * 24 * time.Hour)},
+			{UserID: 3, Email: "recent@example.com", CreatedAt: now.Add(-30 * 24 * time.Hour), LastSentAt: &recentlySentAt},
+		},
+		records: []models.DataAccessRecord{
+			{UserID: 1, ClientID: "client_id", ClientName: "client", Fields: "display_name,color", AccessedAt: now.Add(-2 * time.Hour)},
+			{UserID: 1, ClientID: "client_id", Fields: "bio", AccessedAt: now.Add(-10 * 24 * time.Hour)},
+			{UserID: 3, ClientID: "client_id", Fields: "bio", AccessedAt: now.Add(-time.Minute)},
+		},
+	}
+
+	var sent []*models.Email
+	emailSender := &mocks.MockEmailSenderService{
+		SendEmailFunc: func(email *models.Email) error {
+			sent = append(sent, email)
+			return nil
+		},
+	}
+
+	err := NewSender(repository, emailSender, "admin@layer8.com", 7*24*time.Hour).Send(now)
+
+	assert.Nil(t, err)
+	assert.Len(t, sent, 1)
+	assert.Equal(t, "admin@layer8.com", sent[0].From)
+	assert.Equal(t, "user@example.com", sent[0].To)
+	assert.Contains(t, sent[0].Text, "client read display_name, color")
+	assert.NotContains(t, sent[0].Text, "bio")
+
+	// digests without releases are not emailed but still start over
+	assert.Equal(t, now, *repository.digests[0].LastSentAt)
+	assert.Equal(t, now, *repository.digests[1].LastSentAt)
+	assert.Equal(t, recentlySentAt, *repository.digests[2].LastSentAt)
+}
+
+func TestSend_EmailFailure(t *testing.T) {
+	now := time.Date(2024, 5, 8, 12, 0, 0, 0, time.UTC)
+
+	repository := &digestRepository{
+		digests: []models.DataAccessDigest{
+			{UserID: 1, Email: "user@example.com", CreatedAt: now.Add(-8 * 24 * time.Hour)},
+		},
+		records: []models.DataAccessRecord{
+			{UserID: 1, ClientID: "client_id", Fields: "display_name", AccessedAt: now.Add(-time.Hour)},
+		},
+	}
+
+	emailSender := &mocks.MockEmailSenderService{
+		SendEmailFunc: func(email *models.Email) error {
+			return errors.New("mail server unavailable")
+		},
+	}
+
+	err := NewSender(repository, emailSender, "admin@layer8.com", 7*24*time.Hour).Send(now)
+
+	assert.NotNil(t, err)
+	// the digest is tried again on the next call
+	assert.Nil(t, repository.digests[0].LastSentAt)
+	assert.Nil(t, repository.digests[0].ClaimedAt)
+}
+
+func TestSend_ClaimedDigestIsNotSentTwice(t *testing.T) {
+	now := time.Date(2024, 5, 8, 12, 0, 0, 0, time.UTC)
+	claimedAt := now.Add(-time.Minute)
+
+	repository := &digestRepository{
+		digests: []models.DataAccessDigest{
+			// being sent by another instance
+			{UserID: 1, Email: "user@example.com", CreatedAt: now.Add(-8 * 24 * time.Hour), ClaimedAt: &claimedAt},
+		},
+		records: []models.DataAccessRecord{
+			{UserID: 1, ClientID: "client_id", Fields: "display_name", AccessedAt: now.Add(-time.Hour)},
+		},
+	}
+
+	var sent []*models.Email
+	emailSender := &mocks.MockEmailSenderService{
+		SendEmailFunc: func(email *models.Email) error {
+			sent = append(sent, email)
+			return nil
+		},
+	}
+	sender := NewSender(repository, emailSender, "admin@layer8.com", 7*24*time.Hour)
+
+	assert.Nil(t, sender.Send(now))
+	assert.Empty(t, sent)
+
+	// a claim abandoned for longer than the timeout is taken over
+	assert.Nil(t, sender.Send(now.Add(claimTimeout)))
+	assert.Len(t, sent, 1)
+	assert.Nil(t, repository.digests[0].ClaimedAt)
+}
@@ -1,5 +1,10 @@
 package dto
 
+import (
+	"globe-and-citizen/layer8/server/sdjwt"
+	"globe-and-citizen/layer8/server/webauthn"
+)
+
 type RegisterUserDTO struct {
 	Username  string `json:"username" validate:"required,min=3,max=50"`
 	PublicKey []byte `json:"public_key" validate:"required"`
@@ -12,6 +17,10 @@ type LoginUserDTO struct {
 	Nonce       string `json:"nonce" validate:"required"`
 	CNonce      string `json:"c_nonce" validate:"required"`
 	ClientProof string `json:"client_proof" validate:"required"`
+	ProofOfWork string `json:"proof_of_work"`
+	// DeviceLabel names the device of the session the login starts, it is
+	// set from the request headers
+	DeviceLabel string `json:"-"`
 }
 
 type LoginClientDTO struct {
@@ -19,6 +28,45 @@ type LoginClientDTO struct {
 	Nonce       string `json:"nonce" validate:"required"`
 	CNonce      string `json:"c_nonce" validate:"required"`
 	ClientProof string `json:"client_proof" validate:"required"`
+	ProofOfWork string `json:"proof_of_work"`
+	// DeviceLabel names the device of the session the login starts, it is
+	// set from the request headers
+	DeviceLabel string `json:"-"`
+}
+
+// LoginTwoFactorDTO is the second step of a login that asked for a code of
+// the authenticator. A recovery code can be given instead.
+type LoginTwoFactorDTO struct {
+	TwoFactorToken string `json:"two_factor_token" validate:"required"`
+	Code           string `json:"code" validate:"required"`
+	ProofOfWork    string `json:"proof_of_work"`
+	DeviceLabel    string `json:"-"`
+}
+
+type TwoFactorCodeDTO struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type ClientRequireTwoFactorDTO struct {
+	Required bool `json:"required"`
+}
+
+// PasskeyRegistrationDTO is the response of the authenticator to the
+// registration options of a new passkey.
+type PasskeyRegistrationDTO struct {
+	Name       string                      `json:"name" validate:"max=255"`
+	Credential webauthn.CredentialResponse `json:"credential"`
+}
+
+type DeletePasskeyDTO struct {
+	ID uint `json:"id" validate:"required"`
+}
+
+// LoginPasskeyDTO is the assertion of a passkey for the challenge of login
+// options.
+type LoginPasskeyDTO struct {
+	Credential  webauthn.CredentialResponse `json:"credential"`
+	DeviceLabel string                      `json:"-"`
 }
 
 type LoginPrecheckDTO struct {
@@ -45,6 +93,19 @@ type RegisterClientDTO struct {
 	ServerKey   string `json:"server_key" validate:"required"`
 }
 
+// ClientRegistrationDTO carries the client metadata of RFC 7591, section 2,
+// plus the backend_uri Layer8 needs to route the client's traffic.
+type ClientRegistrationDTO struct {
+	// RedirectURIs are required when the client uses the authorization_code grant
+	RedirectURIs []string `json:"redirect_uris"`
+	ClientName   string   `json:"client_name" validate:"required"`
+	BackendURI   string   `json:"backend_uri" validate:"required"`
+	LogoURI      string   `json:"logo_uri" validate:"omitempty,url"`
+	Contacts     []string `json:"contacts" validate:"omitempty,dive,email"`
+	// GrantTypes defaults to authorization_code when omitted
+	GrantTypes []string `json:"grant_types" validate:"omitempty,dive,oneof=authorization_code client_credentials urn:ietf:params:oauth:grant-type:device_code"`
+}
+
 type CheckBackendURIDTO struct {
 	BackendURI string `json:"backend_uri" validate:"required"`
 }
@@ -68,6 +129,7 @@ type ResetPasswordPrecheckDTO struct {
 
 type ResetPasswordDTO struct {
 	Username  string `json:"username" validate:"required,min=3,max=50"`
+	Challenge string `json:"challenge" validate:"required"`
 	Signature []byte `json:"signature" validate:"required"`
 	StoredKey string `json:"stored_key" validation:"required,min=1"`
 	ServerKey string `json:"server_key" validation:"required,min=1"`
@@ -84,3 +146,42 @@ type CheckPhoneNumberVerificationCodeDTO struct {
 type TelegramSessionIdDTO struct {
 	SessionID string `json:"session_id"`
 }
+
+// RevokeSessionDTO names the session to revoke, or asks to revoke all of
+// them, the current one included.
+type RevokeSessionDTO struct {
+	ID  uint `json:"id" validate:"required_without=All"`
+	All bool `json:"all"`
+}
+
+type RevokeConnectedAppDTO struct {
+	ClientID string `json:"client_id" validate:"required"`
+}
+
+type ClientRedirectURIDTO struct {
+	RedirectURI string `json:"redirect_uri" validate:"required"`
+}
+
+// VerifyZkProofDTO carries a proof and its public inputs, as shared by the
+// user who proved the attribute. DomainCommitment is the one of an email
+// domain claim, and is left empty to check a proof without one.
+type VerifyZkProofDTO struct {
+	ZkKeyPairID      uint   `json:"zk_key_pair_id" validate:"required"`
+	ZkProof          []byte `json:"zk_proof" validate:"required"`
+	Salt             string `json:"salt" validate:"required"`
+	VerificationCode string `json:"verification_code" validate:"required"`
+	DomainCommitment string `json:"domain_commitment,omitempty"`
+}
+
+// VerifiedAttributesCredentialDTO names the Ed25519 key the credential is
+// bound to. The holder keeps the private key and signs a key binding JWT with
+// it for every presentation.
+type VerifiedAttributesCredentialDTO struct {
+	HolderKey sdjwt.JWK `json:"holder_jwk"`
+}
+
+// DataAccessDigestDTO subscribes a user to the data access digest. The email
+// must be the address the user verified.
+type DataAccessDigestDTO struct {
+	Email string `json:"email" validate:"required,email"`
+}
@@ -57,23 +57,27 @@ func (ms *MailerSendService) SendEmail(email *models.Email) error {
 	message.SetFrom(from)
 	message.SetRecipients([]mailersend.Recipient{to})
 	message.SetSubject(email.Subject)
-	message.SetText(
-		fmt.Sprintf(
-			"Hi, %s!\nYour verification code is: %s",
-			email.Content.Username,
-			email.Content.Code,
-		),
-	)
+	if email.Text != "" {
+		message.SetText(email.Text)
+	} else {
+		message.SetText(
+			fmt.Sprintf(
+				"Hi, %s!\nYour verification code is: %s",
+				email.Content.Username,
+				email.Content.Code,
+			),
+		)
+	}
 	//message.SetTemplateID(ms.templateId)
 	//message.SetPersonalization(personalization)
 
 	response, e := mailerSendClient.Email.Send(ctx, message)
 	if e != nil {
-		return fmt.Errorf("error while sending a verification email via MailerSend: %e", e)
+		return fmt.Errorf("error while sending an email via MailerSend: %e", e)
 	}
 	if response.StatusCode != http.StatusAccepted {
 		return fmt.Errorf(
-			"failed to send a verification email, status code %d",
+			"failed to send an email, status code %d",
 			response.StatusCode,
 		)
 	}
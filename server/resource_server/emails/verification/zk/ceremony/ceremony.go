@@ -0,0 +1,321 @@
+// Package ceremony runs the circuit-specific Phase 2 of a Groth16 trusted
+// setup as a multi-party computation, so no single party learns the toxic
+// waste of the Layer8 key pairs.
+//
+// A coordinator starts the ceremony from Phase-1 powers of tau in gnark's
+// mpcsetup encoding. Participants then contribute in turn: each one receives
+// the transcript, checks every earlier contribution, adds their own randomness
+// and passes the transcript on. The keys are sound as long as one participant
+// destroyed their randomness.
+package ceremony
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/groth16/bn254/mpcsetup"
+	"github.com/consensys/gnark/constraint"
+	cs_bn254 "github.com/consensys/gnark/constraint/bn254"
+)
+
+// maxTranscriptEntry bounds a single serialized Phase-2 state, so a corrupt
+// length prefix does not make us allocate arbitrary amounts of memory.
+const maxTranscriptEntry = 1 << 30
+
+// Transcript holds the Phase-2 state the ceremony started from followed by
+// the state after each contribution.
+type Transcript struct {
+	states []mpcsetup.Phase2
+}
+
+// ReadPhase1 decodes Phase-1 parameters written with mpcsetup.Phase1.WriteTo.
+func ReadPhase1(reader io.Reader) (*mpcsetup.Phase1, error) {
+	phase1 := new(mpcsetup.Phase1)
+	if _, err := phase1.ReadFrom(reader); err != nil {
+		return nil, fmt.Errorf("error while reading phase 1 parameters: %v", err)
+	}
+
+	return phase1, nil
+}
+
+// Begin derives the initial Phase-2 state of cs from the Phase-1 parameters.
+func Begin(cs constraint.ConstraintSystem, phase1 *mpcsetup.Phase1) (*Transcript, error) {
+	initial, _, err := initPhase2(cs, phase1)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Transcript{states: []mpcsetup.Phase2{initial}}, nil
+}
+
+// Contributions is the number of participants who contributed so far.
+func (t *Transcript) Contributions() int {
+	return len(t.states) - 1
+}
+
+// ContributionHash identifies the i-th contribution, counted from one.
+// Participants note theirs and check that it appears in the final transcript.
+func (t *Transcript) ContributionHash(i int) string {
+	return hex.EncodeToString(t.states[i].Hash)
+}
+
+// Contribute checks the contributions made so far and appends one made with
+// fresh randomness. The randomness never leaves this call.
+func (t *Transcript) Contribute() error {
+	if err := t.VerifyContributions(); err != nil {
+		return err
+	}
+
+	next, err := clonePhase2(&t.states[len(t.states)-1])
+	if err != nil {
+		return err
+	}
+	next.Contribute()
+
+	t.states = append(t.states, *next)
+	return nil
+}
+
+// VerifyContributions checks that every contribution builds on the previous
+// state and that its author knew the randomness they applied.
+func (t *Transcript) VerifyContributions() error {
+	for i := 1; i < len(t.states); i++ {
+		if err := mpcsetup.VerifyPhase2(&t.states[i-1], &t.states[i]); err != nil {
+			return fmt.Errorf("contribution %d is invalid: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Verify checks the whole transcript: the initial state must be the one Begin
+// derives for cs and phase1, and every contribution must be valid.
+func (t *Transcript) Verify(cs constraint.ConstraintSystem, phase1 *mpcsetup.Phase1) error {
+	_, err := t.verify(cs, phase1)
+	return err
+}
+
+// ExtractKeys verifies the transcript and derives the proving and verifying
+// keys from its last state. At least one contribution is required, the initial
+// state uses no randomness at all.
+func (t *Transcript) ExtractKeys(
+	cs constraint.ConstraintSystem, phase1 *mpcsetup.Phase1,
+) (groth16.ProvingKey, groth16.VerifyingKey, error) {
+	if t.Contributions() == 0 {
+		return nil, nil, errors.New("the ceremony has no contributions yet")
+	}
+
+	evaluations, err := t.verify(cs, phase1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	truncated, err := truncatePhase1(phase1, cs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// gnark reorders the points of the state it extracts from
+	last, err := clonePhase2(&t.states[len(t.states)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	provingKey, verifyingKey := mpcsetup.ExtractKeys(truncated, last, &evaluations, cs.GetNbConstraints())
+
+	return &provingKey, &verifyingKey, nil
+}
+
+// Hash is the hex encoded SHA-256 of the serialized transcript. It is stored
+// next to the extracted key pair so anyone holding the transcript can match
+// it to the published verifying key.
+func (t *Transcript) Hash() (string, error) {
+	hash := sha256.New()
+	if _, err := t.WriteTo(hash); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// WriteTo serializes the transcript as a count followed by length-prefixed
+// Phase-2 states.
+func (t *Transcript) WriteTo(writer io.Writer) (int64, error) {
+	var written int64
+
+	if err := binary.Write(writer, binary.BigEndian, uint32(len(t.states))); err != nil {
+		return written, err
+	}
+	written += 4
+
+	for i := range t.states {
+		var state bytes.Buffer
+		if _, err := t.states[i].WriteTo(&state); err != nil {
+			return written, err
+		}
+
+		if err := binary.Write(writer, binary.BigEndian, uint64(state.Len())); err != nil {
+			return written, err
+		}
+		written += 8
+
+		n, err := writer.Write(state.Bytes())
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// ReadTranscript decodes a transcript serialized with WriteTo. It does not
+// verify it.
+func ReadTranscript(reader io.Reader) (*Transcript, error) {
+	var count uint32
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("error while reading transcript: %v", err)
+	}
+	if count == 0 {
+		return nil, errors.New("transcript has no initial state")
+	}
+
+	transcript := &Transcript{}
+	for i := uint32(0); i < count; i++ {
+		var length uint64
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return nil, fmt.Errorf("error while reading transcript entry %d: %v", i, err)
+		}
+		if length > maxTranscriptEntry {
+			return nil, fmt.Errorf("transcript entry %d is too large", i)
+		}
+
+		state := make([]byte, length)
+		if _, err := io.ReadFull(reader, state); err != nil {
+			return nil, fmt.Errorf("error while reading transcript entry %d: %v", i, err)
+		}
+
+		var phase2 mpcsetup.Phase2
+		if _, err := phase2.ReadFrom(bytes.NewReader(state)); err != nil {
+			return nil, fmt.Errorf("error while decoding transcript entry %d: %v", i, err)
+		}
+		transcript.states = append(transcript.states, phase2)
+	}
+
+	return transcript, nil
+}
+
+func (t *Transcript) verify(
+	cs constraint.ConstraintSystem, phase1 *mpcsetup.Phase1,
+) (mpcsetup.Phase2Evaluations, error) {
+	initial, evaluations, err := initPhase2(cs, phase1)
+	if err != nil {
+		return mpcsetup.Phase2Evaluations{}, err
+	}
+
+	if !sameParameters(&initial, &t.states[0]) {
+		return mpcsetup.Phase2Evaluations{}, errors.New(
+			"the transcript was not started from these phase 1 parameters and circuit",
+		)
+	}
+
+	if err := t.VerifyContributions(); err != nil {
+		return mpcsetup.Phase2Evaluations{}, err
+	}
+
+	return evaluations, nil
+}
+
+// sameParameters compares the points of two states. Their public keys are
+// left out, gnark randomizes the one of the initial state.
+func sameParameters(a, b *mpcsetup.Phase2) bool {
+	if !a.Parameters.G1.Delta.Equal(&b.Parameters.G1.Delta) || !a.Parameters.G2.Delta.Equal(&b.Parameters.G2.Delta) {
+		return false
+	}
+	if len(a.Parameters.G1.L) != len(b.Parameters.G1.L) || len(a.Parameters.G1.Z) != len(b.Parameters.G1.Z) {
+		return false
+	}
+	for i := range a.Parameters.G1.L {
+		if !a.Parameters.G1.L[i].Equal(&b.Parameters.G1.L[i]) {
+			return false
+		}
+	}
+	for i := range a.Parameters.G1.Z {
+		if !a.Parameters.G1.Z[i].Equal(&b.Parameters.G1.Z[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func initPhase2(
+	cs constraint.ConstraintSystem, phase1 *mpcsetup.Phase1,
+) (mpcsetup.Phase2, mpcsetup.Phase2Evaluations, error) {
+	r1cs, ok := cs.(*cs_bn254.R1CS)
+	if !ok {
+		return mpcsetup.Phase2{}, mpcsetup.Phase2Evaluations{}, errors.New("only bn254 R1CS circuits are supported")
+	}
+
+	truncated, err := truncatePhase1(phase1, cs)
+	if err != nil {
+		return mpcsetup.Phase2{}, mpcsetup.Phase2Evaluations{}, err
+	}
+
+	phase2, evaluations := mpcsetup.InitPhase2(r1cs, truncated)
+	return phase2, evaluations, nil
+}
+
+// truncatePhase1 keeps the powers of tau the evaluation domain of cs needs.
+// Phase 2 must run on a domain of exactly that size, while published powers
+// of tau are usually larger than one circuit requires.
+func truncatePhase1(phase1 *mpcsetup.Phase1, cs constraint.ConstraintSystem) (*mpcsetup.Phase1, error) {
+	size := domainSize(cs.GetNbConstraints())
+	available := len(phase1.Parameters.G2.Tau)
+
+	if available < size {
+		return nil, fmt.Errorf(
+			"phase 1 parameters support %d constraints but the circuit needs %d, use powers of tau of at least 2^%d",
+			available, cs.GetNbConstraints(), bits.Len(uint(size-1)),
+		)
+	}
+
+	truncated := *phase1
+	truncated.Parameters.G1.Tau = phase1.Parameters.G1.Tau[:2*size-1]
+	truncated.Parameters.G1.AlphaTau = phase1.Parameters.G1.AlphaTau[:size]
+	truncated.Parameters.G1.BetaTau = phase1.Parameters.G1.BetaTau[:size]
+	truncated.Parameters.G2.Tau = phase1.Parameters.G2.Tau[:size]
+
+	return &truncated, nil
+}
+
+func domainSize(nbConstraints int) int {
+	size := 1
+	for size < nbConstraints {
+		size <<= 1
+	}
+	return size
+}
+
+// clonePhase2 deep copies a state, so Contribute and ExtractKeys leave the
+// transcript they work from untouched.
+func clonePhase2(phase2 *mpcsetup.Phase2) (*mpcsetup.Phase2, error) {
+	var buffer bytes.Buffer
+	if _, err := phase2.WriteTo(&buffer); err != nil {
+		return nil, err
+	}
+
+	clone := new(mpcsetup.Phase2)
+	if _, err := clone.ReadFrom(&buffer); err != nil {
+		return nil, err
+	}
+
+	return clone, nil
+}
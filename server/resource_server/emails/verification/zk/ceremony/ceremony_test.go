@@ -0,0 +1,165 @@
+package ceremony
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/groth16/bn254/mpcsetup"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/stretchr/testify/assert"
+)
+
+// cubeCircuit stands in for the verification circuit, whose Phase 2 takes
+// minutes to initialize.
+type cubeCircuit struct {
+	X frontend.Variable `gnark:",secret"`
+	Y frontend.Variable `gnark:",public"`
+}
+
+func (c *cubeCircuit) Define(api frontend.API) error {
+	api.AssertIsEqual(api.Mul(c.X, c.X, c.X), c.Y)
+	return nil
+}
+
+func compileCubeCircuit(t *testing.T) constraint.ConstraintSystem {
+	cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &cubeCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs
+}
+
+func powersOfTau(power int) *mpcsetup.Phase1 {
+	phase1 := mpcsetup.InitPhase1(power)
+	phase1.Contribute()
+	return &phase1
+}
+
+// roundTrip hands the transcript to the next participant.
+func roundTrip(t *testing.T, transcript *Transcript) *Transcript {
+	var buffer bytes.Buffer
+	_, err := transcript.WriteTo(&buffer)
+	assert.Nil(t, err)
+
+	received, err := ReadTranscript(&buffer)
+	assert.Nil(t, err)
+	return received
+}
+
+func TestCeremony_KeysProveAndVerify(t *testing.T) {
+	cs := compileCubeCircuit(t)
+	phase1 := powersOfTau(4)
+
+	transcript, err := Begin(cs, phase1)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		transcript = roundTrip(t, transcript)
+		assert.Nil(t, transcript.Contribute())
+	}
+	assert.Equal(t, 3, transcript.Contributions())
+
+	hash, err := transcript.Hash()
+	assert.Nil(t, err)
+
+	provingKey, verifyingKey, err := transcript.ExtractKeys(cs, phase1)
+	assert.Nil(t, err)
+
+	hashAfterExtraction, err := transcript.Hash()
+	assert.Nil(t, err)
+	assert.Equal(t, hash, hashAfterExtraction)
+
+	witness, err := frontend.NewWitness(&cubeCircuit{X: 3, Y: 27}, ecc.BN254.ScalarField())
+	assert.Nil(t, err)
+	publicWitness, err := witness.Public()
+	assert.Nil(t, err)
+
+	proof, err := groth16.Prove(cs, provingKey, witness)
+	assert.Nil(t, err)
+	assert.Nil(t, groth16.Verify(proof, verifyingKey, publicWitness))
+}
+
+func TestCeremony_HashIdentifiesTranscript(t *testing.T) {
+	cs := compileCubeCircuit(t)
+
+	transcript, err := Begin(cs, powersOfTau(2))
+	assert.Nil(t, err)
+	assert.Nil(t, transcript.Contribute())
+
+	hash, err := transcript.Hash()
+	assert.Nil(t, err)
+	receivedHash, err := roundTrip(t, transcript).Hash()
+	assert.Nil(t, err)
+	assert.Equal(t, hash, receivedHash)
+
+	assert.Nil(t, transcript.Contribute())
+	nextHash, err := transcript.Hash()
+	assert.Nil(t, err)
+	assert.NotEqual(t, hash, nextHash)
+}
+
+func TestCeremony_TamperedContributionIsRejected(t *testing.T) {
+	cs := compileCubeCircuit(t)
+	phase1 := powersOfTau(2)
+
+	transcript, err := Begin(cs, phase1)
+	assert.Nil(t, err)
+	assert.Nil(t, transcript.Contribute())
+	assert.Nil(t, transcript.Contribute())
+
+	// swap in the delta of a contribution that did not build on the previous one
+	forged, err := Begin(cs, phase1)
+	assert.Nil(t, err)
+	assert.Nil(t, forged.Contribute())
+	transcript.states[2].Parameters.G1.Delta = forged.states[1].Parameters.G1.Delta
+
+	assert.NotNil(t, transcript.VerifyContributions())
+	assert.NotNil(t, transcript.Contribute())
+
+	_, _, err = transcript.ExtractKeys(cs, phase1)
+	assert.NotNil(t, err)
+}
+
+func TestCeremony_TranscriptFromOtherPowersOfTau(t *testing.T) {
+	cs := compileCubeCircuit(t)
+
+	transcript, err := Begin(cs, powersOfTau(2))
+	assert.Nil(t, err)
+	assert.Nil(t, transcript.Contribute())
+
+	assert.Nil(t, transcript.VerifyContributions())
+	assert.NotNil(t, transcript.Verify(cs, powersOfTau(2)))
+}
+
+func TestCeremony_ExtractKeysWithoutContributions(t *testing.T) {
+	cs := compileCubeCircuit(t)
+	phase1 := powersOfTau(2)
+
+	transcript, err := Begin(cs, phase1)
+	assert.Nil(t, err)
+
+	_, _, err = transcript.ExtractKeys(cs, phase1)
+
+	assert.NotNil(t, err)
+}
+
+func TestBegin_PowersOfTauTooSmall(t *testing.T) {
+	_, err := Begin(compileCubeCircuit(t), powersOfTau(0))
+
+	assert.NotNil(t, err)
+}
+
+func TestReadPhase1(t *testing.T) {
+	var buffer bytes.Buffer
+	_, err := powersOfTau(2).WriteTo(&buffer)
+	assert.Nil(t, err)
+
+	phase1, err := ReadPhase1(&buffer)
+
+	assert.Nil(t, err)
+	assert.Len(t, phase1.Parameters.G2.Tau, 4)
+}
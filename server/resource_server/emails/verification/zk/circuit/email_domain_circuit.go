@@ -0,0 +1,140 @@
+package circuit
+
+import (
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/hash/mimc"
+	"github.com/consensys/gnark/std/math/bits"
+	"globe-and-citizen/layer8/server/resource_server/utils"
+)
+
+// EmailDomainCircuit proves to a client that the domain of a user's verified
+// email address is a leaf of the Merkle tree with root DomainSetRoot.
+//
+// Only the root, the tag of the client, the nullifier and the commitment to
+// the domain are public. The nullifier hashes a secret key of the user with
+// the domain and the client tag: a client gets the same nullifier in every
+// proof about the user, and cannot link it to the proofs other clients get.
+// DomainCommitment hashes the domain with the same key, and is the one the
+// MimcCircuit proof of the user's email verification outputs, which ties the
+// domain to the verified address. For a set of a single domain the root
+// reveals that domain, for larger sets only that the domain is one of them.
+type EmailDomainCircuit struct {
+	DomainSetRoot    frontend.Variable `gnark:",public"`
+	ClientTag        frontend.Variable `gnark:",public"`
+	Nullifier        frontend.Variable `gnark:",public"`
+	DomainCommitment frontend.Variable `gnark:",public"`
+
+	// Domain is packed as utils.StringToFrElements does
+	Domain            [utils.EmailDomainFrRepresentationSize]frontend.Variable `gnark:",secret"`
+	NullifierKey      frontend.Variable                                        `gnark:",secret"`
+	MerklePath        [utils.EmailDomainSetDepth]frontend.Variable             `gnark:",secret"`
+	MerklePathIndices [utils.EmailDomainSetDepth]frontend.Variable             `gnark:",secret"`
+}
+
+const runesPerElement = utils.MaxInputLength / utils.InputFrRepresentationSize
+
+func NewEmailDomainCircuit() *EmailDomainCircuit {
+	return new(EmailDomainCircuit)
+}
+
+func (c *EmailDomainCircuit) Define(api frontend.API) error {
+	hasher, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+
+	hasher.Write(c.Domain[:]...)
+	leaf := hasher.Sum()
+
+	node := leaf
+	for level := 0; level < utils.EmailDomainSetDepth; level++ {
+		api.AssertIsBoolean(c.MerklePathIndices[level])
+
+		left := api.Select(c.MerklePathIndices[level], c.MerklePath[level], node)
+		right := api.Select(c.MerklePathIndices[level], node, c.MerklePath[level])
+
+		hasher.Reset()
+		hasher.Write(left, right)
+		node = hasher.Sum()
+	}
+
+	api.AssertIsEqual(node, c.DomainSetRoot)
+
+	hasher.Reset()
+	hasher.Write(c.NullifierKey, leaf, c.ClientTag)
+	api.AssertIsEqual(hasher.Sum(), c.Nullifier)
+
+	hasher.Reset()
+	hasher.Write(leaf, c.NullifierKey)
+	api.AssertIsEqual(hasher.Sum(), c.DomainCommitment)
+
+	return nil
+}
+
+// emailDomainCommitment returns the commitment to the domain of an email
+// address, MiMC(leaf, nullifierKey) with the leaf of EmailDomainCircuit, when
+// atIndex is the position of its last '@' and the domain fits into the
+// packed domain. It returns zero otherwise.
+func emailDomainCommitment(
+	api frontend.API, inputBits [][]frontend.Variable, atIndex frontend.Variable, nullifierKey frontend.Variable,
+) (frontend.Variable, error) {
+	runes := make([]frontend.Variable, 0, utils.MaxInputLength)
+	for _, elementBits := range inputBits {
+		for j := 0; j < runesPerElement; j++ {
+			runeBits := elementBits[j*utils.RuneBitSize : (j+1)*utils.RuneBitSize]
+			runes = append(runes, bits.FromBinary(api, runeBits, bits.WithUnconstrainedInputs()))
+		}
+	}
+
+	// shift the address left so that it starts at atIndex
+	shiftBitCount := 0
+	for 1<<shiftBitCount <= utils.MaxInputLength {
+		shiftBitCount++
+	}
+	shiftBits := bits.ToBinary(api, atIndex, bits.WithNbDigits(shiftBitCount))
+
+	for level, shiftBit := range shiftBits {
+		step := 1 << level
+		shifted := make([]frontend.Variable, len(runes))
+		for i := range runes {
+			next := frontend.Variable(0)
+			if i+step < len(runes) {
+				next = runes[i+step]
+			}
+			shifted[i] = api.Select(shiftBit, next, runes[i])
+		}
+		runes = shifted
+	}
+
+	isDomain := api.IsZero(api.Sub(runes[0], '@'))
+
+	domain := runes[1 : 1+utils.MaxEmailDomainLength]
+	for _, domainRune := range domain {
+		// the '@' must be the last one
+		isDomain = api.Mul(isDomain, api.Sub(1, api.IsZero(api.Sub(domainRune, '@'))))
+	}
+	// the domain must end within the runes packed into the leaf
+	for _, tailRune := range runes[1+utils.MaxEmailDomainLength:] {
+		isDomain = api.Mul(isDomain, api.IsZero(tailRune))
+	}
+
+	hasher, err := mimc.NewMiMC(api)
+	if err != nil {
+		return nil, err
+	}
+
+	// pack the domain as utils.StringToFrElements does
+	for i := 0; i < utils.EmailDomainFrRepresentationSize; i++ {
+		element := frontend.Variable(0)
+		for j := runesPerElement - 1; j >= 0; j-- {
+			element = api.Add(api.Mul(element, 1<<utils.RuneBitSize), domain[i*runesPerElement+j])
+		}
+		hasher.Write(element)
+	}
+	leaf := hasher.Sum()
+
+	hasher.Reset()
+	hasher.Write(leaf, nullifierKey)
+
+	return api.Select(isDomain, hasher.Sum(), 0), nil
+}
@@ -0,0 +1,178 @@
+package circuit_test
+
+import (
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/test"
+
+	"globe-and-citizen/layer8/server/resource_server/emails/verification/code"
+	"globe-and-citizen/layer8/server/resource_server/emails/verification/zk"
+	"globe-and-citizen/layer8/server/resource_server/emails/verification/zk/circuit"
+	"globe-and-citizen/layer8/server/resource_server/models"
+	"globe-and-citizen/layer8/server/resource_server/utils"
+	"globe-and-citizen/layer8/server/zkverify"
+)
+
+const domainClientID = "notTanklsRVKvWkRnbEYaQwTXgCgcBDh"
+
+var (
+	nullifierKey      = []byte("a user's 32 byte nullifier key..")
+	universityDomains = []string{"mit.edu", "ox.ac.uk", "gmail.com", "uni-heidelberg.de"}
+)
+
+func emailDomainAssignment(t *testing.T, domains []string, domain string) *circuit.EmailDomainCircuit {
+	set, err := zkverify.NewEmailDomainSet(domains)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assignment, err := zk.NewEmailDomainAssignment(domain, nullifierKey, domainClientID, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return assignment
+}
+
+func TestEmailDomainCircuit_DomainInSet(t *testing.T) {
+	assignment := emailDomainAssignment(t, universityDomains, "gmail.com")
+
+	err := test.IsSolved(circuit.NewEmailDomainCircuit(), assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatalf("expected the circuit to be solved: %v", err)
+	}
+}
+
+func TestEmailDomainCircuit_SingleDomain(t *testing.T) {
+	assignment := emailDomainAssignment(t, []string{"gmail.com"}, "gmail.com")
+
+	err := test.IsSolved(circuit.NewEmailDomainCircuit(), assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatalf("expected the circuit to be solved: %v", err)
+	}
+}
+
+func TestEmailDomainCircuit_DomainNotInSet(t *testing.T) {
+	// a valid path of another domain does not lead to the root
+	assignment := emailDomainAssignment(t, universityDomains, "mit.edu")
+	elements, err := utils.StringToFrElements("acme.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range assignment.Domain {
+		assignment.Domain[i] = elements[i]
+	}
+
+	err = test.IsSolved(circuit.NewEmailDomainCircuit(), assignment, ecc.BN254.ScalarField())
+	if err == nil {
+		t.Fatal("expected the circuit not to be solved")
+	}
+}
+
+func TestEmailDomainCircuit_NullifierOfAnotherClient(t *testing.T) {
+	assignment := emailDomainAssignment(t, universityDomains, "gmail.com")
+	assignment.ClientTag = zkverify.EmailDomainClientTag("another client")
+
+	err := test.IsSolved(circuit.NewEmailDomainCircuit(), assignment, ecc.BN254.ScalarField())
+	if err == nil {
+		t.Fatal("expected the circuit not to be solved")
+	}
+}
+
+func TestEmailDomainCircuit_AnotherNullifierKey(t *testing.T) {
+	assignment := emailDomainAssignment(t, universityDomains, "gmail.com")
+	assignment.NullifierKey = zkverify.EmailDomainNullifierKey([]byte("another user's key"))
+
+	err := test.IsSolved(circuit.NewEmailDomainCircuit(), assignment, ecc.BN254.ScalarField())
+	if err == nil {
+		t.Fatal("expected the circuit not to be solved")
+	}
+}
+
+const (
+	email            = "myemail@gmail.com"
+	salt             = "ajdjsjsaafktyowqqrtgpowrkdkdkfak"
+	verificationCode = "724b2c"
+)
+
+func verificationCodeOf(input string) (string, error) {
+	return code.NewMIMCCodeGenerator().GenerateCode(&models.User{Salt: salt}, input)
+}
+
+func TestMimcCircuit_CommitsToEmailDomain(t *testing.T) {
+	assignment, err := zk.NewVerificationCodeAssignment(email, salt, verificationCode, nullifierKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = test.IsSolved(circuit.NewMimcCircuit(), assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatalf("expected the circuit to be solved: %v", err)
+	}
+
+	// the proofs of the domain take the commitment the verification outputs
+	domainAssignment := emailDomainAssignment(t, universityDomains, "gmail.com")
+	if assignment.DomainCommitment != domainAssignment.DomainCommitment {
+		t.Fatal("expected the commitments of both circuits to match")
+	}
+}
+
+func TestMimcCircuit_CommitmentToAnotherDomain(t *testing.T) {
+	assignment, err := zk.NewVerificationCodeAssignment(email, salt, verificationCode, nullifierKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment.DomainCommitment = emailDomainAssignment(t, universityDomains, "mit.edu").DomainCommitment
+
+	err = test.IsSolved(circuit.NewMimcCircuit(), assignment, ecc.BN254.ScalarField())
+	if err == nil {
+		t.Fatal("expected the circuit not to be solved")
+	}
+}
+
+func TestMimcCircuit_DomainAfterAnotherAt(t *testing.T) {
+	const input = "my@email@gmail.com"
+	code, err := verificationCodeOf(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assignment, err := zk.NewVerificationCodeAssignment(input, salt, code, nullifierKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "email@gmail.com" is not a domain, the commitment cannot be to it
+	commitment, err := zkverify.EmailDomainCommitment(nullifierKey, "email@gmail.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment.DomainCommitment, _ = zkverify.ParseEmailDomainCommitment(commitment)
+	assignment.AtIndex = 2
+
+	err = test.IsSolved(circuit.NewMimcCircuit(), assignment, ecc.BN254.ScalarField())
+	if err == nil {
+		t.Fatal("expected the circuit not to be solved")
+	}
+}
+
+func TestMimcCircuit_NoCommitmentForPhoneNumbers(t *testing.T) {
+	const input = "+15555550123"
+	code, err := verificationCodeOf(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assignment, err := zk.NewVerificationCodeAssignment(input, salt, code, nullifierKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = test.IsSolved(circuit.NewMimcCircuit(), assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatalf("expected the circuit to be solved: %v", err)
+	}
+	if assignment.DomainCommitment != 0 {
+		t.Fatal("expected no commitment")
+	}
+}
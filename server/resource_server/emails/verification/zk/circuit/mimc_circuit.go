@@ -7,11 +7,25 @@ import (
 	"globe-and-citizen/layer8/server/resource_server/utils"
 )
 
+// MimcCircuit proves that the secret input, an email address or a phone
+// number, mixed with the salt and hashed with MiMC yields the verification
+// code.
+//
+// For an email address it also outputs DomainCommitment, the commitment to
+// its domain that EmailDomainCircuit proves the same domain with, see
+// emailDomainCommitment. It is zero for phone numbers and for addresses
+// whose domain cannot be proved.
 type MimcCircuit struct {
 	SaltAsVariables  [utils.InputFrRepresentationSize]frontend.Variable `gnark:",public"`
 	InputAsVariables [utils.InputFrRepresentationSize]frontend.Variable `gnark:",secret"`
 
 	VerificationCode [utils.VerificationCodeSize]frontend.Variable `gnark:",public"`
+
+	DomainCommitment frontend.Variable `gnark:",public"`
+	// AtIndex is the position of the last '@' of an email address, any
+	// position past the input leaves DomainCommitment zero
+	AtIndex      frontend.Variable `gnark:",secret"`
+	NullifierKey frontend.Variable `gnark:",secret"`
 }
 
 func NewMimcCircuit() *MimcCircuit {
@@ -19,11 +33,47 @@ func NewMimcCircuit() *MimcCircuit {
 }
 
 func (c *MimcCircuit) Define(api frontend.API) error {
+	inputBits := elementBits(api, c.InputAsVariables)
+
+	code := verificationCode(api, c.SaltAsVariables, inputBits)
+
+	for i := 0; i < utils.VerificationCodeSize; i++ {
+		api.AssertIsEqual(code[i], c.VerificationCode[i])
+	}
+
+	commitment, err := emailDomainCommitment(api, inputBits, c.AtIndex, c.NullifierKey)
+	if err != nil {
+		return err
+	}
+	api.AssertIsEqual(commitment, c.DomainCommitment)
+
+	return nil
+}
+
+// elementBits returns the bits of every element, little endian.
+func elementBits(
+	api frontend.API, elements [utils.InputFrRepresentationSize]frontend.Variable,
+) [][]frontend.Variable {
+	elementsBits := make([][]frontend.Variable, len(elements))
+	for i := range elements {
+		elementsBits[i] = bits.ToBinary(api, elements[i])
+	}
+
+	return elementsBits
+}
+
+// verificationCode computes the code MIMCCodeGenerator derives from the input,
+// given by the bits of its elements, and the salt.
+func verificationCode(
+	api frontend.API,
+	salt [utils.InputFrRepresentationSize]frontend.Variable,
+	inputBits [][]frontend.Variable,
+) []frontend.Variable {
 	mimcInstance, _ := mimc.NewMiMC(api)
 
 	for i := 0; i < utils.InputFrRepresentationSize; i++ {
-		inputFrVariableBits := bits.ToBinary(api, c.InputAsVariables[i])
-		saltFrVariableBits := bits.ToBinary(api, c.SaltAsVariables[i])
+		inputFrVariableBits := inputBits[i]
+		saltFrVariableBits := bits.ToBinary(api, salt[i])
 
 		currentVariable := frontend.Variable(0)
 		powerOfTwo := frontend.Variable(1)
@@ -54,9 +104,5 @@ func (c *MimcCircuit) Define(api frontend.API) error {
 		ind++
 	}
 
-	for i := 0; i < utils.VerificationCodeSize; i++ {
-		api.AssertIsEqual(code[i], c.VerificationCode[i])
-	}
-
-	return nil
+	return code
 }
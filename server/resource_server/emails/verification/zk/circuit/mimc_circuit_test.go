@@ -36,6 +36,9 @@ func TestMimcCircuit_ProverSucceeded(t *testing.T) {
 			InputAsVariables: emailAsVariables,
 			SaltAsVariables:  saltAsVariables,
 			VerificationCode: codeAsVariables,
+			DomainCommitment: 0,
+			AtIndex:          utils.MaxInputLength,
+			NullifierKey:     0,
 		},
 		test.WithCurves(ecc.BN254),
 	)
@@ -67,6 +70,9 @@ func TestMimcCircuit_ProverFailed(t *testing.T) {
 			InputAsVariables: emailAsVariables,
 			SaltAsVariables:  saltAsVariables,
 			VerificationCode: codeAsVariables,
+			DomainCommitment: 0,
+			AtIndex:          utils.MaxInputLength,
+			NullifierKey:     0,
 		},
 		test.WithCurves(ecc.BN254),
 	)
@@ -0,0 +1,203 @@
+package zk
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/consensys/gnark/frontend"
+
+	serverModels "globe-and-citizen/layer8/server/models"
+	"globe-and-citizen/layer8/server/resource_server/emails/verification/zk/circuit"
+	"globe-and-citizen/layer8/server/resource_server/utils"
+	"globe-and-citizen/layer8/server/zkverify"
+)
+
+const maxEmailDomainSetNameLength = 64
+
+// AssignmentProver proves a full assignment of a circuit, as KeyManager does.
+type AssignmentProver interface {
+	Prove(assignment frontend.Circuit) ([]byte, uint, error)
+}
+
+// EmailDomainProver proves to a client that the domain of a user's verified
+// address is in the set made of that domain alone, which reveals the domain,
+// or in the configured sets that contain it, which do not. Proofs are made
+// for one client, see circuit.EmailDomainCircuit, and only for what the user
+// released to it.
+type EmailDomainProver struct {
+	prover AssignmentProver
+	sets   map[string]*zkverify.EmailDomainSet
+}
+
+func NewEmailDomainProver(prover AssignmentProver, domainSets map[string][]string) (*EmailDomainProver, error) {
+	sets := map[string]*zkverify.EmailDomainSet{}
+	for name, domains := range domainSets {
+		if name == "" || len(name) > maxEmailDomainSetNameLength {
+			return nil, fmt.Errorf("invalid email domain set name %q", name)
+		}
+
+		set, err := zkverify.NewEmailDomainSet(domains)
+		if err != nil {
+			return nil, fmt.Errorf("email domain set %s: %v", name, err)
+		}
+		sets[name] = set
+	}
+
+	return &EmailDomainProver{prover: prover, sets: sets}, nil
+}
+
+// LoadEmailDomainSets reads sets of domains from a JSON object mapping the
+// name of each set to its domains.
+func LoadEmailDomainSets(path string) (map[string][]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var domainSets map[string][]string
+	if err := json.Unmarshal(content, &domainSets); err != nil {
+		return nil, fmt.Errorf("failed to parse email domain sets: %v", err)
+	}
+
+	return domainSets, nil
+}
+
+// DomainSets returns the configured sets by name.
+func (p *EmailDomainProver) DomainSets() map[string]*zkverify.EmailDomainSet {
+	return p.sets
+}
+
+// ProveEmailDomain proves to clientID that the user's domain is in the set
+// made of that domain alone.
+func (p *EmailDomainProver) ProveEmailDomain(
+	emailDomain serverModels.UserEmailDomain, clientID string,
+) (serverModels.EmailDomainProof, error) {
+	ownSet, err := zkverify.NewEmailDomainSet([]string{emailDomain.Domain})
+	if err != nil {
+		return serverModels.EmailDomainProof{}, err
+	}
+
+	proof, err := p.prove(emailDomain, clientID, ownSet)
+	if err != nil {
+		return serverModels.EmailDomainProof{}, err
+	}
+	proof.Domain = &emailDomain.Domain
+
+	return proof, nil
+}
+
+// ProveEmailDomainMemberships proves to clientID that the user's domain is
+// in each configured set containing it, ordered by set name.
+func (p *EmailDomainProver) ProveEmailDomainMemberships(
+	emailDomain serverModels.UserEmailDomain, clientID string,
+) ([]serverModels.EmailDomainProof, error) {
+	names := make([]string, 0, len(p.sets))
+	for name, set := range p.sets {
+		if set.Contains(emailDomain.Domain) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	proofs := make([]serverModels.EmailDomainProof, 0, len(names))
+	for _, name := range names {
+		proof, err := p.prove(emailDomain, clientID, p.sets[name])
+		if err != nil {
+			return nil, fmt.Errorf("email domain set %s: %v", name, err)
+		}
+		proof.DomainSet = name
+		proofs = append(proofs, proof)
+	}
+
+	return proofs, nil
+}
+
+func (p *EmailDomainProver) prove(
+	emailDomain serverModels.UserEmailDomain, clientID string, set *zkverify.EmailDomainSet,
+) (serverModels.EmailDomainProof, error) {
+	assignment, err := NewEmailDomainAssignment(emailDomain.Domain, emailDomain.NullifierKey, clientID, set)
+	if err != nil {
+		return serverModels.EmailDomainProof{}, err
+	}
+
+	nullifier, err := zkverify.EmailDomainNullifier(emailDomain.NullifierKey, emailDomain.Domain, clientID)
+	if err != nil {
+		return serverModels.EmailDomainProof{}, err
+	}
+
+	proof, zkKeyPairID, err := p.prover.Prove(assignment)
+	if err != nil {
+		return serverModels.EmailDomainProof{}, fmt.Errorf("failed to generate the email domain proof: %v", err)
+	}
+
+	return serverModels.EmailDomainProof{
+		UserID:           emailDomain.UserID,
+		ClientID:         clientID,
+		DomainSetRoot:    set.Root(),
+		Nullifier:        nullifier,
+		DomainCommitment: emailDomain.DomainCommitment,
+		ZkProof:          proof,
+		ZkKeyPairID:      zkKeyPairID,
+	}, nil
+}
+
+// NewEmailDomainAssignment assigns every input of the email domain circuit
+// for a proof to clientID that domain is in set.
+func NewEmailDomainAssignment(
+	domain string, nullifierKey []byte, clientID string, set *zkverify.EmailDomainSet,
+) (*circuit.EmailDomainCircuit, error) {
+	siblings, isRight, err := set.Path(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := zkverify.ParseEmailDomainSetRoot(set.Root())
+	if err != nil {
+		return nil, err
+	}
+
+	nullifier, err := zkverify.EmailDomainNullifier(nullifierKey, domain, clientID)
+	if err != nil {
+		return nil, err
+	}
+	nullifierElement, err := zkverify.ParseEmailDomainNullifier(nullifier)
+	if err != nil {
+		return nil, err
+	}
+
+	commitment, err := zkverify.EmailDomainCommitment(nullifierKey, domain)
+	if err != nil {
+		return nil, err
+	}
+	commitmentElement, err := zkverify.ParseEmailDomainCommitment(commitment)
+	if err != nil {
+		return nil, err
+	}
+
+	domainElements, err := utils.StringToFrElements(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	assignment := circuit.NewEmailDomainCircuit()
+
+	assignment.DomainSetRoot = root
+	assignment.ClientTag = zkverify.EmailDomainClientTag(clientID)
+	assignment.Nullifier = nullifierElement
+	assignment.DomainCommitment = commitmentElement
+	for i := range assignment.Domain {
+		assignment.Domain[i] = domainElements[i]
+	}
+	assignment.NullifierKey = zkverify.EmailDomainNullifierKey(nullifierKey)
+	for level := range siblings {
+		assignment.MerklePath[level] = siblings[level]
+		assignment.MerklePathIndices[level] = 0
+		if isRight[level] {
+			assignment.MerklePathIndices[level] = 1
+		}
+	}
+
+	return assignment, nil
+}
@@ -0,0 +1,151 @@
+package zk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/consensys/gnark/frontend"
+	"github.com/stretchr/testify/assert"
+
+	serverModels "globe-and-citizen/layer8/server/models"
+	"globe-and-citizen/layer8/server/zkverify"
+)
+
+type assignmentProver struct {
+	calls int
+}
+
+func (p *assignmentProver) Prove(assignment frontend.Circuit) ([]byte, uint, error) {
+	p.calls++
+	return []byte("proof"), 4, nil
+}
+
+var testEmailDomainSets = map[string][]string{
+	"providers":    {"gmail.com", "outlook.com"},
+	"universities": {"mit.edu", "ox.ac.uk"},
+}
+
+const clientID = "notTanklsRVKvWkRnbEYaQwTXgCgcBDh"
+
+var userEmailDomain = serverModels.UserEmailDomain{
+	UserID:       3,
+	Domain:       "gmail.com",
+	NullifierKey: []byte("a user's 32 byte nullifier key.."),
+}
+
+func TestEmailDomainProver_ProofsVerify(t *testing.T) {
+	repository := &keyPairRepository{}
+	keyManager := NewKeyManager(repository, EmailDomainCircuit, RunEmailDomainSetup)
+	if err := keyManager.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	prover, err := NewEmailDomainProver(keyManager, testEmailDomainSets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emailDomain := userEmailDomain
+	emailDomain.DomainCommitment, err = zkverify.EmailDomainCommitment(emailDomain.NullifierKey, emailDomain.Domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	own, err := prover.ProveEmailDomain(emailDomain, clientID)
+	assert.Nil(t, err)
+	memberships, err := prover.ProveEmailDomainMemberships(emailDomain, clientID)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "gmail.com", *own.Domain)
+	assert.Equal(t, "", own.DomainSet)
+	assert.Len(t, memberships, 1)
+	assert.Nil(t, memberships[0].Domain)
+	assert.Equal(t, "providers", memberships[0].DomainSet)
+	assert.Equal(t, clientID, memberships[0].ClientID)
+	assert.Equal(t, uint(3), memberships[0].UserID)
+	// the client gets one pseudonym for the user's domain
+	assert.Equal(t, own.Nullifier, memberships[0].Nullifier)
+
+	verifyingKey, err := zkverify.ReadVerifyingKey(repository.keyPairs[0].VerifyingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commitment := emailDomain.DomainCommitment
+	assert.Equal(t, commitment, own.DomainCommitment)
+	assert.Equal(t, commitment, memberships[0].DomainCommitment)
+
+	gmailRoot, _ := zkverify.EmailDomainSetRoot("gmail.com")
+	assert.Equal(t, gmailRoot, own.DomainSetRoot)
+	assert.Nil(t, zkverify.VerifyEmailDomainProof(verifyingKey, own.ZkProof, gmailRoot, clientID, own.Nullifier, commitment))
+
+	providersRoot, _ := zkverify.EmailDomainSetRoot("outlook.com", "gmail.com")
+	proof := memberships[0]
+	assert.Nil(t, zkverify.VerifyEmailDomainProof(
+		verifyingKey, proof.ZkProof, providersRoot, clientID, proof.Nullifier, commitment,
+	))
+
+	universitiesRoot, _ := zkverify.EmailDomainSetRoot("mit.edu", "ox.ac.uk")
+	assert.NotNil(t, zkverify.VerifyEmailDomainProof(
+		verifyingKey, proof.ZkProof, universitiesRoot, clientID, proof.Nullifier, commitment,
+	))
+	// another client cannot pass the proof off as its own
+	assert.NotNil(t, zkverify.VerifyEmailDomainProof(
+		verifyingKey, proof.ZkProof, providersRoot, "another client", proof.Nullifier, commitment,
+	))
+	// nor can the proof be tied to the verification of another address
+	otherCommitment, _ := zkverify.EmailDomainCommitment([]byte("another user's nullifier key...."), "gmail.com")
+	assert.NotNil(t, zkverify.VerifyEmailDomainProof(
+		verifyingKey, proof.ZkProof, providersRoot, clientID, proof.Nullifier, otherCommitment,
+	))
+}
+
+func TestEmailDomainProver_NullifiersDifferBetweenClients(t *testing.T) {
+	prover, err := NewEmailDomainProver(&assignmentProver{}, testEmailDomainSets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proof, err := prover.ProveEmailDomain(userEmailDomain, clientID)
+	assert.Nil(t, err)
+	otherProof, err := prover.ProveEmailDomain(userEmailDomain, "another client")
+	assert.Nil(t, err)
+
+	assert.NotEqual(t, proof.Nullifier, otherProof.Nullifier)
+}
+
+func TestEmailDomainProver_DomainInNoSet(t *testing.T) {
+	assignments := &assignmentProver{}
+	prover, err := NewEmailDomainProver(assignments, testEmailDomainSets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emailDomain := userEmailDomain
+	emailDomain.Domain = "acme.com"
+	proofs, err := prover.ProveEmailDomainMemberships(emailDomain, clientID)
+
+	assert.Nil(t, err)
+	assert.Empty(t, proofs)
+	assert.Equal(t, 0, assignments.calls)
+}
+
+func TestNewEmailDomainProver_InvalidSetName(t *testing.T) {
+	_, err := NewEmailDomainProver(&assignmentProver{}, map[string][]string{"": {"mit.edu"}})
+
+	assert.NotNil(t, err)
+}
+
+func TestLoadEmailDomainSets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "email_domain_sets.json")
+	err := os.WriteFile(path, []byte(`{"universities": ["mit.edu", "ox.ac.uk"]}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	domainSets, err := LoadEmailDomainSets(path)
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{"universities": {"mit.edu", "ox.ac.uk"}}, domainSets)
+}
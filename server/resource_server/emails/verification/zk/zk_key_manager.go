@@ -0,0 +1,362 @@
+package zk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"globe-and-citizen/layer8/server/resource_server/models"
+	"globe-and-citizen/layer8/server/resource_server/utils"
+	"globe-and-citizen/layer8/server/zkverify"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"gorm.io/gorm"
+)
+
+// ErrUnknownZkKeyPair is returned for proofs made with a key pair that does
+// not exist or was retired.
+var ErrUnknownZkKeyPair = errors.New("unknown or retired zk key pair")
+
+type KeyPairRepository interface {
+	GetLatestZkSnarksKeys(circuit string) (models.ZkSnarksKeyPair, error)
+	GetZkSnarksVerifyingKey(id uint) (models.ZkSnarksKeyPair, error)
+	GetZkSnarksVerifyingKeys() ([]models.ZkSnarksKeyPair, error)
+	RotateZkSnarksKeyPair(
+		circuit string, due func(active *models.ZkSnarksKeyPair) bool, generate func() models.ZkSnarksKeyPair,
+	) (bool, error)
+	RetireZkSnarksKeyPairs(ids []uint, retiredAt time.Time) error
+	MarkZkProofsToReprove(keyPairIDs []uint, reproveBy time.Time) (int, error)
+	ResetProofsOfRetiredZkKeyPairs() (int, error)
+}
+
+// SetupFunc runs the Groth16 setup of a circuit.
+type SetupFunc func() (constraint.ConstraintSystem, groth16.ProvingKey, groth16.VerifyingKey)
+
+// Circuit is a circuit whose key pairs a KeyManager manages.
+type Circuit struct {
+	// Name tells the key pairs of the circuit apart from those of others
+	Name    string
+	Compile func() constraint.ConstraintSystem
+}
+
+var (
+	VerificationCodeCircuit = Circuit{Name: models.ZkCircuitVerificationCode, Compile: GenerateConstraintSystem}
+	EmailDomainCircuit      = Circuit{Name: models.ZkCircuitEmailDomain, Compile: GenerateEmailDomainConstraintSystem}
+)
+
+// KeyManager proves with the newest key pair and verifies with whichever key
+// pair a proof names. Superseded key pairs keep verifying until they are
+// retired, which gives users time to verify their attributes again. The
+// database is the source of truth shared by every server instance: key pairs
+// are rotated under a database lock, and a proof naming a key pair this
+// instance has not loaded yet is checked with the key read from the database.
+type KeyManager struct {
+	repository KeyPairRepository
+	circuit    Circuit
+	setup      SetupFunc
+
+	mu              sync.RWMutex
+	cs              constraint.ConstraintSystem
+	activeID        uint
+	activeCreatedAt time.Time
+	// activeFromCeremony is set when the active key pair came from a
+	// multi-party setup ceremony, scheduled rotation must not replace it
+	activeFromCeremony bool
+	provingKey         groth16.ProvingKey
+	verifyingKeys      map[uint]groth16.VerifyingKey
+}
+
+func NewKeyManager(repository KeyPairRepository, circuit Circuit, setup SetupFunc) *KeyManager {
+	return &KeyManager{
+		repository:    repository,
+		circuit:       circuit,
+		setup:         setup,
+		verifyingKeys: map[uint]groth16.VerifyingKey{},
+	}
+}
+
+// Load reads every key pair of the circuit that is not retired and makes the
+// newest one active. When there is none yet, or the newest one was generated
+// for an earlier version of the circuit, a new key pair is generated.
+func (km *KeyManager) Load() error {
+	_, err := km.repository.RotateZkSnarksKeyPair(km.circuit.Name, func(active *models.ZkSnarksKeyPair) bool {
+		return active == nil || km.outdated(active)
+	}, km.generate)
+	if err != nil {
+		return fmt.Errorf("error while generating the first zk-snarks key pair: %v", err)
+	}
+
+	return km.sync()
+}
+
+// Rotate generates a new key pair and proves with it from now on. Proofs made
+// with the previous key pairs stay verifiable until Maintain retires them.
+// They are not made again under the new key pair: that takes the email
+// address or phone number they prove, which are never stored.
+func (km *KeyManager) Rotate() error {
+	_, err := km.repository.RotateZkSnarksKeyPair(km.circuit.Name, func(*models.ZkSnarksKeyPair) bool {
+		return true
+	}, km.generate)
+	if err != nil {
+		return fmt.Errorf("error while saving zk-snarks key pair: %v", err)
+	}
+
+	return km.sync()
+}
+
+// Maintain rotates the active key pair once it is older than rotationInterval
+// and retires the key pairs it superseded gracePeriod ago. A proof cannot be
+// moved to the new key pair by the server, which never stores the email
+// address or phone number it proves, only the user can prove them again.
+// So until the retirement users whose proofs were made with a superseded key
+// pair stay verified, with the retirement as the reprove_by deadline the
+// profile and the zk metadata report. An attribute not verified again by then
+// lapses: its proof is dropped and it reads as unverified. A zero
+// rotationInterval disables scheduled rotation, and so does an active key pair
+// from a setup ceremony: it is replaced by running a new ceremony. An active
+// key pair of an earlier version of the circuit is always replaced. Every
+// server instance may run Maintain, the database serializes the rotation.
+func (km *KeyManager) Maintain(now time.Time, rotationInterval time.Duration, gracePeriod time.Duration) error {
+	_, err := km.repository.RotateZkSnarksKeyPair(km.circuit.Name, func(active *models.ZkSnarksKeyPair) bool {
+		if active == nil || km.outdated(active) {
+			return true
+		}
+		return rotationInterval > 0 &&
+			active.TranscriptHash == nil && !now.Before(active.CreatedAt.Add(rotationInterval))
+	}, km.generate)
+	if err != nil {
+		return fmt.Errorf("error while rotating zk-snarks key pair: %v", err)
+	}
+
+	// picks up rotations and retirements of other server instances too
+	if err := km.sync(); err != nil {
+		return err
+	}
+
+	km.mu.RLock()
+	activeID := km.activeID
+	retireAt := km.activeCreatedAt.Add(gracePeriod)
+	var superseded []uint
+	for id := range km.verifyingKeys {
+		if id != activeID {
+			superseded = append(superseded, id)
+		}
+	}
+	km.mu.RUnlock()
+
+	if len(superseded) > 0 && now.Before(retireAt) {
+		marked, err := km.repository.MarkZkProofsToReprove(superseded, retireAt)
+		if err != nil {
+			return fmt.Errorf("error while asking users to verify again: %v", err)
+		}
+		if marked > 0 {
+			log.Printf("Asked for %d verifications proved with superseded zk-snarks key pairs to be repeated by %s", marked, retireAt)
+		}
+	}
+
+	if len(superseded) > 0 && !now.Before(retireAt) {
+		if err := km.repository.RetireZkSnarksKeyPairs(superseded, now); err != nil {
+			return fmt.Errorf("error while retiring zk-snarks key pairs: %v", err)
+		}
+
+		km.mu.Lock()
+		for _, id := range superseded {
+			delete(km.verifyingKeys, id)
+		}
+		km.mu.Unlock()
+	}
+
+	reset, err := km.repository.ResetProofsOfRetiredZkKeyPairs()
+	if err != nil {
+		return fmt.Errorf("error while resetting proofs of retired zk-snarks key pairs: %v", err)
+	}
+	if reset > 0 {
+		log.Printf("Reset %d verifications proved with retired zk-snarks key pairs", reset)
+	}
+
+	return nil
+}
+
+// outdated reports whether a key pair was generated for an earlier version of
+// the circuit, with other public inputs. It cannot prove the circuit any more
+// and is replaced even when it came from a setup ceremony.
+func (km *KeyManager) outdated(keyPair *models.ZkSnarksKeyPair) bool {
+	verifyingKey, err := zkverify.ReadVerifyingKey(keyPair.VerifyingKey)
+	if err != nil {
+		// sync reports unreadable keys
+		return false
+	}
+
+	km.mu.Lock()
+	if km.cs == nil {
+		km.cs = km.circuit.Compile()
+	}
+	publicInputs := km.cs.GetNbPublicVariables() - 1 // without the constant wire
+	km.mu.Unlock()
+
+	if verifyingKey.NbPublicWitness() == publicInputs {
+		return false
+	}
+
+	log.Printf(
+		"zk-snarks key pair %d has %d public inputs and the %s circuit %d, replacing it",
+		keyPair.ID, verifyingKey.NbPublicWitness(), km.circuit.Name, publicInputs,
+	)
+	return true
+}
+
+// generate runs the setup of the circuit for a rotation.
+func (km *KeyManager) generate() models.ZkSnarksKeyPair {
+	cs, provingKey, verifyingKey := km.setup()
+
+	km.mu.Lock()
+	km.cs = cs
+	km.mu.Unlock()
+
+	return models.ZkSnarksKeyPair{
+		Circuit:      km.circuit.Name,
+		ProvingKey:   utils.WriteBytes(provingKey),
+		VerifyingKey: utils.WriteBytes(verifyingKey),
+		CreatedAt:    time.Now().UTC(),
+	}
+}
+
+// sync replaces the key pairs in memory with those of the circuit that are
+// not retired in the database. The proving key is read again only when the
+// newest key pair changed.
+func (km *KeyManager) sync() error {
+	keyPairs, err := km.repository.GetZkSnarksVerifyingKeys()
+	if err != nil {
+		return fmt.Errorf("error while reading zk-snarks verifying keys: %v", err)
+	}
+
+	verifyingKeys := map[uint]groth16.VerifyingKey{}
+	for _, keyPair := range keyPairs {
+		if keyPair.Circuit != km.circuit.Name || keyPair.RetiredAt != nil {
+			continue
+		}
+
+		verifyingKey, err := zkverify.ReadVerifyingKey(keyPair.VerifyingKey)
+		if err != nil {
+			return fmt.Errorf("zk key pair %d: %v", keyPair.ID, err)
+		}
+		verifyingKeys[keyPair.ID] = verifyingKey
+	}
+
+	latest, err := km.repository.GetLatestZkSnarksKeys(km.circuit.Name)
+	if err != nil {
+		return fmt.Errorf("error while reading zk-snarks keys from the database: %v", err)
+	}
+
+	km.mu.RLock()
+	provingKey := km.provingKey
+	if latest.ID != km.activeID {
+		provingKey = nil
+	}
+	km.mu.RUnlock()
+
+	if provingKey == nil {
+		provingKey = groth16.NewProvingKey(ecc.BN254)
+		utils.ReadBytes[groth16.ProvingKey](provingKey, latest.ProvingKey)
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if km.cs == nil {
+		km.cs = km.circuit.Compile()
+	}
+	km.activeID = latest.ID
+	km.activeCreatedAt = latest.CreatedAt
+	km.activeFromCeremony = latest.TranscriptHash != nil
+	km.provingKey = provingKey
+	km.verifyingKeys = verifyingKeys
+
+	return nil
+}
+
+func (km *KeyManager) GenerateProof(
+	input string, salt string, verificationCode string, nullifierKey []byte,
+) ([]byte, uint, error) {
+	km.mu.RLock()
+	processor := NewProofProcessor(km.cs, km.activeID, km.provingKey, km.verifyingKeys[km.activeID])
+	km.mu.RUnlock()
+
+	return processor.GenerateProof(input, salt, verificationCode, nullifierKey)
+}
+
+// Prove proves an assignment of the circuit with the active key pair and
+// returns the proof with the ID of that key pair.
+func (km *KeyManager) Prove(assignment frontend.Circuit) ([]byte, uint, error) {
+	km.mu.RLock()
+	cs, activeID, provingKey := km.cs, km.activeID, km.provingKey
+	km.mu.RUnlock()
+
+	witness, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		return nil, 0, fmt.Errorf("error while generating zk-snarks witness: %v", err)
+	}
+
+	proof, err := groth16.Prove(cs, provingKey, witness)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var proofBytes bytes.Buffer
+	if _, err := proof.WriteTo(&proofBytes); err != nil {
+		return nil, 0, fmt.Errorf("error while writing proof to byte buffer: %v", err)
+	}
+
+	return proofBytes.Bytes(), activeID, nil
+}
+
+func (km *KeyManager) VerifyProof(
+	zkKeyPairID uint, verificationCode string, salt string, domainCommitment string, proofBytes []byte,
+) error {
+	verifyingKey, err := km.verifyingKey(zkKeyPairID)
+	if err != nil {
+		return err
+	}
+
+	return zkverify.VerifyProof(verifyingKey, proofBytes, salt, verificationCode, domainCommitment)
+}
+
+// verifyingKey returns the verifying key of a key pair of the circuit that is
+// not retired. A key pair another server instance rotated to is read from the
+// database.
+func (km *KeyManager) verifyingKey(id uint) (groth16.VerifyingKey, error) {
+	km.mu.RLock()
+	verifyingKey, ok := km.verifyingKeys[id]
+	km.mu.RUnlock()
+
+	if ok {
+		return verifyingKey, nil
+	}
+
+	keyPair, err := km.repository.GetZkSnarksVerifyingKey(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUnknownZkKeyPair
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while reading zk-snarks verifying key: %v", err)
+	}
+	if keyPair.Circuit != km.circuit.Name || keyPair.RetiredAt != nil {
+		return nil, ErrUnknownZkKeyPair
+	}
+
+	verifyingKey, err = zkverify.ReadVerifyingKey(keyPair.VerifyingKey)
+	if err != nil {
+		return nil, fmt.Errorf("zk key pair %d: %v", keyPair.ID, err)
+	}
+
+	km.mu.Lock()
+	km.verifyingKeys[id] = verifyingKey
+	km.mu.Unlock()
+
+	return verifyingKey, nil
+}
@@ -0,0 +1,276 @@
+package zk
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+
+	"globe-and-citizen/layer8/server/resource_server/models"
+	"globe-and-citizen/layer8/server/resource_server/utils"
+)
+
+type keyPairRepository struct {
+	keyPairs    []models.ZkSnarksKeyPair
+	reproveBy   map[uint]time.Time
+	resetCalled int
+}
+
+func (r *keyPairRepository) RotateZkSnarksKeyPair(
+	circuit string, due func(active *models.ZkSnarksKeyPair) bool, generate func() models.ZkSnarksKeyPair,
+) (bool, error) {
+	var active *models.ZkSnarksKeyPair
+	if latest, err := r.GetLatestZkSnarksKeys(circuit); err == nil {
+		active = &latest
+	}
+	if !due(active) {
+		return false, nil
+	}
+
+	keyPair := generate()
+	keyPair.ID = uint(len(r.keyPairs) + 1)
+	keyPair.Circuit = circuit
+	r.keyPairs = append(r.keyPairs, keyPair)
+	return true, nil
+}
+
+func (r *keyPairRepository) GetZkSnarksVerifyingKey(id uint) (models.ZkSnarksKeyPair, error) {
+	if id == 0 || int(id) > len(r.keyPairs) {
+		return models.ZkSnarksKeyPair{}, gorm.ErrRecordNotFound
+	}
+	return r.keyPairs[id-1], nil
+}
+
+func (r *keyPairRepository) GetLatestZkSnarksKeys(circuit string) (models.ZkSnarksKeyPair, error) {
+	for i := len(r.keyPairs) - 1; i >= 0; i-- {
+		if r.keyPairs[i].Circuit == circuit && r.keyPairs[i].RetiredAt == nil {
+			return r.keyPairs[i], nil
+		}
+	}
+	return models.ZkSnarksKeyPair{}, gorm.ErrRecordNotFound
+}
+
+func (r *keyPairRepository) GetZkSnarksVerifyingKeys() ([]models.ZkSnarksKeyPair, error) {
+	return r.keyPairs, nil
+}
+
+func (r *keyPairRepository) RetireZkSnarksKeyPairs(ids []uint, retiredAt time.Time) error {
+	for _, id := range ids {
+		r.keyPairs[id-1].RetiredAt = &retiredAt
+	}
+	return nil
+}
+
+func (r *keyPairRepository) MarkZkProofsToReprove(keyPairIDs []uint, reproveBy time.Time) (int, error) {
+	if r.reproveBy == nil {
+		r.reproveBy = map[uint]time.Time{}
+	}
+	for _, id := range keyPairIDs {
+		r.reproveBy[id] = reproveBy
+	}
+	return len(keyPairIDs), nil
+}
+
+func (r *keyPairRepository) ResetProofsOfRetiredZkKeyPairs() (int, error) {
+	r.resetCalled++
+	return 0, nil
+}
+
+var (
+	setupOnce         sync.Once
+	setupCS           constraint.ConstraintSystem
+	setupProvingKey   groth16.ProvingKey
+	setupVerifyingKey groth16.VerifyingKey
+)
+
+// cachedSetup runs the Groth16 setup once for every test in the package; the
+// key manager only cares that each rotation stores a key pair under a new ID.
+func cachedSetup() (constraint.ConstraintSystem, groth16.ProvingKey, groth16.VerifyingKey) {
+	setupOnce.Do(func() {
+		setupCS, setupProvingKey, setupVerifyingKey = RunZkSnarksSetup()
+	})
+	return setupCS, setupProvingKey, setupVerifyingKey
+}
+
+func TestKeyManager_LoadGeneratesFirstKeyPair(t *testing.T) {
+	repository := &keyPairRepository{}
+	keyManager := NewKeyManager(repository, VerificationCodeCircuit, cachedSetup)
+
+	err := keyManager.Load()
+
+	assert.Nil(t, err)
+	assert.Len(t, repository.keyPairs, 1)
+}
+
+func TestKeyManager_LoadIgnoresKeyPairsOfOtherCircuits(t *testing.T) {
+	repository := &keyPairRepository{keyPairs: []models.ZkSnarksKeyPair{
+		{ID: 1, Circuit: models.ZkCircuitEmailDomain, VerifyingKey: []byte("not a verification code key")},
+	}}
+	keyManager := NewKeyManager(repository, VerificationCodeCircuit, cachedSetup)
+
+	err := keyManager.Load()
+
+	assert.Nil(t, err)
+	assert.Len(t, repository.keyPairs, 2)
+	assert.Equal(t, models.ZkCircuitVerificationCode, repository.keyPairs[1].Circuit)
+}
+
+func TestKeyManager_ProofsOfPreviousKeyPairStayVerifiable(t *testing.T) {
+	repository := &keyPairRepository{}
+	keyManager := NewKeyManager(repository, VerificationCodeCircuit, cachedSetup)
+	assert.Nil(t, keyManager.Load())
+
+	proof, oldKeyPairID, err := keyManager.GenerateProof(email, salt, "724b2c", nil)
+	assert.Nil(t, err)
+
+	assert.Nil(t, keyManager.Rotate())
+
+	_, newKeyPairID, err := keyManager.GenerateProof(email, salt, "724b2c", nil)
+	assert.Nil(t, err)
+	assert.NotEqual(t, oldKeyPairID, newKeyPairID)
+
+	assert.Nil(t, keyManager.VerifyProof(oldKeyPairID, "724b2c", salt, "", proof))
+
+	// a restarted server loads every key pair that is not retired
+	restarted := NewKeyManager(repository, VerificationCodeCircuit, cachedSetup)
+	assert.Nil(t, restarted.Load())
+	assert.Nil(t, restarted.VerifyProof(oldKeyPairID, "724b2c", salt, "", proof))
+}
+
+func TestKeyManager_VerifyProofWithUnknownKeyPair(t *testing.T) {
+	keyManager := NewKeyManager(&keyPairRepository{}, VerificationCodeCircuit, cachedSetup)
+	assert.Nil(t, keyManager.Load())
+
+	err := keyManager.VerifyProof(42, "724b2c", salt, "", []byte{})
+
+	assert.ErrorIs(t, err, ErrUnknownZkKeyPair)
+}
+
+func TestKeyManager_MaintainRotatesAndRetires(t *testing.T) {
+	repository := &keyPairRepository{}
+	keyManager := NewKeyManager(repository, VerificationCodeCircuit, cachedSetup)
+	assert.Nil(t, keyManager.Load())
+
+	proof, oldKeyPairID, err := keyManager.GenerateProof(email, salt, "724b2c", nil)
+	assert.Nil(t, err)
+
+	rotationInterval := 24 * time.Hour
+	gracePeriod := 7 * 24 * time.Hour
+
+	// the active key pair is not due for rotation yet
+	assert.Nil(t, keyManager.Maintain(time.Now().UTC(), rotationInterval, gracePeriod))
+	assert.Len(t, repository.keyPairs, 1)
+
+	assert.Nil(t, keyManager.Maintain(time.Now().UTC().Add(rotationInterval), rotationInterval, gracePeriod))
+	assert.Len(t, repository.keyPairs, 2)
+	assert.Nil(t, repository.keyPairs[0].RetiredAt)
+	assert.Nil(t, keyManager.VerifyProof(oldKeyPairID, "724b2c", salt, "", proof))
+	// users of the superseded key pair are asked to verify again before it is retired
+	assert.Equal(t, repository.keyPairs[1].CreatedAt.Add(gracePeriod), repository.reproveBy[oldKeyPairID])
+
+	// the grace period counts from the rotation, so disable rotation to pass it
+	assert.Nil(t, keyManager.Maintain(time.Now().UTC().Add(gracePeriod), 0, gracePeriod))
+	assert.NotNil(t, repository.keyPairs[0].RetiredAt)
+	assert.Nil(t, repository.keyPairs[1].RetiredAt)
+	assert.ErrorIs(t, keyManager.VerifyProof(oldKeyPairID, "724b2c", salt, "", proof), ErrUnknownZkKeyPair)
+	assert.Equal(t, 3, repository.resetCalled)
+}
+
+func TestKeyManager_VerifyProofWithKeyPairOfAnotherInstance(t *testing.T) {
+	repository := &keyPairRepository{}
+	keyManager := NewKeyManager(repository, VerificationCodeCircuit, cachedSetup)
+	assert.Nil(t, keyManager.Load())
+
+	// another server instance sharing the database rotates
+	other := NewKeyManager(repository, VerificationCodeCircuit, cachedSetup)
+	assert.Nil(t, other.Load())
+	assert.Nil(t, other.Rotate())
+
+	proof, keyPairID, err := other.GenerateProof(email, salt, "724b2c", nil)
+	assert.Nil(t, err)
+
+	assert.Nil(t, keyManager.VerifyProof(keyPairID, "724b2c", salt, "", proof))
+}
+
+func TestKeyManager_MaintainRotatesOncePerDatabase(t *testing.T) {
+	repository := &keyPairRepository{}
+	first := NewKeyManager(repository, VerificationCodeCircuit, cachedSetup)
+	second := NewKeyManager(repository, VerificationCodeCircuit, cachedSetup)
+	assert.Nil(t, first.Load())
+	assert.Nil(t, second.Load())
+	assert.Len(t, repository.keyPairs, 1)
+
+	rotationInterval := 24 * time.Hour
+	now := time.Now().UTC().Add(rotationInterval)
+	assert.Nil(t, first.Maintain(now, rotationInterval, 7*rotationInterval))
+	assert.Nil(t, second.Maintain(now, rotationInterval, 7*rotationInterval))
+
+	assert.Len(t, repository.keyPairs, 2)
+	first.mu.RLock()
+	second.mu.RLock()
+	assert.Equal(t, first.activeID, second.activeID)
+	second.mu.RUnlock()
+	first.mu.RUnlock()
+}
+
+func TestKeyManager_MaintainKeepsCeremonyKeyPair(t *testing.T) {
+	transcriptHash := "transcript hash"
+	repository := &keyPairRepository{}
+	assert.Nil(t, NewKeyManager(repository, VerificationCodeCircuit, cachedSetup).Load())
+	repository.keyPairs[0].TranscriptHash = &transcriptHash
+
+	keyManager := NewKeyManager(repository, VerificationCodeCircuit, cachedSetup)
+	assert.Nil(t, keyManager.Load())
+
+	rotationInterval := 24 * time.Hour
+	assert.Nil(t, keyManager.Maintain(time.Now().UTC().Add(rotationInterval), rotationInterval, 7*rotationInterval))
+
+	assert.Len(t, repository.keyPairs, 1)
+}
+
+// previousCircuit stands for an earlier version of a circuit, with other
+// public inputs.
+type previousCircuit struct {
+	Input frontend.Variable `gnark:",public"`
+}
+
+func (c *previousCircuit) Define(api frontend.API) error {
+	api.AssertIsEqual(api.Mul(c.Input, c.Input), api.Mul(c.Input, c.Input))
+	return nil
+}
+
+func TestKeyManager_LoadReplacesKeyPairOfPreviousCircuit(t *testing.T) {
+	cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &previousCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, verifyingKey, err := groth16.Setup(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// even a key pair from a setup ceremony cannot prove another circuit
+	transcriptHash := "transcript hash"
+	repository := &keyPairRepository{keyPairs: []models.ZkSnarksKeyPair{{
+		ID:             1,
+		Circuit:        models.ZkCircuitVerificationCode,
+		VerifyingKey:   utils.WriteBytes(verifyingKey),
+		TranscriptHash: &transcriptHash,
+		CreatedAt:      time.Now().UTC(),
+	}}}
+	keyManager := NewKeyManager(repository, VerificationCodeCircuit, cachedSetup)
+
+	assert.Nil(t, keyManager.Load())
+
+	assert.Len(t, repository.keyPairs, 2)
+	_, keyPairID, err := keyManager.GenerateProof(email, salt, "724b2c", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(2), keyPairID)
+}
@@ -2,6 +2,7 @@ package zk
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/consensys/gnark-crypto/ecc"
 	"github.com/consensys/gnark/backend/groth16"
@@ -9,11 +10,14 @@ import (
 	"github.com/consensys/gnark/frontend"
 	"globe-and-citizen/layer8/server/resource_server/emails/verification/zk/circuit"
 	"globe-and-citizen/layer8/server/resource_server/utils"
+	"globe-and-citizen/layer8/server/zkverify"
 )
 
 type IProofProcessor interface {
-	GenerateProof(input string, salt string, verificationCode string) ([]byte, uint, error)
-	VerifyProof(verificationCode string, salt string, proofBytes []byte) error
+	GenerateProof(input string, salt string, verificationCode string, nullifierKey []byte) ([]byte, uint, error)
+	VerifyProof(
+		zkKeyPairID uint, verificationCode string, salt string, domainCommitment string, proofBytes []byte,
+	) error
 }
 
 type ProofProcessor struct {
@@ -41,31 +45,20 @@ func NewProofProcessor(
 	return g
 }
 
+// GenerateProof proves that input yields verificationCode. For an email
+// address and a nullifier key, the proof also commits to the domain of the
+// address, see zkverify.EmailDomainCommitment.
 func (pv *ProofProcessor) GenerateProof(
 	input string,
 	salt string,
 	verificationCode string,
+	nullifierKey []byte,
 ) ([]byte, uint, error) {
-	inputAsCircuitVariables, err := utils.StringToCircuitVariables(input)
-	if err != nil {
-		return []byte{}, 0, err
-	}
-	saltAsCircuitVariables, err := utils.StringToCircuitVariables(salt)
-	if err != nil {
-		return []byte{}, 0, err
-	}
-
-	codeAsCircuitVariables, err := utils.ConvertCodeToCircuitVariables(verificationCode)
+	circ, err := NewVerificationCodeAssignment(input, salt, verificationCode, nullifierKey)
 	if err != nil {
 		return []byte{}, 0, err
 	}
 
-	circ := &circuit.MimcCircuit{
-		InputAsVariables: inputAsCircuitVariables, /* secret */
-		SaltAsVariables:  saltAsCircuitVariables,  /* public */
-		VerificationCode: codeAsCircuitVariables,  /* public */
-	}
-
 	witness, err := frontend.NewWitness(
 		circ,
 		ecc.BN254.ScalarField(),
@@ -89,44 +82,69 @@ func (pv *ProofProcessor) GenerateProof(
 }
 
 func (pv *ProofProcessor) VerifyProof(
-	verificationCode string, salt string, proofBytes []byte,
+	zkKeyPairID uint, verificationCode string, salt string, domainCommitment string, proofBytes []byte,
 ) error {
-	codeAsCircuitVariables, err := utils.ConvertCodeToCircuitVariables(verificationCode)
+	if zkKeyPairID != pv.zkKeyPairId {
+		return ErrUnknownZkKeyPair
+	}
+
+	return zkverify.VerifyProof(pv.verifyingKey, proofBytes, salt, verificationCode, domainCommitment)
+}
+
+// NewVerificationCodeAssignment assigns the circuit of an email address or
+// phone number. The domain commitment is left zero for phone numbers, for
+// addresses whose domain cannot be proved and without a nullifier key.
+func NewVerificationCodeAssignment(
+	input string, salt string, verificationCode string, nullifierKey []byte,
+) (*circuit.MimcCircuit, error) {
+	inputAsCircuitVariables, err := utils.StringToCircuitVariables(input)
+	if err != nil {
+		return nil, err
+	}
 	saltAsCircuitVariables, err := utils.StringToCircuitVariables(salt)
+	if err != nil {
+		return nil, err
+	}
 
-	var proof = groth16.NewProof(ecc.BN254)
-	_, err = proof.ReadFrom(bytes.NewReader(proofBytes))
+	codeAsCircuitVariables, err := utils.ConvertCodeToCircuitVariables(verificationCode)
 	if err != nil {
-		return fmt.Errorf("error while reading proof bytes: %e", err)
+		return nil, err
 	}
 
-	inputAsVariables := [utils.InputFrRepresentationSize]frontend.Variable{}
-	for i := 0; i < utils.InputFrRepresentationSize; i++ {
-		inputAsVariables[i] = 0
+	assignment := &circuit.MimcCircuit{
+		InputAsVariables: inputAsCircuitVariables, /* secret */
+		SaltAsVariables:  saltAsCircuitVariables,  /* public */
+		VerificationCode: codeAsCircuitVariables,  /* public */
+		// an '@' past the input leaves the commitment zero
+		DomainCommitment: 0,                    /* public */
+		AtIndex:          utils.MaxInputLength, /* secret */
+		NullifierKey:     0,                    /* secret */
 	}
 
-	witness, err := frontend.NewWitness(
-		&circuit.MimcCircuit{
-			InputAsVariables: inputAsVariables,
-			SaltAsVariables:  saltAsCircuitVariables,
-			VerificationCode: codeAsCircuitVariables,
-		},
-		ecc.BN254.ScalarField(),
-	)
-	if err != nil {
-		return fmt.Errorf("error while constructing a witness for zk proof verification: %e", err)
+	if nullifierKey == nil {
+		return assignment, nil
 	}
 
-	publicWitness, err := witness.Public()
+	domain, atIndex, err := zkverify.SplitEmailDomain(input)
+	if errors.Is(err, zkverify.ErrUnsupportedEmailDomain) {
+		return assignment, nil
+	}
 	if err != nil {
-		return fmt.Errorf("error while retrieving public witness: %e", err)
+		return nil, err
 	}
 
-	err = groth16.Verify(proof, pv.verifyingKey, publicWitness)
-
+	commitment, err := zkverify.EmailDomainCommitment(nullifierKey, domain)
+	if err != nil {
+		return nil, err
+	}
+	commitmentElement, err := zkverify.ParseEmailDomainCommitment(commitment)
 	if err != nil {
-		return fmt.Errorf("could not verify proof: %e", err)
+		return nil, err
 	}
 
-	return nil
+	assignment.DomainCommitment = commitmentElement
+	assignment.AtIndex = atIndex
+	assignment.NullifierKey = zkverify.EmailDomainNullifierKey(nullifierKey)
+
+	return assignment, nil
 }
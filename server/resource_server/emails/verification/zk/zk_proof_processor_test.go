@@ -14,7 +14,7 @@ func TestGenerateProof_VerificationCodeIsInvalid(t *testing.T) {
 
 	cs, provingKey, verifyingKey := RunZkSnarksSetup()
 	zkProofProcessor := NewProofProcessor(cs, zkKeyPairId, provingKey, verifyingKey)
-	_, _, err := zkProofProcessor.GenerateProof(email, salt, verificationCode)
+	_, _, err := zkProofProcessor.GenerateProof(email, salt, verificationCode, nil)
 
 	assert.NotNil(t, err)
 }
@@ -24,13 +24,13 @@ func TestGenerateProof_Success(t *testing.T) {
 
 	cs, provingKey, verifyingKey := RunZkSnarksSetup()
 	zkProofProcessor := NewProofProcessor(cs, zkKeyPairId, provingKey, verifyingKey)
-	proof, actualZkKeyPairId, err := zkProofProcessor.GenerateProof(email, salt, verificationCode)
+	proof, actualZkKeyPairId, err := zkProofProcessor.GenerateProof(email, salt, verificationCode, nil)
 
 	assert.Nil(t, err)
 	assert.Equal(t, zkKeyPairId, actualZkKeyPairId)
 	assert.True(t, len(proof) > 0)
 
-	err = zkProofProcessor.VerifyProof(verificationCode, salt, proof)
+	err = zkProofProcessor.VerifyProof(zkKeyPairId, verificationCode, salt, "", proof)
 	assert.Nil(t, err)
 }
 
@@ -42,7 +42,7 @@ func TestVerifyProof_ProofIsInvalid(t *testing.T) {
 
 	cs, provingKey, verifyingKey := RunZkSnarksSetup()
 	zkProofProcessor := NewProofProcessor(cs, zkKeyPairId, provingKey, verifyingKey)
-	err := zkProofProcessor.VerifyProof("123456", salt, proof)
+	err := zkProofProcessor.VerifyProof(zkKeyPairId, "123456", salt, "", proof)
 
 	assert.NotNil(t, err)
 }
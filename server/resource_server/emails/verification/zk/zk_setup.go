@@ -31,3 +31,23 @@ func GenerateConstraintSystem() constraint.ConstraintSystem {
 
 	return cs
 }
+
+func RunEmailDomainSetup() (constraint.ConstraintSystem, groth16.ProvingKey, groth16.VerifyingKey) {
+	cs := GenerateEmailDomainConstraintSystem()
+
+	provingKey, verifyingKey, err := groth16.Setup(cs)
+	if err != nil {
+		log.Fatalf("Error happened during the groth16 setup: %e", err)
+	}
+
+	return cs, provingKey, verifyingKey
+}
+
+func GenerateEmailDomainConstraintSystem() constraint.ConstraintSystem {
+	cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, circuit.NewEmailDomainCircuit())
+	if err != nil {
+		log.Fatalf("Error while generating the email domain constraint system: %e", err)
+	}
+
+	return cs
+}
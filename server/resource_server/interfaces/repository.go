@@ -12,19 +12,53 @@ type IRepository interface {
 	FindUser(userId uint) (models.User, error)
 	ProfileUser(userID uint) (models.User, models.UserMetadata, error)
 	ProfileClient(username string) (models.Client, error)
+	CreateScramSession(session models.ScramSession) error
+	ConsumeScramSession(principal string, username string, nonce string, cNonce string, now time.Time) error
+	CreatePasswordResetChallenge(challenge models.PasswordResetChallenge) error
+	ConsumePasswordResetChallenge(username string, challenge string, now time.Time) error
+	SaveTwoFactorCredential(credential models.TwoFactorCredential) error
+	GetTwoFactorCredential(principal string, username string) (models.TwoFactorCredential, error)
+	ConfirmTwoFactorCredential(id uint, step int64, confirmedAt time.Time, recoveryCodeHashes []string) error
+	UseTwoFactorStep(credentialID uint, step int64) error
+	UseTwoFactorRecoveryCode(credentialID uint, codeHash string, usedAt time.Time) error
+	DeleteTwoFactorCredential(principal string, username string) error
+	CreateWebAuthnChallenge(challenge models.WebAuthnChallenge) error
+	ConsumeWebAuthnChallenge(ceremony string, challenge string, userID uint, now time.Time) error
+	CreatePasskey(passkey models.Passkey) error
+	GetPasskey(credentialID string) (models.Passkey, error)
+	GetPasskeysOfUser(userID uint) ([]models.Passkey, error)
+	UseWebAuthnCredential(id uint, signCount uint32, usedAt time.Time) error
+	DeletePasskey(userID uint, id uint) error
 	SaveProofOfEmailVerification(userID uint, verificationCode string, proof []byte, zkKeyPairId uint) error
 	SaveEmailVerificationData(data models.EmailVerificationData) error
 	GetEmailVerificationData(userId uint) (models.EmailVerificationData, error)
 	UpdateUserMetadata(userID uint, req dto.UpdateUserMetadataDTO) error
 	RegisterUser(req dto.RegisterUserDTO) error
-	RegisterClient(req dto.RegisterClientDTO, clientUUID string, clientSecret string) error
+	RegisterClient(req dto.RegisterClientDTO, clientUUID string, secretHash string) error
 	GetClientData(clientName string) (models.Client, error)
 	GetClientDataByBackendURL(backendURL string) (models.Client, error)
 	IsBackendURIExists(backendURL string) (bool, error)
 	SaveZkSnarksKeyPair(keyPair models.ZkSnarksKeyPair) (uint, error)
-	GetLatestZkSnarksKeys() (models.ZkSnarksKeyPair, error)
+	GetLatestZkSnarksKeys(circuit string) (models.ZkSnarksKeyPair, error)
+	RotateZkSnarksKeyPair(
+		circuit string, due func(active *models.ZkSnarksKeyPair) bool, generate func() models.ZkSnarksKeyPair,
+	) (bool, error)
+	GetZkSnarksVerifyingKey(id uint) (models.ZkSnarksKeyPair, error)
+	GetZkSnarksVerifyingKeys() ([]models.ZkSnarksKeyPair, error)
+	RetireZkSnarksKeyPairs(ids []uint, retiredAt time.Time) error
+	MarkZkProofsToReprove(keyPairIDs []uint, reproveBy time.Time) (int, error)
+	ResetProofsOfRetiredZkKeyPairs() (int, error)
+	SaveUserEmailDomain(userID uint, emailDomain *models.UserEmailDomain) error
+	GetEmailDomainProofs(userID uint) ([]models.EmailDomainProof, error)
+	CreateZkProofJob(job models.ZkProofJob) (uint, error)
+	ClaimZkProofJob(now time.Time, staleBefore time.Time) (models.ZkProofJob, error)
+	CompleteZkProofJob(id uint, zkKeyPairID uint, finishedAt time.Time) error
+	FailZkProofJob(id uint, jobError string, finishedAt time.Time) error
+	ExpireZkProofJobs(queuedBefore time.Time, finishedAt time.Time) (int64, error)
+	GetZkProofJob(id uint, userID uint) (models.ZkProofJob, error)
+	CountPendingZkProofJobs() (int64, error)
 	GetUserForUsername(username string) (models.User, error)
-	UpdateUserPassword(username string, storedKey string, serverKey string) error
+	UpdateUserPassword(username string, storedKey string, serverKey string, revokedAt time.Time) error
 	CreateClientTrafficStatisticsEntry(clientId string, rate int) error
 	AddClientTrafficUsage(clientId string, consumedBytes int, now time.Time) error
 	GetClientTrafficStatistics(clientId string) (*models.ClientTrafficStatistics, error)
@@ -36,6 +70,31 @@ type IRepository interface {
 	GetPhoneNumberVerificationData(userID uint) (models.PhoneNumberVerificationData, error)
 	SaveProofOfPhoneNumberVerification(userID uint, verificationCode string, zkProof []byte, zkPairID uint) error
 	SaveTelegramSessionIDHash(userID uint, sessionID []byte) error
+	GetConnectedApps(userID uint) ([]models.ConnectedApp, error)
+	DeleteUserConsent(userID uint, clientID string, revokedAt time.Time) error
+	GetClientRedirectURIs(clientID string) ([]models.ClientRedirectURI, error)
+	AddClientRedirectURI(clientID string, redirectURI string) error
+	RemoveClientRedirectURI(clientID string, redirectURI string) error
+	RotateClientSecret(clientID string, secretHash string, previousExpiresAt time.Time) error
+	SetClientRequireUserTwoFactor(clientID string, required bool) error
+	RegisterDynamicClient(client models.Client, redirectURIs []string, ratePerByte int) error
+	GetClientByID(clientID string) (models.Client, error)
+	UpdateRegisteredClient(client models.Client, redirectURIs []string) error
+	DeleteRegisteredClient(clientID string) error
+	CreateSession(session models.Session) error
+	TouchSession(jti string, now time.Time) error
+	GetUserSessions(userID uint, now time.Time) ([]models.Session, error)
+	GetClientSessions(clientID string, now time.Time) ([]models.Session, error)
+	RevokeUserSessions(userID uint, id uint, revokedAt time.Time) error
+	RevokeClientSessions(clientID string, id uint, revokedAt time.Time) error
+	RevokeSession(jti string, revokedAt time.Time) error
+	GetDataAccessRecords(userID uint, clientID string, since time.Time, until time.Time) ([]models.DataAccessRecord, error)
+	GetDataAccessDigest(userID uint) (models.DataAccessDigest, error)
+	SaveDataAccessDigest(digest models.DataAccessDigest) error
+	DeleteDataAccessDigest(userID uint) error
+	ClaimDueDataAccessDigests(now time.Time, sentBefore time.Time, claimedBefore time.Time) ([]models.DataAccessDigest, error)
+	ReleaseDataAccessDigest(userID uint) error
+	MarkDataAccessDigestSent(userID uint, sentAt time.Time) error
 
 	// Oauth2 methods
 	GetUser(username string) (*serverModel.User, error)
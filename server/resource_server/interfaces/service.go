@@ -1,8 +1,12 @@
 package interfaces
 
 import (
+	"context"
 	"globe-and-citizen/layer8/server/resource_server/dto"
 	"globe-and-citizen/layer8/server/resource_server/models"
+	"globe-and-citizen/layer8/server/sdjwt"
+	"globe-and-citizen/layer8/server/zkverify"
+	"time"
 )
 
 type IService interface {
@@ -11,6 +15,17 @@ type IService interface {
 	LoginPrecheckClient(req dto.LoginPrecheckDTO) (models.LoginPrecheckResponseOutput, error)
 	LoginUser(req dto.LoginUserDTO) (models.LoginUserResponseOutput, error)
 	LoginClient(req dto.LoginClientDTO) (models.LoginClientResponseOutput, error)
+	LoginTwoFactor(req dto.LoginTwoFactorDTO) (models.LoginTwoFactorResponseOutput, error)
+	GetTwoFactorStatus(principal string, username string) (models.TwoFactorStatusResponseOutput, error)
+	StartTwoFactorEnrollment(principal string, username string) (models.TwoFactorEnrollmentResponseOutput, error)
+	ConfirmTwoFactorEnrollment(principal string, username string, code string) (models.TwoFactorRecoveryCodesResponseOutput, error)
+	DisableTwoFactor(principal string, username string, code string) error
+	StartPasskeyRegistration(userID uint, username string) (models.PasskeyCreationOptionsResponseOutput, error)
+	FinishPasskeyRegistration(userID uint, req dto.PasskeyRegistrationDTO) (models.Passkey, error)
+	GetPasskeys(userID uint) ([]models.Passkey, error)
+	DeletePasskey(userID uint, id uint) error
+	StartPasskeyLogin() (models.PasskeyRequestOptionsResponseOutput, error)
+	LoginPasskey(req dto.LoginPasskeyDTO) (models.LoginPasskeyResponseOutput, error)
 	ProfileUser(userID uint) (models.ProfileResponseOutput, error)
 	ProfileClient(userID string) (models.ClientResponseOutput, error)
 	FindUser(userID uint) (models.User, error)
@@ -20,14 +35,26 @@ type IService interface {
 		user models.User, input string, verificationCode string,
 	) ([]byte, uint, error)
 	SaveProofOfEmailVerification(userID uint, verificationCode string, zkProof []byte, zkKeyPairId uint) error
+	EnqueueZkProofJob(userID uint, attribute string, input string, verificationCode string) (models.ZkProofJobResponseOutput, error)
+	GetZkProofJob(userID uint, jobID uint) (models.ZkProofJobResponseOutput, error)
+	WaitForZkProofJob(ctx context.Context, userID uint, jobID uint) (models.ZkProofJobResponseOutput, error)
 	UpdateUserMetadata(userID uint, req dto.UpdateUserMetadataDTO) error
-	RegisterClient(req dto.RegisterClientDTO) error
+	RegisterClient(req dto.RegisterClientDTO) (models.RegisterClientResponseOutput, error)
 	GetClientData(clientName string) (models.ClientResponseOutput, error)
 	GetClientDataByBackendURL(backendURL string) (models.ClientResponseOutput, error)
 	CheckBackendURI(backendURL string) (bool, error)
 	GetUserForUsername(username string) (models.User, error)
 	ValidateSignature(message string, signature []byte, publicKey []byte) error
-	UpdateUserPassword(username string, storedKey string, serverKey string) error
+	ResetPasswordPrecheck(req dto.ResetPasswordPrecheckDTO) (models.ResetPasswordPrecheckResponseOutput, error)
+	ResetPassword(req dto.ResetPasswordDTO) error
+	ValidateUserToken(tokenString string) (uint, error)
+	ValidateClientToken(tokenString string) (*models.ClientClaims, error)
+	ValidateClientTokenWithScope(tokenString string, scope string) (*models.ClientClaims, error)
+	GetUserSessions(userID uint, tokenString string) ([]models.SessionResponseOutput, error)
+	GetClientSessions(clientID string, tokenString string) ([]models.SessionResponseOutput, error)
+	RevokeUserSessions(userID uint, id uint) error
+	RevokeClientSessions(clientID string, id uint) error
+	Logout(tokenString string) error
 	RegisterUserPrecheck(req dto.RegisterUserPrecheckDTO, iterCount int) (string, error)
 	RegisterClientPrecheck(req dto.RegisterClientPrecheckDTO, iterCount int) (string, error)
 	GetClientUnpaidAmount(clientId string) (int, error)
@@ -40,4 +67,23 @@ type IService interface {
 	SaveProofOfPhoneNumberVerification(verificationData models.PhoneNumberVerificationData) error
 	GenerateTelegramSessionID() ([]byte, error)
 	SaveTelegramSessionID(userID uint, sessionID []byte) error
+	GetConnectedApps(userID uint) ([]models.ConnectedAppResponseOutput, error)
+	RevokeConnectedApp(userID uint, clientID string) error
+	GetDataAccessTimeline(userID uint, clientID string, since time.Time, until time.Time) ([]models.DataAccessResponseOutput, error)
+	GetDataAccessDigest(userID uint) (models.DataAccessDigestResponseOutput, error)
+	SubscribeDataAccessDigest(userID uint, email string) error
+	UnsubscribeDataAccessDigest(userID uint) error
+	GetClientRedirectURIs(clientID string) ([]string, error)
+	AddClientRedirectURI(clientID string, redirectURI string) error
+	RemoveClientRedirectURI(clientID string, redirectURI string) error
+	RotateClientSecret(clientID string) (models.RotateClientSecretResponseOutput, error)
+	SetClientRequireUserTwoFactor(clientID string, required bool) error
+	RegisterDynamicClient(req dto.ClientRegistrationDTO) (models.ClientRegistrationResponseOutput, error)
+	GetRegisteredClient(clientID string, registrationAccessToken string) (models.ClientRegistrationResponseOutput, error)
+	UpdateRegisteredClient(clientID string, registrationAccessToken string, req dto.ClientRegistrationDTO) (models.ClientRegistrationResponseOutput, error)
+	DeleteRegisteredClient(clientID string, registrationAccessToken string) error
+	IssueVerifiedAttributesCredential(userID uint, req dto.VerifiedAttributesCredentialDTO) (models.VerifiedAttributesCredentialResponseOutput, error)
+	GetCredentialIssuerMetadata() (sdjwt.IssuerMetadata, error)
+	GetZkVerifyingKeys() ([]zkverify.VerifyingKey, error)
+	VerifyZkProof(req dto.VerifyZkProofDTO) (models.VerifyZkProofResponseOutput, error)
 }
@@ -2,7 +2,7 @@ package models
 
 type Client struct {
 	ID              string `gorm:"column:id; not null" json:"id"`
-	Secret          string `gorm:"column:secret" json:"secret"`
+	SecretHash      string `gorm:"column:secret_hash" json:"-"`
 	Name            string `gorm:"column:name" json:"name"`
 	RedirectURI     string `gorm:"column:redirect_uri" json:"redirect_uri"`
 	BackendURI      string `gorm:"column:backend_uri" json:"backend_uri"`
@@ -12,6 +12,16 @@ type Client struct {
 	ServerKey       string `gorm:"column:server_key;" json:"server_key"`
 	StoredKey       string `gorm:"column:stored_key;" json:"stored_key"`
 	X509Certificate string `gorm:"column:x509_certificate_bytes" json:"x509_certificate_bytes"`
+	LogoURI         string `gorm:"column:logo_uri" json:"logo_uri"`
+	// Contacts and GrantTypes are comma separated lists
+	Contacts   string `gorm:"column:contacts" json:"contacts"`
+	GrantTypes string `gorm:"column:grant_types" json:"grant_types"`
+	// RegistrationAccessTokenHash is only set for clients created through
+	// dynamic client registration; portal clients cannot be managed that way.
+	RegistrationAccessTokenHash string `gorm:"column:registration_access_token_hash" json:"-"`
+	// RequireUserTwoFactor only lets users with two-factor authentication
+	// authorize the client
+	RequireUserTwoFactor bool `gorm:"column:require_user_two_factor; default:false" json:"require_user_two_factor"`
 }
 
 func (Client) TableName() string {
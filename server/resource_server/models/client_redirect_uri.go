@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+type ClientRedirectURI struct {
+	ID          uint      `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	ClientID    string    `gorm:"column:client_id; not null" json:"client_id"`
+	RedirectURI string    `gorm:"column:redirect_uri; not null" json:"redirect_uri"`
+	CreatedAt   time.Time `gorm:"column:created_at; autoCreateTime" json:"created_at"`
+}
+
+func (ClientRedirectURI) TableName() string {
+	return "client_redirect_uris"
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// DataAccessRecord is a release of user metadata to a client: the scopes
+// the client asked with and the metadata fields they released. ClientName
+// is read from the client and is empty once the client is deleted.
+type DataAccessRecord struct {
+	ID         uint      `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	UserID     uint      `gorm:"column:user_id; not null" json:"-"`
+	ClientID   string    `gorm:"column:client_id; not null" json:"client_id"`
+	ClientName string    `gorm:"column:client_name; ->" json:"client_name"`
+	Scopes     string    `gorm:"column:scopes; not null" json:"scopes"`
+	Fields     string    `gorm:"column:fields; not null" json:"fields"`
+	AccessedAt time.Time `gorm:"column:accessed_at; not null" json:"accessed_at"`
+}
+
+func (DataAccessRecord) TableName() string {
+	return "data_access_records"
+}
+
+// DataAccessDigest is a user's subscription to an email digest of the
+// releases of their metadata, sent to the address they verified.
+type DataAccessDigest struct {
+	UserID     uint       `gorm:"column:user_id; primaryKey; not null" json:"-"`
+	Email      string     `gorm:"column:email; not null" json:"-"`
+	CreatedAt  time.Time  `gorm:"column:created_at; not null" json:"created_at"`
+	LastSentAt *time.Time `gorm:"column:last_sent_at" json:"last_sent_at"`
+	// ClaimedAt is set while an instance is sending the digest
+	ClaimedAt *time.Time `gorm:"column:claimed_at" json:"-"`
+}
+
+func (DataAccessDigest) TableName() string {
+	return "data_access_digests"
+}
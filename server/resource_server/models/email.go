@@ -5,6 +5,9 @@ type Email struct {
 	To      string
 	Subject string
 	Content VerificationEmailContent
+	// Text is the body of emails other than verification emails, such as
+	// the data access digest. It replaces the verification code message.
+	Text string
 }
 
 type VerificationEmailContent struct {
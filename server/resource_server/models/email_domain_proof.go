@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+// EmailDomainProof proves to a client that the domain of a user's verified
+// email address is in a set of domains. Proofs of the configured sets carry
+// the name of the set and leave Domain empty; the proof of the set holding
+// the user's domain alone has an empty DomainSet and names the domain. The
+// nullifier is the client's pseudonym for the user's domain, see
+// zkverify.EmailDomainNullifier. DomainCommitment ties the proof to the proof
+// of the user's email verification, see zkverify.EmailDomainCommitment.
+type EmailDomainProof struct {
+	ID               uint      `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	UserID           uint      `gorm:"column:user_id; not null" json:"user_id"`
+	ClientID         string    `gorm:"column:client_id; not null" json:"client_id"`
+	DomainSet        string    `gorm:"column:domain_set; not null" json:"domain_set"`
+	Domain           *string   `gorm:"column:domain" json:"domain"`
+	DomainSetRoot    string    `gorm:"column:domain_set_root; not null" json:"domain_set_root"`
+	Nullifier        string    `gorm:"column:nullifier; not null" json:"nullifier"`
+	DomainCommitment string    `gorm:"column:domain_commitment; not null" json:"domain_commitment"`
+	ZkProof          []byte    `gorm:"column:zk_proof; not null" json:"zk_proof"`
+	ZkKeyPairID      uint      `gorm:"column:zk_key_pair_id; not null" json:"zk_key_pair_id"`
+	CreatedAt        time.Time `gorm:"column:created_at; autoCreateTime" json:"created_at"`
+}
+
+func (EmailDomainProof) TableName() string {
+	return "email_domain_proofs"
+}
+
+// UserEmailDomain is the domain of a user's verified email address, kept so
+// that its proofs can be made for each client the user releases it to. The
+// nullifier key is random and replaced along with the address, so clients
+// cannot link the proofs about the new address to those about the old one.
+type UserEmailDomain struct {
+	UserID       uint   `gorm:"column:user_id; primaryKey; not null" json:"user_id"`
+	Domain       string `gorm:"column:domain; not null" json:"domain"`
+	NullifierKey []byte `gorm:"column:nullifier_key; not null" json:"-"`
+	// DomainCommitment is the commitment the proof of the email verification
+	// outputs, see zkverify.EmailDomainCommitment
+	DomainCommitment string `gorm:"column:domain_commitment; not null" json:"domain_commitment"`
+}
+
+func (UserEmailDomain) TableName() string {
+	return "user_email_domains"
+}
@@ -11,5 +11,16 @@ type Claims struct {
 type ClientClaims struct {
 	UserName string `json:"username"`
 	ClientID string `json:"user_id"`
+	// Scope is only set on tokens issued through the client credentials
+	// grant; client portal tokens carry no scope.
+	Scope string `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// TwoFactorClaims are carried by the token of a login that passed the
+// password check and still has to present a code. The subject is the
+// username of the principal.
+type TwoFactorClaims struct {
+	Principal string `json:"principal"`
 	jwt.RegisteredClaims
 }
@@ -3,14 +3,19 @@ package models
 import "time"
 
 type UserMetadata struct {
-	ID                    uint      `gorm:"column:id; primaryKey; not null" json:"id"`
-	DisplayName           string    `gorm:"column:display_name; not null" json:"display_name"`
-	Color                 string    `gorm:"column:color; not null" json:"color"`
-	Bio                   string    `gorm:"column:bio; not null" json:"bio"`
-	IsEmailVerified       bool      `gorm:"column:is_email_verified; not null" json:"is_email_verified"`
-	IsPhoneNumberVerified bool      `gorm:"column:is_phone_number_verified; not null" json:"is_phone_number_verified"`
-	CreatedAt             time.Time `gorm:"column:created_at; default:CURRENT_TIMESTAMP" json:"created_at"`
-	UpdatedAt             time.Time `gorm:"column:updated_at; default:CURRENT_TIMESTAMP; autoUpdateTime" json:"updated_at"`
+	ID                    uint   `gorm:"column:id; primaryKey; not null" json:"id"`
+	DisplayName           string `gorm:"column:display_name; not null" json:"display_name"`
+	Color                 string `gorm:"column:color; not null" json:"color"`
+	Bio                   string `gorm:"column:bio; not null" json:"bio"`
+	IsEmailVerified       bool   `gorm:"column:is_email_verified; not null" json:"is_email_verified"`
+	IsPhoneNumberVerified bool   `gorm:"column:is_phone_number_verified; not null" json:"is_phone_number_verified"`
+	// EmailReproveBy and PhoneNumberReproveBy are set while the proof of the
+	// attribute was made with a superseded zk key pair: the attribute stays
+	// verified until then and is reset unless the user verifies it again.
+	EmailReproveBy       *time.Time `gorm:"column:email_reprove_by" json:"email_reprove_by,omitempty"`
+	PhoneNumberReproveBy *time.Time `gorm:"column:phone_number_reprove_by" json:"phone_number_reprove_by,omitempty"`
+	CreatedAt            time.Time  `gorm:"column:created_at; default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt            time.Time  `gorm:"column:updated_at; default:CURRENT_TIMESTAMP; autoUpdateTime" json:"updated_at"`
 }
 
 func (UserMetadata) TableName() string {
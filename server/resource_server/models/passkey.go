@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// Passkey is a WebAuthn credential a user logs in with instead of their
+// password.
+type Passkey struct {
+	ID     uint   `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	UserID uint   `gorm:"column:user_id; not null" json:"-"`
+	Name   string `gorm:"column:name; not null" json:"name"`
+	// CredentialID is the base64url encoded id the authenticator knows the
+	// passkey by
+	CredentialID string `gorm:"column:credential_id; not null" json:"credential_id"`
+	// PublicKey is the COSE encoded credential public key
+	PublicKey []byte `gorm:"column:public_key; not null" json:"-"`
+	// SignCount is the signature counter of the last login, a login reporting
+	// a counter that is not greater is refused
+	SignCount         uint32     `gorm:"column:sign_count; not null" json:"-"`
+	AttestationFormat string     `gorm:"column:attestation_format; not null" json:"attestation_format"`
+	AAGUID            string     `gorm:"column:aaguid; not null" json:"aaguid"`
+	LastUsedAt        *time.Time `gorm:"column:last_used_at" json:"last_used_at"`
+	CreatedAt         time.Time  `gorm:"column:created_at; autoCreateTime" json:"created_at"`
+}
+
+func (Passkey) TableName() string {
+	return "passkeys"
+}
+
+// WebAuthnChallenge is issued by the options of a passkey registration or
+// login and consumed by the response of the authenticator. Registrations
+// are issued to a user, logins to no one as the passkey names its user.
+type WebAuthnChallenge struct {
+	ID        uint      `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	Ceremony  string    `gorm:"column:ceremony; not null" json:"ceremony"`
+	Challenge string    `gorm:"column:challenge; not null" json:"challenge"`
+	UserID    *uint     `gorm:"column:user_id" json:"user_id"`
+	ExpiresAt time.Time `gorm:"column:expires_at; not null" json:"expires_at"`
+	CreatedAt time.Time `gorm:"column:created_at; autoCreateTime" json:"created_at"`
+}
+
+func (WebAuthnChallenge) TableName() string {
+	return "webauthn_challenges"
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// PasswordResetChallenge is issued by a password reset precheck. The reset
+// that follows must carry a signature over its Message, made with the key
+// derived from the user's mnemonic, before it expires. It is consumed by the
+// first reset attempt, so neither the signature nor the new keys can be
+// replayed.
+type PasswordResetChallenge struct {
+	ID        uint      `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	Username  string    `gorm:"column:username; not null" json:"username"`
+	Challenge string    `gorm:"column:challenge; not null" json:"challenge"`
+	ExpiresAt time.Time `gorm:"column:expires_at; not null" json:"expires_at"`
+	CreatedAt time.Time `gorm:"column:created_at; autoCreateTime" json:"created_at"`
+}
+
+func (PasswordResetChallenge) TableName() string {
+	return "password_reset_challenges"
+}
+
+// Message is the text the user signs to reset their password. It names the
+// purpose and the account so that the signature is useless anywhere else.
+func (c PasswordResetChallenge) Message() string {
+	return fmt.Sprintf("Reset the password of %s on Layer8\nChallenge: %s", c.Username, c.Challenge)
+}
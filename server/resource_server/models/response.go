@@ -1,19 +1,69 @@
 package models
 
+import (
+	"time"
+
+	"globe-and-citizen/layer8/server/webauthn"
+)
+
 type LoginPrecheckResponseOutput struct {
 	Salt      string `json:"salt"`
 	IterCount int    `json:"iter_count"`
 	Nonce     string `json:"nonce"`
 }
 
+// LoginUserResponseOutput carries the token of a login. When the user
+// enrolled an authenticator, TwoFactorRequired is set instead and the
+// TwoFactorToken is exchanged for the token together with a code.
 type LoginUserResponseOutput struct {
-	ServerSignature string `json:"server_signature"`
-	Token           string `json:"token"`
+	ServerSignature   string `json:"server_signature"`
+	Token             string `json:"token"`
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	TwoFactorToken    string `json:"two_factor_token,omitempty"`
 }
 
 type LoginClientResponseOutput struct {
-	ServerSignature string `json:"server_signature"`
-	Token           string `json:"token"`
+	ServerSignature   string `json:"server_signature"`
+	Token             string `json:"token"`
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	TwoFactorToken    string `json:"two_factor_token,omitempty"`
+}
+
+// PasskeyCreationOptionsResponseOutput is passed as is to
+// navigator.credentials.create once its binary values are decoded.
+type PasskeyCreationOptionsResponseOutput struct {
+	PublicKey webauthn.CreationOptions `json:"publicKey"`
+}
+
+// PasskeyRequestOptionsResponseOutput is passed as is to
+// navigator.credentials.get once its binary values are decoded.
+type PasskeyRequestOptionsResponseOutput struct {
+	PublicKey webauthn.RequestOptions `json:"publicKey"`
+}
+
+type LoginPasskeyResponseOutput struct {
+	Token             string `json:"token"`
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	TwoFactorToken    string `json:"two_factor_token,omitempty"`
+}
+
+type LoginTwoFactorResponseOutput struct {
+	Token string `json:"token"`
+}
+
+type TwoFactorStatusResponseOutput struct {
+	Enabled bool `json:"enabled"`
+}
+
+// TwoFactorEnrollmentResponseOutput is shown to the user once, as a QR code
+// of the ProvisioningURI or as the Secret typed into the authenticator.
+type TwoFactorEnrollmentResponseOutput struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type TwoFactorRecoveryCodesResponseOutput struct {
+	RecoveryCodes []string `json:"recovery_codes"`
 }
 
 type ProfileResponseOutput struct {
@@ -23,15 +73,19 @@ type ProfileResponseOutput struct {
 	Color               string `json:"color"`
 	EmailVerified       bool   `json:"email_verified"`
 	PhoneNumberVerified bool   `json:"phone_number_verified"`
+	// EmailReproveBy and PhoneNumberReproveBy are when a verification made
+	// with a superseded zk key pair is reset unless the user verifies again
+	EmailReproveBy       *time.Time `json:"email_reprove_by,omitempty"`
+	PhoneNumberReproveBy *time.Time `json:"phone_number_reprove_by,omitempty"`
 }
 
 type ClientResponseOutput struct {
-	ID              string `json:"id"`
-	Secret          string `json:"secret"`
-	Name            string `json:"name"`
-	RedirectURI     string `json:"redirect_uri"`
-	BackendURI      string `json:"backend_uri"`
-	X509Certificate string `json:"x509_certificate"`
+	ID                   string `json:"id"`
+	Name                 string `json:"name"`
+	RedirectURI          string `json:"redirect_uri"`
+	BackendURI           string `json:"backend_uri"`
+	X509Certificate      string `json:"x509_certificate"`
+	RequireUserTwoFactor bool   `json:"require_user_two_factor"`
 }
 
 type RegisterUserPrecheckResponseOutput struct {
@@ -45,10 +99,112 @@ type RegisterClientPrecheckResponseOutput struct {
 }
 
 type ResetPasswordPrecheckResponseOutput struct {
-	Salt           string `json:"salt"`
-	IterationCount int    `json:"iterationCount"`
+	Salt           string    `json:"salt"`
+	IterationCount int       `json:"iterationCount"`
+	Challenge      string    `json:"challenge"`
+	Message        string    `json:"message"`
+	ExpiresAt      time.Time `json:"expires_at"`
 }
 
 type ClientUnpaidAmountResponseOutput struct {
 	UnpaidAmount int `json:"unpaid_amount"`
 }
+
+type RegisterClientResponseOutput struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+type RotateClientSecretResponseOutput struct {
+	Secret                  string    `json:"secret"`
+	PreviousSecretExpiresAt time.Time `json:"previous_secret_expires_at"`
+}
+
+// ClientRegistrationResponseOutput is the client information response of
+// RFC 7591 and RFC 7592. The secret and the registration access token are
+// only returned when the client is created.
+type ClientRegistrationResponseOutput struct {
+	ClientID                string   `json:"client_id"`
+	ClientSecret            string   `json:"client_secret,omitempty"`
+	ClientSecretExpiresAt   int64    `json:"client_secret_expires_at"`
+	RegistrationAccessToken string   `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string   `json:"registration_client_uri"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	ClientName              string   `json:"client_name"`
+	BackendURI              string   `json:"backend_uri"`
+	LogoURI                 string   `json:"logo_uri,omitempty"`
+	Contacts                []string `json:"contacts,omitempty"`
+	GrantTypes              []string `json:"grant_types"`
+}
+
+// VerifiedAttributesCredentialResponseOutput carries an SD-JWT with every
+// verified attribute disclosable. The holder presents a subset of them.
+type VerifiedAttributesCredentialResponseOutput struct {
+	Credential string    `json:"credential"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type VerifyZkProofResponseOutput struct {
+	Valid bool `json:"valid"`
+}
+
+// ZkProofJobResponseOutput is the state of a queued proof. Clients poll it
+// until the status is done or failed.
+type ZkProofJobResponseOutput struct {
+	ID         uint       `json:"id"`
+	Attribute  string     `json:"attribute"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+type ConnectedAppResponseOutput struct {
+	ClientID   string     `json:"client_id"`
+	ClientName string     `json:"client_name"`
+	Scopes     []string   `json:"scopes"`
+	GrantedAt  time.Time  `json:"granted_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// SessionResponseOutput is an active session. ClientID is set on the
+// sessions of the apps the user connected, and Current on the session of
+// the token the list was requested with.
+type SessionResponseOutput struct {
+	ID          uint      `json:"id"`
+	DeviceLabel string    `json:"device_label"`
+	ClientID    string    `json:"client_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Current     bool      `json:"current"`
+}
+
+// DataAccessResponseOutput is an entry of the data access timeline of a
+// user: which metadata fields a client read, and when.
+type DataAccessResponseOutput struct {
+	ClientID   string    `json:"client_id"`
+	ClientName string    `json:"client_name"`
+	Scopes     []string  `json:"scopes"`
+	Fields     []string  `json:"fields"`
+	AccessedAt time.Time `json:"accessed_at"`
+}
+
+// DataAccessDigestResponseOutput tells whether the user receives the email
+// digest of the data access timeline. The address is not shown again.
+type DataAccessDigestResponseOutput struct {
+	Enabled    bool       `json:"enabled"`
+	LastSentAt *time.Time `json:"last_sent_at"`
+}
+
+// AuditEventResponseOutput is an entry of the security audit trail. Events
+// about a user listed to a client leave out Subject and Source: the client
+// knows the user only by a pairwise subject.
+type AuditEventResponseOutput struct {
+	Type      string            `json:"type"`
+	Principal string            `json:"principal"`
+	Subject   string            `json:"subject,omitempty"`
+	ClientID  string            `json:"client_id,omitempty"`
+	Source    string            `json:"source,omitempty"`
+	Details   map[string]string `json:"details"`
+	CreatedAt time.Time         `json:"created_at"`
+}
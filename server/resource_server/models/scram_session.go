@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+const (
+	ScramPrincipalUser   = "user"
+	ScramPrincipalClient = "client"
+)
+
+// ScramSession is a server nonce issued by a login precheck. The login that
+// follows must present it before it expires and consumes it, so a client
+// proof computed over it cannot be replayed.
+type ScramSession struct {
+	ID        uint      `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	Principal string    `gorm:"column:principal; not null" json:"principal"`
+	Username  string    `gorm:"column:username; not null" json:"username"`
+	CNonce    string    `gorm:"column:c_nonce; not null" json:"c_nonce"`
+	Nonce     string    `gorm:"column:nonce; not null" json:"nonce"`
+	ExpiresAt time.Time `gorm:"column:expires_at; not null" json:"expires_at"`
+	CreatedAt time.Time `gorm:"column:created_at; autoCreateTime" json:"created_at"`
+}
+
+func (ScramSession) TableName() string {
+	return "scram_sessions"
+}
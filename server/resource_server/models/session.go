@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// Session is a login that stays valid until it expires or is revoked. The
+// tokens of a session carry its JTI as their jti claim. Sessions of the user
+// portal have a UserID, sessions of the client portal a ClientID, and the
+// sessions of an app acting for a user both.
+type Session struct {
+	ID          uint       `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	JTI         string     `gorm:"column:jti; not null" json:"-"`
+	Principal   string     `gorm:"column:principal; not null" json:"-"`
+	UserID      *uint      `gorm:"column:user_id" json:"-"`
+	ClientID    *string    `gorm:"column:client_id" json:"-"`
+	DeviceLabel string     `gorm:"column:device_label; not null" json:"device_label"`
+	CreatedAt   time.Time  `gorm:"column:created_at; not null" json:"created_at"`
+	LastSeenAt  time.Time  `gorm:"column:last_seen_at; not null" json:"last_seen_at"`
+	ExpiresAt   time.Time  `gorm:"column:expires_at; not null" json:"expires_at"`
+	RevokedAt   *time.Time `gorm:"column:revoked_at" json:"-"`
+}
+
+func (Session) TableName() string {
+	return "sessions"
+}
@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// TwoFactorCredential is the TOTP authenticator a user or a client enrolled.
+// It only asks for codes at login once ConfirmedAt is set, which happens when
+// the first code from the authenticator has been checked.
+type TwoFactorCredential struct {
+	ID        uint   `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	Principal string `gorm:"column:principal; not null" json:"principal"`
+	Username  string `gorm:"column:username; not null" json:"username"`
+	// EncryptedSecret is the shared secret sealed by totp.EncryptSecret
+	EncryptedSecret string `gorm:"column:encrypted_secret; not null" json:"-"`
+	// LastUsedStep is the TOTP step of the last accepted code, codes of this
+	// and earlier steps are not accepted again
+	LastUsedStep int64      `gorm:"column:last_used_step; not null" json:"-"`
+	ConfirmedAt  *time.Time `gorm:"column:confirmed_at" json:"confirmed_at"`
+	CreatedAt    time.Time  `gorm:"column:created_at; autoCreateTime" json:"created_at"`
+}
+
+func (TwoFactorCredential) TableName() string {
+	return "two_factor_credentials"
+}
+
+func (c TwoFactorCredential) Confirmed() bool {
+	return c.ConfirmedAt != nil
+}
+
+// TwoFactorRecoveryCode replaces a code of the authenticator once.
+type TwoFactorRecoveryCode struct {
+	ID           uint       `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	CredentialID uint       `gorm:"column:credential_id; not null" json:"credential_id"`
+	CodeHash     string     `gorm:"column:code_hash; not null" json:"-"`
+	UsedAt       *time.Time `gorm:"column:used_at" json:"used_at"`
+}
+
+func (TwoFactorRecoveryCode) TableName() string {
+	return "two_factor_recovery_codes"
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+type UserConsent struct {
+	ID         uint       `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	UserID     uint       `gorm:"column:user_id; not null" json:"user_id"`
+	ClientID   string     `gorm:"column:client_id; not null" json:"client_id"`
+	Scopes     string     `gorm:"column:scopes; not null" json:"scopes"`
+	GrantedAt  time.Time  `gorm:"column:granted_at; not null" json:"granted_at"`
+	LastUsedAt *time.Time `gorm:"column:last_used_at" json:"last_used_at"`
+}
+
+func (UserConsent) TableName() string {
+	return "user_consents"
+}
+
+// ConnectedApp is a user consent joined with the name of the client it was granted to.
+type ConnectedApp struct {
+	ClientID   string     `gorm:"column:client_id"`
+	ClientName string     `gorm:"column:client_name"`
+	Scopes     string     `gorm:"column:scopes"`
+	GrantedAt  time.Time  `gorm:"column:granted_at"`
+	LastUsedAt *time.Time `gorm:"column:last_used_at"`
+}
@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+const (
+	ZkProofJobPending = "pending"
+	ZkProofJobRunning = "running"
+	ZkProofJobDone    = "done"
+	ZkProofJobFailed  = "failed"
+)
+
+const (
+	ZkProofJobEmail       = "email"
+	ZkProofJobPhoneNumber = "phone_number"
+)
+
+// ZkProofJob is a queued proof of an email or phone number verification.
+// Input holds the verified address until the job finishes and is cleared
+// afterwards, like the address itself it must never be returned to clients.
+// The zk proof pool fails a job that has not finished 40 minutes after it was
+// queued and clears its input, whether or not a worker picked it up, so the
+// address is kept in plaintext for at most that long plus a sweep interval.
+type ZkProofJob struct {
+	ID               uint       `gorm:"primaryKey; autoIncrement; not null" json:"id"`
+	UserID           uint       `gorm:"column:user_id; not null" json:"user_id"`
+	Attribute        string     `gorm:"column:attribute; not null" json:"attribute"`
+	Input            string     `gorm:"column:input; not null" json:"-"`
+	VerificationCode string     `gorm:"column:verification_code; not null" json:"-"`
+	Status           string     `gorm:"column:status; not null" json:"status"`
+	Attempts         int        `gorm:"column:attempts; not null" json:"attempts"`
+	Error            string     `gorm:"column:error; not null" json:"-"`
+	ZkKeyPairID      *uint      `gorm:"column:zk_key_pair_id" json:"zk_key_pair_id"`
+	CreatedAt        time.Time  `gorm:"column:created_at; autoCreateTime" json:"created_at"`
+	StartedAt        *time.Time `gorm:"column:started_at" json:"started_at"`
+	FinishedAt       *time.Time `gorm:"column:finished_at" json:"finished_at"`
+}
+
+func (ZkProofJob) TableName() string {
+	return "zk_proof_jobs"
+}
+
+// Finished reports whether the job reached a final status.
+func (j ZkProofJob) Finished() bool {
+	return j.Status == ZkProofJobDone || j.Status == ZkProofJobFailed
+}
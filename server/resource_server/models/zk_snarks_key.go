@@ -1,9 +1,25 @@
 package models
 
+import "time"
+
+// Circuits whose key pairs are stored in zk_snarks_key_pairs
+const (
+	ZkCircuitVerificationCode = "verification_code"
+	ZkCircuitEmailDomain      = "email_domain"
+)
+
 type ZkSnarksKeyPair struct {
 	ID           uint   `gorm:"primaryKey; unique; autoIncrement; not null" json:"id"`
+	Circuit      string `gorm:"column:circuit; not null" json:"circuit"`
 	ProvingKey   []byte `gorm:"column:proving_key; not null" json:"proving_key"`
 	VerifyingKey []byte `gorm:"column:verifying_key; not null" json:"verifying_key"`
+
+	CreatedAt time.Time `gorm:"column:created_at; not null" json:"created_at"`
+	// RetiredAt is set once proofs made with the key pair are no longer accepted
+	RetiredAt *time.Time `gorm:"column:retired_at" json:"retired_at"`
+	// TranscriptHash identifies the trusted setup ceremony the key pair came
+	// from, it is nil for key pairs generated by the server alone
+	TranscriptHash *string `gorm:"column:transcript_hash" json:"transcript_hash"`
 }
 
 func (ZkSnarksKeyPair) TableName() string {
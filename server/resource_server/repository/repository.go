@@ -2,14 +2,18 @@ package repository
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"globe-and-citizen/layer8/server/constants"
 	serverModels "globe-and-citizen/layer8/server/models"
 	"globe-and-citizen/layer8/server/resource_server/dto"
 	interfaces "globe-and-citizen/layer8/server/resource_server/interfaces"
 	"globe-and-citizen/layer8/server/resource_server/models"
+	"hash/fnv"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Repository struct {
@@ -26,12 +30,25 @@ func (r *Repository) RegisterUser(req dto.RegisterUserDTO) error {
 	var user models.User
 
 	tx := r.connection.Begin()
-	if err := tx.Where("username = ?", req.Username).First(&user).Error; err != nil {
+	err := tx.Where("username = ?", req.Username).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		tx.Rollback()
+		return constants.ErrUsernameUnavailable
+	}
+	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("could not find user: %e", err)
 	}
 
-	err := tx.Model(&user).Updates(map[string]interface{}{
+	// Only a username reserved by a precheck can be registered; the keys of
+	// a completed account are never replaced. Both cases are reported the
+	// same way, so registering does not tell which usernames have accounts.
+	if user.StoredKey != "" {
+		tx.Rollback()
+		return constants.ErrUsernameUnavailable
+	}
+
+	err = tx.Model(&user).Updates(map[string]interface{}{
 		"public_key": req.PublicKey,
 		"stored_key": req.StoredKey,
 		"server_key": req.ServerKey,
@@ -70,7 +87,7 @@ func (r *Repository) FindUser(userId uint) (models.User, error) {
 	return user, e
 }
 
-func (r *Repository) RegisterClient(req dto.RegisterClientDTO, clientUUID string, clientSecret string) error {
+func (r *Repository) RegisterClient(req dto.RegisterClientDTO, clientUUID string, secretHash string) error {
 	tx := r.connection.Begin()
 
 	result := tx.Model(&models.Client{}).
@@ -80,7 +97,7 @@ func (r *Repository) RegisterClient(req dto.RegisterClientDTO, clientUUID string
 			"redirect_uri": req.RedirectURI,
 			"backend_uri":  req.BackendURI,
 			"id":           clientUUID,
-			"secret":       clientSecret,
+			"secret_hash":  secretHash,
 			"stored_key":   req.StoredKey,
 			"server_key":   req.ServerKey,
 		})
@@ -95,6 +112,15 @@ func (r *Repository) RegisterClient(req dto.RegisterClientDTO, clientUUID string
 		return fmt.Errorf("no client found with username: %s", req.Username)
 	}
 
+	err := tx.Create(&models.ClientRedirectURI{
+		ClientID:    clientUUID,
+		RedirectURI: req.RedirectURI,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not register the redirect uri: %v", err)
+	}
+
 	tx.Commit()
 	return nil
 }
@@ -135,6 +161,266 @@ func (r *Repository) ProfileClient(username string) (models.Client, error) {
 	return client, nil
 }
 
+// CreateScramSession stores the server nonce of a login precheck. Sessions
+// that expired before session.CreatedAt are swept at the same time.
+func (r *Repository) CreateScramSession(session models.ScramSession) error {
+	return r.connection.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("expires_at <= ?", session.CreatedAt).Delete(&models.ScramSession{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&session).Error
+	})
+}
+
+// ConsumeScramSession deletes the session issued to principal and username
+// for nonce and cNonce if it has not expired at now. It returns
+// gorm.ErrRecordNotFound when there is no such session, which also happens
+// when a concurrent login consumed it first.
+func (r *Repository) ConsumeScramSession(
+	principal string, username string, nonce string, cNonce string, now time.Time,
+) error {
+	result := r.connection.
+		Where(
+			"principal = ? AND username = ? AND nonce = ? AND c_nonce = ? AND expires_at > ?",
+			principal, username, nonce, cNonce, now,
+		).
+		Delete(&models.ScramSession{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// CreatePasswordResetChallenge stores the challenge of a password reset
+// precheck. Expired challenges of all users are removed at the same time.
+func (r *Repository) CreatePasswordResetChallenge(challenge models.PasswordResetChallenge) error {
+	return r.connection.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("expires_at <= ?", challenge.CreatedAt).Delete(&models.PasswordResetChallenge{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&challenge).Error
+	})
+}
+
+// ConsumePasswordResetChallenge deletes the challenge issued to username if
+// it has not expired at now. Like ConsumeScramSession, it returns
+// gorm.ErrRecordNotFound when the challenge is unknown, expired or was
+// already used by another reset.
+func (r *Repository) ConsumePasswordResetChallenge(username string, challenge string, now time.Time) error {
+	result := r.connection.
+		Where("username = ? AND challenge = ? AND expires_at > ?", username, challenge, now).
+		Delete(&models.PasswordResetChallenge{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// SaveTwoFactorCredential stores a new unconfirmed credential, replacing an
+// earlier enrollment that was never confirmed. A confirmed credential is
+// kept and constants.ErrTwoFactorAlreadyEnabled returned.
+func (r *Repository) SaveTwoFactorCredential(credential models.TwoFactorCredential) error {
+	result := r.connection.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "principal"}, {Name: "username"}},
+		DoUpdates: clause.AssignmentColumns([]string{"encrypted_secret", "last_used_step", "created_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "two_factor_credentials.confirmed_at IS NULL"},
+		}},
+	}).Create(&credential)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return constants.ErrTwoFactorAlreadyEnabled
+	}
+
+	return nil
+}
+
+func (r *Repository) GetTwoFactorCredential(principal string, username string) (models.TwoFactorCredential, error) {
+	var credential models.TwoFactorCredential
+	err := r.connection.
+		Where("principal = ? AND username = ?", principal, username).
+		First(&credential).Error
+	if err != nil {
+		return models.TwoFactorCredential{}, err
+	}
+
+	return credential, nil
+}
+
+// ConfirmTwoFactorCredential enables an enrolled credential once its first
+// code checked out at step, storing the hashes of its recovery codes. It
+// returns gorm.ErrRecordNotFound if the credential was confirmed meanwhile.
+func (r *Repository) ConfirmTwoFactorCredential(
+	id uint, step int64, confirmedAt time.Time, recoveryCodeHashes []string,
+) error {
+	return r.connection.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.TwoFactorCredential{}).
+			Where("id = ? AND confirmed_at IS NULL AND last_used_step < ?", id, step).
+			Updates(map[string]interface{}{
+				"confirmed_at":   confirmedAt,
+				"last_used_step": step,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		recoveryCodes := make([]models.TwoFactorRecoveryCode, len(recoveryCodeHashes))
+		for i, codeHash := range recoveryCodeHashes {
+			recoveryCodes[i] = models.TwoFactorRecoveryCode{CredentialID: id, CodeHash: codeHash}
+		}
+
+		return tx.Create(&recoveryCodes).Error
+	})
+}
+
+func (r *Repository) UseTwoFactorStep(credentialID uint, step int64) error {
+	result := r.connection.Model(&models.TwoFactorCredential{}).
+		Where("id = ? AND last_used_step < ?", credentialID, step).
+		Update("last_used_step", step)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (r *Repository) UseTwoFactorRecoveryCode(credentialID uint, codeHash string, usedAt time.Time) error {
+	result := r.connection.Model(&models.TwoFactorRecoveryCode{}).
+		Where("credential_id = ? AND code_hash = ? AND used_at IS NULL", credentialID, codeHash).
+		Update("used_at", usedAt)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteTwoFactorCredential removes the credential of principal and
+// username, its recovery codes are removed with it.
+func (r *Repository) DeleteTwoFactorCredential(principal string, username string) error {
+	result := r.connection.
+		Where("principal = ? AND username = ?", principal, username).
+		Delete(&models.TwoFactorCredential{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// CreateWebAuthnChallenge stores the challenge of passkey options. Challenges
+// that expired before challenge.CreatedAt are swept at the same time.
+func (r *Repository) CreateWebAuthnChallenge(challenge models.WebAuthnChallenge) error {
+	return r.connection.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("expires_at <= ?", challenge.CreatedAt).Delete(&models.WebAuthnChallenge{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&challenge).Error
+	})
+}
+
+func (r *Repository) ConsumeWebAuthnChallenge(ceremony string, challenge string, userID uint, now time.Time) error {
+	query := r.connection.Where("ceremony = ? AND challenge = ? AND expires_at > ?", ceremony, challenge, now)
+	if userID == 0 {
+		query = query.Where("user_id IS NULL")
+	} else {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	result := query.Delete(&models.WebAuthnChallenge{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (r *Repository) CreatePasskey(passkey models.Passkey) error {
+	return r.connection.Create(&passkey).Error
+}
+
+func (r *Repository) GetPasskey(credentialID string) (models.Passkey, error) {
+	var passkey models.Passkey
+	err := r.connection.Where("credential_id = ?", credentialID).First(&passkey).Error
+	if err != nil {
+		return models.Passkey{}, err
+	}
+
+	return passkey, nil
+}
+
+func (r *Repository) GetPasskeysOfUser(userID uint) ([]models.Passkey, error) {
+	var passkeys []models.Passkey
+	err := r.connection.Where("user_id = ?", userID).Order("id").Find(&passkeys).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return passkeys, nil
+}
+
+// UseWebAuthnCredential only moves the signature counter of a passkey
+// forward, authenticators without a counter keep it at zero.
+func (r *Repository) UseWebAuthnCredential(id uint, signCount uint32, usedAt time.Time) error {
+	result := r.connection.Model(&models.Passkey{}).
+		Where("id = ? AND (sign_count < ? OR (sign_count = 0 AND ? = 0))", id, signCount, signCount).
+		Updates(map[string]interface{}{
+			"sign_count":   signCount,
+			"last_used_at": usedAt,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (r *Repository) DeletePasskey(userID uint, id uint) error {
+	result := r.connection.Where("id = ? AND user_id = ?", id, userID).Delete(&models.Passkey{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
 func (r *Repository) SaveProofOfEmailVerification(
 	userId uint, verificationCode string, emailProof []byte, zkKeyPairId uint,
 ) error {
@@ -166,11 +452,15 @@ func (r *Repository) SaveProofOfEmailVerification(
 		return err
 	}
 
+	// a new proof ends the re-prove window of a superseded key pair
 	err = tx.Model(
 		&models.UserMetadata{},
 	).Where(
 		"id = ?", userId,
-	).Update("is_email_verified", true).Error
+	).Updates(map[string]interface{}{
+		"is_email_verified": true,
+		"email_reprove_by":  nil,
+	}).Error
 
 	if err != nil {
 		tx.Rollback()
@@ -227,10 +517,85 @@ func (r *Repository) SaveZkSnarksKeyPair(keyPair models.ZkSnarksKeyPair) (uint,
 	return keyPair.ID, nil
 }
 
-func (r *Repository) GetLatestZkSnarksKeys() (models.ZkSnarksKeyPair, error) {
+func (r *Repository) GetLatestZkSnarksKeys(circuit string) (models.ZkSnarksKeyPair, error) {
 	var keyPair models.ZkSnarksKeyPair
-	err := r.connection.Model(&models.ZkSnarksKeyPair{}).Last(&keyPair).Error
+	err := r.connection.Model(&models.ZkSnarksKeyPair{}).
+		Where("circuit = ? AND retired_at IS NULL", circuit).
+		Last(&keyPair).Error
+
+	if err != nil {
+		return models.ZkSnarksKeyPair{}, err
+	}
+
+	return keyPair, nil
+}
+
+// RotateZkSnarksKeyPair saves the key pair generate returns when due says
+// the active key pair of the circuit, nil if there is none, must be replaced.
+// Server instances rotate under a transaction lock per circuit, so a rotation
+// happens once: the others wait and find the new key pair not due. The active
+// key pair is read without its proving key.
+func (r *Repository) RotateZkSnarksKeyPair(
+	circuit string, due func(active *models.ZkSnarksKeyPair) bool, generate func() models.ZkSnarksKeyPair,
+) (bool, error) {
+	rotated := false
+
+	err := r.connection.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("SELECT pg_advisory_xact_lock(?)", zkKeyRotationLockID(circuit)).Error
+		if err != nil {
+			return err
+		}
+
+		var active models.ZkSnarksKeyPair
+		err = tx.Model(&models.ZkSnarksKeyPair{}).
+			Select("id", "circuit", "created_at", "transcript_hash").
+			Where("circuit = ? AND retired_at IS NULL", circuit).
+			Order("id DESC").
+			Take(&active).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if !due(nil) {
+				return nil
+			}
+		case err != nil:
+			return err
+		default:
+			if !due(&active) {
+				return nil
+			}
+		}
+
+		keyPair := generate()
+		keyPair.Circuit = circuit
+		if err := tx.Create(&keyPair).Error; err != nil {
+			return err
+		}
+
+		rotated = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return rotated, nil
+}
+
+// zkKeyRotationLockID is the advisory lock key of the key pair rotation of a
+// circuit.
+func zkKeyRotationLockID(circuit string) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte("zk_snarks_key_pairs:" + circuit))
+	return int64(hash.Sum64())
+}
 
+// GetZkSnarksVerifyingKey returns a key pair without its proving key.
+func (r *Repository) GetZkSnarksVerifyingKey(id uint) (models.ZkSnarksKeyPair, error) {
+	var keyPair models.ZkSnarksKeyPair
+	err := r.connection.Model(&models.ZkSnarksKeyPair{}).
+		Select("id", "circuit", "verifying_key", "created_at", "retired_at", "transcript_hash").
+		Where("id = ?", id).
+		Take(&keyPair).Error
 	if err != nil {
 		return models.ZkSnarksKeyPair{}, err
 	}
@@ -238,6 +603,287 @@ func (r *Repository) GetLatestZkSnarksKeys() (models.ZkSnarksKeyPair, error) {
 	return keyPair, nil
 }
 
+// GetZkSnarksVerifyingKeys returns every key pair with its proving key left
+// out, since proving keys are large and never leave the server.
+func (r *Repository) GetZkSnarksVerifyingKeys() ([]models.ZkSnarksKeyPair, error) {
+	var keyPairs []models.ZkSnarksKeyPair
+	err := r.connection.Model(&models.ZkSnarksKeyPair{}).
+		Select("id", "circuit", "verifying_key", "created_at", "retired_at", "transcript_hash").
+		Order("id").
+		Find(&keyPairs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return keyPairs, nil
+}
+
+func (r *Repository) RetireZkSnarksKeyPairs(ids []uint, retiredAt time.Time) error {
+	return r.connection.Model(&models.ZkSnarksKeyPair{}).
+		Where("id IN ? AND retired_at IS NULL", ids).
+		Update("retired_at", retiredAt).Error
+}
+
+// MarkZkProofsToReprove asks the users whose email or phone number proofs
+// were made with one of the given superseded key pairs to verify the
+// attribute again by reproveBy, when the key pairs are retired. The
+// attributes stay verified meanwhile. Users already asked keep their
+// deadline. It returns how many attributes were marked. Email domain proofs
+// need no new verification, they are made again from the stored domain.
+func (r *Repository) MarkZkProofsToReprove(keyPairIDs []uint, reproveBy time.Time) (int, error) {
+	marked := 0
+
+	err := r.connection.Transaction(func(tx *gorm.DB) error {
+		emailUsers := tx.Model(&models.User{}).Select("id").
+			Where("zk_key_pair_id IN ? AND octet_length(email_proof) > 0", keyPairIDs)
+
+		result := tx.Model(&models.UserMetadata{}).
+			Where("is_email_verified AND email_reprove_by IS NULL AND id IN (?)", emailUsers).
+			Update("email_reprove_by", reproveBy)
+		if result.Error != nil {
+			return result.Error
+		}
+		marked += int(result.RowsAffected)
+
+		phoneNumberUsers := tx.Model(&models.User{}).Select("id").
+			Where("phone_number_zk_pair_id IN ? AND octet_length(phone_number_zk_proof) > 0", keyPairIDs)
+
+		result = tx.Model(&models.UserMetadata{}).
+			Where("is_phone_number_verified AND phone_number_reprove_by IS NULL AND id IN (?)", phoneNumberUsers).
+			Update("phone_number_reprove_by", reproveBy)
+		if result.Error != nil {
+			return result.Error
+		}
+		marked += int(result.RowsAffected)
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return marked, nil
+}
+
+// ResetProofsOfRetiredZkKeyPairs drops email and phone number proofs
+// made with a retired key pair and marks the attributes unverified. Their
+// users were asked to verify them again under the active key pair for the
+// grace period before the retirement, see MarkZkProofsToReprove. The proofs
+// cannot be regenerated in place because the email address and phone number
+// they prove are never stored. The email domain is dropped along with the
+// email proof, and so are its proofs. Email domain proofs made with a retired
+// key pair are dropped alone, they are made again when next released.
+func (r *Repository) ResetProofsOfRetiredZkKeyPairs() (int, error) {
+	reset := 0
+
+	err := r.connection.Transaction(func(tx *gorm.DB) error {
+		retired := tx.Model(&models.ZkSnarksKeyPair{}).Select("id").Where("retired_at IS NOT NULL")
+
+		var emailUserIDs []uint
+		err := tx.Model(&models.User{}).
+			Where("zk_key_pair_id IN (?) AND octet_length(email_proof) > 0", retired).
+			Pluck("id", &emailUserIDs).Error
+		if err != nil {
+			return err
+		}
+
+		if len(emailUserIDs) > 0 {
+			err = tx.Model(&models.User{}).Where("id IN ?", emailUserIDs).Updates(map[string]interface{}{
+				"verification_code": "",
+				"email_proof":       []byte{},
+			}).Error
+			if err != nil {
+				return err
+			}
+
+			err = tx.Model(&models.UserMetadata{}).Where("id IN ?", emailUserIDs).Updates(map[string]interface{}{
+				"is_email_verified": false,
+				"email_reprove_by":  nil,
+			}).Error
+			if err != nil {
+				return err
+			}
+
+			err = tx.Where("user_id IN ?", emailUserIDs).Delete(&models.EmailDomainProof{}).Error
+			if err != nil {
+				return err
+			}
+
+			err = tx.Where("user_id IN ?", emailUserIDs).Delete(&models.UserEmailDomain{}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.Where("zk_key_pair_id IN (?)", retired).Delete(&models.EmailDomainProof{}).Error
+		if err != nil {
+			return err
+		}
+
+		var phoneNumberUserIDs []uint
+		err = tx.Model(&models.User{}).
+			Where("phone_number_zk_pair_id IN (?) AND octet_length(phone_number_zk_proof) > 0", retired).
+			Pluck("id", &phoneNumberUserIDs).Error
+		if err != nil {
+			return err
+		}
+
+		if len(phoneNumberUserIDs) > 0 {
+			err = tx.Model(&models.User{}).Where("id IN ?", phoneNumberUserIDs).Updates(map[string]interface{}{
+				"phone_number_verification_code": "",
+				"phone_number_zk_proof":          []byte{},
+			}).Error
+			if err != nil {
+				return err
+			}
+
+			err = tx.Model(&models.UserMetadata{}).Where("id IN ?", phoneNumberUserIDs).Updates(map[string]interface{}{
+				"is_phone_number_verified": false,
+				"phone_number_reprove_by":  nil,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		reset = len(emailUserIDs) + len(phoneNumberUserIDs)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return reset, nil
+}
+
+// SaveUserEmailDomain replaces the email domain of a user, nil when the last
+// verified address has none that can be proved. The proofs made for clients
+// belong to the previous address and are dropped.
+func (r *Repository) SaveUserEmailDomain(userID uint, emailDomain *models.UserEmailDomain) error {
+	return r.connection.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ?", userID).Delete(&models.EmailDomainProof{}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("user_id = ?", userID).Delete(&models.UserEmailDomain{}).Error
+		if err != nil {
+			return err
+		}
+
+		if emailDomain == nil {
+			return nil
+		}
+
+		emailDomain.UserID = userID
+		return tx.Create(emailDomain).Error
+	})
+}
+
+func (r *Repository) GetEmailDomainProofs(userID uint) ([]models.EmailDomainProof, error) {
+	var proofs []models.EmailDomainProof
+	err := r.connection.Where("user_id = ?", userID).Order("id").Find(&proofs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return proofs, nil
+}
+
+func (r *Repository) CreateZkProofJob(job models.ZkProofJob) (uint, error) {
+	if err := r.connection.Create(&job).Error; err != nil {
+		return 0, err
+	}
+
+	return job.ID, nil
+}
+
+// ClaimZkProofJob marks the oldest waiting job as running and returns it. A
+// job still running since before staleBefore is claimed again, its worker is
+// assumed dead. Rows locked by another worker are skipped, so several server
+// instances can share the queue.
+func (r *Repository) ClaimZkProofJob(now time.Time, staleBefore time.Time) (models.ZkProofJob, error) {
+	var job models.ZkProofJob
+
+	err := r.connection.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where(
+				"status = ? OR (status = ? AND started_at < ?)",
+				models.ZkProofJobPending, models.ZkProofJobRunning, staleBefore,
+			).
+			Order("id").
+			First(&job).Error
+		if err != nil {
+			return err
+		}
+
+		job.Status = models.ZkProofJobRunning
+		job.Attempts++
+		job.StartedAt = &now
+
+		return tx.Model(&models.ZkProofJob{}).Where("id = ?", job.ID).Updates(map[string]interface{}{
+			"status":     job.Status,
+			"attempts":   job.Attempts,
+			"started_at": now,
+		}).Error
+	})
+	if err != nil {
+		return models.ZkProofJob{}, err
+	}
+
+	return job, nil
+}
+
+func (r *Repository) CompleteZkProofJob(id uint, zkKeyPairID uint, finishedAt time.Time) error {
+	return r.connection.Model(&models.ZkProofJob{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":         models.ZkProofJobDone,
+		"zk_key_pair_id": zkKeyPairID,
+		"input":          "",
+		"finished_at":    finishedAt,
+	}).Error
+}
+
+func (r *Repository) FailZkProofJob(id uint, jobError string, finishedAt time.Time) error {
+	return r.connection.Model(&models.ZkProofJob{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":      models.ZkProofJobFailed,
+		"error":       jobError,
+		"input":       "",
+		"finished_at": finishedAt,
+	}).Error
+}
+
+// ExpireZkProofJobs fails the unfinished jobs queued before queuedBefore and
+// clears their input. It returns how many jobs were expired.
+func (r *Repository) ExpireZkProofJobs(queuedBefore time.Time, finishedAt time.Time) (int64, error) {
+	result := r.connection.Model(&models.ZkProofJob{}).
+		Where("status IN ? AND created_at < ?", []string{models.ZkProofJobPending, models.ZkProofJobRunning}, queuedBefore).
+		Updates(map[string]interface{}{
+			"status":      models.ZkProofJobFailed,
+			"error":       "expired before it was proved",
+			"input":       "",
+			"finished_at": finishedAt,
+		})
+
+	return result.RowsAffected, result.Error
+}
+
+func (r *Repository) GetZkProofJob(id uint, userID uint) (models.ZkProofJob, error) {
+	var job models.ZkProofJob
+	err := r.connection.Where("id = ? AND user_id = ?", id, userID).First(&job).Error
+	if err != nil {
+		return models.ZkProofJob{}, err
+	}
+
+	return job, nil
+}
+
+func (r *Repository) CountPendingZkProofJobs() (int64, error) {
+	var count int64
+	err := r.connection.Model(&models.ZkProofJob{}).Where("status = ?", models.ZkProofJobPending).Count(&count).Error
+
+	return count, err
+}
+
 func (r *Repository) GetUserForUsername(username string) (models.User, error) {
 	var user models.User
 
@@ -289,6 +935,9 @@ func (r *Repository) IsBackendURIExists(backendURL string) (bool, error) {
 	return count > 0, nil
 }
 
+// RegisterPrecheckUser reserves the username for a registration. It does
+// nothing if the username is already taken, by a completed account or by
+// another pending registration.
 func (r *Repository) RegisterPrecheckUser(req dto.RegisterUserPrecheckDTO, salt string, iterCount int) error {
 	user := models.User{
 		Username:       req.Username,
@@ -297,7 +946,8 @@ func (r *Repository) RegisterPrecheckUser(req dto.RegisterUserPrecheckDTO, salt
 		PublicKey:      []byte{},
 	}
 
-	if err := r.connection.Create(&user).Error; err != nil {
+	err := r.connection.Clauses(clause.OnConflict{DoNothing: true}).Create(&user).Error
+	if err != nil {
 		return fmt.Errorf("failed to create a new user: %v", err)
 	}
 
@@ -318,10 +968,32 @@ func (r *Repository) RegisterPrecheckClient(req dto.RegisterClientPrecheckDTO, s
 	return nil
 }
 
-func (r *Repository) UpdateUserPassword(username string, storedKey string, serverKey string) error {
-	return r.connection.Model(&models.User{}).
-		Where("username=?", username).
-		Updates(map[string]interface{}{"stored_key": storedKey, "server_key": serverKey}).Error
+// UpdateUserPassword replaces the SCRAM keys of the user and revokes all of
+// their sessions at revokedAt.
+func (r *Repository) UpdateUserPassword(
+	username string, storedKey string, serverKey string, revokedAt time.Time,
+) error {
+	return r.connection.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		err := tx.Where("username = ?", username).First(&user).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&models.User{}).
+			Where("id = ?", user.ID).
+			Updates(map[string]interface{}{
+				"stored_key": storedKey,
+				"server_key": serverKey,
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&models.Session{}).
+			Where("user_id = ? AND revoked_at IS NULL", user.ID).
+			Update("revoked_at", revokedAt).Error
+	})
 }
 
 func (r *Repository) CreateClientTrafficStatisticsEntry(clientId string, rate int) error {
@@ -494,7 +1166,10 @@ func (r *Repository) SaveProofOfPhoneNumberVerification(
 		&models.UserMetadata{},
 	).Where(
 		"id = ?", userID,
-	).Update("is_phone_number_verified", true).Error
+	).Updates(map[string]interface{}{
+		"is_phone_number_verified": true,
+		"phone_number_reprove_by":  nil,
+	}).Error
 
 	if err != nil {
 		tx.Rollback()
@@ -512,3 +1187,483 @@ func (r *Repository) SaveTelegramSessionIDHash(userID uint, sessionID []byte) er
 		"id = ?", userID,
 	).Update("telegram_session_id_hash", sessionID).Error
 }
+
+func (r *Repository) GetConnectedApps(userID uint) ([]models.ConnectedApp, error) {
+	var apps []models.ConnectedApp
+
+	err := r.connection.Model(&models.UserConsent{}).
+		Select("user_consents.client_id, clients.name AS client_name, user_consents.scopes, "+
+			"user_consents.granted_at, user_consents.last_used_at").
+		Joins("JOIN clients ON clients.id = user_consents.client_id").
+		Where("user_consents.user_id = ?", userID).
+		Order("user_consents.granted_at DESC").
+		Scan(&apps).
+		Error
+
+	if err != nil {
+		return nil, err
+	}
+
+	return apps, nil
+}
+
+// DeleteUserConsent deletes the consent of the user to the client and
+// revokes the sessions the client holds for the user.
+func (r *Repository) DeleteUserConsent(userID uint, clientID string, revokedAt time.Time) error {
+	return r.connection.Transaction(func(tx *gorm.DB) error {
+		result := tx.
+			Where("user_id = ? AND client_id = ?", userID, clientID).
+			Delete(&models.UserConsent{})
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("the app is not connected to the user's account")
+		}
+
+		return tx.Model(&models.Session{}).
+			Where("user_id = ? AND client_id = ? AND revoked_at IS NULL", userID, clientID).
+			Update("revoked_at", revokedAt).Error
+	})
+}
+
+func (r *Repository) GetClientRedirectURIs(clientID string) ([]models.ClientRedirectURI, error) {
+	var redirectURIs []models.ClientRedirectURI
+
+	err := r.connection.Where("client_id = ?", clientID).
+		Order("id").
+		Find(&redirectURIs).
+		Error
+
+	if err != nil {
+		return nil, err
+	}
+
+	return redirectURIs, nil
+}
+
+func (r *Repository) AddClientRedirectURI(clientID string, redirectURI string) error {
+	var count int64
+
+	err := r.connection.Model(&models.ClientRedirectURI{}).
+		Where("client_id = ? AND redirect_uri = ?", clientID, redirectURI).
+		Count(&count).
+		Error
+
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return fmt.Errorf("the redirect uri is already registered")
+	}
+
+	return r.connection.Create(&models.ClientRedirectURI{
+		ClientID:    clientID,
+		RedirectURI: redirectURI,
+	}).Error
+}
+
+func (r *Repository) RemoveClientRedirectURI(clientID string, redirectURI string) error {
+	tx := r.connection.Begin(&sql.TxOptions{Isolation: sql.LevelSerializable})
+
+	var count int64
+	err := tx.Model(&models.ClientRedirectURI{}).
+		Where("client_id = ?", clientID).
+		Count(&count).
+		Error
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if count <= 1 {
+		tx.Rollback()
+		return fmt.Errorf("a client must keep at least one redirect uri")
+	}
+
+	result := tx.Where("client_id = ? AND redirect_uri = ?", clientID, redirectURI).
+		Delete(&models.ClientRedirectURI{})
+
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return fmt.Errorf("the redirect uri is not registered")
+	}
+
+	return tx.Commit().Error
+}
+
+// RotateClientSecret replaces the client's secret hash, keeping the current
+// one valid until previousExpiresAt. A secret still inside an earlier overlap
+// window is dropped, so at most two secrets are ever valid.
+func (r *Repository) RotateClientSecret(clientID string, secretHash string, previousExpiresAt time.Time) error {
+	result := r.connection.Model(&models.Client{}).
+		Where("id = ?", clientID).
+		Updates(map[string]interface{}{
+			"previous_secret_hash":       gorm.Expr("secret_hash"),
+			"previous_secret_expires_at": previousExpiresAt,
+			"secret_hash":                secretHash,
+		})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no client found with id: %s", clientID)
+	}
+
+	return nil
+}
+
+func (r *Repository) SetClientRequireUserTwoFactor(clientID string, required bool) error {
+	result := r.connection.Model(&models.Client{}).
+		Where("id = ?", clientID).
+		Update("require_user_two_factor", required)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no client found with id: %s", clientID)
+	}
+
+	return nil
+}
+
+// RegisterDynamicClient creates a client registered through the dynamic client
+// registration API together with its redirect uris and traffic statistics.
+func (r *Repository) RegisterDynamicClient(client models.Client, redirectURIs []string, ratePerByte int) error {
+	tx := r.connection.Begin()
+
+	if err := tx.Create(&client).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not create client: %v", err)
+	}
+
+	for _, redirectURI := range redirectURIs {
+		err := tx.Create(&models.ClientRedirectURI{
+			ClientID:    client.ID,
+			RedirectURI: redirectURI,
+		}).Error
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not register the redirect uri: %v", err)
+		}
+	}
+
+	err := tx.Create(&models.ClientTrafficStatistics{
+		ClientId:                   client.ID,
+		RatePerByte:                ratePerByte,
+		TotalUsageBytes:            0,
+		UnpaidAmount:               0,
+		LastTrafficUpdateTimestamp: time.Now().UTC(),
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not create client traffic statistics: %v", err)
+	}
+
+	return tx.Commit().Error
+}
+
+func (r *Repository) GetClientByID(clientID string) (models.Client, error) {
+	var client models.Client
+	if err := r.connection.Where("id = ?", clientID).First(&client).Error; err != nil {
+		return models.Client{}, err
+	}
+	return client, nil
+}
+
+// UpdateRegisteredClient replaces the metadata of a dynamically registered
+// client, including its whole set of redirect uris.
+func (r *Repository) UpdateRegisteredClient(client models.Client, redirectURIs []string) error {
+	tx := r.connection.Begin()
+
+	result := tx.Model(&models.Client{}).
+		Where("id = ?", client.ID).
+		Updates(map[string]interface{}{
+			"name":         client.Name,
+			"redirect_uri": client.RedirectURI,
+			"backend_uri":  client.BackendURI,
+			"logo_uri":     client.LogoURI,
+			"contacts":     client.Contacts,
+			"grant_types":  client.GrantTypes,
+		})
+
+	if result.Error != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not update client: %v", result.Error)
+	}
+
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return fmt.Errorf("no client found with id: %s", client.ID)
+	}
+
+	err := tx.Where("client_id = ?", client.ID).Delete(&models.ClientRedirectURI{}).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not remove the redirect uris: %v", err)
+	}
+
+	for _, redirectURI := range redirectURIs {
+		err := tx.Create(&models.ClientRedirectURI{
+			ClientID:    client.ID,
+			RedirectURI: redirectURI,
+		}).Error
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not register the redirect uri: %v", err)
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// DeleteRegisteredClient removes a client together with everything recorded
+// for it. A client that still owes for its traffic is kept.
+func (r *Repository) DeleteRegisteredClient(clientID string) error {
+	tx := r.connection.Begin()
+
+	var clientStatistics models.ClientTrafficStatistics
+	err := tx.Where("client_id = ?", clientID).First(&clientStatistics).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		tx.Rollback()
+		return err
+	}
+
+	if clientStatistics.UnpaidAmount > 0 {
+		tx.Rollback()
+		return fmt.Errorf("the client has unpaid traffic and cannot be deleted")
+	}
+
+	for _, model := range []interface{}{
+		&models.ClientRedirectURI{},
+		&models.UserConsent{},
+		&models.ClientTrafficStatistics{},
+		&serverModels.PairwiseSubject{},
+		&serverModels.DeviceAuthorization{},
+	} {
+		if err := tx.Where("client_id = ?", clientID).Delete(model).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	result := tx.Where("id = ?", clientID).Delete(&models.Client{})
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return fmt.Errorf("no client found with id: %s", clientID)
+	}
+
+	return tx.Commit().Error
+}
+
+// CreateSession stores a new session, and deletes the sessions that expired
+// before it started.
+func (r *Repository) CreateSession(session models.Session) error {
+	return r.connection.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("expires_at <= ?", session.CreatedAt).Delete(&models.Session{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&session).Error
+	})
+}
+
+// TouchSession finds the session and records its use in one statement, so
+// a session revoked in the meantime is not accepted.
+func (r *Repository) TouchSession(jti string, now time.Time) error {
+	result := r.connection.Model(&models.Session{}).
+		Where("jti = ? AND revoked_at IS NULL AND expires_at > ?", jti, now).
+		Update("last_seen_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetUserSessions returns the active sessions of the user portal and of the
+// apps acting for the user, the most recently seen first.
+func (r *Repository) GetUserSessions(userID uint, now time.Time) ([]models.Session, error) {
+	var sessions []models.Session
+	err := r.connection.
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, now).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// GetClientSessions returns the active sessions of the client portal, the
+// most recently seen first. The sessions the client holds for users are
+// listed to the users.
+func (r *Repository) GetClientSessions(clientID string, now time.Time) ([]models.Session, error) {
+	var sessions []models.Session
+	err := r.connection.
+		Where(
+			"principal = ? AND client_id = ? AND revoked_at IS NULL AND expires_at > ?",
+			models.ScramPrincipalClient, clientID, now,
+		).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// RevokeUserSessions revokes the session of the user with the id, or all of
+// their sessions if id is 0.
+func (r *Repository) RevokeUserSessions(userID uint, id uint, revokedAt time.Time) error {
+	query := r.connection.Model(&models.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID)
+	if id != 0 {
+		query = query.Where("id = ?", id)
+	}
+
+	result := query.Update("revoked_at", revokedAt)
+	if result.Error != nil {
+		return result.Error
+	}
+	if id != 0 && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// RevokeClientSessions revokes the client portal session of the client with
+// the id, or all of them if id is 0.
+func (r *Repository) RevokeClientSessions(clientID string, id uint, revokedAt time.Time) error {
+	query := r.connection.Model(&models.Session{}).
+		Where("principal = ? AND client_id = ? AND revoked_at IS NULL", models.ScramPrincipalClient, clientID)
+	if id != 0 {
+		query = query.Where("id = ?", id)
+	}
+
+	result := query.Update("revoked_at", revokedAt)
+	if result.Error != nil {
+		return result.Error
+	}
+	if id != 0 && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (r *Repository) RevokeSession(jti string, revokedAt time.Time) error {
+	return r.connection.Model(&models.Session{}).
+		Where("jti = ? AND revoked_at IS NULL", jti).
+		Update("revoked_at", revokedAt).Error
+}
+
+// GetDataAccessRecords returns the releases of the user's metadata, the
+// latest first. clientID, since and until narrow them down when they are
+// set.
+func (r *Repository) GetDataAccessRecords(
+	userID uint, clientID string, since time.Time, until time.Time,
+) ([]models.DataAccessRecord, error) {
+	query := r.connection.Model(&models.DataAccessRecord{}).
+		Select("data_access_records.id, data_access_records.client_id, clients.name AS client_name, "+
+			"data_access_records.scopes, data_access_records.fields, data_access_records.accessed_at").
+		Joins("LEFT JOIN clients ON clients.id = data_access_records.client_id").
+		Where("data_access_records.user_id = ?", userID)
+	if clientID != "" {
+		query = query.Where("data_access_records.client_id = ?", clientID)
+	}
+	if !since.IsZero() {
+		query = query.Where("data_access_records.accessed_at >= ?", since)
+	}
+	if !until.IsZero() {
+		query = query.Where("data_access_records.accessed_at < ?", until)
+	}
+
+	var records []models.DataAccessRecord
+	err := query.Order("data_access_records.accessed_at DESC").Scan(&records).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (r *Repository) GetDataAccessDigest(userID uint) (models.DataAccessDigest, error) {
+	var digest models.DataAccessDigest
+	err := r.connection.Where("user_id = ?", userID).First(&digest).Error
+	return digest, err
+}
+
+// SaveDataAccessDigest subscribes the user to the digest, or changes the
+// address of the subscription.
+func (r *Repository) SaveDataAccessDigest(digest models.DataAccessDigest) error {
+	return r.connection.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"email"}),
+	}).Create(&digest).Error
+}
+
+func (r *Repository) DeleteDataAccessDigest(userID uint) error {
+	return r.connection.Where("user_id = ?", userID).Delete(&models.DataAccessDigest{}).Error
+}
+
+// ClaimDueDataAccessDigests claims the digests last sent, or subscribed to,
+// before sentBefore that are not claimed yet, or whose claim was taken
+// before claimedBefore and abandoned. The claim is a single UPDATE, so every
+// digest is claimed by only one of the instances sending them.
+func (r *Repository) ClaimDueDataAccessDigests(
+	now time.Time, sentBefore time.Time, claimedBefore time.Time,
+) ([]models.DataAccessDigest, error) {
+	var digests []models.DataAccessDigest
+	err := r.connection.Model(&digests).
+		Clauses(clause.Returning{}).
+		Where("COALESCE(last_sent_at, created_at) < ?", sentBefore).
+		Where("claimed_at IS NULL OR claimed_at < ?", claimedBefore).
+		Update("claimed_at", now).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return digests, nil
+}
+
+// ReleaseDataAccessDigest gives up the claim on a digest that could not be
+// sent, so that it is claimed again on the next round.
+func (r *Repository) ReleaseDataAccessDigest(userID uint) error {
+	return r.connection.Model(&models.DataAccessDigest{}).
+		Where("user_id = ?", userID).
+		Update("claimed_at", nil).Error
+}
+
+func (r *Repository) MarkDataAccessDigestSent(userID uint, sentAt time.Time) error {
+	return r.connection.Model(&models.DataAccessDigest{}).
+		Where("user_id = ?", userID).
+		Updates(map[string]interface{}{
+			"last_sent_at": sentAt,
+			"claimed_at":   nil,
+		}).Error
+}
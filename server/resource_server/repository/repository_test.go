@@ -2,7 +2,9 @@ package repository
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"globe-and-citizen/layer8/server/constants"
 	"globe-and-citizen/layer8/server/resource_server/dto"
 	"globe-and-citizen/layer8/server/resource_server/interfaces"
 	"globe-and-citizen/layer8/server/resource_server/models"
@@ -34,7 +36,7 @@ const verificationCode = "123456"
 const clientId = "1"
 const clientUsername = "client_username"
 const clientName = "test_client"
-const clientSecret = "client_secret"
+const clientSecretHash = "client_secret_hash"
 const redirectUri = "https://gcitizen.com/callback"
 const backendUri = "https://gcitizen.com/backend"
 const clientSalt = "client_salt"
@@ -87,7 +89,7 @@ func TestGetClientData_ClientDoesNotExist(t *testing.T) {
 	).WithArgs(
 		clientName, 1,
 	).WillReturnRows(
-		sqlmock.NewRows([]string{"id", "secret", "name", "redirect_uri"}),
+		sqlmock.NewRows([]string{"id", "name", "redirect_uri"}),
 	)
 
 	_, err := repository.GetClientData(clientName)
@@ -109,9 +111,9 @@ func TestGetClientData_Success(t *testing.T) {
 		clientName, 1,
 	).WillReturnRows(
 		sqlmock.NewRows(
-			[]string{"id", "secret", "name", "redirect_uri", "username", "salt"},
+			[]string{"id", "name", "redirect_uri", "username", "salt"},
 		).AddRow(
-			clientId, clientSecret, clientName, redirectUri, clientUsername, clientSalt,
+			clientId, clientName, redirectUri, clientUsername, clientSalt,
 		),
 	)
 
@@ -120,7 +122,6 @@ func TestGetClientData_Success(t *testing.T) {
 	assert.Nil(t, err)
 
 	assert.Equal(t, clientId, client.ID)
-	assert.Equal(t, clientSecret, client.Secret)
 	assert.Equal(t, clientName, client.Name)
 	assert.Equal(t, redirectUri, client.RedirectURI)
 	assert.Equal(t, clientUsername, client.Username)
@@ -324,9 +325,9 @@ func TestProfileClient_Success(t *testing.T) {
 		clientUsername, 1,
 	).WillReturnRows(
 		sqlmock.NewRows(
-			[]string{"id", "secret", "name", "redirect_uri", "username"},
+			[]string{"id", "name", "redirect_uri", "username"},
 		).AddRow(
-			clientId, clientSecret, clientName, redirectUri, clientUsername,
+			clientId, clientName, redirectUri, clientUsername,
 		),
 	)
 
@@ -337,7 +338,6 @@ func TestProfileClient_Success(t *testing.T) {
 	assert.Equal(t, clientId, client.ID)
 	assert.Equal(t, clientUsername, client.Username)
 	assert.Equal(t, clientName, client.Name)
-	assert.Equal(t, clientSecret, client.Secret)
 	assert.Equal(t, redirectUri, client.RedirectURI)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -632,9 +632,9 @@ func TestSaveProofOfEmailVerification_SettingUserStatusAsVerifiedFails(t *testin
 	)
 
 	mock.ExpectExec(
-		regexp.QuoteMeta(`UPDATE "user_metadata" SET "is_email_verified"=$1,"updated_at"=$2 WHERE id = $3`),
+		regexp.QuoteMeta(`UPDATE "user_metadata" SET "email_reprove_by"=$1,"is_email_verified"=$2,"updated_at"=$3 WHERE id = $4`),
 	).WithArgs(
-		true, sqlmock.AnyArg(), userId,
+		nil, true, sqlmock.AnyArg(), userId,
 	).WillReturnError(
 		fmt.Errorf(""),
 	)
@@ -673,9 +673,9 @@ func TestSaveProofOfEmailVerification_Success(t *testing.T) {
 	)
 
 	mock.ExpectExec(
-		regexp.QuoteMeta(`UPDATE "user_metadata" SET "is_email_verified"=$1,"updated_at"=$2 WHERE id = $3`),
+		regexp.QuoteMeta(`UPDATE "user_metadata" SET "email_reprove_by"=$1,"is_email_verified"=$2,"updated_at"=$3 WHERE id = $4`),
 	).WithArgs(
-		true, sqlmock.AnyArg(), userId,
+		nil, true, sqlmock.AnyArg(), userId,
 	).WillReturnResult(
 		sqlmock.NewResult(0, 1),
 	)
@@ -691,274 +691,271 @@ func TestSaveProofOfEmailVerification_Success(t *testing.T) {
 	}
 }
 
-func TestSaveZkSnarksKeyPair_FailedToSaveZkKeyPair(t *testing.T) {
+func TestCreateScramSession_Success(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
-	mock.ExpectBegin()
+	session := models.ScramSession{
+		Principal: models.ScramPrincipalUser,
+		Username:  username,
+		CNonce:    "c_nonce",
+		Nonce:     "c_nonces_nonce",
+		ExpiresAt: timestamp.Add(2 * time.Minute),
+		CreatedAt: timestamp,
+	}
 
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "scram_sessions" WHERE expires_at <= $1`),
+	).WithArgs(timestamp).WillReturnResult(sqlmock.NewResult(0, 3))
 	mock.ExpectQuery(
-		regexp.QuoteMeta(
-			`INSERT INTO "zk_snarks_key_pairs" ("proving_key","verifying_key") VALUES ($1,$2) RETURNING "id"`,
-		),
+		regexp.QuoteMeta(`INSERT INTO "scram_sessions" ("principal","username","c_nonce","nonce","expires_at","created_at") VALUES ($1,$2,$3,$4,$5,$6) RETURNING "id"`),
 	).WithArgs(
-		provingKey, verifyingKey,
-	).WillReturnError(
-		fmt.Errorf(""),
-	)
+		models.ScramPrincipalUser, username, "c_nonce", "c_nonces_nonce", timestamp.Add(2*time.Minute), timestamp,
+	).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
 
-	mock.ExpectRollback()
+	err := repository.CreateScramSession(session)
 
-	_, err = repository.SaveZkSnarksKeyPair(
-		models.ZkSnarksKeyPair{
-			ProvingKey:   provingKey,
-			VerifyingKey: verifyingKey,
-		},
-	)
+	assert.Nil(t, err)
 
-	assert.NotNil(t, err)
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("There were unfulfilled expectations: %s", err)
 	}
 }
 
-func TestSaveZkSnarksKeyPair_Success(t *testing.T) {
+func TestConsumeScramSession_Success(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
 	mock.ExpectBegin()
-
-	mock.ExpectQuery(
-		regexp.QuoteMeta(
-			`INSERT INTO "zk_snarks_key_pairs" ("proving_key","verifying_key") VALUES ($1,$2) RETURNING "id"`,
-		),
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "scram_sessions" WHERE principal = $1 AND username = $2 AND nonce = $3 AND c_nonce = $4 AND expires_at > $5`),
 	).WithArgs(
-		provingKey, verifyingKey,
-	).WillReturnRows(
-		sqlmock.NewRows(
-			[]string{"id"},
-		).AddRow(zkKeyPairId),
-	)
-
+		models.ScramPrincipalClient, clientUsername, "c_nonces_nonce", "c_nonce", timestamp,
+	).WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
 
-	actualZkTableId, err := repository.SaveZkSnarksKeyPair(
-		models.ZkSnarksKeyPair{
-			ProvingKey:   provingKey,
-			VerifyingKey: verifyingKey,
-		},
-	)
+	err := repository.ConsumeScramSession(models.ScramPrincipalClient, clientUsername, "c_nonces_nonce", "c_nonce", timestamp)
 
 	assert.Nil(t, err)
-	assert.Equal(t, zkKeyPairId, actualZkTableId)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("There were unfulfilled expectations: %s", err)
 	}
 }
 
-func TestGetZkSnarksKeys_FailedToGetNewestZkSnarksKeys(t *testing.T) {
+func TestConsumeScramSession_AlreadyConsumedOrExpired(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
-	mock.ExpectQuery(
-		regexp.QuoteMeta(`SELECT * FROM "zk_snarks_key_pairs" ORDER BY "zk_snarks_key_pairs"."id" DESC LIMIT $1`),
-	).WithArgs(1).WillReturnError(
-		fmt.Errorf(""),
-	)
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "scram_sessions" WHERE principal = $1 AND username = $2 AND nonce = $3 AND c_nonce = $4 AND expires_at > $5`),
+	).WithArgs(
+		models.ScramPrincipalUser, username, "c_nonces_nonce", "c_nonce", timestamp,
+	).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
 
-	_, err = repository.GetLatestZkSnarksKeys()
+	err := repository.ConsumeScramSession(models.ScramPrincipalUser, username, "c_nonces_nonce", "c_nonce", timestamp)
 
-	assert.NotNil(t, err)
+	assert.True(t, errors.Is(err, gorm.ErrRecordNotFound))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
 }
 
-func TestGetZkSnarksKeys_Success(t *testing.T) {
+func TestCreatePasswordResetChallenge_Success(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
+	challenge := models.PasswordResetChallenge{
+		Username:  username,
+		Challenge: "challenge",
+		ExpiresAt: timestamp.Add(5 * time.Minute),
+		CreatedAt: timestamp,
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "password_reset_challenges" WHERE expires_at <= $1`),
+	).WithArgs(timestamp).WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectQuery(
-		regexp.QuoteMeta(`SELECT * FROM "zk_snarks_key_pairs" ORDER BY "zk_snarks_key_pairs"."id" DESC LIMIT $1`),
-	).WithArgs(1).WillReturnRows(
-		sqlmock.NewRows(
-			[]string{"id", "proving_key", "verifying_key"},
-		).AddRow(
-			zkKeyPairId, provingKey, verifyingKey,
-		),
-	)
+		regexp.QuoteMeta(`INSERT INTO "password_reset_challenges" ("username","challenge","expires_at","created_at") VALUES ($1,$2,$3,$4) RETURNING "id"`),
+	).WithArgs(
+		username, "challenge", timestamp.Add(5*time.Minute), timestamp,
+	).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
 
-	zkKeyPair, err := repository.GetLatestZkSnarksKeys()
+	err := repository.CreatePasswordResetChallenge(challenge)
 
 	assert.Nil(t, err)
-	assert.True(t, utils.Equal(provingKey, zkKeyPair.ProvingKey))
-	assert.True(t, utils.Equal(verifyingKey, zkKeyPair.VerifyingKey))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
 }
 
-func TestGetUserForUsername_UserNotFound(t *testing.T) {
+func TestConsumePasswordResetChallenge_Success(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
-	mock.ExpectQuery(
-		regexp.QuoteMeta(
-			`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`,
-		),
-	).WithArgs(
-		username, 1,
-	).WillReturnError(
-		fmt.Errorf("user not found"),
-	)
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "password_reset_challenges" WHERE username = $1 AND challenge = $2 AND expires_at > $3`),
+	).WithArgs(username, "challenge", timestamp).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
 
-	_, err = repository.GetUserForUsername(username)
+	err := repository.ConsumePasswordResetChallenge(username, "challenge", timestamp)
 
-	assert.NotNil(t, err)
+	assert.Nil(t, err)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("There were unfulfilled expectations: %s", err)
 	}
 }
 
-func TestGetUserForUsername_Success(t *testing.T) {
+func TestConsumePasswordResetChallenge_AlreadyConsumedOrExpired(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
-	mock.ExpectQuery(
-		regexp.QuoteMeta(
-			`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`,
-		),
-	).WithArgs(
-		username, 1,
-	).WillReturnRows(
-		sqlmock.NewRows(
-			[]string{"id", "username", "salt", "stored_key", "server_key"},
-		).AddRow(
-			userId, username, userSalt, storedKey, serverKey,
-		),
-	)
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "password_reset_challenges" WHERE username = $1 AND challenge = $2 AND expires_at > $3`),
+	).WithArgs(username, "challenge", timestamp).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
 
-	user, err := repository.GetUserForUsername(username)
+	err := repository.ConsumePasswordResetChallenge(username, "challenge", timestamp)
 
-	assert.Nil(t, err)
-	assert.Equal(t, userId, user.ID)
-	assert.Equal(t, username, user.Username)
-	assert.Equal(t, userSalt, user.Salt)
-	assert.Equal(t, storedKey, user.StoredKey)
-	assert.Equal(t, serverKey, user.ServerKey)
+	assert.True(t, errors.Is(err, gorm.ErrRecordNotFound))
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("There were unfulfilled expectations: %s", err)
 	}
 }
 
-func TestRegisterPrecheckUser_Success(t *testing.T) {
+func TestSaveTwoFactorCredential_ConfirmedCredentialIsKept(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
-	req := dto.RegisterUserPrecheckDTO{
-		Username: "test_user",
-	}
-	salt := "random_salt"
-	iterCount := 4096
-
 	mock.ExpectBegin()
-
 	mock.ExpectQuery(
 		regexp.QuoteMeta(
-			`INSERT INTO "users" ("username","verification_code","email_proof","zk_key_pair_id","phone_number_verification_code","phone_number_zk_proof","phone_number_zk_pair_id","public_key","salt","iteration_count","server_key","stored_key","telegram_session_id_hash") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13) RETURNING "id"`,
+			`INSERT INTO "two_factor_credentials" ("principal","username","encrypted_secret","last_used_step","confirmed_at","created_at") `+
+				`VALUES ($1,$2,$3,$4,$5,$6) ON CONFLICT ("principal","username") DO UPDATE SET `+
+				`"encrypted_secret"="excluded"."encrypted_secret","last_used_step"="excluded"."last_used_step","created_at"="excluded"."created_at" `+
+				`WHERE two_factor_credentials.confirmed_at IS NULL RETURNING "id"`,
 		),
 	).WithArgs(
-		req.Username, "", sqlmock.AnyArg(), 0, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), salt, iterCount, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
-	).WillReturnRows(
-		sqlmock.NewRows([]string{"id"}).AddRow(1),
-	)
-
+		models.ScramPrincipalUser, username, "encrypted_secret", 0, nil, timestamp,
+	).WillReturnRows(sqlmock.NewRows([]string{"id"}))
 	mock.ExpectCommit()
 
-	err := repository.RegisterPrecheckUser(req, salt, iterCount)
+	err := repository.SaveTwoFactorCredential(models.TwoFactorCredential{
+		Principal:       models.ScramPrincipalUser,
+		Username:        username,
+		EncryptedSecret: "encrypted_secret",
+		CreatedAt:       timestamp,
+	})
 
-	assert.Nil(t, err, "Error should be nil")
-	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+	assert.ErrorIs(t, err, constants.ErrTwoFactorAlreadyEnabled)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
 }
 
-func TestRegisterPrecheckUser_RepositoryError(t *testing.T) {
+func TestUseTwoFactorStep_StepAlreadyUsed(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
-	req := dto.RegisterUserPrecheckDTO{
-		Username: "test_user",
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "two_factor_credentials" SET "last_used_step"=$1 WHERE id = $2 AND last_used_step < $3`),
+	).WithArgs(int64(100), 3, int64(100)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	err := repository.UseTwoFactorStep(3, 100)
+
+	assert.True(t, errors.Is(err, gorm.ErrRecordNotFound))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
 	}
-	salt := "random_salt"
-	iterCount := 4096
+}
 
-	mock.ExpectBegin()
+func TestConfirmTwoFactorCredential_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
 
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(
+			`UPDATE "two_factor_credentials" SET "confirmed_at"=$1,"last_used_step"=$2 `+
+				`WHERE id = $3 AND confirmed_at IS NULL AND last_used_step < $4`,
+		),
+	).WithArgs(timestamp, int64(100), 3, int64(100)).WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectQuery(
 		regexp.QuoteMeta(
-			`INSERT INTO "users" ("username","verification_code","email_proof","zk_key_pair_id","phone_number_verification_code","phone_number_zk_proof","phone_number_zk_pair_id","public_key","salt","iteration_count","server_key","stored_key","telegram_session_id_hash") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13) RETURNING "id"`,
+			`INSERT INTO "two_factor_recovery_codes" ("credential_id","code_hash","used_at") VALUES ($1,$2,$3),($4,$5,$6) RETURNING "id"`,
 		),
-	).WithArgs(
-		req.Username, "", sqlmock.AnyArg(), 0, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), salt, iterCount, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
-	).WillReturnError(fmt.Errorf("failed to create user"))
-
-	mock.ExpectRollback()
+	).WithArgs(3, "hash1", nil, 3, "hash2", nil).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	mock.ExpectCommit()
 
-	err := repository.RegisterPrecheckUser(req, salt, iterCount)
+	err := repository.ConfirmTwoFactorCredential(3, 100, timestamp, []string{"hash1", "hash2"})
 
-	assert.NotNil(t, err, "Expected error due to database error")
-	assert.Equal(t, "failed to create a new user: failed to create user", err.Error())
+	assert.Nil(t, err)
 
-	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
 }
 
-func TestRegisterPrecheckUser_BeginTransactionFailure(t *testing.T) {
+func TestConsumeWebAuthnChallenge_LoginChallenge(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
-	req := dto.RegisterUserPrecheckDTO{
-		Username: "test_user",
-	}
-	salt := "random_salt"
-	iterCount := 4096
-
-	mock.ExpectBegin().WillReturnError(fmt.Errorf("failed to begin transaction"))
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(
+			`DELETE FROM "webauthn_challenges" WHERE (ceremony = $1 AND challenge = $2 AND expires_at > $3) AND user_id IS NULL`,
+		),
+	).WithArgs("login", "challenge", timestamp).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
 
-	err := repository.RegisterPrecheckUser(req, salt, iterCount)
+	err := repository.ConsumeWebAuthnChallenge("login", "challenge", 0, timestamp)
 
-	assert.NotNil(t, err, "Error should not be nil")
-	assert.Contains(t, err.Error(), "failed to begin transaction", "Error message should contain 'failed to begin transaction'")
+	assert.True(t, errors.Is(err, gorm.ErrRecordNotFound))
 
-	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
 }
 
-func TestRegisterUser_FailToGetUserRecord(t *testing.T) {
+func TestUseWebAuthnCredential_SignCountDidNotIncrease(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
 	mock.ExpectBegin()
-
-	mock.ExpectQuery(
+	mock.ExpectExec(
 		regexp.QuoteMeta(
-			`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`,
+			`UPDATE "passkeys" SET "last_used_at"=$1,"sign_count"=$2 `+
+				`WHERE id = $3 AND (sign_count < $4 OR (sign_count = 0 AND $5 = 0))`,
 		),
-	).WithArgs(
-		username, 1,
-	).WillReturnError(
-		fmt.Errorf("could not get user record"),
-	)
+	).WithArgs(timestamp, uint32(7), 5, uint32(7), uint32(7)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
 
-	mock.ExpectRollback()
+	err := repository.UseWebAuthnCredential(5, 7, timestamp)
 
-	userDto := dto.RegisterUserDTO{
-		Username:  username,
-		PublicKey: publicKey,
-		StoredKey: storedKey,
-		ServerKey: serverKey,
-	}
-	err = repository.RegisterUser(userDto)
+	assert.True(t, errors.Is(err, gorm.ErrRecordNotFound))
 
-	assert.NotNil(t, err)
-	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
 }
 
-func TestRegisterUser_FailToUpdateUserRecord(t *testing.T) {
+func TestSaveZkSnarksKeyPair_FailedToSaveZkKeyPair(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
@@ -966,45 +963,31 @@ func TestRegisterUser_FailToUpdateUserRecord(t *testing.T) {
 
 	mock.ExpectQuery(
 		regexp.QuoteMeta(
-			`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`,
-		),
-	).WithArgs(
-		username, 1,
-	).WillReturnRows(
-		sqlmock.NewRows(
-			[]string{
-				"id", "username", "salt", "email_proof", "verification_code", "zk_key_pair_id", "public_key", "iteration_count", "server_key", "stored_key",
-			},
-		).AddRow(
-			userId, username, userSalt, emailProof, verificationCode, 0, publicKey, 4096, serverKey, storedKey,
-		),
-	)
-
-	mock.ExpectExec(
-		regexp.QuoteMeta(
-			`UPDATE "users" SET "public_key"=$1,"server_key"=$2,"stored_key"=$3 WHERE "id" = $4`,
+			`INSERT INTO "zk_snarks_key_pairs" ("circuit","proving_key","verifying_key","created_at","retired_at","transcript_hash") VALUES ($1,$2,$3,$4,$5,$6) RETURNING "id"`,
 		),
 	).WithArgs(
-		publicKey, serverKey, storedKey, userId,
+		models.ZkCircuitVerificationCode, provingKey, verifyingKey, sqlmock.AnyArg(), nil, nil,
 	).WillReturnError(
-		fmt.Errorf("could not update user record"),
+		fmt.Errorf(""),
 	)
 
 	mock.ExpectRollback()
 
-	userDto := dto.RegisterUserDTO{
-		Username:  username,
-		PublicKey: publicKey,
-		StoredKey: storedKey,
-		ServerKey: serverKey,
-	}
-	err = repository.RegisterUser(userDto)
+	_, err = repository.SaveZkSnarksKeyPair(
+		models.ZkSnarksKeyPair{
+			Circuit:      models.ZkCircuitVerificationCode,
+			ProvingKey:   provingKey,
+			VerifyingKey: verifyingKey,
+		},
+	)
 
 	assert.NotNil(t, err)
-	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
 }
 
-func TestRegisterUser_FailToInsertANewUserMetadataRecord(t *testing.T) {
+func TestSaveZkSnarksKeyPair_Success(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
@@ -1012,313 +995,1725 @@ func TestRegisterUser_FailToInsertANewUserMetadataRecord(t *testing.T) {
 
 	mock.ExpectQuery(
 		regexp.QuoteMeta(
-			`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`,
+			`INSERT INTO "zk_snarks_key_pairs" ("circuit","proving_key","verifying_key","created_at","retired_at","transcript_hash") VALUES ($1,$2,$3,$4,$5,$6) RETURNING "id"`,
 		),
 	).WithArgs(
-		username, 1,
+		models.ZkCircuitVerificationCode, provingKey, verifyingKey, sqlmock.AnyArg(), nil, nil,
 	).WillReturnRows(
 		sqlmock.NewRows(
-			[]string{
-				"id", "username", "salt", "email_proof", "verification_code", "zk_key_pair_id", "public_key", "iteration_count", "server_key", "stored_key",
-			},
+			[]string{"id"},
+		).AddRow(zkKeyPairId),
+	)
+
+	mock.ExpectCommit()
+
+	actualZkTableId, err := repository.SaveZkSnarksKeyPair(
+		models.ZkSnarksKeyPair{
+			Circuit:      models.ZkCircuitVerificationCode,
+			ProvingKey:   provingKey,
+			VerifyingKey: verifyingKey,
+		},
+	)
+
+	assert.Nil(t, err)
+	assert.Equal(t, zkKeyPairId, actualZkTableId)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetZkSnarksKeys_FailedToGetNewestZkSnarksKeys(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT * FROM "zk_snarks_key_pairs" WHERE circuit = $1 AND retired_at IS NULL ORDER BY "zk_snarks_key_pairs"."id" DESC LIMIT $2`),
+	).WithArgs(models.ZkCircuitEmailDomain, 1).WillReturnError(
+		fmt.Errorf(""),
+	)
+
+	_, err = repository.GetLatestZkSnarksKeys(models.ZkCircuitEmailDomain)
+
+	assert.NotNil(t, err)
+}
+
+func TestGetZkSnarksKeys_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT * FROM "zk_snarks_key_pairs" WHERE circuit = $1 AND retired_at IS NULL ORDER BY "zk_snarks_key_pairs"."id" DESC LIMIT $2`),
+	).WithArgs(models.ZkCircuitEmailDomain, 1).WillReturnRows(
+		sqlmock.NewRows(
+			[]string{"id", "proving_key", "verifying_key"},
 		).AddRow(
-			userId, username, userSalt, emailProof, verificationCode, 0, publicKey, 4096, serverKey, storedKey,
+			zkKeyPairId, provingKey, verifyingKey,
+		),
+	)
+
+	zkKeyPair, err := repository.GetLatestZkSnarksKeys(models.ZkCircuitEmailDomain)
+
+	assert.Nil(t, err)
+	assert.True(t, utils.Equal(provingKey, zkKeyPair.ProvingKey))
+	assert.True(t, utils.Equal(verifyingKey, zkKeyPair.VerifyingKey))
+}
+
+func TestGetZkSnarksVerifyingKeys_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT "id","circuit","verifying_key","created_at","retired_at","transcript_hash" FROM "zk_snarks_key_pairs" ORDER BY id`),
+	).WillReturnRows(
+		sqlmock.NewRows(
+			[]string{"id", "circuit", "verifying_key", "created_at", "retired_at", "transcript_hash"},
+		).AddRow(
+			zkKeyPairId, models.ZkCircuitVerificationCode, verifyingKey, time.Now(), time.Now(), nil,
+		).AddRow(
+			zkKeyPairId+1, models.ZkCircuitEmailDomain, verifyingKey, time.Now(), nil, "transcript hash",
 		),
 	)
 
+	keyPairs, err := repository.GetZkSnarksVerifyingKeys()
+
+	assert.Nil(t, err)
+	assert.Len(t, keyPairs, 2)
+	assert.Equal(t, zkKeyPairId, keyPairs[0].ID)
+	assert.Empty(t, keyPairs[0].ProvingKey)
+	assert.NotNil(t, keyPairs[0].RetiredAt)
+	assert.True(t, utils.Equal(verifyingKey, keyPairs[1].VerifyingKey))
+	assert.Nil(t, keyPairs[1].RetiredAt)
+	assert.Nil(t, keyPairs[0].TranscriptHash)
+	assert.Equal(t, "transcript hash", *keyPairs[1].TranscriptHash)
+	assert.Equal(t, models.ZkCircuitEmailDomain, keyPairs[1].Circuit)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRetireZkSnarksKeyPairs_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	retiredAt := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "zk_snarks_key_pairs" SET "retired_at"=$1 WHERE id IN ($2,$3) AND retired_at IS NULL`),
+	).WithArgs(
+		retiredAt, 1, 2,
+	).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	err := repository.RetireZkSnarksKeyPairs([]uint{1, 2}, retiredAt)
+
+	assert.Nil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRotateZkSnarksKeyPair_NotDue(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_advisory_xact_lock($1)`)).
+		WithArgs(zkKeyRotationLockID(models.ZkCircuitVerificationCode)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT "id","circuit","created_at","transcript_hash" FROM "zk_snarks_key_pairs" WHERE circuit = $1 AND retired_at IS NULL ORDER BY id DESC LIMIT $2`),
+	).WithArgs(
+		models.ZkCircuitVerificationCode, 1,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "circuit", "created_at", "transcript_hash"}).
+			AddRow(zkKeyPairId, models.ZkCircuitVerificationCode, time.Now(), nil),
+	)
+	mock.ExpectCommit()
+
+	rotated, err := repository.RotateZkSnarksKeyPair(models.ZkCircuitVerificationCode, func(active *models.ZkSnarksKeyPair) bool {
+		return active == nil
+	}, func() models.ZkSnarksKeyPair {
+		t.Fatal("a key pair was generated although the active one is not due")
+		return models.ZkSnarksKeyPair{}
+	})
+
+	assert.Nil(t, err)
+	assert.False(t, rotated)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRotateZkSnarksKeyPair_FirstKeyPair(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_advisory_xact_lock($1)`)).
+		WithArgs(zkKeyRotationLockID(models.ZkCircuitVerificationCode)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT "id","circuit","created_at","transcript_hash" FROM "zk_snarks_key_pairs" WHERE circuit = $1 AND retired_at IS NULL ORDER BY id DESC LIMIT $2`),
+	).WithArgs(
+		models.ZkCircuitVerificationCode, 1,
+	).WillReturnRows(sqlmock.NewRows([]string{"id", "circuit", "created_at", "transcript_hash"}))
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`INSERT INTO "zk_snarks_key_pairs"`),
+	).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(zkKeyPairId))
+	mock.ExpectCommit()
+
+	rotated, err := repository.RotateZkSnarksKeyPair(models.ZkCircuitVerificationCode, func(active *models.ZkSnarksKeyPair) bool {
+		return active == nil
+	}, func() models.ZkSnarksKeyPair {
+		return models.ZkSnarksKeyPair{ProvingKey: provingKey, VerifyingKey: verifyingKey, CreatedAt: time.Now()}
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, rotated)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetZkSnarksVerifyingKey_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT "id","circuit","verifying_key","created_at","retired_at","transcript_hash" FROM "zk_snarks_key_pairs" WHERE id = $1 LIMIT $2`),
+	).WithArgs(
+		zkKeyPairId, 1,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "circuit", "verifying_key", "created_at", "retired_at", "transcript_hash"}).
+			AddRow(zkKeyPairId, models.ZkCircuitVerificationCode, verifyingKey, time.Now(), nil, nil),
+	)
+
+	keyPair, err := repository.GetZkSnarksVerifyingKey(zkKeyPairId)
+
+	assert.Nil(t, err)
+	assert.Equal(t, zkKeyPairId, keyPair.ID)
+	assert.Empty(t, keyPair.ProvingKey)
+	assert.True(t, utils.Equal(verifyingKey, keyPair.VerifyingKey))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMarkZkProofsToReprove_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	reproveBy := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "user_metadata" SET "email_reprove_by"=$1,"updated_at"=$2 WHERE is_email_verified AND email_reprove_by IS NULL AND id IN (SELECT "id" FROM "users" WHERE zk_key_pair_id IN ($3) AND octet_length(email_proof) > 0)`),
+	).WithArgs(
+		reproveBy, sqlmock.AnyArg(), 1,
+	).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "user_metadata" SET "phone_number_reprove_by"=$1,"updated_at"=$2 WHERE is_phone_number_verified AND phone_number_reprove_by IS NULL AND id IN (SELECT "id" FROM "users" WHERE phone_number_zk_pair_id IN ($3) AND octet_length(phone_number_zk_proof) > 0)`),
+	).WithArgs(
+		reproveBy, sqlmock.AnyArg(), 1,
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	marked, err := repository.MarkZkProofsToReprove([]uint{1}, reproveBy)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, marked)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestResetProofsOfRetiredZkKeyPairs_EmailProofReset(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT "id" FROM "users" WHERE zk_key_pair_id IN (SELECT "id" FROM "zk_snarks_key_pairs" WHERE retired_at IS NOT NULL) AND octet_length(email_proof) > 0`),
+	).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(userId))
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "users" SET "email_proof"=$1,"verification_code"=$2 WHERE id IN ($3)`),
+	).WithArgs(
+		[]byte{}, "", userId,
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "user_metadata" SET "email_reprove_by"=$1,"is_email_verified"=$2,"updated_at"=$3 WHERE id IN ($4)`),
+	).WithArgs(
+		nil, false, sqlmock.AnyArg(), userId,
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "email_domain_proofs" WHERE user_id IN ($1)`),
+	).WithArgs(userId).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "user_email_domains" WHERE user_id IN ($1)`),
+	).WithArgs(userId).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "email_domain_proofs" WHERE zk_key_pair_id IN (SELECT "id" FROM "zk_snarks_key_pairs" WHERE retired_at IS NOT NULL)`),
+	).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT "id" FROM "users" WHERE phone_number_zk_pair_id IN (SELECT "id" FROM "zk_snarks_key_pairs" WHERE retired_at IS NOT NULL) AND octet_length(phone_number_zk_proof) > 0`),
+	).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectCommit()
+
+	reset, err := repository.ResetProofsOfRetiredZkKeyPairs()
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, reset)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSaveUserEmailDomain_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	emailDomain := &models.UserEmailDomain{Domain: "gmail.com", NullifierKey: []byte("key"), DomainCommitment: "commitment"}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "email_domain_proofs" WHERE user_id = $1`),
+	).WithArgs(userId).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "user_email_domains" WHERE user_id = $1`),
+	).WithArgs(userId).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`INSERT INTO "user_email_domains" ("domain","nullifier_key","domain_commitment","user_id") VALUES ($1,$2,$3,$4) RETURNING "user_id"`,
+		),
+	).WithArgs(
+		"gmail.com", []byte("key"), "commitment", userId,
+	).WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(userId))
+	mock.ExpectCommit()
+
+	err := repository.SaveUserEmailDomain(userId, emailDomain)
+
+	assert.Nil(t, err)
+	assert.Equal(t, userId, emailDomain.UserID)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSaveUserEmailDomain_NoDomain(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "email_domain_proofs" WHERE user_id = $1`),
+	).WithArgs(userId).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "user_email_domains" WHERE user_id = $1`),
+	).WithArgs(userId).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := repository.SaveUserEmailDomain(userId, nil)
+
+	assert.Nil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCreateZkProofJob_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	createdAt := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`INSERT INTO "zk_proof_jobs" ("user_id","attribute","input","verification_code","status","attempts","error","zk_key_pair_id","created_at","started_at","finished_at") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11) RETURNING "id"`),
+	).WithArgs(
+		userId, models.ZkProofJobEmail, "user@email.com", verificationCode, models.ZkProofJobPending, 0, "", nil, createdAt, nil, nil,
+	).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+	mock.ExpectCommit()
+
+	jobID, err := repository.CreateZkProofJob(models.ZkProofJob{
+		UserID:           userId,
+		Attribute:        models.ZkProofJobEmail,
+		Input:            "user@email.com",
+		VerificationCode: verificationCode,
+		Status:           models.ZkProofJobPending,
+		CreatedAt:        createdAt,
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, uint(5), jobID)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestClaimZkProofJob_QueueIsEmpty(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	now := time.Now()
+	staleBefore := now.Add(-time.Minute)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT * FROM "zk_proof_jobs" WHERE status = $1 OR (status = $2 AND started_at < $3) ORDER BY id,"zk_proof_jobs"."id" LIMIT $4 FOR UPDATE SKIP LOCKED`),
+	).WithArgs(
+		models.ZkProofJobPending, models.ZkProofJobRunning, staleBefore, 1,
+	).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+
+	_, err := repository.ClaimZkProofJob(now, staleBefore)
+
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestClaimZkProofJob_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	now := time.Now()
+	staleBefore := now.Add(-time.Minute)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT * FROM "zk_proof_jobs" WHERE status = $1 OR (status = $2 AND started_at < $3) ORDER BY id,"zk_proof_jobs"."id" LIMIT $4 FOR UPDATE SKIP LOCKED`),
+	).WithArgs(
+		models.ZkProofJobPending, models.ZkProofJobRunning, staleBefore, 1,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "user_id", "attribute", "status", "attempts"}).
+			AddRow(5, userId, models.ZkProofJobEmail, models.ZkProofJobPending, 0),
+	)
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "zk_proof_jobs" SET "attempts"=$1,"started_at"=$2,"status"=$3 WHERE id = $4`),
+	).WithArgs(
+		1, now, models.ZkProofJobRunning, 5,
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	job, err := repository.ClaimZkProofJob(now, staleBefore)
+
+	assert.Nil(t, err)
+	assert.Equal(t, uint(5), job.ID)
+	assert.Equal(t, models.ZkProofJobRunning, job.Status)
+	assert.Equal(t, 1, job.Attempts)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCompleteZkProofJob_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	finishedAt := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "zk_proof_jobs" SET "finished_at"=$1,"input"=$2,"status"=$3,"zk_key_pair_id"=$4 WHERE id = $5`),
+	).WithArgs(
+		finishedAt, "", models.ZkProofJobDone, 3, 5,
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := repository.CompleteZkProofJob(5, 3, finishedAt)
+
+	assert.Nil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFailZkProofJob_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	finishedAt := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "zk_proof_jobs" SET "error"=$1,"finished_at"=$2,"input"=$3,"status"=$4 WHERE id = $5`),
+	).WithArgs(
+		"failed to generate zk proof", finishedAt, "", models.ZkProofJobFailed, 5,
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := repository.FailZkProofJob(5, "failed to generate zk proof", finishedAt)
+
+	assert.Nil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestExpireZkProofJobs_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	queuedBefore := time.Now().Add(-time.Hour)
+	finishedAt := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "zk_proof_jobs" SET "error"=$1,"finished_at"=$2,"input"=$3,"status"=$4 WHERE status IN ($5,$6) AND created_at < $7`),
+	).WithArgs(
+		"expired before it was proved", finishedAt, "", models.ZkProofJobFailed,
+		models.ZkProofJobPending, models.ZkProofJobRunning, queuedBefore,
+	).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	expired, err := repository.ExpireZkProofJobs(queuedBefore, finishedAt)
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), expired)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestClaimDueDataAccessDigests_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	now := time.Now()
+	sentBefore := now.Add(-7 * 24 * time.Hour)
+	claimedBefore := now.Add(-10 * time.Minute)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`UPDATE "data_access_digests" SET "claimed_at"=$1 WHERE COALESCE(last_sent_at, created_at) < $2 AND (claimed_at IS NULL OR claimed_at < $3) RETURNING *`),
+	).WithArgs(
+		now, sentBefore, claimedBefore,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"user_id", "email", "created_at", "last_sent_at", "claimed_at"}).
+			AddRow(userId, "user@example.com", sentBefore, nil, now),
+	)
+	mock.ExpectCommit()
+
+	digests, err := repository.ClaimDueDataAccessDigests(now, sentBefore, claimedBefore)
+
+	assert.Nil(t, err)
+	assert.Len(t, digests, 1)
+	assert.Equal(t, userId, digests[0].UserID)
+	assert.Equal(t, "user@example.com", digests[0].Email)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMarkDataAccessDigestSent_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	sentAt := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "data_access_digests" SET "claimed_at"=$1,"last_sent_at"=$2 WHERE user_id = $3`),
+	).WithArgs(
+		nil, sentAt, userId,
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := repository.MarkDataAccessDigestSent(userId, sentAt)
+
+	assert.Nil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetUserForUsername_UserNotFound(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`,
+		),
+	).WithArgs(
+		username, 1,
+	).WillReturnError(
+		fmt.Errorf("user not found"),
+	)
+
+	_, err = repository.GetUserForUsername(username)
+
+	assert.NotNil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetUserForUsername_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`,
+		),
+	).WithArgs(
+		username, 1,
+	).WillReturnRows(
+		sqlmock.NewRows(
+			[]string{"id", "username", "salt", "stored_key", "server_key"},
+		).AddRow(
+			userId, username, userSalt, storedKey, serverKey,
+		),
+	)
+
+	user, err := repository.GetUserForUsername(username)
+
+	assert.Nil(t, err)
+	assert.Equal(t, userId, user.ID)
+	assert.Equal(t, username, user.Username)
+	assert.Equal(t, userSalt, user.Salt)
+	assert.Equal(t, storedKey, user.StoredKey)
+	assert.Equal(t, serverKey, user.ServerKey)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRegisterPrecheckUser_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	req := dto.RegisterUserPrecheckDTO{
+		Username: "test_user",
+	}
+	salt := "random_salt"
+	iterCount := 4096
+
+	mock.ExpectBegin()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`INSERT INTO "users" ("username","verification_code","email_proof","zk_key_pair_id","phone_number_verification_code","phone_number_zk_proof","phone_number_zk_pair_id","public_key","salt","iteration_count","server_key","stored_key","telegram_session_id_hash") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13) ON CONFLICT DO NOTHING RETURNING "id"`,
+		),
+	).WithArgs(
+		req.Username, "", sqlmock.AnyArg(), 0, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), salt, iterCount, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow(1),
+	)
+
+	mock.ExpectCommit()
+
+	err := repository.RegisterPrecheckUser(req, salt, iterCount)
+
+	assert.Nil(t, err, "Error should be nil")
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestRegisterPrecheckUser_RepositoryError(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	req := dto.RegisterUserPrecheckDTO{
+		Username: "test_user",
+	}
+	salt := "random_salt"
+	iterCount := 4096
+
+	mock.ExpectBegin()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`INSERT INTO "users" ("username","verification_code","email_proof","zk_key_pair_id","phone_number_verification_code","phone_number_zk_proof","phone_number_zk_pair_id","public_key","salt","iteration_count","server_key","stored_key","telegram_session_id_hash") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13) ON CONFLICT DO NOTHING RETURNING "id"`,
+		),
+	).WithArgs(
+		req.Username, "", sqlmock.AnyArg(), 0, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), salt, iterCount, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+	).WillReturnError(fmt.Errorf("failed to create user"))
+
+	mock.ExpectRollback()
+
+	err := repository.RegisterPrecheckUser(req, salt, iterCount)
+
+	assert.NotNil(t, err, "Expected error due to database error")
+	assert.Equal(t, "failed to create a new user: failed to create user", err.Error())
+
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestRegisterPrecheckUser_BeginTransactionFailure(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	req := dto.RegisterUserPrecheckDTO{
+		Username: "test_user",
+	}
+	salt := "random_salt"
+	iterCount := 4096
+
+	mock.ExpectBegin().WillReturnError(fmt.Errorf("failed to begin transaction"))
+
+	err := repository.RegisterPrecheckUser(req, salt, iterCount)
+
+	assert.NotNil(t, err, "Error should not be nil")
+	assert.Contains(t, err.Error(), "failed to begin transaction", "Error message should contain 'failed to begin transaction'")
+
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestRegisterUser_FailToGetUserRecord(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`,
+		),
+	).WithArgs(
+		username, 1,
+	).WillReturnError(
+		fmt.Errorf("could not get user record"),
+	)
+
+	mock.ExpectRollback()
+
+	userDto := dto.RegisterUserDTO{
+		Username:  username,
+		PublicKey: publicKey,
+		StoredKey: storedKey,
+		ServerKey: serverKey,
+	}
+	err = repository.RegisterUser(userDto)
+
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestRegisterUser_FailToUpdateUserRecord(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`,
+		),
+	).WithArgs(
+		username, 1,
+	).WillReturnRows(
+		sqlmock.NewRows(
+			[]string{
+				"id", "username", "salt", "email_proof", "verification_code", "zk_key_pair_id", "public_key", "iteration_count", "server_key", "stored_key",
+			},
+		).AddRow(
+			userId, username, userSalt, emailProof, verificationCode, 0, []byte{}, 4096, "", "",
+		),
+	)
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(
+			`UPDATE "users" SET "public_key"=$1,"server_key"=$2,"stored_key"=$3 WHERE "id" = $4`,
+		),
+	).WithArgs(
+		publicKey, serverKey, storedKey, userId,
+	).WillReturnError(
+		fmt.Errorf("could not update user record"),
+	)
+
+	mock.ExpectRollback()
+
+	userDto := dto.RegisterUserDTO{
+		Username:  username,
+		PublicKey: publicKey,
+		StoredKey: storedKey,
+		ServerKey: serverKey,
+	}
+	err = repository.RegisterUser(userDto)
+
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestRegisterUser_FailToInsertANewUserMetadataRecord(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`,
+		),
+	).WithArgs(
+		username, 1,
+	).WillReturnRows(
+		sqlmock.NewRows(
+			[]string{
+				"id", "username", "salt", "email_proof", "verification_code", "zk_key_pair_id", "public_key", "iteration_count", "server_key", "stored_key",
+			},
+		).AddRow(
+			userId, username, userSalt, emailProof, verificationCode, 0, []byte{}, 4096, "", "",
+		),
+	)
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(
+			`UPDATE "users" SET "public_key"=$1,"server_key"=$2,"stored_key"=$3 WHERE "id" = $4`,
+		),
+	).WithArgs(
+		publicKey, serverKey, storedKey, userId,
+	).WillReturnResult(
+		sqlmock.NewResult(1, 1),
+	)
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`INSERT INTO "user_metadata" ("display_name","color","bio","is_email_verified","is_phone_number_verified","email_reprove_by","phone_number_reprove_by","id") VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING "created_at","updated_at","id"`,
+		),
+	).WithArgs(
+		"", "", "", false, false, nil, nil, userId,
+	).WillReturnError(
+		fmt.Errorf(""),
+	)
+
+	mock.ExpectRollback()
+
+	userDto := dto.RegisterUserDTO{
+		Username:  username,
+		PublicKey: publicKey,
+		StoredKey: storedKey,
+		ServerKey: serverKey,
+	}
+	err = repository.RegisterUser(userDto)
+
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestRegisterUser_UsernameAlreadyRegistered(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`,
+		),
+	).WithArgs(
+		username, 1,
+	).WillReturnRows(
+		sqlmock.NewRows(
+			[]string{
+				"id", "username", "salt", "email_proof", "verification_code", "zk_key_pair_id", "public_key", "iteration_count", "server_key", "stored_key",
+			},
+		).AddRow(
+			userId, username, userSalt, emailProof, verificationCode, 0, publicKey, 4096, serverKey, storedKey,
+		),
+	)
+
+	mock.ExpectRollback()
+
+	userDto := dto.RegisterUserDTO{
+		Username:  username,
+		PublicKey: []byte("0xdddddd"),
+		StoredKey: "new_stored_key",
+		ServerKey: "new_server_key",
+	}
+	err = repository.RegisterUser(userDto)
+
+	assert.ErrorIs(t, err, constants.ErrUsernameUnavailable)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestRegisterUser_UsernameNotReserved(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`,
+		),
+	).WithArgs(
+		username, 1,
+	).WillReturnError(
+		gorm.ErrRecordNotFound,
+	)
+
+	mock.ExpectRollback()
+
+	userDto := dto.RegisterUserDTO{
+		Username:  username,
+		PublicKey: []byte("0xdddddd"),
+		StoredKey: "new_stored_key",
+		ServerKey: "new_server_key",
+	}
+	err = repository.RegisterUser(userDto)
+
+	// reported like a taken username, so accounts cannot be enumerated
+	assert.ErrorIs(t, err, constants.ErrUsernameUnavailable)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestRegisterUser_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`,
+		),
+	).WithArgs(
+		username, 1,
+	).WillReturnRows(
+		sqlmock.NewRows(
+			[]string{
+				"id", "username", "salt", "email_proof", "verification_code", "zk_key_pair_id", "public_key", "iteration_count", "server_key", "stored_key",
+			},
+		).AddRow(
+			userId, username, userSalt, emailProof, verificationCode, 0, []byte{}, 4096, "", "",
+		),
+	)
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(
+			`UPDATE "users" SET "public_key"=$1,"server_key"=$2,"stored_key"=$3 WHERE "id" = $4`,
+		),
+	).WithArgs(
+		publicKey, serverKey, storedKey, userId,
+	).WillReturnResult(
+		sqlmock.NewResult(1, 1),
+	)
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`INSERT INTO "user_metadata" ("display_name","color","bio","is_email_verified","is_phone_number_verified","email_reprove_by","phone_number_reprove_by","id") VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING "created_at","updated_at","id"`,
+		),
+	).WithArgs(
+		"", "", "", false, false, nil, nil, userId,
+	).WillReturnRows(
+		sqlmock.NewRows(
+			[]string{"created_at", "updated_at", "id"},
+		).AddRow(
+			time.Time{}, time.Time{}, userId,
+		),
+	)
+
+	mock.ExpectCommit()
+
+	userDto := dto.RegisterUserDTO{
+		Username:  username,
+		PublicKey: publicKey,
+		StoredKey: storedKey,
+		ServerKey: serverKey,
+	}
+	err = repository.RegisterUser(userDto)
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func expectUserForPasswordUpdate(name string) {
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`),
+	).WithArgs(name, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(userId, name))
+}
+
+func TestUpdateUserPassword_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+
+	expectUserForPasswordUpdate(username)
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "users" SET "server_key"=$1,"stored_key"=$2 WHERE id = $3`),
+	).WithArgs(serverKey, storedKey, userId).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// a new password ends every session of the user
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "sessions" SET "revoked_at"=$1 WHERE user_id = $2 AND revoked_at IS NULL`),
+	).WithArgs(timestamp, userId).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	mock.ExpectCommit()
+
+	err := repository.UpdateUserPassword(username, storedKey, serverKey, timestamp)
+
+	assert.Nil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateUserPassword_UpdateQueryFailed(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+
+	expectUserForPasswordUpdate(username)
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "users" SET "server_key"=$1,"stored_key"=$2 WHERE id = $3`),
+	).WithArgs(serverKey, storedKey, userId).
+		WillReturnError(fmt.Errorf("database error"))
+
+	mock.ExpectRollback()
+
+	err := repository.UpdateUserPassword(username, storedKey, serverKey, timestamp)
+
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "database error")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateUserPassword_RevokingSessionsFailed(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+
+	expectUserForPasswordUpdate(username)
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "users" SET "server_key"=$1,"stored_key"=$2 WHERE id = $3`),
+	).WithArgs(serverKey, storedKey, userId).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "sessions" SET "revoked_at"=$1 WHERE user_id = $2 AND revoked_at IS NULL`),
+	).WithArgs(timestamp, userId).
+		WillReturnError(fmt.Errorf("database error"))
+
+	// the password is not changed while old sessions stay valid
+	mock.ExpectRollback()
+
+	err := repository.UpdateUserPassword(username, storedKey, serverKey, timestamp)
+
+	assert.NotNil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateUserPassword_EdgeCaseUsername(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+
+	expectUserForPasswordUpdate(usernameWithSpecialChars)
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "users" SET "server_key"=$1,"stored_key"=$2 WHERE id = $3`),
+	).WithArgs(serverKey, storedKey, userId).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "sessions" SET "revoked_at"=$1 WHERE user_id = $2 AND revoked_at IS NULL`),
+	).WithArgs(timestamp, userId).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectCommit()
+
+	err := repository.UpdateUserPassword(usernameWithSpecialChars, storedKey, serverKey, timestamp)
+
+	assert.Nil(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRegisterPrecheckClient_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	req := dto.RegisterClientPrecheckDTO{
+		Username: clientUsername,
+	}
+	mock.ExpectBegin()
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(
+			`INSERT INTO "clients" ("id","secret_hash","name","redirect_uri","backend_uri","username","salt","iteration_count","server_key","stored_key","x509_certificate_bytes","logo_uri","contacts","grant_types","registration_access_token_hash","require_user_two_factor") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16)`,
+		),
+	).WithArgs(
+		"", "", "", "", "", clientUsername, clientSalt, clientIterationCount, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "", "", "", "", false,
+	).WillReturnResult(
+		sqlmock.NewResult(1, 1),
+	)
+
+	mock.ExpectCommit()
+
+	err := repository.RegisterPrecheckClient(req, clientSalt, clientIterationCount)
+
+	assert.Nil(t, err, "Error should be nil")
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestRegisterPrecheckClient_RepositoryError(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	req := dto.RegisterClientPrecheckDTO{
+		Username: clientUsername,
+	}
+
+	mock.ExpectBegin()
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(
+			`INSERT INTO "clients" ("id","secret_hash","name","redirect_uri","backend_uri","username","salt","iteration_count","server_key","stored_key","x509_certificate_bytes","logo_uri","contacts","grant_types","registration_access_token_hash","require_user_two_factor") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16)`,
+		),
+	).WithArgs(
+		"", "", "", "", "", clientUsername, clientSalt, clientIterationCount, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "", "", "", "", false,
+	).WillReturnError(fmt.Errorf("failed to create client"))
+
+	mock.ExpectRollback()
+
+	err := repository.RegisterPrecheckClient(req, clientSalt, clientIterationCount)
+
+	assert.NotNil(t, err, "Expected error due to database error")
+	assert.Equal(t, "failed to create a new client: failed to create client", err.Error())
+
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestRegisterPrecheckClient_BeginTransactionFailure(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	req := dto.RegisterClientPrecheckDTO{
+		Username: clientUsername,
+	}
+
+	mock.ExpectBegin().WillReturnError(fmt.Errorf("failed to begin transaction"))
+
+	err := repository.RegisterPrecheckClient(req, clientSalt, clientIterationCount)
+
+	assert.NotNil(t, err, "Error should not be nil")
+	assert.Contains(t, err.Error(), "failed to begin transaction", "Error message should contain 'failed to begin transaction'")
+
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestRegisterClient_FailToUpdateClientRecord(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(
+			`UPDATE "clients" SET "backend_uri"=$1,"id"=$2,"name"=$3,"redirect_uri"=$4,"secret_hash"=$5,"server_key"=$6,"stored_key"=$7 WHERE username = $8`,
+		),
+	).WithArgs(
+		backendUri, clientId, clientName, redirectUri, clientSecretHash, serverKey, storedKey, clientUsername,
+	).WillReturnError(
+		fmt.Errorf("could not update client record"),
+	)
+
+	mock.ExpectRollback()
+
+	clientDto := dto.RegisterClientDTO{
+		Username:    clientUsername,
+		Name:        clientName,
+		RedirectURI: redirectUri,
+		BackendURI:  backendUri,
+		StoredKey:   storedKey,
+		ServerKey:   serverKey,
+	}
+	err = repository.RegisterClient(clientDto, clientId, clientSecretHash)
+
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestRegisterClient_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(
+			`UPDATE "clients" SET "backend_uri"=$1,"id"=$2,"name"=$3,"redirect_uri"=$4,"secret_hash"=$5,"server_key"=$6,"stored_key"=$7 WHERE username = $8`,
+		),
+	).WithArgs(
+		backendUri, clientId, clientName, redirectUri, clientSecretHash, serverKey, storedKey, clientUsername,
+	).WillReturnResult(
+		sqlmock.NewResult(1, 1),
+	)
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`INSERT INTO "client_redirect_uris" ("client_id","redirect_uri","created_at") VALUES ($1,$2,$3) RETURNING "id"`,
+		),
+	).WithArgs(
+		clientId, redirectUri, sqlmock.AnyArg(),
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow(1),
+	)
+
+	mock.ExpectCommit()
+
+	clientDto := dto.RegisterClientDTO{
+		Username:    clientUsername,
+		Name:        clientName,
+		RedirectURI: redirectUri,
+		BackendURI:  backendUri,
+		StoredKey:   storedKey,
+		ServerKey:   serverKey,
+	}
+	err = repository.RegisterClient(clientDto, clientId, clientSecretHash)
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestGetConnectedApps_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`SELECT user_consents.client_id, clients.name AS client_name, user_consents.scopes, user_consents.granted_at, user_consents.last_used_at FROM "user_consents" JOIN clients ON clients.id = user_consents.client_id WHERE user_consents.user_id = $1 ORDER BY user_consents.granted_at DESC`,
+		),
+	).WithArgs(
+		userId,
+	).WillReturnRows(
+		sqlmock.NewRows(
+			[]string{"client_id", "client_name", "scopes", "granted_at", "last_used_at"},
+		).AddRow(clientId, clientName, "read:user", timestamp, nil),
+	)
+
+	apps, err := repository.GetConnectedApps(userId)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []models.ConnectedApp{
+		{ClientID: clientId, ClientName: clientName, Scopes: "read:user", GrantedAt: timestamp},
+	}, apps)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestDeleteUserConsent_AppIsNotConnected(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "user_consents" WHERE user_id = $1 AND client_id = $2`),
+	).WithArgs(
+		userId, clientId,
+	).WillReturnResult(
+		sqlmock.NewResult(0, 0),
+	)
+	mock.ExpectRollback()
+
+	err := repository.DeleteUserConsent(userId, clientId, timestamp)
+
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestDeleteUserConsent_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "user_consents" WHERE user_id = $1 AND client_id = $2`),
+	).WithArgs(
+		userId, clientId,
+	).WillReturnResult(
+		sqlmock.NewResult(0, 1),
+	)
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "sessions" SET "revoked_at"=$1 WHERE user_id = $2 AND client_id = $3 AND revoked_at IS NULL`),
+	).WithArgs(
+		timestamp, userId, clientId,
+	).WillReturnResult(
+		sqlmock.NewResult(0, 1),
+	)
+	mock.ExpectCommit()
+
+	err := repository.DeleteUserConsent(userId, clientId, timestamp)
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestCreateSession_DeletesExpiredSessions(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	user := uint(userId)
+	session := models.Session{
+		JTI:         "session_jti",
+		Principal:   models.ScramPrincipalUser,
+		UserID:      &user,
+		DeviceLabel: "Firefox on Linux",
+		CreatedAt:   timestamp,
+		LastSeenAt:  timestamp,
+		ExpiresAt:   timestamp.Add(time.Hour),
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM "sessions" WHERE expires_at <= $1`),
+	).WithArgs(
+		timestamp,
+	).WillReturnResult(
+		sqlmock.NewResult(0, 3),
+	)
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`INSERT INTO "sessions" ("jti","principal","user_id","client_id","device_label","created_at","last_seen_at","expires_at","revoked_at") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING "id"`),
+	).WithArgs(
+		"session_jti", models.ScramPrincipalUser, user, nil, "Firefox on Linux", timestamp, timestamp, timestamp.Add(time.Hour), nil,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow(1),
+	)
+	mock.ExpectCommit()
+
+	err := repository.CreateSession(session)
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestTouchSession_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "sessions" SET "last_seen_at"=$1 WHERE jti = $2 AND revoked_at IS NULL AND expires_at > $3`),
+	).WithArgs(
+		timestamp, "session_jti", timestamp,
+	).WillReturnResult(
+		sqlmock.NewResult(0, 1),
+	)
+	mock.ExpectCommit()
+
+	err := repository.TouchSession("session_jti", timestamp)
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestTouchSession_RevokedOrExpired(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "sessions" SET "last_seen_at"=$1 WHERE jti = $2 AND revoked_at IS NULL AND expires_at > $3`),
+	).WithArgs(
+		timestamp, "session_jti", timestamp,
+	).WillReturnResult(
+		sqlmock.NewResult(0, 0),
+	)
+	mock.ExpectCommit()
+
+	err := repository.TouchSession("session_jti", timestamp)
+
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestRevokeUserSessions_One(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
 	mock.ExpectExec(
-		regexp.QuoteMeta(
-			`UPDATE "users" SET "public_key"=$1,"server_key"=$2,"stored_key"=$3 WHERE "id" = $4`,
-		),
+		regexp.QuoteMeta(`UPDATE "sessions" SET "revoked_at"=$1 WHERE (user_id = $2 AND revoked_at IS NULL) AND id = $3`),
 	).WithArgs(
-		publicKey, serverKey, storedKey, userId,
+		timestamp, userId, 7,
 	).WillReturnResult(
-		sqlmock.NewResult(1, 1),
+		sqlmock.NewResult(0, 1),
 	)
+	mock.ExpectCommit()
 
-	mock.ExpectQuery(
-		regexp.QuoteMeta(
-			`INSERT INTO "user_metadata" ("display_name","color","bio","is_email_verified","is_phone_number_verified","id") VALUES ($1,$2,$3,$4,$5,$6) RETURNING "created_at","updated_at","id"`,
-		),
+	err := repository.RevokeUserSessions(userId, 7, timestamp)
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestRevokeUserSessions_SessionOfAnotherUser(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "sessions" SET "revoked_at"=$1 WHERE (user_id = $2 AND revoked_at IS NULL) AND id = $3`),
 	).WithArgs(
-		"", "", "", false, false, userId,
-	).WillReturnError(
-		fmt.Errorf(""),
+		timestamp, userId, 7,
+	).WillReturnResult(
+		sqlmock.NewResult(0, 0),
 	)
+	mock.ExpectCommit()
 
-	mock.ExpectRollback()
-
-	userDto := dto.RegisterUserDTO{
-		Username:  username,
-		PublicKey: publicKey,
-		StoredKey: storedKey,
-		ServerKey: serverKey,
-	}
-	err = repository.RegisterUser(userDto)
+	err := repository.RevokeUserSessions(userId, 7, timestamp)
 
-	assert.NotNil(t, err)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
 	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
 }
 
-func TestRegisterUser_Success(t *testing.T) {
+func TestRevokeUserSessions_All(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
 	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`UPDATE "sessions" SET "revoked_at"=$1 WHERE user_id = $2 AND revoked_at IS NULL`),
+	).WithArgs(
+		timestamp, userId,
+	).WillReturnResult(
+		sqlmock.NewResult(0, 3),
+	)
+	mock.ExpectCommit()
+
+	err := repository.RevokeUserSessions(userId, 0, timestamp)
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestAddClientRedirectURI_AlreadyRegistered(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
 
 	mock.ExpectQuery(
-		regexp.QuoteMeta(
-			`SELECT * FROM "users" WHERE username = $1 ORDER BY "users"."id" LIMIT $2`,
-		),
+		regexp.QuoteMeta(`SELECT count(*) FROM "client_redirect_uris" WHERE client_id = $1 AND redirect_uri = $2`),
 	).WithArgs(
-		username, 1,
+		clientId, redirectUri,
 	).WillReturnRows(
-		sqlmock.NewRows(
-			[]string{
-				"id", "username", "salt", "email_proof", "verification_code", "zk_key_pair_id", "public_key", "iteration_count", "server_key", "stored_key",
-			},
-		).AddRow(
-			userId, username, userSalt, emailProof, verificationCode, 0, publicKey, 4096, serverKey, storedKey,
-		),
+		sqlmock.NewRows([]string{"count"}).AddRow(1),
 	)
 
-	mock.ExpectExec(
-		regexp.QuoteMeta(
-			`UPDATE "users" SET "public_key"=$1,"server_key"=$2,"stored_key"=$3 WHERE "id" = $4`,
-		),
+	err := repository.AddClientRedirectURI(clientId, redirectUri)
+
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestAddClientRedirectURI_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT count(*) FROM "client_redirect_uris" WHERE client_id = $1 AND redirect_uri = $2`),
 	).WithArgs(
-		publicKey, serverKey, storedKey, userId,
-	).WillReturnResult(
-		sqlmock.NewResult(1, 1),
+		clientId, redirectUri,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"count"}).AddRow(0),
 	)
 
+	mock.ExpectBegin()
 	mock.ExpectQuery(
 		regexp.QuoteMeta(
-			`INSERT INTO "user_metadata" ("display_name","color","bio","is_email_verified","is_phone_number_verified","id") VALUES ($1,$2,$3,$4,$5,$6) RETURNING "created_at","updated_at","id"`,
+			`INSERT INTO "client_redirect_uris" ("client_id","redirect_uri","created_at") VALUES ($1,$2,$3) RETURNING "id"`,
 		),
 	).WithArgs(
-		"", "", "", false, false, userId,
+		clientId, redirectUri, sqlmock.AnyArg(),
 	).WillReturnRows(
-		sqlmock.NewRows(
-			[]string{"created_at", "updated_at", "id"},
-		).AddRow(
-			time.Time{}, time.Time{}, userId,
-		),
+		sqlmock.NewRows([]string{"id"}).AddRow(2),
 	)
-
 	mock.ExpectCommit()
 
-	userDto := dto.RegisterUserDTO{
-		Username:  username,
-		PublicKey: publicKey,
-		StoredKey: storedKey,
-		ServerKey: serverKey,
-	}
-	err = repository.RegisterUser(userDto)
+	err := repository.AddClientRedirectURI(clientId, redirectUri)
 
 	assert.Nil(t, err)
 	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
 }
 
-func TestUpdateUserPassword_Success(t *testing.T) {
+func TestRemoveClientRedirectURI_LastRedirectURI(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
 	mock.ExpectBegin()
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT count(*) FROM "client_redirect_uris" WHERE client_id = $1`),
+	).WithArgs(
+		clientId,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"count"}).AddRow(1),
+	)
+	mock.ExpectRollback()
 
-	mock.ExpectExec(
-		regexp.QuoteMeta(`UPDATE "users" SET "server_key"=$1,"stored_key"=$2 WHERE username=$3`),
-	).WithArgs(serverKey, storedKey, username).
-		WillReturnResult(sqlmock.NewResult(1, 1))
-
-	mock.ExpectCommit()
-
-	err := repository.UpdateUserPassword(username, storedKey, serverKey)
-
-	assert.Nil(t, err)
+	err := repository.RemoveClientRedirectURI(clientId, redirectUri)
 
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("There were unfulfilled expectations: %s", err)
-	}
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
 }
 
-func TestUpdateUserPassword_UpdateQueryFailed(t *testing.T) {
+func TestRemoveClientRedirectURI_NotRegistered(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
 	mock.ExpectBegin()
-
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT count(*) FROM "client_redirect_uris" WHERE client_id = $1`),
+	).WithArgs(
+		clientId,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"count"}).AddRow(2),
+	)
 	mock.ExpectExec(
-		regexp.QuoteMeta(`UPDATE "users" SET "server_key"=$1,"stored_key"=$2 WHERE username=$3`),
-	).WithArgs(serverKey, storedKey, username).
-		WillReturnError(fmt.Errorf("database error"))
-
+		regexp.QuoteMeta(`DELETE FROM "client_redirect_uris" WHERE client_id = $1 AND redirect_uri = $2`),
+	).WithArgs(
+		clientId, "https://unknown.com/callback",
+	).WillReturnResult(
+		sqlmock.NewResult(0, 0),
+	)
 	mock.ExpectRollback()
 
-	err := repository.UpdateUserPassword(username, storedKey, serverKey)
+	err := repository.RemoveClientRedirectURI(clientId, "https://unknown.com/callback")
 
 	assert.NotNil(t, err)
-	assert.Contains(t, err.Error(), "database error")
-
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("There were unfulfilled expectations: %s", err)
-	}
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
 }
 
-func TestUpdateUserPassword_EdgeCaseUsername(t *testing.T) {
+func TestRemoveClientRedirectURI_Success(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
 	mock.ExpectBegin()
-
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT count(*) FROM "client_redirect_uris" WHERE client_id = $1`),
+	).WithArgs(
+		clientId,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"count"}).AddRow(2),
+	)
 	mock.ExpectExec(
-		regexp.QuoteMeta(`UPDATE "users" SET "server_key"=$1,"stored_key"=$2 WHERE username=$3`),
-	).WithArgs(serverKey, storedKey, usernameWithSpecialChars).
-		WillReturnResult(sqlmock.NewResult(1, 1))
-
+		regexp.QuoteMeta(`DELETE FROM "client_redirect_uris" WHERE client_id = $1 AND redirect_uri = $2`),
+	).WithArgs(
+		clientId, redirectUri,
+	).WillReturnResult(
+		sqlmock.NewResult(0, 1),
+	)
 	mock.ExpectCommit()
 
-	err := repository.UpdateUserPassword(usernameWithSpecialChars, storedKey, serverKey)
+	err := repository.RemoveClientRedirectURI(clientId, redirectUri)
 
 	assert.Nil(t, err)
-
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("There were unfulfilled expectations: %s", err)
-	}
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
 }
 
-func TestRegisterPrecheckClient_Success(t *testing.T) {
+func TestRotateClientSecret_ClientNotFound(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
-	req := dto.RegisterClientPrecheckDTO{
-		Username: clientUsername,
-	}
-	mock.ExpectBegin()
+	previousExpiresAt := time.Now().UTC().Add(time.Hour)
 
+	mock.ExpectBegin()
 	mock.ExpectExec(
 		regexp.QuoteMeta(
-			`INSERT INTO "clients" ("id","secret","name","redirect_uri","backend_uri","username","salt","iteration_count","server_key","stored_key","x509_certificate_bytes") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)`,
+			`UPDATE "clients" SET "previous_secret_expires_at"=$1,"previous_secret_hash"=secret_hash,"secret_hash"=$2 WHERE id = $3`,
 		),
 	).WithArgs(
-		"", "", "", "", "", clientUsername, clientSalt, clientIterationCount, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+		previousExpiresAt, clientSecretHash, clientId,
 	).WillReturnResult(
-		sqlmock.NewResult(1, 1),
+		sqlmock.NewResult(0, 0),
 	)
-
 	mock.ExpectCommit()
 
-	err := repository.RegisterPrecheckClient(req, clientSalt, clientIterationCount)
+	err := repository.RotateClientSecret(clientId, clientSecretHash, previousExpiresAt)
 
-	assert.Nil(t, err, "Error should be nil")
+	assert.NotNil(t, err)
 	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
 }
 
-func TestRegisterPrecheckClient_RepositoryError(t *testing.T) {
+func TestRotateClientSecret_Success(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
-	req := dto.RegisterClientPrecheckDTO{
-		Username: clientUsername,
-	}
+	previousExpiresAt := time.Now().UTC().Add(time.Hour)
 
 	mock.ExpectBegin()
-
 	mock.ExpectExec(
 		regexp.QuoteMeta(
-			`INSERT INTO "clients" ("id","secret","name","redirect_uri","backend_uri","username","salt","iteration_count","server_key","stored_key","x509_certificate_bytes") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)`,
+			`UPDATE "clients" SET "previous_secret_expires_at"=$1,"previous_secret_hash"=secret_hash,"secret_hash"=$2 WHERE id = $3`,
 		),
 	).WithArgs(
-		"", "", "", "", "", clientUsername, clientSalt, clientIterationCount, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
-	).WillReturnError(fmt.Errorf("failed to create client"))
-
-	mock.ExpectRollback()
-
-	err := repository.RegisterPrecheckClient(req, clientSalt, clientIterationCount)
+		previousExpiresAt, clientSecretHash, clientId,
+	).WillReturnResult(
+		sqlmock.NewResult(0, 1),
+	)
+	mock.ExpectCommit()
 
-	assert.NotNil(t, err, "Expected error due to database error")
-	assert.Equal(t, "failed to create a new client: failed to create client", err.Error())
+	err := repository.RotateClientSecret(clientId, clientSecretHash, previousExpiresAt)
 
+	assert.Nil(t, err)
 	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
 }
 
-func TestRegisterPrecheckClient_BeginTransactionFailure(t *testing.T) {
+func TestRegisterDynamicClient_Success(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
-	req := dto.RegisterClientPrecheckDTO{
-		Username: clientUsername,
+	client := models.Client{
+		ID:                          clientId,
+		SecretHash:                  clientSecretHash,
+		Name:                        clientName,
+		RedirectURI:                 redirectUri,
+		BackendURI:                  backendUri,
+		Username:                    clientId,
+		GrantTypes:                  "authorization_code",
+		RegistrationAccessTokenHash: "registration_access_token_hash",
 	}
 
-	mock.ExpectBegin().WillReturnError(fmt.Errorf("failed to begin transaction"))
-
-	err := repository.RegisterPrecheckClient(req, clientSalt, clientIterationCount)
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(
+			`INSERT INTO "clients" ("id","secret_hash","name","redirect_uri","backend_uri","username","salt","iteration_count","server_key","stored_key","x509_certificate_bytes","logo_uri","contacts","grant_types","registration_access_token_hash","require_user_two_factor") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16)`,
+		),
+	).WithArgs(
+		clientId, clientSecretHash, clientName, redirectUri, backendUri, clientId, "", 0, "", "", "", "", "", "authorization_code", "registration_access_token_hash", false,
+	).WillReturnResult(
+		sqlmock.NewResult(1, 1),
+	)
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`INSERT INTO "client_redirect_uris" ("client_id","redirect_uri","created_at") VALUES ($1,$2,$3) RETURNING "id"`,
+		),
+	).WithArgs(
+		clientId, redirectUri, sqlmock.AnyArg(),
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow(1),
+	)
+	mock.ExpectQuery(
+		regexp.QuoteMeta(
+			`INSERT INTO "client_traffic_statistics" ("client_id","rate_per_byte","total_usage_bytes","unpaid_amount","last_traffic_update_timestamp") VALUES ($1,$2,$3,$4,$5) RETURNING "id"`,
+		),
+	).WithArgs(
+		clientId, 5, 0, 0, sqlmock.AnyArg(),
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow(1),
+	)
+	mock.ExpectCommit()
 
-	assert.NotNil(t, err, "Error should not be nil")
-	assert.Contains(t, err.Error(), "failed to begin transaction", "Error message should contain 'failed to begin transaction'")
+	err := repository.RegisterDynamicClient(client, []string{redirectUri}, 5)
 
+	assert.Nil(t, err)
 	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
 }
 
-func TestRegisterClient_FailToUpdateClientRecord(t *testing.T) {
+func TestRegisterDynamicClient_FailedToCreateTrafficStatistics(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
 	mock.ExpectBegin()
-
 	mock.ExpectExec(
-		regexp.QuoteMeta(
-			`UPDATE "clients" SET "backend_uri"=$1,"id"=$2,"name"=$3,"redirect_uri"=$4,"secret"=$5,"server_key"=$6,"stored_key"=$7 WHERE username = $8`,
-		),
-	).WithArgs(
-		backendUri, clientId, clientName, redirectUri, clientSecret, serverKey, storedKey, clientUsername,
+		regexp.QuoteMeta(`INSERT INTO "clients"`),
+	).WillReturnResult(
+		sqlmock.NewResult(1, 1),
+	)
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`INSERT INTO "client_traffic_statistics"`),
 	).WillReturnError(
-		fmt.Errorf("could not update client record"),
+		fmt.Errorf("insert failed"),
 	)
-
 	mock.ExpectRollback()
 
-	clientDto := dto.RegisterClientDTO{
-		Username:    clientUsername,
-		Name:        clientName,
-		RedirectURI: redirectUri,
-		BackendURI:  backendUri,
-		StoredKey:   storedKey,
-		ServerKey:   serverKey,
-	}
-	err = repository.RegisterClient(clientDto, clientId, clientSecret)
+	err := repository.RegisterDynamicClient(models.Client{ID: clientId, Username: clientId}, []string{}, 5)
 
 	assert.NotNil(t, err)
 	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
 }
 
-func TestRegisterClient_Success(t *testing.T) {
+func TestDeleteRegisteredClient_UnpaidTraffic(t *testing.T) {
 	SetUp(t)
 	defer mockDB.Close()
 
 	mock.ExpectBegin()
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT * FROM "client_traffic_statistics" WHERE client_id = $1 ORDER BY "client_traffic_statistics"."id" LIMIT $2`),
+	).WithArgs(
+		clientId, 1,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "client_id", "unpaid_amount"}).AddRow(1, clientId, 100),
+	)
+	mock.ExpectRollback()
+
+	err := repository.DeleteRegisteredClient(clientId)
+
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
+}
+
+func TestDeleteRegisteredClient_Success(t *testing.T) {
+	SetUp(t)
+	defer mockDB.Close()
 
+	mock.ExpectBegin()
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT * FROM "client_traffic_statistics" WHERE client_id = $1 ORDER BY "client_traffic_statistics"."id" LIMIT $2`),
+	).WithArgs(
+		clientId, 1,
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "client_id", "unpaid_amount"}).AddRow(1, clientId, 0),
+	)
+	for _, table := range []string{"client_redirect_uris", "user_consents", "client_traffic_statistics", "pairwise_subjects", "device_authorizations"} {
+		mock.ExpectExec(
+			regexp.QuoteMeta(`DELETE FROM "` + table + `" WHERE client_id = $1`),
+		).WithArgs(
+			clientId,
+		).WillReturnResult(
+			sqlmock.NewResult(0, 1),
+		)
+	}
 	mock.ExpectExec(
-		regexp.QuoteMeta(
-			`UPDATE "clients" SET "backend_uri"=$1,"id"=$2,"name"=$3,"redirect_uri"=$4,"secret"=$5,"server_key"=$6,"stored_key"=$7 WHERE username = $8`,
-		),
+		regexp.QuoteMeta(`DELETE FROM "clients" WHERE id = $1`),
 	).WithArgs(
-		backendUri, clientId, clientName, redirectUri, clientSecret, serverKey, storedKey, clientUsername,
+		clientId,
 	).WillReturnResult(
-		sqlmock.NewResult(1, 1),
+		sqlmock.NewResult(0, 1),
 	)
-
 	mock.ExpectCommit()
 
-	clientDto := dto.RegisterClientDTO{
-		Username:    clientUsername,
-		Name:        clientName,
-		RedirectURI: redirectUri,
-		BackendURI:  backendUri,
-		StoredKey:   storedKey,
-		ServerKey:   serverKey,
-	}
-	err = repository.RegisterClient(clientDto, clientId, clientSecret)
+	err := repository.DeleteRegisteredClient(clientId)
 
 	assert.Nil(t, err)
 	assert.Nil(t, mock.ExpectationsWereMet(), "There were unfulfilled expectations!")
@@ -2,12 +2,15 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"globe-and-citizen/layer8/server/constants"
 	"globe-and-citizen/layer8/server/resource_server/dto"
 	"globe-and-citizen/layer8/server/resource_server/emails/verification"
 	"globe-and-citizen/layer8/server/resource_server/emails/verification/code"
@@ -15,13 +18,53 @@ import (
 	"globe-and-citizen/layer8/server/resource_server/interfaces"
 	"globe-and-citizen/layer8/server/resource_server/models"
 	"globe-and-citizen/layer8/server/resource_server/utils"
+	"globe-and-citizen/layer8/server/sdjwt"
+	"globe-and-citizen/layer8/server/totp"
+	serverUtils "globe-and-citizen/layer8/server/utils"
+	"globe-and-citizen/layer8/server/webauthn"
+	"globe-and-citizen/layer8/server/zkverify"
 	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
+	"gorm.io/gorm"
+)
+
+const defaultClientSecretRotationOverlap = 24 * time.Hour
+
+const zkProofJobPollInterval = 500 * time.Millisecond
+
+// passwordResetChallengeTTL is how long a password reset challenge can be
+// signed and used.
+const passwordResetChallengeTTL = 5 * time.Minute
+
+const (
+	twoFactorIssuer            = "Layer8"
+	twoFactorRecoveryCodeCount = 10
+)
+
+// webauthnChallengeTTL is how long the challenge of passkey options can be
+// answered, as long as the browser waits for the authenticator
+const webauthnChallengeTTL = 2 * time.Minute
+
+// scramSessionTTL is how long the server nonce of a login precheck can be
+// used to log in
+const scramSessionTTL = 2 * time.Minute
+
+const (
+	verifiedAttributesCredentialType = "layer8_verified_attributes"
+	verifiedAttributesCredentialTTL  = 30 * 24 * time.Hour
+
+	emailVerifiedClaim       = "email_verified"
+	phoneNumberVerifiedClaim = "phone_number_verified"
+	// keyIDClaimSuffix names the claim with the ID of the zk key pair an
+	// attribute was proved with, e.g. email_verified_key_id
+	keyIDClaimSuffix = "_key_id"
 )
 
 type service struct {
@@ -46,12 +89,28 @@ func NewService(
 	}
 }
 
-func (s *service) RegisterClient(req dto.RegisterClientDTO) error {
+// RegisterClient completes the registration of a client. Like a rotated
+// secret, the generated secret is only returned here and only its hash is
+// stored.
+func (s *service) RegisterClient(req dto.RegisterClientDTO) (models.RegisterClientResponseOutput, error) {
 	clientUUID := utils.GenerateUUID()
-	clientSecret := utils.GenerateSecret(utils.SecretSize)
 	req.BackendURI = utils.RemoveProtocolFromURL(req.BackendURI)
 
-	return s.repository.RegisterClient(req, clientUUID, clientSecret)
+	secret := utils.GenerateSecret(utils.SecretSize)
+	secretHash, err := serverUtils.HashClientSecret(secret)
+	if err != nil {
+		return models.RegisterClientResponseOutput{}, err
+	}
+
+	err = s.repository.RegisterClient(req, clientUUID, secretHash)
+	if err != nil {
+		return models.RegisterClientResponseOutput{}, err
+	}
+
+	return models.RegisterClientResponseOutput{
+		ID:     clientUUID,
+		Secret: secret,
+	}, nil
 }
 
 func (s *service) GetClientData(clientName string) (models.ClientResponseOutput, error) {
@@ -61,7 +120,6 @@ func (s *service) GetClientData(clientName string) (models.ClientResponseOutput,
 	}
 	clientModel := models.ClientResponseOutput{
 		ID:              clientData.ID,
-		Secret:          clientData.Secret,
 		Name:            clientData.Name,
 		RedirectURI:     clientData.RedirectURI,
 		BackendURI:      clientData.BackendURI,
@@ -77,7 +135,6 @@ func (s *service) GetClientDataByBackendURL(backendURL string) (models.ClientRes
 	}
 	clientModel := models.ClientResponseOutput{
 		ID:              clientData.ID,
-		Secret:          clientData.Secret,
 		Name:            clientData.Name,
 		RedirectURI:     clientData.RedirectURI,
 		BackendURI:      clientData.BackendURI,
@@ -87,82 +144,154 @@ func (s *service) GetClientDataByBackendURL(backendURL string) (models.ClientRes
 }
 
 func (s *service) LoginPrecheckUser(req dto.LoginPrecheckDTO) (models.LoginPrecheckResponseOutput, error) {
-	sNonce := utils.GenerateRandomSalt(utils.SaltSize)
+	salt, iterCount, err := s.userScramParameters(req.Username)
+	if err != nil {
+		return models.LoginPrecheckResponseOutput{}, err
+	}
 
-	user, err := s.repository.GetUserForUsername(req.Username)
+	nonce, err := s.startScramSession(models.ScramPrincipalUser, req)
 	if err != nil {
 		return models.LoginPrecheckResponseOutput{}, err
 	}
+
 	loginPrecheckResp := models.LoginPrecheckResponseOutput{
-		Salt:      user.Salt,
-		IterCount: user.IterationCount,
-		Nonce:     req.CNonce + sNonce,
+		Salt:      salt,
+		IterCount: iterCount,
+		Nonce:     nonce,
 	}
 	return loginPrecheckResp, nil
 }
 
 func (s *service) LoginPrecheckClient(req dto.LoginPrecheckDTO) (models.LoginPrecheckResponseOutput, error) {
-	sNonce := utils.GenerateRandomSalt(utils.SaltSize)
-
 	client, err := s.repository.ProfileClient(req.Username)
 	if err != nil {
 		return models.LoginPrecheckResponseOutput{}, err
 	}
+
+	nonce, err := s.startScramSession(models.ScramPrincipalClient, req)
+	if err != nil {
+		return models.LoginPrecheckResponseOutput{}, err
+	}
+
 	loginPrecheckResp := models.LoginPrecheckResponseOutput{
 		Salt:      client.Salt,
 		IterCount: client.IterationCount,
-		Nonce:     req.CNonce + sNonce,
+		Nonce:     nonce,
 	}
 	return loginPrecheckResp, nil
 }
 
-func (s *service) LoginUser(req dto.LoginUserDTO) (models.LoginUserResponseOutput, error) {
-	user, err := s.repository.GetUserForUsername(req.Username)
+// userScramParameters returns the salt and iteration count of the user with
+// the given username. Usernames without a completed registration get fake
+// ones instead, so that prechecks do not tell whether an account exists.
+func (s *service) userScramParameters(username string) (string, int, error) {
+	user, err := s.repository.GetUserForUsername(username)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && user.StoredKey == "") {
+		return fakeScramParameters(username)
+	}
 	if err != nil {
-		return models.LoginUserResponseOutput{}, err
+		return "", 0, err
 	}
 
-	storedKeyBytes, err := hex.DecodeString(user.StoredKey)
+	return user.Salt, user.IterationCount, nil
+}
+
+// fakeScramParameters derives a salt for username from a server secret, so
+// that every precheck for the same unknown username returns the same salt,
+// just like it would for a real account. The iteration count is the one new
+// accounts are registered with.
+func fakeScramParameters(username string) (string, int, error) {
+	secret := os.Getenv("PRECHECK_FAKE_SALT_SECRET")
+	if secret == "" {
+		return "", 0, fmt.Errorf("precheck fake salt secret is not configured")
+	}
+
+	iterCount, err := strconv.Atoi(os.Getenv("SCRAM_ITERATION_COUNT"))
 	if err != nil {
-		return models.LoginUserResponseOutput{}, fmt.Errorf("error decoding stored key: %v", err)
+		return "", 0, fmt.Errorf("invalid iteration count configuration: %v", err)
 	}
 
-	authMessage := fmt.Sprintf("[n=%s,r=%s,s=%s,i=%d,r=%s]", req.Username, req.CNonce, user.Salt, user.IterationCount, req.Nonce)
-	authMessageBytes := []byte(authMessage)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("scram-salt:" + username))
 
-	clientSignatureHMAC := hmac.New(sha256.New, storedKeyBytes)
-	clientSignatureHMAC.Write(authMessageBytes)
-	clientSignature := clientSignatureHMAC.Sum(nil)
+	return hex.EncodeToString(mac.Sum(nil)), iterCount, nil
+}
 
-	clientProofBytes, err := hex.DecodeString(req.ClientProof)
+// startScramSession issues the nonce of a SCRAM exchange: the client nonce
+// followed by a fresh server nonce. It stays valid for scramSessionTTL and
+// only for one login of the same principal.
+func (s *service) startScramSession(principal string, req dto.LoginPrecheckDTO) (string, error) {
+	nonce := req.CNonce + utils.GenerateRandomSalt(utils.SaltSize)
+	createdAt := time.Now().UTC()
+
+	err := s.repository.CreateScramSession(models.ScramSession{
+		Principal: principal,
+		Username:  req.Username,
+		CNonce:    req.CNonce,
+		Nonce:     nonce,
+		ExpiresAt: createdAt.Add(scramSessionTTL),
+		CreatedAt: createdAt,
+	})
 	if err != nil {
-		return models.LoginUserResponseOutput{}, fmt.Errorf("error decoding client proof: %v", err)
+		return "", fmt.Errorf("failed to start login session: %v", err)
 	}
 
-	clientKeyBytes, err := utils.XorBytes(clientSignature, clientProofBytes)
+	return nonce, nil
+}
+
+// consumeScramSession fails unless the nonces of a login were issued by a
+// precheck of the same principal that has not expired nor been used.
+func (s *service) consumeScramSession(principal string, username string, nonce string, cNonce string) error {
+	err := s.repository.ConsumeScramSession(principal, username, nonce, cNonce, time.Now().UTC())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return constants.ErrInvalidLoginSession
+	}
 	if err != nil {
-		return models.LoginUserResponseOutput{}, fmt.Errorf("error performing XOR operation: %v", err)
+		return fmt.Errorf("failed to check login session: %v", err)
 	}
 
-	clientKeyHash := sha256.Sum256(clientKeyBytes)
+	return nil
+}
+
+func (s *service) LoginUser(req dto.LoginUserDTO) (models.LoginUserResponseOutput, error) {
+	err := s.consumeScramSession(models.ScramPrincipalUser, req.Username, req.Nonce, req.CNonce)
+	if err != nil {
+		return models.LoginUserResponseOutput{}, err
+	}
 
-	clientKeyHashStr := hex.EncodeToString(clientKeyHash[:])
-	if clientKeyHashStr != user.StoredKey {
-		return models.LoginUserResponseOutput{}, fmt.Errorf("server failed to authenticate the user")
+	user, err := s.repository.GetUserForUsername(req.Username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.LoginUserResponseOutput{}, constants.ErrAuthenticationFailed
+	}
+	if err != nil {
+		return models.LoginUserResponseOutput{}, err
 	}
 
-	serverKeyBytes, err := hex.DecodeString(user.ServerKey)
+	authMessage := utils.ScramAuthMessage(req.Username, req.CNonce, user.Salt, user.IterationCount, req.Nonce)
+
+	serverSignatureHex, err := utils.VerifyScramClientProof(authMessage, user.StoredKey, user.ServerKey, req.ClientProof)
+	if errors.Is(err, constants.ErrInvalidClientProof) {
+		return models.LoginUserResponseOutput{}, constants.ErrAuthenticationFailed
+	}
 	if err != nil {
-		return models.LoginUserResponseOutput{}, fmt.Errorf("error decoding server key: %v", err)
+		return models.LoginUserResponseOutput{}, err
 	}
 
-	serverSignatureHMAC := hmac.New(sha256.New, serverKeyBytes)
-	serverSignatureHMAC.Write(authMessageBytes)
-	serverSignatureHex := hex.EncodeToString(serverSignatureHMAC.Sum(nil))
+	twoFactorToken, err := s.pendingTwoFactorLogin(models.ScramPrincipalUser, user.Username)
+	if err != nil {
+		return models.LoginUserResponseOutput{}, err
+	}
+	if twoFactorToken != "" {
+		return models.LoginUserResponseOutput{
+			ServerSignature:   serverSignatureHex,
+			TwoFactorRequired: true,
+			TwoFactorToken:    twoFactorToken,
+		}, nil
+	}
 
-	tokenString, err := utils.GenerateToken(user)
+	tokenString, err := s.issueUserToken(user, req.DeviceLabel)
 	if err != nil {
-		return models.LoginUserResponseOutput{}, fmt.Errorf("error generating token: %v", err)
+		return models.LoginUserResponseOutput{}, err
 	}
 
 	return models.LoginUserResponseOutput{
@@ -172,60 +301,474 @@ func (s *service) LoginUser(req dto.LoginUserDTO) (models.LoginUserResponseOutpu
 }
 
 func (s *service) LoginClient(req dto.LoginClientDTO) (models.LoginClientResponseOutput, error) {
+	err := s.consumeScramSession(models.ScramPrincipalClient, req.Username, req.Nonce, req.CNonce)
+	if err != nil {
+		return models.LoginClientResponseOutput{}, err
+	}
+
 	client, err := s.repository.ProfileClient(req.Username)
 	if err != nil {
 		return models.LoginClientResponseOutput{}, err
 	}
 
-	storedKeyBytes, err := hex.DecodeString(client.StoredKey)
+	authMessage := utils.ScramAuthMessage(req.Username, req.CNonce, client.Salt, client.IterationCount, req.Nonce)
+
+	serverSignatureHex, err := utils.VerifyScramClientProof(authMessage, client.StoredKey, client.ServerKey, req.ClientProof)
+	if errors.Is(err, constants.ErrInvalidClientProof) {
+		return models.LoginClientResponseOutput{}, constants.ErrAuthenticationFailed
+	}
+	if err != nil {
+		return models.LoginClientResponseOutput{}, err
+	}
+
+	twoFactorToken, err := s.pendingTwoFactorLogin(models.ScramPrincipalClient, client.Username)
+	if err != nil {
+		return models.LoginClientResponseOutput{}, err
+	}
+	if twoFactorToken != "" {
+		return models.LoginClientResponseOutput{
+			ServerSignature:   serverSignatureHex,
+			TwoFactorRequired: true,
+			TwoFactorToken:    twoFactorToken,
+		}, nil
+	}
+
+	tokenString, err := s.issueClientToken(client, req.DeviceLabel)
 	if err != nil {
-		return models.LoginClientResponseOutput{}, fmt.Errorf("error decoding stored key: %v", err)
+		return models.LoginClientResponseOutput{}, err
 	}
 
-	authMessage := fmt.Sprintf("[n=%s,r=%s,s=%s,i=%d,r=%s]", req.Username, req.CNonce, client.Salt, client.IterationCount, req.Nonce)
-	authMessageBytes := []byte(authMessage)
+	return models.LoginClientResponseOutput{
+		ServerSignature: serverSignatureHex,
+		Token:           tokenString,
+	}, nil
+}
+
+// newSession starts a session of the user or client portal that lasts as long
+// as the token issued for it.
+func (s *service) newSession(session models.Session) (models.Session, error) {
+	now := time.Now().UTC()
+	session.JTI = utils.GenerateUUID()
+	session.CreatedAt = now
+	session.LastSeenAt = now
+	session.ExpiresAt = now.Add(utils.SessionTTL)
+
+	err := s.repository.CreateSession(session)
+	if err != nil {
+		return models.Session{}, fmt.Errorf("failed to create session: %v", err)
+	}
 
-	clientSignatureHMAC := hmac.New(sha256.New, storedKeyBytes)
-	clientSignatureHMAC.Write(authMessageBytes)
-	clientSignature := clientSignatureHMAC.Sum(nil)
+	return session, nil
+}
 
-	clientProofBytes, err := hex.DecodeString(req.ClientProof)
+func (s *service) issueUserToken(user models.User, deviceLabel string) (string, error) {
+	session, err := s.newSession(models.Session{
+		Principal:   models.ScramPrincipalUser,
+		UserID:      &user.ID,
+		DeviceLabel: deviceLabel,
+	})
 	if err != nil {
-		return models.LoginClientResponseOutput{}, fmt.Errorf("error decoding client proof: %v", err)
+		return "", err
 	}
 
-	clientKeyBytes, err := utils.XorBytes(clientSignature, clientProofBytes)
+	tokenString, err := utils.GenerateToken(user, session)
 	if err != nil {
-		return models.LoginClientResponseOutput{}, fmt.Errorf("error performing XOR operation: %v", err)
+		return "", fmt.Errorf("error generating token: %v", err)
 	}
 
-	clientKeyHash := sha256.Sum256(clientKeyBytes)
+	return tokenString, nil
+}
 
-	clientKeyHashStr := hex.EncodeToString(clientKeyHash[:])
-	if clientKeyHashStr != client.StoredKey {
-		return models.LoginClientResponseOutput{}, fmt.Errorf("server failed to authenticate the user")
+func (s *service) issueClientToken(client models.Client, deviceLabel string) (string, error) {
+	session, err := s.newSession(models.Session{
+		Principal:   models.ScramPrincipalClient,
+		ClientID:    &client.ID,
+		DeviceLabel: deviceLabel,
+	})
+	if err != nil {
+		return "", err
 	}
 
-	serverKeyBytes, err := hex.DecodeString(client.ServerKey)
+	tokenString, err := utils.CompleteClientLoginv2(client, session)
 	if err != nil {
-		return models.LoginClientResponseOutput{}, fmt.Errorf("error decoding server key: %v", err)
+		return "", fmt.Errorf("error generating token: %v", err)
 	}
 
-	serverSignatureHMAC := hmac.New(sha256.New, serverKeyBytes)
-	serverSignatureHMAC.Write(authMessageBytes)
-	serverSignatureHex := hex.EncodeToString(serverSignatureHMAC.Sum(nil))
+	return tokenString, nil
+}
 
-	tokenString, err := utils.CompleteClientLoginv2(client)
+// pendingTwoFactorLogin returns the token of the second login step when the
+// principal confirmed an authenticator, or "" when the password is enough.
+func (s *service) pendingTwoFactorLogin(principal string, username string) (string, error) {
+	credential, err := s.repository.GetTwoFactorCredential(principal, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
 	if err != nil {
-		return models.LoginClientResponseOutput{}, fmt.Errorf("error generating token: %v", err)
+		return "", fmt.Errorf("failed to get two-factor credential: %v", err)
+	}
+	if !credential.Confirmed() {
+		return "", nil
 	}
 
-	return models.LoginClientResponseOutput{
-		ServerSignature: serverSignatureHex,
-		Token:           tokenString,
+	twoFactorToken, err := utils.GenerateTwoFactorToken(principal, username)
+	if err != nil {
+		return "", fmt.Errorf("error generating two-factor token: %v", err)
+	}
+
+	return twoFactorToken, nil
+}
+
+// LoginTwoFactor completes a login of LoginUser or LoginClient that asked
+// for a second factor and issues the token of the principal.
+func (s *service) LoginTwoFactor(req dto.LoginTwoFactorDTO) (models.LoginTwoFactorResponseOutput, error) {
+	claims, err := utils.ParseTwoFactorToken(req.TwoFactorToken)
+	if err != nil {
+		return models.LoginTwoFactorResponseOutput{}, err
+	}
+
+	err = s.verifyTwoFactorCode(claims.Principal, claims.Subject, req.Code)
+	if err != nil {
+		return models.LoginTwoFactorResponseOutput{}, err
+	}
+
+	var tokenString string
+	switch claims.Principal {
+	case models.ScramPrincipalUser:
+		user, err := s.repository.GetUserForUsername(claims.Subject)
+		if err != nil {
+			return models.LoginTwoFactorResponseOutput{}, err
+		}
+		tokenString, err = s.issueUserToken(user, req.DeviceLabel)
+		if err != nil {
+			return models.LoginTwoFactorResponseOutput{}, err
+		}
+	case models.ScramPrincipalClient:
+		client, err := s.repository.ProfileClient(claims.Subject)
+		if err != nil {
+			return models.LoginTwoFactorResponseOutput{}, err
+		}
+		tokenString, err = s.issueClientToken(client, req.DeviceLabel)
+		if err != nil {
+			return models.LoginTwoFactorResponseOutput{}, err
+		}
+	default:
+		return models.LoginTwoFactorResponseOutput{}, constants.ErrInvalidTwoFactorToken
+	}
+
+	return models.LoginTwoFactorResponseOutput{Token: tokenString}, nil
+}
+
+// verifyTwoFactorCode checks a code of the confirmed authenticator of the
+// principal, or one of its recovery codes, and marks it as used.
+func (s *service) verifyTwoFactorCode(principal string, username string, code string) error {
+	credential, err := s.repository.GetTwoFactorCredential(principal, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return constants.ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get two-factor credential: %v", err)
+	}
+	if !credential.Confirmed() {
+		return constants.ErrTwoFactorNotEnabled
+	}
+
+	key, err := totp.EncryptionKey()
+	if err != nil {
+		return err
+	}
+
+	return totp.Verify(s.repository, key, totp.Credential{
+		ID:              credential.ID,
+		EncryptedSecret: credential.EncryptedSecret,
+		LastUsedStep:    credential.LastUsedStep,
+	}, code, time.Now().UTC())
+}
+
+func (s *service) GetTwoFactorStatus(principal string, username string) (models.TwoFactorStatusResponseOutput, error) {
+	credential, err := s.repository.GetTwoFactorCredential(principal, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.TwoFactorStatusResponseOutput{Enabled: false}, nil
+	}
+	if err != nil {
+		return models.TwoFactorStatusResponseOutput{}, err
+	}
+
+	return models.TwoFactorStatusResponseOutput{Enabled: credential.Confirmed()}, nil
+}
+
+// StartTwoFactorEnrollment generates the shared secret of a new
+// authenticator. Logins do not ask for codes until the enrollment is
+// confirmed with ConfirmTwoFactorEnrollment.
+func (s *service) StartTwoFactorEnrollment(
+	principal string, username string,
+) (models.TwoFactorEnrollmentResponseOutput, error) {
+	key, err := totp.EncryptionKey()
+	if err != nil {
+		return models.TwoFactorEnrollmentResponseOutput{}, err
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return models.TwoFactorEnrollmentResponseOutput{}, err
+	}
+
+	encryptedSecret, err := totp.EncryptSecret(key, secret)
+	if err != nil {
+		return models.TwoFactorEnrollmentResponseOutput{}, err
+	}
+
+	err = s.repository.SaveTwoFactorCredential(models.TwoFactorCredential{
+		Principal:       principal,
+		Username:        username,
+		EncryptedSecret: encryptedSecret,
+		CreatedAt:       time.Now().UTC(),
+	})
+	if err != nil {
+		return models.TwoFactorEnrollmentResponseOutput{}, err
+	}
+
+	return models.TwoFactorEnrollmentResponseOutput{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(twoFactorIssuer, username, secret),
+	}, nil
+}
+
+// ConfirmTwoFactorEnrollment enables the enrolled authenticator once it
+// produced a valid code. The recovery codes are returned only this once.
+func (s *service) ConfirmTwoFactorEnrollment(
+	principal string, username string, code string,
+) (models.TwoFactorRecoveryCodesResponseOutput, error) {
+	credential, err := s.repository.GetTwoFactorCredential(principal, username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.TwoFactorRecoveryCodesResponseOutput{}, constants.ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		return models.TwoFactorRecoveryCodesResponseOutput{}, err
+	}
+	if credential.Confirmed() {
+		return models.TwoFactorRecoveryCodesResponseOutput{}, constants.ErrTwoFactorAlreadyEnabled
+	}
+
+	key, err := totp.EncryptionKey()
+	if err != nil {
+		return models.TwoFactorRecoveryCodesResponseOutput{}, err
+	}
+
+	secret, err := totp.DecryptSecret(key, credential.EncryptedSecret)
+	if err != nil {
+		return models.TwoFactorRecoveryCodesResponseOutput{}, err
+	}
+
+	now := time.Now().UTC()
+	step, ok, err := totp.Validate(secret, strings.TrimSpace(code), now, credential.LastUsedStep)
+	if err != nil {
+		return models.TwoFactorRecoveryCodesResponseOutput{}, err
+	}
+	if !ok {
+		return models.TwoFactorRecoveryCodesResponseOutput{}, constants.ErrInvalidTwoFactorCode
+	}
+
+	recoveryCodes, err := totp.GenerateRecoveryCodes(twoFactorRecoveryCodeCount)
+	if err != nil {
+		return models.TwoFactorRecoveryCodesResponseOutput{}, err
+	}
+
+	codeHashes := make([]string, len(recoveryCodes))
+	for i, recoveryCode := range recoveryCodes {
+		codeHashes[i] = totp.HashRecoveryCode(recoveryCode)
+	}
+
+	err = s.repository.ConfirmTwoFactorCredential(credential.ID, step, now, codeHashes)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.TwoFactorRecoveryCodesResponseOutput{}, constants.ErrTwoFactorAlreadyEnabled
+	}
+	if err != nil {
+		return models.TwoFactorRecoveryCodesResponseOutput{}, err
+	}
+
+	return models.TwoFactorRecoveryCodesResponseOutput{RecoveryCodes: recoveryCodes}, nil
+}
+
+// DisableTwoFactor removes the authenticator of the principal. It takes a
+// code, so a stolen session alone cannot turn the second factor off.
+func (s *service) DisableTwoFactor(principal string, username string, code string) error {
+	err := s.verifyTwoFactorCode(principal, username, code)
+	if err != nil {
+		return err
+	}
+
+	return s.repository.DeleteTwoFactorCredential(principal, username)
+}
+
+// issueWebAuthnChallenge stores the challenge of passkey options, issued to
+// userID for a registration or to no one (0) for a login.
+func (s *service) issueWebAuthnChallenge(ceremony string, userID uint) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+
+	createdAt := time.Now().UTC()
+	webauthnChallenge := models.WebAuthnChallenge{
+		Ceremony:  ceremony,
+		Challenge: challenge,
+		ExpiresAt: createdAt.Add(webauthnChallengeTTL),
+		CreatedAt: createdAt,
+	}
+	if userID != 0 {
+		webauthnChallenge.UserID = &userID
+	}
+
+	err = s.repository.CreateWebAuthnChallenge(webauthnChallenge)
+	if err != nil {
+		return "", fmt.Errorf("failed to start passkey ceremony: %v", err)
+	}
+
+	return challenge, nil
+}
+
+// StartPasskeyRegistration returns the options the browser creates a new
+// passkey of the user with.
+func (s *service) StartPasskeyRegistration(
+	userID uint, username string,
+) (models.PasskeyCreationOptionsResponseOutput, error) {
+	config, err := webauthn.ConfigFromEnv()
+	if err != nil {
+		return models.PasskeyCreationOptionsResponseOutput{}, err
+	}
+
+	passkeys, err := s.repository.GetPasskeysOfUser(userID)
+	if err != nil {
+		return models.PasskeyCreationOptionsResponseOutput{}, err
+	}
+	registered := make([]string, len(passkeys))
+	for i, passkey := range passkeys {
+		registered[i] = passkey.CredentialID
+	}
+
+	challenge, err := s.issueWebAuthnChallenge(webauthn.CeremonyRegistration, userID)
+	if err != nil {
+		return models.PasskeyCreationOptionsResponseOutput{}, err
+	}
+
+	return models.PasskeyCreationOptionsResponseOutput{
+		PublicKey: webauthn.NewCreationOptions(config, challenge, userID, username, registered),
+	}, nil
+}
+
+// FinishPasskeyRegistration stores the passkey the authenticator created for
+// the options of StartPasskeyRegistration.
+func (s *service) FinishPasskeyRegistration(userID uint, req dto.PasskeyRegistrationDTO) (models.Passkey, error) {
+	config, err := webauthn.ConfigFromEnv()
+	if err != nil {
+		return models.Passkey{}, err
+	}
+
+	now := time.Now().UTC()
+	credential, err := webauthn.VerifyRegistration(s.repository, config, userID, req.Credential, now)
+	if err != nil {
+		return models.Passkey{}, err
+	}
+
+	passkey := models.Passkey{
+		UserID:            userID,
+		Name:              req.Name,
+		CredentialID:      credential.CredentialID,
+		PublicKey:         credential.PublicKey,
+		SignCount:         credential.SignCount,
+		AttestationFormat: credential.AttestationFormat,
+		AAGUID:            credential.AAGUID,
+		CreatedAt:         now,
+	}
+	if err := s.repository.CreatePasskey(passkey); err != nil {
+		return models.Passkey{}, err
+	}
+
+	return passkey, nil
+}
+
+func (s *service) GetPasskeys(userID uint) ([]models.Passkey, error) {
+	return s.repository.GetPasskeysOfUser(userID)
+}
+
+func (s *service) DeletePasskey(userID uint, id uint) error {
+	return s.repository.DeletePasskey(userID, id)
+}
+
+// StartPasskeyLogin returns the options of a login with any passkey. The
+// passkey tells who logs in, so no username is asked for and none can be
+// probed.
+func (s *service) StartPasskeyLogin() (models.PasskeyRequestOptionsResponseOutput, error) {
+	config, err := webauthn.ConfigFromEnv()
+	if err != nil {
+		return models.PasskeyRequestOptionsResponseOutput{}, err
+	}
+
+	challenge, err := s.issueWebAuthnChallenge(webauthn.CeremonyLogin, 0)
+	if err != nil {
+		return models.PasskeyRequestOptionsResponseOutput{}, err
+	}
+
+	return models.PasskeyRequestOptionsResponseOutput{
+		PublicKey: webauthn.NewRequestOptions(config, challenge),
 	}, nil
 }
 
+// LoginPasskey logs the user in with the assertion of one of their passkeys.
+// A passkey that verified the user stands for two factors, one that only
+// saw them present still asks for a code of their authenticator, if any.
+func (s *service) LoginPasskey(req dto.LoginPasskeyDTO) (models.LoginPasskeyResponseOutput, error) {
+	config, err := webauthn.ConfigFromEnv()
+	if err != nil {
+		return models.LoginPasskeyResponseOutput{}, err
+	}
+
+	passkey, err := s.repository.GetPasskey(req.Credential.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.LoginPasskeyResponseOutput{}, constants.ErrInvalidPasskey
+	}
+	if err != nil {
+		return models.LoginPasskeyResponseOutput{}, err
+	}
+
+	userVerified, err := webauthn.VerifyLogin(s.repository, config, webauthn.Credential{
+		ID:           passkey.ID,
+		UserID:       passkey.UserID,
+		CredentialID: passkey.CredentialID,
+		PublicKey:    passkey.PublicKey,
+		SignCount:    passkey.SignCount,
+	}, req.Credential, time.Now().UTC())
+	if err != nil {
+		return models.LoginPasskeyResponseOutput{}, err
+	}
+
+	user, err := s.repository.FindUser(passkey.UserID)
+	if err != nil {
+		return models.LoginPasskeyResponseOutput{}, err
+	}
+
+	if !userVerified {
+		twoFactorToken, err := s.pendingTwoFactorLogin(models.ScramPrincipalUser, user.Username)
+		if err != nil {
+			return models.LoginPasskeyResponseOutput{}, err
+		}
+		if twoFactorToken != "" {
+			return models.LoginPasskeyResponseOutput{
+				TwoFactorRequired: true,
+				TwoFactorToken:    twoFactorToken,
+			}, nil
+		}
+	}
+
+	tokenString, err := s.issueUserToken(user, req.DeviceLabel)
+	if err != nil {
+		return models.LoginPasskeyResponseOutput{}, err
+	}
+
+	return models.LoginPasskeyResponseOutput{Token: tokenString}, nil
+}
+
 func (s *service) ProfileUser(userID uint) (models.ProfileResponseOutput, error) {
 	user, metadata, err := s.repository.ProfileUser(userID)
 	if err != nil {
@@ -233,12 +776,14 @@ func (s *service) ProfileUser(userID uint) (models.ProfileResponseOutput, error)
 	}
 
 	return models.ProfileResponseOutput{
-		Username:            user.Username,
-		DisplayName:         metadata.DisplayName,
-		Bio:                 metadata.Bio,
-		Color:               metadata.Color,
-		EmailVerified:       metadata.IsEmailVerified,
-		PhoneNumberVerified: metadata.IsPhoneNumberVerified,
+		Username:             user.Username,
+		DisplayName:          metadata.DisplayName,
+		Bio:                  metadata.Bio,
+		Color:                metadata.Color,
+		EmailVerified:        metadata.IsEmailVerified,
+		PhoneNumberVerified:  metadata.IsPhoneNumberVerified,
+		EmailReproveBy:       metadata.EmailReproveBy,
+		PhoneNumberReproveBy: metadata.PhoneNumberReproveBy,
 	}, nil
 }
 
@@ -248,12 +793,12 @@ func (s *service) ProfileClient(username string) (models.ClientResponseOutput, e
 		return models.ClientResponseOutput{}, err
 	}
 	clientModel := models.ClientResponseOutput{
-		ID:              clientData.ID,
-		Secret:          clientData.Secret,
-		Name:            clientData.Name,
-		RedirectURI:     clientData.RedirectURI,
-		BackendURI:      clientData.BackendURI,
-		X509Certificate: clientData.X509Certificate,
+		ID:                   clientData.ID,
+		Name:                 clientData.Name,
+		RedirectURI:          clientData.RedirectURI,
+		BackendURI:           clientData.BackendURI,
+		X509Certificate:      clientData.X509Certificate,
+		RequireUserTwoFactor: clientData.RequireUserTwoFactor,
 	}
 	return clientModel, nil
 }
@@ -268,6 +813,8 @@ func (s *service) VerifyEmail(userID uint, userEmail string) error {
 		return e
 	}
 
+	userEmail = normalizeEmailDomain(userEmail)
+
 	verificationCode, err := s.emailVerifier.GenerateVerificationCode(&user, userEmail)
 	if err != nil {
 		return err
@@ -289,6 +836,18 @@ func (s *service) VerifyEmail(userID uint, userEmail string) error {
 	return e
 }
 
+// normalizeEmailDomain lowercases the domain of an address. The verification
+// code is computed over the address as normalized here, so that proofs of its
+// domain match domain sets, which are lowercase.
+func normalizeEmailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+
+	return email[:at+1] + strings.ToLower(email[at+1:])
+}
+
 func (s *service) CheckEmailVerificationCode(userId uint, code string) error {
 	verificationData, e := s.repository.GetEmailVerificationData(userId)
 	if e != nil {
@@ -300,12 +859,14 @@ func (s *service) CheckEmailVerificationCode(userId uint, code string) error {
 	return e
 }
 
+// GenerateZkProof proves the input without committing to an email domain,
+// the proof jobs make the proofs that do.
 func (s *service) GenerateZkProof(
 	user models.User,
 	input string, // email or phone number
 	verificationCode string,
 ) ([]byte, uint, error) {
-	return s.proofProcessor.GenerateProof(input, user.Salt, verificationCode)
+	return s.proofProcessor.GenerateProof(input, user.Salt, verificationCode, nil)
 }
 
 func (s *service) SaveProofOfEmailVerification(
@@ -314,8 +875,75 @@ func (s *service) SaveProofOfEmailVerification(
 	return s.repository.SaveProofOfEmailVerification(userId, verificationCode, zkProof, zkKeyPairId)
 }
 
-func (s *service) UpdateUserMetadata(userID uint, req dto.UpdateUserMetadataDTO) error {
-	return s.repository.UpdateUserMetadata(userID, req)
+func (s *service) EnqueueZkProofJob(
+	userID uint, attribute string, input string, verificationCode string,
+) (models.ZkProofJobResponseOutput, error) {
+	if attribute == models.ZkProofJobEmail {
+		input = normalizeEmailDomain(input)
+	}
+
+	job := models.ZkProofJob{
+		UserID:           userID,
+		Attribute:        attribute,
+		Input:            input,
+		VerificationCode: verificationCode,
+		Status:           models.ZkProofJobPending,
+		CreatedAt:        time.Now().UTC(),
+	}
+
+	id, err := s.repository.CreateZkProofJob(job)
+	if err != nil {
+		return models.ZkProofJobResponseOutput{}, err
+	}
+	job.ID = id
+
+	return zkProofJobResponse(job), nil
+}
+
+func (s *service) GetZkProofJob(userID uint, jobID uint) (models.ZkProofJobResponseOutput, error) {
+	job, err := s.repository.GetZkProofJob(jobID, userID)
+	if err != nil {
+		return models.ZkProofJobResponseOutput{}, err
+	}
+
+	return zkProofJobResponse(job), nil
+}
+
+// WaitForZkProofJob returns once the job is finished or ctx is done, in which
+// case the job is returned in its current state.
+func (s *service) WaitForZkProofJob(
+	ctx context.Context, userID uint, jobID uint,
+) (models.ZkProofJobResponseOutput, error) {
+	for {
+		job, err := s.repository.GetZkProofJob(jobID, userID)
+		if err != nil {
+			return models.ZkProofJobResponseOutput{}, err
+		}
+
+		if job.Finished() {
+			return zkProofJobResponse(job), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return zkProofJobResponse(job), nil
+		case <-time.After(zkProofJobPollInterval):
+		}
+	}
+}
+
+func zkProofJobResponse(job models.ZkProofJob) models.ZkProofJobResponseOutput {
+	return models.ZkProofJobResponseOutput{
+		ID:         job.ID,
+		Attribute:  job.Attribute,
+		Status:     job.Status,
+		CreatedAt:  job.CreatedAt,
+		FinishedAt: job.FinishedAt,
+	}
+}
+
+func (s *service) UpdateUserMetadata(userID uint, req dto.UpdateUserMetadataDTO) error {
+	return s.repository.UpdateUserMetadata(userID, req)
 }
 
 func (s *service) CheckBackendURI(backendURL string) (bool, error) {
@@ -341,6 +969,11 @@ func (s *service) ValidateSignature(message string, signature []byte, publicKey
 	return nil
 }
 
+// RegisterUserPrecheck reserves the username and returns the salt the new
+// account is registered with. A username that is already taken gets the
+// same fake salt a login precheck would show for it; the conflict is only
+// reported by RegisterUser. A username another precheck reserved and that
+// is not registered yet is unavailable, its salt is never handed out.
 func (s *service) RegisterUserPrecheck(req dto.RegisterUserPrecheckDTO, iterCount int) (string, error) {
 	rmSalt := utils.GenerateRandomSalt(utils.SaltSize)
 
@@ -349,6 +982,20 @@ func (s *service) RegisterUserPrecheck(req dto.RegisterUserPrecheckDTO, iterCoun
 		return "", err
 	}
 
+	user, err := s.repository.GetUserForUsername(req.Username)
+	if err != nil {
+		return "", err
+	}
+
+	if user.StoredKey != "" {
+		salt, _, err := fakeScramParameters(req.Username)
+		return salt, err
+	}
+
+	if user.Salt != rmSalt {
+		return "", constants.ErrUsernameUnavailable
+	}
+
 	return rmSalt, nil
 }
 
@@ -367,8 +1014,151 @@ func (s *service) RegisterUser(req dto.RegisterUserDTO) error {
 	return s.repository.RegisterUser(req)
 }
 
-func (s *service) UpdateUserPassword(username string, storedKey string, serverKey string) error {
-	return s.repository.UpdateUserPassword(username, storedKey, serverKey)
+// ResetPasswordPrecheck returns the SCRAM parameters of the user along with a
+// fresh challenge that the reset must sign. The challenge stays valid for
+// passwordResetChallengeTTL and for a single reset attempt. Unknown usernames
+// get fake parameters and a challenge that no signature will satisfy.
+func (s *service) ResetPasswordPrecheck(
+	req dto.ResetPasswordPrecheckDTO,
+) (models.ResetPasswordPrecheckResponseOutput, error) {
+	salt, iterCount, err := s.userScramParameters(req.Username)
+	if err != nil {
+		return models.ResetPasswordPrecheckResponseOutput{}, err
+	}
+
+	createdAt := time.Now().UTC()
+	challenge := models.PasswordResetChallenge{
+		Username:  req.Username,
+		Challenge: utils.GenerateRandomSalt(utils.SaltSize),
+		ExpiresAt: createdAt.Add(passwordResetChallengeTTL),
+		CreatedAt: createdAt,
+	}
+
+	err = s.repository.CreatePasswordResetChallenge(challenge)
+	if err != nil {
+		return models.ResetPasswordPrecheckResponseOutput{}, fmt.Errorf("failed to issue password reset challenge: %v", err)
+	}
+
+	return models.ResetPasswordPrecheckResponseOutput{
+		Salt:           salt,
+		IterationCount: iterCount,
+		Challenge:      challenge.Challenge,
+		Message:        challenge.Message(),
+		ExpiresAt:      challenge.ExpiresAt,
+	}, nil
+}
+
+// ResetPassword replaces the SCRAM keys of the user once the signature over
+// their reset challenge checks out against the public key derived from their
+// mnemonic. The challenge is consumed before the signature is checked, so
+// every challenge allows a single attempt. A successful reset revokes all
+// sessions of the user.
+func (s *service) ResetPassword(req dto.ResetPasswordDTO) error {
+	err := s.repository.ConsumePasswordResetChallenge(req.Username, req.Challenge, time.Now().UTC())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return constants.ErrInvalidPasswordResetChallenge
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check password reset challenge: %v", err)
+	}
+
+	user, err := s.repository.GetUserForUsername(req.Username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return constants.ErrInvalidPasswordResetSignature
+	}
+	if err != nil {
+		return err
+	}
+
+	challenge := models.PasswordResetChallenge{Username: user.Username, Challenge: req.Challenge}
+	err = s.ValidateSignature(challenge.Message(), req.Signature, user.PublicKey)
+	if err != nil {
+		return constants.ErrInvalidPasswordResetSignature
+	}
+
+	return s.repository.UpdateUserPassword(user.Username, req.StoredKey, req.ServerKey, time.Now().UTC())
+}
+
+// ValidateUserToken returns the user a user portal token was issued to, as
+// long as its session was not revoked.
+func (s *service) ValidateUserToken(tokenString string) (uint, error) {
+	return utils.ValidateToken(s.repository, tokenString)
+}
+
+func (s *service) ValidateClientToken(tokenString string) (*models.ClientClaims, error) {
+	return utils.ValidateClientToken(s.repository, tokenString)
+}
+
+func (s *service) ValidateClientTokenWithScope(tokenString string, scope string) (*models.ClientClaims, error) {
+	return utils.ValidateClientTokenWithScope(s.repository, tokenString, scope)
+}
+
+// GetUserSessions lists the live sessions of the user, marking the one of
+// the token the list is asked with.
+func (s *service) GetUserSessions(userID uint, tokenString string) ([]models.SessionResponseOutput, error) {
+	sessions, err := s.repository.GetUserSessions(userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	return sessionsResponse(sessions, tokenString), nil
+}
+
+func (s *service) GetClientSessions(clientID string, tokenString string) ([]models.SessionResponseOutput, error) {
+	sessions, err := s.repository.GetClientSessions(clientID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	return sessionsResponse(sessions, tokenString), nil
+}
+
+func sessionsResponse(sessions []models.Session, tokenString string) []models.SessionResponseOutput {
+	currentJTI, _ := utils.ParseSessionID(tokenString)
+
+	response := make([]models.SessionResponseOutput, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, models.SessionResponseOutput{
+			ID:          session.ID,
+			DeviceLabel: session.DeviceLabel,
+			ClientID:    sessionClientID(session),
+			CreatedAt:   session.CreatedAt,
+			LastSeenAt:  session.LastSeenAt,
+			ExpiresAt:   session.ExpiresAt,
+			Current:     session.JTI == currentJTI,
+		})
+	}
+
+	return response
+}
+
+// sessionClientID names the app of an app session of a user. Sessions of the
+// portals have none.
+func sessionClientID(session models.Session) string {
+	if session.UserID == nil || session.ClientID == nil {
+		return ""
+	}
+	return *session.ClientID
+}
+
+// RevokeUserSessions revokes the user's session with the id, or all of them
+// when id is 0.
+func (s *service) RevokeUserSessions(userID uint, id uint) error {
+	return s.repository.RevokeUserSessions(userID, id, time.Now().UTC())
+}
+
+func (s *service) RevokeClientSessions(clientID string, id uint) error {
+	return s.repository.RevokeClientSessions(clientID, id, time.Now().UTC())
+}
+
+// Logout revokes the session of a user or client portal token.
+func (s *service) Logout(tokenString string) error {
+	jti, err := utils.ParseSessionID(tokenString)
+	if err != nil {
+		return err
+	}
+
+	return s.repository.RevokeSession(jti, time.Now().UTC())
 }
 
 func (s *service) GetClientUnpaidAmount(clientId string) (int, error) {
@@ -513,3 +1303,489 @@ func (s *service) SaveTelegramSessionID(userID uint, sessionID []byte) error {
 
 	return s.repository.SaveTelegramSessionIDHash(userID, sessionIDHash[:])
 }
+
+func (s *service) GetConnectedApps(userID uint) ([]models.ConnectedAppResponseOutput, error) {
+	apps, err := s.repository.GetConnectedApps(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	response := make([]models.ConnectedAppResponseOutput, 0, len(apps))
+	for _, app := range apps {
+		response = append(response, models.ConnectedAppResponseOutput{
+			ClientID:   app.ClientID,
+			ClientName: app.ClientName,
+			Scopes:     strings.Split(app.Scopes, ","),
+			GrantedAt:  app.GrantedAt,
+			LastUsedAt: app.LastUsedAt,
+		})
+	}
+
+	return response, nil
+}
+
+// RevokeConnectedApp deletes the user's consent for the client and revokes
+// the sessions of the access tokens already issued to it.
+func (s *service) RevokeConnectedApp(userID uint, clientID string) error {
+	return s.repository.DeleteUserConsent(userID, clientID, time.Now().UTC())
+}
+
+// GetDataAccessTimeline lists which metadata fields clients read from the
+// user, the latest first. clientID, since and until narrow the timeline down
+// when they are set.
+func (s *service) GetDataAccessTimeline(
+	userID uint, clientID string, since time.Time, until time.Time,
+) ([]models.DataAccessResponseOutput, error) {
+	records, err := s.repository.GetDataAccessRecords(userID, clientID, since, until)
+	if err != nil {
+		return nil, err
+	}
+
+	timeline := make([]models.DataAccessResponseOutput, 0, len(records))
+	for _, record := range records {
+		timeline = append(timeline, models.DataAccessResponseOutput{
+			ClientID:   record.ClientID,
+			ClientName: record.ClientName,
+			Scopes:     splitList(record.Scopes),
+			Fields:     splitList(record.Fields),
+			AccessedAt: record.AccessedAt,
+		})
+	}
+
+	return timeline, nil
+}
+
+// splitList splits a comma separated list, an empty list has no elements.
+func splitList(list string) []string {
+	if list == "" {
+		return []string{}
+	}
+	return strings.Split(list, ",")
+}
+
+func (s *service) GetDataAccessDigest(userID uint) (models.DataAccessDigestResponseOutput, error) {
+	digest, err := s.repository.GetDataAccessDigest(userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.DataAccessDigestResponseOutput{Enabled: false}, nil
+	}
+	if err != nil {
+		return models.DataAccessDigestResponseOutput{}, err
+	}
+
+	return models.DataAccessDigestResponseOutput{
+		Enabled:    true,
+		LastSentAt: digest.LastSentAt,
+	}, nil
+}
+
+// SubscribeDataAccessDigest sends the data access digest of the user to the
+// email. The address is not stored with the user, so it must be the one the
+// user verified: its verification code must match the user's.
+func (s *service) SubscribeDataAccessDigest(userID uint, email string) error {
+	user, err := s.repository.FindUser(userID)
+	if err != nil {
+		return err
+	}
+
+	email = normalizeEmailDomain(email)
+
+	if user.EmailVerificationCode == "" {
+		return constants.ErrDigestEmailNotVerified
+	}
+
+	verificationCode, err := s.codeGenerator.GenerateCode(&user, email)
+	if err != nil {
+		return err
+	}
+	if verificationCode != user.EmailVerificationCode {
+		return constants.ErrDigestEmailNotVerified
+	}
+
+	return s.repository.SaveDataAccessDigest(models.DataAccessDigest{
+		UserID:    userID,
+		Email:     email,
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+func (s *service) UnsubscribeDataAccessDigest(userID uint) error {
+	return s.repository.DeleteDataAccessDigest(userID)
+}
+
+func (s *service) GetClientRedirectURIs(clientID string) ([]string, error) {
+	redirectURIs, err := s.repository.GetClientRedirectURIs(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	uris := make([]string, 0, len(redirectURIs))
+	for _, redirectURI := range redirectURIs {
+		uris = append(uris, redirectURI.RedirectURI)
+	}
+
+	return uris, nil
+}
+
+func (s *service) AddClientRedirectURI(clientID string, redirectURI string) error {
+	if err := serverUtils.ValidateRedirectURI(redirectURI); err != nil {
+		return err
+	}
+
+	return s.repository.AddClientRedirectURI(clientID, redirectURI)
+}
+
+func (s *service) RemoveClientRedirectURI(clientID string, redirectURI string) error {
+	return s.repository.RemoveClientRedirectURI(clientID, redirectURI)
+}
+
+// RotateClientSecret issues a new secret for the client. Only its hash is
+// stored, so the returned secret cannot be shown again. The secret it replaces
+// keeps working for CLIENT_SECRET_ROTATION_OVERLAP (24h by default).
+func (s *service) RotateClientSecret(clientID string) (models.RotateClientSecretResponseOutput, error) {
+	overlap := defaultClientSecretRotationOverlap
+	if value := os.Getenv("CLIENT_SECRET_ROTATION_OVERLAP"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return models.RotateClientSecretResponseOutput{}, fmt.Errorf("invalid client secret rotation overlap: %s", value)
+		}
+		overlap = parsed
+	}
+
+	secret := utils.GenerateSecret(utils.SecretSize)
+	secretHash, err := serverUtils.HashClientSecret(secret)
+	if err != nil {
+		return models.RotateClientSecretResponseOutput{}, err
+	}
+
+	previousExpiresAt := time.Now().UTC().Add(overlap)
+	err = s.repository.RotateClientSecret(clientID, secretHash, previousExpiresAt)
+	if err != nil {
+		return models.RotateClientSecretResponseOutput{}, err
+	}
+
+	return models.RotateClientSecretResponseOutput{
+		Secret:                  secret,
+		PreviousSecretExpiresAt: previousExpiresAt,
+	}, nil
+}
+
+// RegisterDynamicClient creates a client from RFC 7591 metadata. The client
+// secret and the registration access token are returned once and only their
+// hashes are stored.
+// SetClientRequireUserTwoFactor makes the OAuth authorization of the client
+// refuse users without a confirmed authenticator.
+func (s *service) SetClientRequireUserTwoFactor(clientID string, required bool) error {
+	return s.repository.SetClientRequireUserTwoFactor(clientID, required)
+}
+
+func (s *service) RegisterDynamicClient(req dto.ClientRegistrationDTO) (models.ClientRegistrationResponseOutput, error) {
+	client, redirectURIs, err := clientFromRegistrationMetadata(req)
+	if err != nil {
+		return models.ClientRegistrationResponseOutput{}, err
+	}
+
+	exists, err := s.repository.IsBackendURIExists(client.BackendURI)
+	if err != nil {
+		return models.ClientRegistrationResponseOutput{}, err
+	}
+	if exists {
+		return models.ClientRegistrationResponseOutput{}, fmt.Errorf("backend uri %s is already registered", client.BackendURI)
+	}
+
+	ratePerByte, err := strconv.Atoi(os.Getenv("CLIENT_TRAFFIC_RATE_PER_BYTE"))
+	if err != nil {
+		return models.ClientRegistrationResponseOutput{}, fmt.Errorf("client traffic rate is not configured: %v", err)
+	}
+
+	secret := utils.GenerateSecret(utils.SecretSize)
+	secretHash, err := serverUtils.HashClientSecret(secret)
+	if err != nil {
+		return models.ClientRegistrationResponseOutput{}, err
+	}
+
+	registrationAccessToken := utils.GenerateSecret(utils.SecretSize)
+
+	client.ID = utils.GenerateUUID()
+	// dynamically registered clients never log into the portal, the username
+	// only has to be unique
+	client.Username = client.ID
+	client.SecretHash = secretHash
+	client.RegistrationAccessTokenHash = hashRegistrationAccessToken(registrationAccessToken)
+
+	err = s.repository.RegisterDynamicClient(client, redirectURIs, ratePerByte)
+	if err != nil {
+		return models.ClientRegistrationResponseOutput{}, err
+	}
+
+	response := clientRegistrationResponse(client, redirectURIs)
+	response.ClientSecret = secret
+	response.RegistrationAccessToken = registrationAccessToken
+
+	return response, nil
+}
+
+func (s *service) GetRegisteredClient(clientID string, registrationAccessToken string) (models.ClientRegistrationResponseOutput, error) {
+	client, err := s.authenticateRegistrationAccess(clientID, registrationAccessToken)
+	if err != nil {
+		return models.ClientRegistrationResponseOutput{}, err
+	}
+
+	redirectURIs, err := s.GetClientRedirectURIs(client.ID)
+	if err != nil {
+		return models.ClientRegistrationResponseOutput{}, err
+	}
+
+	return clientRegistrationResponse(client, redirectURIs), nil
+}
+
+// UpdateRegisteredClient replaces the client's metadata as described in
+// RFC 7592, section 2.2. Fields left out of the request are cleared.
+func (s *service) UpdateRegisteredClient(
+	clientID string,
+	registrationAccessToken string,
+	req dto.ClientRegistrationDTO,
+) (models.ClientRegistrationResponseOutput, error) {
+	current, err := s.authenticateRegistrationAccess(clientID, registrationAccessToken)
+	if err != nil {
+		return models.ClientRegistrationResponseOutput{}, err
+	}
+
+	client, redirectURIs, err := clientFromRegistrationMetadata(req)
+	if err != nil {
+		return models.ClientRegistrationResponseOutput{}, err
+	}
+	client.ID = current.ID
+
+	if client.BackendURI != current.BackendURI {
+		exists, err := s.repository.IsBackendURIExists(client.BackendURI)
+		if err != nil {
+			return models.ClientRegistrationResponseOutput{}, err
+		}
+		if exists {
+			return models.ClientRegistrationResponseOutput{}, fmt.Errorf("backend uri %s is already registered", client.BackendURI)
+		}
+	}
+
+	err = s.repository.UpdateRegisteredClient(client, redirectURIs)
+	if err != nil {
+		return models.ClientRegistrationResponseOutput{}, err
+	}
+
+	return clientRegistrationResponse(client, redirectURIs), nil
+}
+
+func (s *service) DeleteRegisteredClient(clientID string, registrationAccessToken string) error {
+	client, err := s.authenticateRegistrationAccess(clientID, registrationAccessToken)
+	if err != nil {
+		return err
+	}
+
+	return s.repository.DeleteRegisteredClient(client.ID)
+}
+
+// authenticateRegistrationAccess returns the client if registrationAccessToken
+// was issued for it. Unknown clients are reported the same way as a wrong
+// token, so the API does not reveal which client ids exist.
+func (s *service) authenticateRegistrationAccess(clientID string, registrationAccessToken string) (models.Client, error) {
+	client, err := s.repository.GetClientByID(clientID)
+	if err != nil {
+		return models.Client{}, constants.ErrInvalidRegistrationAccessToken
+	}
+
+	tokenHash := hashRegistrationAccessToken(registrationAccessToken)
+	if client.RegistrationAccessTokenHash == "" ||
+		!hmac.Equal([]byte(client.RegistrationAccessTokenHash), []byte(tokenHash)) {
+		return models.Client{}, constants.ErrInvalidRegistrationAccessToken
+	}
+
+	return client, nil
+}
+
+// clientFromRegistrationMetadata validates the metadata of a registration or
+// update request and maps it onto a client, without its credentials.
+func clientFromRegistrationMetadata(req dto.ClientRegistrationDTO) (models.Client, []string, error) {
+	grantTypes := req.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = []string{constants.GrantTypeAuthorizationCode}
+	}
+
+	redirectURIs := []string{}
+	for _, redirectURI := range req.RedirectURIs {
+		if err := serverUtils.ValidateRedirectURI(redirectURI); err != nil {
+			return models.Client{}, nil, err
+		}
+		if !slices.Contains(redirectURIs, redirectURI) {
+			redirectURIs = append(redirectURIs, redirectURI)
+		}
+	}
+
+	if len(redirectURIs) == 0 && slices.Contains(grantTypes, constants.GrantTypeAuthorizationCode) {
+		return models.Client{}, nil, fmt.Errorf("redirect_uris are required for the authorization_code grant")
+	}
+
+	client := models.Client{
+		Name:       req.ClientName,
+		BackendURI: utils.RemoveProtocolFromURL(req.BackendURI),
+		LogoURI:    req.LogoURI,
+		Contacts:   strings.Join(req.Contacts, ","),
+		GrantTypes: strings.Join(slices.Compact(slices.Sorted(slices.Values(grantTypes))), ","),
+	}
+	if len(redirectURIs) > 0 {
+		client.RedirectURI = redirectURIs[0]
+	}
+
+	return client, redirectURIs, nil
+}
+
+func clientRegistrationResponse(client models.Client, redirectURIs []string) models.ClientRegistrationResponseOutput {
+	response := models.ClientRegistrationResponseOutput{
+		ClientID: client.ID,
+		// secrets issued at registration do not expire, they are rotated instead
+		ClientSecretExpiresAt: 0,
+		RegistrationClientURI: os.Getenv("PROXY_URL") + "/api/v1/register/" + client.ID,
+		RedirectURIs:          redirectURIs,
+		ClientName:            client.Name,
+		BackendURI:            client.BackendURI,
+		LogoURI:               client.LogoURI,
+		GrantTypes:            strings.Split(client.GrantTypes, ","),
+	}
+	if client.Contacts != "" {
+		response.Contacts = strings.Split(client.Contacts, ",")
+	}
+	return response
+}
+
+func hashRegistrationAccessToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// IssueVerifiedAttributesCredential issues an SD-JWT to the user with one
+// selectively disclosable boolean claim per verified attribute, and one with
+// the ID of the zk key pair it was proved with, so a verifier can tell which
+// of the published verifying keys the attribute rests on. The credential is
+// bound to the holder key of the request, so service providers only accept
+// it from the holder, with a key binding JWT made for them.
+func (s *service) IssueVerifiedAttributesCredential(userID uint, req dto.VerifiedAttributesCredentialDTO) (models.VerifiedAttributesCredentialResponseOutput, error) {
+	if _, err := req.HolderKey.PublicKey(); err != nil {
+		return models.VerifiedAttributesCredentialResponseOutput{}, fmt.Errorf("invalid holder key: %v", err)
+	}
+
+	issuer, err := utils.LoadCredentialIssuer()
+	if err != nil {
+		return models.VerifiedAttributesCredentialResponseOutput{}, err
+	}
+
+	user, metadata, err := s.repository.ProfileUser(userID)
+	if err != nil {
+		return models.VerifiedAttributesCredentialResponseOutput{}, err
+	}
+
+	// the claims are only the verification status and the key pair: proofs,
+	// their salt and the verification codes are per user and would let
+	// service providers link the holder, key pairs are shared by every user
+	// verified while they were current
+	var disclosures []sdjwt.Disclosure
+	for _, attribute := range []struct {
+		claim       string
+		verified    bool
+		zkKeyPairID uint
+	}{
+		{emailVerifiedClaim, metadata.IsEmailVerified, user.EmailZkKeyPairId},
+		{phoneNumberVerifiedClaim, metadata.IsPhoneNumberVerified, user.PhoneNumberZkPairID},
+	} {
+		if !attribute.verified {
+			continue
+		}
+		disclosure, err := sdjwt.NewDisclosure(attribute.claim, true)
+		if err != nil {
+			return models.VerifiedAttributesCredentialResponseOutput{}, err
+		}
+		disclosures = append(disclosures, disclosure)
+
+		if attribute.zkKeyPairID == 0 {
+			continue
+		}
+		disclosure, err = sdjwt.NewDisclosure(attribute.claim+keyIDClaimSuffix, attribute.zkKeyPairID)
+		if err != nil {
+			return models.VerifiedAttributesCredentialResponseOutput{}, err
+		}
+		disclosures = append(disclosures, disclosure)
+	}
+
+	if len(disclosures) == 0 {
+		return models.VerifiedAttributesCredentialResponseOutput{}, fmt.Errorf("the user has no verified attributes")
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	expiresAt := now.Add(verifiedAttributesCredentialTTL)
+
+	// no subject claim: the credential is presented to many service providers
+	// and a shared identifier would let them link the user
+	credential, err := issuer.Issue(
+		map[string]interface{}{
+			"iss": os.Getenv("PROXY_URL"),
+			"vct": verifiedAttributesCredentialType,
+			"iat": now.Unix(),
+			"exp": expiresAt.Unix(),
+			"cnf": sdjwt.Confirmation(req.HolderKey),
+		},
+		disclosures,
+	)
+	if err != nil {
+		return models.VerifiedAttributesCredentialResponseOutput{}, err
+	}
+
+	return models.VerifiedAttributesCredentialResponseOutput{
+		Credential: credential,
+		ExpiresAt:  expiresAt,
+	}, nil
+}
+
+func (s *service) GetCredentialIssuerMetadata() (sdjwt.IssuerMetadata, error) {
+	issuer, err := utils.LoadCredentialIssuer()
+	if err != nil {
+		return sdjwt.IssuerMetadata{}, err
+	}
+
+	return sdjwt.IssuerMetadata{
+		Issuer: os.Getenv("PROXY_URL"),
+		JWKS:   sdjwt.KeySet{Keys: []sdjwt.JWK{issuer.PublicJWK()}},
+	}, nil
+}
+
+// GetZkVerifyingKeys publishes the verifying key of every key pair proofs were
+// ever generated with, so stored proofs stay checkable after a new setup.
+func (s *service) GetZkVerifyingKeys() ([]zkverify.VerifyingKey, error) {
+	keyPairs, err := s.repository.GetZkSnarksVerifyingKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	verifyingKeys := make([]zkverify.VerifyingKey, 0, len(keyPairs))
+	for _, keyPair := range keyPairs {
+		verifyingKeys = append(verifyingKeys, zkverify.VerifyingKey{
+			ID:             keyPair.ID,
+			Curve:          zkverify.Curve,
+			Circuit:        keyPair.Circuit,
+			VerifyingKey:   keyPair.VerifyingKey,
+			RetiredAt:      keyPair.RetiredAt,
+			TranscriptHash: keyPair.TranscriptHash,
+		})
+	}
+
+	return verifyingKeys, nil
+}
+
+// VerifyZkProof checks a proof against the key pair it names. A proof that
+// does not verify is a valid answer, not an error.
+func (s *service) VerifyZkProof(req dto.VerifyZkProofDTO) (models.VerifyZkProofResponseOutput, error) {
+	err := s.proofProcessor.VerifyProof(
+		req.ZkKeyPairID, req.VerificationCode, req.Salt, req.DomainCommitment, req.ZkProof,
+	)
+	if errors.Is(err, zk.ErrUnknownZkKeyPair) {
+		return models.VerifyZkProofResponseOutput{}, fmt.Errorf("zk key pair %d: %w", req.ZkKeyPairID, err)
+	}
+
+	return models.VerifyZkProofResponseOutput{Valid: err == nil}, nil
+}
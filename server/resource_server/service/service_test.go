@@ -1,9 +1,15 @@
 package service_test
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"globe-and-citizen/layer8/server/constants"
 	serverModels "globe-and-citizen/layer8/server/models"
 	"globe-and-citizen/layer8/server/resource_server/dto"
 	"globe-and-citizen/layer8/server/resource_server/emails/verification"
@@ -13,6 +19,13 @@ import (
 	"globe-and-citizen/layer8/server/resource_server/service"
 	"globe-and-citizen/layer8/server/resource_server/utils"
 	"globe-and-citizen/layer8/server/resource_server/utils/mocks"
+	"globe-and-citizen/layer8/server/sdjwt"
+	"globe-and-citizen/layer8/server/totp"
+	serverUtils "globe-and-citizen/layer8/server/utils"
+	"globe-and-citizen/layer8/server/webauthn"
+	"globe-and-citizen/layer8/server/webauthn/webauthntest"
+	"globe-and-citizen/layer8/server/zkverify"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -20,6 +33,7 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 
 	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
 )
 
 const userId uint = 1
@@ -78,12 +92,55 @@ type mockRepository struct {
 	registerUserPrecheck         func(req dto.RegisterUserPrecheckDTO, salt string, iterCount int) error
 	registerClientPrecheck       func(req dto.RegisterClientPrecheckDTO, salt string, iterCount int) error
 	registerUser                 func(req dto.RegisterUserDTO) error
-	registerClient               func(req dto.RegisterClientDTO, id string, secret string) error
+	registerClient               func(req dto.RegisterClientDTO, id string, secretHash string) error
 	getUserForUsername           func(username string) (models.User, error)
 	profileClient                func(username string) (models.Client, error)
-	updateUserPassword           func(username string, storedKey string, serverKey string) error
+	updateUserPassword           func(username string, storedKey string, serverKey string, revokedAt time.Time) error
 	getUserMetadata              func(userID int64, key string) (*serverModels.UserMetadata, error)
 	updateUserMetadata           func(userID uint, req dto.UpdateUserMetadataDTO) error
+	getConnectedApps             func(userID uint) ([]models.ConnectedApp, error)
+	deleteUserConsent            func(userID uint, clientID string, revokedAt time.Time) error
+	getClientRedirectURIs        func(clientID string) ([]models.ClientRedirectURI, error)
+	addClientRedirectURI         func(clientID string, redirectURI string) error
+	removeClientRedirectURI      func(clientID string, redirectURI string) error
+	rotateClientSecret           func(clientID string, secretHash string, previousExpiresAt time.Time) error
+	isBackendURIExists           func(backendURL string) (bool, error)
+	registerDynamicClient        func(client models.Client, redirectURIs []string, ratePerByte int) error
+	getClientByID                func(clientID string) (models.Client, error)
+	updateRegisteredClient       func(client models.Client, redirectURIs []string) error
+	deleteRegisteredClient       func(clientID string) error
+	getZkSnarksVerifyingKeys     func() ([]models.ZkSnarksKeyPair, error)
+	createZkProofJob             func(job models.ZkProofJob) (uint, error)
+	getZkProofJob                func(id uint, userID uint) (models.ZkProofJob, error)
+	createScramSession           func(session models.ScramSession) error
+	consumeScramSession          func(principal string, username string, nonce string, cNonce string, now time.Time) error
+	createResetChallenge         func(challenge models.PasswordResetChallenge) error
+	consumeResetChallenge        func(username string, challenge string, now time.Time) error
+	saveTwoFactorCredential      func(credential models.TwoFactorCredential) error
+	getTwoFactorCredential       func(principal string, username string) (models.TwoFactorCredential, error)
+	confirmTwoFactorCredential   func(id uint, step int64, confirmedAt time.Time, codeHashes []string) error
+	useTwoFactorStep             func(credentialID uint, step int64) error
+	useTwoFactorRecoveryCode     func(credentialID uint, codeHash string, usedAt time.Time) error
+	deleteTwoFactorCredential    func(principal string, username string) error
+	setClientRequireTwoFactor    func(clientID string, required bool) error
+	createWebAuthnChallenge      func(challenge models.WebAuthnChallenge) error
+	consumeWebAuthnChallenge     func(ceremony string, challenge string, userID uint, now time.Time) error
+	createPasskey                func(passkey models.Passkey) error
+	getPasskey                   func(credentialID string) (models.Passkey, error)
+	getPasskeysOfUser            func(userID uint) ([]models.Passkey, error)
+	useWebAuthnCredential        func(id uint, signCount uint32, usedAt time.Time) error
+	deletePasskey                func(userID uint, id uint) error
+	createSession                func(session models.Session) error
+	touchSession                 func(jti string, now time.Time) error
+	getUserSessions              func(userID uint, now time.Time) ([]models.Session, error)
+	getClientSessions            func(clientID string, now time.Time) ([]models.Session, error)
+	revokeUserSessions           func(userID uint, id uint, revokedAt time.Time) error
+	revokeClientSessions         func(clientID string, id uint, revokedAt time.Time) error
+	revokeSession                func(jti string, revokedAt time.Time) error
+	getDataAccessRecords         func(userID uint, clientID string, since time.Time, until time.Time) ([]models.DataAccessRecord, error)
+	getDataAccessDigest          func(userID uint) (models.DataAccessDigest, error)
+	saveDataAccessDigest         func(digest models.DataAccessDigest) error
+	deleteDataAccessDigest       func(userID uint) error
 }
 
 func (m *mockRepository) FindUser(userId uint) (models.User, error) {
@@ -127,11 +184,14 @@ func (m *mockRepository) RegisterPrecheckClient(req dto.RegisterClientPrecheckDT
 	return m.registerClientPrecheck(req, salt, iterCount)
 }
 
-func (m *mockRepository) RegisterClient(req dto.RegisterClientDTO, id string, secret string) error {
-	return m.registerClient(req, id, secret)
+func (m *mockRepository) RegisterClient(req dto.RegisterClientDTO, id string, secretHash string) error {
+	return m.registerClient(req, id, secretHash)
 }
 
 func (m *mockRepository) IsBackendURIExists(backendURL string) (bool, error) {
+	if m.isBackendURIExists != nil {
+		return m.isBackendURIExists(backendURL)
+	}
 	return true, nil
 }
 
@@ -139,7 +199,6 @@ func (m *mockRepository) GetClientData(clientName string) (models.Client, error)
 	if clientName == "testclient" {
 		return models.Client{
 			ID:          "1",
-			Secret:      "testsecret",
 			Name:        "testclient",
 			RedirectURI: "https://gcitizen.com/callback",
 		}, nil
@@ -187,7 +246,7 @@ func (m *mockRepository) SaveZkSnarksKeyPair(keyPair models.ZkSnarksKeyPair) (ui
 	return 0, nil
 }
 
-func (m *mockRepository) GetLatestZkSnarksKeys() (models.ZkSnarksKeyPair, error) {
+func (m *mockRepository) GetLatestZkSnarksKeys(circuit string) (models.ZkSnarksKeyPair, error) {
 	return models.ZkSnarksKeyPair{}, nil
 }
 
@@ -195,8 +254,10 @@ func (m *mockRepository) GetUserForUsername(username string) (models.User, error
 	return m.getUserForUsername(username)
 }
 
-func (m *mockRepository) UpdateUserPassword(username string, storedKey string, serverKey string) error {
-	return m.updateUserPassword(username, storedKey, serverKey)
+func (m *mockRepository) UpdateUserPassword(
+	username string, storedKey string, serverKey string, revokedAt time.Time,
+) error {
+	return m.updateUserPassword(username, storedKey, serverKey, revokedAt)
 }
 
 func (m *mockRepository) AddClientTrafficUsage(string, int, time.Time) error {
@@ -235,6 +296,331 @@ func (m *mockRepository) SaveTelegramSessionIDHash(userID uint, sessionID []byte
 	return nil
 }
 
+func (m *mockRepository) GetConnectedApps(userID uint) ([]models.ConnectedApp, error) {
+	return m.getConnectedApps(userID)
+}
+
+func (m *mockRepository) DeleteUserConsent(userID uint, clientID string, revokedAt time.Time) error {
+	return m.deleteUserConsent(userID, clientID, revokedAt)
+}
+
+func (m *mockRepository) GetClientRedirectURIs(clientID string) ([]models.ClientRedirectURI, error) {
+	return m.getClientRedirectURIs(clientID)
+}
+
+func (m *mockRepository) AddClientRedirectURI(clientID string, redirectURI string) error {
+	return m.addClientRedirectURI(clientID, redirectURI)
+}
+
+func (m *mockRepository) RemoveClientRedirectURI(clientID string, redirectURI string) error {
+	return m.removeClientRedirectURI(clientID, redirectURI)
+}
+
+func (m *mockRepository) RotateClientSecret(clientID string, secretHash string, previousExpiresAt time.Time) error {
+	return m.rotateClientSecret(clientID, secretHash, previousExpiresAt)
+}
+
+func (m *mockRepository) RegisterDynamicClient(client models.Client, redirectURIs []string, ratePerByte int) error {
+	return m.registerDynamicClient(client, redirectURIs, ratePerByte)
+}
+
+func (m *mockRepository) GetClientByID(clientID string) (models.Client, error) {
+	return m.getClientByID(clientID)
+}
+
+func (m *mockRepository) UpdateRegisteredClient(client models.Client, redirectURIs []string) error {
+	return m.updateRegisteredClient(client, redirectURIs)
+}
+
+func (m *mockRepository) DeleteRegisteredClient(clientID string) error {
+	return m.deleteRegisteredClient(clientID)
+}
+
+func (m *mockRepository) RotateZkSnarksKeyPair(
+	circuit string, due func(active *models.ZkSnarksKeyPair) bool, generate func() models.ZkSnarksKeyPair,
+) (bool, error) {
+	return false, nil
+}
+
+func (m *mockRepository) GetZkSnarksVerifyingKey(id uint) (models.ZkSnarksKeyPair, error) {
+	return models.ZkSnarksKeyPair{}, nil
+}
+
+func (m *mockRepository) GetZkSnarksVerifyingKeys() ([]models.ZkSnarksKeyPair, error) {
+	return m.getZkSnarksVerifyingKeys()
+}
+
+func (m *mockRepository) RetireZkSnarksKeyPairs(ids []uint, retiredAt time.Time) error {
+	return nil
+}
+
+func (m *mockRepository) MarkZkProofsToReprove(keyPairIDs []uint, reproveBy time.Time) (int, error) {
+	return 0, nil
+}
+
+func (m *mockRepository) ResetProofsOfRetiredZkKeyPairs() (int, error) {
+	return 0, nil
+}
+
+func (m *mockRepository) CreateZkProofJob(job models.ZkProofJob) (uint, error) {
+	return m.createZkProofJob(job)
+}
+
+func (m *mockRepository) ClaimZkProofJob(now time.Time, staleBefore time.Time) (models.ZkProofJob, error) {
+	return models.ZkProofJob{}, nil
+}
+
+func (m *mockRepository) CompleteZkProofJob(id uint, zkKeyPairID uint, finishedAt time.Time) error {
+	return nil
+}
+
+func (m *mockRepository) FailZkProofJob(id uint, jobError string, finishedAt time.Time) error {
+	return nil
+}
+
+func (m *mockRepository) ExpireZkProofJobs(queuedBefore time.Time, finishedAt time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (m *mockRepository) GetZkProofJob(id uint, userID uint) (models.ZkProofJob, error) {
+	return m.getZkProofJob(id, userID)
+}
+
+func (m *mockRepository) CountPendingZkProofJobs() (int64, error) {
+	return 0, nil
+}
+
+func (m *mockRepository) CreateScramSession(session models.ScramSession) error {
+	if m.createScramSession != nil {
+		return m.createScramSession(session)
+	}
+	return nil
+}
+
+func (m *mockRepository) ConsumeScramSession(
+	principal string, username string, nonce string, cNonce string, now time.Time,
+) error {
+	if m.consumeScramSession != nil {
+		return m.consumeScramSession(principal, username, nonce, cNonce, now)
+	}
+	return nil
+}
+
+func (m *mockRepository) CreatePasswordResetChallenge(challenge models.PasswordResetChallenge) error {
+	if m.createResetChallenge != nil {
+		return m.createResetChallenge(challenge)
+	}
+	return nil
+}
+
+func (m *mockRepository) ConsumePasswordResetChallenge(username string, challenge string, now time.Time) error {
+	if m.consumeResetChallenge != nil {
+		return m.consumeResetChallenge(username, challenge, now)
+	}
+	return nil
+}
+
+func (m *mockRepository) SaveTwoFactorCredential(credential models.TwoFactorCredential) error {
+	if m.saveTwoFactorCredential != nil {
+		return m.saveTwoFactorCredential(credential)
+	}
+	return nil
+}
+
+func (m *mockRepository) GetTwoFactorCredential(principal string, username string) (models.TwoFactorCredential, error) {
+	if m.getTwoFactorCredential != nil {
+		return m.getTwoFactorCredential(principal, username)
+	}
+	return models.TwoFactorCredential{}, gorm.ErrRecordNotFound
+}
+
+func (m *mockRepository) ConfirmTwoFactorCredential(
+	id uint, step int64, confirmedAt time.Time, recoveryCodeHashes []string,
+) error {
+	if m.confirmTwoFactorCredential != nil {
+		return m.confirmTwoFactorCredential(id, step, confirmedAt, recoveryCodeHashes)
+	}
+	return nil
+}
+
+func (m *mockRepository) UseTwoFactorStep(credentialID uint, step int64) error {
+	if m.useTwoFactorStep != nil {
+		return m.useTwoFactorStep(credentialID, step)
+	}
+	return nil
+}
+
+func (m *mockRepository) UseTwoFactorRecoveryCode(credentialID uint, codeHash string, usedAt time.Time) error {
+	if m.useTwoFactorRecoveryCode != nil {
+		return m.useTwoFactorRecoveryCode(credentialID, codeHash, usedAt)
+	}
+	return gorm.ErrRecordNotFound
+}
+
+func (m *mockRepository) DeleteTwoFactorCredential(principal string, username string) error {
+	if m.deleteTwoFactorCredential != nil {
+		return m.deleteTwoFactorCredential(principal, username)
+	}
+	return nil
+}
+
+func (m *mockRepository) CreateWebAuthnChallenge(challenge models.WebAuthnChallenge) error {
+	if m.createWebAuthnChallenge != nil {
+		return m.createWebAuthnChallenge(challenge)
+	}
+	return nil
+}
+
+func (m *mockRepository) ConsumeWebAuthnChallenge(ceremony string, challenge string, userID uint, now time.Time) error {
+	if m.consumeWebAuthnChallenge != nil {
+		return m.consumeWebAuthnChallenge(ceremony, challenge, userID, now)
+	}
+	return nil
+}
+
+func (m *mockRepository) CreatePasskey(passkey models.Passkey) error {
+	if m.createPasskey != nil {
+		return m.createPasskey(passkey)
+	}
+	return nil
+}
+
+func (m *mockRepository) GetPasskey(credentialID string) (models.Passkey, error) {
+	if m.getPasskey != nil {
+		return m.getPasskey(credentialID)
+	}
+	return models.Passkey{}, gorm.ErrRecordNotFound
+}
+
+func (m *mockRepository) GetPasskeysOfUser(userID uint) ([]models.Passkey, error) {
+	if m.getPasskeysOfUser != nil {
+		return m.getPasskeysOfUser(userID)
+	}
+	return nil, nil
+}
+
+func (m *mockRepository) UseWebAuthnCredential(id uint, signCount uint32, usedAt time.Time) error {
+	if m.useWebAuthnCredential != nil {
+		return m.useWebAuthnCredential(id, signCount, usedAt)
+	}
+	return nil
+}
+
+func (m *mockRepository) DeletePasskey(userID uint, id uint) error {
+	if m.deletePasskey != nil {
+		return m.deletePasskey(userID, id)
+	}
+	return nil
+}
+
+func (m *mockRepository) CreateSession(session models.Session) error {
+	if m.createSession != nil {
+		return m.createSession(session)
+	}
+	return nil
+}
+
+func (m *mockRepository) TouchSession(jti string, now time.Time) error {
+	if m.touchSession != nil {
+		return m.touchSession(jti, now)
+	}
+	return nil
+}
+
+func (m *mockRepository) GetUserSessions(userID uint, now time.Time) ([]models.Session, error) {
+	if m.getUserSessions != nil {
+		return m.getUserSessions(userID, now)
+	}
+	return nil, nil
+}
+
+func (m *mockRepository) GetClientSessions(clientID string, now time.Time) ([]models.Session, error) {
+	if m.getClientSessions != nil {
+		return m.getClientSessions(clientID, now)
+	}
+	return nil, nil
+}
+
+func (m *mockRepository) RevokeUserSessions(userID uint, id uint, revokedAt time.Time) error {
+	if m.revokeUserSessions != nil {
+		return m.revokeUserSessions(userID, id, revokedAt)
+	}
+	return nil
+}
+
+func (m *mockRepository) RevokeClientSessions(clientID string, id uint, revokedAt time.Time) error {
+	if m.revokeClientSessions != nil {
+		return m.revokeClientSessions(clientID, id, revokedAt)
+	}
+	return nil
+}
+
+func (m *mockRepository) RevokeSession(jti string, revokedAt time.Time) error {
+	if m.revokeSession != nil {
+		return m.revokeSession(jti, revokedAt)
+	}
+	return nil
+}
+
+func (m *mockRepository) GetDataAccessRecords(
+	userID uint, clientID string, since time.Time, until time.Time,
+) ([]models.DataAccessRecord, error) {
+	if m.getDataAccessRecords != nil {
+		return m.getDataAccessRecords(userID, clientID, since, until)
+	}
+	return nil, nil
+}
+
+func (m *mockRepository) GetDataAccessDigest(userID uint) (models.DataAccessDigest, error) {
+	if m.getDataAccessDigest != nil {
+		return m.getDataAccessDigest(userID)
+	}
+	return models.DataAccessDigest{}, gorm.ErrRecordNotFound
+}
+
+func (m *mockRepository) SaveDataAccessDigest(digest models.DataAccessDigest) error {
+	if m.saveDataAccessDigest != nil {
+		return m.saveDataAccessDigest(digest)
+	}
+	return nil
+}
+
+func (m *mockRepository) DeleteDataAccessDigest(userID uint) error {
+	if m.deleteDataAccessDigest != nil {
+		return m.deleteDataAccessDigest(userID)
+	}
+	return nil
+}
+
+func (m *mockRepository) ClaimDueDataAccessDigests(
+	now time.Time, sentBefore time.Time, claimedBefore time.Time,
+) ([]models.DataAccessDigest, error) {
+	return nil, nil
+}
+
+func (m *mockRepository) ReleaseDataAccessDigest(userID uint) error {
+	return nil
+}
+
+func (m *mockRepository) MarkDataAccessDigestSent(userID uint, sentAt time.Time) error {
+	return nil
+}
+
+func (m *mockRepository) SetClientRequireUserTwoFactor(clientID string, required bool) error {
+	if m.setClientRequireTwoFactor != nil {
+		return m.setClientRequireTwoFactor(clientID, required)
+	}
+	return nil
+}
+
+func (m *mockRepository) SaveUserEmailDomain(userID uint, emailDomain *models.UserEmailDomain) error {
+	return nil
+}
+
+func (m *mockRepository) GetEmailDomainProofs(userID uint) ([]models.EmailDomainProof, error) {
+	return nil, nil
+}
+
 func TestLoginPreCheckUser_RepositoryError(t *testing.T) {
 	mockRepo := &mockRepository{
 		getUserForUsername: func(username string) (models.User, error) {
@@ -255,6 +641,82 @@ func TestLoginPreCheckUser_RepositoryError(t *testing.T) {
 	assert.Empty(t, loginPrecheckResp)
 }
 
+func setUpFakeScramParameters(t *testing.T) {
+	t.Setenv("PRECHECK_FAKE_SALT_SECRET", "precheck_secret")
+	t.Setenv("SCRAM_ITERATION_COUNT", "4096")
+}
+
+func unknownUsernameRepository() *mockRepository {
+	return &mockRepository{
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{}, gorm.ErrRecordNotFound
+		},
+	}
+}
+
+func TestLoginPreCheckUser_UnknownUsernameGetsFakeParameters(t *testing.T) {
+	setUpFakeScramParameters(t)
+
+	sessions := 0
+	mockRepo := unknownUsernameRepository()
+	mockRepo.createScramSession = func(session models.ScramSession) error {
+		sessions++
+		return nil
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	req := dto.LoginPrecheckDTO{Username: "unknown_user", CNonce: cNonce}
+
+	first, err := currService.LoginPrecheckUser(req)
+	assert.Nil(t, err)
+
+	second, err := currService.LoginPrecheckUser(req)
+	assert.Nil(t, err)
+
+	other, err := currService.LoginPrecheckUser(dto.LoginPrecheckDTO{Username: "other_unknown_user", CNonce: cNonce})
+	assert.Nil(t, err)
+
+	assert.Len(t, first.Salt, len(salt))
+	assert.Equal(t, first.Salt, second.Salt)
+	assert.NotEqual(t, first.Salt, other.Salt)
+	assert.Equal(t, 4096, first.IterCount)
+	assert.True(t, strings.HasPrefix(first.Nonce, cNonce))
+	assert.NotEqual(t, first.Nonce, second.Nonce)
+	assert.Equal(t, 3, sessions)
+}
+
+func TestLoginPreCheckUser_PendingRegistrationGetsFakeParameters(t *testing.T) {
+	setUpFakeScramParameters(t)
+
+	currService := service.NewService(unknownUsernameRepository(), nil, nil, code.NewMIMCCodeGenerator())
+	unknown, err := currService.LoginPrecheckUser(dto.LoginPrecheckDTO{Username: username, CNonce: cNonce})
+	assert.Nil(t, err)
+
+	mockRepo := &mockRepository{
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{Username: username, Salt: salt, IterationCount: iterationCount}, nil
+		},
+	}
+	currService = service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
+	pending, err := currService.LoginPrecheckUser(dto.LoginPrecheckDTO{Username: username, CNonce: cNonce})
+	assert.Nil(t, err)
+
+	assert.Equal(t, unknown.Salt, pending.Salt)
+	assert.NotEqual(t, salt, pending.Salt)
+}
+
+func TestLoginPreCheckUser_FakeSaltSecretNotConfigured(t *testing.T) {
+	t.Setenv("PRECHECK_FAKE_SALT_SECRET", "")
+	t.Setenv("SCRAM_ITERATION_COUNT", "4096")
+
+	currService := service.NewService(unknownUsernameRepository(), nil, nil, code.NewMIMCCodeGenerator())
+
+	resp, err := currService.LoginPrecheckUser(dto.LoginPrecheckDTO{Username: username, CNonce: cNonce})
+
+	assert.NotNil(t, err)
+	assert.Empty(t, resp)
+}
+
 func TestLoginPreCheckUser_Success(t *testing.T) {
 	mockRepo := &mockRepository{
 		getUserForUsername: func(username string) (models.User, error) {
@@ -262,6 +724,7 @@ func TestLoginPreCheckUser_Success(t *testing.T) {
 				Username:       username,
 				Salt:           salt,
 				IterationCount: iterationCount,
+				StoredKey:      storedKey,
 			}, nil
 		},
 	}
@@ -281,34 +744,56 @@ func TestLoginPreCheckUser_Success(t *testing.T) {
 	assert.Equal(t, loginPrecheckResp.IterCount, iterationCount)
 }
 
-func TestLoginUser_RepositoryError(t *testing.T) {
+func TestLoginPreCheckUser_StartsScramSession(t *testing.T) {
+	var session models.ScramSession
 	mockRepo := &mockRepository{
 		getUserForUsername: func(username string) (models.User, error) {
-			return models.User{}, errors.New("repository error")
+			return models.User{Username: username, Salt: salt, IterationCount: iterationCount, StoredKey: storedKey}, nil
+		},
+		createScramSession: func(s models.ScramSession) error {
+			session = s
+			return nil
 		},
 	}
+
 	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
 
-	req := dto.LoginUserDTO{
-		Username:    username,
-		CNonce:      cNonce,
-		Nonce:       nonce,
-		ClientProof: clientProof,
+	loginPrecheckResp, err := currService.LoginPrecheckUser(dto.LoginPrecheckDTO{Username: username, CNonce: cNonce})
+
+	assert.Nil(t, err)
+	assert.Equal(t, models.ScramPrincipalUser, session.Principal)
+	assert.Equal(t, username, session.Username)
+	assert.Equal(t, cNonce, session.CNonce)
+	assert.Equal(t, loginPrecheckResp.Nonce, session.Nonce)
+	assert.Equal(t, 2*time.Minute, session.ExpiresAt.Sub(session.CreatedAt))
+}
+
+func TestLoginPreCheckUser_ScramSessionNotStored(t *testing.T) {
+	mockRepo := &mockRepository{
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{Username: username, Salt: salt, IterationCount: iterationCount, StoredKey: storedKey}, nil
+		},
+		createScramSession: func(session models.ScramSession) error {
+			return errors.New("connection reset")
+		},
 	}
 
-	loginUserResp, err := currService.LoginUser(req)
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	loginPrecheckResp, err := currService.LoginPrecheckUser(dto.LoginPrecheckDTO{Username: username, CNonce: cNonce})
 
 	assert.NotNil(t, err)
-	assert.Equal(t, "repository error", err.Error())
-	assert.Empty(t, loginUserResp)
+	assert.Empty(t, loginPrecheckResp)
 }
 
-func TestLoginUser_DecodingStoredKeyError(t *testing.T) {
+func TestLoginUser_ScramSessionInvalidOrExpired(t *testing.T) {
 	mockRepo := &mockRepository{
+		consumeScramSession: func(principal string, username string, nonce string, cNonce string, now time.Time) error {
+			return gorm.ErrRecordNotFound
+		},
 		getUserForUsername: func(username string) (models.User, error) {
-			return models.User{
-				StoredKey: "TEST_STORED_KEY_FOR_DECODE_ERROR_!@#", // Invalid stored key
-			}, nil
+			t.Fatal("the user must not be looked up without a valid login session")
+			return models.User{}, nil
 		},
 	}
 	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
@@ -323,13 +808,111 @@ func TestLoginUser_DecodingStoredKeyError(t *testing.T) {
 	loginUserResp, err := currService.LoginUser(req)
 
 	assert.NotNil(t, err)
-	assert.Equal(t, "error decoding stored key: encoding/hex: invalid byte: U+0054 'T'", err.Error())
+	assert.Equal(t, "login session is invalid or expired", err.Error())
 	assert.Empty(t, loginUserResp)
 }
 
-func TestLoginUser_DecodingClientProofError(t *testing.T) {
+func TestLoginUser_ConsumesScramSession(t *testing.T) {
+	consumed := 0
 	mockRepo := &mockRepository{
-		getUserForUsername: func(username string) (models.User, error) {
+		consumeScramSession: func(principal string, name string, n string, cn string, now time.Time) error {
+			consumed++
+			assert.Equal(t, models.ScramPrincipalUser, principal)
+			assert.Equal(t, username, name)
+			assert.Equal(t, nonce, n)
+			assert.Equal(t, cNonce, cn)
+			return nil
+		},
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{
+				StoredKey:      storedKey,
+				ServerKey:      serverKey,
+				Salt:           salt,
+				IterationCount: iterationCount,
+			}, nil
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	req := dto.LoginUserDTO{
+		Username:    username,
+		CNonce:      cNonce,
+		Nonce:       nonce,
+		ClientProof: clientProof,
+	}
+
+	_, err := currService.LoginUser(req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, consumed)
+}
+
+func TestLoginUser_RepositoryError(t *testing.T) {
+	mockRepo := &mockRepository{
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{}, errors.New("repository error")
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	req := dto.LoginUserDTO{
+		Username:    username,
+		CNonce:      cNonce,
+		Nonce:       nonce,
+		ClientProof: clientProof,
+	}
+
+	loginUserResp, err := currService.LoginUser(req)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "repository error", err.Error())
+	assert.Empty(t, loginUserResp)
+}
+
+func TestLoginUser_UnknownUsername(t *testing.T) {
+	currService := service.NewService(unknownUsernameRepository(), nil, nil, code.NewMIMCCodeGenerator())
+
+	req := dto.LoginUserDTO{
+		Username:    "unknown_user",
+		CNonce:      cNonce,
+		Nonce:       nonce,
+		ClientProof: clientProof,
+	}
+
+	loginUserResp, err := currService.LoginUser(req)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "server failed to authenticate the user", err.Error())
+	assert.Empty(t, loginUserResp)
+}
+
+func TestLoginUser_DecodingStoredKeyError(t *testing.T) {
+	mockRepo := &mockRepository{
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{
+				StoredKey: "TEST_STORED_KEY_FOR_DECODE_ERROR_!@#", // Invalid stored key
+			}, nil
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	req := dto.LoginUserDTO{
+		Username:    username,
+		CNonce:      cNonce,
+		Nonce:       nonce,
+		ClientProof: clientProof,
+	}
+
+	loginUserResp, err := currService.LoginUser(req)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "error decoding stored key: encoding/hex: invalid byte: U+0054 'T'", err.Error())
+	assert.Empty(t, loginUserResp)
+}
+
+func TestLoginUser_DecodingClientProofError(t *testing.T) {
+	mockRepo := &mockRepository{
+		getUserForUsername: func(username string) (models.User, error) {
 			return models.User{
 				StoredKey:      storedKey,
 				Salt:           salt,
@@ -458,6 +1041,73 @@ func TestLoginUser_Success(t *testing.T) {
 	assert.Equal(t, testServerSignature, loginUserResp.ServerSignature)
 }
 
+func TestLoginUser_StartsSession(t *testing.T) {
+	t.Setenv("JWT_SECRET_KEY", "secret")
+
+	var session models.Session
+	mockRepo := &mockRepository{
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{
+				ID:             userId,
+				StoredKey:      storedKey,
+				ServerKey:      serverKey,
+				Salt:           salt,
+				IterationCount: iterationCount,
+			}, nil
+		},
+		createSession: func(created models.Session) error {
+			session = created
+			return nil
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	loginUserResp, err := currService.LoginUser(dto.LoginUserDTO{
+		Username:    username,
+		CNonce:      cNonce,
+		Nonce:       nonce,
+		ClientProof: clientProof,
+		DeviceLabel: "Firefox on Linux",
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, models.ScramPrincipalUser, session.Principal)
+	assert.Equal(t, userId, *session.UserID)
+	assert.Nil(t, session.ClientID)
+	assert.Equal(t, "Firefox on Linux", session.DeviceLabel)
+	assert.Equal(t, session.CreatedAt.Add(utils.SessionTTL), session.ExpiresAt)
+
+	jti, err := utils.ParseSessionID(loginUserResp.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, session.JTI, jti)
+}
+
+func TestLoginUser_SessionNotCreated(t *testing.T) {
+	mockRepo := &mockRepository{
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{
+				StoredKey:      storedKey,
+				ServerKey:      serverKey,
+				Salt:           salt,
+				IterationCount: iterationCount,
+			}, nil
+		},
+		createSession: func(session models.Session) error {
+			return errors.New("database error")
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	_, err := currService.LoginUser(dto.LoginUserDTO{
+		Username:    username,
+		CNonce:      cNonce,
+		Nonce:       nonce,
+		ClientProof: clientProof,
+	})
+
+	assert.NotNil(t, err)
+}
+
 func TestProfileUser(t *testing.T) {
 	// Create a new mock repository
 	mockRepo := &mockRepository{
@@ -495,6 +1145,31 @@ func TestProfileUser(t *testing.T) {
 	assert.Equal(t, color, userDetails.Color)
 }
 
+func TestProfileUser_ReproveBy(t *testing.T) {
+	reproveBy := time.Now().Add(24 * time.Hour).UTC()
+
+	mockRepo := &mockRepository{
+		profileUser: func(userID uint) (models.User, models.UserMetadata, error) {
+			return models.User{ID: userID, Username: username}, models.UserMetadata{
+				ID:                    userID,
+				IsEmailVerified:       true,
+				IsPhoneNumberVerified: true,
+				EmailReproveBy:        &reproveBy,
+			}, nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	userDetails, err := mockService.ProfileUser(userId)
+
+	assert.Nil(t, err)
+	// the email stays verified until the deadline, the phone number has none
+	assert.True(t, userDetails.EmailVerified)
+	assert.Equal(t, &reproveBy, userDetails.EmailReproveBy)
+	assert.Nil(t, userDetails.PhoneNumberReproveBy)
+}
+
 func TestUpdateUserMetadata(t *testing.T) {
 	mockRepo := &mockRepository{
 		updateUserMetadata: func(userID uint, req dto.UpdateUserMetadataDTO) error {
@@ -549,7 +1224,6 @@ func TestGetClientData(t *testing.T) {
 
 	// Use assert to check if the error is nil
 	assert.Nil(t, err)
-	assert.Equal(t, clientData.Secret, "testsecret")
 	assert.Equal(t, clientData.RedirectURI, "https://gcitizen.com/callback")
 }
 
@@ -981,13 +1655,18 @@ func TestValidateSignature_Success(t *testing.T) {
 }
 
 func TestRegisterUserPrecheck_Success(t *testing.T) {
+	var reservedSalt string
 	mockRepo := &mockRepository{
 		registerUserPrecheck: func(req dto.RegisterUserPrecheckDTO, rmSalt string, iterCount int) error {
 			assert.Equal(t, username, req.Username, "Username should match")
 			assert.NotEmpty(t, rmSalt, "Salt should not be empty")
 			assert.Equal(t, 4096, iterCount, "Iteration count should match")
+			reservedSalt = rmSalt
 			return nil
 		},
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{Username: username, Salt: reservedSalt}, nil
+		},
 	}
 
 	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
@@ -997,10 +1676,10 @@ func TestRegisterUserPrecheck_Success(t *testing.T) {
 	}
 	iterCount := 4096
 
-	salt, err := currService.RegisterUserPrecheck(req, iterCount)
+	returnedSalt, err := currService.RegisterUserPrecheck(req, iterCount)
 
 	assert.Nil(t, err, "Expected no error during RegisterUserPrecheck")
-	assert.NotEmpty(t, salt, "Salt should not be empty in the response")
+	assert.Equal(t, reservedSalt, returnedSalt, "The salt of the reserved username should be returned")
 }
 
 func TestRegisterUserPrecheck_RepositoryError(t *testing.T) {
@@ -1025,12 +1704,17 @@ func TestRegisterUserPrecheck_RepositoryError(t *testing.T) {
 }
 
 func TestRegisterUserPrecheck_InvalidIterationCount(t *testing.T) {
+	var reservedSalt string
 	mockRepo := &mockRepository{
 		registerUserPrecheck: func(req dto.RegisterUserPrecheckDTO, rmSalt string, iterCount int) error {
 			assert.Equal(t, username, req.Username, "Username should match")
 			assert.Equal(t, 0, iterCount, "Iteration count should match")
+			reservedSalt = rmSalt
 			return nil
 		},
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{Username: username, Salt: reservedSalt}, nil
+		},
 	}
 
 	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
@@ -1040,10 +1724,51 @@ func TestRegisterUserPrecheck_InvalidIterationCount(t *testing.T) {
 	}
 	iterCount := 0
 
-	salt, err := currService.RegisterUserPrecheck(req, iterCount)
+	returnedSalt, err := currService.RegisterUserPrecheck(req, iterCount)
 
 	assert.Nil(t, err, "Expected no error during RegisterUserPrecheck")
-	assert.NotEmpty(t, salt, "Salt should not be empty in the response")
+	assert.Equal(t, reservedSalt, returnedSalt, "The salt of the reserved username should be returned")
+}
+
+func TestRegisterUserPrecheck_UsernameReservedByAnotherPrecheck(t *testing.T) {
+	mockRepo := &mockRepository{
+		registerUserPrecheck: func(req dto.RegisterUserPrecheckDTO, rmSalt string, iterCount int) error {
+			return nil
+		},
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{Username: username, Salt: salt}, nil
+		},
+	}
+	currService := service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
+
+	reservedSalt, err := currService.RegisterUserPrecheck(dto.RegisterUserPrecheckDTO{Username: username}, 4096)
+
+	assert.ErrorIs(t, err, constants.ErrUsernameUnavailable)
+	assert.Empty(t, reservedSalt)
+}
+
+func TestRegisterUserPrecheck_UsernameTaken(t *testing.T) {
+	setUpFakeScramParameters(t)
+
+	currService := service.NewService(unknownUsernameRepository(), nil, nil, code.NewMIMCCodeGenerator())
+	unknown, err := currService.LoginPrecheckUser(dto.LoginPrecheckDTO{Username: username, CNonce: cNonce})
+	assert.Nil(t, err)
+
+	mockRepo := &mockRepository{
+		registerUserPrecheck: func(req dto.RegisterUserPrecheckDTO, rmSalt string, iterCount int) error {
+			return nil
+		},
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{Username: username, Salt: salt, StoredKey: storedKey}, nil
+		},
+	}
+	currService = service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
+
+	takenSalt, err := currService.RegisterUserPrecheck(dto.RegisterUserPrecheckDTO{Username: username}, 4096)
+
+	assert.Nil(t, err)
+	assert.NotEqual(t, salt, takenSalt)
+	assert.Equal(t, unknown.Salt, takenSalt)
 }
 
 func TestRegisterUser_RepositoryFailedToStoreUserData(t *testing.T) {
@@ -1094,103 +1819,400 @@ func TestRegisterUser_Success(t *testing.T) {
 	assert.Nil(t, err)
 }
 
-func TestUpdateUserPassword_Success(t *testing.T) {
+func TestResetPasswordPrecheck_IssuesChallenge(t *testing.T) {
+	var challenge models.PasswordResetChallenge
 	mockRepo := &mockRepository{
-		updateUserPassword: func(currUsername, currStoredKey, currServerKey string) error {
-			assert.Equal(t, username, currUsername)
-			assert.Equal(t, storedKey, currStoredKey)
-			assert.Equal(t, serverKey, currServerKey)
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{Username: username, Salt: salt, IterationCount: iterationCount, StoredKey: storedKey}, nil
+		},
+		createResetChallenge: func(c models.PasswordResetChallenge) error {
+			challenge = c
 			return nil
 		},
 	}
 
 	currService := service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
 
-	err := currService.UpdateUserPassword(username, storedKey, serverKey)
-	assert.NoError(t, err, "Expected no error for successful password update")
+	resp, err := currService.ResetPasswordPrecheck(dto.ResetPasswordPrecheckDTO{Username: username})
+
+	assert.Nil(t, err)
+	assert.Equal(t, salt, resp.Salt)
+	assert.Equal(t, iterationCount, resp.IterationCount)
+	assert.Equal(t, username, challenge.Username)
+	assert.NotEmpty(t, challenge.Challenge)
+	assert.Equal(t, challenge.Challenge, resp.Challenge)
+	assert.Equal(t, challenge.Message(), resp.Message)
+	assert.Contains(t, resp.Message, username)
+	assert.Equal(t, 5*time.Minute, challenge.ExpiresAt.Sub(challenge.CreatedAt))
 }
 
-func TestUpdateUserPassword_RepositoryError(t *testing.T) {
+func TestResetPasswordPrecheck_ChallengeNotStored(t *testing.T) {
 	mockRepo := &mockRepository{
-		updateUserPassword: func(currUsername, currStoredKey, currServerKey string) error {
-			assert.Equal(t, username, currUsername)
-			assert.Equal(t, storedKey, currStoredKey)
-			assert.Equal(t, serverKey, currServerKey)
-			return fmt.Errorf("database error")
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{Username: username, Salt: salt, IterationCount: iterationCount, StoredKey: storedKey}, nil
+		},
+		createResetChallenge: func(challenge models.PasswordResetChallenge) error {
+			return errors.New("connection reset")
 		},
 	}
 
 	currService := service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
 
-	err := currService.UpdateUserPassword(username, storedKey, serverKey)
-	assert.Error(t, err, "Expected an error when repository returns an error")
-	assert.Equal(t, "database error", err.Error())
+	resp, err := currService.ResetPasswordPrecheck(dto.ResetPasswordPrecheckDTO{Username: username})
+
+	assert.NotNil(t, err)
+	assert.Empty(t, resp)
 }
 
-func TestLoginPreCheckClient_RepositoryError(t *testing.T) {
-	mockRepo := &mockRepository{
-		profileClient: func(username string) (models.Client, error) {
-			return models.Client{}, errors.New("repository error")
-		},
-	}
-	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+func TestResetPasswordPrecheck_UnknownUsername(t *testing.T) {
+	setUpFakeScramParameters(t)
 
-	req := dto.LoginPrecheckDTO{
-		Username: username,
-		CNonce:   cNonce,
+	var challenge models.PasswordResetChallenge
+	mockRepo := unknownUsernameRepository()
+	mockRepo.createResetChallenge = func(c models.PasswordResetChallenge) error {
+		challenge = c
+		return nil
 	}
 
-	loginClientPrecheckResp, err := currService.LoginPrecheckClient(req)
+	currService := service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
 
-	assert.NotNil(t, err)
-	assert.Equal(t, "repository error", err.Error())
-	assert.Empty(t, loginClientPrecheckResp)
+	resp, err := currService.ResetPasswordPrecheck(dto.ResetPasswordPrecheckDTO{Username: "unknown_user"})
+
+	assert.Nil(t, err)
+	assert.Len(t, resp.Salt, len(salt))
+	assert.Equal(t, 4096, resp.IterationCount)
+	assert.Equal(t, "unknown_user", challenge.Username)
+	assert.Equal(t, challenge.Message(), resp.Message)
 }
 
-func TestLoginPreCheckClient_Success(t *testing.T) {
-	mockRepo := &mockRepository{
-		profileClient: func(username string) (models.Client, error) {
-			return models.Client{
-				Username:       username,
-				Salt:           salt,
-				IterationCount: iterationCount,
-			}, nil
-		},
-	}
+func TestResetPassword_UnknownUsername(t *testing.T) {
+	challenge := models.PasswordResetChallenge{Username: "unknown_user", Challenge: "challenge"}
+	req, _ := newResetPasswordRequest(t, challenge.Message())
+	req.Username = "unknown_user"
 
-	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+	currService := service.NewService(unknownUsernameRepository(), nil, nil, code.NewMIMCCodeGenerator())
 
-	req := dto.LoginPrecheckDTO{
-		Username: username,
-		CNonce:   cNonce,
-	}
+	err := currService.ResetPassword(req)
 
-	loginPrecheckResp, err := currService.LoginPrecheckClient(req)
+	assert.ErrorIs(t, err, constants.ErrInvalidPasswordResetSignature)
+}
 
+func newResetPasswordRequest(t *testing.T, message string) (dto.ResetPasswordDTO, models.User) {
+	privateKey, err := crypto.GenerateKey()
 	assert.Nil(t, err)
-	assert.Equal(t, loginPrecheckResp.Salt, salt)
-	assert.True(t, strings.HasPrefix(loginPrecheckResp.Nonce, cNonce))
-	assert.Equal(t, loginPrecheckResp.IterCount, iterationCount)
-}
 
-func TestLoginClient_RepositoryError(t *testing.T) {
-	mockRepo := &mockRepository{
-		profileClient: func(username string) (models.Client, error) {
-			return models.Client{}, errors.New("repository error")
-		},
-	}
-	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+	signature, err := crypto.Sign(crypto.Keccak256([]byte(message)), privateKey)
+	assert.Nil(t, err)
 
-	req := dto.LoginClientDTO{
-		Username:    username,
-		CNonce:      cNonce,
-		Nonce:       nonce,
-		ClientProof: clientProof,
+	user := models.User{
+		Username:  username,
+		PublicKey: crypto.FromECDSAPub(&privateKey.PublicKey),
 	}
+	req := dto.ResetPasswordDTO{
+		Username:  username,
+		Challenge: "challenge",
+		Signature: signature[:64],
+		StoredKey: storedKey,
+		ServerKey: serverKey,
+	}
+	return req, user
+}
 
-	loginClientResp, err := currService.LoginClient(req)
+func TestResetPassword_Success(t *testing.T) {
+	challenge := models.PasswordResetChallenge{Username: username, Challenge: "challenge"}
+	req, user := newResetPasswordRequest(t, challenge.Message())
 
-	assert.NotNil(t, err)
+	updated := false
+	mockRepo := &mockRepository{
+		consumeResetChallenge: func(currUsername string, currChallenge string, now time.Time) error {
+			assert.Equal(t, username, currUsername)
+			assert.Equal(t, "challenge", currChallenge)
+			return nil
+		},
+		getUserForUsername: func(username string) (models.User, error) {
+			return user, nil
+		},
+		updateUserPassword: func(currUsername, currStoredKey, currServerKey string, revokedAt time.Time) error {
+			updated = true
+			assert.Equal(t, username, currUsername)
+			assert.Equal(t, storedKey, currStoredKey)
+			assert.Equal(t, serverKey, currServerKey)
+			assert.WithinDuration(t, time.Now(), revokedAt, time.Minute)
+			return nil
+		},
+	}
+
+	currService := service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
+
+	err := currService.ResetPassword(req)
+
+	assert.Nil(t, err)
+	assert.True(t, updated)
+}
+
+func TestResetPassword_ChallengeInvalidOrExpired(t *testing.T) {
+	challenge := models.PasswordResetChallenge{Username: username, Challenge: "challenge"}
+	req, user := newResetPasswordRequest(t, challenge.Message())
+
+	mockRepo := &mockRepository{
+		consumeResetChallenge: func(username string, challenge string, now time.Time) error {
+			return gorm.ErrRecordNotFound
+		},
+		getUserForUsername: func(username string) (models.User, error) {
+			return user, nil
+		},
+		updateUserPassword: func(username, storedKey, serverKey string, revokedAt time.Time) error {
+			t.Fatal("the password must not be updated without a valid challenge")
+			return nil
+		},
+	}
+
+	currService := service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
+
+	err := currService.ResetPassword(req)
+
+	assert.ErrorIs(t, err, constants.ErrInvalidPasswordResetChallenge)
+}
+
+func TestResetPassword_SignatureOverFixedMessage(t *testing.T) {
+	req, user := newResetPasswordRequest(t, "Sign-in with Layer8")
+
+	mockRepo := &mockRepository{
+		getUserForUsername: func(username string) (models.User, error) {
+			return user, nil
+		},
+		updateUserPassword: func(username, storedKey, serverKey string, revokedAt time.Time) error {
+			t.Fatal("the password must not be updated without a signature over the challenge")
+			return nil
+		},
+	}
+
+	currService := service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
+
+	err := currService.ResetPassword(req)
+
+	assert.ErrorIs(t, err, constants.ErrInvalidPasswordResetSignature)
+}
+
+func TestResetPassword_RepositoryError(t *testing.T) {
+	challenge := models.PasswordResetChallenge{Username: username, Challenge: "challenge"}
+	req, user := newResetPasswordRequest(t, challenge.Message())
+
+	mockRepo := &mockRepository{
+		getUserForUsername: func(username string) (models.User, error) {
+			return user, nil
+		},
+		updateUserPassword: func(username, storedKey, serverKey string, revokedAt time.Time) error {
+			return fmt.Errorf("database error")
+		},
+	}
+
+	currService := service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
+
+	err := currService.ResetPassword(req)
+
+	assert.Error(t, err, "Expected an error when repository returns an error")
+	assert.Equal(t, "database error", err.Error())
+}
+
+func testSession(jti string) models.Session {
+	now := time.Now()
+	return models.Session{JTI: jti, CreatedAt: now, ExpiresAt: now.Add(utils.SessionTTL)}
+}
+
+func TestValidateUserToken_SessionRevoked(t *testing.T) {
+	t.Setenv("JWT_SECRET_KEY", "secret")
+
+	token, err := utils.GenerateToken(models.User{ID: userId, Username: username}, testSession("session_jti"))
+	assert.Nil(t, err)
+
+	mockRepo := &mockRepository{
+		touchSession: func(jti string, now time.Time) error {
+			assert.Equal(t, "session_jti", jti)
+			return gorm.ErrRecordNotFound
+		},
+	}
+
+	currService := service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
+
+	_, err = currService.ValidateUserToken(token)
+
+	assert.ErrorIs(t, err, constants.ErrSessionRevoked)
+}
+
+func TestValidateUserToken_LiveSession(t *testing.T) {
+	t.Setenv("JWT_SECRET_KEY", "secret")
+
+	token, err := utils.GenerateToken(models.User{ID: userId, Username: username}, testSession("session_jti"))
+	assert.Nil(t, err)
+
+	var touched string
+	mockRepo := &mockRepository{
+		touchSession: func(jti string, now time.Time) error {
+			touched = jti
+			return nil
+		},
+	}
+
+	currService := service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
+
+	id, err := currService.ValidateUserToken(token)
+
+	assert.Nil(t, err)
+	assert.Equal(t, userId, id)
+	assert.Equal(t, "session_jti", touched)
+}
+
+func TestValidateUserToken_NoSession(t *testing.T) {
+	t.Setenv("JWT_SECRET_KEY", "secret")
+
+	// tokens issued before sessions were stored carry no jti
+	token, err := utils.GenerateToken(models.User{ID: userId, Username: username}, testSession(""))
+	assert.Nil(t, err)
+
+	currService := service.NewService(&mockRepository{}, nil, nil, code.NewMIMCCodeGenerator())
+
+	_, err = currService.ValidateUserToken(token)
+
+	assert.ErrorIs(t, err, constants.ErrSessionRevoked)
+}
+
+func TestGetUserSessions_MarksCurrentSession(t *testing.T) {
+	t.Setenv("JWT_SECRET_KEY", "secret")
+
+	token, err := utils.GenerateToken(models.User{ID: userId, Username: username}, testSession("current_jti"))
+	assert.Nil(t, err)
+
+	appClientID := clientId
+	mockRepo := &mockRepository{
+		getUserSessions: func(id uint, now time.Time) ([]models.Session, error) {
+			assert.Equal(t, userId, id)
+			user := id
+			return []models.Session{
+				{ID: 1, JTI: "current_jti", UserID: &user, DeviceLabel: "Firefox on Linux"},
+				{ID: 2, JTI: "other_jti", UserID: &user, ClientID: &appClientID, DeviceLabel: "App"},
+			}, nil
+		},
+	}
+
+	currService := service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
+
+	sessions, err := currService.GetUserSessions(userId, token)
+
+	assert.Nil(t, err)
+	assert.Len(t, sessions, 2)
+	assert.True(t, sessions[0].Current)
+	assert.Equal(t, "", sessions[0].ClientID)
+	assert.False(t, sessions[1].Current)
+	assert.Equal(t, clientId, sessions[1].ClientID)
+}
+
+func TestLogout_RevokesSessionOfToken(t *testing.T) {
+	t.Setenv("JWT_SECRET_KEY", "secret")
+
+	// an expired token can still be logged out
+	session := testSession("session_jti")
+	session.ExpiresAt = time.Now().Add(-time.Minute)
+	token, err := utils.CompleteClientLoginv2(models.Client{ID: clientId, Username: username}, session)
+	assert.Nil(t, err)
+
+	var revoked string
+	mockRepo := &mockRepository{
+		revokeSession: func(jti string, revokedAt time.Time) error {
+			revoked = jti
+			return nil
+		},
+	}
+
+	currService := service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
+
+	err = currService.Logout(token)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "session_jti", revoked)
+}
+
+func TestLogout_InvalidToken(t *testing.T) {
+	t.Setenv("JWT_SECRET_KEY", "secret")
+
+	mockRepo := &mockRepository{
+		revokeSession: func(jti string, revokedAt time.Time) error {
+			t.Fatal("a forged token must not revoke a session")
+			return nil
+		},
+	}
+
+	currService := service.NewService(mockRepo, nil, nil, code.NewMIMCCodeGenerator())
+
+	err := currService.Logout("not.a.token")
+
+	assert.NotNil(t, err)
+}
+
+func TestLoginPreCheckClient_RepositoryError(t *testing.T) {
+	mockRepo := &mockRepository{
+		profileClient: func(username string) (models.Client, error) {
+			return models.Client{}, errors.New("repository error")
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	req := dto.LoginPrecheckDTO{
+		Username: username,
+		CNonce:   cNonce,
+	}
+
+	loginClientPrecheckResp, err := currService.LoginPrecheckClient(req)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "repository error", err.Error())
+	assert.Empty(t, loginClientPrecheckResp)
+}
+
+func TestLoginPreCheckClient_Success(t *testing.T) {
+	mockRepo := &mockRepository{
+		profileClient: func(username string) (models.Client, error) {
+			return models.Client{
+				Username:       username,
+				Salt:           salt,
+				IterationCount: iterationCount,
+			}, nil
+		},
+	}
+
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	req := dto.LoginPrecheckDTO{
+		Username: username,
+		CNonce:   cNonce,
+	}
+
+	loginPrecheckResp, err := currService.LoginPrecheckClient(req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, loginPrecheckResp.Salt, salt)
+	assert.True(t, strings.HasPrefix(loginPrecheckResp.Nonce, cNonce))
+	assert.Equal(t, loginPrecheckResp.IterCount, iterationCount)
+}
+
+func TestLoginClient_RepositoryError(t *testing.T) {
+	mockRepo := &mockRepository{
+		profileClient: func(username string) (models.Client, error) {
+			return models.Client{}, errors.New("repository error")
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	req := dto.LoginClientDTO{
+		Username:    username,
+		CNonce:      cNonce,
+		Nonce:       nonce,
+		ClientProof: clientProof,
+	}
+
+	loginClientResp, err := currService.LoginClient(req)
+
+	assert.NotNil(t, err)
 	assert.Equal(t, "repository error", err.Error())
 	assert.Empty(t, loginClientResp)
 }
@@ -1324,6 +2346,51 @@ func TestLoginClient_DecodingServerKeyError(t *testing.T) {
 	assert.Empty(t, loginClientResp)
 }
 
+func TestLoginPreCheckClient_StartsScramSession(t *testing.T) {
+	var session models.ScramSession
+	mockRepo := &mockRepository{
+		profileClient: func(username string) (models.Client, error) {
+			return models.Client{Username: username, Salt: salt, IterationCount: iterationCount}, nil
+		},
+		createScramSession: func(s models.ScramSession) error {
+			session = s
+			return nil
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	loginPrecheckResp, err := currService.LoginPrecheckClient(dto.LoginPrecheckDTO{Username: username, CNonce: cNonce})
+
+	assert.Nil(t, err)
+	assert.Equal(t, models.ScramPrincipalClient, session.Principal)
+	assert.Equal(t, loginPrecheckResp.Nonce, session.Nonce)
+}
+
+func TestLoginClient_ScramSessionOfUserRejected(t *testing.T) {
+	mockRepo := &mockRepository{
+		consumeScramSession: func(principal string, username string, nonce string, cNonce string, now time.Time) error {
+			if principal != models.ScramPrincipalClient {
+				return nil
+			}
+			return gorm.ErrRecordNotFound
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	req := dto.LoginClientDTO{
+		Username:    username,
+		CNonce:      cNonce,
+		Nonce:       nonce,
+		ClientProof: clientProof,
+	}
+
+	loginClientResp, err := currService.LoginClient(req)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "login session is invalid or expired", err.Error())
+	assert.Empty(t, loginClientResp)
+}
+
 func TestLoginClient_Success(t *testing.T) {
 	mockRepo := &mockRepository{
 		profileClient: func(username string) (models.Client, error) {
@@ -1416,7 +2483,7 @@ func TestRegisterClientPrecheck_InvalidIterationCount(t *testing.T) {
 
 func TestRegisterClient_RepositoryFailedToStoreUserData(t *testing.T) {
 	mockRepo := &mockRepository{
-		registerClient: func(req dto.RegisterClientDTO, id string, secret string) error {
+		registerClient: func(req dto.RegisterClientDTO, id string, secretHash string) error {
 			assert.Equal(t, username, req.Username)
 			assert.Equal(t, clientName, req.Name)
 			assert.Equal(t, redirectUri, req.RedirectURI)
@@ -1429,7 +2496,7 @@ func TestRegisterClient_RepositoryFailedToStoreUserData(t *testing.T) {
 	}
 	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
 
-	err := currService.RegisterClient(
+	_, err := currService.RegisterClient(
 		dto.RegisterClientDTO{
 			Username:    username,
 			Name:        clientName,
@@ -1444,8 +2511,9 @@ func TestRegisterClient_RepositoryFailedToStoreUserData(t *testing.T) {
 }
 
 func TestRegisterClient_Success(t *testing.T) {
+	var storedID, storedSecretHash string
 	mockRepo := &mockRepository{
-		registerClient: func(req dto.RegisterClientDTO, id string, secret string) error {
+		registerClient: func(req dto.RegisterClientDTO, id string, secretHash string) error {
 			assert.Equal(t, username, req.Username)
 			assert.Equal(t, clientName, req.Name)
 			assert.Equal(t, redirectUri, req.RedirectURI)
@@ -1453,12 +2521,14 @@ func TestRegisterClient_Success(t *testing.T) {
 			assert.Equal(t, storedKey, req.StoredKey)
 			assert.Equal(t, serverKey, req.ServerKey)
 
+			storedID = id
+			storedSecretHash = secretHash
 			return nil
 		},
 	}
 	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
 
-	err := currService.RegisterClient(
+	resp, err := currService.RegisterClient(
 		dto.RegisterClientDTO{
 			Username:    username,
 			Name:        clientName,
@@ -1470,4 +2540,1209 @@ func TestRegisterClient_Success(t *testing.T) {
 	)
 
 	assert.Nil(t, err)
+	assert.Equal(t, storedID, resp.ID)
+	assert.NotEmpty(t, resp.Secret)
+	// only the hash of the returned secret is stored
+	assert.NotEqual(t, resp.Secret, storedSecretHash)
+	assert.True(t, serverUtils.CompareClientSecret(storedSecretHash, resp.Secret))
+}
+
+func TestGetConnectedApps_Success(t *testing.T) {
+	grantedAt := time.Now().UTC()
+
+	mockRepo := &mockRepository{
+		getConnectedApps: func(userID uint) ([]models.ConnectedApp, error) {
+			assert.Equal(t, uint(userId), userID)
+			return []models.ConnectedApp{
+				{
+					ClientID:   "client_id",
+					ClientName: "client",
+					Scopes:     "read:user,read:user:color",
+					GrantedAt:  grantedAt,
+				},
+			}, nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	apps, err := mockService.GetConnectedApps(userId)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []models.ConnectedAppResponseOutput{
+		{
+			ClientID:   "client_id",
+			ClientName: "client",
+			Scopes:     []string{"read:user", "read:user:color"},
+			GrantedAt:  grantedAt,
+		},
+	}, apps)
+}
+
+func TestGetConnectedApps_RepositoryError(t *testing.T) {
+	mockRepo := &mockRepository{
+		getConnectedApps: func(userID uint) ([]models.ConnectedApp, error) {
+			return nil, errors.New("repository error")
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	_, err := mockService.GetConnectedApps(userId)
+
+	assert.NotNil(t, err)
+}
+
+func TestRevokeConnectedApp(t *testing.T) {
+	mockRepo := &mockRepository{
+		deleteUserConsent: func(userID uint, clientID string, revokedAt time.Time) error {
+			assert.Equal(t, uint(userId), userID)
+			assert.Equal(t, "client_id", clientID)
+			assert.False(t, revokedAt.IsZero())
+			return nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	err := mockService.RevokeConnectedApp(userId, "client_id")
+
+	assert.Nil(t, err)
+}
+
+func TestGetDataAccessTimeline(t *testing.T) {
+	since := timestamp.Add(-time.Hour)
+
+	mockRepo := &mockRepository{
+		getDataAccessRecords: func(userID uint, clientID string, from time.Time, until time.Time) ([]models.DataAccessRecord, error) {
+			assert.Equal(t, uint(userId), userID)
+			assert.Equal(t, "client_id", clientID)
+			assert.Equal(t, since, from)
+			assert.True(t, until.IsZero())
+			return []models.DataAccessRecord{
+				{
+					ClientID:   "client_id",
+					ClientName: "client",
+					Scopes:     "read:user,read:user:color",
+					Fields:     "display_name,color",
+					AccessedAt: timestamp,
+				},
+				{
+					ClientID:   "client_id",
+					Scopes:     "read:user:is_email_verified",
+					AccessedAt: since,
+				},
+			}, nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	timeline, err := mockService.GetDataAccessTimeline(userId, "client_id", since, time.Time{})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []models.DataAccessResponseOutput{
+		{
+			ClientID:   "client_id",
+			ClientName: "client",
+			Scopes:     []string{"read:user", "read:user:color"},
+			Fields:     []string{"display_name", "color"},
+			AccessedAt: timestamp,
+		},
+		{
+			ClientID:   "client_id",
+			Scopes:     []string{"read:user:is_email_verified"},
+			Fields:     []string{},
+			AccessedAt: since,
+		},
+	}, timeline)
+}
+
+func TestGetDataAccessDigest_NotSubscribed(t *testing.T) {
+	mockService := service.NewService(&mockRepository{}, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	digest, err := mockService.GetDataAccessDigest(userId)
+
+	assert.Nil(t, err)
+	assert.False(t, digest.Enabled)
+}
+
+func TestSubscribeDataAccessDigest_VerifiedEmail(t *testing.T) {
+	codeGenerator := code.NewMIMCCodeGenerator()
+	user := models.User{ID: userId, Username: username, Salt: salt}
+	emailVerificationCode, err := codeGenerator.GenerateCode(&user, "user@example.com")
+	assert.Nil(t, err)
+	user.EmailVerificationCode = emailVerificationCode
+
+	var saved models.DataAccessDigest
+	mockRepo := &mockRepository{
+		findUser: func(userID uint) (models.User, error) {
+			return user, nil
+		},
+		saveDataAccessDigest: func(digest models.DataAccessDigest) error {
+			saved = digest
+			return nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, codeGenerator)
+
+	err = mockService.SubscribeDataAccessDigest(userId, "user@EXAMPLE.com")
+
+	assert.Nil(t, err)
+	assert.Equal(t, uint(userId), saved.UserID)
+	assert.Equal(t, "user@example.com", saved.Email)
+}
+
+func TestSubscribeDataAccessDigest_UnverifiedEmail(t *testing.T) {
+	codeGenerator := code.NewMIMCCodeGenerator()
+	user := models.User{ID: userId, Username: username, Salt: salt}
+	emailVerificationCode, err := codeGenerator.GenerateCode(&user, "user@example.com")
+	assert.Nil(t, err)
+	user.EmailVerificationCode = emailVerificationCode
+
+	mockRepo := &mockRepository{
+		findUser: func(userID uint) (models.User, error) {
+			return user, nil
+		},
+		saveDataAccessDigest: func(digest models.DataAccessDigest) error {
+			t.Fatal("the digest must not be saved")
+			return nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, codeGenerator)
+
+	err = mockService.SubscribeDataAccessDigest(userId, "someone@example.com")
+
+	assert.ErrorIs(t, err, constants.ErrDigestEmailNotVerified)
+}
+
+func TestSubscribeDataAccessDigest_NoVerifiedEmail(t *testing.T) {
+	mockRepo := &mockRepository{
+		findUser: func(userID uint) (models.User, error) {
+			return models.User{ID: userId, Username: username, Salt: salt}, nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	err := mockService.SubscribeDataAccessDigest(userId, "user@example.com")
+
+	assert.ErrorIs(t, err, constants.ErrDigestEmailNotVerified)
+}
+
+func TestGetClientRedirectURIs(t *testing.T) {
+	mockRepo := &mockRepository{
+		getClientRedirectURIs: func(clientID string) ([]models.ClientRedirectURI, error) {
+			assert.Equal(t, "client_id", clientID)
+			return []models.ClientRedirectURI{
+				{ClientID: clientID, RedirectURI: "https://client.com/callback"},
+				{ClientID: clientID, RedirectURI: "http://localhost/callback"},
+			}, nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	redirectURIs, err := mockService.GetClientRedirectURIs("client_id")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"https://client.com/callback", "http://localhost/callback"}, redirectURIs)
+}
+
+func TestAddClientRedirectURI_InvalidRedirectURI(t *testing.T) {
+	mockRepo := &mockRepository{
+		addClientRedirectURI: func(clientID string, redirectURI string) error {
+			t.Fatal("the repository must not be called with an invalid redirect uri")
+			return nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	err := mockService.AddClientRedirectURI("client_id", "http://client.com/callback")
+
+	assert.NotNil(t, err)
+}
+
+func TestAddClientRedirectURI_Success(t *testing.T) {
+	mockRepo := &mockRepository{
+		addClientRedirectURI: func(clientID string, redirectURI string) error {
+			assert.Equal(t, "client_id", clientID)
+			assert.Equal(t, "https://client.com/callback", redirectURI)
+			return nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	err := mockService.AddClientRedirectURI("client_id", "https://client.com/callback")
+
+	assert.Nil(t, err)
+}
+
+func TestRotateClientSecret_InvalidOverlap(t *testing.T) {
+	os.Setenv("CLIENT_SECRET_ROTATION_OVERLAP", "one day")
+	defer os.Unsetenv("CLIENT_SECRET_ROTATION_OVERLAP")
+
+	mockRepo := &mockRepository{
+		rotateClientSecret: func(clientID string, secretHash string, previousExpiresAt time.Time) error {
+			t.Fatal("the repository must not be called with an invalid overlap")
+			return nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	_, err := mockService.RotateClientSecret("client_id")
+
+	assert.NotNil(t, err)
+}
+
+func TestRotateClientSecret_Success(t *testing.T) {
+	os.Setenv("CLIENT_SECRET_ROTATION_OVERLAP", "1h")
+	defer os.Unsetenv("CLIENT_SECRET_ROTATION_OVERLAP")
+
+	var storedHash string
+	var storedExpiresAt time.Time
+	mockRepo := &mockRepository{
+		rotateClientSecret: func(clientID string, secretHash string, previousExpiresAt time.Time) error {
+			assert.Equal(t, "client_id", clientID)
+			storedHash = secretHash
+			storedExpiresAt = previousExpiresAt
+			return nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	rotated, err := mockService.RotateClientSecret("client_id")
+
+	assert.Nil(t, err)
+	assert.NotEqual(t, rotated.Secret, storedHash)
+	assert.True(t, serverUtils.CompareClientSecret(storedHash, rotated.Secret))
+	assert.Equal(t, storedExpiresAt, rotated.PreviousSecretExpiresAt)
+	assert.WithinDuration(t, time.Now().UTC().Add(time.Hour), rotated.PreviousSecretExpiresAt, time.Minute)
+}
+
+const clientRedirectURI = "https://client.com/callback"
+
+func TestRegisterDynamicClient_RedirectURIsRequiredForAuthorizationCode(t *testing.T) {
+	mockRepo := &mockRepository{}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	_, err := mockService.RegisterDynamicClient(dto.ClientRegistrationDTO{
+		ClientName: clientName,
+		BackendURI: backendUri,
+	})
+
+	assert.NotNil(t, err)
+}
+
+func TestRegisterDynamicClient_BackendURIAlreadyRegistered(t *testing.T) {
+	mockRepo := &mockRepository{
+		isBackendURIExists: func(backendURL string) (bool, error) {
+			return true, nil
+		},
+		registerDynamicClient: func(client models.Client, redirectURIs []string, ratePerByte int) error {
+			t.Fatal("the client must not be created")
+			return nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	_, err := mockService.RegisterDynamicClient(dto.ClientRegistrationDTO{
+		RedirectURIs: []string{clientRedirectURI},
+		ClientName:   clientName,
+		BackendURI:   backendUri,
+	})
+
+	assert.NotNil(t, err)
+}
+
+func TestRegisterDynamicClient_Success(t *testing.T) {
+	os.Setenv("CLIENT_TRAFFIC_RATE_PER_BYTE", "5")
+	defer os.Unsetenv("CLIENT_TRAFFIC_RATE_PER_BYTE")
+	os.Setenv("PROXY_URL", "https://layer8.com")
+	defer os.Unsetenv("PROXY_URL")
+
+	var created models.Client
+	mockRepo := &mockRepository{
+		isBackendURIExists: func(backendURL string) (bool, error) {
+			assert.Equal(t, "client.com", backendURL)
+			return false, nil
+		},
+		registerDynamicClient: func(client models.Client, redirectURIs []string, ratePerByte int) error {
+			created = client
+			assert.Equal(t, []string{clientRedirectURI, "http://localhost/callback"}, redirectURIs)
+			assert.Equal(t, 5, ratePerByte)
+			return nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	registered, err := mockService.RegisterDynamicClient(dto.ClientRegistrationDTO{
+		RedirectURIs: []string{clientRedirectURI, "http://localhost/callback", clientRedirectURI},
+		ClientName:   clientName,
+		BackendURI:   "https://client.com",
+		Contacts:     []string{"admin@client.com"},
+		GrantTypes:   []string{"client_credentials", "authorization_code"},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, created.ID, registered.ClientID)
+	assert.Equal(t, created.ID, created.Username)
+	assert.Equal(t, clientRedirectURI, created.RedirectURI)
+	assert.Equal(t, "authorization_code,client_credentials", created.GrantTypes)
+	assert.True(t, serverUtils.CompareClientSecret(created.SecretHash, registered.ClientSecret))
+	assert.NotEmpty(t, registered.RegistrationAccessToken)
+	assert.NotEqual(t, registered.RegistrationAccessToken, created.RegistrationAccessTokenHash)
+	assert.Equal(t, "https://layer8.com/api/v1/register/"+created.ID, registered.RegistrationClientURI)
+	assert.Equal(t, []string{"admin@client.com"}, registered.Contacts)
+	assert.Equal(t, []string{"authorization_code", "client_credentials"}, registered.GrantTypes)
+
+	// the registration access token is what authenticates later management calls
+	mockRepo.getClientByID = func(clientID string) (models.Client, error) {
+		return created, nil
+	}
+	mockRepo.getClientRedirectURIs = func(clientID string) ([]models.ClientRedirectURI, error) {
+		return []models.ClientRedirectURI{{ClientID: clientID, RedirectURI: clientRedirectURI}}, nil
+	}
+
+	fetched, err := mockService.GetRegisteredClient(created.ID, registered.RegistrationAccessToken)
+	assert.Nil(t, err)
+	assert.Equal(t, clientName, fetched.ClientName)
+	assert.Empty(t, fetched.ClientSecret)
+	assert.Empty(t, fetched.RegistrationAccessToken)
+}
+
+func TestGetRegisteredClient_InvalidRegistrationAccessToken(t *testing.T) {
+	mockRepo := &mockRepository{
+		getClientByID: func(clientID string) (models.Client, error) {
+			return models.Client{ID: clientID, RegistrationAccessTokenHash: "some_hash"}, nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	_, err := mockService.GetRegisteredClient("client_id", "wrong_token")
+
+	assert.ErrorIs(t, err, constants.ErrInvalidRegistrationAccessToken)
+}
+
+func TestDeleteRegisteredClient_PortalClientCannotBeManaged(t *testing.T) {
+	mockRepo := &mockRepository{
+		getClientByID: func(clientID string) (models.Client, error) {
+			return models.Client{ID: clientID}, nil
+		},
+		deleteRegisteredClient: func(clientID string) error {
+			t.Fatal("a portal client must not be deleted")
+			return nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	err := mockService.DeleteRegisteredClient("client_id", "")
+
+	assert.ErrorIs(t, err, constants.ErrInvalidRegistrationAccessToken)
+}
+
+func TestUpdateRegisteredClient_Success(t *testing.T) {
+	registrationAccessToken := "registration_access_token"
+	tokenHash := sha256.Sum256([]byte(registrationAccessToken))
+
+	mockRepo := &mockRepository{
+		getClientByID: func(clientID string) (models.Client, error) {
+			return models.Client{
+				ID:                          clientID,
+				BackendURI:                  "client.com",
+				RegistrationAccessTokenHash: hex.EncodeToString(tokenHash[:]),
+			}, nil
+		},
+		isBackendURIExists: func(backendURL string) (bool, error) {
+			t.Fatal("an unchanged backend uri must not be checked")
+			return false, nil
+		},
+		updateRegisteredClient: func(client models.Client, redirectURIs []string) error {
+			assert.Equal(t, "client_id", client.ID)
+			assert.Equal(t, "new name", client.Name)
+			assert.Equal(t, []string{clientRedirectURI}, redirectURIs)
+			return nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	updated, err := mockService.UpdateRegisteredClient("client_id", registrationAccessToken, dto.ClientRegistrationDTO{
+		RedirectURIs: []string{clientRedirectURI},
+		ClientName:   "new name",
+		BackendURI:   "https://client.com",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "new name", updated.ClientName)
+}
+
+func setCredentialIssuerSigningKey(t *testing.T) {
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CREDENTIAL_ISSUER_SIGNING_KEY", base64.StdEncoding.EncodeToString(seed))
+	t.Cleanup(func() { os.Unsetenv("CREDENTIAL_ISSUER_SIGNING_KEY") })
+}
+
+func newHolderKey(t *testing.T) (ed25519.PrivateKey, dto.VerifiedAttributesCredentialDTO) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, dto.VerifiedAttributesCredentialDTO{HolderKey: sdjwt.NewJWK(pub)}
+}
+
+func TestIssueVerifiedAttributesCredential_SigningKeyNotConfigured(t *testing.T) {
+	os.Unsetenv("CREDENTIAL_ISSUER_SIGNING_KEY")
+
+	mockService := service.NewService(&mockRepository{}, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	_, req := newHolderKey(t)
+	_, err := mockService.IssueVerifiedAttributesCredential(userId, req)
+
+	assert.NotNil(t, err)
+}
+
+func TestIssueVerifiedAttributesCredential_InvalidHolderKey(t *testing.T) {
+	setCredentialIssuerSigningKey(t)
+
+	mockService := service.NewService(&mockRepository{}, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	_, err := mockService.IssueVerifiedAttributesCredential(userId, dto.VerifiedAttributesCredentialDTO{
+		HolderKey: sdjwt.JWK{KeyType: "EC", Curve: "P-256", X: "x"},
+	})
+
+	assert.NotNil(t, err)
+}
+
+func TestIssueVerifiedAttributesCredential_NoVerifiedAttributes(t *testing.T) {
+	setCredentialIssuerSigningKey(t)
+
+	mockRepo := &mockRepository{
+		profileUser: func(userID uint) (models.User, models.UserMetadata, error) {
+			return models.User{ID: userID}, models.UserMetadata{}, nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	_, req := newHolderKey(t)
+	_, err := mockService.IssueVerifiedAttributesCredential(userId, req)
+
+	assert.NotNil(t, err)
+}
+
+func TestIssueVerifiedAttributesCredential_VerifiableWithPublishedKeys(t *testing.T) {
+	setCredentialIssuerSigningKey(t)
+	os.Setenv("PROXY_URL", "https://layer8.example")
+	defer os.Unsetenv("PROXY_URL")
+
+	mockRepo := &mockRepository{
+		profileUser: func(userID uint) (models.User, models.UserMetadata, error) {
+			return models.User{
+					ID:                          userID,
+					Salt:                        "salt",
+					EmailVerificationCode:       "724b2c",
+					EmailZkProof:                []byte("email_proof"),
+					EmailZkKeyPairId:            3,
+					PhoneNumberVerificationCode: "a1b2c3",
+					PhoneNumberZkPairID:         4,
+				}, models.UserMetadata{
+					IsEmailVerified:       true,
+					IsPhoneNumberVerified: true,
+				}, nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	holderKey, req := newHolderKey(t)
+	credential, err := mockService.IssueVerifiedAttributesCredential(userId, req)
+	assert.Nil(t, err)
+	assert.True(t, credential.ExpiresAt.After(time.Now()))
+
+	metadata, err := mockService.GetCredentialIssuerMetadata()
+	assert.Nil(t, err)
+	assert.Equal(t, "https://layer8.example", metadata.Issuer)
+
+	presentation, err := sdjwt.Present(credential.Credential, "email_verified", "email_verified_key_id")
+	assert.Nil(t, err)
+
+	// without the holder key a presentation is not accepted
+	_, err = sdjwt.Verify(presentation, metadata.JWKS, "https://sp.example", "nonce")
+	assert.NotNil(t, err)
+
+	presentation, err = sdjwt.Bind(presentation, holderKey, "https://sp.example", "nonce")
+	assert.Nil(t, err)
+
+	claims, err := sdjwt.Verify(presentation, metadata.JWKS, "https://sp.example", "nonce")
+	assert.Nil(t, err)
+
+	assert.Equal(t, "https://layer8.example", claims["iss"])
+	assert.NotContains(t, claims, "sub")
+	assert.NotContains(t, claims, "phone_number_verified")
+	assert.NotContains(t, claims, "phone_number_verified_key_id")
+	assert.Equal(t, true, claims["email_verified"])
+	// the key ID matches the proof to one of the published verifying keys
+	assert.Equal(t, float64(3), claims["email_verified_key_id"])
+}
+
+func TestGetZkVerifyingKeys_Success(t *testing.T) {
+	transcriptHash := "transcript hash"
+	mockRepo := &mockRepository{
+		getZkSnarksVerifyingKeys: func() ([]models.ZkSnarksKeyPair, error) {
+			return []models.ZkSnarksKeyPair{
+				{ID: 1, Circuit: models.ZkCircuitVerificationCode, VerifyingKey: []byte("first")},
+				{ID: 2, Circuit: models.ZkCircuitEmailDomain, VerifyingKey: []byte("second"), TranscriptHash: &transcriptHash},
+			}, nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	verifyingKeys, err := mockService.GetZkVerifyingKeys()
+
+	assert.Nil(t, err)
+	assert.Equal(t, []zkverify.VerifyingKey{
+		{ID: 1, Curve: zkverify.Curve, Circuit: models.ZkCircuitVerificationCode, VerifyingKey: []byte("first")},
+		{
+			ID:             2,
+			Curve:          zkverify.Curve,
+			Circuit:        models.ZkCircuitEmailDomain,
+			VerifyingKey:   []byte("second"),
+			TranscriptHash: &transcriptHash,
+		},
+	}, verifyingKeys)
+}
+
+func TestVerifyZkProof_UnknownKeyPair(t *testing.T) {
+	proofProcessor := &mocks.MockProofGenerator{
+		VerifyProofFunc: func(
+			zkKeyPairID uint, verificationCode string, salt string, domainCommitment string, proofBytes []byte,
+		) error {
+			assert.Equal(t, uint(7), zkKeyPairID)
+			return zk.ErrUnknownZkKeyPair
+		},
+	}
+
+	mockService := service.NewService(&mockRepository{}, &verification.EmailVerifier{}, proofProcessor, code.NewMIMCCodeGenerator())
+
+	_, err := mockService.VerifyZkProof(dto.VerifyZkProofDTO{
+		ZkKeyPairID:      7,
+		ZkProof:          []byte("proof"),
+		Salt:             "salt",
+		VerificationCode: "724b2c",
+	})
+
+	assert.True(t, errors.Is(err, zk.ErrUnknownZkKeyPair))
+}
+
+func TestVerifyZkProof_InvalidProof(t *testing.T) {
+	proofProcessor := &mocks.MockProofGenerator{
+		VerifyProofFunc: func(
+			zkKeyPairID uint, verificationCode string, salt string, domainCommitment string, proofBytes []byte,
+		) error {
+			return fmt.Errorf("could not verify proof")
+		},
+	}
+
+	mockService := service.NewService(&mockRepository{}, &verification.EmailVerifier{}, proofProcessor, code.NewMIMCCodeGenerator())
+
+	result, err := mockService.VerifyZkProof(dto.VerifyZkProofDTO{
+		ZkKeyPairID:      1,
+		ZkProof:          []byte("not a proof"),
+		Salt:             "salt",
+		VerificationCode: "724b2c",
+	})
+
+	assert.Nil(t, err)
+	assert.False(t, result.Valid)
+}
+
+func TestVerifyZkProof_ValidProof(t *testing.T) {
+	proofProcessor := &mocks.MockProofGenerator{
+		VerifyProofFunc: func(
+			zkKeyPairID uint, verificationCode string, salt string, domainCommitment string, proofBytes []byte,
+		) error {
+			assert.Equal(t, "724b2c", verificationCode)
+			assert.Equal(t, "salt", salt)
+			assert.Equal(t, []byte("proof"), proofBytes)
+			return nil
+		},
+	}
+
+	mockService := service.NewService(&mockRepository{}, &verification.EmailVerifier{}, proofProcessor, code.NewMIMCCodeGenerator())
+
+	result, err := mockService.VerifyZkProof(dto.VerifyZkProofDTO{
+		ZkKeyPairID:      1,
+		ZkProof:          []byte("proof"),
+		Salt:             "salt",
+		VerificationCode: "724b2c",
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, result.Valid)
+}
+
+func TestEnqueueZkProofJob_Success(t *testing.T) {
+	mockRepo := &mockRepository{
+		createZkProofJob: func(job models.ZkProofJob) (uint, error) {
+			assert.Equal(t, userId, job.UserID)
+			assert.Equal(t, models.ZkProofJobEmail, job.Attribute)
+			assert.Equal(t, userEmail, job.Input)
+			assert.Equal(t, "724b2c", job.VerificationCode)
+			assert.Equal(t, models.ZkProofJobPending, job.Status)
+			return 5, nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	job, err := mockService.EnqueueZkProofJob(userId, models.ZkProofJobEmail, userEmail, "724b2c")
+
+	assert.Nil(t, err)
+	assert.Equal(t, uint(5), job.ID)
+	assert.Equal(t, models.ZkProofJobPending, job.Status)
+	assert.False(t, job.CreatedAt.IsZero())
+}
+
+func TestEnqueueZkProofJob_EmailDomainLowercased(t *testing.T) {
+	mockRepo := &mockRepository{
+		createZkProofJob: func(job models.ZkProofJob) (uint, error) {
+			assert.Equal(t, "First.Last@mit.edu", job.Input)
+			return 5, nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	_, err := mockService.EnqueueZkProofJob(userId, models.ZkProofJobEmail, "First.Last@MIT.edu", "724b2c")
+
+	assert.Nil(t, err)
+}
+
+func TestWaitForZkProofJob_ReturnsFinishedJob(t *testing.T) {
+	calls := 0
+	mockRepo := &mockRepository{
+		getZkProofJob: func(id uint, userID uint) (models.ZkProofJob, error) {
+			calls++
+			status := models.ZkProofJobRunning
+			if calls == 2 {
+				status = models.ZkProofJobDone
+			}
+			return models.ZkProofJob{ID: id, UserID: userID, Status: status}, nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	job, err := mockService.WaitForZkProofJob(context.Background(), userId, 5)
+
+	assert.Nil(t, err)
+	assert.Equal(t, models.ZkProofJobDone, job.Status)
+	assert.Equal(t, 2, calls)
+}
+
+func TestWaitForZkProofJob_ReturnsCurrentStateWhenContextIsDone(t *testing.T) {
+	mockRepo := &mockRepository{
+		getZkProofJob: func(id uint, userID uint) (models.ZkProofJob, error) {
+			return models.ZkProofJob{ID: id, UserID: userID, Status: models.ZkProofJobPending}, nil
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	job, err := mockService.WaitForZkProofJob(ctx, userId, 5)
+
+	assert.Nil(t, err)
+	assert.Equal(t, models.ZkProofJobPending, job.Status)
+}
+
+func TestWaitForZkProofJob_JobNotFound(t *testing.T) {
+	mockRepo := &mockRepository{
+		getZkProofJob: func(id uint, userID uint) (models.ZkProofJob, error) {
+			return models.ZkProofJob{}, fmt.Errorf("record not found")
+		},
+	}
+
+	mockService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	_, err := mockService.WaitForZkProofJob(context.Background(), userId, 5)
+
+	assert.NotNil(t, err)
+}
+
+// twoFactorKey configures the key the shared secrets are encrypted under.
+func twoFactorKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	t.Setenv("TOTP_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+	t.Setenv("JWT_SECRET_KEY", "jwt_secret")
+	return key
+}
+
+func confirmedTwoFactorCredential(t *testing.T, principal string, secret string) models.TwoFactorCredential {
+	encryptedSecret, err := totp.EncryptSecret(twoFactorKey(t), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	confirmedAt := timestamp
+	return models.TwoFactorCredential{
+		ID:              3,
+		Principal:       principal,
+		Username:        username,
+		EncryptedSecret: encryptedSecret,
+		ConfirmedAt:     &confirmedAt,
+	}
+}
+
+func TestLoginUser_TwoFactorRequired(t *testing.T) {
+	credential := confirmedTwoFactorCredential(t, models.ScramPrincipalUser, "JBSWY3DPEHPK3PXP")
+
+	mockRepo := &mockRepository{
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{
+				Username:       username,
+				StoredKey:      storedKey,
+				ServerKey:      serverKey,
+				Salt:           salt,
+				IterationCount: iterationCount,
+			}, nil
+		},
+		getTwoFactorCredential: func(principal string, username string) (models.TwoFactorCredential, error) {
+			return credential, nil
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	loginUserResp, err := currService.LoginUser(dto.LoginUserDTO{
+		Username:    username,
+		CNonce:      cNonce,
+		Nonce:       nonce,
+		ClientProof: clientProof,
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, testServerSignature, loginUserResp.ServerSignature)
+	assert.True(t, loginUserResp.TwoFactorRequired)
+	assert.Empty(t, loginUserResp.Token)
+
+	claims, err := utils.ParseTwoFactorToken(loginUserResp.TwoFactorToken)
+	assert.Nil(t, err)
+	assert.Equal(t, models.ScramPrincipalUser, claims.Principal)
+	assert.Equal(t, username, claims.Subject)
+
+	// the pending login is not a user portal token
+	_, err = utils.ParseUserToken(loginUserResp.TwoFactorToken)
+	assert.NotNil(t, err)
+}
+
+func TestLoginTwoFactor_Success(t *testing.T) {
+	secret := "JBSWY3DPEHPK3PXP"
+	credential := confirmedTwoFactorCredential(t, models.ScramPrincipalUser, secret)
+
+	var usedStep int64
+	mockRepo := &mockRepository{
+		getTwoFactorCredential: func(principal string, username string) (models.TwoFactorCredential, error) {
+			return credential, nil
+		},
+		useTwoFactorStep: func(credentialID uint, step int64) error {
+			usedStep = step
+			return nil
+		},
+		getUserForUsername: func(username string) (models.User, error) {
+			return models.User{ID: userId, Username: username}, nil
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	twoFactorToken, err := utils.GenerateTwoFactorToken(models.ScramPrincipalUser, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step := totp.Step(time.Now())
+	totpCode, err := totp.Code(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := currService.LoginTwoFactor(dto.LoginTwoFactorDTO{TwoFactorToken: twoFactorToken, Code: totpCode})
+
+	assert.Nil(t, err)
+	assert.Equal(t, step, usedStep)
+
+	claims, err := utils.ParseUserToken(resp.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, userId, claims.UserID)
+}
+
+func TestLoginTwoFactor_ClientRecoveryCode(t *testing.T) {
+	credential := confirmedTwoFactorCredential(t, models.ScramPrincipalClient, "JBSWY3DPEHPK3PXP")
+	recoveryCode := "0123-4567-89ab-cdef"
+
+	mockRepo := &mockRepository{
+		getTwoFactorCredential: func(principal string, username string) (models.TwoFactorCredential, error) {
+			assert.Equal(t, models.ScramPrincipalClient, principal)
+			return credential, nil
+		},
+		useTwoFactorRecoveryCode: func(credentialID uint, codeHash string, usedAt time.Time) error {
+			if codeHash != totp.HashRecoveryCode(recoveryCode) {
+				return gorm.ErrRecordNotFound
+			}
+			return nil
+		},
+		profileClient: func(username string) (models.Client, error) {
+			return models.Client{ID: clientId, Username: username}, nil
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	twoFactorToken, err := utils.GenerateTwoFactorToken(models.ScramPrincipalClient, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = currService.LoginTwoFactor(dto.LoginTwoFactorDTO{TwoFactorToken: twoFactorToken, Code: "0000-0000-0000-0000"})
+	assert.ErrorIs(t, err, constants.ErrInvalidTwoFactorCode)
+
+	resp, err := currService.LoginTwoFactor(dto.LoginTwoFactorDTO{TwoFactorToken: twoFactorToken, Code: recoveryCode})
+	assert.Nil(t, err)
+
+	claims, err := utils.ValidateClientToken(mockRepo, resp.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, clientId, claims.ClientID)
+}
+
+func TestLoginTwoFactor_InvalidToken(t *testing.T) {
+	twoFactorKey(t)
+
+	userToken, err := utils.GenerateToken(models.User{ID: userId, Username: username}, testSession("session_jti"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currService := service.NewService(&mockRepository{}, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	_, err = currService.LoginTwoFactor(dto.LoginTwoFactorDTO{TwoFactorToken: userToken, Code: "123456"})
+
+	assert.ErrorIs(t, err, constants.ErrInvalidTwoFactorToken)
+}
+
+func TestStartTwoFactorEnrollment_Success(t *testing.T) {
+	key := twoFactorKey(t)
+
+	var saved models.TwoFactorCredential
+	mockRepo := &mockRepository{
+		saveTwoFactorCredential: func(credential models.TwoFactorCredential) error {
+			saved = credential
+			return nil
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	enrollment, err := currService.StartTwoFactorEnrollment(models.ScramPrincipalUser, username)
+
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(enrollment.ProvisioningURI, "otpauth://totp/Layer8:test_user?"))
+	assert.Contains(t, enrollment.ProvisioningURI, "secret="+enrollment.Secret)
+
+	assert.Equal(t, models.ScramPrincipalUser, saved.Principal)
+	assert.Equal(t, username, saved.Username)
+	assert.Nil(t, saved.ConfirmedAt)
+
+	secret, err := totp.DecryptSecret(key, saved.EncryptedSecret)
+	assert.Nil(t, err)
+	assert.Equal(t, enrollment.Secret, secret)
+}
+
+func TestStartTwoFactorEnrollment_AlreadyEnabled(t *testing.T) {
+	twoFactorKey(t)
+
+	mockRepo := &mockRepository{
+		saveTwoFactorCredential: func(credential models.TwoFactorCredential) error {
+			return constants.ErrTwoFactorAlreadyEnabled
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	_, err := currService.StartTwoFactorEnrollment(models.ScramPrincipalUser, username)
+
+	assert.ErrorIs(t, err, constants.ErrTwoFactorAlreadyEnabled)
+}
+
+func TestConfirmTwoFactorEnrollment_Success(t *testing.T) {
+	secret := "JBSWY3DPEHPK3PXP"
+	credential := confirmedTwoFactorCredential(t, models.ScramPrincipalUser, secret)
+	credential.ConfirmedAt = nil
+
+	var confirmedStep int64
+	var codeHashes []string
+	mockRepo := &mockRepository{
+		getTwoFactorCredential: func(principal string, username string) (models.TwoFactorCredential, error) {
+			return credential, nil
+		},
+		confirmTwoFactorCredential: func(id uint, step int64, confirmedAt time.Time, hashes []string) error {
+			confirmedStep = step
+			codeHashes = hashes
+			return nil
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	step := totp.Step(time.Now())
+	totpCode, err := totp.Code(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := currService.ConfirmTwoFactorEnrollment(models.ScramPrincipalUser, username, totpCode)
+
+	assert.Nil(t, err)
+	assert.Equal(t, step, confirmedStep)
+	assert.Len(t, resp.RecoveryCodes, 10)
+	assert.Len(t, codeHashes, 10)
+	assert.Equal(t, totp.HashRecoveryCode(resp.RecoveryCodes[0]), codeHashes[0])
+}
+
+func TestConfirmTwoFactorEnrollment_InvalidCode(t *testing.T) {
+	secret := "JBSWY3DPEHPK3PXP"
+	credential := confirmedTwoFactorCredential(t, models.ScramPrincipalUser, secret)
+	credential.ConfirmedAt = nil
+
+	mockRepo := &mockRepository{
+		getTwoFactorCredential: func(principal string, username string) (models.TwoFactorCredential, error) {
+			return credential, nil
+		},
+		confirmTwoFactorCredential: func(id uint, step int64, confirmedAt time.Time, hashes []string) error {
+			t.Fatal("an enrollment must not be confirmed with an invalid code")
+			return nil
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	totpCode, err := totp.Code(secret, totp.Step(time.Now())+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = currService.ConfirmTwoFactorEnrollment(models.ScramPrincipalUser, username, totpCode)
+
+	assert.ErrorIs(t, err, constants.ErrInvalidTwoFactorCode)
+}
+
+func TestConfirmTwoFactorEnrollment_AlreadyEnabled(t *testing.T) {
+	credential := confirmedTwoFactorCredential(t, models.ScramPrincipalUser, "JBSWY3DPEHPK3PXP")
+
+	mockRepo := &mockRepository{
+		getTwoFactorCredential: func(principal string, username string) (models.TwoFactorCredential, error) {
+			return credential, nil
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	_, err := currService.ConfirmTwoFactorEnrollment(models.ScramPrincipalUser, username, "123456")
+
+	assert.ErrorIs(t, err, constants.ErrTwoFactorAlreadyEnabled)
+}
+
+func TestDisableTwoFactor_InvalidCode(t *testing.T) {
+	secret := "JBSWY3DPEHPK3PXP"
+	credential := confirmedTwoFactorCredential(t, models.ScramPrincipalUser, secret)
+
+	mockRepo := &mockRepository{
+		getTwoFactorCredential: func(principal string, username string) (models.TwoFactorCredential, error) {
+			return credential, nil
+		},
+		deleteTwoFactorCredential: func(principal string, username string) error {
+			t.Fatal("two-factor authentication must not be disabled with an invalid code")
+			return nil
+		},
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	totpCode, err := totp.Code(secret, totp.Step(time.Now())+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = currService.DisableTwoFactor(models.ScramPrincipalUser, username, totpCode)
+
+	assert.ErrorIs(t, err, constants.ErrInvalidTwoFactorCode)
+}
+
+const passkeyOrigin = "http://localhost:5001"
+
+func passkeyConfig(t *testing.T) {
+	t.Setenv("WEBAUTHN_RP_ID", "localhost")
+	t.Setenv("WEBAUTHN_ORIGINS", passkeyOrigin)
+	t.Setenv("JWT_SECRET_KEY", "jwt_secret")
+}
+
+// passkeyRepository stores the passkey ceremony challenges the service issues
+// and the sign counter of the passkey.
+func passkeyRepository(passkey *models.Passkey) *mockRepository {
+	challenges := map[string]models.WebAuthnChallenge{}
+
+	return &mockRepository{
+		createWebAuthnChallenge: func(challenge models.WebAuthnChallenge) error {
+			challenges[challenge.Challenge] = challenge
+			return nil
+		},
+		consumeWebAuthnChallenge: func(ceremony string, challenge string, userID uint, now time.Time) error {
+			stored, ok := challenges[challenge]
+			if !ok || stored.Ceremony != ceremony || (stored.UserID == nil) != (userID == 0) {
+				return gorm.ErrRecordNotFound
+			}
+			delete(challenges, challenge)
+			return nil
+		},
+		getPasskey: func(credentialID string) (models.Passkey, error) {
+			if passkey == nil || passkey.CredentialID != credentialID {
+				return models.Passkey{}, gorm.ErrRecordNotFound
+			}
+			return *passkey, nil
+		},
+		useWebAuthnCredential: func(id uint, signCount uint32, usedAt time.Time) error {
+			passkey.SignCount = signCount
+			return nil
+		},
+		findUser: func(userID uint) (models.User, error) {
+			return models.User{ID: userID, Username: username}, nil
+		},
+	}
+}
+
+// registeredPasskey registers the passkey of authenticator for userId.
+func registeredPasskey(t *testing.T, authenticator *webauthntest.Authenticator) *models.Passkey {
+	passkey := &models.Passkey{}
+	mockRepo := passkeyRepository(passkey)
+	mockRepo.createPasskey = func(created models.Passkey) error {
+		*passkey = created
+		passkey.ID = 5
+		return nil
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	options, err := currService.StartPasskeyRegistration(userId, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = currService.FinishPasskeyRegistration(userId, dto.PasskeyRegistrationDTO{
+		Name:       "Laptop",
+		Credential: authenticator.Register(options.PublicKey),
+	})
+	if err != nil {
+		t.Fatal("Failed to register the passkey:", err)
+	}
+
+	return passkey
+}
+
+func TestFinishPasskeyRegistration_Success(t *testing.T) {
+	passkeyConfig(t)
+	authenticator := webauthntest.NewAuthenticator(passkeyOrigin)
+
+	passkey := registeredPasskey(t, authenticator)
+
+	assert.Equal(t, userId, passkey.UserID)
+	assert.Equal(t, "Laptop", passkey.Name)
+	assert.Equal(t, authenticator.CredentialID(), passkey.CredentialID)
+	assert.Equal(t, authenticator.PublicKey(), passkey.PublicKey)
+	assert.Equal(t, webauthn.AttestationFormatNone, passkey.AttestationFormat)
+}
+
+func TestStartPasskeyRegistration_ExcludesRegisteredPasskeys(t *testing.T) {
+	passkeyConfig(t)
+
+	mockRepo := passkeyRepository(nil)
+	mockRepo.getPasskeysOfUser = func(userID uint) ([]models.Passkey, error) {
+		return []models.Passkey{{CredentialID: "registered"}}, nil
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	options, err := currService.StartPasskeyRegistration(userId, username)
+
+	assert.Nil(t, err)
+	assert.Len(t, options.PublicKey.ExcludeCredentials, 1)
+	assert.Equal(t, "registered", options.PublicKey.ExcludeCredentials[0].ID)
+}
+
+func TestLoginPasskey_Success(t *testing.T) {
+	passkeyConfig(t)
+	authenticator := webauthntest.NewAuthenticator(passkeyOrigin)
+	passkey := registeredPasskey(t, authenticator)
+
+	currService := service.NewService(passkeyRepository(passkey), &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	options, err := currService.StartPasskeyLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := currService.LoginPasskey(dto.LoginPasskeyDTO{Credential: authenticator.Login(options.PublicKey)})
+
+	assert.Nil(t, err)
+	assert.False(t, resp.TwoFactorRequired)
+	assert.Equal(t, uint32(1), passkey.SignCount)
+
+	claims, err := utils.ParseUserToken(resp.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, userId, claims.UserID)
+}
+
+func TestLoginPasskey_UnknownPasskey(t *testing.T) {
+	passkeyConfig(t)
+	currService := service.NewService(passkeyRepository(nil), &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	options, err := currService.StartPasskeyLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := webauthntest.NewAuthenticator(passkeyOrigin)
+	_, err = currService.LoginPasskey(dto.LoginPasskeyDTO{Credential: authenticator.Login(options.PublicKey)})
+
+	assert.ErrorIs(t, err, constants.ErrInvalidPasskey)
+}
+
+func TestLoginPasskey_UserNotVerifiedRequiresTwoFactor(t *testing.T) {
+	passkeyConfig(t)
+	authenticator := webauthntest.NewAuthenticator(passkeyOrigin)
+	passkey := registeredPasskey(t, authenticator)
+	credential := confirmedTwoFactorCredential(t, models.ScramPrincipalUser, "JBSWY3DPEHPK3PXP")
+
+	mockRepo := passkeyRepository(passkey)
+	mockRepo.getTwoFactorCredential = func(principal string, username string) (models.TwoFactorCredential, error) {
+		return credential, nil
+	}
+	currService := service.NewService(mockRepo, &verification.EmailVerifier{}, &mocks.MockProofGenerator{}, code.NewMIMCCodeGenerator())
+
+	options, err := currService.StartPasskeyLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator.UserVerified = false
+	resp, err := currService.LoginPasskey(dto.LoginPasskeyDTO{Credential: authenticator.Login(options.PublicKey)})
+
+	assert.Nil(t, err)
+	assert.True(t, resp.TwoFactorRequired)
+	assert.Empty(t, resp.Token)
+
+	claims, err := utils.ParseTwoFactorToken(resp.TwoFactorToken)
+	assert.Nil(t, err)
+	assert.Equal(t, username, claims.Subject)
 }
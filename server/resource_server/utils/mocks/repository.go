@@ -7,6 +7,8 @@ import (
 
 	"globe-and-citizen/layer8/server/resource_server/models"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type MockRepository struct {
@@ -18,13 +20,26 @@ type MockRepository struct {
 	GetUserForUsernameMock                 func(username string) (models.User, error)
 	RegisterUserPrecheckMock               func(req dto.RegisterUserPrecheckDTO, salt string, iterCount int) error
 	RegisterUserMock                       func(req dto.RegisterUserDTO) error
-	UpdateUserPasswordMock                 func(username string, storedKey string, serverKey string) error
+	UpdateUserPasswordMock                 func(username string, storedKey string, serverKey string, revokedAt time.Time) error
 	DeleteEmailVerificationDataMock        func(userId uint) error
 	SetUserEmailVerifiedMock               func(userID uint) error
 	SavePhoneNumberVerificationDataMock    func(data models.PhoneNumberVerificationData) error
 	GetPhoneNumberVerificationDataMock     func(userID uint) (models.PhoneNumberVerificationData, error)
 	SaveProofOfPhoneNumberVerificationMock func(userID uint, verificationCode string, zkProof []byte, zkPairID uint) error
 	SaveTelegramSessionIDHashMock          func(userID uint, sessionID []byte) error
+	GetConnectedAppsMock                   func(userID uint) ([]models.ConnectedApp, error)
+	DeleteUserConsentMock                  func(userID uint, clientID string, revokedAt time.Time) error
+	GetClientRedirectURIsMock              func(clientID string) ([]models.ClientRedirectURI, error)
+	AddClientRedirectURIMock               func(clientID string, redirectURI string) error
+	RemoveClientRedirectURIMock            func(clientID string, redirectURI string) error
+	RotateClientSecretMock                 func(clientID string, secretHash string, previousExpiresAt time.Time) error
+	RegisterDynamicClientMock              func(client models.Client, redirectURIs []string, ratePerByte int) error
+	GetClientByIDMock                      func(clientID string) (models.Client, error)
+	UpdateRegisteredClientMock             func(client models.Client, redirectURIs []string) error
+	DeleteRegisteredClientMock             func(clientID string) error
+	GetZkSnarksVerifyingKeysMock           func() ([]models.ZkSnarksKeyPair, error)
+	RetireZkSnarksKeyPairsMock             func(ids []uint, retiredAt time.Time) error
+	ResetProofsOfRetiredZkKeyPairsMock     func() (int, error)
 }
 
 func (m *MockRepository) FindUser(userId uint) (models.User, error) {
@@ -60,8 +75,10 @@ func (m *MockRepository) RegisterUser(req dto.RegisterUserDTO) error {
 	return m.RegisterUserMock(req)
 }
 
-func (m *MockRepository) UpdateUserPassword(username string, storedKey string, serverKey string) error {
-	return m.UpdateUserPasswordMock(username, storedKey, serverKey)
+func (m *MockRepository) UpdateUserPassword(
+	username string, storedKey string, serverKey string, revokedAt time.Time,
+) error {
+	return m.UpdateUserPasswordMock(username, storedKey, serverKey, revokedAt)
 }
 
 func (m *MockRepository) ProfileUser(userID uint) (models.User, models.UserMetadata, error) {
@@ -80,7 +97,6 @@ func (m *MockRepository) GetClientData(clientName string) (models.Client, error)
 	if clientName == "testclient" {
 		return models.Client{
 			ID:          "1",
-			Secret:      "testsecret",
 			Name:        "testclient",
 			RedirectURI: "https://gcitizen.com/callback",
 		}, nil
@@ -128,11 +144,158 @@ func (m *MockRepository) SaveZkSnarksKeyPair(keyPair models.ZkSnarksKeyPair) (ui
 	return 0, nil
 }
 
-func (m *MockRepository) GetLatestZkSnarksKeys() (models.ZkSnarksKeyPair, error) {
+func (m *MockRepository) GetLatestZkSnarksKeys(circuit string) (models.ZkSnarksKeyPair, error) {
+	return models.ZkSnarksKeyPair{}, nil
+}
+
+func (m *MockRepository) RotateZkSnarksKeyPair(
+	circuit string, due func(active *models.ZkSnarksKeyPair) bool, generate func() models.ZkSnarksKeyPair,
+) (bool, error) {
+	return false, nil
+}
+
+func (m *MockRepository) GetZkSnarksVerifyingKey(id uint) (models.ZkSnarksKeyPair, error) {
 	return models.ZkSnarksKeyPair{}, nil
 }
 
-func (m *MockRepository) RegisterClient(req dto.RegisterClientDTO, id string, secret string) error {
+func (m *MockRepository) GetZkSnarksVerifyingKeys() ([]models.ZkSnarksKeyPair, error) {
+	if m.GetZkSnarksVerifyingKeysMock != nil {
+		return m.GetZkSnarksVerifyingKeysMock()
+	}
+	return []models.ZkSnarksKeyPair{}, nil
+}
+
+func (m *MockRepository) RetireZkSnarksKeyPairs(ids []uint, retiredAt time.Time) error {
+	if m.RetireZkSnarksKeyPairsMock != nil {
+		return m.RetireZkSnarksKeyPairsMock(ids, retiredAt)
+	}
+	return nil
+}
+
+func (m *MockRepository) MarkZkProofsToReprove(keyPairIDs []uint, reproveBy time.Time) (int, error) {
+	return 0, nil
+}
+
+func (m *MockRepository) ResetProofsOfRetiredZkKeyPairs() (int, error) {
+	if m.ResetProofsOfRetiredZkKeyPairsMock != nil {
+		return m.ResetProofsOfRetiredZkKeyPairsMock()
+	}
+	return 0, nil
+}
+
+func (m *MockRepository) CreateZkProofJob(job models.ZkProofJob) (uint, error) {
+	return 0, nil
+}
+
+func (m *MockRepository) ClaimZkProofJob(now time.Time, staleBefore time.Time) (models.ZkProofJob, error) {
+	return models.ZkProofJob{}, nil
+}
+
+func (m *MockRepository) CompleteZkProofJob(id uint, zkKeyPairID uint, finishedAt time.Time) error {
+	return nil
+}
+
+func (m *MockRepository) FailZkProofJob(id uint, jobError string, finishedAt time.Time) error {
+	return nil
+}
+
+func (m *MockRepository) ExpireZkProofJobs(queuedBefore time.Time, finishedAt time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (m *MockRepository) GetZkProofJob(id uint, userID uint) (models.ZkProofJob, error) {
+	return models.ZkProofJob{}, nil
+}
+
+func (m *MockRepository) CountPendingZkProofJobs() (int64, error) {
+	return 0, nil
+}
+
+func (m *MockRepository) CreateScramSession(session models.ScramSession) error {
+	return nil
+}
+
+func (m *MockRepository) ConsumeScramSession(
+	principal string, username string, nonce string, cNonce string, now time.Time,
+) error {
+	return nil
+}
+
+func (m *MockRepository) CreatePasswordResetChallenge(challenge models.PasswordResetChallenge) error {
+	return nil
+}
+
+func (m *MockRepository) ConsumePasswordResetChallenge(username string, challenge string, now time.Time) error {
+	return nil
+}
+
+func (m *MockRepository) SaveTwoFactorCredential(credential models.TwoFactorCredential) error {
+	return nil
+}
+
+func (m *MockRepository) GetTwoFactorCredential(principal string, username string) (models.TwoFactorCredential, error) {
+	return models.TwoFactorCredential{}, gorm.ErrRecordNotFound
+}
+
+func (m *MockRepository) ConfirmTwoFactorCredential(
+	id uint, step int64, confirmedAt time.Time, recoveryCodeHashes []string,
+) error {
+	return nil
+}
+
+func (m *MockRepository) UseTwoFactorStep(credentialID uint, step int64) error {
+	return nil
+}
+
+func (m *MockRepository) UseTwoFactorRecoveryCode(credentialID uint, codeHash string, usedAt time.Time) error {
+	return nil
+}
+
+func (m *MockRepository) DeleteTwoFactorCredential(principal string, username string) error {
+	return nil
+}
+
+func (m *MockRepository) CreateWebAuthnChallenge(challenge models.WebAuthnChallenge) error {
+	return nil
+}
+
+func (m *MockRepository) ConsumeWebAuthnChallenge(ceremony string, challenge string, userID uint, now time.Time) error {
+	return nil
+}
+
+func (m *MockRepository) CreatePasskey(passkey models.Passkey) error {
+	return nil
+}
+
+func (m *MockRepository) GetPasskey(credentialID string) (models.Passkey, error) {
+	return models.Passkey{}, gorm.ErrRecordNotFound
+}
+
+func (m *MockRepository) GetPasskeysOfUser(userID uint) ([]models.Passkey, error) {
+	return []models.Passkey{}, nil
+}
+
+func (m *MockRepository) UseWebAuthnCredential(id uint, signCount uint32, usedAt time.Time) error {
+	return nil
+}
+
+func (m *MockRepository) DeletePasskey(userID uint, id uint) error {
+	return nil
+}
+
+func (m *MockRepository) SetClientRequireUserTwoFactor(clientID string, required bool) error {
+	return nil
+}
+
+func (m *MockRepository) SaveUserEmailDomain(userID uint, emailDomain *models.UserEmailDomain) error {
+	return nil
+}
+
+func (m *MockRepository) GetEmailDomainProofs(userID uint) ([]models.EmailDomainProof, error) {
+	return nil, nil
+}
+
+func (m *MockRepository) RegisterClient(req dto.RegisterClientDTO, id string, secretHash string) error {
 	return nil
 }
 
@@ -187,3 +350,133 @@ func (m *MockRepository) SaveTelegramSessionIDHash(userID uint, sessionID []byte
 	}
 	return nil
 }
+
+func (m *MockRepository) GetConnectedApps(userID uint) ([]models.ConnectedApp, error) {
+	if m.GetConnectedAppsMock != nil {
+		return m.GetConnectedAppsMock(userID)
+	}
+	return nil, nil
+}
+
+func (m *MockRepository) DeleteUserConsent(userID uint, clientID string, revokedAt time.Time) error {
+	if m.DeleteUserConsentMock != nil {
+		return m.DeleteUserConsentMock(userID, clientID, revokedAt)
+	}
+	return nil
+}
+
+func (m *MockRepository) GetClientRedirectURIs(clientID string) ([]models.ClientRedirectURI, error) {
+	if m.GetClientRedirectURIsMock != nil {
+		return m.GetClientRedirectURIsMock(clientID)
+	}
+	return nil, nil
+}
+
+func (m *MockRepository) AddClientRedirectURI(clientID string, redirectURI string) error {
+	if m.AddClientRedirectURIMock != nil {
+		return m.AddClientRedirectURIMock(clientID, redirectURI)
+	}
+	return nil
+}
+
+func (m *MockRepository) RemoveClientRedirectURI(clientID string, redirectURI string) error {
+	if m.RemoveClientRedirectURIMock != nil {
+		return m.RemoveClientRedirectURIMock(clientID, redirectURI)
+	}
+	return nil
+}
+
+func (m *MockRepository) RotateClientSecret(clientID string, secretHash string, previousExpiresAt time.Time) error {
+	if m.RotateClientSecretMock != nil {
+		return m.RotateClientSecretMock(clientID, secretHash, previousExpiresAt)
+	}
+	return nil
+}
+
+func (m *MockRepository) RegisterDynamicClient(client models.Client, redirectURIs []string, ratePerByte int) error {
+	if m.RegisterDynamicClientMock != nil {
+		return m.RegisterDynamicClientMock(client, redirectURIs, ratePerByte)
+	}
+	return nil
+}
+
+func (m *MockRepository) GetClientByID(clientID string) (models.Client, error) {
+	if m.GetClientByIDMock != nil {
+		return m.GetClientByIDMock(clientID)
+	}
+	return models.Client{}, nil
+}
+
+func (m *MockRepository) UpdateRegisteredClient(client models.Client, redirectURIs []string) error {
+	if m.UpdateRegisteredClientMock != nil {
+		return m.UpdateRegisteredClientMock(client, redirectURIs)
+	}
+	return nil
+}
+
+func (m *MockRepository) DeleteRegisteredClient(clientID string) error {
+	if m.DeleteRegisteredClientMock != nil {
+		return m.DeleteRegisteredClientMock(clientID)
+	}
+	return nil
+}
+
+func (m *MockRepository) CreateSession(session models.Session) error {
+	return nil
+}
+
+func (m *MockRepository) TouchSession(jti string, now time.Time) error {
+	return nil
+}
+
+func (m *MockRepository) GetUserSessions(userID uint, now time.Time) ([]models.Session, error) {
+	return nil, nil
+}
+
+func (m *MockRepository) GetClientSessions(clientID string, now time.Time) ([]models.Session, error) {
+	return nil, nil
+}
+
+func (m *MockRepository) RevokeUserSessions(userID uint, id uint, revokedAt time.Time) error {
+	return nil
+}
+
+func (m *MockRepository) RevokeClientSessions(clientID string, id uint, revokedAt time.Time) error {
+	return nil
+}
+
+func (m *MockRepository) RevokeSession(jti string, revokedAt time.Time) error {
+	return nil
+}
+
+func (m *MockRepository) GetDataAccessRecords(
+	userID uint, clientID string, since time.Time, until time.Time,
+) ([]models.DataAccessRecord, error) {
+	return nil, nil
+}
+
+func (m *MockRepository) GetDataAccessDigest(userID uint) (models.DataAccessDigest, error) {
+	return models.DataAccessDigest{}, nil
+}
+
+func (m *MockRepository) SaveDataAccessDigest(digest models.DataAccessDigest) error {
+	return nil
+}
+
+func (m *MockRepository) DeleteDataAccessDigest(userID uint) error {
+	return nil
+}
+
+func (m *MockRepository) ClaimDueDataAccessDigests(
+	now time.Time, sentBefore time.Time, claimedBefore time.Time,
+) ([]models.DataAccessDigest, error) {
+	return nil, nil
+}
+
+func (m *MockRepository) ReleaseDataAccessDigest(userID uint) error {
+	return nil
+}
+
+func (m *MockRepository) MarkDataAccessDigestSent(userID uint, sentAt time.Time) error {
+	return nil
+}
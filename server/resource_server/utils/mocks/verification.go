@@ -22,17 +22,19 @@ func (g *MockCodeGenerator) GenerateCode(user *models.User, emailAddress string)
 
 type MockProofGenerator struct {
 	GenerateProofFunc func(emailAddress string, salt string, verificationCode string) ([]byte, uint, error)
-	VerifyProofFunc   func(verificationCode string, salt string, proofBytes []byte) error
+	VerifyProofFunc   func(
+		zkKeyPairID uint, verificationCode string, salt string, domainCommitment string, proofBytes []byte,
+	) error
 }
 
 func (pg *MockProofGenerator) GenerateProof(
-	emailAddress string, salt string, verificationCode string,
+	emailAddress string, salt string, verificationCode string, nullifierKey []byte,
 ) ([]byte, uint, error) {
 	return pg.GenerateProofFunc(emailAddress, salt, verificationCode)
 }
 
 func (pg *MockProofGenerator) VerifyProof(
-	verificationCode string, salt string, proofBytes []byte,
+	zkKeyPairID uint, verificationCode string, salt string, domainCommitment string, proofBytes []byte,
 ) error {
-	return pg.VerifyProofFunc(verificationCode, salt, proofBytes)
+	return pg.VerifyProofFunc(zkKeyPairID, verificationCode, salt, domainCommitment, proofBytes)
 }
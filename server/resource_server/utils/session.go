@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+
+	"globe-and-citizen/layer8/server/constants"
+)
+
+// SessionTTL is how long a session of the user or client portal, and so its
+// token, stays valid
+const SessionTTL = 60 * time.Minute
+
+const maxDeviceLabelLength = 255
+
+// SessionStore checks the sessions of tokens. Both the resource server and
+// the authorization server repositories implement it.
+type SessionStore interface {
+	// TouchSession records that the session with the jti was seen at now. It
+	// returns gorm.ErrRecordNotFound if the session was revoked or expired.
+	TouchSession(jti string, now time.Time) error
+}
+
+// CheckSession returns constants.ErrSessionRevoked unless the session of the
+// token with the jti is live, and records its use.
+func CheckSession(store SessionStore, jti string) error {
+	// tokens issued before sessions were stored have no jti
+	if jti == "" {
+		return constants.ErrSessionRevoked
+	}
+
+	err := store.TouchSession(jti, time.Now().UTC())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return constants.ErrSessionRevoked
+	}
+	return err
+}
+
+// ParseSessionID returns the jti of a user or client portal token, which
+// need not be valid anymore, so that its session can be ended.
+func ParseSessionID(tokenString string) (string, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(os.Getenv("JWT_SECRET_KEY")), nil
+	}, jwt.WithoutClaimsValidation())
+	if err != nil {
+		return "", err
+	}
+	if claims.ID == "" {
+		return "", fmt.Errorf("token has no session")
+	}
+	return claims.ID, nil
+}
+
+// DeviceLabel names the browser and operating system of a User-Agent
+// header, like "Firefox on Linux", for the list of sessions. Agents it does
+// not recognise are shown as they are.
+func DeviceLabel(userAgent string) string {
+	var browser string
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+
+	var system string
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		system = "Android"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		system = "iOS"
+	case strings.Contains(userAgent, "Windows"):
+		system = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		system = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		system = "Linux"
+	}
+
+	if browser != "" && system != "" {
+		return browser + " on " + system
+	}
+	if userAgent == "" {
+		return "Unknown device"
+	}
+	if len(userAgent) > maxDeviceLabelLength {
+		return userAgent[:maxDeviceLabelLength]
+	}
+	return userAgent
+}
@@ -1,15 +1,23 @@
 package utils
 
 import (
+	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"globe-and-citizen/layer8/server/constants"
 	"globe-and-citizen/layer8/server/resource_server/models"
+	"globe-and-citizen/layer8/server/sdjwt"
 	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -118,16 +126,19 @@ func GenerateSecret(secretSize int) string {
 	return hex.EncodeToString(randomBytes[:])
 }
 
-func CompleteClientLoginv2(client models.Client) (token string, err error) {
+// CompleteClientLoginv2 issues the client portal token of a session started
+// by a login of the client.
+func CompleteClientLoginv2(client models.Client, session models.Session) (token string, err error) {
 	jwtSecretStr := os.Getenv("JWT_SECRET_KEY")
 	jwtSecretByte := []byte(jwtSecretStr)
 
-	expirationTime := time.Now().Add(60 * time.Minute)
 	claims := &models.ClientClaims{
 		UserName: client.Username,
 		ClientID: client.ID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			ID:        session.JTI,
+			ExpiresAt: jwt.NewNumericDate(session.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(session.CreatedAt),
 			Issuer:    "GlobeAndCitizen",
 		},
 	}
@@ -140,7 +151,23 @@ func CompleteClientLoginv2(client models.Client) (token string, err error) {
 	return tokenString, nil
 }
 
-func ValidateToken(tokenString string) (uint, error) {
+// ValidateToken returns the user a user portal token was issued to, if its
+// session was not revoked.
+func ValidateToken(store SessionStore, tokenString string) (uint, error) {
+	claims, err := ParseUserToken(tokenString)
+	if err != nil {
+		return 0, err
+	}
+	if err := CheckSession(store, claims.ID); err != nil {
+		return 0, err
+	}
+	return claims.UserID, nil
+}
+
+// ParseUserToken returns the claims of a valid user portal token. It only
+// checks the signature and expiry; revoked sessions are rejected by
+// ValidateToken.
+func ParseUserToken(tokenString string) (*models.Claims, error) {
 	claims := &models.Claims{}
 	JWT_SECRET_STR := os.Getenv("JWT_SECRET_KEY")
 	JWT_SECRET_BYTE := []byte(JWT_SECRET_STR)
@@ -148,15 +175,79 @@ func ValidateToken(tokenString string) (uint, error) {
 		return JWT_SECRET_BYTE, nil
 	})
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	if !token.Valid {
-		return 0, fmt.Errorf("invalid token")
+		return nil, fmt.Errorf("invalid token")
 	}
-	return claims.UserID, nil
+	return claims, nil
 }
 
-func ValidateClientToken(tokenString string) (*models.ClientClaims, error) {
+// ValidateClientToken accepts only client portal tokens of sessions that
+// were not revoked. Tokens from the client credentials grant are signed with
+// another key and limited to the APIs that check their scope with
+// ValidateClientTokenWithScope.
+func ValidateClientToken(store SessionStore, tokenString string) (*models.ClientClaims, error) {
+	claims, err := parseClientToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckSession(store, claims.ID); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// ValidateClientTokenWithScope accepts a client credentials token that was
+// granted the given scope, or a client portal token of a session that was not
+// revoked. The former are short lived and not tied to a session.
+func ValidateClientTokenWithScope(store SessionStore, tokenString string, scope string) (*models.ClientClaims, error) {
+	if claims, err := parseClientCredentialsToken(tokenString); err == nil {
+		if !slices.Contains(constants.ParseScopes(claims.Scope), scope) {
+			return nil, fmt.Errorf("token was not granted the %s scope", scope)
+		}
+		return claims, nil
+	}
+
+	return ValidateClientToken(store, tokenString)
+}
+
+// ValidateInitialAccessToken checks the token that authorizes dynamic client
+// registration (RFC 7591, section 3). Registration is disabled while
+// CLIENT_REGISTRATION_INITIAL_ACCESS_TOKEN is not set.
+func ValidateInitialAccessToken(token string) error {
+	expected := os.Getenv("CLIENT_REGISTRATION_INITIAL_ACCESS_TOKEN")
+	if expected == "" {
+		return fmt.Errorf("dynamic client registration is disabled")
+	}
+
+	// compare digests so the comparison time does not depend on the length either
+	expectedHash := sha256.Sum256([]byte(expected))
+	tokenHash := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare(expectedHash[:], tokenHash[:]) != 1 {
+		return fmt.Errorf("invalid initial access token")
+	}
+
+	return nil
+}
+
+// LoadCredentialIssuer returns the signer of verifiable credentials. Its key
+// is the base64 encoded Ed25519 seed in CREDENTIAL_ISSUER_SIGNING_KEY.
+func LoadCredentialIssuer() (*sdjwt.Issuer, error) {
+	encoded := os.Getenv("CREDENTIAL_ISSUER_SIGNING_KEY")
+	if encoded == "" {
+		return nil, fmt.Errorf("credential issuer signing key is not configured")
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("credential issuer signing key must be a base64 encoded %d byte seed", ed25519.SeedSize)
+	}
+
+	return sdjwt.NewIssuer(ed25519.NewKeyFromSeed(seed)), nil
+}
+
+func parseClientToken(tokenString string) (*models.ClientClaims, error) {
 	claims := &models.ClientClaims{}
 	JWT_SECRET_STR := os.Getenv("JWT_SECRET_KEY")
 	JWT_SECRET_BYTE := []byte(JWT_SECRET_STR)
@@ -169,19 +260,53 @@ func ValidateClientToken(tokenString string) (*models.ClientClaims, error) {
 	if !token.Valid {
 		return nil, fmt.Errorf("invalid token")
 	}
+	if claims.Scope != "" {
+		return nil, fmt.Errorf("client portal tokens carry no scope")
+	}
+	return claims, nil
+}
+
+// parseClientCredentialsToken returns the claims of a token issued through
+// the client credentials grant, which is signed with its own key and carries
+// its own audience.
+func parseClientCredentialsToken(tokenString string) (*models.ClientClaims, error) {
+	signingKey := os.Getenv("CLIENT_CREDENTIALS_TOKEN_SIGNING_KEY")
+	if signingKey == "" {
+		return nil, fmt.Errorf("client credentials token signing key is not configured")
+	}
+
+	claims := &models.ClientClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(signingKey), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if !claims.VerifyAudience(constants.ClientCredentialsTokenAudience, true) {
+		return nil, fmt.Errorf("token is not a client credentials token")
+	}
+	if claims.Scope == "" {
+		return nil, fmt.Errorf("client credentials token has no scope")
+	}
 	return claims, nil
 }
 
-func GenerateToken(user models.User) (string, error) {
+// GenerateToken issues the user portal token of a session started by a login
+// of the user.
+func GenerateToken(user models.User, session models.Session) (string, error) {
 	JWT_SECRET_STR := os.Getenv("JWT_SECRET_KEY")
 	JWT_SECRET_BYTE := []byte(JWT_SECRET_STR)
 
-	expirationTime := time.Now().Add(60 * time.Minute)
 	claims := &models.Claims{
 		UserName: user.Username,
 		UserID:   user.ID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			ID:        session.JTI,
+			ExpiresAt: jwt.NewNumericDate(session.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(session.CreatedAt),
 			Issuer:    "GlobeAndCitizen",
 		},
 	}
@@ -193,6 +318,51 @@ func GenerateToken(user models.User) (string, error) {
 	return tokenString, nil
 }
 
+// twoFactorTokenTTL is how long the code of the second login step can be
+// entered after the password check
+const twoFactorTokenTTL = 5 * time.Minute
+
+// twoFactorTokenKey is derived from the JWT secret so that a token of a
+// pending login is not accepted where a user or client token is expected.
+func twoFactorTokenKey() []byte {
+	key := sha256.Sum256([]byte("two-factor:" + os.Getenv("JWT_SECRET_KEY")))
+	return key[:]
+}
+
+// GenerateTwoFactorToken is issued instead of a token to a principal that
+// passed the password check and has enrolled an authenticator.
+func GenerateTwoFactorToken(principal string, username string) (string, error) {
+	issuedAt := time.Now()
+	claims := &models.TwoFactorClaims{
+		Principal: principal,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   username,
+			ExpiresAt: jwt.NewNumericDate(issuedAt.Add(twoFactorTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			Issuer:    "GlobeAndCitizen",
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(twoFactorTokenKey())
+}
+
+// ParseTwoFactorToken returns the claims of an unexpired token issued by
+// GenerateTwoFactorToken, otherwise constants.ErrInvalidTwoFactorToken.
+func ParseTwoFactorToken(tokenString string) (*models.TwoFactorClaims, error) {
+	claims := &models.TwoFactorClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return twoFactorTokenKey(), nil
+	})
+	if err != nil || !token.Valid || claims.Subject == "" {
+		return nil, constants.ErrInvalidTwoFactorToken
+	}
+	return claims, nil
+}
+
 func GenerateUPTokenJWT(secret string, clientID string) (string, error) {
 	claims := jwt.RegisteredClaims{
 		Issuer:    "layer8",
@@ -245,3 +415,47 @@ func XorBytes(bytesA, bytesB []byte) ([]byte, error) {
 	}
 	return result, nil
 }
+
+// ScramAuthMessage is the message both sides of a SCRAM login sign.
+func ScramAuthMessage(username string, cNonce string, salt string, iterationCount int, nonce string) string {
+	return fmt.Sprintf("[n=%s,r=%s,s=%s,i=%d,r=%s]", username, cNonce, salt, iterationCount, nonce)
+}
+
+// VerifyScramClientProof checks that the hex encoded client proof over
+// authMessage was computed from the client key behind storedKey, and returns
+// the server signature the client checks the server with. A proof from
+// another key fails with constants.ErrInvalidClientProof.
+func VerifyScramClientProof(authMessage string, storedKey string, serverKey string, clientProof string) (string, error) {
+	storedKeyBytes, err := hex.DecodeString(storedKey)
+	if err != nil {
+		return "", fmt.Errorf("error decoding stored key: %v", err)
+	}
+
+	clientSignatureHMAC := hmac.New(sha256.New, storedKeyBytes)
+	clientSignatureHMAC.Write([]byte(authMessage))
+	clientSignature := clientSignatureHMAC.Sum(nil)
+
+	clientProofBytes, err := hex.DecodeString(clientProof)
+	if err != nil {
+		return "", fmt.Errorf("error decoding client proof: %v", err)
+	}
+
+	clientKeyBytes, err := XorBytes(clientSignature, clientProofBytes)
+	if err != nil {
+		return "", fmt.Errorf("error performing XOR operation: %v", err)
+	}
+
+	clientKeyHash := sha256.Sum256(clientKeyBytes)
+	if hex.EncodeToString(clientKeyHash[:]) != storedKey {
+		return "", constants.ErrInvalidClientProof
+	}
+
+	serverKeyBytes, err := hex.DecodeString(serverKey)
+	if err != nil {
+		return "", fmt.Errorf("error decoding server key: %v", err)
+	}
+
+	serverSignatureHMAC := hmac.New(sha256.New, serverKeyBytes)
+	serverSignatureHMAC.Write([]byte(authMessage))
+	return hex.EncodeToString(serverSignatureHMAC.Sum(nil)), nil
+}
@@ -11,10 +11,24 @@ import (
 const VerificationCodeSize = 6
 const InputFrRepresentationSize = 38
 
+// An email domain is packed like any other input but into fewer elements, so
+// it can be at most EmailDomainFrRepresentationSize*runesPerElement runes long.
+const EmailDomainFrRepresentationSize = 9
+const MaxEmailDomainLength = EmailDomainFrRepresentationSize * runesPerElement
+
+// EmailDomainSetDepth is the depth of the Merkle trees of allowed domains.
+const EmailDomainSetDepth = 16
+
+// MaxInputLength is the number of runes an input is packed into.
+const MaxInputLength = InputFrRepresentationSize * runesPerElement
+
 const runesPerElement = 7
 const bytes = 4
 const elementByteSize = 32
 
+// RuneBitSize is the number of bits every rune takes in a packed element.
+const RuneBitSize = bytes * 8
+
 func StringToFrElements(input string) ([InputFrRepresentationSize]fr.Element, error) {
 	runeCount := utf8.RuneCountInString(input)
 
@@ -0,0 +1,299 @@
+// Package zkproofjobs generates the proofs of email and phone number
+// verifications in the background. Verification endpoints only queue a job;
+// a bounded pool of workers proves and stores the result, so Groth16 proving
+// no longer holds request goroutines.
+package zkproofjobs
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"gorm.io/gorm"
+
+	"globe-and-citizen/layer8/server/resource_server/models"
+	"globe-and-citizen/layer8/server/zkverify"
+)
+
+const (
+	// pollInterval is how long an idle worker waits before looking for jobs
+	// again, jobs queued by other server instances are only seen by polling
+	pollInterval = time.Second
+	// staleAfter is how long a job may run before another worker claims it
+	staleAfter = 10 * time.Minute
+	// maxAttempts bounds how often a job whose worker died is claimed again
+	maxAttempts = 3
+	// expireAfter bounds how long the plaintext input of an unfinished job is
+	// stored: a job queued longer ago is failed and its input cleared, also
+	// when no worker is left to claim it. It leaves time for every attempt.
+	expireAfter = (maxAttempts + 1) * staleAfter
+	// sweepInterval is how often expired jobs are looked for
+	sweepInterval = time.Minute
+	// nullifierKeySize is the size of the random key the nullifiers of the
+	// email domain proofs of a verified address are made with
+	nullifierKeySize = 32
+)
+
+type Repository interface {
+	ClaimZkProofJob(now time.Time, staleBefore time.Time) (models.ZkProofJob, error)
+	CompleteZkProofJob(id uint, zkKeyPairID uint, finishedAt time.Time) error
+	FailZkProofJob(id uint, jobError string, finishedAt time.Time) error
+	ExpireZkProofJobs(queuedBefore time.Time, finishedAt time.Time) (int64, error)
+	CountPendingZkProofJobs() (int64, error)
+	FindUser(userID uint) (models.User, error)
+	SaveProofOfEmailVerification(userID uint, verificationCode string, proof []byte, zkKeyPairId uint) error
+	SavePhoneNumberVerificationData(data models.PhoneNumberVerificationData) error
+	SaveUserEmailDomain(userID uint, emailDomain *models.UserEmailDomain) error
+}
+
+type Prover interface {
+	GenerateProof(input string, salt string, verificationCode string, nullifierKey []byte) ([]byte, uint, error)
+}
+
+type Pool struct {
+	repository Repository
+	prover     Prover
+	workers    int
+	// phoneNumberCodeValidity is how long the code sent through Telegram
+	// stays valid, counted from when the job was queued
+	phoneNumberCodeValidity time.Duration
+	now                     func() time.Time
+
+	provingDuration metric.Float64Histogram
+	finishedJobs    metric.Int64Counter
+}
+
+func NewPool(
+	repository Repository,
+	prover Prover,
+	workers int,
+	phoneNumberCodeValidity time.Duration,
+) *Pool {
+	meter := otel.GetMeterProvider().Meter("layer8")
+
+	provingDuration, _ := meter.Float64Histogram(
+		"zk_proof_generation_duration",
+		metric.WithDescription("Time spent generating zk proofs of verified attributes"),
+		metric.WithUnit("s"),
+	)
+	finishedJobs, _ := meter.Int64Counter(
+		"zk_proof_jobs_finished",
+		metric.WithDescription("The total number of finished zk proof jobs"),
+	)
+	_, err := meter.Int64ObservableGauge(
+		"zk_proof_queue_depth",
+		metric.WithDescription("The number of zk proof jobs waiting for a worker"),
+		metric.WithInt64Callback(func(ctx context.Context, observer metric.Int64Observer) error {
+			depth, err := repository.CountPendingZkProofJobs()
+			if err != nil {
+				return err
+			}
+			observer.Observe(depth)
+			return nil
+		}),
+	)
+	if err != nil {
+		log.Printf("failed to register the zk proof queue depth metric: %v", err)
+	}
+
+	return &Pool{
+		repository:              repository,
+		prover:                  prover,
+		workers:                 workers,
+		phoneNumberCodeValidity: phoneNumberCodeValidity,
+		now:                     func() time.Time { return time.Now().UTC() },
+		provingDuration:         provingDuration,
+		finishedJobs:            finishedJobs,
+	}
+}
+
+// Run processes jobs until ctx is done.
+func (p *Pool) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.sweep(ctx)
+	}()
+
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (p *Pool) work(ctx context.Context) {
+	for {
+		processed, err := p.ProcessNext(ctx)
+		if err != nil {
+			log.Printf("zk proof worker: %v", err)
+		}
+
+		if processed {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+func (p *Pool) sweep(ctx context.Context) {
+	for {
+		if err := p.ExpireStaleJobs(ctx); err != nil {
+			log.Printf("zk proof sweeper: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sweepInterval):
+		}
+	}
+}
+
+// ExpireStaleJobs fails the jobs queued more than expireAfter ago that are
+// still unfinished and clears their input.
+func (p *Pool) ExpireStaleJobs(ctx context.Context) error {
+	now := p.now()
+
+	expired, err := p.repository.ExpireZkProofJobs(now.Add(-expireAfter), now)
+	if err != nil {
+		return fmt.Errorf("failed to expire zk proof jobs: %v", err)
+	}
+	if expired > 0 {
+		p.finishedJobs.Add(ctx, expired, metric.WithAttributes(attribute.String("status", models.ZkProofJobFailed)))
+		log.Printf("Expired %d zk proof jobs queued before %s", expired, now.Add(-expireAfter))
+	}
+
+	return nil
+}
+
+// ProcessNext claims one job and runs it. It reports false when the queue
+// was empty.
+func (p *Pool) ProcessNext(ctx context.Context) (bool, error) {
+	now := p.now()
+
+	job, err := p.repository.ClaimZkProofJob(now, now.Add(-staleAfter))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to claim a zk proof job: %v", err)
+	}
+
+	if job.Attempts > maxAttempts {
+		return true, p.fail(ctx, job, fmt.Errorf("gave up after %d attempts", maxAttempts))
+	}
+
+	zkKeyPairID, err := p.prove(ctx, job)
+	if err != nil {
+		return true, p.fail(ctx, job, err)
+	}
+
+	if err := p.repository.CompleteZkProofJob(job.ID, zkKeyPairID, p.now()); err != nil {
+		return true, fmt.Errorf("failed to complete zk proof job %d: %v", job.ID, err)
+	}
+	p.finishedJobs.Add(ctx, 1, metric.WithAttributes(attribute.String("status", models.ZkProofJobDone)))
+
+	return true, nil
+}
+
+func (p *Pool) prove(ctx context.Context, job models.ZkProofJob) (uint, error) {
+	user, err := p.repository.FindUser(job.UserID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find user: %v", err)
+	}
+
+	// the proof of an email address commits to its domain under a new key
+	var nullifierKey []byte
+	if job.Attribute == models.ZkProofJobEmail {
+		nullifierKey = make([]byte, nullifierKeySize)
+		if _, err := rand.Read(nullifierKey); err != nil {
+			return 0, fmt.Errorf("failed to generate the email domain nullifier key: %v", err)
+		}
+	}
+
+	startedAt := time.Now()
+	proof, zkKeyPairID, err := p.prover.GenerateProof(job.Input, user.Salt, job.VerificationCode, nullifierKey)
+	p.provingDuration.Record(ctx, time.Since(startedAt).Seconds(),
+		metric.WithAttributes(attribute.String("attribute", job.Attribute)),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate zk proof: %v", err)
+	}
+
+	switch job.Attribute {
+	case models.ZkProofJobEmail:
+		err = p.repository.SaveProofOfEmailVerification(job.UserID, job.VerificationCode, proof, zkKeyPairID)
+		if err == nil {
+			err = p.saveEmailDomain(job, nullifierKey)
+		}
+	case models.ZkProofJobPhoneNumber:
+		err = p.repository.SavePhoneNumberVerificationData(models.PhoneNumberVerificationData{
+			UserId:           job.UserID,
+			VerificationCode: job.VerificationCode,
+			ExpiresAt:        job.CreatedAt.Add(p.phoneNumberCodeValidity),
+			ZkProof:          proof,
+			ZkPairID:         zkKeyPairID,
+		})
+	default:
+		return 0, fmt.Errorf("unknown attribute %q", job.Attribute)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to save zk proof: %v", err)
+	}
+
+	return zkKeyPairID, nil
+}
+
+// saveEmailDomain keeps the domain of the verified address, which is only
+// known while the job holds the address, so that it can be proved to the
+// clients the user releases it to. The email stays verified when its domain
+// cannot be proved, it only comes without domain claims.
+func (p *Pool) saveEmailDomain(job models.ZkProofJob, nullifierKey []byte) error {
+	domain, _, err := zkverify.SplitEmailDomain(job.Input)
+	if err != nil {
+		if !errors.Is(err, zkverify.ErrUnsupportedEmailDomain) {
+			log.Printf("zk proof job %d: failed to read the email domain: %v", job.ID, err)
+		}
+		return p.repository.SaveUserEmailDomain(job.UserID, nil)
+	}
+
+	commitment, err := zkverify.EmailDomainCommitment(nullifierKey, domain)
+	if err != nil {
+		return fmt.Errorf("failed to commit to the email domain: %v", err)
+	}
+
+	return p.repository.SaveUserEmailDomain(job.UserID, &models.UserEmailDomain{
+		Domain:           domain,
+		NullifierKey:     nullifierKey,
+		DomainCommitment: commitment,
+	})
+}
+
+func (p *Pool) fail(ctx context.Context, job models.ZkProofJob, jobErr error) error {
+	p.finishedJobs.Add(ctx, 1, metric.WithAttributes(attribute.String("status", models.ZkProofJobFailed)))
+
+	if err := p.repository.FailZkProofJob(job.ID, jobErr.Error(), p.now()); err != nil {
+		return fmt.Errorf("failed to mark zk proof job %d as failed: %v", job.ID, err)
+	}
+
+	return fmt.Errorf("zk proof job %d failed: %v", job.ID, jobErr)
+}
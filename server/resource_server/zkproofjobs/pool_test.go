@@ -0,0 +1,363 @@
+package zkproofjobs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+
+	"globe-and-citizen/layer8/server/resource_server/models"
+	"globe-and-citizen/layer8/server/resource_server/utils"
+	"globe-and-citizen/layer8/server/zkverify"
+)
+
+type jobRepository struct {
+	mu                sync.Mutex
+	jobs              []models.ZkProofJob
+	emailProofs       map[uint][]byte
+	phoneNumberData   []models.PhoneNumberVerificationData
+	emailDomains      map[uint]*models.UserEmailDomain
+	saveEmailProofErr error
+}
+
+func (r *jobRepository) ClaimZkProofJob(now time.Time, staleBefore time.Time) (models.ZkProofJob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, job := range r.jobs {
+		stale := job.Status == models.ZkProofJobRunning && job.StartedAt.Before(staleBefore)
+		if job.Status == models.ZkProofJobPending || stale {
+			r.jobs[i].Status = models.ZkProofJobRunning
+			r.jobs[i].Attempts++
+			r.jobs[i].StartedAt = &now
+			return r.jobs[i], nil
+		}
+	}
+	return models.ZkProofJob{}, gorm.ErrRecordNotFound
+}
+
+func (r *jobRepository) CompleteZkProofJob(id uint, zkKeyPairID uint, finishedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job := &r.jobs[id-1]
+	job.Status = models.ZkProofJobDone
+	job.ZkKeyPairID = &zkKeyPairID
+	job.FinishedAt = &finishedAt
+	job.Input = ""
+	return nil
+}
+
+func (r *jobRepository) FailZkProofJob(id uint, jobError string, finishedAt time.Time) error {
+	job := &r.jobs[id-1]
+	job.Status = models.ZkProofJobFailed
+	job.Error = jobError
+	job.FinishedAt = &finishedAt
+	job.Input = ""
+	return nil
+}
+
+func (r *jobRepository) ExpireZkProofJobs(queuedBefore time.Time, finishedAt time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var expired int64
+	for i, job := range r.jobs {
+		if !job.Finished() && job.CreatedAt.Before(queuedBefore) {
+			r.jobs[i].Status = models.ZkProofJobFailed
+			r.jobs[i].FinishedAt = &finishedAt
+			r.jobs[i].Input = ""
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+func (r *jobRepository) CountPendingZkProofJobs() (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var count int64
+	for _, job := range r.jobs {
+		if job.Status == models.ZkProofJobPending {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *jobRepository) FindUser(userID uint) (models.User, error) {
+	return models.User{ID: userID, Salt: "salt"}, nil
+}
+
+func (r *jobRepository) SaveProofOfEmailVerification(
+	userID uint, verificationCode string, proof []byte, zkKeyPairId uint,
+) error {
+	if r.saveEmailProofErr != nil {
+		return r.saveEmailProofErr
+	}
+	r.emailProofs[userID] = proof
+	return nil
+}
+
+func (r *jobRepository) SavePhoneNumberVerificationData(data models.PhoneNumberVerificationData) error {
+	r.phoneNumberData = append(r.phoneNumberData, data)
+	return nil
+}
+
+func (r *jobRepository) SaveUserEmailDomain(userID uint, emailDomain *models.UserEmailDomain) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.emailDomains == nil {
+		r.emailDomains = map[uint]*models.UserEmailDomain{}
+	}
+	r.emailDomains[userID] = emailDomain
+	return nil
+}
+
+type prover struct {
+	calls        int
+	err          error
+	nullifierKey []byte
+}
+
+func (p *prover) GenerateProof(
+	input string, salt string, verificationCode string, nullifierKey []byte,
+) ([]byte, uint, error) {
+	p.calls++
+	p.nullifierKey = nullifierKey
+	if p.err != nil {
+		return nil, 0, p.err
+	}
+	return []byte(input + salt + verificationCode), 7, nil
+}
+
+var testNow = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestPool(repository *jobRepository, prover *prover) *Pool {
+	pool := NewPool(repository, prover, 1, 15*time.Minute)
+	pool.now = func() time.Time { return testNow }
+	return pool
+}
+
+func newJob(id uint, attribute string) models.ZkProofJob {
+	return models.ZkProofJob{
+		ID:               id,
+		UserID:           3,
+		Attribute:        attribute,
+		Input:            "input",
+		VerificationCode: "a1b2c3",
+		Status:           models.ZkProofJobPending,
+		CreatedAt:        testNow.Add(-time.Minute),
+	}
+}
+
+func TestPool_ProcessNextEmpty(t *testing.T) {
+	repository := &jobRepository{}
+	prover := &prover{}
+
+	processed, err := newTestPool(repository, prover).ProcessNext(context.Background())
+
+	assert.Nil(t, err)
+	assert.False(t, processed)
+	assert.Equal(t, 0, prover.calls)
+}
+
+func TestPool_ProcessNextEmail(t *testing.T) {
+	job := newJob(1, models.ZkProofJobEmail)
+	job.Input = "someone@mit.edu"
+	repository := &jobRepository{
+		jobs:        []models.ZkProofJob{job},
+		emailProofs: map[uint][]byte{},
+	}
+
+	prover := &prover{}
+
+	processed, err := newTestPool(repository, prover).ProcessNext(context.Background())
+
+	assert.Nil(t, err)
+	assert.True(t, processed)
+	assert.Equal(t, []byte("someone@mit.edusalta1b2c3"), repository.emailProofs[3])
+	assert.Equal(t, models.ZkProofJobDone, repository.jobs[0].Status)
+	assert.Equal(t, uint(7), *repository.jobs[0].ZkKeyPairID)
+	assert.Empty(t, repository.jobs[0].Input)
+	assert.Equal(t, "mit.edu", repository.emailDomains[3].Domain)
+	assert.Len(t, repository.emailDomains[3].NullifierKey, nullifierKeySize)
+	// the proof commits to the domain under the key kept with it
+	assert.Equal(t, prover.nullifierKey, repository.emailDomains[3].NullifierKey)
+	commitment, _ := zkverify.EmailDomainCommitment(prover.nullifierKey, "mit.edu")
+	assert.Equal(t, commitment, repository.emailDomains[3].DomainCommitment)
+}
+
+func TestPool_ProcessNextEmailReplacesNullifierKey(t *testing.T) {
+	first := newJob(1, models.ZkProofJobEmail)
+	first.Input = "someone@mit.edu"
+	second := newJob(2, models.ZkProofJobEmail)
+	second.Input = "someone.else@mit.edu"
+	repository := &jobRepository{
+		jobs:        []models.ZkProofJob{first, second},
+		emailProofs: map[uint][]byte{},
+	}
+	pool := newTestPool(repository, &prover{})
+
+	_, err := pool.ProcessNext(context.Background())
+	assert.Nil(t, err)
+	firstKey := repository.emailDomains[3].NullifierKey
+
+	_, err = pool.ProcessNext(context.Background())
+	assert.Nil(t, err)
+
+	// proofs about the new address cannot be linked to those about the old one
+	assert.NotEqual(t, firstKey, repository.emailDomains[3].NullifierKey)
+}
+
+func TestPool_ProcessNextEmailWithUnsupportedDomain(t *testing.T) {
+	job := newJob(1, models.ZkProofJobEmail)
+	job.Input = "someone@" + strings.Repeat("a", utils.MaxEmailDomainLength+1)
+	repository := &jobRepository{
+		jobs:         []models.ZkProofJob{job},
+		emailProofs:  map[uint][]byte{},
+		emailDomains: map[uint]*models.UserEmailDomain{3: {Domain: "previous.address"}},
+	}
+
+	processed, err := newTestPool(repository, &prover{}).ProcessNext(context.Background())
+
+	assert.Nil(t, err)
+	assert.True(t, processed)
+	assert.Equal(t, models.ZkProofJobDone, repository.jobs[0].Status)
+	assert.NotEmpty(t, repository.emailProofs[3])
+	assert.Contains(t, repository.emailDomains, uint(3))
+	assert.Nil(t, repository.emailDomains[3])
+}
+
+func TestPool_ProcessNextPhoneNumber(t *testing.T) {
+	repository := &jobRepository{
+		jobs: []models.ZkProofJob{newJob(1, models.ZkProofJobPhoneNumber)},
+	}
+	prover := &prover{}
+
+	processed, err := newTestPool(repository, prover).ProcessNext(context.Background())
+
+	assert.Nil(t, err)
+	assert.True(t, processed)
+	assert.Nil(t, prover.nullifierKey)
+	assert.Equal(t, []models.PhoneNumberVerificationData{{
+		UserId:           3,
+		VerificationCode: "a1b2c3",
+		ExpiresAt:        testNow.Add(14 * time.Minute),
+		ZkProof:          []byte("inputsalta1b2c3"),
+		ZkPairID:         7,
+	}}, repository.phoneNumberData)
+	assert.Equal(t, models.ZkProofJobDone, repository.jobs[0].Status)
+}
+
+func TestPool_ProcessNextProvingFails(t *testing.T) {
+	repository := &jobRepository{
+		jobs: []models.ZkProofJob{newJob(1, models.ZkProofJobEmail)},
+	}
+
+	processed, err := newTestPool(repository, &prover{err: errors.New("no keys")}).ProcessNext(context.Background())
+
+	assert.NotNil(t, err)
+	assert.True(t, processed)
+	assert.Equal(t, models.ZkProofJobFailed, repository.jobs[0].Status)
+	assert.Contains(t, repository.jobs[0].Error, "no keys")
+	assert.Empty(t, repository.jobs[0].Input)
+}
+
+func TestPool_ProcessNextSavingFails(t *testing.T) {
+	repository := &jobRepository{
+		jobs:              []models.ZkProofJob{newJob(1, models.ZkProofJobEmail)},
+		saveEmailProofErr: errors.New("connection reset"),
+	}
+
+	_, err := newTestPool(repository, &prover{}).ProcessNext(context.Background())
+
+	assert.NotNil(t, err)
+	assert.Equal(t, models.ZkProofJobFailed, repository.jobs[0].Status)
+}
+
+func TestPool_ProcessNextReclaimsStaleJob(t *testing.T) {
+	startedAt := testNow.Add(-staleAfter - time.Second)
+	job := newJob(1, models.ZkProofJobEmail)
+	job.Status = models.ZkProofJobRunning
+	job.Attempts = 1
+	job.StartedAt = &startedAt
+	repository := &jobRepository{jobs: []models.ZkProofJob{job}, emailProofs: map[uint][]byte{}}
+
+	processed, err := newTestPool(repository, &prover{}).ProcessNext(context.Background())
+
+	assert.Nil(t, err)
+	assert.True(t, processed)
+	assert.Equal(t, models.ZkProofJobDone, repository.jobs[0].Status)
+	assert.Equal(t, 2, repository.jobs[0].Attempts)
+}
+
+func TestPool_ProcessNextGivesUpAfterMaxAttempts(t *testing.T) {
+	startedAt := testNow.Add(-staleAfter - time.Second)
+	job := newJob(1, models.ZkProofJobEmail)
+	job.Status = models.ZkProofJobRunning
+	job.Attempts = maxAttempts
+	job.StartedAt = &startedAt
+	repository := &jobRepository{jobs: []models.ZkProofJob{job}}
+	prover := &prover{}
+
+	_, err := newTestPool(repository, prover).ProcessNext(context.Background())
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, prover.calls)
+	assert.Equal(t, models.ZkProofJobFailed, repository.jobs[0].Status)
+}
+
+func TestPool_ExpireStaleJobs(t *testing.T) {
+	abandoned := newJob(1, models.ZkProofJobEmail)
+	abandoned.CreatedAt = testNow.Add(-expireAfter - time.Second)
+	running := newJob(2, models.ZkProofJobPhoneNumber)
+	running.CreatedAt = testNow.Add(-expireAfter - time.Second)
+	running.Status = models.ZkProofJobRunning
+	recent := newJob(3, models.ZkProofJobEmail)
+	repository := &jobRepository{jobs: []models.ZkProofJob{abandoned, running, recent}}
+
+	err := newTestPool(repository, &prover{}).ExpireStaleJobs(context.Background())
+
+	assert.Nil(t, err)
+	for _, job := range repository.jobs[:2] {
+		assert.Equal(t, models.ZkProofJobFailed, job.Status)
+		assert.Empty(t, job.Input)
+	}
+	assert.Equal(t, models.ZkProofJobPending, repository.jobs[2].Status)
+	assert.Equal(t, "input", repository.jobs[2].Input)
+}
+
+func TestPool_RunStopsWithContext(t *testing.T) {
+	repository := &jobRepository{
+		jobs:        []models.ZkProofJob{newJob(1, models.ZkProofJobEmail), newJob(2, models.ZkProofJobEmail)},
+		emailProofs: map[uint][]byte{},
+	}
+	pool := newTestPool(repository, &prover{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		count, _ := repository.CountPendingZkProofJobs()
+		return count == 0
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * pollInterval):
+		t.Fatal("pool did not stop")
+	}
+}
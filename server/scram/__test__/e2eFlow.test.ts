@@ -234,6 +234,7 @@ const resetPassword = async () => {
             },
             body: JSON.stringify({
                 username: loginUsername,
+                challenge: resetPasswordPrecheckResponseBody.data.challenge,
                 signature: Array.from(signature),
                 stored_key: data.storedKey,
                 server_key: data.serverKey,
@@ -314,7 +315,7 @@ describe('Perform a Register and Login flow and match their keys', () => {
     test('call the resetPassword function, and match their keys', async () => {
         const alert = jest.fn();
         const modalWindowActive = { value: false };
-        const mockResponsePrecheck = { data: { salt: 'mock-salt', iterationCount: 4096 } };
+        const mockResponsePrecheck = { data: { salt: 'mock-salt', iterationCount: 4096, challenge: 'mock-challenge' } };
         const mockResponseResetPasword = { is_success: true, message: 'Password reset successfully' };
 
         fetchMock.mockResponses(
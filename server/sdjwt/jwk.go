@@ -0,0 +1,76 @@
+package sdjwt
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// JWK is an Ed25519 public key in the RFC 8037 JSON Web Key format.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+func NewJWK(pub ed25519.PublicKey) JWK {
+	return JWK{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(pub),
+		KeyID:     Thumbprint(pub),
+		Algorithm: "EdDSA",
+		Use:       "sig",
+	}
+}
+
+// PublicKey decodes the key, rejecting anything but Ed25519 signing keys.
+func (k JWK) PublicKey() (ed25519.PublicKey, error) {
+	if k.KeyType != "OKP" || k.Curve != "Ed25519" {
+		return nil, fmt.Errorf("unsupported key type %s/%s", k.KeyType, k.Curve)
+	}
+
+	pub, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 public key")
+	}
+
+	return ed25519.PublicKey(pub), nil
+}
+
+// KeySet is a JWK Set as served by the issuer.
+type KeySet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (s KeySet) Lookup(keyID string) (ed25519.PublicKey, error) {
+	for _, key := range s.Keys {
+		if key.KeyID == keyID {
+			return key.PublicKey()
+		}
+	}
+
+	return nil, fmt.Errorf("unknown issuer key: %q", keyID)
+}
+
+// IssuerMetadata is the JWT VC issuer metadata document verifiers fetch from
+// /.well-known/jwt-vc-issuer to learn the issuer keys.
+type IssuerMetadata struct {
+	Issuer string `json:"issuer"`
+	JWKS   KeySet `json:"jwks"`
+}
+
+// Thumbprint computes the RFC 7638 JWK thumbprint of an Ed25519 key. The
+// members are hashed in lexicographic order, as the RFC requires.
+func Thumbprint(pub ed25519.PublicKey) string {
+	canonical := fmt.Sprintf(
+		`{"crv":"Ed25519","kty":"OKP","x":"%s"}`,
+		base64.RawURLEncoding.EncodeToString(pub),
+	)
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,400 @@
+// Package sdjwt issues and verifies Selective Disclosure JWTs
+// (draft-ietf-oauth-selective-disclosure-jwt). Only top-level object claims
+// can be made selectively disclosable, and the issuer and holder sign with
+// Ed25519. A credential bound to a holder key is only accepted with a key
+// binding JWT, so a presentation copied by a verifier cannot be replayed.
+//
+// The package has no dependency on the rest of the server, so service
+// providers can use Verify to check credentials offline against the keys
+// Layer8 publishes.
+package sdjwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// HashAlgorithm is the only disclosure digest algorithm issued and accepted.
+	HashAlgorithm = "sha-256"
+	// TokenType is the typ header of the issuer-signed JWT.
+	TokenType = "vc+sd-jwt"
+	// KeyBindingTokenType is the typ header of the key binding JWT.
+	KeyBindingTokenType = "kb+jwt"
+	// KeyBindingMaxAge is how long after it was signed a key binding JWT is
+	// accepted.
+	KeyBindingMaxAge = 5 * time.Minute
+
+	separator = "~"
+	saltSize  = 16
+
+	digestsClaim       = "_sd"
+	digestAlgorithmKey = "_sd_alg"
+	confirmationClaim  = "cnf"
+)
+
+// Disclosure is a selectively disclosable claim: a salted name/value pair
+// whose digest is signed by the issuer in place of the claim itself.
+type Disclosure struct {
+	Salt  string
+	Name  string
+	Value interface{}
+
+	encoded string
+}
+
+// NewDisclosure salts the claim and encodes it as
+// base64url(json([salt, name, value])).
+func NewDisclosure(name string, value interface{}) (Disclosure, error) {
+	if name == "" || name == digestsClaim || name == "..." {
+		return Disclosure{}, fmt.Errorf("claim name %q cannot be disclosed selectively", name)
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return Disclosure{}, fmt.Errorf("failed to generate disclosure salt: %v", err)
+	}
+
+	d := Disclosure{
+		Salt:  base64.RawURLEncoding.EncodeToString(salt),
+		Name:  name,
+		Value: value,
+	}
+
+	raw, err := json.Marshal([]interface{}{d.Salt, d.Name, d.Value})
+	if err != nil {
+		return Disclosure{}, fmt.Errorf("failed to encode disclosure: %v", err)
+	}
+	d.encoded = base64.RawURLEncoding.EncodeToString(raw)
+
+	return d, nil
+}
+
+// Encoded returns the disclosure as it appears in an SD-JWT.
+func (d Disclosure) Encoded() string {
+	return d.encoded
+}
+
+// Digest returns the value the issuer signs in the _sd claim.
+func (d Disclosure) Digest() string {
+	return digest(d.encoded)
+}
+
+func digest(encoded string) string {
+	sum := sha256.Sum256([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func parseDisclosure(encoded string) (Disclosure, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Disclosure{}, fmt.Errorf("disclosure is not base64url encoded: %v", err)
+	}
+
+	var parts []json.RawMessage
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return Disclosure{}, fmt.Errorf("disclosure is not a json array: %v", err)
+	}
+	if len(parts) != 3 {
+		return Disclosure{}, fmt.Errorf("disclosure must have 3 elements, got %d", len(parts))
+	}
+
+	d := Disclosure{encoded: encoded}
+	if err := json.Unmarshal(parts[0], &d.Salt); err != nil {
+		return Disclosure{}, fmt.Errorf("disclosure salt is not a string")
+	}
+	if err := json.Unmarshal(parts[1], &d.Name); err != nil {
+		return Disclosure{}, fmt.Errorf("disclosure claim name is not a string")
+	}
+	if err := json.Unmarshal(parts[2], &d.Value); err != nil {
+		return Disclosure{}, fmt.Errorf("disclosure value is invalid: %v", err)
+	}
+
+	return d, nil
+}
+
+// Confirmation returns the cnf claim that binds a credential to the holder
+// key, see RFC 7800.
+func Confirmation(holderKey JWK) map[string]interface{} {
+	return map[string]interface{}{"jwk": holderKey}
+}
+
+// Issuer signs SD-JWTs with an Ed25519 key.
+type Issuer struct {
+	key   ed25519.PrivateKey
+	keyID string
+}
+
+func NewIssuer(key ed25519.PrivateKey) *Issuer {
+	return &Issuer{
+		key:   key,
+		keyID: Thumbprint(key.Public().(ed25519.PublicKey)),
+	}
+}
+
+// KeyID is the kid header of issued credentials, the RFC 7638 thumbprint of
+// the public key.
+func (i *Issuer) KeyID() string {
+	return i.keyID
+}
+
+// PublicJWK returns the key verifiers need to check credentials from this
+// issuer.
+func (i *Issuer) PublicJWK() JWK {
+	return NewJWK(i.key.Public().(ed25519.PublicKey))
+}
+
+// Issue signs claims together with the digests of the disclosures and returns
+// the SD-JWT carrying every disclosure. The holder removes the disclosures it
+// does not want to reveal with Present.
+func (i *Issuer) Issue(claims map[string]interface{}, disclosures []Disclosure) (string, error) {
+	payload := jwt.MapClaims{}
+	for name, value := range claims {
+		payload[name] = value
+	}
+
+	digests := make([]string, 0, len(disclosures))
+	for _, d := range disclosures {
+		if _, ok := payload[d.Name]; ok {
+			return "", fmt.Errorf("claim %s is both disclosed selectively and always", d.Name)
+		}
+		digests = append(digests, d.Digest())
+	}
+	// sorted so the order does not hint at which claim a digest belongs to
+	slices.Sort(digests)
+
+	payload[digestsClaim] = digests
+	payload[digestAlgorithmKey] = HashAlgorithm
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, payload)
+	token.Header["typ"] = TokenType
+	token.Header["kid"] = i.keyID
+
+	signed, err := token.SignedString(i.key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign credential: %v", err)
+	}
+
+	var b strings.Builder
+	b.WriteString(signed)
+	b.WriteString(separator)
+	for _, d := range disclosures {
+		b.WriteString(d.encoded)
+		b.WriteString(separator)
+	}
+
+	return b.String(), nil
+}
+
+// Present keeps only the disclosures of the named claims, producing the SD-JWT
+// the holder hands to a verifier once bound with Bind.
+func Present(sdJWT string, claimNames ...string) (string, error) {
+	issuerJWT, encodedDisclosures, keyBindingJWT, err := split(sdJWT)
+	if err != nil {
+		return "", err
+	}
+	if keyBindingJWT != "" {
+		return "", fmt.Errorf("sd-jwt is already bound to a presentation")
+	}
+
+	var b strings.Builder
+	b.WriteString(issuerJWT)
+	b.WriteString(separator)
+	for _, encoded := range encodedDisclosures {
+		d, err := parseDisclosure(encoded)
+		if err != nil {
+			return "", err
+		}
+		if slices.Contains(claimNames, d.Name) {
+			b.WriteString(encoded)
+			b.WriteString(separator)
+		}
+	}
+
+	return b.String(), nil
+}
+
+// Bind appends the key binding JWT to a presentation made with Present. It is
+// signed with the holder key the credential was issued to and names the
+// verifier and its nonce, so it is only accepted by that verifier, once.
+func Bind(presentation string, holderKey ed25519.PrivateKey, audience string, nonce string) (string, error) {
+	if !strings.HasSuffix(presentation, separator) {
+		return "", fmt.Errorf("presentation must end with a separator")
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{
+		"iat":     time.Now().Unix(),
+		"aud":     audience,
+		"nonce":   nonce,
+		"sd_hash": digest(presentation),
+	})
+	token.Header["typ"] = KeyBindingTokenType
+
+	signed, err := token.SignedString(holderKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign key binding: %v", err)
+	}
+
+	return presentation + signed, nil
+}
+
+// Verify checks the issuer signature against keys and returns the claims the
+// presentation reveals: the always disclosed claims plus every disclosure
+// included. Expired credentials are rejected. A credential bound to a holder
+// key must come with a key binding JWT for audience and nonce.
+func Verify(presentation string, keys KeySet, audience string, nonce string) (map[string]interface{}, error) {
+	issuerJWT, encodedDisclosures, keyBindingJWT, err := split(presentation)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := jwt.Parse(issuerJWT, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodEd25519); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return keys.Lookup(kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify the issuer signature: %v", err)
+	}
+	if typ, _ := token.Header["typ"].(string); typ != TokenType {
+		return nil, fmt.Errorf("unexpected token type: %q", typ)
+	}
+
+	payload := token.Claims.(jwt.MapClaims)
+	if alg, _ := payload[digestAlgorithmKey].(string); alg != HashAlgorithm {
+		return nil, fmt.Errorf("unsupported disclosure digest algorithm: %q", alg)
+	}
+
+	if confirmation, ok := payload[confirmationClaim]; ok {
+		holderKey, err := confirmationKey(confirmation)
+		if err != nil {
+			return nil, err
+		}
+		if keyBindingJWT == "" {
+			return nil, fmt.Errorf("credential is bound to a holder key, the key binding is missing")
+		}
+		presented := strings.TrimSuffix(presentation, keyBindingJWT)
+		if err := verifyKeyBinding(keyBindingJWT, holderKey, presented, audience, nonce); err != nil {
+			return nil, err
+		}
+	} else if keyBindingJWT != "" {
+		return nil, fmt.Errorf("credential is not bound to a holder key")
+	}
+
+	signedDigests := map[string]bool{}
+	if rawDigests, ok := payload[digestsClaim].([]interface{}); ok {
+		for _, raw := range rawDigests {
+			if value, ok := raw.(string); ok {
+				signedDigests[value] = true
+			}
+		}
+	}
+
+	claims := map[string]interface{}{}
+	for name, value := range payload {
+		if name != digestsClaim && name != digestAlgorithmKey {
+			claims[name] = value
+		}
+	}
+
+	for _, encoded := range encodedDisclosures {
+		d, err := parseDisclosure(encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		dgst := d.Digest()
+		if !signedDigests[dgst] {
+			return nil, fmt.Errorf("disclosure of %s is not signed by the issuer", d.Name)
+		}
+		// a digest is consumed once so a disclosure cannot be repeated
+		delete(signedDigests, dgst)
+
+		if _, ok := claims[d.Name]; ok {
+			return nil, fmt.Errorf("claim %s is disclosed more than once", d.Name)
+		}
+		claims[d.Name] = d.Value
+	}
+
+	return claims, nil
+}
+
+// confirmationKey decodes the holder key of the cnf claim.
+func confirmationKey(confirmation interface{}) (ed25519.PublicKey, error) {
+	raw, err := json.Marshal(confirmation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cnf claim: %v", err)
+	}
+
+	var cnf struct {
+		JWK *JWK `json:"jwk"`
+	}
+	if err := json.Unmarshal(raw, &cnf); err != nil || cnf.JWK == nil {
+		return nil, fmt.Errorf("cnf claim carries no holder key")
+	}
+
+	return cnf.JWK.PublicKey()
+}
+
+// verifyKeyBinding checks that the key binding JWT is signed by the holder
+// key, was made for this verifier and nonce recently, and covers exactly the
+// presented disclosures.
+func verifyKeyBinding(keyBindingJWT string, holderKey ed25519.PublicKey, presented string, audience string, nonce string) error {
+	// iat is checked below with the allowed age, exp is not used
+	token, err := jwt.Parse(keyBindingJWT, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodEd25519); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return holderKey, nil
+	}, jwt.WithoutClaimsValidation())
+	if err != nil {
+		return fmt.Errorf("failed to verify the key binding signature: %v", err)
+	}
+	if typ, _ := token.Header["typ"].(string); typ != KeyBindingTokenType {
+		return fmt.Errorf("unexpected key binding type: %q", typ)
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if !claims.VerifyAudience(audience, true) {
+		return fmt.Errorf("key binding was made for another verifier")
+	}
+	if value, _ := claims["nonce"].(string); nonce == "" || value != nonce {
+		return fmt.Errorf("key binding was made for another nonce")
+	}
+	if value, _ := claims["sd_hash"].(string); value != digest(presented) {
+		return fmt.Errorf("key binding does not cover the presented disclosures")
+	}
+
+	issuedAt, ok := claims["iat"].(float64)
+	if !ok {
+		return fmt.Errorf("key binding has no issue time")
+	}
+	age := time.Since(time.Unix(int64(issuedAt), 0))
+	if age > KeyBindingMaxAge || age < -KeyBindingMaxAge {
+		return fmt.Errorf("key binding is too old or from the future")
+	}
+
+	return nil
+}
+
+// split separates the issuer-signed JWT from the disclosures and the key
+// binding JWT, which is empty when the SD-JWT ends with a separator.
+func split(sdJWT string) (string, []string, string, error) {
+	parts := strings.Split(sdJWT, separator)
+	if len(parts) < 2 {
+		return "", nil, "", fmt.Errorf("sd-jwt has no disclosure separator")
+	}
+
+	return parts[0], parts[1 : len(parts)-1], parts[len(parts)-1], nil
+}
@@ -0,0 +1,207 @@
+package sdjwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestIssuer(t *testing.T) *Issuer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewIssuer(key)
+}
+
+func newTestHolderKey(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func issueTestCredential(t *testing.T, issuer *Issuer, expiresAt time.Time) string {
+	return issueTestCredentialWithClaims(t, issuer, map[string]interface{}{
+		"iss": "https://layer8.example",
+		"exp": expiresAt.Unix(),
+	})
+}
+
+func issueBoundTestCredential(t *testing.T, issuer *Issuer, holderKey ed25519.PrivateKey) string {
+	return issueTestCredentialWithClaims(t, issuer, map[string]interface{}{
+		"iss": "https://layer8.example",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"cnf": Confirmation(NewJWK(holderKey.Public().(ed25519.PublicKey))),
+	})
+}
+
+func issueTestCredentialWithClaims(t *testing.T, issuer *Issuer, claims map[string]interface{}) string {
+	email, err := NewDisclosure("email_verified", map[string]interface{}{"verified": true})
+	assert.Nil(t, err)
+	phone, err := NewDisclosure("phone_number_verified", map[string]interface{}{"verified": true})
+	assert.Nil(t, err)
+
+	sdJWT, err := issuer.Issue(claims, []Disclosure{email, phone})
+	assert.Nil(t, err)
+
+	return sdJWT
+}
+
+func TestVerify_PresentationRevealsOnlySelectedClaims(t *testing.T) {
+	issuer := newTestIssuer(t)
+	holderKey := newTestHolderKey(t)
+	sdJWT := issueBoundTestCredential(t, issuer, holderKey)
+
+	presentation, err := Present(sdJWT, "email_verified")
+	assert.Nil(t, err)
+	presentation, err = Bind(presentation, holderKey, "https://sp.example", "nonce")
+	assert.Nil(t, err)
+
+	claims, err := Verify(presentation, KeySet{Keys: []JWK{issuer.PublicJWK()}}, "https://sp.example", "nonce")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "https://layer8.example", claims["iss"])
+	assert.Equal(t, map[string]interface{}{"verified": true}, claims["email_verified"])
+	assert.NotContains(t, claims, "phone_number_verified")
+	assert.NotContains(t, claims, "_sd")
+}
+
+func TestVerify_UnknownIssuerKey(t *testing.T) {
+	sdJWT := issueTestCredential(t, newTestIssuer(t), time.Now().Add(time.Hour))
+
+	_, err := Verify(sdJWT, KeySet{Keys: []JWK{newTestIssuer(t).PublicJWK()}}, "", "")
+
+	assert.NotNil(t, err)
+}
+
+func TestVerify_ExpiredCredential(t *testing.T) {
+	issuer := newTestIssuer(t)
+	sdJWT := issueTestCredential(t, issuer, time.Now().Add(-time.Minute))
+
+	_, err := Verify(sdJWT, KeySet{Keys: []JWK{issuer.PublicJWK()}}, "", "")
+
+	assert.NotNil(t, err)
+}
+
+func TestVerify_DisclosureNotSignedByIssuer(t *testing.T) {
+	issuer := newTestIssuer(t)
+	sdJWT := issueTestCredential(t, issuer, time.Now().Add(time.Hour))
+
+	forged, err := NewDisclosure("email_verified", map[string]interface{}{"verified": true})
+	assert.Nil(t, err)
+
+	issuerJWT := strings.SplitN(sdJWT, separator, 2)[0]
+	_, err = Verify(issuerJWT+separator+forged.Encoded()+separator, KeySet{Keys: []JWK{issuer.PublicJWK()}}, "", "")
+
+	assert.NotNil(t, err)
+}
+
+func TestVerify_RepeatedDisclosure(t *testing.T) {
+	issuer := newTestIssuer(t)
+	sdJWT := issueTestCredential(t, issuer, time.Now().Add(time.Hour))
+
+	parts := strings.Split(sdJWT, separator)
+	repeated := parts[0] + separator + parts[1] + separator + parts[1] + separator
+
+	_, err := Verify(repeated, KeySet{Keys: []JWK{issuer.PublicJWK()}}, "", "")
+
+	assert.NotNil(t, err)
+}
+
+func TestVerify_KeyBindingMissing(t *testing.T) {
+	issuer := newTestIssuer(t)
+	sdJWT := issueBoundTestCredential(t, issuer, newTestHolderKey(t))
+
+	// a presentation copied from another verifier without the holder key
+	presentation, err := Present(sdJWT, "email_verified")
+	assert.Nil(t, err)
+
+	_, err = Verify(presentation, KeySet{Keys: []JWK{issuer.PublicJWK()}}, "https://sp.example", "nonce")
+
+	assert.NotNil(t, err)
+}
+
+func TestVerify_KeyBindingRejected(t *testing.T) {
+	issuer := newTestIssuer(t)
+	holderKey := newTestHolderKey(t)
+	sdJWT := issueBoundTestCredential(t, issuer, holderKey)
+
+	presentation, err := Present(sdJWT, "email_verified")
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name      string
+		holderKey ed25519.PrivateKey
+		audience  string
+		nonce     string
+	}{
+		{name: "another holder", holderKey: newTestHolderKey(t), audience: "https://sp.example", nonce: "nonce"},
+		{name: "another verifier", holderKey: holderKey, audience: "https://other-sp.example", nonce: "nonce"},
+		{name: "another nonce", holderKey: holderKey, audience: "https://sp.example", nonce: "other nonce"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bound, err := Bind(presentation, tt.holderKey, tt.audience, tt.nonce)
+			assert.Nil(t, err)
+
+			_, err = Verify(bound, KeySet{Keys: []JWK{issuer.PublicJWK()}}, "https://sp.example", "nonce")
+
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestVerify_DisclosureAddedAfterKeyBinding(t *testing.T) {
+	issuer := newTestIssuer(t)
+	holderKey := newTestHolderKey(t)
+	sdJWT := issueBoundTestCredential(t, issuer, holderKey)
+
+	presentation, err := Present(sdJWT, "email_verified")
+	assert.Nil(t, err)
+	bound, err := Bind(presentation, holderKey, "https://sp.example", "nonce")
+	assert.Nil(t, err)
+
+	parts := strings.Split(sdJWT, separator)
+	keyBindingJWT := strings.TrimPrefix(bound, presentation)
+	extended := presentation + parts[2] + separator + keyBindingJWT
+
+	_, err = Verify(extended, KeySet{Keys: []JWK{issuer.PublicJWK()}}, "https://sp.example", "nonce")
+
+	assert.NotNil(t, err)
+}
+
+func TestVerify_KeyBindingOfUnboundCredential(t *testing.T) {
+	issuer := newTestIssuer(t)
+	sdJWT := issueTestCredential(t, issuer, time.Now().Add(time.Hour))
+
+	bound, err := Bind(sdJWT, newTestHolderKey(t), "https://sp.example", "nonce")
+	assert.Nil(t, err)
+
+	_, err = Verify(bound, KeySet{Keys: []JWK{issuer.PublicJWK()}}, "https://sp.example", "nonce")
+
+	assert.NotNil(t, err)
+}
+
+func TestIssue_ClaimDisclosedSelectivelyAndAlways(t *testing.T) {
+	d, err := NewDisclosure("email_verified", true)
+	assert.Nil(t, err)
+
+	_, err = newTestIssuer(t).Issue(map[string]interface{}{"email_verified": true}, []Disclosure{d})
+
+	assert.NotNil(t, err)
+}
+
+func TestThumbprint_RFC8037Example(t *testing.T) {
+	// RFC 8037 appendix A.3
+	jwk := JWK{KeyType: "OKP", Curve: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	pub, err := jwk.PublicKey()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", Thumbprint(pub))
+}
@@ -0,0 +1,106 @@
+package totp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const recoveryCodeSize = 8
+
+// EncryptionKey returns the AES-256 key the shared secrets are stored under,
+// given base64 encoded in TOTP_ENCRYPTION_KEY.
+func EncryptionKey() ([]byte, error) {
+	value := os.Getenv("TOTP_ENCRYPTION_KEY")
+	if value == "" {
+		return nil, errors.New("TOTP_ENCRYPTION_KEY is not set")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding TOTP_ENCRYPTION_KEY: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, errors.New("TOTP_ENCRYPTION_KEY must be 32 bytes long")
+	}
+
+	return key, nil
+}
+
+// EncryptSecret seals a shared secret with AES-GCM, the random nonce is
+// stored in front of the ciphertext.
+func EncryptSecret(key []byte, secret string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func DecryptSecret(key []byte, encryptedSecret string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encryptedSecret)
+	if err != nil {
+		return "", fmt.Errorf("error decoding encrypted totp secret: %v", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted totp secret is too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	secret, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting totp secret: %v", err)
+	}
+
+	return string(secret), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// GenerateRecoveryCodes returns n single-use codes of the form xxxx-xxxx-xxxx-xxxx.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		random := make([]byte, recoveryCodeSize)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+
+		code := hex.EncodeToString(random)
+		codes[i] = strings.Join([]string{code[0:4], code[4:8], code[8:12], code[12:16]}, "-")
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode is how a recovery code is stored. The codes are random
+// enough for an unsalted hash.
+func HashRecoveryCode(code string) string {
+	normalized := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(code)), "-", "")
+	hash := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,134 @@
+package totp
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+
+	"globe-and-citizen/layer8/server/constants"
+)
+
+// the SHA-1 secret of the test vectors of RFC 6238 appendix B
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode_RFC6238Vectors(t *testing.T) {
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, expected := range vectors {
+		code, err := Code(rfcSecret, Step(time.Unix(unix, 0)))
+
+		assert.Nil(t, err)
+		assert.Equal(t, expected, code, "at %d", unix)
+	}
+}
+
+func TestValidate_AcceptsAdjacentStepsOnce(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	previous, _ := Code(rfcSecret, Step(now)-1)
+
+	step, ok, err := Validate(rfcSecret, previous, now, 0)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now)-1, step)
+
+	_, ok, _ = Validate(rfcSecret, previous, now, step)
+	assert.False(t, ok)
+
+	tooOld, _ := Code(rfcSecret, Step(now)-2)
+	_, ok, _ = Validate(rfcSecret, tooOld, now, 0)
+	assert.False(t, ok)
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("Layer8", "alice smith", "ABC")
+
+	assert.Equal(t, "otpauth://totp/Layer8:alice%20smith?algorithm=SHA1&digits=6&issuer=Layer8&period=30&secret=ABC", uri)
+}
+
+func TestEncryptSecret_RoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+
+	encrypted, err := EncryptSecret(key, rfcSecret)
+	assert.Nil(t, err)
+	assert.NotContains(t, encrypted, rfcSecret)
+
+	secret, err := DecryptSecret(key, encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, rfcSecret, secret)
+
+	otherKey := make([]byte, 32)
+	otherKey[0] = 1
+	_, err = DecryptSecret(otherKey, encrypted)
+	assert.NotNil(t, err)
+}
+
+func TestEncryptionKey(t *testing.T) {
+	t.Setenv("TOTP_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(make([]byte, 16)))
+	_, err := EncryptionKey()
+	assert.NotNil(t, err)
+
+	t.Setenv("TOTP_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	key, err := EncryptionKey()
+	assert.Nil(t, err)
+	assert.Len(t, key, 32)
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+
+	assert.Nil(t, err)
+	assert.Len(t, codes, 10)
+	assert.Len(t, codes[0], 19)
+	assert.Equal(t, HashRecoveryCode(codes[0]), HashRecoveryCode(" "+strings.ToUpper(codes[0])))
+	assert.NotEqual(t, codes[0], codes[1])
+}
+
+type memoryStore struct {
+	lastUsedStep int64
+	unusedCodes  map[string]bool
+}
+
+func (s *memoryStore) UseTwoFactorStep(credentialID uint, step int64) error {
+	if step <= s.lastUsedStep {
+		return gorm.ErrRecordNotFound
+	}
+	s.lastUsedStep = step
+	return nil
+}
+
+func (s *memoryStore) UseTwoFactorRecoveryCode(credentialID uint, codeHash string, usedAt time.Time) error {
+	if !s.unusedCodes[codeHash] {
+		return gorm.ErrRecordNotFound
+	}
+	s.unusedCodes[codeHash] = false
+	return nil
+}
+
+func TestVerify(t *testing.T) {
+	key := make([]byte, 32)
+	encrypted, _ := EncryptSecret(key, rfcSecret)
+	credential := Credential{ID: 1, EncryptedSecret: encrypted}
+	store := &memoryStore{unusedCodes: map[string]bool{HashRecoveryCode("aaaa-bbbb-cccc-dddd"): true}}
+	now := time.Unix(1111111111, 0)
+
+	assert.ErrorIs(t, Verify(store, key, credential, "000000", now), constants.ErrInvalidTwoFactorCode)
+
+	assert.Nil(t, Verify(store, key, credential, "050471", now))
+	assert.Equal(t, Step(now), store.lastUsedStep)
+
+	// replayed before the stored credential was reloaded
+	assert.ErrorIs(t, Verify(store, key, credential, "050471", now), constants.ErrInvalidTwoFactorCode)
+
+	assert.Nil(t, Verify(store, key, credential, "AAAA-BBBB-CCCC-DDDD", now))
+	assert.ErrorIs(t, Verify(store, key, credential, "aaaa-bbbb-cccc-dddd", now), constants.ErrInvalidTwoFactorCode)
+}
@@ -0,0 +1,64 @@
+package totp
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"globe-and-citizen/layer8/server/constants"
+)
+
+// Store marks codes as used. Both the resource server and the authorization
+// server repositories implement it, as logins to either can ask for a code.
+type Store interface {
+	// UseTwoFactorStep makes step the last used step of the credential. It
+	// returns gorm.ErrRecordNotFound unless step is after the last used one.
+	UseTwoFactorStep(credentialID uint, step int64) error
+	// UseTwoFactorRecoveryCode marks an unused recovery code of the credential
+	// as used. It returns gorm.ErrRecordNotFound if there is no such code.
+	UseTwoFactorRecoveryCode(credentialID uint, codeHash string, usedAt time.Time) error
+}
+
+// Credential is the part of a stored enrollment needed to check codes.
+type Credential struct {
+	ID              uint
+	EncryptedSecret string
+	LastUsedStep    int64
+}
+
+// Verify accepts a current code of the authenticator or an unused recovery
+// code and marks it as used, otherwise it fails with
+// constants.ErrInvalidTwoFactorCode.
+func Verify(store Store, key []byte, credential Credential, code string, now time.Time) error {
+	code = strings.TrimSpace(code)
+
+	if len(code) != Digits {
+		err := store.UseTwoFactorRecoveryCode(credential.ID, HashRecoveryCode(code), now)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return constants.ErrInvalidTwoFactorCode
+		}
+		return err
+	}
+
+	secret, err := DecryptSecret(key, credential.EncryptedSecret)
+	if err != nil {
+		return err
+	}
+
+	step, ok, err := Validate(secret, code, now, credential.LastUsedStep)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return constants.ErrInvalidTwoFactorCode
+	}
+
+	// a concurrent login may have used the same code first
+	err = store.UseTwoFactorStep(credential.ID, step)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return constants.ErrInvalidTwoFactorCode
+	}
+	return err
+}
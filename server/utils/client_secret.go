@@ -0,0 +1,22 @@
+package utils
+
+import "golang.org/x/crypto/bcrypt"
+
+// HashClientSecret returns the bcrypt hash under which a client secret is
+// stored. The secret itself is only ever shown to the client once.
+func HashClientSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CompareClientSecret reports whether secret matches the stored hash. An empty
+// hash, left by a client that was never issued a secret, matches nothing.
+func CompareClientSecret(hash string, secret string) bool {
+	if hash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil
+}
@@ -0,0 +1,17 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareClientSecret(t *testing.T) {
+	hash, err := HashClientSecret("client_secret")
+	assert.Nil(t, err)
+	assert.NotEqual(t, "client_secret", hash)
+
+	assert.True(t, CompareClientSecret(hash, "client_secret"))
+	assert.False(t, CompareClientSecret(hash, "another_secret"))
+	assert.False(t, CompareClientSecret("", ""))
+}
@@ -12,6 +12,7 @@ package mocks
 import (
 	entities "globe-and-citizen/layer8/server/entities"
 	models "globe-and-citizen/layer8/server/models"
+	models0 "globe-and-citizen/layer8/server/resource_server/models"
 	reflect "reflect"
 
 	layer8_utils "github.com/globe-and-citizen/layer8-utils"
@@ -43,21 +44,6 @@ func (m *MockServiceInterface) EXPECT() *MockServiceInterfaceMockRecorder {
 	return m.recorder
 }
 
-// AccessResourcesWithToken mocks base method.
-func (m *MockServiceInterface) AccessResourcesWithToken(token string) (map[string]any, error) {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AccessResourcesWithToken", token)
-	ret0, _ := ret[0].(map[string]any)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
-}
-
-// AccessResourcesWithToken indicates an expected call of AccessResourcesWithToken.
-func (mr *MockServiceInterfaceMockRecorder) AccessResourcesWithToken(token any) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AccessResourcesWithToken", reflect.TypeOf((*MockServiceInterface)(nil).AccessResourcesWithToken), token)
-}
-
 // AddTestClient mocks base method.
 func (m *MockServiceInterface) AddTestClient() (*models.Client, error) {
 	m.ctrl.T.Helper()
@@ -73,6 +59,20 @@ func (mr *MockServiceInterfaceMockRecorder) AddTestClient() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddTestClient", reflect.TypeOf((*MockServiceInterface)(nil).AddTestClient))
 }
 
+// ApproveDeviceAuthorization mocks base method.
+func (m *MockServiceInterface) ApproveDeviceAuthorization(userCode string, userID int64, scopes []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ApproveDeviceAuthorization", userCode, userID, scopes)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ApproveDeviceAuthorization indicates an expected call of ApproveDeviceAuthorization.
+func (mr *MockServiceInterfaceMockRecorder) ApproveDeviceAuthorization(userCode, userID, scopes any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ApproveDeviceAuthorization", reflect.TypeOf((*MockServiceInterface)(nil).ApproveDeviceAuthorization), userCode, userID, scopes)
+}
+
 // AuthenticateClient mocks base method.
 func (m *MockServiceInterface) AuthenticateClient(uuid, secret string) error {
 	m.ctrl.T.Helper()
@@ -102,19 +102,63 @@ func (mr *MockServiceInterfaceMockRecorder) CheckClient(backendURL any) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckClient", reflect.TypeOf((*MockServiceInterface)(nil).CheckClient), backendURL)
 }
 
+// CheckClientGrantType mocks base method.
+func (m *MockServiceInterface) CheckClientGrantType(clientID, grantType string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CheckClientGrantType", clientID, grantType)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CheckClientGrantType indicates an expected call of CheckClientGrantType.
+func (mr *MockServiceInterfaceMockRecorder) CheckClientGrantType(clientID, grantType any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckClientGrantType", reflect.TypeOf((*MockServiceInterface)(nil).CheckClientGrantType), clientID, grantType)
+}
+
+// CreateDeviceAuthorization mocks base method.
+func (m *MockServiceInterface) CreateDeviceAuthorization(clientID string, scopes []string) (string, *models.DeviceAuthorization, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateDeviceAuthorization", clientID, scopes)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(*models.DeviceAuthorization)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// CreateDeviceAuthorization indicates an expected call of CreateDeviceAuthorization.
+func (mr *MockServiceInterfaceMockRecorder) CreateDeviceAuthorization(clientID, scopes any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateDeviceAuthorization", reflect.TypeOf((*MockServiceInterface)(nil).CreateDeviceAuthorization), clientID, scopes)
+}
+
 // DecodeAuthorizationCode mocks base method.
-func (m *MockServiceInterface) DecodeAuthorizationCode(secret, code string) (*layer8_utils.AuthCodeClaims, error) {
+func (m *MockServiceInterface) DecodeAuthorizationCode(clientID, code, redirectURI string) (*layer8_utils.AuthCodeClaims, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "DecodeAuthorizationCode", secret, code)
+	ret := m.ctrl.Call(m, "DecodeAuthorizationCode", clientID, code, redirectURI)
 	ret0, _ := ret[0].(*layer8_utils.AuthCodeClaims)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // DecodeAuthorizationCode indicates an expected call of DecodeAuthorizationCode.
-func (mr *MockServiceInterfaceMockRecorder) DecodeAuthorizationCode(secret, code any) *gomock.Call {
+func (mr *MockServiceInterfaceMockRecorder) DecodeAuthorizationCode(clientID, code, redirectURI any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DecodeAuthorizationCode", reflect.TypeOf((*MockServiceInterface)(nil).DecodeAuthorizationCode), secret, code)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DecodeAuthorizationCode", reflect.TypeOf((*MockServiceInterface)(nil).DecodeAuthorizationCode), clientID, code, redirectURI)
+}
+
+// DenyDeviceAuthorization mocks base method.
+func (m *MockServiceInterface) DenyDeviceAuthorization(userCode string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DenyDeviceAuthorization", userCode)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DenyDeviceAuthorization indicates an expected call of DenyDeviceAuthorization.
+func (mr *MockServiceInterfaceMockRecorder) DenyDeviceAuthorization(userCode any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DenyDeviceAuthorization", reflect.TypeOf((*MockServiceInterface)(nil).DenyDeviceAuthorization), userCode)
 }
 
 // ExchangeCodeForToken mocks base method.
@@ -133,18 +177,18 @@ func (mr *MockServiceInterfaceMockRecorder) ExchangeCodeForToken(config, code an
 }
 
 // GenerateAccessToken mocks base method.
-func (m *MockServiceInterface) GenerateAccessToken(authClaims *layer8_utils.AuthCodeClaims, clientID, clientSecret string) (string, error) {
+func (m *MockServiceInterface) GenerateAccessToken(authClaims *layer8_utils.AuthCodeClaims, clientID string) (string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GenerateAccessToken", authClaims, clientID, clientSecret)
+	ret := m.ctrl.Call(m, "GenerateAccessToken", authClaims, clientID)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GenerateAccessToken indicates an expected call of GenerateAccessToken.
-func (mr *MockServiceInterfaceMockRecorder) GenerateAccessToken(authClaims, clientID, clientSecret any) *gomock.Call {
+func (mr *MockServiceInterfaceMockRecorder) GenerateAccessToken(authClaims, clientID any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GenerateAccessToken", reflect.TypeOf((*MockServiceInterface)(nil).GenerateAccessToken), authClaims, clientID, clientSecret)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GenerateAccessToken", reflect.TypeOf((*MockServiceInterface)(nil).GenerateAccessToken), authClaims, clientID)
 }
 
 // GenerateAuthJwtCode mocks base method.
@@ -177,6 +221,21 @@ func (mr *MockServiceInterfaceMockRecorder) GenerateAuthorizationURL(config, use
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GenerateAuthorizationURL", reflect.TypeOf((*MockServiceInterface)(nil).GenerateAuthorizationURL), config, userID)
 }
 
+// GenerateClientCredentialsToken mocks base method.
+func (m *MockServiceInterface) GenerateClientCredentialsToken(clientID string, scopes []string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GenerateClientCredentialsToken", clientID, scopes)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GenerateClientCredentialsToken indicates an expected call of GenerateClientCredentialsToken.
+func (mr *MockServiceInterfaceMockRecorder) GenerateClientCredentialsToken(clientID, scopes any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GenerateClientCredentialsToken", reflect.TypeOf((*MockServiceInterface)(nil).GenerateClientCredentialsToken), clientID, scopes)
+}
+
 // GetClient mocks base method.
 func (m *MockServiceInterface) GetClient(id string) (*models.Client, error) {
 	m.ctrl.T.Helper()
@@ -192,6 +251,51 @@ func (mr *MockServiceInterfaceMockRecorder) GetClient(id any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetClient", reflect.TypeOf((*MockServiceInterface)(nil).GetClient), id)
 }
 
+// GetCoveringConsent mocks base method.
+func (m *MockServiceInterface) GetCoveringConsent(userID int64, clientID string, scopes []string) (*models.UserConsent, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCoveringConsent", userID, clientID, scopes)
+	ret0, _ := ret[0].(*models.UserConsent)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCoveringConsent indicates an expected call of GetCoveringConsent.
+func (mr *MockServiceInterfaceMockRecorder) GetCoveringConsent(userID, clientID, scopes any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCoveringConsent", reflect.TypeOf((*MockServiceInterface)(nil).GetCoveringConsent), userID, clientID, scopes)
+}
+
+// GetPairwiseSubject mocks base method.
+func (m *MockServiceInterface) GetPairwiseSubject(clientID string, userID int64) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetPairwiseSubject", clientID, userID)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetPairwiseSubject indicates an expected call of GetPairwiseSubject.
+func (mr *MockServiceInterfaceMockRecorder) GetPairwiseSubject(clientID, userID any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPairwiseSubject", reflect.TypeOf((*MockServiceInterface)(nil).GetPairwiseSubject), clientID, userID)
+}
+
+// GetPendingDeviceAuthorization mocks base method.
+func (m *MockServiceInterface) GetPendingDeviceAuthorization(userCode string) (*models.DeviceAuthorization, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetPendingDeviceAuthorization", userCode)
+	ret0, _ := ret[0].(*models.DeviceAuthorization)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetPendingDeviceAuthorization indicates an expected call of GetPendingDeviceAuthorization.
+func (mr *MockServiceInterfaceMockRecorder) GetPendingDeviceAuthorization(userCode any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPendingDeviceAuthorization", reflect.TypeOf((*MockServiceInterface)(nil).GetPendingDeviceAuthorization), userCode)
+}
+
 // GetUserByToken mocks base method.
 func (m *MockServiceInterface) GetUserByToken(token string) (*models.User, error) {
 	m.ctrl.T.Helper()
@@ -208,33 +312,122 @@ func (mr *MockServiceInterfaceMockRecorder) GetUserByToken(token any) *gomock.Ca
 }
 
 // GetZkUserMetadata mocks base method.
-func (m *MockServiceInterface) GetZkUserMetadata(scopesStr string, userID int64) (*entities.ZkMetadataResponse, error) {
+func (m *MockServiceInterface) GetZkUserMetadata(clientID, scopesStr string, userID int64) (*entities.ZkMetadataResponse, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetZkUserMetadata", scopesStr, userID)
+	ret := m.ctrl.Call(m, "GetZkUserMetadata", clientID, scopesStr, userID)
 	ret0, _ := ret[0].(*entities.ZkMetadataResponse)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetZkUserMetadata indicates an expected call of GetZkUserMetadata.
-func (mr *MockServiceInterfaceMockRecorder) GetZkUserMetadata(scopesStr, userID any) *gomock.Call {
+func (mr *MockServiceInterfaceMockRecorder) GetZkUserMetadata(clientID, scopesStr, userID any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetZkUserMetadata", reflect.TypeOf((*MockServiceInterface)(nil).GetZkUserMetadata), clientID, scopesStr, userID)
+}
+
+// LoginPasskey mocks base method.
+func (m *MockServiceInterface) LoginPasskey(req entities.PasskeyLoginRequest) (map[string]any, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoginPasskey", req)
+	ret0, _ := ret[0].(map[string]any)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoginPasskey indicates an expected call of LoginPasskey.
+func (mr *MockServiceInterfaceMockRecorder) LoginPasskey(req any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoginPasskey", reflect.TypeOf((*MockServiceInterface)(nil).LoginPasskey), req)
+}
+
+// LoginTwoFactor mocks base method.
+func (m *MockServiceInterface) LoginTwoFactor(req entities.TwoFactorLoginRequest) (map[string]any, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoginTwoFactor", req)
+	ret0, _ := ret[0].(map[string]any)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoginTwoFactor indicates an expected call of LoginTwoFactor.
+func (mr *MockServiceInterfaceMockRecorder) LoginTwoFactor(req any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetZkUserMetadata", reflect.TypeOf((*MockServiceInterface)(nil).GetZkUserMetadata), scopesStr, userID)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoginTwoFactor", reflect.TypeOf((*MockServiceInterface)(nil).LoginTwoFactor), req)
 }
 
 // LoginUser mocks base method.
-func (m *MockServiceInterface) LoginUser(username, password string) (map[string]any, error) {
+func (m *MockServiceInterface) LoginUser(req entities.LoginRequest) (map[string]any, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "LoginUser", username, password)
+	ret := m.ctrl.Call(m, "LoginUser", req)
 	ret0, _ := ret[0].(map[string]any)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // LoginUser indicates an expected call of LoginUser.
-func (mr *MockServiceInterfaceMockRecorder) LoginUser(username, password any) *gomock.Call {
+func (mr *MockServiceInterfaceMockRecorder) LoginUser(req any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoginUser", reflect.TypeOf((*MockServiceInterface)(nil).LoginUser), req)
+}
+
+// PollDeviceAuthorization mocks base method.
+func (m *MockServiceInterface) PollDeviceAuthorization(clientID, deviceCode string) (*layer8_utils.AuthCodeClaims, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PollDeviceAuthorization", clientID, deviceCode)
+	ret0, _ := ret[0].(*layer8_utils.AuthCodeClaims)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PollDeviceAuthorization indicates an expected call of PollDeviceAuthorization.
+func (mr *MockServiceInterfaceMockRecorder) PollDeviceAuthorization(clientID, deviceCode any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoginUser", reflect.TypeOf((*MockServiceInterface)(nil).LoginUser), username, password)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PollDeviceAuthorization", reflect.TypeOf((*MockServiceInterface)(nil).PollDeviceAuthorization), clientID, deviceCode)
+}
+
+// ResolvePairwiseSubject mocks base method.
+func (m *MockServiceInterface) ResolvePairwiseSubject(clientID, subject string) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResolvePairwiseSubject", clientID, subject)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ResolvePairwiseSubject indicates an expected call of ResolvePairwiseSubject.
+func (mr *MockServiceInterfaceMockRecorder) ResolvePairwiseSubject(clientID, subject any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResolvePairwiseSubject", reflect.TypeOf((*MockServiceInterface)(nil).ResolvePairwiseSubject), clientID, subject)
+}
+
+// ResolveRedirectURI mocks base method.
+func (m *MockServiceInterface) ResolveRedirectURI(client *models.Client, requested string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResolveRedirectURI", client, requested)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ResolveRedirectURI indicates an expected call of ResolveRedirectURI.
+func (mr *MockServiceInterfaceMockRecorder) ResolveRedirectURI(client, requested any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResolveRedirectURI", reflect.TypeOf((*MockServiceInterface)(nil).ResolveRedirectURI), client, requested)
+}
+
+// SaveUserConsent mocks base method.
+func (m *MockServiceInterface) SaveUserConsent(userID int64, clientID string, scopes []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveUserConsent", userID, clientID, scopes)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveUserConsent indicates an expected call of SaveUserConsent.
+func (mr *MockServiceInterfaceMockRecorder) SaveUserConsent(userID, clientID, scopes any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveUserConsent", reflect.TypeOf((*MockServiceInterface)(nil).SaveUserConsent), userID, clientID, scopes)
 }
 
 // SaveX509Certificate mocks base method.
@@ -252,18 +445,33 @@ func (mr *MockServiceInterfaceMockRecorder) SaveX509Certificate(clientID, certif
 }
 
 // ValidateAccessToken mocks base method.
-func (m *MockServiceInterface) ValidateAccessToken(clientSecret, accessToken string) (*entities.ClientClaims, error) {
+func (m *MockServiceInterface) ValidateAccessToken(accessToken string) (*entities.ClientClaims, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "ValidateAccessToken", clientSecret, accessToken)
+	ret := m.ctrl.Call(m, "ValidateAccessToken", accessToken)
 	ret0, _ := ret[0].(*entities.ClientClaims)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // ValidateAccessToken indicates an expected call of ValidateAccessToken.
-func (mr *MockServiceInterfaceMockRecorder) ValidateAccessToken(clientSecret, accessToken any) *gomock.Call {
+func (mr *MockServiceInterfaceMockRecorder) ValidateAccessToken(accessToken any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ValidateAccessToken", reflect.TypeOf((*MockServiceInterface)(nil).ValidateAccessToken), accessToken)
+}
+
+// ValidateClientTokenWithScope mocks base method.
+func (m *MockServiceInterface) ValidateClientTokenWithScope(tokenString, scope string) (*models0.ClientClaims, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ValidateClientTokenWithScope", tokenString, scope)
+	ret0, _ := ret[0].(*models0.ClientClaims)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ValidateClientTokenWithScope indicates an expected call of ValidateClientTokenWithScope.
+func (mr *MockServiceInterfaceMockRecorder) ValidateClientTokenWithScope(tokenString, scope any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ValidateAccessToken", reflect.TypeOf((*MockServiceInterface)(nil).ValidateAccessToken), clientSecret, accessToken)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ValidateClientTokenWithScope", reflect.TypeOf((*MockServiceInterface)(nil).ValidateClientTokenWithScope), tokenString, scope)
 }
 
 // VerifyToken mocks base method.
@@ -280,3 +488,17 @@ func (mr *MockServiceInterfaceMockRecorder) VerifyToken(token any) *gomock.Call
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "VerifyToken", reflect.TypeOf((*MockServiceInterface)(nil).VerifyToken), token)
 }
+
+// VerifyUserConsent mocks base method.
+func (m *MockServiceInterface) VerifyUserConsent(userID int64, clientID string, issuedAt int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "VerifyUserConsent", userID, clientID, issuedAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// VerifyUserConsent indicates an expected call of VerifyUserConsent.
+func (mr *MockServiceInterfaceMockRecorder) VerifyUserConsent(userID, clientID, issuedAt any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "VerifyUserConsent", reflect.TypeOf((*MockServiceInterface)(nil).VerifyUserConsent), userID, clientID, issuedAt)
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// ValidateRedirectURI checks that uri can be registered as an OAuth redirect
+// URI: absolute, without a fragment, and served over https unless it points to
+// the loopback interface.
+func ValidateRedirectURI(uri string) error {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("invalid redirect uri: %v", err)
+	}
+
+	if !parsed.IsAbs() || parsed.Host == "" {
+		return fmt.Errorf("redirect uri must be an absolute url")
+	}
+
+	if parsed.Fragment != "" {
+		return fmt.Errorf("redirect uri must not contain a fragment")
+	}
+
+	if parsed.Scheme != "https" && !(parsed.Scheme == "http" && isLoopbackHost(parsed.Hostname())) {
+		return fmt.Errorf("redirect uri must use https unless it points to localhost")
+	}
+
+	return nil
+}
+
+// MatchRedirectURI picks the redirect URI to send the authorization response
+// to. The requested URI must equal one of the registered ones; it may only be
+// omitted when exactly one is registered. Loopback URIs match regardless of
+// port, since native apps listen on whatever port is free (RFC 8252, 7.3).
+func MatchRedirectURI(registered []string, requested string) (string, error) {
+	if requested == "" {
+		if len(registered) == 1 {
+			return registered[0], nil
+		}
+		return "", fmt.Errorf("redirect_uri is required when the client has %d redirect uris registered", len(registered))
+	}
+
+	for _, uri := range registered {
+		if uri == requested {
+			return requested, nil
+		}
+	}
+
+	requestedURL, err := url.Parse(requested)
+	if err != nil || !isLoopbackHost(requestedURL.Hostname()) {
+		return "", fmt.Errorf("redirect_uri %s is not registered for the client", requested)
+	}
+
+	for _, uri := range registered {
+		registeredURL, err := url.Parse(uri)
+		if err != nil || !isLoopbackHost(registeredURL.Hostname()) {
+			continue
+		}
+
+		if registeredURL.Scheme == requestedURL.Scheme &&
+			registeredURL.Hostname() == requestedURL.Hostname() &&
+			registeredURL.Path == requestedURL.Path &&
+			registeredURL.RawQuery == requestedURL.RawQuery {
+			return requested, nil
+		}
+	}
+
+	return "", fmt.Errorf("redirect_uri %s is not registered for the client", requested)
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateRedirectURI(t *testing.T) {
+	tests := []struct {
+		uri   string
+		valid bool
+	}{
+		{"https://client.com/callback", true},
+		{"http://localhost:8080/callback", true},
+		{"http://127.0.0.1/callback", true},
+		{"http://client.com/callback", false},
+		{"https://client.com/callback#fragment", false},
+		{"/callback", false},
+		{"client.com/callback", false},
+	}
+
+	for _, test := range tests {
+		err := ValidateRedirectURI(test.uri)
+		assert.Equal(t, test.valid, err == nil, test.uri)
+	}
+}
+
+func TestMatchRedirectURI(t *testing.T) {
+	registered := []string{"https://client.com/callback", "http://127.0.0.1/callback"}
+
+	tests := []struct {
+		requested string
+		expected  string
+		valid     bool
+	}{
+		{"https://client.com/callback", "https://client.com/callback", true},
+		{"http://127.0.0.1:51234/callback", "http://127.0.0.1:51234/callback", true},
+		{"https://client.com/callback/", "", false},
+		{"https://client.com/callback?next=/", "", false},
+		{"http://127.0.0.1:51234/other", "", false},
+		{"http://localhost:51234/callback", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		redirectURI, err := MatchRedirectURI(registered, test.requested)
+		assert.Equal(t, test.valid, err == nil, test.requested)
+		assert.Equal(t, test.expected, redirectURI, test.requested)
+	}
+
+	redirectURI, err := MatchRedirectURI([]string{"https://client.com/callback"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://client.com/callback", redirectURI)
+}
@@ -0,0 +1,83 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// id-fido-gen-ce-aaguid, the certificate extension holding the AAGUID of the
+// authenticator model
+var aaguidExtensionID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+type packedStatement struct {
+	Algorithm int64    `cbor:"alg"`
+	Signature []byte   `cbor:"sig"`
+	X5C       [][]byte `cbor:"x5c,omitempty"`
+}
+
+// verifyAttestation checks the attestation statement of a new credential
+// against the formats config accepts. The signature of a "packed" statement
+// is checked, but its certificate is not chained to a trusted root: the
+// policy decides which kinds of authenticators are accepted, not which
+// vendors.
+func verifyAttestation(
+	config Config, object attestationObject, authData authenticatorData, key publicKey, clientDataHash []byte,
+) error {
+	if !config.allowsAttestationFormat(object.Format) {
+		return invalid("attestation format %q is not allowed", object.Format)
+	}
+
+	switch object.Format {
+	case AttestationFormatNone:
+		var statement map[string]interface{}
+		if err := cbor.Unmarshal(object.Statement, &statement); err != nil || len(statement) != 0 {
+			return invalid("none attestation has a statement")
+		}
+		return nil
+
+	case AttestationFormatPacked:
+		var statement packedStatement
+		if err := cbor.Unmarshal(object.Statement, &statement); err != nil {
+			return invalid("packed attestation statement is malformed")
+		}
+
+		signed := append(append([]byte{}, object.AuthData...), clientDataHash...)
+
+		if len(statement.X5C) == 0 {
+			// self attestation, signed by the credential key itself
+			if statement.Algorithm != key.algorithm {
+				return invalid("self attestation algorithm does not match the credential key")
+			}
+			if !verifySignature(key.algorithm, key.key, signed, statement.Signature) {
+				return invalid("self attestation signature is invalid")
+			}
+			return nil
+		}
+
+		certificate, err := x509.ParseCertificate(statement.X5C[0])
+		if err != nil {
+			return invalid("attestation certificate is malformed")
+		}
+		if certificate.Version != 3 || certificate.IsCA {
+			return invalid("attestation certificate is not an end entity certificate")
+		}
+		for _, extension := range certificate.Extensions {
+			if !extension.Id.Equal(aaguidExtensionID) {
+				continue
+			}
+			var aaguid []byte
+			if _, err := asn1.Unmarshal(extension.Value, &aaguid); err != nil || !bytes.Equal(aaguid, authData.AAGUID) {
+				return invalid("attestation certificate is for another authenticator model")
+			}
+		}
+		if !verifySignature(statement.Algorithm, certificate.PublicKey, signed, statement.Signature) {
+			return invalid("packed attestation signature is invalid")
+		}
+		return nil
+	}
+
+	return invalid("attestation format %q is not supported", object.Format)
+}
@@ -0,0 +1,163 @@
+package webauthn
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"gorm.io/gorm"
+
+	"globe-and-citizen/layer8/server/constants"
+)
+
+// Store consumes challenges and records the use of passkeys. Both the
+// resource server and the authorization server repositories implement it, as
+// users log in to either with a passkey.
+type Store interface {
+	// ConsumeWebAuthnChallenge deletes the unexpired challenge issued for the
+	// ceremony to userID, 0 for a login that is not issued to any user. It
+	// returns gorm.ErrRecordNotFound if there is no such challenge.
+	ConsumeWebAuthnChallenge(ceremony string, challenge string, userID uint, now time.Time) error
+	// UseWebAuthnCredential stores the signature counter of a login with the
+	// passkey. It returns gorm.ErrRecordNotFound unless signCount is greater
+	// than the stored counter, or both are zero.
+	UseWebAuthnCredential(id uint, signCount uint32, usedAt time.Time) error
+}
+
+// Credential is a registered passkey.
+type Credential struct {
+	// ID is the id of the stored passkey, not set before it is stored
+	ID     uint
+	UserID uint
+	// CredentialID is the base64url encoded id the authenticator knows the
+	// passkey by
+	CredentialID string
+	// PublicKey is the COSE encoded credential public key
+	PublicKey         []byte
+	SignCount         uint32
+	AttestationFormat string
+	AAGUID            string
+}
+
+// VerifyRegistration checks the response of the authenticator to
+// registration options issued to userID and returns the new passkey.
+func VerifyRegistration(store Store, config Config, userID uint, response CredentialResponse, now time.Time) (Credential, error) {
+	rawClientData, data, err := parseClientData(config, response.Response.ClientDataJSON, "webauthn.create")
+	if err != nil {
+		return Credential{}, err
+	}
+	if err := consumeChallenge(store, CeremonyRegistration, data.Challenge, userID, now); err != nil {
+		return Credential{}, err
+	}
+
+	rawObject, err := decodeBase64(response.Response.AttestationObject)
+	if err != nil {
+		return Credential{}, invalid("attestation object is not base64url encoded")
+	}
+	var object attestationObject
+	if err := cbor.Unmarshal(rawObject, &object); err != nil {
+		return Credential{}, invalid("attestation object is malformed")
+	}
+
+	authData, err := parseAuthenticatorData(object.AuthData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if err := checkAuthenticatorData(config, authData); err != nil {
+		return Credential{}, err
+	}
+	if authData.CredentialID == nil {
+		return Credential{}, invalid("attested credential data is missing")
+	}
+
+	key, err := parsePublicKey(authData.PublicKey)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	clientDataHash := sha256.Sum256(rawClientData)
+	if err := verifyAttestation(config, object, authData, key, clientDataHash[:]); err != nil {
+		return Credential{}, err
+	}
+
+	return Credential{
+		UserID:            userID,
+		CredentialID:      encoding.EncodeToString(authData.CredentialID),
+		PublicKey:         authData.PublicKey,
+		SignCount:         authData.SignCount,
+		AttestationFormat: object.Format,
+		AAGUID:            formatAAGUID(authData.AAGUID),
+	}, nil
+}
+
+// VerifyLogin checks the assertion of credential, the passkey response.ID
+// names, for a challenge of login options. It returns whether the
+// authenticator verified the user, who is otherwise only known to be present.
+func VerifyLogin(store Store, config Config, credential Credential, response CredentialResponse, now time.Time) (bool, error) {
+	rawClientData, data, err := parseClientData(config, response.Response.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		return false, err
+	}
+	if err := consumeChallenge(store, CeremonyLogin, data.Challenge, 0, now); err != nil {
+		return false, err
+	}
+
+	if response.Response.UserHandle != "" {
+		userHandle, err := decodeBase64(response.Response.UserHandle)
+		if err != nil || subtle.ConstantTimeCompare(userHandle, UserHandle(credential.UserID)) != 1 {
+			return false, invalid("user handle does not match the passkey")
+		}
+	}
+
+	rawAuthData, err := decodeBase64(response.Response.AuthenticatorData)
+	if err != nil {
+		return false, invalid("authenticator data is not base64url encoded")
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return false, err
+	}
+	if err := checkAuthenticatorData(config, authData); err != nil {
+		return false, err
+	}
+
+	key, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return false, err
+	}
+	signature, err := decodeBase64(response.Response.Signature)
+	if err != nil {
+		return false, invalid("signature is not base64url encoded")
+	}
+
+	clientDataHash := sha256.Sum256(rawClientData)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if !verifySignature(key.algorithm, key.key, signed, signature) {
+		return false, invalid("assertion signature is invalid")
+	}
+
+	// authenticators that do not count signatures always report zero
+	if (authData.SignCount != 0 || credential.SignCount != 0) && authData.SignCount <= credential.SignCount {
+		return false, constants.ErrPasskeyCloned
+	}
+	err = store.UseWebAuthnCredential(credential.ID, authData.SignCount, now)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// a concurrent login reported a later counter first
+		return false, constants.ErrPasskeyCloned
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return authData.userVerified(), nil
+}
+
+func consumeChallenge(store Store, ceremony string, challenge string, userID uint, now time.Time) error {
+	err := store.ConsumeWebAuthnChallenge(ceremony, challenge, userID, now)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return constants.ErrInvalidPasskeyCeremony
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// COSE key types and curves of RFC 9053
+const (
+	coseKeyTypeOKP = 1
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+)
+
+// coseKey is a credential public key. The meaning of the parameters -1 and -2
+// depends on the key type, so they are decoded once it is known.
+type coseKey struct {
+	KeyType   int64           `cbor:"1,keyasint"`
+	Algorithm int64           `cbor:"3,keyasint"`
+	Param1    cbor.RawMessage `cbor:"-1,keyasint"`
+	Param2    cbor.RawMessage `cbor:"-2,keyasint"`
+	Param3    cbor.RawMessage `cbor:"-3,keyasint,omitempty"`
+}
+
+// publicKey is a parsed credential public key along with its algorithm.
+type publicKey struct {
+	algorithm int64
+	key       crypto.PublicKey
+}
+
+func parsePublicKey(encoded []byte) (publicKey, error) {
+	var key coseKey
+	if err := cbor.Unmarshal(encoded, &key); err != nil {
+		return publicKey{}, invalid("credential public key is malformed")
+	}
+
+	switch {
+	case key.KeyType == coseKeyTypeEC2 && key.Algorithm == AlgES256:
+		var curve int64
+		var x, y []byte
+		if cbor.Unmarshal(key.Param1, &curve) != nil ||
+			cbor.Unmarshal(key.Param2, &x) != nil ||
+			cbor.Unmarshal(key.Param3, &y) != nil {
+			return publicKey{}, invalid("EC2 public key is malformed")
+		}
+		if curve != coseCurveP256 {
+			return publicKey{}, invalid("EC2 curve %d is not supported", curve)
+		}
+
+		ecKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !ecKey.Curve.IsOnCurve(ecKey.X, ecKey.Y) {
+			return publicKey{}, invalid("EC2 public key is not on the curve")
+		}
+		return publicKey{algorithm: AlgES256, key: ecKey}, nil
+
+	case key.KeyType == coseKeyTypeOKP && key.Algorithm == AlgEdDSA:
+		var curve int64
+		var x []byte
+		if cbor.Unmarshal(key.Param1, &curve) != nil || cbor.Unmarshal(key.Param2, &x) != nil {
+			return publicKey{}, invalid("OKP public key is malformed")
+		}
+		if curve != coseCurveEd25519 || len(x) != ed25519.PublicKeySize {
+			return publicKey{}, invalid("OKP curve %d is not supported", curve)
+		}
+		return publicKey{algorithm: AlgEdDSA, key: ed25519.PublicKey(x)}, nil
+
+	case key.KeyType == coseKeyTypeRSA && key.Algorithm == AlgRS256:
+		var n, e []byte
+		if cbor.Unmarshal(key.Param1, &n) != nil || cbor.Unmarshal(key.Param2, &e) != nil {
+			return publicKey{}, invalid("RSA public key is malformed")
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return publicKey{}, invalid("RSA public exponent is too large")
+		}
+		return publicKey{
+			algorithm: AlgRS256,
+			key:       &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())},
+		}, nil
+	}
+
+	return publicKey{}, invalid("key type %d with algorithm %d is not supported", key.KeyType, key.Algorithm)
+}
+
+// verifySignature checks signature over message with key using algorithm,
+// one of the COSE algorithms of the package.
+func verifySignature(algorithm int64, key crypto.PublicKey, message []byte, signature []byte) bool {
+	digest := sha256.Sum256(message)
+
+	switch algorithm {
+	case AlgES256:
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		return ok && ecdsa.VerifyASN1(ecKey, digest[:], signature)
+	case AlgEdDSA:
+		edKey, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(edKey, message, signature)
+	case AlgRS256:
+		rsaKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
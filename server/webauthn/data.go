@@ -0,0 +1,167 @@
+package webauthn
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"globe-and-citizen/layer8/server/constants"
+)
+
+// flags of the authenticator data
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagAttestedCredentialData = 0x40
+)
+
+const (
+	rpIDHashSize   = 32
+	signCountSize  = 4
+	aaguidSize     = 16
+	authDataHeader = rpIDHashSize + 1 + signCountSize
+)
+
+// CredentialResponse is a PublicKeyCredential as serialized by its toJSON
+// method, with binary values base64url encoded.
+type CredentialResponse struct {
+	// ID is the base64url encoded credential id
+	ID       string                `json:"id"`
+	Type     string                `json:"type"`
+	Response AuthenticatorResponse `json:"response"`
+}
+
+// AuthenticatorResponse holds the attestation object of a registration or
+// the authenticator data, signature and user handle of a login.
+type AuthenticatorResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type attestationObject struct {
+	Format    string          `cbor:"fmt"`
+	Statement cbor.RawMessage `cbor:"attStmt"`
+	AuthData  []byte          `cbor:"authData"`
+}
+
+type authenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+	// set when flagAttestedCredentialData is, that is on registration
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func (d authenticatorData) userPresent() bool {
+	return d.Flags&flagUserPresent != 0
+}
+
+func (d authenticatorData) userVerified() bool {
+	return d.Flags&flagUserVerified != 0
+}
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", constants.ErrInvalidPasskey, fmt.Sprintf(format, args...))
+}
+
+// decodeBase64 accepts base64url with or without padding, as browsers differ
+func decodeBase64(value string) ([]byte, error) {
+	return encoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// parseClientData decodes the client data of a ceremony and checks it was
+// collected for ceremonyType on one of the origins of config.
+func parseClientData(config Config, encoded string, ceremonyType string) ([]byte, clientData, error) {
+	raw, err := decodeBase64(encoded)
+	if err != nil {
+		return nil, clientData{}, invalid("client data is not base64url encoded")
+	}
+
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, clientData{}, invalid("client data is malformed")
+	}
+	if data.Type != ceremonyType {
+		return nil, clientData{}, invalid("client data is of type %q", data.Type)
+	}
+	if !config.allowsOrigin(data.Origin) {
+		return nil, clientData{}, invalid("origin %q is not allowed", data.Origin)
+	}
+
+	return raw, data, nil
+}
+
+func parseAuthenticatorData(raw []byte) (authenticatorData, error) {
+	if len(raw) < authDataHeader {
+		return authenticatorData{}, invalid("authenticator data is too short")
+	}
+
+	data := authenticatorData{
+		RPIDHash:  raw[:rpIDHashSize],
+		Flags:     raw[rpIDHashSize],
+		SignCount: binary.BigEndian.Uint32(raw[rpIDHashSize+1 : authDataHeader]),
+	}
+	if data.Flags&flagAttestedCredentialData == 0 {
+		return data, nil
+	}
+
+	rest := raw[authDataHeader:]
+	if len(rest) < aaguidSize+2 {
+		return authenticatorData{}, invalid("attested credential data is too short")
+	}
+	data.AAGUID = rest[:aaguidSize]
+	idLength := int(binary.BigEndian.Uint16(rest[aaguidSize : aaguidSize+2]))
+	rest = rest[aaguidSize+2:]
+	if len(rest) < idLength {
+		return authenticatorData{}, invalid("credential id is too short")
+	}
+	data.CredentialID = rest[:idLength]
+	rest = rest[idLength:]
+
+	// the key is followed by the extensions, if any
+	var key cbor.RawMessage
+	extensions, err := cbor.UnmarshalFirst(rest, &key)
+	if err != nil {
+		return authenticatorData{}, invalid("credential public key is malformed")
+	}
+	data.PublicKey = rest[:len(rest)-len(extensions)]
+
+	return data, nil
+}
+
+// checkAuthenticatorData checks the data was signed for the relying party
+// and with the user present, and verified if the policy requires it.
+func checkAuthenticatorData(config Config, data authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(config.RPID))
+	if subtle.ConstantTimeCompare(rpIDHash[:], data.RPIDHash) != 1 {
+		return invalid("authenticator data is for another relying party")
+	}
+	if !data.userPresent() {
+		return invalid("user was not present")
+	}
+	if config.requiresUserVerification() && !data.userVerified() {
+		return invalid("user was not verified")
+	}
+	return nil
+}
+
+func formatAAGUID(aaguid []byte) string {
+	return hex.EncodeToString(aaguid)
+}
@@ -0,0 +1,225 @@
+// Package webauthn implements the registration and authentication ceremonies
+// of the Web Authentication API for the passkeys users log in with. Only the
+// "none" and "packed" attestation formats and the ES256, EdDSA and RS256
+// algorithms are supported, which covers platform authenticators and most
+// security keys.
+package webauthn
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// CeremonyRegistration is the ceremony a challenge of a new passkey is issued for
+	CeremonyRegistration = "registration"
+	// CeremonyLogin is the ceremony a challenge of a login is issued for
+	CeremonyLogin = "login"
+
+	AttestationFormatNone   = "none"
+	AttestationFormatPacked = "packed"
+
+	UserVerificationRequired  = "required"
+	UserVerificationPreferred = "preferred"
+
+	challengeSize = 32
+	// timeout of the ceremonies in milliseconds, as passed to the browser
+	ceremonyTimeout = 120000
+)
+
+// COSE algorithm identifiers of the supported credential keys
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+var encoding = base64.RawURLEncoding
+
+// Config is the relying party the passkeys are scoped to and the policy they
+// are registered and used under.
+type Config struct {
+	RPID   string
+	RPName string
+	// Origins are the pages a ceremony can run on
+	Origins []string
+	// AttestationFormats are the attestation statements accepted for a new
+	// passkey, "none" accepts authenticators that do not attest
+	AttestationFormats []string
+	// UserVerification is "required" when the authenticator must check a PIN
+	// or biometric of the user, not only their presence
+	UserVerification string
+}
+
+// ConfigFromEnv reads the relying party from WEBAUTHN_RP_ID, WEBAUTHN_RP_NAME
+// and WEBAUTHN_ORIGINS, and the policy from WEBAUTHN_ATTESTATION_FORMATS and
+// WEBAUTHN_USER_VERIFICATION. Lists are comma separated.
+func ConfigFromEnv() (Config, error) {
+	config := Config{
+		RPID:               os.Getenv("WEBAUTHN_RP_ID"),
+		RPName:             os.Getenv("WEBAUTHN_RP_NAME"),
+		Origins:            splitList(os.Getenv("WEBAUTHN_ORIGINS")),
+		AttestationFormats: splitList(os.Getenv("WEBAUTHN_ATTESTATION_FORMATS")),
+		UserVerification:   os.Getenv("WEBAUTHN_USER_VERIFICATION"),
+	}
+
+	if config.RPID == "" {
+		return Config{}, errors.New("WEBAUTHN_RP_ID is not set")
+	}
+	if len(config.Origins) == 0 {
+		return Config{}, errors.New("WEBAUTHN_ORIGINS is not set")
+	}
+	if config.RPName == "" {
+		config.RPName = "Layer8"
+	}
+	if len(config.AttestationFormats) == 0 {
+		config.AttestationFormats = []string{AttestationFormatNone, AttestationFormatPacked}
+	}
+	if config.UserVerification == "" {
+		config.UserVerification = UserVerificationPreferred
+	}
+
+	return config, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c Config) allowsOrigin(origin string) bool {
+	return slices.Contains(c.Origins, origin)
+}
+
+func (c Config) allowsAttestationFormat(format string) bool {
+	return slices.Contains(c.AttestationFormats, format)
+}
+
+func (c Config) requiresUserVerification() bool {
+	return c.UserVerification == UserVerificationRequired
+}
+
+// NewChallenge returns a random base64url encoded challenge.
+func NewChallenge() (string, error) {
+	challenge := make([]byte, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(challenge), nil
+}
+
+// UserHandle is the id a passkey stores for the user it was created for.
+// Logins get it back from the authenticator along with the assertion.
+func UserHandle(userID uint) []byte {
+	return []byte(strconv.FormatUint(uint64(userID), 10))
+}
+
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	// ID is the base64url encoded user handle
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	// ID is the base64url encoded credential id
+	ID string `json:"id"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are the PublicKeyCredentialCreationOptions of a
+// registration, with binary values base64url encoded.
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     RelyingParty           `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the PublicKeyCredentialRequestOptions of a login, with
+// binary values base64url encoded.
+type RequestOptions struct {
+	Challenge        string `json:"challenge"`
+	RPID             string `json:"rpId"`
+	Timeout          int    `json:"timeout"`
+	UserVerification string `json:"userVerification"`
+}
+
+// NewCreationOptions asks the browser for a discoverable passkey of the user,
+// so that later logins need no username. excludeCredentialIDs keeps an
+// authenticator from registering the same user twice.
+func NewCreationOptions(
+	config Config, challenge string, userID uint, username string, excludeCredentialIDs []string,
+) CreationOptions {
+	excluded := make([]CredentialDescriptor, len(excludeCredentialIDs))
+	for i, id := range excludeCredentialIDs {
+		excluded[i] = CredentialDescriptor{Type: "public-key", ID: id}
+	}
+
+	// only ask for an attestation statement when "none" would be refused
+	attestation := "none"
+	if !config.allowsAttestationFormat(AttestationFormatNone) {
+		attestation = "direct"
+	}
+
+	return CreationOptions{
+		Challenge: challenge,
+		RP:        RelyingParty{ID: config.RPID, Name: config.RPName},
+		User: UserEntity{
+			ID:          encoding.EncodeToString(UserHandle(userID)),
+			Name:        username,
+			DisplayName: username,
+		},
+		PubKeyCredParams: []CredentialParameter{
+			{Type: "public-key", Alg: AlgES256},
+			{Type: "public-key", Alg: AlgEdDSA},
+			{Type: "public-key", Alg: AlgRS256},
+		},
+		Timeout:            ceremonyTimeout,
+		ExcludeCredentials: excluded,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "required",
+			UserVerification: config.UserVerification,
+		},
+		Attestation: attestation,
+	}
+}
+
+// NewRequestOptions asks the browser for any passkey of the relying party.
+func NewRequestOptions(config Config, challenge string) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		RPID:             config.RPID,
+		Timeout:          ceremonyTimeout,
+		UserVerification: config.UserVerification,
+	}
+}
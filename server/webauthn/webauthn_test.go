@@ -0,0 +1,210 @@
+package webauthn_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+
+	"globe-and-citizen/layer8/server/constants"
+	"globe-and-citizen/layer8/server/webauthn"
+	"globe-and-citizen/layer8/server/webauthn/webauthntest"
+)
+
+const testOrigin = "https://layer8.example"
+
+var testNow = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var testConfig = webauthn.Config{
+	RPID:               "layer8.example",
+	RPName:             "Layer8",
+	Origins:            []string{testOrigin},
+	AttestationFormats: []string{webauthn.AttestationFormatNone, webauthn.AttestationFormatPacked},
+	UserVerification:   webauthn.UserVerificationPreferred,
+}
+
+// memoryStore keeps challenges by ceremony and challenge, along with the user
+// they were issued to
+type memoryStore struct {
+	challenges map[[2]string]uint
+	signCounts map[uint]uint32
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{challenges: map[[2]string]uint{}, signCounts: map[uint]uint32{}}
+}
+
+func (s *memoryStore) issue(ceremony string, userID uint) string {
+	challenge, _ := webauthn.NewChallenge()
+	s.challenges[[2]string{ceremony, challenge}] = userID
+	return challenge
+}
+
+func (s *memoryStore) ConsumeWebAuthnChallenge(ceremony string, challenge string, userID uint, now time.Time) error {
+	issuedTo, ok := s.challenges[[2]string{ceremony, challenge}]
+	if !ok || issuedTo != userID {
+		return gorm.ErrRecordNotFound
+	}
+	delete(s.challenges, [2]string{ceremony, challenge})
+	return nil
+}
+
+func (s *memoryStore) UseWebAuthnCredential(id uint, signCount uint32, usedAt time.Time) error {
+	stored := s.signCounts[id]
+	if signCount <= stored && (signCount != 0 || stored != 0) {
+		return gorm.ErrRecordNotFound
+	}
+	s.signCounts[id] = signCount
+	return nil
+}
+
+func register(t *testing.T, store *memoryStore, config webauthn.Config, authenticator *webauthntest.Authenticator) webauthn.Credential {
+	options := webauthn.NewCreationOptions(config, store.issue(webauthn.CeremonyRegistration, 7), 7, "alice", nil)
+
+	credential, err := webauthn.VerifyRegistration(store, config, 7, authenticator.Register(options), testNow)
+	if err != nil {
+		t.Fatal("Failed to register the passkey:", err)
+	}
+
+	credential.ID = 1
+	return credential
+}
+
+func TestVerifyRegistration_Success(t *testing.T) {
+	store := newMemoryStore()
+	authenticator := webauthntest.NewAuthenticator(testOrigin)
+	authenticator.AttestationFormat = webauthn.AttestationFormatPacked
+
+	credential := register(t, store, testConfig, authenticator)
+
+	assert.Equal(t, uint(7), credential.UserID)
+	assert.Equal(t, authenticator.CredentialID(), credential.CredentialID)
+	assert.Equal(t, authenticator.PublicKey(), credential.PublicKey)
+	assert.Equal(t, webauthn.AttestationFormatPacked, credential.AttestationFormat)
+	assert.Empty(t, store.challenges)
+}
+
+func TestVerifyRegistration_AttestationFormatNotAllowed(t *testing.T) {
+	store := newMemoryStore()
+	config := testConfig
+	config.AttestationFormats = []string{webauthn.AttestationFormatPacked}
+	options := webauthn.NewCreationOptions(config, store.issue(webauthn.CeremonyRegistration, 7), 7, "alice", nil)
+
+	_, err := webauthn.VerifyRegistration(store, config, 7, webauthntest.NewAuthenticator(testOrigin).Register(options), testNow)
+
+	assert.ErrorIs(t, err, constants.ErrInvalidPasskey)
+	assert.Equal(t, "direct", options.Attestation)
+}
+
+func TestVerifyRegistration_ChallengeOfAnotherUser(t *testing.T) {
+	store := newMemoryStore()
+	options := webauthn.NewCreationOptions(testConfig, store.issue(webauthn.CeremonyRegistration, 8), 7, "alice", nil)
+
+	_, err := webauthn.VerifyRegistration(store, testConfig, 7, webauthntest.NewAuthenticator(testOrigin).Register(options), testNow)
+
+	assert.ErrorIs(t, err, constants.ErrInvalidPasskeyCeremony)
+}
+
+func TestVerifyRegistration_OriginNotAllowed(t *testing.T) {
+	store := newMemoryStore()
+	options := webauthn.NewCreationOptions(testConfig, store.issue(webauthn.CeremonyRegistration, 7), 7, "alice", nil)
+
+	authenticator := webauthntest.NewAuthenticator("https://phishing.example")
+	_, err := webauthn.VerifyRegistration(store, testConfig, 7, authenticator.Register(options), testNow)
+
+	assert.ErrorIs(t, err, constants.ErrInvalidPasskey)
+}
+
+func TestVerifyLogin_Success(t *testing.T) {
+	store := newMemoryStore()
+	authenticator := webauthntest.NewAuthenticator(testOrigin)
+	credential := register(t, store, testConfig, authenticator)
+
+	options := webauthn.NewRequestOptions(testConfig, store.issue(webauthn.CeremonyLogin, 0))
+	userVerified, err := webauthn.VerifyLogin(store, testConfig, credential, authenticator.Login(options), testNow)
+
+	assert.Nil(t, err)
+	assert.True(t, userVerified)
+	assert.Equal(t, uint32(1), store.signCounts[1])
+}
+
+func TestVerifyLogin_ChallengeIsSingleUse(t *testing.T) {
+	store := newMemoryStore()
+	authenticator := webauthntest.NewAuthenticator(testOrigin)
+	credential := register(t, store, testConfig, authenticator)
+
+	options := webauthn.NewRequestOptions(testConfig, store.issue(webauthn.CeremonyLogin, 0))
+	assertion := authenticator.Login(options)
+
+	_, err := webauthn.VerifyLogin(store, testConfig, credential, assertion, testNow)
+	assert.Nil(t, err)
+
+	credential.SignCount = store.signCounts[1]
+	_, err = webauthn.VerifyLogin(store, testConfig, credential, assertion, testNow)
+	assert.ErrorIs(t, err, constants.ErrInvalidPasskeyCeremony)
+}
+
+func TestVerifyLogin_SignCountDidNotIncrease(t *testing.T) {
+	store := newMemoryStore()
+	authenticator := webauthntest.NewAuthenticator(testOrigin)
+	credential := register(t, store, testConfig, authenticator)
+	credential.SignCount = 5
+
+	options := webauthn.NewRequestOptions(testConfig, store.issue(webauthn.CeremonyLogin, 0))
+	_, err := webauthn.VerifyLogin(store, testConfig, credential, authenticator.Login(options), testNow)
+
+	assert.ErrorIs(t, err, constants.ErrPasskeyCloned)
+}
+
+func TestVerifyLogin_AuthenticatorWithoutCounter(t *testing.T) {
+	store := newMemoryStore()
+	authenticator := webauthntest.NewAuthenticator(testOrigin)
+	authenticator.CountSignatures = false
+	credential := register(t, store, testConfig, authenticator)
+
+	for i := 0; i < 2; i++ {
+		options := webauthn.NewRequestOptions(testConfig, store.issue(webauthn.CeremonyLogin, 0))
+		_, err := webauthn.VerifyLogin(store, testConfig, credential, authenticator.Login(options), testNow)
+		assert.Nil(t, err)
+	}
+}
+
+func TestVerifyLogin_UserVerificationRequired(t *testing.T) {
+	store := newMemoryStore()
+	config := testConfig
+	config.UserVerification = webauthn.UserVerificationRequired
+	authenticator := webauthntest.NewAuthenticator(testOrigin)
+	credential := register(t, store, config, authenticator)
+
+	authenticator.UserVerified = false
+	options := webauthn.NewRequestOptions(config, store.issue(webauthn.CeremonyLogin, 0))
+	_, err := webauthn.VerifyLogin(store, config, credential, authenticator.Login(options), testNow)
+
+	assert.ErrorIs(t, err, constants.ErrInvalidPasskey)
+}
+
+func TestVerifyLogin_PasskeyOfAnotherUser(t *testing.T) {
+	store := newMemoryStore()
+	authenticator := webauthntest.NewAuthenticator(testOrigin)
+	credential := register(t, store, testConfig, authenticator)
+	credential.UserID = 8
+
+	options := webauthn.NewRequestOptions(testConfig, store.issue(webauthn.CeremonyLogin, 0))
+	_, err := webauthn.VerifyLogin(store, testConfig, credential, authenticator.Login(options), testNow)
+
+	assert.ErrorIs(t, err, constants.ErrInvalidPasskey)
+}
+
+func TestVerifyLogin_SignatureOfAnotherPasskey(t *testing.T) {
+	store := newMemoryStore()
+	credential := register(t, store, testConfig, webauthntest.NewAuthenticator(testOrigin))
+
+	impostor := webauthntest.NewAuthenticator(testOrigin)
+	register(t, store, testConfig, impostor)
+
+	options := webauthn.NewRequestOptions(testConfig, store.issue(webauthn.CeremonyLogin, 0))
+	_, err := webauthn.VerifyLogin(store, testConfig, credential, impostor.Login(options), testNow)
+
+	assert.ErrorIs(t, err, constants.ErrInvalidPasskey)
+}
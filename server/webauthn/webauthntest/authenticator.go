@@ -0,0 +1,184 @@
+// Package webauthntest provides a software authenticator to run the passkey
+// ceremonies of package webauthn in tests.
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"globe-and-citizen/layer8/server/webauthn"
+)
+
+var encoding = base64.RawURLEncoding
+
+// keys are sorted, so that a public key always encodes the same
+var cborEncoding, _ = cbor.CoreDetEncOptions().EncMode()
+
+// Authenticator holds one ES256 passkey. The zero value is not usable, use
+// NewAuthenticator.
+type Authenticator struct {
+	// Origin is the page the ceremonies run on
+	Origin string
+	// AttestationFormat is "none" or "packed", a self attestation
+	AttestationFormat string
+	// UserVerified sets the user verified flag of the authenticator data
+	UserVerified bool
+	// CountSignatures increments SignCount before each assertion, otherwise
+	// it stays zero like on authenticators without a counter
+	CountSignatures bool
+	SignCount       uint32
+
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+}
+
+// NewAuthenticator returns an authenticator that verifies the user and counts
+// signatures, and does not attest its passkey.
+func NewAuthenticator(origin string) *Authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		panic(err)
+	}
+
+	return &Authenticator{
+		Origin:            origin,
+		AttestationFormat: webauthn.AttestationFormatNone,
+		UserVerified:      true,
+		CountSignatures:   true,
+		key:               key,
+		credentialID:      credentialID,
+	}
+}
+
+// CredentialID is the base64url encoded id of the passkey.
+func (a *Authenticator) CredentialID() string {
+	return encoding.EncodeToString(a.credentialID)
+}
+
+// PublicKey is the COSE encoded public key of the passkey.
+func (a *Authenticator) PublicKey() []byte {
+	key, err := cborEncoding.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// Register creates the passkey for the user and relying party of options.
+func (a *Authenticator) Register(options webauthn.CreationOptions) webauthn.CredentialResponse {
+	userHandle, err := encoding.DecodeString(options.User.ID)
+	if err != nil {
+		panic(err)
+	}
+	a.userHandle = userHandle
+
+	clientData := a.clientData("webauthn.create", options.Challenge)
+
+	attestedCredentialData := make([]byte, 16, 18+len(a.credentialID))
+	attestedCredentialData = binary.BigEndian.AppendUint16(attestedCredentialData, uint16(len(a.credentialID)))
+	attestedCredentialData = append(attestedCredentialData, a.credentialID...)
+	attestedCredentialData = append(attestedCredentialData, a.PublicKey()...)
+
+	authData := a.authenticatorData(options.RP.ID, 0x40, attestedCredentialData)
+
+	statement := map[string]interface{}{}
+	if a.AttestationFormat == webauthn.AttestationFormatPacked {
+		statement["alg"] = webauthn.AlgES256
+		statement["sig"] = a.sign(authData, clientData)
+	}
+
+	attestationObject, err := cborEncoding.Marshal(map[string]interface{}{
+		"fmt":      a.AttestationFormat,
+		"attStmt":  statement,
+		"authData": authData,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return webauthn.CredentialResponse{
+		ID:   a.CredentialID(),
+		Type: "public-key",
+		Response: webauthn.AuthenticatorResponse{
+			ClientDataJSON:    encoding.EncodeToString(clientData),
+			AttestationObject: encoding.EncodeToString(attestationObject),
+		},
+	}
+}
+
+// Login signs an assertion for the challenge of options.
+func (a *Authenticator) Login(options webauthn.RequestOptions) webauthn.CredentialResponse {
+	if a.CountSignatures {
+		a.SignCount++
+	}
+
+	clientData := a.clientData("webauthn.get", options.Challenge)
+	authData := a.authenticatorData(options.RPID, 0, nil)
+
+	return webauthn.CredentialResponse{
+		ID:   a.CredentialID(),
+		Type: "public-key",
+		Response: webauthn.AuthenticatorResponse{
+			ClientDataJSON:    encoding.EncodeToString(clientData),
+			AuthenticatorData: encoding.EncodeToString(authData),
+			Signature:         encoding.EncodeToString(a.sign(authData, clientData)),
+			UserHandle:        encoding.EncodeToString(a.userHandle),
+		},
+	}
+}
+
+func (a *Authenticator) clientData(ceremonyType string, challenge string) []byte {
+	clientData, err := json.Marshal(map[string]interface{}{
+		"type":        ceremonyType,
+		"challenge":   challenge,
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return clientData
+}
+
+func (a *Authenticator) authenticatorData(rpID string, flags byte, attestedCredentialData []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	flags |= 0x01 // user present
+	if a.UserVerified {
+		flags |= 0x04
+	}
+
+	authData := append(rpIDHash[:], flags)
+	authData = binary.BigEndian.AppendUint32(authData, a.SignCount)
+	return append(authData, attestedCredentialData...)
+}
+
+func (a *Authenticator) sign(authData []byte, clientData []byte) []byte {
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signature
+}
@@ -0,0 +1,338 @@
+package zkverify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/frontend"
+
+	"globe-and-citizen/layer8/server/resource_server/emails/verification/zk/circuit"
+	"globe-and-citizen/layer8/server/resource_server/utils"
+)
+
+// ErrUnsupportedEmailDomain is returned for addresses whose domain cannot be
+// proved: it is missing or longer than utils.MaxEmailDomainLength runes.
+var ErrUnsupportedEmailDomain = errors.New("unsupported email domain")
+
+// SplitEmailDomain returns the domain of an address and the position, in
+// runes, of the '@' in front of it.
+func SplitEmailDomain(email string) (string, int, error) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return "", 0, fmt.Errorf("%w: no '@' in address", ErrUnsupportedEmailDomain)
+	}
+
+	domain := email[at+1:]
+	if domain == "" || utf8.RuneCountInString(domain) > utils.MaxEmailDomainLength {
+		return "", 0, fmt.Errorf("%w: %q", ErrUnsupportedEmailDomain, domain)
+	}
+
+	return domain, utf8.RuneCountInString(email[:at]), nil
+}
+
+// EmailDomainLeaf is the Merkle leaf of a domain: the MiMC hash of the domain
+// packed into field elements like every other circuit input.
+func EmailDomainLeaf(domain string) (fr.Element, error) {
+	if utf8.RuneCountInString(domain) > utils.MaxEmailDomainLength {
+		return fr.Element{}, fmt.Errorf("%w: %q", ErrUnsupportedEmailDomain, domain)
+	}
+
+	elements, err := utils.StringToFrElements(domain)
+	if err != nil {
+		return fr.Element{}, err
+	}
+
+	return hashElements(elements[:utils.EmailDomainFrRepresentationSize]...), nil
+}
+
+func hashElements(elements ...fr.Element) fr.Element {
+	hasher := mimc.NewMiMC()
+	for _, element := range elements {
+		elementBytes := element.Bytes()
+		hasher.Write(elementBytes[:])
+	}
+
+	var hash fr.Element
+	hash.SetBytes(hasher.Sum(nil))
+	return hash
+}
+
+// EmailDomainSet is a Merkle tree of allowed domains. Domains are compared
+// in lower case and their leaves are sorted by domain, so the root depends on
+// the set only and anyone can recompute it from the published domains.
+type EmailDomainSet struct {
+	domains []string
+	// levels[0] holds the leaves, every level is padded with the hash of an
+	// empty subtree of its height
+	levels [][]fr.Element
+	empty  [utils.EmailDomainSetDepth + 1]fr.Element
+}
+
+func NewEmailDomainSet(domains []string) (*EmailDomainSet, error) {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		normalized = append(normalized, strings.ToLower(strings.TrimSpace(domain)))
+	}
+	slices.Sort(normalized)
+	normalized = slices.Compact(normalized)
+
+	if len(normalized) == 0 {
+		return nil, errors.New("email domain set is empty")
+	}
+	if len(normalized) > 1<<utils.EmailDomainSetDepth {
+		return nil, fmt.Errorf("email domain set has more than %d domains", 1<<utils.EmailDomainSetDepth)
+	}
+
+	set := &EmailDomainSet{domains: normalized}
+
+	for level := 0; level < utils.EmailDomainSetDepth; level++ {
+		set.empty[level+1] = hashElements(set.empty[level], set.empty[level])
+	}
+
+	leaves := make([]fr.Element, len(normalized))
+	for i, domain := range normalized {
+		if domain == "" {
+			return nil, fmt.Errorf("%w: empty domain in set", ErrUnsupportedEmailDomain)
+		}
+
+		leaf, err := EmailDomainLeaf(domain)
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = leaf
+	}
+
+	set.levels = [][]fr.Element{leaves}
+	for level := 0; level < utils.EmailDomainSetDepth; level++ {
+		nodes := set.levels[level]
+		parents := make([]fr.Element, (len(nodes)+1)/2)
+		for i := range parents {
+			parents[i] = hashElements(nodes[2*i], set.node(level, 2*i+1))
+		}
+		set.levels = append(set.levels, parents)
+	}
+
+	return set, nil
+}
+
+func (s *EmailDomainSet) node(level int, index int) fr.Element {
+	if index < len(s.levels[level]) {
+		return s.levels[level][index]
+	}
+	return s.empty[level]
+}
+
+// Domains returns the domains of the set, normalized and sorted.
+func (s *EmailDomainSet) Domains() []string {
+	return slices.Clone(s.domains)
+}
+
+// Root returns the root of the set, hex encoded as in proofs and claims.
+func (s *EmailDomainSet) Root() string {
+	root := s.levels[utils.EmailDomainSetDepth][0].Bytes()
+	return hex.EncodeToString(root[:])
+}
+
+// Contains reports whether domain is in the set.
+func (s *EmailDomainSet) Contains(domain string) bool {
+	_, found := slices.BinarySearch(s.domains, domain)
+	return found
+}
+
+// Path returns the siblings of the leaf of domain from the bottom up, and for
+// each level whether the path goes through the right child.
+func (s *EmailDomainSet) Path(domain string) (
+	[utils.EmailDomainSetDepth]fr.Element, [utils.EmailDomainSetDepth]bool, error,
+) {
+	var siblings [utils.EmailDomainSetDepth]fr.Element
+	var isRight [utils.EmailDomainSetDepth]bool
+
+	index, found := slices.BinarySearch(s.domains, domain)
+	if !found {
+		return siblings, isRight, fmt.Errorf("domain %q is not in the set", domain)
+	}
+
+	for level := 0; level < utils.EmailDomainSetDepth; level++ {
+		siblings[level] = s.node(level, index^1)
+		isRight[level] = index%2 == 1
+		index /= 2
+	}
+
+	return siblings, isRight, nil
+}
+
+// EmailDomainSetRoot returns the root of the set of domains, for instance
+// {"acme.com"} to check a proof that an address is at acme.com.
+func EmailDomainSetRoot(domains ...string) (string, error) {
+	set, err := NewEmailDomainSet(domains)
+	if err != nil {
+		return "", err
+	}
+
+	return set.Root(), nil
+}
+
+// ParseEmailDomainSetRoot decodes a root encoded by EmailDomainSet.Root.
+func ParseEmailDomainSetRoot(root string) (fr.Element, error) {
+	element, err := parseElement(root)
+	if err != nil {
+		return element, fmt.Errorf("invalid email domain set root: %v", err)
+	}
+
+	return element, nil
+}
+
+func parseElement(encoded string) (fr.Element, error) {
+	var element fr.Element
+
+	elementBytes, err := hex.DecodeString(encoded)
+	if err != nil {
+		return element, err
+	}
+	if err := element.SetBytesCanonical(elementBytes); err != nil {
+		return element, err
+	}
+
+	return element, nil
+}
+
+// EmailDomainClientTag is the public input naming the client a proof of the
+// email domain is made for: the SHA-256 of its ID reduced into the field.
+func EmailDomainClientTag(clientID string) fr.Element {
+	digest := sha256.Sum256([]byte(clientID))
+
+	var tag fr.Element
+	tag.SetBytes(digest[:])
+	return tag
+}
+
+// EmailDomainNullifier returns the hex encoded nullifier of the proofs of
+// domain made for clientID with a user's nullifier key. It is the same in
+// every proof the client gets about the user's domain, and without the key
+// it cannot be linked to the nullifiers other clients get.
+func EmailDomainNullifier(nullifierKey []byte, domain string, clientID string) (string, error) {
+	leaf, err := EmailDomainLeaf(domain)
+	if err != nil {
+		return "", err
+	}
+
+	nullifier := hashElements(EmailDomainNullifierKey(nullifierKey), leaf, EmailDomainClientTag(clientID))
+	nullifierBytes := nullifier.Bytes()
+	return hex.EncodeToString(nullifierBytes[:]), nil
+}
+
+// ParseEmailDomainNullifier decodes a nullifier encoded by
+// EmailDomainNullifier.
+func ParseEmailDomainNullifier(nullifier string) (fr.Element, error) {
+	element, err := parseElement(nullifier)
+	if err != nil {
+		return element, fmt.Errorf("invalid email domain nullifier: %v", err)
+	}
+
+	return element, nil
+}
+
+// EmailDomainCommitment returns the hex encoded commitment to the domain of
+// a user's verified address under their nullifier key. The proof of the
+// email verification outputs it and every proof of the domain takes it as a
+// public input, which ties the domain to the verified address. It is the
+// same for every client.
+func EmailDomainCommitment(nullifierKey []byte, domain string) (string, error) {
+	leaf, err := EmailDomainLeaf(domain)
+	if err != nil {
+		return "", err
+	}
+
+	commitment := hashElements(leaf, EmailDomainNullifierKey(nullifierKey))
+	commitmentBytes := commitment.Bytes()
+	return hex.EncodeToString(commitmentBytes[:]), nil
+}
+
+// ParseEmailDomainCommitment decodes a commitment encoded by
+// EmailDomainCommitment.
+func ParseEmailDomainCommitment(commitment string) (fr.Element, error) {
+	element, err := parseElement(commitment)
+	if err != nil {
+		return element, fmt.Errorf("invalid email domain commitment: %v", err)
+	}
+
+	return element, nil
+}
+
+// EmailDomainNullifierKey reduces a user's random nullifier key into the
+// field.
+func EmailDomainNullifierKey(nullifierKey []byte) fr.Element {
+	var key fr.Element
+	key.SetBytes(nullifierKey)
+	return key
+}
+
+// VerifyEmailDomainProof checks that proofBytes proves to clientID that the
+// domain of the user's verified address is in the set with the given root,
+// under the nullifier the client got for the user. domainCommitment is the
+// commitment the proof of the user's email verification outputs, checking
+// that proof with VerifyProof and the same commitment shows the domain is the
+// one of the verified address.
+func VerifyEmailDomainProof(
+	verifyingKey groth16.VerifyingKey,
+	proofBytes []byte,
+	domainSetRoot string,
+	clientID string,
+	nullifier string,
+	domainCommitment string,
+) error {
+	root, err := ParseEmailDomainSetRoot(domainSetRoot)
+	if err != nil {
+		return err
+	}
+
+	nullifierElement, err := ParseEmailDomainNullifier(nullifier)
+	if err != nil {
+		return err
+	}
+
+	commitment, err := ParseEmailDomainCommitment(domainCommitment)
+	if err != nil {
+		return err
+	}
+
+	assignment := circuit.NewEmailDomainCircuit()
+	assignment.DomainSetRoot = root
+	assignment.ClientTag = EmailDomainClientTag(clientID)
+	assignment.Nullifier = nullifierElement
+	assignment.DomainCommitment = commitment
+	// the secret inputs are not part of the public witness, zeros only fill the slots
+	for i := range assignment.Domain {
+		assignment.Domain[i] = 0
+	}
+	assignment.NullifierKey = 0
+	for i := range assignment.MerklePath {
+		assignment.MerklePath[i] = 0
+		assignment.MerklePathIndices[i] = 0
+	}
+
+	public, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		return fmt.Errorf("error while constructing a witness for zk proof verification: %v", err)
+	}
+
+	proof, err := readProof(proofBytes)
+	if err != nil {
+		return err
+	}
+
+	if err := groth16.Verify(proof, verifyingKey, public); err != nil {
+		return fmt.Errorf("could not verify proof: %v", err)
+	}
+
+	return nil
+}
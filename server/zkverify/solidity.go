@@ -0,0 +1,141 @@
+package zkverify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend/groth16"
+	groth16_bn254 "github.com/consensys/gnark/backend/groth16/bn254"
+	"github.com/consensys/gnark/backend/solidity"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+
+	"globe-and-citizen/layer8/server/resource_server/utils"
+)
+
+// SolidityVerifierContract is the name of the exported verifier contract.
+const SolidityVerifierContract = "Layer8ZkVerifier"
+
+// PublicInputsCount is the number of public inputs of the circuit: the salt
+// followed by the verification code and the email domain commitment.
+const PublicInputsCount = utils.InputFrRepresentationSize + utils.VerificationCodeSize + 1
+
+const solidityPragmaVersion = "^0.8.28"
+
+// VerifierABI describes verifyProof of the exported contract. It reverts
+// when the proof is invalid and returns nothing otherwise.
+var VerifierABI = fmt.Sprintf(
+	`[{"type":"function","name":"verifyProof","stateMutability":"view","inputs":[`+
+		`{"name":"proof","type":"uint256[8]"},{"name":"input","type":"uint256[%d]"}],"outputs":[]}]`,
+	PublicInputsCount,
+)
+
+// ExportSolidityVerifier writes a contract that checks proofs made with
+// verifyingKey. Each contract accepts proofs of a single key pair, so a new
+// one has to be deployed after the keys are rotated.
+func ExportSolidityVerifier(verifyingKey groth16.VerifyingKey, zkKeyPairID uint, writer io.Writer) error {
+	if verifyingKey.NbPublicWitness() != PublicInputsCount {
+		return fmt.Errorf(
+			"the verifying key has %d public inputs instead of %d, it predates the current circuit",
+			verifyingKey.NbPublicWitness(), PublicInputsCount,
+		)
+	}
+
+	var contract bytes.Buffer
+	if err := verifyingKey.ExportSolidity(&contract, solidity.WithPragmaVersion(solidityPragmaVersion)); err != nil {
+		return fmt.Errorf("error while exporting the verifying key: %v", err)
+	}
+
+	source := contract.String()
+	if !strings.Contains(source, "contract Verifier {") {
+		return errors.New("unexpected verifier contract template")
+	}
+	source = strings.Replace(source, "contract Verifier {", "contract "+SolidityVerifierContract+" {", 1)
+
+	header := fmt.Sprintf(
+		"// Verifies Layer8 email and phone number proofs made with zk key pair %d.\n"+
+			"// Generated from its verifying key, do not edit.\n",
+		zkKeyPairID,
+	)
+	_, err := io.WriteString(writer, header+source)
+	return err
+}
+
+// SolidityProof converts a stored proof to the points (A, B, C) in the EIP-197
+// encoding the verifier contract expects.
+func SolidityProof(proofBytes []byte) ([8]*big.Int, error) {
+	var words [8]*big.Int
+
+	proof, err := readProof(proofBytes)
+	if err != nil {
+		return words, err
+	}
+
+	bn254Proof, ok := proof.(*groth16_bn254.Proof)
+	if !ok {
+		return words, errors.New("proof is not on curve bn254")
+	}
+	if len(bn254Proof.Commitments) > 0 {
+		return words, errors.New("proofs with commitments are not supported")
+	}
+
+	encoded := bn254Proof.MarshalSolidity()
+	for i := range words {
+		words[i] = new(big.Int).SetBytes(encoded[i*fr.Bytes : (i+1)*fr.Bytes])
+	}
+
+	return words, nil
+}
+
+// PublicInputs returns the public inputs of a proof in the order the verifier
+// contract expects them. domainCommitment is empty for phone numbers and for
+// addresses without a provable domain.
+func PublicInputs(
+	salt string, verificationCode string, domainCommitment string,
+) ([PublicInputsCount]*big.Int, error) {
+	var inputs [PublicInputsCount]*big.Int
+
+	public, err := publicWitness(salt, verificationCode, domainCommitment)
+	if err != nil {
+		return inputs, err
+	}
+
+	vector, ok := public.Vector().(fr.Vector)
+	if !ok || len(vector) != PublicInputsCount {
+		return inputs, errors.New("unexpected public witness layout")
+	}
+
+	for i := range vector {
+		inputs[i] = vector[i].BigInt(new(big.Int))
+	}
+
+	return inputs, nil
+}
+
+// EncodeVerifyProofCalldata encodes a call to verifyProof of the exported
+// contract for a stored proof and its public inputs. Contracts that gate on a
+// proof can take the same two arguments and forward them to the verifier.
+func EncodeVerifyProofCalldata(
+	proofBytes []byte, salt string, verificationCode string, domainCommitment string,
+) ([]byte, error) {
+	proof, err := SolidityProof(proofBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs, err := PublicInputs(salt, verificationCode, domainCommitment)
+	if err != nil {
+		return nil, err
+	}
+
+	verifierABI, err := abi.JSON(strings.NewReader(VerifierABI))
+	if err != nil {
+		return nil, err
+	}
+
+	return verifierABI.Pack("verifyProof", proof, inputs)
+}
@@ -0,0 +1,207 @@
+package zkverify_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/stretchr/testify/assert"
+
+	"globe-and-citizen/layer8/server/zkverify"
+)
+
+// lookupSolc returns the path of solc, which CI installs. Elsewhere the test
+// is skipped when solc is missing.
+func lookupSolc(t *testing.T) string {
+	solc, err := exec.LookPath("solc")
+	if err != nil {
+		if os.Getenv("CI") != "" {
+			t.Fatal("solc is required to check the exported verifier on chain")
+		}
+		t.Skip("solc is not installed")
+	}
+
+	return solc
+}
+
+// compileVerifier compiles an exported verifier.
+func compileVerifier(t *testing.T, solc string, source string) (abi.ABI, []byte) {
+	input, err := json.Marshal(map[string]any{
+		"language": "Solidity",
+		"sources": map[string]any{
+			zkverify.SolidityVerifierContract + ".sol": map[string]string{"content": source},
+		},
+		"settings": map[string]any{
+			"optimizer":       map[string]any{"enabled": true, "runs": 200},
+			"outputSelection": map[string]any{"*": map[string]any{"*": []string{"abi", "evm.bytecode.object"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(solc, "--standard-json")
+	cmd.Stdin = bytes.NewReader(input)
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("solc failed: %v", err)
+	}
+
+	var compiled struct {
+		Errors []struct {
+			Severity         string `json:"severity"`
+			FormattedMessage string `json:"formattedMessage"`
+		} `json:"errors"`
+		Contracts map[string]map[string]struct {
+			ABI json.RawMessage `json:"abi"`
+			EVM struct {
+				Bytecode struct {
+					Object string `json:"object"`
+				} `json:"bytecode"`
+			} `json:"evm"`
+		} `json:"contracts"`
+	}
+	if err := json.Unmarshal(output, &compiled); err != nil {
+		t.Fatalf("unexpected solc output: %v", err)
+	}
+	for _, compileErr := range compiled.Errors {
+		if compileErr.Severity == "error" {
+			t.Fatalf("the exported verifier does not compile: %s", compileErr.FormattedMessage)
+		}
+	}
+
+	contract, ok := compiled.Contracts[zkverify.SolidityVerifierContract+".sol"][zkverify.SolidityVerifierContract]
+	if !ok {
+		t.Fatalf("solc did not output contract %s", zkverify.SolidityVerifierContract)
+	}
+
+	contractABI, err := abi.JSON(bytes.NewReader(contract.ABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return contractABI, common.FromHex(contract.EVM.Bytecode.Object)
+}
+
+// deployVerifier exports the verifier of a key, compiles it and deploys it on
+// a simulated chain.
+func deployVerifier(t *testing.T, solc string, verifyingKeyBytes []byte) (simulated.Client, common.Address) {
+	verifyingKey, err := zkverify.ReadVerifyingKey(verifyingKeyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var source bytes.Buffer
+	if err := zkverify.ExportSolidityVerifier(verifyingKey, zkKeyPairId, &source); err != nil {
+		t.Fatal(err)
+	}
+	contractABI, bytecode := compileVerifier(t, solc, source.String())
+
+	// the calldata encoder packs for the function of the contract
+	verifierABI, err := abi.JSON(strings.NewReader(zkverify.VerifierABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, verifierABI.Methods["verifyProof"].ID, contractABI.Methods["verifyProof"].ID)
+
+	deployerKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployer := crypto.PubkeyToAddress(deployerKey.PublicKey)
+
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		deployer: {Balance: new(big.Int).Lsh(big.NewInt(1), 64)},
+	})
+	t.Cleanup(func() { backend.Close() })
+	client := backend.Client()
+
+	chainID, err := client.ChainID(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := bind.NewKeyedTransactorWithChainID(deployerKey, chainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address, _, _, err := bind.DeployContract(opts, contractABI, bytecode, client)
+	if err != nil {
+		t.Fatalf("failed to deploy the verifier: %v", err)
+	}
+	backend.Commit()
+
+	return client, address
+}
+
+// verifiesOnChain calls the deployed verifier, which reverts on invalid
+// proofs.
+func verifiesOnChain(t *testing.T, client simulated.Client, verifier common.Address, calldata []byte) bool {
+	_, err := client.CallContract(context.Background(), ethereum.CallMsg{To: &verifier, Data: calldata}, nil)
+	return err == nil
+}
+
+func TestEncodeVerifyProofCalldata_VerifiesOnChain(t *testing.T) {
+	solc := lookupSolc(t)
+	proof, verifyingKeyBytes := generateProof(t)
+	client, verifier := deployVerifier(t, solc, verifyingKeyBytes)
+
+	calldata, err := zkverify.EncodeVerifyProofCalldata(proof, salt, verificationCode, domainCommitment(t))
+	assert.Nil(t, err)
+	assert.True(t, verifiesOnChain(t, client, verifier, calldata))
+
+	calldata, err = zkverify.EncodeVerifyProofCalldata(proof, salt, "724b2d", domainCommitment(t))
+	assert.Nil(t, err)
+	assert.False(t, verifiesOnChain(t, client, verifier, calldata))
+
+	calldata, err = zkverify.EncodeVerifyProofCalldata(proof, salt, verificationCode, "")
+	assert.Nil(t, err)
+	assert.False(t, verifiesOnChain(t, client, verifier, calldata))
+
+	// a tampered proof: A and C swapped
+	calldata, err = zkverify.EncodeVerifyProofCalldata(proof, salt, verificationCode, domainCommitment(t))
+	assert.Nil(t, err)
+	tampered := bytes.Clone(calldata)
+	copy(tampered[4:4+64], calldata[4+6*32:4+8*32])
+	copy(tampered[4+6*32:4+8*32], calldata[4:4+64])
+	assert.False(t, verifiesOnChain(t, client, verifier, tampered))
+}
+
+func TestEncodeVerifyProofCalldata_InvalidProof(t *testing.T) {
+	_, err := zkverify.EncodeVerifyProofCalldata([]byte("not a proof"), salt, verificationCode, "")
+
+	assert.NotNil(t, err)
+}
+
+func TestExportSolidityVerifier(t *testing.T) {
+	_, verifyingKeyBytes := generateProof(t)
+	verifyingKey, err := zkverify.ReadVerifyingKey(verifyingKeyBytes)
+	assert.Nil(t, err)
+
+	var contract bytes.Buffer
+	err = zkverify.ExportSolidityVerifier(verifyingKey, zkKeyPairId, &contract)
+
+	assert.Nil(t, err)
+	source := contract.String()
+	assert.Contains(t, source, fmt.Sprintf("zk key pair %d", zkKeyPairId))
+	assert.Contains(t, source, "contract "+zkverify.SolidityVerifierContract+" {")
+	assert.Contains(t, source, "pragma solidity ^0.8.28;")
+	// the signature the calldata encoder packs for
+	assert.Regexp(t, fmt.Sprintf(
+		`function verifyProof\(\s*uint256\[8\] calldata proof,\s*uint256\[%d\] calldata input\s*\) public view`,
+		zkverify.PublicInputsCount,
+	), source)
+}
@@ -0,0 +1,240 @@
+// Package zkverify checks the Groth16 proofs Layer8 stores when a user
+// verifies an email address or phone number. The public inputs are the user's
+// salt, the verification code and, for email addresses, a commitment to the
+// domain; the address itself stays secret.
+//
+// Service providers fetch the verifying keys once with FetchVerifyingKeys and
+// check proofs locally with VerifyProof, so a "verified email" claim does not
+// have to be taken on trust.
+package zkverify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/frontend"
+
+	"globe-and-citizen/layer8/server/resource_server/emails/verification/zk/circuit"
+	"globe-and-citizen/layer8/server/resource_server/utils"
+)
+
+// Curve is the curve every Layer8 key pair is generated on.
+const Curve = "bn254"
+
+// VerifyingKeysPath is where a Layer8 server publishes its verifying keys.
+const VerifyingKeysPath = "/api/v1/zk/verifying-keys"
+
+// Circuits a published verifying key can belong to. A key only checks proofs
+// of its own circuit.
+const (
+	CircuitVerificationCode = "verification_code"
+	CircuitEmailDomain      = "email_domain"
+)
+
+// VerifyingKey is a published verifying key in gnark's binary encoding.
+// Circuit is CircuitVerificationCode for keys of email and phone number
+// proofs and CircuitEmailDomain for keys of email domain proofs.
+// Proofs made with a retired key are no longer accepted by Layer8. Keys from
+// a multi-party setup ceremony carry the SHA-256 of its transcript, anyone
+// holding the transcript can check the key was derived from it.
+type VerifyingKey struct {
+	ID             uint       `json:"id"`
+	Curve          string     `json:"curve"`
+	Circuit        string     `json:"circuit"`
+	VerifyingKey   []byte     `json:"verifying_key"`
+	RetiredAt      *time.Time `json:"retired_at,omitempty"`
+	TranscriptHash *string    `json:"transcript_hash,omitempty"`
+}
+
+// ReadVerifyingKey decodes a verifying key serialized with gnark's WriteTo.
+func ReadVerifyingKey(keyBytes []byte) (groth16.VerifyingKey, error) {
+	verifyingKey := groth16.NewVerifyingKey(ecc.BN254)
+	if _, err := verifyingKey.ReadFrom(bytes.NewReader(keyBytes)); err != nil {
+		return nil, fmt.Errorf("error while reading verifying key bytes: %v", err)
+	}
+
+	return verifyingKey, nil
+}
+
+// VerifyProof checks that proofBytes proves knowledge of an input which,
+// mixed with salt and hashed with MiMC, yields verificationCode, and whose
+// email domain has the commitment domainCommitment. The commitment is empty
+// for phone numbers and for addresses without a provable domain.
+//
+// Keys generated before the circuit committed to the domain are still
+// accepted, with an empty domainCommitment only.
+func VerifyProof(
+	verifyingKey groth16.VerifyingKey, proofBytes []byte, salt string, verificationCode string, domainCommitment string,
+) error {
+	public, err := publicWitness(salt, verificationCode, domainCommitment)
+	if err != nil {
+		return err
+	}
+
+	if verifyingKey.NbPublicWitness() == legacyPublicInputsCount {
+		if domainCommitment != "" {
+			return errors.New("the verifying key predates email domain commitments")
+		}
+
+		public, err = legacyPublicWitness(public)
+		if err != nil {
+			return err
+		}
+	}
+
+	proof, err := readProof(proofBytes)
+	if err != nil {
+		return err
+	}
+
+	if err := groth16.Verify(proof, verifyingKey, public); err != nil {
+		return fmt.Errorf("could not verify proof: %v", err)
+	}
+
+	return nil
+}
+
+func readProof(proofBytes []byte) (groth16.Proof, error) {
+	proof := groth16.NewProof(ecc.BN254)
+	if _, err := proof.ReadFrom(bytes.NewReader(proofBytes)); err != nil {
+		return nil, fmt.Errorf("error while reading proof bytes: %v", err)
+	}
+
+	return proof, nil
+}
+
+// publicWitness builds the public inputs of the circuit from the salt, the
+// verification code and the email domain commitment.
+func publicWitness(salt string, verificationCode string, domainCommitment string) (witness.Witness, error) {
+	codeAsCircuitVariables, err := utils.ConvertCodeToCircuitVariables(verificationCode)
+	if err != nil {
+		return nil, fmt.Errorf("invalid verification code: %v", err)
+	}
+	saltAsCircuitVariables, err := utils.StringToCircuitVariables(salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %v", err)
+	}
+
+	var commitment fr.Element
+	if domainCommitment != "" {
+		commitment, err = ParseEmailDomainCommitment(domainCommitment)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the secret input is not part of the public witness, zeros only fill the slots
+	inputAsVariables := [utils.InputFrRepresentationSize]frontend.Variable{}
+	for i := range inputAsVariables {
+		inputAsVariables[i] = 0
+	}
+
+	publicWitness, err := frontend.NewWitness(
+		&circuit.MimcCircuit{
+			InputAsVariables: inputAsVariables,
+			SaltAsVariables:  saltAsCircuitVariables,
+			VerificationCode: codeAsCircuitVariables,
+			DomainCommitment: commitment,
+			AtIndex:          0,
+			NullifierKey:     0,
+		},
+		ecc.BN254.ScalarField(),
+		frontend.PublicOnly(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error while constructing a witness for zk proof verification: %v", err)
+	}
+
+	return publicWitness, nil
+}
+
+// legacyPublicInputsCount is the number of public inputs of the circuit
+// before it committed to the email domain: the salt and the verification code.
+const legacyPublicInputsCount = utils.InputFrRepresentationSize + utils.VerificationCodeSize
+
+// legacyPublicWitness drops the domain commitment, the last public input,
+// from a public witness.
+func legacyPublicWitness(public witness.Witness) (witness.Witness, error) {
+	vector, ok := public.Vector().(fr.Vector)
+	if !ok || len(vector) != legacyPublicInputsCount+1 {
+		return nil, errors.New("unexpected public witness layout")
+	}
+
+	legacy, err := witness.New(ecc.BN254.ScalarField())
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(chan any, legacyPublicInputsCount)
+	for _, value := range vector[:legacyPublicInputsCount] {
+		values <- value
+	}
+	close(values)
+
+	if err := legacy.Fill(legacyPublicInputsCount, 0, values); err != nil {
+		return nil, fmt.Errorf("error while constructing a witness for zk proof verification: %v", err)
+	}
+
+	return legacy, nil
+}
+
+// FetchVerifyingKeys downloads the verifying keys of circuit published by
+// the Layer8 server at baseURL, indexed by key pair ID. Retired keys and keys
+// of other circuits are left out, so a proof is never checked with the key of
+// another circuit.
+func FetchVerifyingKeys(
+	ctx context.Context, client *http.Client, baseURL string, circuit string,
+) (map[uint]groth16.VerifyingKey, error) {
+	if circuit != CircuitVerificationCode && circuit != CircuitEmailDomain {
+		return nil, fmt.Errorf("unknown circuit %q", circuit)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+VerifyingKeysPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch verifying keys: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch verifying keys: unexpected status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Data []VerifyingKey `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode verifying keys: %v", err)
+	}
+
+	keys := make(map[uint]groth16.VerifyingKey, len(body.Data))
+	for _, published := range body.Data {
+		if published.RetiredAt != nil || published.Circuit != circuit {
+			continue
+		}
+		if published.Curve != Curve {
+			return nil, fmt.Errorf("verifying key %d is on unsupported curve %s", published.ID, published.Curve)
+		}
+
+		verifyingKey, err := ReadVerifyingKey(published.VerifyingKey)
+		if err != nil {
+			return nil, fmt.Errorf("verifying key %d: %v", published.ID, err)
+		}
+		keys[published.ID] = verifyingKey
+	}
+
+	return keys, nil
+}
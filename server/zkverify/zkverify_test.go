@@ -0,0 +1,193 @@
+package zkverify_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/stretchr/testify/assert"
+
+	"globe-and-citizen/layer8/server/resource_server/emails/verification/zk"
+	"globe-and-citizen/layer8/server/resource_server/utils"
+	"globe-and-citizen/layer8/server/zkverify"
+)
+
+const email = "myemail@gmail.com"
+const salt = "ajdjsjsaafktyowqqrtgpowrkdkdkfak"
+const verificationCode = "724b2c"
+const zkKeyPairId uint = 2
+
+var nullifierKey = []byte("a user's 32 byte nullifier key..")
+
+var (
+	setupOnce               sync.Once
+	sharedProof             []byte
+	sharedVerifyingKeyBytes []byte
+)
+
+// generateProof runs the expensive Groth16 setup once for the whole package.
+func generateProof(t *testing.T) ([]byte, []byte) {
+	setupOnce.Do(func() {
+		cs, provingKey, verifyingKey := zk.RunZkSnarksSetup()
+		proofProcessor := zk.NewProofProcessor(cs, zkKeyPairId, provingKey, verifyingKey)
+
+		var err error
+		sharedProof, _, err = proofProcessor.GenerateProof(email, salt, verificationCode, nullifierKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sharedVerifyingKeyBytes = utils.WriteBytes(verifyingKey)
+	})
+
+	return sharedProof, sharedVerifyingKeyBytes
+}
+
+// domainCommitment is the commitment the shared proof outputs.
+func domainCommitment(t *testing.T) string {
+	commitment, err := zkverify.EmailDomainCommitment(nullifierKey, "gmail.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commitment
+}
+
+func TestVerifyProof_PublishedKey(t *testing.T) {
+	proof, verifyingKeyBytes := generateProof(t)
+	commitment := domainCommitment(t)
+
+	verifyingKey, err := zkverify.ReadVerifyingKey(verifyingKeyBytes)
+	assert.Nil(t, err)
+
+	assert.Nil(t, zkverify.VerifyProof(verifyingKey, proof, salt, verificationCode, commitment))
+	assert.NotNil(t, zkverify.VerifyProof(verifyingKey, proof, salt, "724b2d", commitment))
+	assert.NotNil(t, zkverify.VerifyProof(verifyingKey, proof, "another salt", verificationCode, commitment))
+}
+
+func TestVerifyProof_AnotherDomainCommitment(t *testing.T) {
+	proof, verifyingKeyBytes := generateProof(t)
+
+	verifyingKey, err := zkverify.ReadVerifyingKey(verifyingKeyBytes)
+	assert.Nil(t, err)
+
+	otherCommitment, err := zkverify.EmailDomainCommitment(nullifierKey, "outlook.com")
+	assert.Nil(t, err)
+
+	assert.NotNil(t, zkverify.VerifyProof(verifyingKey, proof, salt, verificationCode, otherCommitment))
+	assert.NotNil(t, zkverify.VerifyProof(verifyingKey, proof, salt, verificationCode, ""))
+}
+
+// legacyCircuit has the public inputs of the circuit before it committed to
+// the email domain.
+type legacyCircuit struct {
+	SaltAsVariables  [utils.InputFrRepresentationSize]frontend.Variable `gnark:",public"`
+	Sum              frontend.Variable                                  `gnark:",secret"`
+	VerificationCode [utils.VerificationCodeSize]frontend.Variable      `gnark:",public"`
+}
+
+func (c *legacyCircuit) Define(api frontend.API) error {
+	api.AssertIsEqual(c.Sum, api.Add(c.SaltAsVariables[0], c.VerificationCode[0], c.VerificationCode[1:]...))
+	return nil
+}
+
+func TestVerifyProof_LegacyKey(t *testing.T) {
+	cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &legacyCircuit{})
+	assert.Nil(t, err)
+	provingKey, verifyingKey, err := groth16.Setup(cs)
+	assert.Nil(t, err)
+
+	saltAsVariables, err := utils.StringToCircuitVariables(salt)
+	assert.Nil(t, err)
+	codeAsVariables, err := utils.ConvertCodeToCircuitVariables(verificationCode)
+	assert.Nil(t, err)
+	assignment := &legacyCircuit{SaltAsVariables: saltAsVariables, VerificationCode: codeAsVariables}
+	var sum fr.Element
+	sum.SetInterface(saltAsVariables[0])
+	for _, digit := range codeAsVariables {
+		var element fr.Element
+		element.SetInterface(digit)
+		sum.Add(&sum, &element)
+	}
+	assignment.Sum = sum
+
+	witness, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+	assert.Nil(t, err)
+	proof, err := groth16.Prove(cs, provingKey, witness)
+	assert.Nil(t, err)
+	var proofBytes bytes.Buffer
+	_, err = proof.WriteTo(&proofBytes)
+	assert.Nil(t, err)
+
+	assert.Nil(t, zkverify.VerifyProof(verifyingKey, proofBytes.Bytes(), salt, verificationCode, ""))
+	assert.NotNil(t, zkverify.VerifyProof(verifyingKey, proofBytes.Bytes(), salt, "724b2d", ""))
+	// the key does not prove the domain
+	assert.NotNil(t, zkverify.VerifyProof(verifyingKey, proofBytes.Bytes(), salt, verificationCode, domainCommitment(t)))
+}
+
+func TestVerifyProof_InvalidVerificationCode(t *testing.T) {
+	_, verifyingKeyBytes := generateProof(t)
+
+	verifyingKey, err := zkverify.ReadVerifyingKey(verifyingKeyBytes)
+	assert.Nil(t, err)
+
+	err = zkverify.VerifyProof(verifyingKey, []byte{}, salt, "not a code", "")
+
+	assert.NotNil(t, err)
+}
+
+func TestReadVerifyingKey_InvalidBytes(t *testing.T) {
+	_, err := zkverify.ReadVerifyingKey([]byte("not a key"))
+
+	assert.NotNil(t, err)
+}
+
+func TestFetchVerifyingKeys(t *testing.T) {
+	proof, verifyingKeyBytes := generateProof(t)
+	retiredAt := time.Now()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, zkverify.VerifyingKeysPath, r.URL.Path)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"is_success": true,
+			"data": []zkverify.VerifyingKey{
+				{ID: zkKeyPairId - 1, Curve: zkverify.Curve, Circuit: zkverify.CircuitVerificationCode, VerifyingKey: []byte("retired"), RetiredAt: &retiredAt},
+				{ID: zkKeyPairId, Curve: zkverify.Curve, Circuit: zkverify.CircuitVerificationCode, VerifyingKey: verifyingKeyBytes},
+				{ID: zkKeyPairId + 1, Curve: zkverify.Curve, Circuit: zkverify.CircuitEmailDomain, VerifyingKey: []byte("email domain")},
+			},
+		})
+	}))
+	defer server.Close()
+
+	keys, err := zkverify.FetchVerifyingKeys(context.Background(), server.Client(), server.URL, zkverify.CircuitVerificationCode)
+
+	assert.Nil(t, err)
+	assert.Len(t, keys, 1)
+	assert.Nil(t, zkverify.VerifyProof(keys[zkKeyPairId], proof, salt, verificationCode, domainCommitment(t)))
+}
+
+func TestFetchVerifyingKeys_UnknownCircuit(t *testing.T) {
+	_, err := zkverify.FetchVerifyingKeys(context.Background(), http.DefaultClient, "http://localhost", "")
+
+	assert.NotNil(t, err)
+}
+
+func TestFetchVerifyingKeys_UnexpectedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	_, err := zkverify.FetchVerifyingKeys(context.Background(), server.Client(), server.URL, zkverify.CircuitEmailDomain)
+
+	assert.NotNil(t, err)
+}
@@ -26,6 +26,8 @@ describe('Register Client Page', () => {
     cy.get('input[id="username"]').type(username)
     cy.get('input[id="password"]').type(password)
     cy.get('button').click()
+    cy.get('input[id="client_secret"]').invoke('val').should('not.be.empty')
+    cy.contains('Continue to login').click()
     cy.url().should('include', 'http://localhost:5001/client-login-page')
   })
 
@@ -70,7 +72,11 @@ describe('Login Page', () => {
     });
     
     cy.contains('.font-bold', 'Secret:').should('exist');
-    cy.get('input[placeholder="Secret"]').should('exist').should(($input) => {
+    cy.get('input[placeholder="Secret"]').should('exist').should('have.value', '');
+
+    cy.on('window:confirm', () => true);
+    cy.get('button[value="RotateSecret"]').click();
+    cy.get('input[placeholder="Secret"]').should(($input) => {
       expect($input.val()).not.to.be.empty;
     });
   })
@@ -103,15 +109,12 @@ describe('Login Page', () => {
     cy.get('button').click();
     cy.url().should('include', 'http://localhost:5001/client-profile');
     cy.wait(15000);
-    const secret = 'b333a024c425f1b250e9cd8084093220edbddc7f727ab31797232e48a3d57a59';
-    
     cy.window().then((window) => {
       window.document.execCommand = cy.stub().returns(true);
-      window.user = {
-        id: secret
-      };
     });
-  
+
+    cy.on('window:confirm', () => true);
+    cy.get('button[value="RotateSecret"]').click();
     cy.get('button[value="Secret"]').click();
   
     cy.wait(5000);